@@ -6,18 +6,23 @@ import (
 	"DataArk/common"
 	"DataArk/search"
 	"embed"
+	"encoding/csv"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 	"html/template"
 	"io"
+	"log"
+	"math"
 	"net/http"
 	neturl "net/url"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var (
@@ -25,18 +30,95 @@ var (
 	repairArchiveConsistency = search.RepairArchiveConsistency
 	registerWithToken        = common.RegisterWithToken
 	loginWithToken           = common.LoginWithToken
+	loginWithTOTP            = common.LoginWithTOTP
+	refreshToken             = common.RefreshToken
+	revokeTokenClaims        = common.RevokeTokenClaims
+	revokeAllUserTokens      = common.RevokeAllUserTokens
+	listUsers                = common.GetAllUsers
+	createUserWithRole       = common.CreateUserWithRole
+	updateUserAccount        = common.UpdateUserAccount
+	deleteUserByID           = common.DeleteUser
+	resetUserPassword        = common.ResetUserPassword
+	changeUserPassword       = common.ChangeUserPassword
+	listAPITokens            = common.ListAPITokens
+	createAPIToken           = common.CreateAPIToken
+	deleteAPIToken           = common.DeleteAPIToken
+	listLoginThrottles       = common.ListLoginThrottles
+	unlockLogin              = common.UnlockLogin
+	listLoginFailures        = common.ListLoginFailures
+	listAuditEvents          = common.ListAuditEvents
+	eachAuditEvent           = common.EachAuditEvent
+	beginTOTPEnrollment      = common.BeginTOTPEnrollment
+	enableTOTP               = common.EnableTOTP
+	disableTOTP              = common.DisableTOTP
+	resetTOTP                = common.ResetTOTP
+	regenerateRecoveryCodes  = common.RegenerateRecoveryCodes
+	countRecoveryCodes       = common.CountRecoveryCodes
 	queryByKeyword           = search.QueryByKeyword
+	queryHybrid              = search.QueryHybrid
 	addDocURLTask            = search.AddDocURLTask
 	getArchiveTask           = search.GetArchiveTask
 	getArchiveStatsSnapshot  = common.GetArchiveStats
 	refreshStatsFromDisk     = common.RefreshArchiveStatsFromDisk
 	addDocFileToIndex        = search.AddDocFile
 	deleteDocByHTMLPath      = search.DeleteDocByHTMLPath
+	findRelatedDocuments     = search.FindRelatedDocuments
+	setArchiveVisibility     = search.SetArchiveVisibility
+	resolveArchiveFile       = search.ResolveArchiveFile
+	archiveAccessForUser     = common.ArchiveAccessForUser
+	resolveArchiveOwnership  = common.ResolveArchiveOwnership
+	listTeams                = common.ListTeams
+	listUserTeams            = common.ListUserTeams
+	createTeam               = common.CreateTeam
+	deleteTeam               = common.DeleteTeam
+	addTeamMember            = common.AddTeamMember
+	removeTeamMember         = common.RemoveTeamMember
 	createBackupArchive      = backup.CreateBackup
 	restoreBackupArchive     = backup.RestoreBackup
+	verifyBackupArchive      = backup.VerifyBackup
+	createBackupSnapshot     = backup.CreateSnapshot
+	listBackupSnapshots      = backup.ListSnapshots
+	restoreBackupSnapshot    = backup.RestoreSnapshot
+	getBackupSnapshot        = backup.GetSnapshot
+	writeBackupSnapshotZip   = backup.WriteSnapshotZip
+	deleteBackupSnapshot     = backup.DeleteSnapshot
+	getBackupSchedule        = backup.GetScheduleSettings
+	updateBackupSchedule     = backup.UpdateScheduleSettings
+	startBackupScheduler     = backup.StartScheduler
+	initBackupTargets        = backup.InitTargets
+	initBackupEncryption     = backup.InitEncryption
+	shipBackupSnapshot       = backup.ShipSnapshot
+	listBackupTargets        = backup.ListTargets
+	listTargetBackups        = backup.ListTargetBackups
+	restoreFromTarget        = backup.RestoreFromTarget
+	restoreSelectedArchive   = backup.RestoreSelected
+	restoreSelectedTarget    = backup.RestoreSelectedFromTarget
+	initBackupJobs           = backup.InitBackupJobs
+	startBackupJob           = backup.StartBackupJob
+	startRestoreJob          = backup.StartRestoreJob
+	listBackupJobs           = backup.ListBackupJobs
+	getBackupJob             = backup.GetBackupJob
+	cancelBackupJob          = backup.CancelBackupJob
+	deleteBackupJob          = backup.DeleteBackupJob
+	backupJobFile            = backup.BackupJobFile
+	createBackupUpload       = backup.CreateBackupUpload
+	getBackupUpload          = backup.GetBackupUpload
+	writeBackupUpload        = backup.WriteBackupUpload
+	deleteBackupUpload       = backup.DeleteBackupUpload
+	startUploadedRestoreJob  = backup.StartUploadedRestoreJob
 	initDatabase             = common.InitDB
+	initJWTKeys              = common.InitJWTKeys
+	listJWTKeys              = common.ListJWTKeys
+	rotateJWTKey             = common.RotateJWTKey
+	initOIDC                 = common.InitOIDC
+	oidcEnabled              = common.OIDCEnabled
+	oidcAuthCodeURL          = common.OIDCAuthCodeURL
+	completeOIDCLogin        = common.CompleteOIDCLogin
+	exchangeOIDCLoginCode    = common.ExchangeOIDCLoginCode
 	createSearchIndex        = search.CreateDefaultIndex
 	initArchiveQueue         = search.InitArchiveTaskQueue
+	getIndexSettings         = search.GetIndexSettings
+	updateIndexSettings      = search.UpdateIndexSettings
 	runGinRouter             = func(router *gin.Engine, addr string) error {
 		return router.Run(addr)
 	}
@@ -45,11 +127,12 @@ var (
 // AuthController 认证控制器
 type AuthController struct{}
 
-// Register 用户注册
+// Register 由管理员创建用户，未指定角色时为 viewer
 func (ac *AuthController) Register(c *gin.Context) {
 	var req struct {
 		Username string `json:"username" binding:"required,min=3,max=20"`
 		Password string `json:"password" binding:"required,min=6"`
+		Role     string `json:"role"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -62,7 +145,8 @@ func (ac *AuthController) Register(c *gin.Context) {
 	}
 
 	// 注册用户并生成Token
-	tokenResponse, err := registerWithToken(req.Username, req.Password)
+	tokenResponse, err := registerWithToken(req.Username, req.Password, req.Role)
+	recordAuditEvent(c.Request.Context(), common.AuditActionUserCreate, req.Username, "role="+req.Role, err)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"Status":  "0",
@@ -96,8 +180,11 @@ func (ac *AuthController) Login(c *gin.Context) {
 	}
 
 	// 登录并生成Token
-	tokenResponse, err := loginWithToken(req.Username, req.Password)
+	tokenResponse, err := loginWithToken(req.Username, req.Password, c.ClientIP())
 	if err != nil {
+		if respondLoginThrottled(c, err) {
+			return
+		}
 		c.JSON(http.StatusUnauthorized, gin.H{
 			"Status":  "0",
 			"Error":   err.Error(),
@@ -106,184 +193,2752 @@ func (ac *AuthController) Login(c *gin.Context) {
 		return
 	}
 
+	respondLogin(c, tokenResponse)
+}
+
+// LoginTOTP 登录第二步：提交密码登录返回的 mfaToken 和验证码（或恢复码），换取正式 Token
+func (ac *AuthController) LoginTOTP(c *gin.Context) {
+	var req struct {
+		MFAToken string `json:"mfaToken" binding:"required"`
+		Code     string `json:"code" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"Status":  "0",
+			"Message": "Invalid request data",
+			"Error":   err.Error(),
+		})
+		return
+	}
+
+	tokenResponse, err := loginWithTOTP(req.MFAToken, req.Code, c.ClientIP())
+	if err != nil {
+		if respondLoginThrottled(c, err) {
+			return
+		}
+		message := "Login failed"
+		if errors.Is(err, common.ErrInvalidCredentials) {
+			message = "Invalid two-factor authentication code"
+		} else if errors.Is(err, common.ErrMFATokenInvalid) {
+			message = "Login session expired, please sign in again"
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"Status":  "0",
+			"Error":   err.Error(),
+			"Message": message,
+		})
+		return
+	}
+
+	respondLogin(c, tokenResponse)
+}
+
+// respondLogin 返回登录结果，需要两步验证时 Data 中只有 mfa_token
+func respondLogin(c *gin.Context, tokenResponse *common.TokenResponse) {
+	message := "Login successful"
+	if tokenResponse.MFARequired {
+		message = "Two-factor authentication required"
+	}
 	c.JSON(http.StatusOK, gin.H{
 		"Status":  "1",
-		"Message": "Login successful",
+		"Message": message,
 		"Data":    tokenResponse,
 	})
 }
 
-func (ac *AuthController) AuthChecker(c *gin.Context) {
+// respondLoginThrottled 登录过于频繁时返回 429 和 Retry-After，返回是否已经写入响应
+func respondLoginThrottled(c *gin.Context, err error) bool {
+	var throttled *common.LoginThrottledError
+	if !errors.As(err, &throttled) {
+		return false
+	}
+	retryAfter := int(math.Ceil(throttled.RetryAfter.Seconds()))
+	c.Header("Retry-After", strconv.Itoa(retryAfter))
+	c.JSON(http.StatusTooManyRequests, gin.H{
+		"Status":  "0",
+		"Error":   err.Error(),
+		"Message": "Too many failed login attempts",
+		"Data": gin.H{
+			"retryAfter": retryAfter,
+			"locked":     throttled.Locked,
+		},
+	})
+	return true
+}
+
+// oidcStateCookie 把 state 绑定到发起登录的浏览器，防止把别人的登录结果注入当前会话
+const oidcStateCookie = "dataark_oidc_state"
+
+// OIDCConfig 返回是否启用了单点登录，供登录页决定是否显示 SSO 入口
+func (ac *AuthController) OIDCConfig(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{
 		"Status":  "1",
-		"Message": "Already login",
+		"Message": "",
+		"Data": gin.H{
+			"enabled": oidcEnabled(),
+		},
 	})
 }
 
-func SearchByKeyword(c *gin.Context) {
-	queryString := c.Query("q")
-	queryPage := c.Query("p")
-	pageNum := int64(0)
-	if queryPage == "" {
-		pageNum = 1
-	} else {
-		var err error
-		pageNum, err = strconv.ParseInt(queryPage, 10, 64)
-		if err != nil {
-			c.JSON(403, gin.H{
+// OIDCLogin 跳转到身份提供方的登录页
+func (ac *AuthController) OIDCLogin(c *gin.Context) {
+	authURL, state, err := oidcAuthCodeURL(c.Request.Context())
+	if err != nil {
+		status := http.StatusBadGateway
+		if errors.Is(err, common.ErrOIDCDisabled) {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, gin.H{
+			"Status":  "0",
+			"Message": "Single sign-on is unavailable",
+			"Error":   err.Error(),
+		})
+		return
+	}
+
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, state, int(10*time.Minute/time.Second), "/api/oidc", "", c.Request.TLS != nil, true)
+	c.Redirect(http.StatusFound, authURL)
+}
+
+// OIDCCallback 处理身份提供方的回调，成功后带一次性登录码跳回登录页
+func (ac *AuthController) OIDCCallback(c *gin.Context) {
+	state := c.Query("state")
+	cookieState, _ := c.Cookie(oidcStateCookie)
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, "", -1, "/api/oidc", "", c.Request.TLS != nil, true)
+
+	redirectWithError := func(message string) {
+		c.Redirect(http.StatusFound, "/#/login?ssoError="+neturl.QueryEscape(message))
+	}
+	if idpError := c.Query("error"); idpError != "" {
+		redirectWithError(idpError)
+		return
+	}
+	if state == "" || cookieState != state {
+		redirectWithError(common.ErrOIDCStateInvalid.Error())
+		return
+	}
+
+	loginCode, err := completeOIDCLogin(c.Request.Context(), state, c.Query("code"))
+	if err != nil {
+		log.Printf("oidc login failed: %v", err)
+		switch {
+		case errors.Is(err, common.ErrOIDCUserNotAllowed), errors.Is(err, common.ErrOIDCUserNotProvisioned),
+			errors.Is(err, common.ErrUserDisabled), errors.Is(err, common.ErrUsernameExists), errors.Is(err, common.ErrOIDCStateInvalid):
+			redirectWithError(err.Error())
+		default:
+			redirectWithError("single sign-on failed")
+		}
+		return
+	}
+	c.Redirect(http.StatusFound, "/#/login?ssoCode="+neturl.QueryEscape(loginCode))
+}
+
+// OIDCExchange 用回调得到的一次性登录码换取 Token
+func (ac *AuthController) OIDCExchange(c *gin.Context) {
+	var req struct {
+		Code string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"Status":  "0",
+			"Message": "Invalid request data",
+			"Error":   err.Error(),
+		})
+		return
+	}
+
+	tokenResponse, err := exchangeOIDCLoginCode(req.Code, c.ClientIP())
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"Status":  "0",
+			"Error":   err.Error(),
+			"Message": "Login failed",
+		})
+		return
+	}
+	respondLogin(c, tokenResponse)
+}
+
+// Logout 吊销当前请求使用的Token
+func (ac *AuthController) Logout(c *gin.Context) {
+	claims, _ := c.Get("claims")
+	tokenClaims, _ := claims.(*common.Claims)
+	if err := revokeTokenClaims(tokenClaims); err != nil {
+		if errors.Is(err, common.ErrTokenNotRevocable) {
+			c.JSON(http.StatusBadRequest, gin.H{
 				"Status":  "0",
-				"Message": "参数 p 格式错误",
+				"Message": "This token cannot be revoked individually, please log out all sessions",
+				"Error":   err.Error(),
 			})
 			return
 		}
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"Status":  "0",
+			"Message": "Logout failed",
+			"Error":   err.Error(),
+		})
+		return
 	}
-	if queryString == "" {
-		c.JSON(403, gin.H{
+
+	c.JSON(http.StatusOK, gin.H{
+		"Status":  "1",
+		"Message": "Logout successful",
+	})
+}
+
+// LogoutAll 注销当前用户的全部会话，包括本次请求使用的Token
+func (ac *AuthController) LogoutAll(c *gin.Context) {
+	user, ok := RequireAuth(c)
+	if !ok {
+		return
+	}
+	if err := revokeAllUserTokens(user.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
 			"Status":  "0",
-			"Message": "缺少关键参数 q",
+			"Message": "Logout failed",
+			"Error":   err.Error(),
 		})
 		return
 	}
-	queryResult, pageAndHits := queryByKeyword(queryString, pageNum)
 
-	if queryResult == "Error" {
-		c.JSON(500, gin.H{
+	c.JSON(http.StatusOK, gin.H{
+		"Status":  "1",
+		"Message": "All sessions have been logged out",
+	})
+}
+
+// RefreshToken 在Token即将过期时换发新Token，旧Token随即失效
+func (ac *AuthController) RefreshToken(c *gin.Context) {
+	tokenString, err := extractTokenFromHeader(c.GetHeader("Authorization"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{
 			"Status":  "0",
-			"Message": "查询失败",
+			"Message": "Please provide a valid token",
+			"Error":   err.Error(),
 		})
 		return
 	}
 
-	c.JSON(200, gin.H{
-		"Status":     "1",
-		"Message":    "",
-		"Result":     queryResult,
-		"TotalHits":  pageAndHits["TotalHits"],
-		"TotalPages": pageAndHits["TotalPages"],
+	tokenResponse, err := refreshToken(tokenString)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"Status":  "0",
+			"Message": "Refresh failed",
+			"Error":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"Status":  "1",
+		"Message": "Refresh successful",
+		"Data":    tokenResponse,
 	})
 }
 
-func AddDocByURL(c *gin.Context) {
-	var req struct {
-		URL string `json:"url"`
+// ListJWTKeys 列出可用于校验Token的签名密钥，不返回密钥内容
+func (ac *AuthController) ListJWTKeys(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"Status":  "1",
+		"Message": "",
+		"Data":    listJWTKeys(),
+	})
+}
+
+// RotateJWTKey 生成新的签名密钥，旧密钥签发的Token在过期前仍然有效
+func (ac *AuthController) RotateJWTKey(c *gin.Context) {
+	key, err := rotateJWTKey()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"Status":  "0",
+			"Message": "Rotate signing key failed",
+			"Error":   err.Error(),
+		})
+		return
 	}
 
-	if err := c.ShouldBindJSON(&req); err != nil {
+	c.JSON(http.StatusOK, gin.H{
+		"Status":  "1",
+		"Message": "Signing key rotated",
+		"Data":    key,
+	})
+}
+
+func (ac *AuthController) AuthChecker(c *gin.Context) {
+	user, _ := GetCurrentUser(c)
+	c.JSON(http.StatusOK, gin.H{
+		"Status":  "1",
+		"Message": "Already login",
+		"Data":    user,
+	})
+}
+
+const (
+	defaultUserPageSize = 20
+	maxUserPageSize     = 100
+)
+
+// UserController 用户管理控制器，除 ChangeMyPassword 外都只对管理员开放
+type UserController struct{}
+
+// ListUsers 分页列出用户
+func (uc *UserController) ListUsers(c *gin.Context) {
+	page, err := parsePositiveQueryInt(c, "page", 1)
+	if err != nil {
 		c.JSON(403, gin.H{
 			"Status":  "0",
-			"Message": "请求参数错误",
+			"Message": "参数 page 格式错误",
 		})
 		return
 	}
-
-	archiveURL := strings.TrimSpace(req.URL)
-	parsedURL, err := neturl.Parse(archiveURL)
-	if archiveURL == "" || err != nil || (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") || parsedURL.Hostname() == "" {
+	pageSize, err := parsePositiveQueryInt(c, "pageSize", defaultUserPageSize)
+	if err != nil || pageSize > maxUserPageSize {
 		c.JSON(403, gin.H{
 			"Status":  "0",
-			"Message": "链接格式错误",
+			"Message": "参数 pageSize 格式错误",
 		})
 		return
 	}
 
-	task, created, err := addDocURLTask(archiveURL)
+	users, total, err := listUsers(page, pageSize)
 	if err != nil {
 		c.JSON(500, gin.H{
 			"Status":  "0",
-			"Message": "创建离线任务失败",
+			"Message": "获取用户列表失败",
 			"Error":   err.Error(),
 		})
 		return
 	}
-
-	statusCode, message := buildArchiveTaskResponse(task, created)
-	c.JSON(statusCode, gin.H{
+	c.JSON(200, gin.H{
 		"Status":  "1",
-		"Message": message,
-		"Data":    task,
+		"Message": "",
+		"Data": gin.H{
+			"users": users,
+			"total": total,
+		},
 	})
 }
 
-func GetArchiveTaskStatus(c *gin.Context) {
-	taskID := c.Param("taskId")
-	if strings.TrimSpace(taskID) == "" {
+// CreateUser 创建用户，未指定角色时为 viewer
+func (uc *UserController) CreateUser(c *gin.Context) {
+	var req struct {
+		Username string `json:"username" binding:"required,min=3,max=20"`
+		Password string `json:"password" binding:"required,min=6"`
+		Role     string `json:"role"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(403, gin.H{
 			"Status":  "0",
-			"Message": "缺少任务编号",
+			"Message": "请求参数错误",
+			"Error":   err.Error(),
+		})
+		return
+	}
+	if _, err := common.NormalizeRole(req.Role); err != nil {
+		c.JSON(403, gin.H{
+			"Status":  "0",
+			"Message": "角色参数错误",
+			"Error":   err.Error(),
 		})
 		return
 	}
 
-	task, err := getArchiveTask(taskID)
-	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			c.JSON(404, gin.H{
+	user, err := createUserWithRole(req.Username, req.Password, req.Role)
+	recordAuditEvent(c.Request.Context(), common.AuditActionUserCreate, req.Username, "role="+req.Role, err)
+	if err != nil || user == nil {
+		if err == nil || errors.Is(err, common.ErrUsernameExists) {
+			c.JSON(409, gin.H{
 				"Status":  "0",
-				"Message": "任务不存在",
+				"Message": "用户名已存在",
 			})
 			return
 		}
-
 		c.JSON(500, gin.H{
 			"Status":  "0",
-			"Message": "查询离线任务失败",
+			"Message": "创建用户失败",
 			"Error":   err.Error(),
 		})
 		return
 	}
-
-	statusCode, message := buildArchiveTaskResponse(task, false)
-	c.JSON(statusCode, gin.H{
+	c.JSON(201, gin.H{
 		"Status":  "1",
-		"Message": message,
-		"Data":    task,
+		"Message": "用户创建成功",
+		"Data":    user,
 	})
 }
 
-// GetArchiveStats 返回已入库的归档统计快照，不触发磁盘扫描。
-func GetArchiveStats(c *gin.Context) {
-	stats, err := getArchiveStatsSnapshot()
-	if err != nil {
-		c.JSON(500, gin.H{
+// UpdateUser 修改用户角色或禁用状态
+func (uc *UserController) UpdateUser(c *gin.Context) {
+	userID, ok := parseUserIDParam(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		Role     *string `json:"role"`
+		Disabled *bool   `json:"disabled"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || (req.Role == nil && req.Disabled == nil) {
+		c.JSON(403, gin.H{
 			"Status":  "0",
-			"Message": "查询统计信息失败",
-			"Error":   err.Error(),
+			"Message": "请求参数错误",
+		})
+		return
+	}
+	if req.Role != nil {
+		if _, err := common.NormalizeRole(*req.Role); err != nil {
+			c.JSON(403, gin.H{
+				"Status":  "0",
+				"Message": "角色参数错误",
+				"Error":   err.Error(),
+			})
+			return
+		}
+	}
+	if currentUserID, _ := GetCurrentUserID(c); currentUserID == userID && req.Disabled != nil && *req.Disabled {
+		c.JSON(403, gin.H{
+			"Status":  "0",
+			"Message": "不能禁用当前登录用户",
 		})
 		return
 	}
 
+	user, err := updateUserAccount(userID, req.Role, req.Disabled)
+	auditUserChange(c, common.AuditActionUserUpdate, userID, describeAccountUpdate(req.Role, req.Disabled), err)
+	if err != nil {
+		respondUserError(c, err, "修改用户失败")
+		return
+	}
 	c.JSON(200, gin.H{
 		"Status":  "1",
-		"Message": "查询统计信息成功",
-		"Data":    stats,
+		"Message": "用户修改成功",
+		"Data":    user,
 	})
 }
 
-// RefreshArchiveStats 扫描归档目录并用扫描结果重建统计表。
-func RefreshArchiveStats(c *gin.Context) {
-	stats, err := refreshStatsFromDisk()
-	if err != nil {
-		c.JSON(500, gin.H{
+// DeleteUser 删除用户
+func (uc *UserController) DeleteUser(c *gin.Context) {
+	userID, ok := parseUserIDParam(c)
+	if !ok {
+		return
+	}
+	if currentUserID, _ := GetCurrentUserID(c); currentUserID == userID {
+		c.JSON(403, gin.H{
 			"Status":  "0",
-			"Message": "刷新统计信息失败",
-			"Error":   err.Error(),
+			"Message": "不能删除当前登录用户",
 		})
 		return
 	}
 
+	err := deleteUserByID(userID)
+	auditUserChange(c, common.AuditActionUserDelete, userID, "", err)
+	if err != nil {
+		respondUserError(c, err, "删除用户失败")
+		return
+	}
 	c.JSON(200, gin.H{
 		"Status":  "1",
-		"Message": "刷新统计信息成功",
+		"Message": "用户删除成功",
+	})
+}
+
+// ResetPassword 由管理员重置用户密码
+func (uc *UserController) ResetPassword(c *gin.Context) {
+	userID, ok := parseUserIDParam(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		Password string `json:"password" binding:"required,min=6"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(403, gin.H{
+			"Status":  "0",
+			"Message": "请求参数错误",
+			"Error":   err.Error(),
+		})
+		return
+	}
+
+	err := resetUserPassword(userID, req.Password)
+	auditUserChange(c, common.AuditActionUserPasswordReset, userID, "", err)
+	if err != nil {
+		respondUserError(c, err, "重置密码失败")
+		return
+	}
+	c.JSON(200, gin.H{
+		"Status":  "1",
+		"Message": "密码重置成功",
+	})
+}
+
+// ChangeMyPassword 当前登录用户修改自己的密码，需要提供当前密码
+func (uc *UserController) ChangeMyPassword(c *gin.Context) {
+	user, ok := RequireAuth(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		CurrentPassword string `json:"currentPassword" binding:"required"`
+		NewPassword     string `json:"newPassword" binding:"required,min=6"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(403, gin.H{
+			"Status":  "0",
+			"Message": "请求参数错误",
+			"Error":   err.Error(),
+		})
+		return
+	}
+
+	// 修改密码会注销全部会话，为当前会话换发新 Token 时保留其两步验证状态
+	claims, _ := c.Get("claims")
+	tokenClaims, _ := claims.(*common.Claims)
+	tokenResponse, err := changeUserPassword(user.ID, req.CurrentPassword, req.NewPassword, tokenClaims != nil && tokenClaims.MFA)
+	auditUserChange(c, common.AuditActionPasswordChange, user.ID, "", err)
+	if err != nil {
+		if errors.Is(err, common.ErrInvalidCredentials) {
+			c.JSON(403, gin.H{
+				"Status":  "0",
+				"Message": "当前密码错误",
+			})
+			return
+		}
+		respondUserError(c, err, "修改密码失败")
+		return
+	}
+	c.JSON(200, gin.H{
+		"Status":  "1",
+		"Message": "密码修改成功",
+		"Data":    tokenResponse,
+	})
+}
+
+// LogoutUser 注销指定用户的全部会话，用于处理泄露的Token
+func (uc *UserController) LogoutUser(c *gin.Context) {
+	userID, ok := parseUserIDParam(c)
+	if !ok {
+		return
+	}
+
+	err := revokeAllUserTokens(userID)
+	auditUserChange(c, common.AuditActionUserLogout, userID, "", err)
+	if err != nil {
+		respondUserError(c, err, "注销会话失败")
+		return
+	}
+	c.JSON(200, gin.H{
+		"Status":  "1",
+		"Message": "用户的全部会话已注销",
+	})
+}
+
+// GetMyTOTPStatus 返回当前用户是否启用了两步验证以及剩余恢复码数量
+func (uc *UserController) GetMyTOTPStatus(c *gin.Context) {
+	user, ok := RequireAuth(c)
+	if !ok {
+		return
+	}
+	remaining := int64(0)
+	if user.TOTPEnabled {
+		count, err := countRecoveryCodes(user.ID)
+		if err != nil {
+			c.JSON(500, gin.H{
+				"Status":  "0",
+				"Message": "获取两步验证状态失败",
+				"Error":   err.Error(),
+			})
+			return
+		}
+		remaining = count
+	}
+	c.JSON(200, gin.H{
+		"Status":  "1",
+		"Message": "",
+		"Data": gin.H{
+			"enabled":       user.TOTPEnabled,
+			"recoveryCodes": remaining,
+		},
+	})
+}
+
+// SetupMyTOTP 生成新的 TOTP 密钥和 otpauth:// 地址，供验证器应用扫码绑定
+func (uc *UserController) SetupMyTOTP(c *gin.Context) {
+	user, ok := RequireAuth(c)
+	if !ok {
+		return
+	}
+
+	setup, err := beginTOTPEnrollment(user.ID)
+	if err != nil {
+		respondTOTPError(c, err, "生成两步验证密钥失败")
+		return
+	}
+	c.JSON(200, gin.H{
+		"Status":  "1",
+		"Message": "请使用验证器应用扫描二维码，并输入验证码完成绑定",
+		"Data":    setup,
+	})
+}
+
+// EnableMyTOTP 校验验证器生成的验证码并启用两步验证，恢复码只在本次响应中返回
+func (uc *UserController) EnableMyTOTP(c *gin.Context) {
+	user, ok := RequireAuth(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		Code string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(403, gin.H{
+			"Status":  "0",
+			"Message": "请求参数错误",
+			"Error":   err.Error(),
+		})
+		return
+	}
+
+	codes, err := enableTOTP(user.ID, req.Code)
+	if err != nil {
+		respondTOTPError(c, err, "启用两步验证失败")
+		return
+	}
+	c.JSON(200, gin.H{
+		"Status":  "1",
+		"Message": "两步验证已启用，请妥善保存恢复码",
+		"Data": gin.H{
+			"recoveryCodes": codes,
+		},
+	})
+}
+
+// DisableMyTOTP 关闭两步验证，需要当前密码和验证码（或恢复码）
+func (uc *UserController) DisableMyTOTP(c *gin.Context) {
+	user, ok := RequireAuth(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		Password string `json:"password" binding:"required"`
+		Code     string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(403, gin.H{
+			"Status":  "0",
+			"Message": "请求参数错误",
+			"Error":   err.Error(),
+		})
+		return
+	}
+
+	if err := disableTOTP(user.ID, req.Password, req.Code); err != nil {
+		if errors.Is(err, common.ErrInvalidCredentials) {
+			c.JSON(403, gin.H{
+				"Status":  "0",
+				"Message": "当前密码错误",
+			})
+			return
+		}
+		respondTOTPError(c, err, "关闭两步验证失败")
+		return
+	}
+	c.JSON(200, gin.H{
+		"Status":  "1",
+		"Message": "两步验证已关闭",
+	})
+}
+
+// RegenerateMyRecoveryCodes 作废旧的恢复码并生成新的一组
+func (uc *UserController) RegenerateMyRecoveryCodes(c *gin.Context) {
+	user, ok := RequireAuth(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		Code string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(403, gin.H{
+			"Status":  "0",
+			"Message": "请求参数错误",
+			"Error":   err.Error(),
+		})
+		return
+	}
+
+	codes, err := regenerateRecoveryCodes(user.ID, req.Code)
+	if err != nil {
+		respondTOTPError(c, err, "生成恢复码失败")
+		return
+	}
+	c.JSON(200, gin.H{
+		"Status":  "1",
+		"Message": "恢复码已重新生成，旧的恢复码已失效",
+		"Data": gin.H{
+			"recoveryCodes": codes,
+		},
+	})
+}
+
+// ResetUserTOTP 管理员清除指定用户的两步验证，并注销其全部会话，用于用户丢失验证器的情况
+func (uc *UserController) ResetUserTOTP(c *gin.Context) {
+	userID, ok := parseUserIDParam(c)
+	if !ok {
+		return
+	}
+
+	err := resetTOTP(userID)
+	auditUserChange(c, common.AuditActionUserTOTPReset, userID, "", err)
+	if err != nil {
+		respondUserError(c, err, "重置两步验证失败")
+		return
+	}
+	if err := revokeAllUserTokens(userID); err != nil {
+		respondUserError(c, err, "注销会话失败")
+		return
+	}
+	c.JSON(200, gin.H{
+		"Status":  "1",
+		"Message": "用户的两步验证已重置",
+	})
+}
+
+// respondTOTPError 把两步验证相关的错误转换为对应的状态码
+func respondTOTPError(c *gin.Context, err error, message string) {
+	switch {
+	case errors.Is(err, common.ErrInvalidTOTPCode):
+		c.JSON(403, gin.H{
+			"Status":  "0",
+			"Message": "验证码错误",
+		})
+	case errors.Is(err, common.ErrTOTPAlreadyEnabled):
+		c.JSON(409, gin.H{
+			"Status":  "0",
+			"Message": "两步验证已启用",
+		})
+	case errors.Is(err, common.ErrTOTPNotEnabled), errors.Is(err, common.ErrTOTPNotEnrolled):
+		c.JSON(409, gin.H{
+			"Status":  "0",
+			"Message": "尚未启用两步验证",
+		})
+	default:
+		respondUserError(c, err, message)
+	}
+}
+
+// 审计记录导出格式
+const (
+	auditExportCSV  = "csv"
+	auditExportJSON = "json"
+)
+
+// ListAuditEvents 管理员按操作者、动作、结果、目标和时间范围查询审计记录；
+// format=csv 或 format=json 时以附件形式导出全部符合条件的记录。
+func ListAuditEvents(c *gin.Context) {
+	filter, ok := parseAuditFilter(c)
+	if !ok {
+		return
+	}
+
+	switch format := c.Query("format"); format {
+	case "":
+	case auditExportCSV, auditExportJSON:
+		exportAuditEvents(c, filter, format)
+		return
+	default:
+		c.JSON(403, gin.H{
+			"Status":  "0",
+			"Message": "参数 format 只能是 csv 或 json",
+		})
+		return
+	}
+
+	page, err := parsePositiveQueryInt(c, "page", 1)
+	if err != nil {
+		c.JSON(403, gin.H{
+			"Status":  "0",
+			"Message": "参数 page 格式错误",
+		})
+		return
+	}
+	pageSize, err := parsePositiveQueryInt(c, "pageSize", defaultUserPageSize)
+	if err != nil || pageSize > maxUserPageSize {
+		c.JSON(403, gin.H{
+			"Status":  "0",
+			"Message": "参数 pageSize 格式错误",
+		})
+		return
+	}
+
+	events, total, err := listAuditEvents(filter, page, pageSize)
+	if err != nil {
+		c.JSON(500, gin.H{
+			"Status":  "0",
+			"Message": "获取审计记录失败",
+			"Error":   err.Error(),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"Status":  "1",
+		"Message": "",
+		"Data": gin.H{
+			"events": events,
+			"total":  total,
+		},
+	})
+}
+
+func parseAuditFilter(c *gin.Context) (common.AuditFilter, bool) {
+	filter := common.AuditFilter{
+		Actor:   strings.TrimSpace(c.Query("actor")),
+		Action:  strings.TrimSpace(c.Query("action")),
+		Outcome: strings.TrimSpace(c.Query("outcome")),
+		Target:  strings.TrimSpace(c.Query("target")),
+	}
+	if filter.Outcome != "" && filter.Outcome != common.AuditOutcomeSuccess && filter.Outcome != common.AuditOutcomeFailure {
+		c.JSON(403, gin.H{
+			"Status":  "0",
+			"Message": "参数 outcome 只能是 success 或 failure",
+		})
+		return filter, false
+	}
+	for _, bound := range []struct {
+		name  string
+		value **time.Time
+	}{{"since", &filter.Since}, {"until", &filter.Until}} {
+		raw := strings.TrimSpace(c.Query(bound.name))
+		if raw == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			c.JSON(403, gin.H{
+				"Status":  "0",
+				"Message": "参数 " + bound.name + " 格式错误，应为 RFC 3339 时间",
+			})
+			return filter, false
+		}
+		*bound.value = &parsed
+	}
+	return filter, true
+}
+
+// exportAuditEvents 分批读取并直接写入响应，导出本身也会记录一条审计。
+func exportAuditEvents(c *gin.Context, filter common.AuditFilter, format string) {
+	fileName := "audit-" + time.Now().Format("20060102-150405") + "." + format
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fileName))
+	c.Header("Cache-Control", "no-store")
+
+	var err error
+	count := 0
+	if format == auditExportCSV {
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		c.Status(http.StatusOK)
+		writer := csv.NewWriter(c.Writer)
+		_ = writer.Write([]string{"id", "createdAt", "actorId", "actor", "action", "target", "ip", "outcome", "detail"})
+		err = eachAuditEvent(filter, func(event common.AuditEvent) error {
+			count++
+			return writer.Write([]string{
+				strconv.FormatUint(uint64(event.ID), 10),
+				event.CreatedAt.UTC().Format(time.RFC3339),
+				strconv.FormatUint(uint64(event.ActorID), 10),
+				csvSafeCell(event.Actor),
+				csvSafeCell(event.Action),
+				csvSafeCell(event.Target),
+				csvSafeCell(event.IP),
+				event.Outcome,
+				csvSafeCell(event.Detail),
+			})
+		})
+		writer.Flush()
+		if err == nil {
+			err = writer.Error()
+		}
+	} else {
+		c.Header("Content-Type", "application/json; charset=utf-8")
+		c.Status(http.StatusOK)
+		encoder := json.NewEncoder(c.Writer)
+		_, _ = io.WriteString(c.Writer, "[")
+		err = eachAuditEvent(filter, func(event common.AuditEvent) error {
+			if count > 0 {
+				if _, err := io.WriteString(c.Writer, ","); err != nil {
+					return err
+				}
+			}
+			count++
+			return encoder.Encode(event)
+		})
+		_, _ = io.WriteString(c.Writer, "]")
+	}
+	if err != nil {
+		// 响应头已经发出，只能记录日志
+		log.Printf("failed to export audit events: %v", err)
+	}
+	recordAuditEvent(c.Request.Context(), common.AuditActionAuditExport, format, fmt.Sprintf("exported %d events", count), err)
+}
+
+// csvSafeCell 避免导出的 CSV 在表格软件中被当成公式执行
+func csvSafeCell(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+// API Token 的最长有效期，0 表示永不过期
+const maxAPITokenLifetimeDays = 3650
+
+// APITokenController 当前用户管理自己的 API Token，只能通过登录会话访问
+type APITokenController struct{}
+
+// ListAPITokens 列出当前用户的 API Token，不包含 Token 明文
+func (tc *APITokenController) ListAPITokens(c *gin.Context) {
+	user, ok := RequireAuth(c)
+	if !ok {
+		return
+	}
+
+	tokens, err := listAPITokens(user.ID)
+	if err != nil {
+		c.JSON(500, gin.H{
+			"Status":  "0",
+			"Message": "获取 API Token 列表失败",
+			"Error":   err.Error(),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"Status":  "1",
+		"Message": "",
+		"Data":    tokens,
+	})
+}
+
+// CreateAPIToken 创建 API Token，明文只在本次响应中返回。申请 backup scope 时需要提交两步验证码 code
+func (tc *APITokenController) CreateAPIToken(c *gin.Context) {
+	user, ok := RequireAuth(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		Name          string   `json:"name" binding:"required,max=64"`
+		Scopes        []string `json:"scopes" binding:"required"`
+		ExpiresInDays int      `json:"expiresInDays"`
+		Code          string   `json:"code"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(403, gin.H{
+			"Status":  "0",
+			"Message": "请求参数错误",
+			"Error":   err.Error(),
+		})
+		return
+	}
+	if req.ExpiresInDays < 0 || req.ExpiresInDays > maxAPITokenLifetimeDays {
+		c.JSON(403, gin.H{
+			"Status":  "0",
+			"Message": "参数 expiresInDays 格式错误",
+		})
+		return
+	}
+	if _, err := common.NormalizeAPITokenScopes(req.Scopes); err != nil {
+		c.JSON(403, gin.H{
+			"Status":  "0",
+			"Message": "参数 scopes 格式错误",
+			"Error":   err.Error(),
+		})
+		return
+	}
+
+	var expiresAt *time.Time
+	if req.ExpiresInDays > 0 {
+		expiry := time.Now().AddDate(0, 0, req.ExpiresInDays)
+		expiresAt = &expiry
+	}
+	apiToken, plainToken, err := createAPIToken(user.ID, req.Name, req.Scopes, expiresAt, req.Code)
+	if err != nil {
+		if errors.Is(err, common.ErrAPITokenScopeNotAllowed) {
+			c.JSON(403, gin.H{
+				"Status":  "0",
+				"Message": "当前角色不能申请该权限范围",
+				"Error":   err.Error(),
+			})
+			return
+		}
+		if errors.Is(err, common.ErrInvalidTOTPCode) || errors.Is(err, common.ErrTOTPNotEnabled) {
+			respondTOTPError(c, err, "创建 API Token 失败")
+			return
+		}
+		c.JSON(500, gin.H{
+			"Status":  "0",
+			"Message": "创建 API Token 失败",
+			"Error":   err.Error(),
+		})
+		return
+	}
+	c.JSON(201, gin.H{
+		"Status":  "1",
+		"Message": "API Token 创建成功，请立即保存，之后无法再次查看",
+		"Data": gin.H{
+			"token":    plainToken,
+			"apiToken": apiToken,
+		},
+	})
+}
+
+// DeleteAPIToken 删除当前用户的 API Token
+func (tc *APITokenController) DeleteAPIToken(c *gin.Context) {
+	user, ok := RequireAuth(c)
+	if !ok {
+		return
+	}
+	tokenID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil || tokenID == 0 {
+		c.JSON(403, gin.H{
+			"Status":  "0",
+			"Message": "API Token ID 格式错误",
+		})
+		return
+	}
+
+	if err := deleteAPIToken(user.ID, uint(tokenID)); err != nil {
+		if errors.Is(err, common.ErrAPITokenNotFound) {
+			c.JSON(404, gin.H{
+				"Status":  "0",
+				"Message": "API Token 不存在",
+			})
+			return
+		}
+		c.JSON(500, gin.H{
+			"Status":  "0",
+			"Message": "删除 API Token 失败",
+			"Error":   err.Error(),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"Status":  "1",
+		"Message": "API Token 已删除",
+	})
+}
+
+// TeamController 团队管理控制器，除 ListMyTeams 外都只对管理员开放
+type TeamController struct{}
+
+// ListTeams 列出全部团队及其成员
+func (tc *TeamController) ListTeams(c *gin.Context) {
+	teams, err := listTeams()
+	if err != nil {
+		c.JSON(500, gin.H{
+			"Status":  "0",
+			"Message": "获取团队列表失败",
+			"Error":   err.Error(),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"Status":  "1",
+		"Message": "",
+		"Data":    teams,
+	})
+}
+
+// ListMyTeams 列出当前用户所属的团队，供归档时选择团队
+func (tc *TeamController) ListMyTeams(c *gin.Context) {
+	user, ok := RequireAuth(c)
+	if !ok {
+		return
+	}
+	teams, err := listUserTeams(user.ID)
+	if err != nil {
+		c.JSON(500, gin.H{
+			"Status":  "0",
+			"Message": "获取团队列表失败",
+			"Error":   err.Error(),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"Status":  "1",
+		"Message": "",
+		"Data":    teams,
+	})
+}
+
+// CreateTeam 创建团队
+func (tc *TeamController) CreateTeam(c *gin.Context) {
+	var req struct {
+		Name string `json:"name" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(403, gin.H{
+			"Status":  "0",
+			"Message": "请求参数错误",
+			"Error":   err.Error(),
+		})
+		return
+	}
+
+	team, err := createTeam(req.Name)
+	if err != nil {
+		respondTeamError(c, err, "创建团队失败")
+		return
+	}
+	c.JSON(201, gin.H{
+		"Status":  "1",
+		"Message": "团队创建成功",
+		"Data":    team,
+	})
+}
+
+// DeleteTeam 删除团队，团队归档此后只有归档者和管理员可见
+func (tc *TeamController) DeleteTeam(c *gin.Context) {
+	teamID, ok := parseTeamIDParam(c)
+	if !ok {
+		return
+	}
+	if err := deleteTeam(teamID); err != nil {
+		respondTeamError(c, err, "删除团队失败")
+		return
+	}
+	c.JSON(200, gin.H{
+		"Status":  "1",
+		"Message": "团队删除成功",
+	})
+}
+
+// AddTeamMember 把用户加入团队
+func (tc *TeamController) AddTeamMember(c *gin.Context) {
+	teamID, ok := parseTeamIDParam(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		UserID uint `json:"userId" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(403, gin.H{
+			"Status":  "0",
+			"Message": "请求参数错误",
+			"Error":   err.Error(),
+		})
+		return
+	}
+
+	if err := addTeamMember(teamID, req.UserID); err != nil {
+		respondTeamError(c, err, "添加团队成员失败")
+		return
+	}
+	c.JSON(200, gin.H{
+		"Status":  "1",
+		"Message": "团队成员已添加",
+	})
+}
+
+// RemoveTeamMember 把用户移出团队
+func (tc *TeamController) RemoveTeamMember(c *gin.Context) {
+	teamID, ok := parseTeamIDParam(c)
+	if !ok {
+		return
+	}
+	userID, err := strconv.ParseUint(c.Param("userId"), 10, 64)
+	if err != nil || userID == 0 {
+		c.JSON(403, gin.H{
+			"Status":  "0",
+			"Message": "用户 ID 格式错误",
+		})
+		return
+	}
+
+	if err := removeTeamMember(teamID, uint(userID)); err != nil {
+		respondTeamError(c, err, "移除团队成员失败")
+		return
+	}
+	c.JSON(200, gin.H{
+		"Status":  "1",
+		"Message": "团队成员已移除",
+	})
+}
+
+func parseTeamIDParam(c *gin.Context) (uint, bool) {
+	teamID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil || teamID == 0 {
+		c.JSON(403, gin.H{
+			"Status":  "0",
+			"Message": "团队 ID 格式错误",
+		})
+		return 0, false
+	}
+	return uint(teamID), true
+}
+
+func respondTeamError(c *gin.Context, err error, message string) {
+	switch {
+	case errors.Is(err, common.ErrInvalidTeamName):
+		c.JSON(403, gin.H{
+			"Status":  "0",
+			"Message": "团队名称长度需要在 1 到 64 个字符之间",
+		})
+	case errors.Is(err, common.ErrTeamNameExists):
+		c.JSON(409, gin.H{
+			"Status":  "0",
+			"Message": "团队名称已存在",
+		})
+	case errors.Is(err, common.ErrTeamMemberExists):
+		c.JSON(409, gin.H{
+			"Status":  "0",
+			"Message": "用户已经是团队成员",
+		})
+	case errors.Is(err, common.ErrTeamNotFound):
+		c.JSON(404, gin.H{
+			"Status":  "0",
+			"Message": "团队不存在",
+		})
+	case errors.Is(err, common.ErrTeamMemberNotFound):
+		c.JSON(404, gin.H{
+			"Status":  "0",
+			"Message": "用户不是团队成员",
+		})
+	case errors.Is(err, common.ErrUserNotFound):
+		c.JSON(404, gin.H{
+			"Status":  "0",
+			"Message": "用户不存在",
+		})
+	default:
+		c.JSON(500, gin.H{
+			"Status":  "0",
+			"Message": message,
+			"Error":   err.Error(),
+		})
+	}
+}
+
+// ListLoginLocks 列出当前因连续登录失败被延迟或锁定的用户名和 IP
+func (uc *UserController) ListLoginLocks(c *gin.Context) {
+	throttles, err := listLoginThrottles()
+	if err != nil {
+		c.JSON(500, gin.H{
+			"Status":  "0",
+			"Message": "获取登录锁定列表失败",
+			"Error":   err.Error(),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"Status":  "1",
+		"Message": "",
+		"Data":    throttles,
+	})
+}
+
+// UnlockLogin 解除用户名或 IP 的登录锁定，通过 username 或 ip 参数指定
+func (uc *UserController) UnlockLogin(c *gin.Context) {
+	kind, value := common.LoginThrottleUser, c.Query("username")
+	if value == "" {
+		kind, value = common.LoginThrottleIP, c.Query("ip")
+	}
+	if value == "" {
+		c.JSON(403, gin.H{
+			"Status":  "0",
+			"Message": "需要提供 username 或 ip 参数",
+		})
+		return
+	}
+
+	unlocked, err := unlockLogin(kind, value)
+	if err != nil {
+		c.JSON(500, gin.H{
+			"Status":  "0",
+			"Message": "解除登录锁定失败",
+			"Error":   err.Error(),
+		})
+		return
+	}
+	if !unlocked {
+		c.JSON(404, gin.H{
+			"Status":  "0",
+			"Message": "没有对应的登录失败记录",
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"Status":  "1",
+		"Message": "登录锁定已解除",
+	})
+}
+
+// ListLoginFailures 分页列出失败登录记录，可按 username 过滤
+func (uc *UserController) ListLoginFailures(c *gin.Context) {
+	page, err := parsePositiveQueryInt(c, "page", 1)
+	if err != nil {
+		c.JSON(403, gin.H{
+			"Status":  "0",
+			"Message": "参数 page 格式错误",
+		})
+		return
+	}
+	pageSize, err := parsePositiveQueryInt(c, "pageSize", defaultUserPageSize)
+	if err != nil || pageSize > maxUserPageSize {
+		c.JSON(403, gin.H{
+			"Status":  "0",
+			"Message": "参数 pageSize 格式错误",
+		})
+		return
+	}
+
+	failures, total, err := listLoginFailures(page, pageSize, c.Query("username"))
+	if err != nil {
+		c.JSON(500, gin.H{
+			"Status":  "0",
+			"Message": "获取失败登录记录失败",
+			"Error":   err.Error(),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"Status":  "1",
+		"Message": "",
+		"Data": gin.H{
+			"failures": failures,
+			"total":    total,
+		},
+	})
+}
+
+func parseUserIDParam(c *gin.Context) (uint, bool) {
+	userID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil || userID == 0 {
+		c.JSON(403, gin.H{
+			"Status":  "0",
+			"Message": "用户 ID 格式错误",
+		})
+		return 0, false
+	}
+	return uint(userID), true
+}
+
+func parsePositiveQueryInt(c *gin.Context, key string, defaultValue int) (int, error) {
+	rawValue := c.Query(key)
+	if rawValue == "" {
+		return defaultValue, nil
+	}
+	value, err := strconv.Atoi(rawValue)
+	if err != nil {
+		return 0, err
+	}
+	if value <= 0 {
+		return 0, fmt.Errorf("%s must be positive", key)
+	}
+	return value, nil
+}
+
+// auditUserChange 记录对用户账号的修改，目标为 user:<id>
+func auditUserChange(c *gin.Context, action string, userID uint, detail string, err error) {
+	recordAuditEvent(c.Request.Context(), action, "user:"+strconv.FormatUint(uint64(userID), 10), detail, err)
+}
+
+func describeAccountUpdate(role *string, disabled *bool) string {
+	parts := make([]string, 0, 2)
+	if role != nil {
+		parts = append(parts, "role="+*role)
+	}
+	if disabled != nil {
+		parts = append(parts, "disabled="+strconv.FormatBool(*disabled))
+	}
+	return strings.Join(parts, " ")
+}
+
+func respondUserError(c *gin.Context, err error, message string) {
+	switch {
+	case errors.Is(err, common.ErrUserNotFound):
+		c.JSON(404, gin.H{
+			"Status":  "0",
+			"Message": "用户不存在",
+		})
+	case errors.Is(err, common.ErrLastAdmin):
+		c.JSON(409, gin.H{
+			"Status":  "0",
+			"Message": "至少需要保留一个可用的管理员",
+		})
+	default:
+		c.JSON(500, gin.H{
+			"Status":  "0",
+			"Message": message,
+			"Error":   err.Error(),
+		})
+	}
+}
+
+func SearchByKeyword(c *gin.Context) {
+	queryString := c.Query("q")
+	queryPage := c.Query("p")
+	pageNum := int64(0)
+	if queryPage == "" {
+		pageNum = 1
+	} else {
+		var err error
+		pageNum, err = strconv.ParseInt(queryPage, 10, 64)
+		if err != nil {
+			c.JSON(403, gin.H{
+				"Status":  "0",
+				"Message": "参数 p 格式错误",
+			})
+			return
+		}
+	}
+	if queryString == "" {
+		c.JSON(403, gin.H{
+			"Status":  "0",
+			"Message": "缺少关键参数 q",
+		})
+		return
+	}
+	semanticRatio := 0.0
+	if semantic := c.Query("semantic"); semantic != "" {
+		var err error
+		semanticRatio, err = strconv.ParseFloat(semantic, 64)
+		if err != nil || semanticRatio < 0 || semanticRatio > 1 {
+			c.JSON(403, gin.H{
+				"Status":  "0",
+				"Message": "参数 semantic 格式错误",
+			})
+			return
+		}
+	}
+
+	access, ok := currentArchiveAccess(c)
+	if !ok {
+		return
+	}
+
+	var queryResult string
+	var pageAndHits map[string]int
+	if semanticRatio > 0 {
+		var err error
+		queryResult, pageAndHits, err = queryHybrid(queryString, pageNum, semanticRatio, access)
+		if errors.Is(err, search.ErrSemanticSearchDisabled) {
+			c.JSON(403, gin.H{
+				"Status":  "0",
+				"Message": "语义搜索未启用",
+			})
+			return
+		}
+		if err != nil {
+			log.Println("Error Occur: " + err.Error())
+			queryResult = "Error"
+		}
+	} else {
+		queryResult, pageAndHits = queryByKeyword(queryString, pageNum, access)
+	}
+
+	if queryResult == "Error" {
+		c.JSON(500, gin.H{
+			"Status":  "0",
+			"Message": "查询失败",
+		})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"Status":     "1",
+		"Message":    "",
+		"Result":     queryResult,
+		"TotalHits":  pageAndHits["TotalHits"],
+		"TotalPages": pageAndHits["TotalPages"],
+	})
+}
+
+func AddDocByURL(c *gin.Context) {
+	var req struct {
+		URL        string `json:"url"`
+		Visibility string `json:"visibility"`
+		TeamID     uint   `json:"teamId"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(403, gin.H{
+			"Status":  "0",
+			"Message": "请求参数错误",
+		})
+		return
+	}
+
+	archiveURL := strings.TrimSpace(req.URL)
+	parsedURL, err := neturl.Parse(archiveURL)
+	if archiveURL == "" || err != nil || (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") || parsedURL.Hostname() == "" {
+		c.JSON(403, gin.H{
+			"Status":  "0",
+			"Message": "链接格式错误",
+		})
+		return
+	}
+
+	ownership, ok := resolveRequestOwnership(c, req.Visibility, req.TeamID)
+	if !ok {
+		return
+	}
+
+	task, created, err := addDocURLTask(archiveURL, ownership)
+	if err != nil {
+		c.JSON(500, gin.H{
+			"Status":  "0",
+			"Message": "创建离线任务失败",
+			"Error":   err.Error(),
+		})
+		return
+	}
+
+	statusCode, message := buildArchiveTaskResponse(task, created)
+	c.JSON(statusCode, gin.H{
+		"Status":  "1",
+		"Message": message,
+		"Data":    task,
+	})
+}
+
+func GetArchiveTaskStatus(c *gin.Context) {
+	taskID := c.Param("taskId")
+	if strings.TrimSpace(taskID) == "" {
+		c.JSON(403, gin.H{
+			"Status":  "0",
+			"Message": "缺少任务编号",
+		})
+		return
+	}
+
+	access, ok := currentArchiveAccess(c)
+	if !ok {
+		return
+	}
+
+	task, err := getArchiveTask(taskID)
+	// 其他用户的私有任务按不存在处理，避免泄露归档的 URL
+	if err == nil && !access.CanView(task.ArchiveOwnership) {
+		err = gorm.ErrRecordNotFound
+	}
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(404, gin.H{
+				"Status":  "0",
+				"Message": "任务不存在",
+			})
+			return
+		}
+
+		c.JSON(500, gin.H{
+			"Status":  "0",
+			"Message": "查询离线任务失败",
+			"Error":   err.Error(),
+		})
+		return
+	}
+
+	statusCode, message := buildArchiveTaskResponse(task, false)
+	c.JSON(statusCode, gin.H{
+		"Status":  "1",
+		"Message": message,
+		"Data":    task,
+	})
+}
+
+// GetArchiveStats 返回已入库的归档统计快照，不触发磁盘扫描。
+func GetArchiveStats(c *gin.Context) {
+	stats, err := getArchiveStatsSnapshot()
+	if err != nil {
+		c.JSON(500, gin.H{
+			"Status":  "0",
+			"Message": "查询统计信息失败",
+			"Error":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"Status":  "1",
+		"Message": "查询统计信息成功",
+		"Data":    stats,
+	})
+}
+
+// RefreshArchiveStats 扫描归档目录并用扫描结果重建统计表。
+func RefreshArchiveStats(c *gin.Context) {
+	stats, err := refreshStatsFromDisk()
+	if err != nil {
+		c.JSON(500, gin.H{
+			"Status":  "0",
+			"Message": "刷新统计信息失败",
+			"Error":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"Status":  "1",
+		"Message": "刷新统计信息成功",
 		"Data":    stats,
 	})
 }
 
-func GetArchiveConsistency(c *gin.Context) {
-	report, err := checkArchiveConsistency(c.Request.Context())
+func GetArchiveConsistency(c *gin.Context) {
+	report, err := checkArchiveConsistency(c.Request.Context())
+	if err != nil {
+		c.JSON(500, gin.H{
+			"Status":  "0",
+			"Message": "检查归档一致性失败",
+			"Error":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"Status":  "1",
+		"Message": "检查归档一致性成功",
+		"Data":    report,
+	})
+}
+
+func RepairArchiveConsistency(c *gin.Context) {
+	report, err := repairArchiveConsistency(c.Request.Context())
+	if err != nil {
+		c.JSON(500, gin.H{
+			"Status":  "0",
+			"Message": "修复归档一致性失败",
+			"Error":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"Status":  "1",
+		"Message": "修复归档一致性完成",
+		"Data":    report,
+	})
+}
+
+// GetSearchSettings 返回当前生效的搜索索引配置及其版本号。
+func GetSearchSettings(c *gin.Context) {
+	record, err := getIndexSettings()
+	if err != nil {
+		c.JSON(500, gin.H{
+			"Status":  "0",
+			"Message": "查询搜索配置失败",
+			"Error":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"Status":  "1",
+		"Message": "查询搜索配置成功",
+		"Data":    record,
+	})
+}
+
+// UpdateSearchSettings 保存搜索索引配置并立即下发，请求需携带读取时的版本号。
+func UpdateSearchSettings(c *gin.Context) {
+	var req struct {
+		Version  *int                  `json:"version"`
+		Settings *search.IndexSettings `json:"settings"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Version == nil || req.Settings == nil {
+		c.JSON(403, gin.H{
+			"Status":  "0",
+			"Message": "请求参数错误",
+		})
+		return
+	}
+
+	username, _ := GetCurrentUsername(c)
+	record, err := updateIndexSettings(c.Request.Context(), *req.Settings, *req.Version, username)
+	if err != nil {
+		switch {
+		case errors.Is(err, search.ErrInvalidIndexSettings):
+			c.JSON(403, gin.H{
+				"Status":  "0",
+				"Message": "搜索配置不合法",
+				"Error":   err.Error(),
+			})
+		case errors.Is(err, common.ErrSearchIndexSettingVersionConflict):
+			c.JSON(http.StatusConflict, gin.H{
+				"Status":  "0",
+				"Message": "搜索配置已被其他人修改，请刷新后重试",
+				"Error":   err.Error(),
+			})
+		default:
+			c.JSON(500, gin.H{
+				"Status":  "0",
+				"Message": "保存搜索配置失败",
+				"Error":   err.Error(),
+				"Data":    record,
+			})
+		}
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"Status":  "1",
+		"Message": "搜索配置已保存并生效",
+		"Data":    record,
+	})
+}
+
+func buildArchiveTaskResponse(task *common.ArchiveTask, created bool) (int, string) {
+	if created {
+		return http.StatusAccepted, "链接离线任务已加入队列"
+	}
+
+	// pending/running 都返回 202，是为了明确告诉前端这不是同步完成型接口，
+	// 调用方应该继续轮询任务状态，而不是把这次响应误判成最终结果。
+	switch task.Status {
+	case search.ArchiveTaskStatusPending, search.ArchiveTaskStatusRunning:
+		return http.StatusAccepted, "链接离线任务正在处理中"
+	case search.ArchiveTaskStatusSuccess:
+		return http.StatusOK, "链接离线任务已完成"
+	case search.ArchiveTaskStatusFailed:
+		return http.StatusOK, "链接离线任务执行失败"
+	default:
+		return http.StatusOK, "链接离线任务状态已返回"
+	}
+}
+
+func AddHTMLFile(c *gin.Context) {
+	htmlFile, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(500, gin.H{
+			"Status":  "0",
+			"Message": "上传文件失败",
+		})
+		return
+	}
+
+	tempDir := filepath.Join(common.ARCHIVEFILELOACTION, "Temporary")
+	if err := os.MkdirAll(tempDir, os.ModePerm); err != nil {
+		c.JSON(500, gin.H{
+			"Status":  "0",
+			"Message": "初始化临时目录失败",
+		})
+		return
+	}
+	// 上传到临时目录
+	filePath := filepath.Join(tempDir, htmlFile.Filename)
+
+	if err := c.SaveUploadedFile(htmlFile, filePath); err != nil {
+		c.JSON(500, gin.H{
+			"Status":  "0",
+			"Message": "上传文件失败",
+		})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"Status":  "1",
+		"Message": "文件上传成功",
+	})
+}
+
+type File struct {
+	Uid      string   `json:"uid"`
+	File     struct{} `json:"file"`
+	Name     string   `json:"name"`
+	Status   string   `json:"status"`
+	Percent  int      `json:"percent"`
+	Response struct {
+		Message string `json:"Message"`
+		Status  string `json:"Status"`
+	} `json:"response"`
+}
+
+type AddDocRequest struct {
+	Domain     string `json:"domain"`
+	Files      []File `json:"files"`
+	Visibility string `json:"visibility"`
+	TeamID     uint   `json:"teamId"`
+}
+
+func AddDocByHTMLFile(c *gin.Context) {
+	var req AddDocRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(403, gin.H{
+			"Status":  "0",
+			"Message": "请求参数错误",
+		})
+		return
+	}
+	if req.Domain == "" {
+		c.JSON(403, gin.H{
+			"Status":  "0",
+			"Message": "请求参数错误",
+		})
+		return
+	}
+	if len(req.Files) != 1 {
+		c.JSON(403, gin.H{
+			"Status":  "0",
+			"Message": "仅支持单个文件上传",
+		})
+		return
+	}
+	if req.Files[0].Name == "" {
+		c.JSON(403, gin.H{
+			"Status":  "0",
+			"Message": "请求参数错误",
+		})
+		return
+	}
+
+	ownership, ok := resolveRequestOwnership(c, req.Visibility, req.TeamID)
+	if !ok {
+		return
+	}
+	access, ok := currentArchiveAccess(c)
+	if !ok {
+		return
+	}
+
+	if err := addDocFileToIndex(req.Files[0].Name, req.Domain, ownership, access); err != nil {
+		if errors.Is(err, common.ErrArchiveAccessDenied) {
+			c.JSON(403, gin.H{
+				"Status":  "0",
+				"Message": "同名归档属于其他用户，无法覆盖",
+			})
+			return
+		}
+		c.JSON(500, gin.H{
+			"Status":  "0",
+			"Message": "上传文件失败",
+		})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"Status":  "1",
+		"Message": "文件上传成功",
+	})
+	return
+}
+
+func DeleteArchiveDocument(c *gin.Context) {
+	htmlPath := strings.TrimSpace(c.Query("path"))
+	if htmlPath == "" {
+		var req struct {
+			Path string `json:"path"`
+		}
+		if err := c.ShouldBindJSON(&req); err == nil {
+			htmlPath = strings.TrimSpace(req.Path)
+		}
+	}
+
+	if htmlPath == "" {
+		c.JSON(403, gin.H{
+			"Status":  "0",
+			"Message": "缺少关键参数 path",
+		})
+		return
+	}
+
+	access, ok := currentArchiveAccess(c)
+	if !ok {
+		return
+	}
+
+	result, err := deleteDocByHTMLPath(c.Request.Context(), htmlPath, access)
+	if err != nil {
+		switch {
+		case errors.Is(err, search.ErrInvalidArchivePath):
+			c.JSON(403, gin.H{
+				"Status":  "0",
+				"Message": "HTML 路径参数错误",
+				"Error":   err.Error(),
+			})
+		case errors.Is(err, common.ErrArchiveAccessDenied):
+			c.JSON(403, gin.H{
+				"Status":  "0",
+				"Message": "没有权限删除该文档",
+			})
+		case errors.Is(err, search.ErrArchiveDocumentNotFound), errors.Is(err, search.ErrArchiveFileNotFound):
+			c.JSON(404, gin.H{
+				"Status":  "0",
+				"Message": "文档不存在",
+				"Error":   err.Error(),
+			})
+		default:
+			c.JSON(500, gin.H{
+				"Status":  "0",
+				"Message": "删除文档失败",
+				"Error":   err.Error(),
+			})
+		}
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"Status":  "1",
+		"Message": "文档删除成功",
+		"Data":    result,
+	})
+}
+
+// GetRelatedDocuments 按归档 HTML 路径查找内容相近的其它归档
+func GetRelatedDocuments(c *gin.Context) {
+	htmlPath := strings.TrimSpace(c.Query("path"))
+	if htmlPath == "" {
+		c.JSON(403, gin.H{
+			"Status":  "0",
+			"Message": "缺少关键参数 path",
+		})
+		return
+	}
+	limit := search.DefaultRelatedLimit
+	if rawLimit := c.Query("limit"); rawLimit != "" {
+		var err error
+		limit, err = strconv.Atoi(rawLimit)
+		if err != nil || limit <= 0 || limit > search.MaxRelatedLimit {
+			c.JSON(403, gin.H{
+				"Status":  "0",
+				"Message": "参数 limit 格式错误",
+			})
+			return
+		}
+	}
+
+	access, ok := currentArchiveAccess(c)
+	if !ok {
+		return
+	}
+
+	result, err := findRelatedDocuments(c.Request.Context(), htmlPath, limit, access)
+	if err != nil {
+		switch {
+		case errors.Is(err, search.ErrInvalidArchivePath):
+			c.JSON(403, gin.H{
+				"Status":  "0",
+				"Message": "HTML 路径参数错误",
+				"Error":   err.Error(),
+			})
+		case errors.Is(err, search.ErrArchiveFileNotFound):
+			c.JSON(404, gin.H{
+				"Status":  "0",
+				"Message": "文档不存在",
+				"Error":   err.Error(),
+			})
+		default:
+			c.JSON(500, gin.H{
+				"Status":  "0",
+				"Message": "查找相关文档失败",
+				"Error":   err.Error(),
+			})
+		}
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"Status":  "1",
+		"Message": "",
+		"Data":    result,
+	})
+}
+
+// SetArchiveVisibility 修改归档的可见范围，只有归档者、所属团队成员和管理员可以修改
+func SetArchiveVisibility(c *gin.Context) {
+	var req struct {
+		Path       string `json:"path"`
+		Visibility string `json:"visibility"`
+		TeamID     uint   `json:"teamId"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || strings.TrimSpace(req.Path) == "" || strings.TrimSpace(req.Visibility) == "" {
+		c.JSON(403, gin.H{
+			"Status":  "0",
+			"Message": "请求参数错误",
+		})
+		return
+	}
+	user, ok := RequireAuth(c)
+	if !ok {
+		return
+	}
+	access, ok := currentArchiveAccess(c)
+	if !ok {
+		return
+	}
+
+	result, err := setArchiveVisibility(c.Request.Context(), strings.TrimSpace(req.Path), req.Visibility, req.TeamID, user, access)
+	if err != nil {
+		switch {
+		case errors.Is(err, search.ErrInvalidArchivePath):
+			c.JSON(403, gin.H{
+				"Status":  "0",
+				"Message": "HTML 路径参数错误",
+				"Error":   err.Error(),
+			})
+		case errors.Is(err, search.ErrArchiveFileNotFound):
+			c.JSON(404, gin.H{
+				"Status":  "0",
+				"Message": "文档不存在",
+				"Error":   err.Error(),
+			})
+		case errors.Is(err, common.ErrArchiveAccessDenied):
+			c.JSON(403, gin.H{
+				"Status":  "0",
+				"Message": "没有权限修改该文档",
+			})
+		default:
+			if !respondOwnershipError(c, err) {
+				c.JSON(500, gin.H{
+					"Status":  "0",
+					"Message": "修改可见范围失败",
+					"Error":   err.Error(),
+				})
+			}
+		}
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"Status":  "1",
+		"Message": "可见范围已修改",
+		"Data":    result,
+	})
+}
+
+// ServeArchiveFile 按可见范围提供 /archive 下的归档文件，不可见的文件与不存在的文件一样返回 404
+func ServeArchiveFile(c *gin.Context) {
+	access, ok := currentArchiveAccess(c)
+	if !ok {
+		return
+	}
+	// c.Param 已经解码过，传入原始转义路径，由 resolveArchiveFile 只解码一次
+	absPath, err := resolveArchiveFile(c.Request.URL.EscapedPath(), access)
+	if err != nil {
+		if errors.Is(err, search.ErrInvalidArchivePath) || errors.Is(err, search.ErrArchiveFileNotFound) {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	// 与原先的静态目录一样不提供目录列表
+	if fileInfo, err := os.Stat(absPath); err != nil || fileInfo.IsDir() {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	c.File(absPath)
+}
+
+// currentArchiveAccess 计算当前用户可访问的归档范围，失败时已写入响应
+func currentArchiveAccess(c *gin.Context) (common.ArchiveAccess, bool) {
+	user, ok := RequireAuth(c)
+	if !ok {
+		return common.ArchiveAccess{}, false
+	}
+	access, err := archiveAccessForUser(user)
+	if err != nil {
+		c.JSON(500, gin.H{
+			"Status":  "0",
+			"Message": "查询用户团队失败",
+			"Error":   err.Error(),
+		})
+		return common.ArchiveAccess{}, false
+	}
+	return access, true
+}
+
+// resolveRequestOwnership 按请求中的可见范围和团队计算新归档的归属，失败时已写入响应
+func resolveRequestOwnership(c *gin.Context, visibility string, teamID uint) (common.ArchiveOwnership, bool) {
+	user, ok := RequireAuth(c)
+	if !ok {
+		return common.ArchiveOwnership{}, false
+	}
+	ownership, err := resolveArchiveOwnership(user, visibility, teamID)
+	if err != nil {
+		if !respondOwnershipError(c, err) {
+			c.JSON(500, gin.H{
+				"Status":  "0",
+				"Message": "查询用户团队失败",
+				"Error":   err.Error(),
+			})
+		}
+		return common.ArchiveOwnership{}, false
+	}
+	return ownership, true
+}
+
+// respondOwnershipError 处理可见范围参数相关的错误，其它错误返回 false 由调用方处理
+func respondOwnershipError(c *gin.Context, err error) bool {
+	switch {
+	case errors.Is(err, common.ErrInvalidVisibility):
+		c.JSON(403, gin.H{
+			"Status":  "0",
+			"Message": "可见范围参数错误",
+			"Error":   err.Error(),
+		})
+	case errors.Is(err, common.ErrArchiveTeamRequired):
+		c.JSON(403, gin.H{
+			"Status":  "0",
+			"Message": "团队可见的归档需要指定团队",
+		})
+	case errors.Is(err, common.ErrTeamNotFound):
+		c.JSON(404, gin.H{
+			"Status":  "0",
+			"Message": "团队不存在",
+		})
+	case errors.Is(err, common.ErrNotTeamMember):
+		c.JSON(403, gin.H{
+			"Status":  "0",
+			"Message": "不是该团队的成员",
+		})
+	default:
+		return false
+	}
+	return true
+}
+
+func CreateBackup(c *gin.Context) {
+	preparedBackup, err := createBackupArchive(c.Request.Context())
+	if err != nil {
+		c.JSON(500, gin.H{
+			"Status":  "0",
+			"Message": "创建备份失败",
+			"Error":   err.Error(),
+		})
+		return
+	}
+	defer preparedBackup.Cleanup()
+
+	reader, writer := io.Pipe()
+	go func() {
+		err := preparedBackup.WriteZip(writer)
+		_ = writer.CloseWithError(err)
+	}()
+
+	c.DataFromReader(http.StatusOK, -1, "application/zip", reader, map[string]string{
+		"Content-Disposition": fmt.Sprintf("attachment; filename=%q", preparedBackup.FileName),
+		"Cache-Control":       "no-store",
+	})
+}
+
+// RestoreBackup 用上传的备份 zip 恢复，?dryRun=true 时只校验备份并返回恢复会带来的变化。
+// 表单中带有 domains 或 paths 时只把这些域名或文件合并回当前归档。
+func RestoreBackup(c *gin.Context) {
+	dryRun, ok := parseDryRunQuery(c)
+	if !ok {
+		return
+	}
+	zipPath, cleanup, ok := saveUploadedBackup(c, "dataark-restore-upload-*")
+	if !ok {
+		return
+	}
+	defer cleanup()
+
+	selection := backup.RestoreSelection{
+		Domains: splitFormList(c.PostFormArray("domains")),
+		Paths:   splitFormList(c.PostFormArray("paths")),
+	}
+	selective, ok := selectiveRestoreRequested(c, selection, dryRun)
+	if !ok {
+		return
+	}
+	if selective {
+		result, err := restoreSelectedArchive(c.Request.Context(), zipPath, selection)
+		respondSelectiveRestore(c, result, err)
+		return
+	}
+
+	result, err := restoreBackupArchive(c.Request.Context(), zipPath, backup.RestoreOptions{DryRun: dryRun})
+	if err != nil {
+		if !respondBackupFileError(c, err) && !respondRestoreError(c, err) {
+			c.JSON(500, gin.H{
+				"Status":  "0",
+				"Message": "恢复备份失败",
+				"Error":   err.Error(),
+			})
+		}
+		return
+	}
+
+	message := "备份恢复成功"
+	if dryRun {
+		message = "恢复预演完成，未改动任何数据"
+	}
+	c.JSON(200, gin.H{
+		"Status":  "1",
+		"Message": message,
+		"Data":    result,
+	})
+}
+
+// VerifyBackup 在临时目录中检查上传的备份 zip 能否恢复，不改动任何数据
+func VerifyBackup(c *gin.Context) {
+	zipPath, cleanup, ok := saveUploadedBackup(c, "dataark-verify-upload-*")
+	if !ok {
+		return
+	}
+	defer cleanup()
+
+	report, err := verifyBackupArchive(c.Request.Context(), zipPath)
+	if err != nil {
+		c.JSON(500, gin.H{
+			"Status":  "0",
+			"Message": "校验备份失败",
+			"Error":   err.Error(),
+		})
+		return
+	}
+
+	message := "备份校验通过"
+	if !report.Valid {
+		message = "备份校验未通过"
+	}
+	c.JSON(200, gin.H{
+		"Status":  "1",
+		"Message": message,
+		"Data":    report,
+	})
+}
+
+// saveUploadedBackup 把表单中的 file 保存到临时目录，失败时已写入响应
+func saveUploadedBackup(c *gin.Context, tempPattern string) (string, func(), bool) {
+	backupFile, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(403, gin.H{
+			"Status":  "0",
+			"Message": "缺少备份文件",
+		})
+		return "", nil, false
+	}
+	if !strings.EqualFold(filepath.Ext(backupFile.Filename), ".zip") {
+		c.JSON(403, gin.H{
+			"Status":  "0",
+			"Message": "备份文件必须是 zip 压缩包",
+		})
+		return "", nil, false
+	}
+
+	tempDir, err := os.MkdirTemp("", tempPattern)
+	if err != nil {
+		c.JSON(500, gin.H{
+			"Status":  "0",
+			"Message": "初始化恢复临时目录失败",
+			"Error":   err.Error(),
+		})
+		return "", nil, false
+	}
+	cleanup := func() { _ = os.RemoveAll(tempDir) }
+
+	// 保留上传时的文件名，审计记录中可以看到恢复的是哪个备份
+	zipPath := filepath.Join(tempDir, filepath.Base(backupFile.Filename))
+	if err := c.SaveUploadedFile(backupFile, zipPath); err != nil {
+		cleanup()
+		c.JSON(500, gin.H{
+			"Status":  "0",
+			"Message": "保存备份文件失败",
+			"Error":   err.Error(),
+		})
+		return "", nil, false
+	}
+	return zipPath, cleanup, true
+}
+
+// splitFormList 合并重复的表单字段，并按逗号拆分每个值
+func splitFormList(values []string) []string {
+	var items []string
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+	}
+	return items
+}
+
+// selectiveRestoreRequested 判断是否只恢复部分内容；部分恢复不支持预演，同时指定时写入 403 并返回 ok=false
+func selectiveRestoreRequested(c *gin.Context, selection backup.RestoreSelection, dryRun bool) (bool, bool) {
+	if len(selection.Domains) == 0 && len(selection.Paths) == 0 {
+		return false, true
+	}
+	if dryRun {
+		c.JSON(403, gin.H{
+			"Status":  "0",
+			"Message": "部分恢复不支持预演",
+		})
+		return false, false
+	}
+	return true, true
+}
+
+func respondSelectiveRestore(c *gin.Context, result *backup.SelectiveRestoreResult, err error) {
+	if err != nil {
+		switch {
+		case respondBackupFileError(c, err):
+		case errors.Is(err, backup.ErrInvalidRestoreSelection):
+			c.JSON(403, gin.H{
+				"Status":  "0",
+				"Message": "恢复范围格式错误",
+				"Error":   err.Error(),
+			})
+		case errors.Is(err, backup.ErrRestoreSelectionNotFound):
+			c.JSON(404, gin.H{
+				"Status":  "0",
+				"Message": "备份中没有选中的域名或文件",
+				"Error":   err.Error(),
+			})
+		default:
+			c.JSON(500, gin.H{
+				"Status":  "0",
+				"Message": "恢复备份失败",
+				"Error":   err.Error(),
+			})
+		}
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"Status":  "1",
+		"Message": "部分恢复成功",
+		"Data":    result,
+	})
+}
+
+func parseDryRunQuery(c *gin.Context) (bool, bool) {
+	rawValue := c.Query("dryRun")
+	if rawValue == "" {
+		return false, true
+	}
+	dryRun, err := strconv.ParseBool(rawValue)
+	if err != nil {
+		c.JSON(403, gin.H{
+			"Status":  "0",
+			"Message": "dryRun 参数格式错误",
+		})
+		return false, false
+	}
+	return dryRun, true
+}
+
+// CreateBackupSnapshot 在 -backupdir 仓库中创建增量备份，只保存自上次备份以来变化的文件
+func CreateBackupSnapshot(c *gin.Context) {
+	snapshot, err := createBackupSnapshot(c.Request.Context())
+	if err != nil {
+		if !respondSnapshotError(c, err) {
+			c.JSON(500, gin.H{
+				"Status":  "0",
+				"Message": "创建增量备份失败",
+				"Error":   err.Error(),
+			})
+		}
+		return
+	}
+
+	// 上传到备份目标失败时快照仍然保留在本机，结果中带上每个目标的错误
+	uploads, err := shipBackupSnapshot(c.Request.Context(), snapshot.ID)
+	message := "增量备份创建成功"
+	if err != nil {
+		message = "增量备份创建成功，上传到备份目标失败"
+	}
+
+	c.JSON(201, gin.H{
+		"Status":  "1",
+		"Message": message,
+		"Data": struct {
+			backup.SnapshotSummary
+			Uploads []backup.ShipResult `json:"uploads,omitempty"`
+		}{snapshot.Summary(), uploads},
+	})
+}
+
+func ListBackupSnapshots(c *gin.Context) {
+	snapshots, err := listBackupSnapshots()
+	if err != nil {
+		if !respondSnapshotError(c, err) {
+			c.JSON(500, gin.H{
+				"Status":  "0",
+				"Message": "获取增量备份列表失败",
+				"Error":   err.Error(),
+			})
+		}
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"Status":  "1",
+		"Message": "",
+		"Data":    snapshots,
+	})
+}
+
+// RestoreBackupSnapshot 把数据库和归档目录恢复到指定增量备份的时间点
+func RestoreBackupSnapshot(c *gin.Context) {
+	result, err := restoreBackupSnapshot(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		if !respondSnapshotError(c, err) && !respondRestoreError(c, err) {
+			c.JSON(500, gin.H{
+				"Status":  "0",
+				"Message": "恢复备份失败",
+				"Error":   err.Error(),
+			})
+		}
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"Status":  "1",
+		"Message": "备份恢复成功",
+		"Data":    result,
+	})
+}
+
+// DownloadBackupSnapshot 把增量备份打包成 zip 下载，格式与 POST /api/backup 相同，可以直接上传恢复
+func DownloadBackupSnapshot(c *gin.Context) {
+	id := c.Param("id")
+	if _, err := getBackupSnapshot(id); err != nil {
+		if !respondSnapshotError(c, err) {
+			c.JSON(500, gin.H{
+				"Status":  "0",
+				"Message": "读取增量备份失败",
+				"Error":   err.Error(),
+			})
+		}
+		return
+	}
+
+	ctx := c.Request.Context()
+	reader, writer := io.Pipe()
+	go func() {
+		err := writeBackupSnapshotZip(ctx, id, writer)
+		_ = writer.CloseWithError(err)
+	}()
+
+	c.DataFromReader(http.StatusOK, -1, "application/zip", reader, map[string]string{
+		"Content-Disposition": fmt.Sprintf("attachment; filename=%q", backup.SnapshotZipName(id)),
+		"Cache-Control":       "no-store",
+	})
+}
+
+// DeleteBackupSnapshot 删除增量备份，并回收不再被其它备份引用的文件
+func DeleteBackupSnapshot(c *gin.Context) {
+	result, err := deleteBackupSnapshot(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		if !respondSnapshotError(c, err) {
+			c.JSON(500, gin.H{
+				"Status":  "0",
+				"Message": "删除增量备份失败",
+				"Error":   err.Error(),
+				"Data":    result,
+			})
+		}
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"Status":  "1",
+		"Message": "增量备份已删除",
+		"Data":    result,
+	})
+}
+
+// respondBackupFileError 处理备份文件无法解密或校验失败的错误，这时数据库和归档目录都没有改动
+func respondBackupFileError(c *gin.Context, err error) bool {
+	switch {
+	case errors.Is(err, backup.ErrBackupDecrypt):
+		c.JSON(403, gin.H{
+			"Status":  "0",
+			"Message": "备份文件无法解密",
+			"Error":   err.Error(),
+		})
+	case errors.Is(err, backup.ErrBackupNotEncrypted):
+		c.JSON(403, gin.H{
+			"Status":  "0",
+			"Message": "已启用备份加密，不能恢复未加密的备份",
+		})
+	case errors.Is(err, backup.ErrBackupIntegrity):
+		c.JSON(403, gin.H{
+			"Status":  "0",
+			"Message": "备份文件校验失败",
+			"Error":   err.Error(),
+		})
+	default:
+		return false
+	}
+	return true
+}
+
+// respondRestoreError 处理改动数据之后失败的恢复，Data 中返回失败的阶段和是否已经回滚，其它错误返回 false 由调用方处理
+func respondRestoreError(c *gin.Context, err error) bool {
+	var restoreErr *backup.RestoreError
+	if !errors.As(err, &restoreErr) {
+		return false
+	}
+	message := "恢复备份失败，已回滚到恢复前的状态"
+	if !restoreErr.RolledBack {
+		message = "恢复备份失败，回滚也失败，请检查数据"
+	}
+	c.JSON(500, gin.H{
+		"Status":  "0",
+		"Message": message,
+		"Error":   err.Error(),
+		"Data":    restoreErr,
+	})
+	return true
+}
+
+// respondSnapshotError 处理备份编号相关的错误，其它错误返回 false 由调用方处理
+func respondSnapshotError(c *gin.Context, err error) bool {
+	switch {
+	case errors.Is(err, backup.ErrInvalidSnapshotID):
+		c.JSON(403, gin.H{
+			"Status":  "0",
+			"Message": "备份编号格式错误",
+		})
+	case errors.Is(err, backup.ErrSnapshotNotFound):
+		c.JSON(404, gin.H{
+			"Status":  "0",
+			"Message": "增量备份不存在",
+		})
+	case errors.Is(err, backup.ErrSnapshotRepositoryUnencrypted):
+		c.JSON(409, gin.H{
+			"Status":  "0",
+			"Message": "已启用备份加密，但增量备份仓库中已有未加密的快照",
+			"Error":   err.Error(),
+		})
+	case errors.Is(err, backup.ErrSnapshotRepositoryEncrypted):
+		c.JSON(409, gin.H{
+			"Status":  "0",
+			"Message": "增量备份仓库已加密，当前配置无法解开仓库密钥",
+			"Error":   err.Error(),
+		})
+	default:
+		return false
+	}
+	return true
+}
+
+// GetBackupSchedule 返回定时备份配置和下一次执行时间
+func GetBackupSchedule(c *gin.Context) {
+	settings, err := getBackupSchedule()
+	if err != nil {
+		c.JSON(500, gin.H{
+			"Status":  "0",
+			"Message": "查询定时备份配置失败",
+			"Error":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"Status":  "1",
+		"Message": "查询定时备份配置成功",
+		"Data":    settings,
+	})
+}
+
+// UpdateBackupSchedule 保存定时备份配置，schedule 为空表示停止定时备份
+func UpdateBackupSchedule(c *gin.Context) {
+	var req struct {
+		Schedule   string `json:"schedule"`
+		KeepLast   int    `json:"keepLast"`
+		KeepDaily  int    `json:"keepDaily"`
+		KeepWeekly int    `json:"keepWeekly"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(403, gin.H{
+			"Status":  "0",
+			"Message": "请求参数错误",
+		})
+		return
+	}
+
+	username, _ := GetCurrentUsername(c)
+	settings, err := updateBackupSchedule(common.BackupSchedule{
+		Schedule:   req.Schedule,
+		KeepLast:   req.KeepLast,
+		KeepDaily:  req.KeepDaily,
+		KeepWeekly: req.KeepWeekly,
+	}, username)
+	if err != nil {
+		if errors.Is(err, backup.ErrInvalidBackupSchedule) {
+			c.JSON(403, gin.H{
+				"Status":  "0",
+				"Message": "定时备份配置不合法",
+				"Error":   err.Error(),
+			})
+			return
+		}
+		c.JSON(500, gin.H{
+			"Status":  "0",
+			"Message": "保存定时备份配置失败",
+			"Error":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"Status":  "1",
+		"Message": "定时备份配置已保存",
+		"Data":    settings,
+	})
+}
+
+// ListBackupTargets 返回 -backuptargets 配置的备份目标，地址中不含密码
+func ListBackupTargets(c *gin.Context) {
+	c.JSON(200, gin.H{
+		"Status":  "1",
+		"Message": "",
+		"Data":    listBackupTargets(),
+	})
+}
+
+// ListTargetBackups 列出备份目标中的备份 zip
+func ListTargetBackups(c *gin.Context) {
+	backups, err := listTargetBackups(c.Request.Context(), c.Param("name"))
+	if err != nil {
+		if !respondTargetError(c, err) {
+			c.JSON(500, gin.H{
+				"Status":  "0",
+				"Message": "获取备份目标中的备份失败",
+				"Error":   err.Error(),
+			})
+		}
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"Status":  "1",
+		"Message": "",
+		"Data":    backups,
+	})
+}
+
+// RestoreFromBackupTarget 从备份目标下载指定的备份 zip 并恢复，本机备份仓库丢失时使用；
+// 请求体带有 domains 或 paths 时只恢复这些域名或文件
+func RestoreFromBackupTarget(c *gin.Context) {
+	var req struct {
+		Name    string   `json:"name"`
+		DryRun  bool     `json:"dryRun"`
+		Domains []string `json:"domains"`
+		Paths   []string `json:"paths"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Name == "" {
+		c.JSON(403, gin.H{
+			"Status":  "0",
+			"Message": "请求参数错误",
+		})
+		return
+	}
+
+	selection := backup.RestoreSelection{Domains: req.Domains, Paths: req.Paths}
+	selective, ok := selectiveRestoreRequested(c, selection, req.DryRun)
+	if !ok {
+		return
+	}
+	if selective {
+		result, err := restoreSelectedTarget(c.Request.Context(), c.Param("name"), req.Name, selection)
+		if err == nil || !respondTargetError(c, err) {
+			respondSelectiveRestore(c, result, err)
+		}
+		return
+	}
+
+	result, err := restoreFromTarget(c.Request.Context(), c.Param("name"), req.Name, backup.RestoreOptions{DryRun: req.DryRun})
+	if err != nil {
+		if !respondTargetError(c, err) && !respondBackupFileError(c, err) && !respondRestoreError(c, err) {
+			c.JSON(500, gin.H{
+				"Status":  "0",
+				"Message": "恢复备份失败",
+				"Error":   err.Error(),
+			})
+		}
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"Status":  "1",
+		"Message": "备份恢复成功",
+		"Data":    result,
+	})
+}
+
+// respondTargetError 处理备份目标相关的错误，其它错误返回 false 由调用方处理
+func respondTargetError(c *gin.Context, err error) bool {
+	switch {
+	case errors.Is(err, backup.ErrInvalidBackupName):
+		c.JSON(403, gin.H{
+			"Status":  "0",
+			"Message": "备份文件名格式错误",
+		})
+	case errors.Is(err, backup.ErrBackupTargetNotFound):
+		c.JSON(404, gin.H{
+			"Status":  "0",
+			"Message": "备份目标不存在",
+		})
+	case errors.Is(err, backup.ErrBackupObjectNotFound):
+		c.JSON(404, gin.H{
+			"Status":  "0",
+			"Message": "备份目标中没有该备份",
+		})
+	default:
+		return false
+	}
+	return true
+}
+
+// CreateBackupJob 在后台创建完整备份，立即返回任务，完成后通过 /api/backupJobs/:id/download 下载
+func CreateBackupJob(c *gin.Context) {
+	job, err := startBackupJob(c.Request.Context())
+	if err != nil {
+		c.JSON(500, gin.H{
+			"Status":  "0",
+			"Message": "创建备份任务失败",
+			"Error":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(202, gin.H{
+		"Status":  "1",
+		"Message": "备份任务已创建",
+		"Data":    job,
+	})
+}
+
+// CreateRestoreJob 用上传的备份 zip 在后台恢复，?dryRun=true 时只校验备份并在结果中返回恢复会带来的变化
+func CreateRestoreJob(c *gin.Context) {
+	dryRun, ok := parseDryRunQuery(c)
+	if !ok {
+		return
+	}
+	zipPath, cleanup, ok := saveUploadedBackup(c, "dataark-restore-job-upload-*")
+	if !ok {
+		return
+	}
+	defer cleanup()
+
+	job, err := startRestoreJob(c.Request.Context(), zipPath, backup.RestoreOptions{DryRun: dryRun})
+	if err != nil {
+		c.JSON(500, gin.H{
+			"Status":  "0",
+			"Message": "创建恢复任务失败",
+			"Error":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(202, gin.H{
+		"Status":  "1",
+		"Message": "恢复任务已创建",
+		"Data":    job,
+	})
+}
+
+func ListBackupJobs(c *gin.Context) {
+	jobs, err := listBackupJobs()
 	if err != nil {
 		c.JSON(500, gin.H{
 			"Status":  "0",
-			"Message": "检查归档一致性失败",
+			"Message": "获取备份任务列表失败",
 			"Error":   err.Error(),
 		})
 		return
@@ -291,124 +2946,130 @@ func GetArchiveConsistency(c *gin.Context) {
 
 	c.JSON(200, gin.H{
 		"Status":  "1",
-		"Message": "检查归档一致性成功",
-		"Data":    report,
+		"Message": "",
+		"Data":    jobs,
 	})
 }
 
-func RepairArchiveConsistency(c *gin.Context) {
-	report, err := repairArchiveConsistency(c.Request.Context())
+// GetBackupJob 返回备份或恢复任务的阶段、进度和结果
+func GetBackupJob(c *gin.Context) {
+	job, err := getBackupJob(c.Param("id"))
 	if err != nil {
-		c.JSON(500, gin.H{
-			"Status":  "0",
-			"Message": "修复归档一致性失败",
-			"Error":   err.Error(),
-		})
+		if !respondBackupJobError(c, err) {
+			c.JSON(500, gin.H{
+				"Status":  "0",
+				"Message": "查询备份任务失败",
+				"Error":   err.Error(),
+			})
+		}
 		return
 	}
 
 	c.JSON(200, gin.H{
 		"Status":  "1",
-		"Message": "修复归档一致性完成",
-		"Data":    report,
+		"Message": "",
+		"Data":    job,
 	})
 }
 
-func buildArchiveTaskResponse(task *common.ArchiveTask, created bool) (int, string) {
-	if created {
-		return http.StatusAccepted, "链接离线任务已加入队列"
+// DownloadBackupJob 下载已完成的备份任务生成的 zip
+func DownloadBackupJob(c *gin.Context) {
+	zipPath, fileName, err := backupJobFile(c.Param("id"))
+	if err != nil {
+		if !respondBackupJobError(c, err) {
+			c.JSON(500, gin.H{
+				"Status":  "0",
+				"Message": "读取备份文件失败",
+				"Error":   err.Error(),
+			})
+		}
+		return
 	}
 
-	// pending/running 都返回 202，是为了明确告诉前端这不是同步完成型接口，
-	// 调用方应该继续轮询任务状态，而不是把这次响应误判成最终结果。
-	switch task.Status {
-	case search.ArchiveTaskStatusPending, search.ArchiveTaskStatusRunning:
-		return http.StatusAccepted, "链接离线任务正在处理中"
-	case search.ArchiveTaskStatusSuccess:
-		return http.StatusOK, "链接离线任务已完成"
-	case search.ArchiveTaskStatusFailed:
-		return http.StatusOK, "链接离线任务执行失败"
-	default:
-		return http.StatusOK, "链接离线任务状态已返回"
-	}
+	c.Header("Cache-Control", "no-store")
+	c.FileAttachment(zipPath, fileName)
 }
 
-func AddHTMLFile(c *gin.Context) {
-	htmlFile, err := c.FormFile("file")
+// CancelBackupJob 请求取消任务，恢复任务开始覆盖数据库后会继续执行到结束
+func CancelBackupJob(c *gin.Context) {
+	job, err := cancelBackupJob(c.Param("id"))
 	if err != nil {
-		c.JSON(500, gin.H{
-			"Status":  "0",
-			"Message": "上传文件失败",
-		})
+		if !respondBackupJobError(c, err) {
+			c.JSON(500, gin.H{
+				"Status":  "0",
+				"Message": "取消备份任务失败",
+				"Error":   err.Error(),
+			})
+		}
 		return
 	}
 
-	tempDir := filepath.Join(common.ARCHIVEFILELOACTION, "Temporary")
-	if err := os.MkdirAll(tempDir, os.ModePerm); err != nil {
-		c.JSON(500, gin.H{
-			"Status":  "0",
-			"Message": "初始化临时目录失败",
-		})
-		return
-	}
-	// 上传到临时目录
-	filePath := filepath.Join(tempDir, htmlFile.Filename)
+	c.JSON(202, gin.H{
+		"Status":  "1",
+		"Message": "已请求取消备份任务",
+		"Data":    job,
+	})
+}
 
-	if err := c.SaveUploadedFile(htmlFile, filePath); err != nil {
-		c.JSON(500, gin.H{
-			"Status":  "0",
-			"Message": "上传文件失败",
-		})
+// DeleteBackupJob 删除已结束的任务记录和生成的备份文件
+func DeleteBackupJob(c *gin.Context) {
+	if err := deleteBackupJob(c.Param("id")); err != nil {
+		if !respondBackupJobError(c, err) {
+			c.JSON(500, gin.H{
+				"Status":  "0",
+				"Message": "删除备份任务失败",
+				"Error":   err.Error(),
+			})
+		}
 		return
 	}
 
 	c.JSON(200, gin.H{
 		"Status":  "1",
-		"Message": "文件上传成功",
+		"Message": "备份任务已删除",
 	})
 }
 
-type File struct {
-	Uid      string   `json:"uid"`
-	File     struct{} `json:"file"`
-	Name     string   `json:"name"`
-	Status   string   `json:"status"`
-	Percent  int      `json:"percent"`
-	Response struct {
-		Message string `json:"Message"`
-		Status  string `json:"Status"`
-	} `json:"response"`
-}
-
-type AddDocRequest struct {
-	Domain string `json:"domain"`
-	Files  []File `json:"files"`
-}
-
-func AddDocByHTMLFile(c *gin.Context) {
-	var req AddDocRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(403, gin.H{
+// respondBackupJobError 处理备份任务相关的错误，其它错误返回 false 由调用方处理
+func respondBackupJobError(c *gin.Context, err error) bool {
+	switch {
+	case errors.Is(err, backup.ErrBackupJobNotFound):
+		c.JSON(404, gin.H{
 			"Status":  "0",
-			"Message": "请求参数错误",
+			"Message": "备份任务不存在",
 		})
-		return
-	}
-	if req.Domain == "" {
-		c.JSON(403, gin.H{
+	case errors.Is(err, backup.ErrBackupJobNoFile):
+		c.JSON(404, gin.H{
 			"Status":  "0",
-			"Message": "请求参数错误",
+			"Message": "备份任务没有可下载的文件",
 		})
-		return
-	}
-	if len(req.Files) != 1 {
-		c.JSON(403, gin.H{
+	case errors.Is(err, backup.ErrBackupJobNotActive):
+		c.JSON(409, gin.H{
 			"Status":  "0",
-			"Message": "仅支持单个文件上传",
+			"Message": "备份任务已结束",
 		})
-		return
+	case errors.Is(err, backup.ErrBackupJobActive):
+		c.JSON(409, gin.H{
+			"Status":  "0",
+			"Message": "备份任务正在执行，请先取消",
+		})
+	default:
+		return false
 	}
-	if req.Files[0].Name == "" {
+	return true
+}
+
+// uploadOffsetHeader 是分块上传中数据的起始位置，响应中返回下一块的起始位置，与 tus 协议的同名头一致。
+const uploadOffsetHeader = "Upload-Offset"
+
+// CreateBackupUpload 登记一个分块上传的备份 zip，之后用 PATCH /api/backupUploads/:id 按顺序上传数据，
+// 适合浏览器请求容易超时或中断的大型备份
+func CreateBackupUpload(c *gin.Context) {
+	var req struct {
+		FileName string `json:"fileName"`
+		Size     int64  `json:"size"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(403, gin.H{
 			"Status":  "0",
 			"Message": "请求参数错误",
@@ -416,59 +3077,89 @@ func AddDocByHTMLFile(c *gin.Context) {
 		return
 	}
 
-	if err := addDocFileToIndex(req.Files[0].Name, req.Domain); err != nil {
-		c.JSON(500, gin.H{
-			"Status":  "0",
-			"Message": "上传文件失败",
-		})
+	upload, err := createBackupUpload(c.Request.Context(), req.FileName, req.Size)
+	if err != nil {
+		if !respondBackupUploadError(c, err, nil) {
+			c.JSON(500, gin.H{
+				"Status":  "0",
+				"Message": "创建上传失败",
+				"Error":   err.Error(),
+			})
+		}
 		return
 	}
 
-	c.JSON(200, gin.H{
+	c.Header(uploadOffsetHeader, "0")
+	c.JSON(201, gin.H{
 		"Status":  "1",
-		"Message": "文件上传成功",
+		"Message": "上传已创建",
+		"Data":    upload,
 	})
-	return
 }
 
-func DeleteArchiveDocument(c *gin.Context) {
-	htmlPath := strings.TrimSpace(c.Query("path"))
-	if htmlPath == "" {
-		var req struct {
-			Path string `json:"path"`
-		}
-		if err := c.ShouldBindJSON(&req); err == nil {
-			htmlPath = strings.TrimSpace(req.Path)
+// GetBackupUpload 返回已经收到的字节数，连接中断后客户端从这里继续上传
+func GetBackupUpload(c *gin.Context) {
+	upload, err := getBackupUpload(c.Param("id"))
+	if err != nil {
+		if !respondBackupUploadError(c, err, nil) {
+			c.JSON(500, gin.H{
+				"Status":  "0",
+				"Message": "查询上传失败",
+				"Error":   err.Error(),
+			})
 		}
+		return
 	}
 
-	if htmlPath == "" {
+	c.Header(uploadOffsetHeader, strconv.FormatInt(upload.Offset, 10))
+	c.JSON(200, gin.H{
+		"Status":  "1",
+		"Message": "",
+		"Data":    upload,
+	})
+}
+
+// WriteBackupUpload 把请求体追加到上传文件，Upload-Offset 头必须等于已经收到的字节数
+func WriteBackupUpload(c *gin.Context) {
+	offset, err := strconv.ParseInt(c.GetHeader(uploadOffsetHeader), 10, 64)
+	if err != nil || offset < 0 {
 		c.JSON(403, gin.H{
 			"Status":  "0",
-			"Message": "缺少关键参数 path",
+			"Message": "Upload-Offset 头格式错误",
 		})
 		return
 	}
 
-	result, err := deleteDocByHTMLPath(c.Request.Context(), htmlPath)
+	upload, err := writeBackupUpload(c.Request.Context(), c.Param("id"), offset, c.Request.Body)
+	if upload != nil {
+		c.Header(uploadOffsetHeader, strconv.FormatInt(upload.Offset, 10))
+	}
 	if err != nil {
-		switch {
-		case errors.Is(err, search.ErrInvalidArchivePath):
-			c.JSON(403, gin.H{
-				"Status":  "0",
-				"Message": "HTML 路径参数错误",
-				"Error":   err.Error(),
-			})
-		case errors.Is(err, search.ErrArchiveDocumentNotFound), errors.Is(err, search.ErrArchiveFileNotFound):
-			c.JSON(404, gin.H{
+		if !respondBackupUploadError(c, err, upload) {
+			c.JSON(500, gin.H{
 				"Status":  "0",
-				"Message": "文档不存在",
+				"Message": "写入上传数据失败",
 				"Error":   err.Error(),
+				"Data":    upload,
 			})
-		default:
+		}
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"Status":  "1",
+		"Message": "",
+		"Data":    upload,
+	})
+}
+
+// DeleteBackupUpload 放弃上传并删除已经收到的数据
+func DeleteBackupUpload(c *gin.Context) {
+	if err := deleteBackupUpload(c.Param("id")); err != nil {
+		if !respondBackupUploadError(c, err, nil) {
 			c.JSON(500, gin.H{
 				"Status":  "0",
-				"Message": "删除文档失败",
+				"Message": "删除上传失败",
 				"Error":   err.Error(),
 			})
 		}
@@ -477,88 +3168,73 @@ func DeleteArchiveDocument(c *gin.Context) {
 
 	c.JSON(200, gin.H{
 		"Status":  "1",
-		"Message": "文档删除成功",
-		"Data":    result,
+		"Message": "上传已删除",
 	})
 }
 
-func CreateBackup(c *gin.Context) {
-	preparedBackup, err := createBackupArchive(c.Request.Context())
-	if err != nil {
-		c.JSON(500, gin.H{
-			"Status":  "0",
-			"Message": "创建备份失败",
-			"Error":   err.Error(),
-		})
+// CreateUploadedRestoreJob 用上传完成的备份在后台恢复，?dryRun=true 时只校验备份
+func CreateUploadedRestoreJob(c *gin.Context) {
+	dryRun, ok := parseDryRunQuery(c)
+	if !ok {
 		return
 	}
-	defer preparedBackup.Cleanup()
 
-	reader, writer := io.Pipe()
-	go func() {
-		err := preparedBackup.WriteZip(writer)
-		_ = writer.CloseWithError(err)
-	}()
+	job, err := startUploadedRestoreJob(c.Request.Context(), c.Param("id"), backup.RestoreOptions{DryRun: dryRun})
+	if err != nil {
+		if !respondBackupUploadError(c, err, nil) {
+			c.JSON(500, gin.H{
+				"Status":  "0",
+				"Message": "创建恢复任务失败",
+				"Error":   err.Error(),
+			})
+		}
+		return
+	}
 
-	c.DataFromReader(http.StatusOK, -1, "application/zip", reader, map[string]string{
-		"Content-Disposition": fmt.Sprintf("attachment; filename=%q", preparedBackup.FileName),
-		"Cache-Control":       "no-store",
+	c.JSON(202, gin.H{
+		"Status":  "1",
+		"Message": "恢复任务已创建",
+		"Data":    job,
 	})
 }
 
-func RestoreBackup(c *gin.Context) {
-	backupFile, err := c.FormFile("file")
-	if err != nil {
-		c.JSON(403, gin.H{
+// respondBackupUploadError 处理分块上传相关的错误，offset 不一致时在 Data 中返回当前进度，其它错误返回 false 由调用方处理
+func respondBackupUploadError(c *gin.Context, err error, upload *backup.BackupUpload) bool {
+	switch {
+	case errors.Is(err, backup.ErrBackupUploadNotFound):
+		c.JSON(404, gin.H{
 			"Status":  "0",
-			"Message": "缺少备份文件",
+			"Message": "上传不存在或已过期",
 		})
-		return
-	}
-	if !strings.EqualFold(filepath.Ext(backupFile.Filename), ".zip") {
+	case errors.Is(err, backup.ErrInvalidBackupUpload):
 		c.JSON(403, gin.H{
 			"Status":  "0",
-			"Message": "备份文件必须是 zip 压缩包",
+			"Message": "上传参数错误",
+			"Error":   err.Error(),
+			"Data":    upload,
 		})
-		return
-	}
-
-	tempDir, err := os.MkdirTemp("", "dataark-restore-upload-*")
-	if err != nil {
-		c.JSON(500, gin.H{
+	case errors.Is(err, backup.ErrBackupUploadOffset):
+		c.JSON(409, gin.H{
 			"Status":  "0",
-			"Message": "初始化恢复临时目录失败",
+			"Message": "上传位置不一致，请从返回的位置继续上传",
 			"Error":   err.Error(),
+			"Data":    upload,
 		})
-		return
-	}
-	defer os.RemoveAll(tempDir)
-
-	zipPath := filepath.Join(tempDir, "backup.zip")
-	if err := c.SaveUploadedFile(backupFile, zipPath); err != nil {
-		c.JSON(500, gin.H{
+	case errors.Is(err, backup.ErrBackupUploadBusy):
+		c.JSON(409, gin.H{
 			"Status":  "0",
-			"Message": "保存备份文件失败",
-			"Error":   err.Error(),
+			"Message": "上传正在写入其它数据",
 		})
-		return
-	}
-
-	result, err := restoreBackupArchive(c.Request.Context(), zipPath)
-	if err != nil {
-		c.JSON(500, gin.H{
+	case errors.Is(err, backup.ErrBackupUploadIncomplete):
+		c.JSON(409, gin.H{
 			"Status":  "0",
-			"Message": "恢复备份失败",
+			"Message": "上传尚未完成",
 			"Error":   err.Error(),
 		})
-		return
+	default:
+		return false
 	}
-
-	c.JSON(200, gin.H{
-		"Status":  "1",
-		"Message": "备份恢复成功",
-		"Data":    result,
-	})
+	return true
 }
 
 var Templates embed.FS
@@ -583,43 +3259,154 @@ func WebStarter(debugMode bool) {
 	if !debugMode {
 		gin.SetMode(gin.ReleaseMode)
 	}
+	if err := initJWTKeys(); err != nil {
+		fmt.Printf("failed to load jwt signing keys: %v\n", err)
+		return
+	}
+	if err := initOIDC(); err != nil {
+		fmt.Printf("invalid oidc configuration: %v\n", err)
+		return
+	}
+	if err := initBackupTargets(); err != nil {
+		fmt.Printf("invalid backup targets: %v\n", err)
+		return
+	}
+	if err := initBackupEncryption(); err != nil {
+		fmt.Printf("invalid backup encryption keys: %v\n", err)
+		return
+	}
 	initDatabase()
 	createSearchIndex()
+	// 回滚中断的恢复需要重建索引，在搜索引擎初始化之后执行
+	if err := initBackupJobs(); err != nil {
+		fmt.Printf("failed to initialize backup jobs: %v\n", err)
+		return
+	}
 	if err := initArchiveQueue(); err != nil {
 		fmt.Printf("failed to initialize archive task queue: %v\n", err)
 		return
 	}
+	if err := startBackupScheduler(); err != nil {
+		fmt.Printf("failed to start backup scheduler: %v\n", err)
+		return
+	}
 	router := gin.Default()
 	if debugMode {
 		router.Use(CORSMiddleware())
 	}
+	router.Use(AuditMiddleware())
 	authController := &AuthController{}
+	userController := &UserController{}
+	apiTokenController := &APITokenController{}
+	teamController := &TeamController{}
 	public := router.Group("/api")
 	{
 		public.POST("/login", authController.Login)
+		public.POST("/login/totp", authController.LoginTOTP)
+		public.GET("/oidc/config", authController.OIDCConfig)
+		public.GET("/oidc/login", authController.OIDCLogin)
+		public.GET("/oidc/callback", authController.OIDCCallback)
+		public.POST("/oidc/exchange", authController.OIDCExchange)
 	}
+	// API Token 只能访问声明了对应 scope 的接口，其余接口仅限登录会话
+	reader := router.Group("/api")
+	reader.Use(AuthMiddleware(common.ScopeSearchRead))
+	{
+		reader.GET("/search", SearchByKeyword)
+		reader.GET("/archiveStats", GetArchiveStats)
+		reader.GET("/archive/related", GetRelatedDocuments)
+		reader.GET("/searchSettings", GetSearchSettings)
+	}
+	router.GET("/api/archiveTask/:taskId", AuthMiddleware(common.ScopeSearchRead, common.ScopeArchiveWrite), GetArchiveTaskStatus)
+	router.GET("/api/authChecker", AuthMiddleware(common.APITokenScopes()...), authController.AuthChecker)
 	protected := router.Group("/api")
 	protected.Use(AuthMiddleware())
 	{
-		protected.GET("/search", SearchByKeyword)
-		protected.POST("/uploadHtmlFile", AddHTMLFile)
-		protected.POST("/upload", AddDocByHTMLFile)
-		protected.POST("/archiveByURL", AddDocByURL)
-		protected.GET("/archiveTask/:taskId", GetArchiveTaskStatus)
-		protected.GET("/archiveStats", GetArchiveStats)
-		protected.POST("/archiveStats/refresh", RefreshArchiveStats)
-		protected.GET("/archiveConsistency", GetArchiveConsistency)
-		protected.POST("/archiveConsistency/repair", RepairArchiveConsistency)
-		protected.DELETE("/archive", DeleteArchiveDocument)
-		protected.POST("/backup", CreateBackup)
-		protected.POST("/backup/restore", RestoreBackup)
-		protected.GET("/authChecker", authController.AuthChecker)
-		protected.POST("/register", authController.Register)
+		protected.POST("/me/password", userController.ChangeMyPassword)
+		protected.GET("/me/totp", userController.GetMyTOTPStatus)
+		protected.POST("/me/totp/setup", userController.SetupMyTOTP)
+		protected.POST("/me/totp/enable", userController.EnableMyTOTP)
+		protected.POST("/me/totp/disable", userController.DisableMyTOTP)
+		protected.POST("/me/totp/recoveryCodes", userController.RegenerateMyRecoveryCodes)
+		protected.POST("/logout", authController.Logout)
+		protected.POST("/logout/all", authController.LogoutAll)
+		protected.POST("/token/refresh", authController.RefreshToken)
+		protected.GET("/apiTokens", apiTokenController.ListAPITokens)
+		protected.POST("/apiTokens", apiTokenController.CreateAPIToken)
+		protected.DELETE("/apiTokens/:id", apiTokenController.DeleteAPIToken)
+		protected.GET("/me/teams", teamController.ListMyTeams)
+	}
+	editor := router.Group("/api")
+	editor.Use(AuthMiddleware(common.ScopeArchiveWrite), RequireRole(common.RoleEditor))
+	{
+		editor.POST("/uploadHtmlFile", AddHTMLFile)
+		editor.POST("/upload", AddDocByHTMLFile)
+		editor.POST("/archiveByURL", AddDocByURL)
+		editor.POST("/archiveStats/refresh", RefreshArchiveStats)
+		editor.GET("/archiveConsistency", GetArchiveConsistency)
+		editor.DELETE("/archive", DeleteArchiveDocument)
+		editor.PUT("/archive/visibility", SetArchiveVisibility)
+	}
+	backupGroup := router.Group("/api")
+	// 备份包含全部数据，恢复会覆盖全部数据，要求管理员启用两步验证
+	backupGroup.Use(AuthMiddleware(common.ScopeBackup), RequireRole(common.RoleAdmin), RequireTwoFactor())
+	{
+		backupGroup.POST("/backup", CreateBackup)
+		backupGroup.POST("/backup/restore", RestoreBackup)
+		backupGroup.POST("/backup/verify", VerifyBackup)
+		backupGroup.GET("/backups", ListBackupSnapshots)
+		backupGroup.POST("/backups", CreateBackupSnapshot)
+		backupGroup.GET("/backups/:id", DownloadBackupSnapshot)
+		backupGroup.DELETE("/backups/:id", DeleteBackupSnapshot)
+		backupGroup.POST("/backups/:id/restore", RestoreBackupSnapshot)
+		backupGroup.GET("/backupSchedule", GetBackupSchedule)
+		backupGroup.PUT("/backupSchedule", UpdateBackupSchedule)
+		backupGroup.GET("/backupTargets", ListBackupTargets)
+		backupGroup.GET("/backupTargets/:name/backups", ListTargetBackups)
+		backupGroup.POST("/backupTargets/:name/restore", RestoreFromBackupTarget)
+		backupGroup.GET("/backupJobs", ListBackupJobs)
+		backupGroup.POST("/backupJobs", CreateBackupJob)
+		backupGroup.POST("/backupJobs/restore", CreateRestoreJob)
+		backupGroup.GET("/backupJobs/:id", GetBackupJob)
+		backupGroup.GET("/backupJobs/:id/download", DownloadBackupJob)
+		backupGroup.POST("/backupJobs/:id/cancel", CancelBackupJob)
+		backupGroup.DELETE("/backupJobs/:id", DeleteBackupJob)
+		backupGroup.POST("/backupUploads", CreateBackupUpload)
+		backupGroup.GET("/backupUploads/:id", GetBackupUpload)
+		backupGroup.PATCH("/backupUploads/:id", WriteBackupUpload)
+		backupGroup.DELETE("/backupUploads/:id", DeleteBackupUpload)
+		backupGroup.POST("/backupUploads/:id/restore", CreateUploadedRestoreJob)
+	}
+	admin := router.Group("/api")
+	admin.Use(AuthMiddleware(), RequireRole(common.RoleAdmin))
+	{
+		admin.POST("/archiveConsistency/repair", RepairArchiveConsistency)
+		admin.PUT("/searchSettings", UpdateSearchSettings)
+		admin.POST("/register", authController.Register)
+		admin.GET("/users", userController.ListUsers)
+		admin.POST("/users", userController.CreateUser)
+		admin.PATCH("/users/:id", userController.UpdateUser)
+		admin.DELETE("/users/:id", userController.DeleteUser)
+		admin.POST("/users/:id/password", userController.ResetPassword)
+		admin.POST("/users/:id/logout", userController.LogoutUser)
+		admin.POST("/users/:id/totp/reset", userController.ResetUserTOTP)
+		admin.GET("/loginLocks", userController.ListLoginLocks)
+		admin.DELETE("/loginLocks", userController.UnlockLogin)
+		admin.GET("/loginFailures", userController.ListLoginFailures)
+		admin.GET("/audit", ListAuditEvents)
+		admin.GET("/teams", teamController.ListTeams)
+		admin.POST("/teams", teamController.CreateTeam)
+		admin.DELETE("/teams/:id", teamController.DeleteTeam)
+		admin.POST("/teams/:id/members", teamController.AddTeamMember)
+		admin.DELETE("/teams/:id/members/:userId", teamController.RemoveTeamMember)
+		admin.GET("/jwtKeys", authController.ListJWTKeys)
+		admin.POST("/jwtKeys/rotate", authController.RotateJWTKey)
 	}
 	archiveGroup := router.Group("/")
-	archiveGroup.Use(AuthMiddleware())
+	archiveGroup.Use(AuthMiddleware(common.ScopeArchiveRead))
 	{
-		archiveGroup.Static("/archive", common.ARCHIVEFILELOACTION)
+		archiveGroup.GET("/archive/*filepath", ServeArchiveFile)
+		archiveGroup.HEAD("/archive/*filepath", ServeArchiveFile)
 	}
 	router.Static("/static", "./static/web/")
 	router.StaticFS("/assets", http.FS(assets.LoadFile()))
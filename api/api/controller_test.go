@@ -6,8 +6,10 @@ import (
 	"DataArk/search"
 	"bytes"
 	"context"
+	"encoding/csv"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"io"
 	"mime/multipart"
@@ -17,10 +19,17 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"gorm.io/gorm"
 )
 
+// TestMain 控制器测试不连接数据库，审计记录默认不写入，需要检查的测试自行替换 recordAuditEvent。
+func TestMain(m *testing.M) {
+	recordAuditEvent = func(context.Context, string, string, string, error) {}
+	os.Exit(m.Run())
+}
+
 func TestGetArchiveConsistencyReturnsReport(t *testing.T) {
 	oldCheck := checkArchiveConsistency
 	t.Cleanup(func() {
@@ -140,18 +149,18 @@ func TestAuthControllerRegisterAndLogin(t *testing.T) {
 		loginWithToken = oldLogin
 	})
 
-	registerWithToken = func(username string, password string) (*common.TokenResponse, error) {
-		if username != "alice" || password != "secret1" {
-			t.Fatalf("unexpected register input %q %q", username, password)
+	registerWithToken = func(username string, password string, role string) (*common.TokenResponse, error) {
+		if username != "alice" || password != "secret1" || role != common.RoleEditor {
+			t.Fatalf("unexpected register input %q %q %q", username, password, role)
 		}
 		return &common.TokenResponse{Token: "registered"}, nil
 	}
-	response := performJSONControllerRequest(http.MethodPost, "/register", `{"username":"alice","password":"secret1"}`, controller.Register)
+	response := performJSONControllerRequest(http.MethodPost, "/register", `{"username":"alice","password":"secret1","role":"editor"}`, controller.Register)
 	if response.Code != http.StatusCreated {
 		t.Fatalf("register status = %d, want 201", response.Code)
 	}
 
-	registerWithToken = func(string, string) (*common.TokenResponse, error) {
+	registerWithToken = func(string, string, string) (*common.TokenResponse, error) {
 		return nil, errors.New("duplicate")
 	}
 	response = performJSONControllerRequest(http.MethodPost, "/register", `{"username":"alice","password":"secret1"}`, controller.Register)
@@ -163,7 +172,7 @@ func TestAuthControllerRegisterAndLogin(t *testing.T) {
 		t.Fatalf("invalid register status = %d, want 400", response.Code)
 	}
 
-	loginWithToken = func(username string, password string) (*common.TokenResponse, error) {
+	loginWithToken = func(username string, password string, clientIP string) (*common.TokenResponse, error) {
 		return &common.TokenResponse{Token: username + ":" + password}, nil
 	}
 	response = performJSONControllerRequest(http.MethodPost, "/login", `{"username":"alice","password":"secret1"}`, controller.Login)
@@ -171,13 +180,20 @@ func TestAuthControllerRegisterAndLogin(t *testing.T) {
 		t.Fatalf("login status = %d, want 200", response.Code)
 	}
 
-	loginWithToken = func(string, string) (*common.TokenResponse, error) {
+	loginWithToken = func(string, string, string) (*common.TokenResponse, error) {
 		return nil, errors.New("invalid")
 	}
 	response = performJSONControllerRequest(http.MethodPost, "/login", `{"username":"alice","password":"secret1"}`, controller.Login)
 	if response.Code != http.StatusUnauthorized {
 		t.Fatalf("login failure status = %d, want 401", response.Code)
 	}
+	loginWithToken = func(string, string, string) (*common.TokenResponse, error) {
+		return nil, &common.LoginThrottledError{RetryAfter: 1500 * time.Millisecond, Locked: true}
+	}
+	response = performJSONControllerRequest(http.MethodPost, "/login", `{"username":"alice","password":"secret1"}`, controller.Login)
+	if response.Code != http.StatusTooManyRequests || response.Header().Get("Retry-After") != "2" || !strings.Contains(response.Body.String(), `"locked":true`) {
+		t.Fatalf("throttled login status=%d retry=%q body=%s", response.Code, response.Header().Get("Retry-After"), response.Body.String())
+	}
 	response = performJSONControllerRequest(http.MethodPost, "/login", `{`, controller.Login)
 	if response.Code != http.StatusBadRequest {
 		t.Fatalf("invalid login status = %d, want 400", response.Code)
@@ -190,65 +206,112 @@ func TestSearchByKeywordBranches(t *testing.T) {
 		queryByKeyword = oldQuery
 	})
 
-	response := performControllerRequest(http.MethodGet, "/search", SearchByKeyword)
+	response := performArchiveControllerRequest(http.MethodGet, "/search", "", SearchByKeyword)
 	if response.Code != http.StatusForbidden {
 		t.Fatalf("missing q status = %d, want 403", response.Code)
 	}
-	response = performControllerRequest(http.MethodGet, "/search?q=test&p=bad", SearchByKeyword)
+	response = performArchiveControllerRequest(http.MethodGet, "/search?q=test&p=bad", "", SearchByKeyword)
 	if response.Code != http.StatusForbidden {
 		t.Fatalf("bad page status = %d, want 403", response.Code)
 	}
 
-	queryByKeyword = func(keyword string, pageNum int64) (string, map[string]int) {
+	queryByKeyword = func(keyword string, pageNum int64, access common.ArchiveAccess) (string, map[string]int) {
 		if keyword != "test" || pageNum != 2 {
 			t.Fatalf("unexpected query %q page %d", keyword, pageNum)
 		}
 		return `[{"title":"hit"}]`, map[string]int{"TotalHits": 1, "TotalPages": 1}
 	}
-	response = performControllerRequest(http.MethodGet, "/search?q=test&p=2", SearchByKeyword)
+	response = performArchiveControllerRequest(http.MethodGet, "/search?q=test&p=2", "", SearchByKeyword)
 	if response.Code != http.StatusOK {
 		t.Fatalf("search status = %d, want 200", response.Code)
 	}
 
-	queryByKeyword = func(string, int64) (string, map[string]int) {
+	queryByKeyword = func(string, int64, common.ArchiveAccess) (string, map[string]int) {
 		return "Error", nil
 	}
-	response = performControllerRequest(http.MethodGet, "/search?q=test", SearchByKeyword)
+	response = performArchiveControllerRequest(http.MethodGet, "/search?q=test", "", SearchByKeyword)
 	if response.Code != http.StatusInternalServerError {
 		t.Fatalf("search error status = %d, want 500", response.Code)
 	}
 }
 
+func TestSearchByKeywordSemanticBranches(t *testing.T) {
+	oldQuery := queryByKeyword
+	oldHybrid := queryHybrid
+	t.Cleanup(func() {
+		queryByKeyword = oldQuery
+		queryHybrid = oldHybrid
+	})
+
+	queryByKeyword = func(string, int64, common.ArchiveAccess) (string, map[string]int) {
+		t.Fatal("keyword query should not be used for semantic search")
+		return "", nil
+	}
+	for _, rawURL := range []string{"/search?q=test&semantic=bad", "/search?q=test&semantic=1.5", "/search?q=test&semantic=-0.1"} {
+		response := performArchiveControllerRequest(http.MethodGet, rawURL, "", SearchByKeyword)
+		if response.Code != http.StatusForbidden {
+			t.Fatalf("%s status = %d, want 403", rawURL, response.Code)
+		}
+	}
+
+	queryHybrid = func(keyword string, pageNum int64, semanticRatio float64, access common.ArchiveAccess) (string, map[string]int, error) {
+		if keyword != "test" || pageNum != 1 || semanticRatio != 0.5 {
+			t.Fatalf("unexpected hybrid query %q page %d ratio %v", keyword, pageNum, semanticRatio)
+		}
+		return `[{"title":"hit"}]`, map[string]int{"TotalHits": 1, "TotalPages": 1}, nil
+	}
+	response := performArchiveControllerRequest(http.MethodGet, "/search?q=test&semantic=0.5", "", SearchByKeyword)
+	if response.Code != http.StatusOK {
+		t.Fatalf("semantic search status = %d, want 200", response.Code)
+	}
+
+	queryHybrid = func(string, int64, float64, common.ArchiveAccess) (string, map[string]int, error) {
+		return "", nil, search.ErrSemanticSearchDisabled
+	}
+	response = performArchiveControllerRequest(http.MethodGet, "/search?q=test&semantic=1", "", SearchByKeyword)
+	if response.Code != http.StatusForbidden {
+		t.Fatalf("disabled semantic search status = %d, want 403", response.Code)
+	}
+
+	queryHybrid = func(string, int64, float64, common.ArchiveAccess) (string, map[string]int, error) {
+		return "", nil, errors.New("embedding service down")
+	}
+	response = performArchiveControllerRequest(http.MethodGet, "/search?q=test&semantic=1", "", SearchByKeyword)
+	if response.Code != http.StatusInternalServerError {
+		t.Fatalf("semantic search error status = %d, want 500", response.Code)
+	}
+}
+
 func TestAddDocByURLBranches(t *testing.T) {
 	oldAdd := addDocURLTask
 	t.Cleanup(func() {
 		addDocURLTask = oldAdd
 	})
 
-	response := performJSONControllerRequest(http.MethodPost, "/archiveByURL", `{`, AddDocByURL)
+	response := performArchiveControllerRequest(http.MethodPost, "/archiveByURL", `{`, AddDocByURL)
 	if response.Code != http.StatusForbidden {
 		t.Fatalf("invalid json status = %d, want 403", response.Code)
 	}
-	response = performJSONControllerRequest(http.MethodPost, "/archiveByURL", `{"url":"ftp://example.com"}`, AddDocByURL)
+	response = performArchiveControllerRequest(http.MethodPost, "/archiveByURL", `{"url":"ftp://example.com"}`, AddDocByURL)
 	if response.Code != http.StatusForbidden {
 		t.Fatalf("invalid url status = %d, want 403", response.Code)
 	}
 
-	addDocURLTask = func(rawURL string) (*common.ArchiveTask, bool, error) {
+	addDocURLTask = func(rawURL string, ownership common.ArchiveOwnership) (*common.ArchiveTask, bool, error) {
 		if rawURL != "https://example.com" {
 			t.Fatalf("rawURL = %q", rawURL)
 		}
 		return &common.ArchiveTask{ID: "task", Status: search.ArchiveTaskStatusPending}, true, nil
 	}
-	response = performJSONControllerRequest(http.MethodPost, "/archiveByURL", `{"url":"https://example.com"}`, AddDocByURL)
+	response = performArchiveControllerRequest(http.MethodPost, "/archiveByURL", `{"url":"https://example.com"}`, AddDocByURL)
 	if response.Code != http.StatusAccepted {
 		t.Fatalf("success status = %d, want 202", response.Code)
 	}
 
-	addDocURLTask = func(string) (*common.ArchiveTask, bool, error) {
+	addDocURLTask = func(string, common.ArchiveOwnership) (*common.ArchiveTask, bool, error) {
 		return nil, false, errors.New("queue down")
 	}
-	response = performJSONControllerRequest(http.MethodPost, "/archiveByURL", `{"url":"https://example.com"}`, AddDocByURL)
+	response = performArchiveControllerRequest(http.MethodPost, "/archiveByURL", `{"url":"https://example.com"}`, AddDocByURL)
 	if response.Code != http.StatusInternalServerError {
 		t.Fatalf("error status = %d, want 500", response.Code)
 	}
@@ -267,21 +330,21 @@ func TestArchiveTaskAndStatsHandlers(t *testing.T) {
 	getArchiveTask = func(id string) (*common.ArchiveTask, error) {
 		return &common.ArchiveTask{ID: id, Status: search.ArchiveTaskStatusSuccess}, nil
 	}
-	response := performPathControllerRequest(http.MethodGet, "/archiveTask/:taskId", "/archiveTask/task-1", GetArchiveTaskStatus)
+	response := performUserControllerRequest(http.MethodGet, "/archiveTask/:taskId", "/archiveTask/task-1", "", archiveTestAdmin, GetArchiveTaskStatus)
 	if response.Code != http.StatusOK {
 		t.Fatalf("task status = %d, want 200", response.Code)
 	}
 	getArchiveTask = func(string) (*common.ArchiveTask, error) {
 		return nil, gorm.ErrRecordNotFound
 	}
-	response = performPathControllerRequest(http.MethodGet, "/archiveTask/:taskId", "/archiveTask/missing", GetArchiveTaskStatus)
+	response = performUserControllerRequest(http.MethodGet, "/archiveTask/:taskId", "/archiveTask/missing", "", archiveTestAdmin, GetArchiveTaskStatus)
 	if response.Code != http.StatusNotFound {
 		t.Fatalf("missing task status = %d, want 404", response.Code)
 	}
 	getArchiveTask = func(string) (*common.ArchiveTask, error) {
 		return nil, errors.New("db down")
 	}
-	response = performPathControllerRequest(http.MethodGet, "/archiveTask/:taskId", "/archiveTask/error", GetArchiveTaskStatus)
+	response = performUserControllerRequest(http.MethodGet, "/archiveTask/:taskId", "/archiveTask/error", "", archiveTestAdmin, GetArchiveTaskStatus)
 	if response.Code != http.StatusInternalServerError {
 		t.Fatalf("task error status = %d, want 500", response.Code)
 	}
@@ -323,35 +386,37 @@ func TestAddDocByHTMLFileBranches(t *testing.T) {
 		addDocFileToIndex = oldAdd
 	})
 
-	response := performJSONControllerRequest(http.MethodPost, "/upload", `{`, AddDocByHTMLFile)
+	response := performArchiveControllerRequest(http.MethodPost, "/upload", `{`, AddDocByHTMLFile)
 	if response.Code != http.StatusForbidden {
 		t.Fatalf("invalid json status = %d, want 403", response.Code)
 	}
-	response = performJSONControllerRequest(http.MethodPost, "/upload", `{"domain":"","files":[]}`, AddDocByHTMLFile)
+	response = performArchiveControllerRequest(http.MethodPost, "/upload", `{"domain":"","files":[]}`, AddDocByHTMLFile)
 	if response.Code != http.StatusForbidden {
 		t.Fatalf("missing domain status = %d, want 403", response.Code)
 	}
-	response = performJSONControllerRequest(http.MethodPost, "/upload", `{"domain":"example.com","files":[]}`, AddDocByHTMLFile)
+	response = performArchiveControllerRequest(http.MethodPost, "/upload", `{"domain":"example.com","files":[]}`, AddDocByHTMLFile)
 	if response.Code != http.StatusForbidden {
 		t.Fatalf("wrong file count status = %d, want 403", response.Code)
 	}
-	response = performJSONControllerRequest(http.MethodPost, "/upload", `{"domain":"example.com","files":[{"name":""}]}`, AddDocByHTMLFile)
+	response = performArchiveControllerRequest(http.MethodPost, "/upload", `{"domain":"example.com","files":[{"name":""}]}`, AddDocByHTMLFile)
 	if response.Code != http.StatusForbidden {
 		t.Fatalf("missing file name status = %d, want 403", response.Code)
 	}
 
-	addDocFileToIndex = func(fileName string, originDomain string) error {
+	addDocFileToIndex = func(fileName string, originDomain string, ownership common.ArchiveOwnership, access common.ArchiveAccess) error {
 		if fileName != "page.html" || originDomain != "example.com" {
 			t.Fatalf("unexpected add doc input %q %q", fileName, originDomain)
 		}
 		return nil
 	}
-	response = performJSONControllerRequest(http.MethodPost, "/upload", `{"domain":"example.com","files":[{"name":"page.html"}]}`, AddDocByHTMLFile)
+	response = performArchiveControllerRequest(http.MethodPost, "/upload", `{"domain":"example.com","files":[{"name":"page.html"}]}`, AddDocByHTMLFile)
 	if response.Code != http.StatusOK {
 		t.Fatalf("success status = %d, want 200", response.Code)
 	}
-	addDocFileToIndex = func(string, string) error { return errors.New("index failed") }
-	response = performJSONControllerRequest(http.MethodPost, "/upload", `{"domain":"example.com","files":[{"name":"page.html"}]}`, AddDocByHTMLFile)
+	addDocFileToIndex = func(string, string, common.ArchiveOwnership, common.ArchiveAccess) error {
+		return errors.New("index failed")
+	}
+	response = performArchiveControllerRequest(http.MethodPost, "/upload", `{"domain":"example.com","files":[{"name":"page.html"}]}`, AddDocByHTMLFile)
 	if response.Code != http.StatusInternalServerError {
 		t.Fatalf("error status = %d, want 500", response.Code)
 	}
@@ -363,36 +428,84 @@ func TestDeleteArchiveDocumentBranches(t *testing.T) {
 		deleteDocByHTMLPath = oldDelete
 	})
 
-	response := performControllerRequest(http.MethodDelete, "/archive", DeleteArchiveDocument)
+	response := performArchiveControllerRequest(http.MethodDelete, "/archive", "", DeleteArchiveDocument)
 	if response.Code != http.StatusForbidden {
 		t.Fatalf("missing path status = %d, want 403", response.Code)
 	}
 
-	deleteDocByHTMLPath = func(context.Context, string) (*search.DeleteDocResult, error) {
+	deleteDocByHTMLPath = func(context.Context, string, common.ArchiveAccess) (*search.DeleteDocResult, error) {
 		return nil, search.ErrInvalidArchivePath
 	}
-	response = performControllerRequest(http.MethodDelete, "/archive?path=/bad", DeleteArchiveDocument)
+	response = performArchiveControllerRequest(http.MethodDelete, "/archive?path=/bad", "", DeleteArchiveDocument)
 	if response.Code != http.StatusForbidden {
 		t.Fatalf("invalid path status = %d, want 403", response.Code)
 	}
-	deleteDocByHTMLPath = func(context.Context, string) (*search.DeleteDocResult, error) {
+	deleteDocByHTMLPath = func(context.Context, string, common.ArchiveAccess) (*search.DeleteDocResult, error) {
 		return nil, search.ErrArchiveDocumentNotFound
 	}
-	response = performJSONControllerRequest(http.MethodDelete, "/archive", `{"path":"/archive/example/page.html"}`, DeleteArchiveDocument)
+	response = performArchiveControllerRequest(http.MethodDelete, "/archive", `{"path":"/archive/example/page.html"}`, DeleteArchiveDocument)
 	if response.Code != http.StatusNotFound {
 		t.Fatalf("not found status = %d, want 404", response.Code)
 	}
-	deleteDocByHTMLPath = func(context.Context, string) (*search.DeleteDocResult, error) {
+	deleteDocByHTMLPath = func(context.Context, string, common.ArchiveAccess) (*search.DeleteDocResult, error) {
 		return nil, errors.New("delete failed")
 	}
-	response = performControllerRequest(http.MethodDelete, "/archive?path=/archive/example/page.html", DeleteArchiveDocument)
+	response = performArchiveControllerRequest(http.MethodDelete, "/archive?path=/archive/example/page.html", "", DeleteArchiveDocument)
 	if response.Code != http.StatusInternalServerError {
 		t.Fatalf("error status = %d, want 500", response.Code)
 	}
-	deleteDocByHTMLPath = func(context.Context, string) (*search.DeleteDocResult, error) {
+	deleteDocByHTMLPath = func(context.Context, string, common.ArchiveAccess) (*search.DeleteDocResult, error) {
 		return &search.DeleteDocResult{Path: "/archive/example/page.html"}, nil
 	}
-	response = performControllerRequest(http.MethodDelete, "/archive?path=/archive/example/page.html", DeleteArchiveDocument)
+	response = performArchiveControllerRequest(http.MethodDelete, "/archive?path=/archive/example/page.html", "", DeleteArchiveDocument)
+	if response.Code != http.StatusOK {
+		t.Fatalf("success status = %d, want 200", response.Code)
+	}
+}
+
+func TestGetRelatedDocumentsBranches(t *testing.T) {
+	oldRelated := findRelatedDocuments
+	t.Cleanup(func() {
+		findRelatedDocuments = oldRelated
+	})
+
+	response := performArchiveControllerRequest(http.MethodGet, "/archive/related", "", GetRelatedDocuments)
+	if response.Code != http.StatusForbidden {
+		t.Fatalf("missing path status = %d, want 403", response.Code)
+	}
+	response = performArchiveControllerRequest(http.MethodGet, "/archive/related?path=/archive/example/page.html&limit=500", "", GetRelatedDocuments)
+	if response.Code != http.StatusForbidden {
+		t.Fatalf("bad limit status = %d, want 403", response.Code)
+	}
+
+	findRelatedDocuments = func(context.Context, string, int, common.ArchiveAccess) (*search.RelatedDocResult, error) {
+		return nil, search.ErrInvalidArchivePath
+	}
+	response = performArchiveControllerRequest(http.MethodGet, "/archive/related?path=/bad", "", GetRelatedDocuments)
+	if response.Code != http.StatusForbidden {
+		t.Fatalf("invalid path status = %d, want 403", response.Code)
+	}
+	findRelatedDocuments = func(context.Context, string, int, common.ArchiveAccess) (*search.RelatedDocResult, error) {
+		return nil, search.ErrArchiveFileNotFound
+	}
+	response = performArchiveControllerRequest(http.MethodGet, "/archive/related?path=/archive/example/page.html", "", GetRelatedDocuments)
+	if response.Code != http.StatusNotFound {
+		t.Fatalf("not found status = %d, want 404", response.Code)
+	}
+	findRelatedDocuments = func(context.Context, string, int, common.ArchiveAccess) (*search.RelatedDocResult, error) {
+		return nil, errors.New("search failed")
+	}
+	response = performArchiveControllerRequest(http.MethodGet, "/archive/related?path=/archive/example/page.html", "", GetRelatedDocuments)
+	if response.Code != http.StatusInternalServerError {
+		t.Fatalf("error status = %d, want 500", response.Code)
+	}
+	findRelatedDocuments = func(_ context.Context, htmlPath string, limit int, _ common.ArchiveAccess) (*search.RelatedDocResult, error) {
+		if htmlPath != "/archive/example/page.html" || limit != 3 {
+			t.Fatalf("unexpected path %q limit %d", htmlPath, limit)
+		}
+		return &search.RelatedDocResult{Path: htmlPath, Documents: []search.RelatedDocument{}}, nil
+	}
+	response = performArchiveControllerRequest(http.MethodGet, "/archive/related?path=/archive/example/page.html&limit=3", "", GetRelatedDocuments)
 	if response.Code != http.StatusOK {
 		t.Fatalf("success status = %d, want 200", response.Code)
 	}
@@ -461,7 +574,7 @@ func TestBackupHandlers(t *testing.T) {
 	if response.Code != http.StatusForbidden {
 		t.Fatalf("restore wrong extension status = %d, want 403", response.Code)
 	}
-	restoreBackupArchive = func(context.Context, string) (*backup.RestoreResult, error) {
+	restoreBackupArchive = func(context.Context, string, backup.RestoreOptions) (*backup.RestoreResult, error) {
 		return &backup.RestoreResult{IndexedDocuments: 4}, nil
 	}
 	body, contentType = multipartBody(t, "file", "backup.zip", "zip content")
@@ -469,7 +582,24 @@ func TestBackupHandlers(t *testing.T) {
 	if response.Code != http.StatusOK {
 		t.Fatalf("restore success status = %d, want 200 body=%s", response.Code, response.Body.String())
 	}
-	restoreBackupArchive = func(context.Context, string) (*backup.RestoreResult, error) {
+	// 预演时把 dryRun 传给恢复流程
+	restoreBackupArchive = func(_ context.Context, _ string, options backup.RestoreOptions) (*backup.RestoreResult, error) {
+		if !options.DryRun {
+			t.Fatal("dryRun=true should request a dry run")
+		}
+		return &backup.RestoreResult{DryRun: true, Plan: &backup.RestorePlan{FilesAdded: 2}}, nil
+	}
+	body, contentType = multipartBody(t, "file", "backup.zip", "zip content")
+	response = performRawControllerRequest(http.MethodPost, "/backup/restore?dryRun=true", body, contentType, RestoreBackup)
+	if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), `"filesAdded":2`) {
+		t.Fatalf("dry run status=%d body=%s", response.Code, response.Body.String())
+	}
+	body, contentType = multipartBody(t, "file", "backup.zip", "zip content")
+	response = performRawControllerRequest(http.MethodPost, "/backup/restore?dryRun=maybe", body, contentType, RestoreBackup)
+	if response.Code != http.StatusForbidden {
+		t.Fatalf("invalid dryRun status = %d, want 403", response.Code)
+	}
+	restoreBackupArchive = func(context.Context, string, backup.RestoreOptions) (*backup.RestoreResult, error) {
 		return nil, errors.New("restore failed")
 	}
 	body, contentType = multipartBody(t, "file", "backup.zip", "zip content")
@@ -477,147 +607,1960 @@ func TestBackupHandlers(t *testing.T) {
 	if response.Code != http.StatusInternalServerError {
 		t.Fatalf("restore error status = %d, want 500", response.Code)
 	}
+	// 改动数据之后失败时返回失败的阶段和回滚结果
+	restoreBackupArchive = func(context.Context, string, backup.RestoreOptions) (*backup.RestoreResult, error) {
+		return nil, &backup.RestoreError{Phase: backup.JobPhaseArchiveRestore, RolledBack: true, Err: errors.New("disk full")}
+	}
+	body, contentType = multipartBody(t, "file", "backup.zip", "zip content")
+	response = performRawControllerRequest(http.MethodPost, "/backup/restore", body, contentType, RestoreBackup)
+	if response.Code != http.StatusInternalServerError || !strings.Contains(response.Body.String(), `"phase":"archive_restore"`) ||
+		!strings.Contains(response.Body.String(), `"rolledBack":true`) {
+		t.Fatalf("rolled back restore status=%d body=%s", response.Code, response.Body.String())
+	}
+	// 解密或校验失败时数据没有改动，按请求错误返回
+	for _, restoreErr := range []error{backup.ErrBackupDecrypt, backup.ErrBackupNotEncrypted, fmt.Errorf("%w: checksum mismatch", backup.ErrBackupIntegrity)} {
+		restoreBackupArchive = func(context.Context, string, backup.RestoreOptions) (*backup.RestoreResult, error) {
+			return nil, restoreErr
+		}
+		body, contentType = multipartBody(t, "file", "backup.zip", "zip content")
+		response = performRawControllerRequest(http.MethodPost, "/backup/restore", body, contentType, RestoreBackup)
+		if response.Code != http.StatusForbidden {
+			t.Fatalf("restore %v status = %d, want 403", restoreErr, response.Code)
+		}
+	}
 }
 
-func TestCORSMiddleware(t *testing.T) {
-	gin.SetMode(gin.TestMode)
-	router := gin.New()
-	router.Use(CORSMiddleware())
-	router.GET("/", func(c *gin.Context) {
-		c.String(http.StatusOK, "ok")
-	})
+func TestVerifyBackupHandler(t *testing.T) {
+	oldVerify := verifyBackupArchive
+	t.Cleanup(func() { verifyBackupArchive = oldVerify })
 
-	response := httptest.NewRecorder()
-	router.ServeHTTP(response, httptest.NewRequest(http.MethodOptions, "/", nil))
-	if response.Code != http.StatusNoContent {
-		t.Fatalf("options status = %d, want 204", response.Code)
+	response := performControllerRequest(http.MethodPost, "/backup/verify", VerifyBackup)
+	if response.Code != http.StatusForbidden {
+		t.Fatalf("verify missing file status = %d, want 403", response.Code)
 	}
 
-	response = httptest.NewRecorder()
-	router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/", nil))
-	if response.Header().Get("Access-Control-Allow-Origin") != "*" || response.Body.String() != "ok" {
-		t.Fatalf("unexpected cors response headers=%v body=%q", response.Header(), response.Body.String())
+	var verifiedPath string
+	verifyBackupArchive = func(_ context.Context, zipPath string) (*backup.VerifyReport, error) {
+		verifiedPath = zipPath
+		if content, err := os.ReadFile(zipPath); err != nil || string(content) != "zip content" {
+			t.Fatalf("uploaded backup content=%q err=%v", content, err)
+		}
+		return &backup.VerifyReport{Valid: false, HTMLFiles: 3, Problems: []string{"1 archive HTML files cannot be parsed"}}, nil
+	}
+	body, contentType := multipartBody(t, "file", "backup.zip", "zip content")
+	response = performRawControllerRequest(http.MethodPost, "/backup/verify", body, contentType, VerifyBackup)
+	if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), `"valid":false`) || !strings.Contains(response.Body.String(), "cannot be parsed") {
+		t.Fatalf("verify status=%d body=%s", response.Code, response.Body.String())
+	}
+	// 上传的临时文件在请求结束后删除
+	if _, err := os.Stat(verifiedPath); !os.IsNotExist(err) {
+		t.Fatalf("uploaded backup %s should be removed, err=%v", verifiedPath, err)
+	}
+
+	verifyBackupArchive = func(context.Context, string) (*backup.VerifyReport, error) {
+		return nil, context.Canceled
+	}
+	body, contentType = multipartBody(t, "file", "backup.zip", "zip content")
+	response = performRawControllerRequest(http.MethodPost, "/backup/verify", body, contentType, VerifyBackup)
+	if response.Code != http.StatusInternalServerError {
+		t.Fatalf("verify error status = %d, want 500", response.Code)
 	}
 }
 
-func TestWebStarterInitializesAndRunsRouter(t *testing.T) {
-	oldInitDB := initDatabase
-	oldCreateIndex := createSearchIndex
-	oldInitQueue := initArchiveQueue
-	oldRun := runGinRouter
+func TestBackupJobHandlers(t *testing.T) {
+	oldStartBackup := startBackupJob
+	oldStartRestore := startRestoreJob
+	oldList := listBackupJobs
+	oldGet := getBackupJob
+	oldCancel := cancelBackupJob
+	oldDelete := deleteBackupJob
+	oldFile := backupJobFile
 	t.Cleanup(func() {
-		initDatabase = oldInitDB
-		createSearchIndex = oldCreateIndex
-		initArchiveQueue = oldInitQueue
-		runGinRouter = oldRun
+		startBackupJob = oldStartBackup
+		startRestoreJob = oldStartRestore
+		listBackupJobs = oldList
+		getBackupJob = oldGet
+		cancelBackupJob = oldCancel
+		deleteBackupJob = oldDelete
+		backupJobFile = oldFile
 	})
+	const jobID = "6f1c2f3e-8d53-4a35-9b3c-1a0f5d0b7e21"
 
-	var calls []string
-	initDatabase = func() { calls = append(calls, "db") }
-	createSearchIndex = func() error {
-		calls = append(calls, "index")
-		return nil
+	startBackupJob = func(context.Context) (*common.BackupJob, error) {
+		return &common.BackupJob{ID: jobID, Kind: backup.JobKindBackup, Status: backup.JobStatusPending}, nil
 	}
-	initArchiveQueue = func() error {
-		calls = append(calls, "queue")
-		return nil
+	response := performControllerRequest(http.MethodPost, "/backupJobs", CreateBackupJob)
+	if response.Code != http.StatusAccepted || !strings.Contains(response.Body.String(), jobID) {
+		t.Fatalf("create backup job status=%d body=%s", response.Code, response.Body.String())
 	}
-	runGinRouter = func(router *gin.Engine, addr string) error {
-		calls = append(calls, "run:"+addr)
-		if len(router.Routes()) == 0 {
-			t.Fatal("router should have registered routes")
+	startBackupJob = func(context.Context) (*common.BackupJob, error) { return nil, errors.New("disk full") }
+	if response := performControllerRequest(http.MethodPost, "/backupJobs", CreateBackupJob); response.Code != http.StatusInternalServerError {
+		t.Fatalf("create backup job error status = %d, want 500", response.Code)
+	}
+
+	var restoreOptions backup.RestoreOptions
+	startRestoreJob = func(_ context.Context, zipPath string, options backup.RestoreOptions) (*common.BackupJob, error) {
+		restoreOptions = options
+		if filepath.Base(zipPath) != "backup.zip" {
+			t.Fatalf("restore job zip path = %q", zipPath)
 		}
-		return errors.New("port used")
+		return &common.BackupJob{ID: jobID, Kind: backup.JobKindRestore, DryRun: options.DryRun}, nil
+	}
+	body, contentType := multipartBody(t, "file", "backup.zip", "zip content")
+	response = performRawControllerRequest(http.MethodPost, "/backupJobs/restore?dryRun=true", body, contentType, CreateRestoreJob)
+	if response.Code != http.StatusAccepted || !restoreOptions.DryRun {
+		t.Fatalf("create restore job status=%d options=%+v body=%s", response.Code, restoreOptions, response.Body.String())
+	}
+	if response := performControllerRequest(http.MethodPost, "/backupJobs/restore", CreateRestoreJob); response.Code != http.StatusForbidden {
+		t.Fatalf("restore job without file status = %d, want 403", response.Code)
 	}
 
-	WebStarter(false)
+	listBackupJobs = func() ([]common.BackupJob, error) {
+		return []common.BackupJob{{ID: jobID, Phase: backup.JobPhaseZip, Percent: 60}}, nil
+	}
+	response = performControllerRequest(http.MethodGet, "/backupJobs", ListBackupJobs)
+	if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), `"percent":60`) {
+		t.Fatalf("list backup jobs status=%d body=%s", response.Code, response.Body.String())
+	}
 
-	if strings.Join(calls, ",") != "db,index,queue,run:0.0.0.0:7845" {
-		t.Fatalf("calls = %#v", calls)
+	getBackupJob = func(id string) (*common.BackupJob, error) {
+		if id != jobID {
+			return nil, backup.ErrBackupJobNotFound
+		}
+		return &common.BackupJob{ID: id, Phase: backup.JobPhaseArchiveCopy, BytesDone: 10, BytesTotal: 20}, nil
+	}
+	response = performPathControllerRequest(http.MethodGet, "/backupJobs/:id", "/backupJobs/"+jobID, GetBackupJob)
+	if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), `"phase":"archive_copy"`) {
+		t.Fatalf("get backup job status=%d body=%s", response.Code, response.Body.String())
+	}
+	if response := performPathControllerRequest(http.MethodGet, "/backupJobs/:id", "/backupJobs/missing", GetBackupJob); response.Code != http.StatusNotFound {
+		t.Fatalf("get missing job status = %d, want 404", response.Code)
+	}
+
+	zipPath := filepath.Join(t.TempDir(), jobID+".zip")
+	if err := os.WriteFile(zipPath, []byte("zip content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	backupJobFile = func(string) (string, string, error) { return zipPath, "dataark-backup-20260427-120000.zip", nil }
+	response = performPathControllerRequest(http.MethodGet, "/backupJobs/:id/download", "/backupJobs/"+jobID+"/download", DownloadBackupJob)
+	if response.Code != http.StatusOK || response.Body.String() != "zip content" ||
+		!strings.Contains(response.Header().Get("Content-Disposition"), "dataark-backup-20260427-120000.zip") {
+		t.Fatalf("download job status=%d headers=%v", response.Code, response.Header())
+	}
+	backupJobFile = func(string) (string, string, error) { return "", "", backup.ErrBackupJobNoFile }
+	if response := performPathControllerRequest(http.MethodGet, "/backupJobs/:id/download", "/backupJobs/"+jobID+"/download", DownloadBackupJob); response.Code != http.StatusNotFound {
+		t.Fatalf("download unfinished job status = %d, want 404", response.Code)
+	}
+
+	cancelBackupJob = func(id string) (*common.BackupJob, error) {
+		return &common.BackupJob{ID: id, CancelRequested: true}, nil
+	}
+	response = performPathControllerRequest(http.MethodPost, "/backupJobs/:id/cancel", "/backupJobs/"+jobID+"/cancel", CancelBackupJob)
+	if response.Code != http.StatusAccepted || !strings.Contains(response.Body.String(), `"cancelRequested":true`) {
+		t.Fatalf("cancel job status=%d body=%s", response.Code, response.Body.String())
+	}
+	cancelBackupJob = func(string) (*common.BackupJob, error) { return nil, backup.ErrBackupJobNotActive }
+	if response := performPathControllerRequest(http.MethodPost, "/backupJobs/:id/cancel", "/backupJobs/"+jobID+"/cancel", CancelBackupJob); response.Code != http.StatusConflict {
+		t.Fatalf("cancel finished job status = %d, want 409", response.Code)
+	}
+
+	deleteBackupJob = func(string) error { return backup.ErrBackupJobActive }
+	if response := performPathControllerRequest(http.MethodDelete, "/backupJobs/:id", "/backupJobs/"+jobID, DeleteBackupJob); response.Code != http.StatusConflict {
+		t.Fatalf("delete running job status = %d, want 409", response.Code)
+	}
+	deleteBackupJob = func(string) error { return nil }
+	if response := performPathControllerRequest(http.MethodDelete, "/backupJobs/:id", "/backupJobs/"+jobID, DeleteBackupJob); response.Code != http.StatusOK {
+		t.Fatalf("delete job status = %d, want 200", response.Code)
 	}
 }
 
-func TestWebStarterStopsWhenQueueInitializationFails(t *testing.T) {
-	oldInitDB := initDatabase
-	oldCreateIndex := createSearchIndex
-	oldInitQueue := initArchiveQueue
-	oldRun := runGinRouter
+func TestBackupUploadHandlers(t *testing.T) {
+	oldCreate := createBackupUpload
+	oldGet := getBackupUpload
+	oldWrite := writeBackupUpload
+	oldDelete := deleteBackupUpload
+	oldStart := startUploadedRestoreJob
 	t.Cleanup(func() {
-		initDatabase = oldInitDB
-		createSearchIndex = oldCreateIndex
-		initArchiveQueue = oldInitQueue
-		runGinRouter = oldRun
+		createBackupUpload = oldCreate
+		getBackupUpload = oldGet
+		writeBackupUpload = oldWrite
+		deleteBackupUpload = oldDelete
+		startUploadedRestoreJob = oldStart
 	})
+	const uploadID = "0b8a4c2d-5e6f-4a1b-9c3d-7e8f9a0b1c2d"
 
-	initDatabase = func() {}
-	createSearchIndex = func() error { return nil }
-	initArchiveQueue = func() error { return errors.New("queue failed") }
-	runGinRouter = func(*gin.Engine, string) error {
-		t.Fatal("router should not run when queue initialization fails")
-		return nil
+	createBackupUpload = func(_ context.Context, fileName string, size int64) (*backup.BackupUpload, error) {
+		if fileName != "backup.zip" {
+			return nil, backup.ErrInvalidBackupUpload
+		}
+		return &backup.BackupUpload{ID: uploadID, FileName: fileName, Size: size}, nil
+	}
+	response := performJSONControllerRequest(http.MethodPost, "/backupUploads", `{"fileName":"backup.zip","size":20}`, CreateBackupUpload)
+	if response.Code != http.StatusCreated || !strings.Contains(response.Body.String(), uploadID) {
+		t.Fatalf("create upload status=%d body=%s", response.Code, response.Body.String())
+	}
+	if response := performJSONControllerRequest(http.MethodPost, "/backupUploads", `{"fileName":"backup.tar","size":20}`, CreateBackupUpload); response.Code != http.StatusForbidden {
+		t.Fatalf("create invalid upload status = %d, want 403", response.Code)
 	}
 
-	WebStarter(true)
-}
+	getBackupUpload = func(id string) (*backup.BackupUpload, error) {
+		if id != uploadID {
+			return nil, backup.ErrBackupUploadNotFound
+		}
+		return &backup.BackupUpload{ID: id, Size: 20, Offset: 8}, nil
+	}
+	response = performPathControllerRequest(http.MethodGet, "/backupUploads/:id", "/backupUploads/"+uploadID, GetBackupUpload)
+	if response.Code != http.StatusOK || response.Header().Get("Upload-Offset") != "8" {
+		t.Fatalf("get upload status=%d headers=%v", response.Code, response.Header())
+	}
+	if response := performPathControllerRequest(http.MethodGet, "/backupUploads/:id", "/backupUploads/missing", GetBackupUpload); response.Code != http.StatusNotFound {
+		t.Fatalf("get missing upload status = %d, want 404", response.Code)
+	}
 
-func performControllerRequest(method string, target string, handler gin.HandlerFunc) *httptest.ResponseRecorder {
-	return performRawControllerRequest(method, target, nil, "", handler)
-}
+	patch := func(offset string, body string) *httptest.ResponseRecorder {
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+		router.PATCH("/backupUploads/:id", WriteBackupUpload)
+		request := httptest.NewRequest(http.MethodPatch, "/backupUploads/"+uploadID, strings.NewReader(body))
+		if offset != "" {
+			request.Header.Set("Upload-Offset", offset)
+		}
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		return response
+	}
+	writeBackupUpload = func(_ context.Context, id string, offset int64, r io.Reader) (*backup.BackupUpload, error) {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if offset != 8 {
+			return &backup.BackupUpload{ID: id, Size: 20, Offset: 8}, backup.ErrBackupUploadOffset
+		}
+		return &backup.BackupUpload{ID: id, Size: 20, Offset: offset + int64(len(data))}, nil
+	}
+	response = patch("8", "chunk")
+	if response.Code != http.StatusOK || response.Header().Get("Upload-Offset") != "13" {
+		t.Fatalf("write chunk status=%d headers=%v", response.Code, response.Header())
+	}
+	// 位置不一致时返回服务器上的进度，客户端据此续传
+	response = patch("0", "chunk")
+	if response.Code != http.StatusConflict || response.Header().Get("Upload-Offset") != "8" || !strings.Contains(response.Body.String(), `"offset":8`) {
+		t.Fatalf("stale offset status=%d headers=%v body=%s", response.Code, response.Header(), response.Body.String())
+	}
+	if response := patch("", "chunk"); response.Code != http.StatusForbidden {
+		t.Fatalf("missing offset status = %d, want 403", response.Code)
+	}
 
-func performJSONControllerRequest(method string, target string, body string, handler gin.HandlerFunc) *httptest.ResponseRecorder {
-	return performRawControllerRequest(method, target, strings.NewReader(body), "application/json", handler)
-}
+	startUploadedRestoreJob = func(_ context.Context, id string, options backup.RestoreOptions) (*common.BackupJob, error) {
+		if !options.DryRun {
+			return nil, backup.ErrBackupUploadIncomplete
+		}
+		return &common.BackupJob{ID: id, Kind: backup.JobKindRestore, DryRun: true}, nil
+	}
+	response = performPathControllerRequest(http.MethodPost, "/backupUploads/:id/restore", "/backupUploads/"+uploadID+"/restore?dryRun=true", CreateUploadedRestoreJob)
+	if response.Code != http.StatusAccepted || !strings.Contains(response.Body.String(), `"dryRun":true`) {
+		t.Fatalf("restore upload status=%d body=%s", response.Code, response.Body.String())
+	}
+	if response := performPathControllerRequest(http.MethodPost, "/backupUploads/:id/restore", "/backupUploads/"+uploadID+"/restore", CreateUploadedRestoreJob); response.Code != http.StatusConflict {
+		t.Fatalf("restore incomplete upload status = %d, want 409", response.Code)
+	}
 
-func performPathControllerRequest(method string, routePath string, target string, handler gin.HandlerFunc) *httptest.ResponseRecorder {
-	gin.SetMode(gin.TestMode)
-	router := gin.New()
-	router.Handle(method, routePath, handler)
-	request := httptest.NewRequest(method, target, nil)
-	response := httptest.NewRecorder()
-	router.ServeHTTP(response, request)
-	return response
+	deleteBackupUpload = func(string) error { return nil }
+	if response := performPathControllerRequest(http.MethodDelete, "/backupUploads/:id", "/backupUploads/"+uploadID, DeleteBackupUpload); response.Code != http.StatusOK {
+		t.Fatalf("delete upload status = %d, want 200", response.Code)
+	}
 }
 
-func performRawControllerRequest(method string, target string, body io.Reader, contentType string, handler gin.HandlerFunc) *httptest.ResponseRecorder {
-	gin.SetMode(gin.TestMode)
-	router := gin.New()
-	routePath := strings.Split(target, "?")[0]
-	router.Handle(method, routePath, handler)
-	request := httptest.NewRequest(method, target, body)
-	if contentType != "" {
-		request.Header.Set("Content-Type", contentType)
+func TestBackupSnapshotHandlers(t *testing.T) {
+	oldCreate := createBackupSnapshot
+	oldList := listBackupSnapshots
+	oldRestore := restoreBackupSnapshot
+	oldGet := getBackupSnapshot
+	oldWrite := writeBackupSnapshotZip
+	oldDelete := deleteBackupSnapshot
+	oldShip := shipBackupSnapshot
+	t.Cleanup(func() {
+		shipBackupSnapshot = oldShip
+		createBackupSnapshot = oldCreate
+		listBackupSnapshots = oldList
+		restoreBackupSnapshot = oldRestore
+		getBackupSnapshot = oldGet
+		writeBackupSnapshotZip = oldWrite
+		deleteBackupSnapshot = oldDelete
+	})
+
+	createBackupSnapshot = func(context.Context) (*backup.Snapshot, error) {
+		return &backup.Snapshot{
+			ID:            "20260427-120000",
+			SnapshotStats: backup.SnapshotStats{FileCount: 3, NewBlobs: 1},
+			Files:         []backup.SnapshotFile{{Path: "archive/example.com/a.html"}},
+		}, nil
+	}
+	shipBackupSnapshot = func(context.Context, string) ([]backup.ShipResult, error) { return nil, nil }
+	response := performControllerRequest(http.MethodPost, "/backups", CreateBackupSnapshot)
+	if response.Code != http.StatusCreated || !strings.Contains(response.Body.String(), `"newBlobs":1`) || strings.Contains(response.Body.String(), "a.html") {
+		t.Fatalf("create status=%d body=%s, want summary without file list", response.Code, response.Body.String())
+	}
+	// 上传失败不影响本机快照，返回每个目标的结果
+	shipBackupSnapshot = func(_ context.Context, id string) ([]backup.ShipResult, error) {
+		return []backup.ShipResult{{Target: "nas", Object: backup.SnapshotZipName(id), Error: "connection refused"}}, errors.New("upload to nas: connection refused")
+	}
+	response = performControllerRequest(http.MethodPost, "/backups", CreateBackupSnapshot)
+	if response.Code != http.StatusCreated || !strings.Contains(response.Body.String(), `"error":"connection refused"`) || !strings.Contains(response.Body.String(), `"newBlobs":1`) {
+		t.Fatalf("create with failed upload status=%d body=%s", response.Code, response.Body.String())
+	}
+	createBackupSnapshot = func(context.Context) (*backup.Snapshot, error) {
+		return nil, errors.New("disk full")
+	}
+	if response := performControllerRequest(http.MethodPost, "/backups", CreateBackupSnapshot); response.Code != http.StatusInternalServerError {
+		t.Fatalf("create error status = %d, want 500", response.Code)
 	}
-	response := httptest.NewRecorder()
-	router.ServeHTTP(response, request)
-	return response
-}
 
-func decodeResponse(t *testing.T, response *httptest.ResponseRecorder) map[string]interface{} {
-	t.Helper()
-	var payload map[string]interface{}
-	if err := json.Unmarshal(response.Body.Bytes(), &payload); err != nil {
-		t.Fatalf("failed to decode response: %v", err)
+	listBackupSnapshots = func() ([]backup.SnapshotSummary, error) {
+		return []backup.SnapshotSummary{{ID: "20260427-120000"}}, nil
+	}
+	if response := performControllerRequest(http.MethodGet, "/backups", ListBackupSnapshots); response.Code != http.StatusOK || !strings.Contains(response.Body.String(), "20260427-120000") {
+		t.Fatalf("list status=%d body=%s", response.Code, response.Body.String())
 	}
-	return payload
-}
 
-func contains(value string, part string) bool {
-	return strings.Contains(value, part)
+	restoreBackupSnapshot = func(_ context.Context, id string) (*backup.RestoreResult, error) {
+		switch id {
+		case "missing":
+			return nil, backup.ErrSnapshotNotFound
+		case "bad..id":
+			return nil, backup.ErrInvalidSnapshotID
+		case "broken":
+			return nil, backup.ErrBlobCorrupted
+		}
+		return &backup.RestoreResult{IndexedDocuments: 2}, nil
+	}
+	for id, want := range map[string]int{
+		"20260427-120000": http.StatusOK,
+		"missing":         http.StatusNotFound,
+		"bad..id":         http.StatusForbidden,
+		"broken":          http.StatusInternalServerError,
+	} {
+		response := performPathControllerRequest(http.MethodPost, "/backups/:id/restore", "/backups/"+id+"/restore", RestoreBackupSnapshot)
+		if response.Code != want {
+			t.Fatalf("restore %s status = %d, want %d", id, response.Code, want)
+		}
+	}
+
+	getBackupSnapshot = func(id string) (*backup.Snapshot, error) {
+		if id == "missing" {
+			return nil, backup.ErrSnapshotNotFound
+		}
+		return &backup.Snapshot{ID: id}, nil
+	}
+	writeBackupSnapshotZip = func(_ context.Context, id string, w io.Writer) error {
+		_, err := io.WriteString(w, "zip:"+id)
+		return err
+	}
+	response = performPathControllerRequest(http.MethodGet, "/backups/:id", "/backups/20260427-120000", DownloadBackupSnapshot)
+	if response.Code != http.StatusOK || response.Body.String() != "zip:20260427-120000" {
+		t.Fatalf("download status=%d body=%s", response.Code, response.Body.String())
+	}
+	if disposition := response.Header().Get("Content-Disposition"); !strings.Contains(disposition, "dataark-backup-20260427-120000.zip") {
+		t.Fatalf("Content-Disposition = %q", disposition)
+	}
+	if response := performPathControllerRequest(http.MethodGet, "/backups/:id", "/backups/missing", DownloadBackupSnapshot); response.Code != http.StatusNotFound {
+		t.Fatalf("download missing status = %d, want 404", response.Code)
+	}
+
+	deleteBackupSnapshot = func(_ context.Context, id string) (*backup.PruneResult, error) {
+		if id == "missing" {
+			return nil, backup.ErrSnapshotNotFound
+		}
+		return &backup.PruneResult{DeletedSnapshots: []string{id}, RemovedBlobs: 2}, nil
+	}
+	response = performPathControllerRequest(http.MethodDelete, "/backups/:id", "/backups/20260427-120000", DeleteBackupSnapshot)
+	if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), `"removedBlobs":2`) {
+		t.Fatalf("delete status=%d body=%s", response.Code, response.Body.String())
+	}
+	if response := performPathControllerRequest(http.MethodDelete, "/backups/:id", "/backups/missing", DeleteBackupSnapshot); response.Code != http.StatusNotFound {
+		t.Fatalf("delete missing status = %d, want 404", response.Code)
+	}
 }
 
-func multipartBody(t *testing.T, fieldName string, fileName string, content string) (*bytes.Buffer, string) {
-	t.Helper()
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
-	part, err := writer.CreateFormFile(fieldName, fileName)
-	if err != nil {
-		t.Fatal(err)
+func TestBackupTargetHandlers(t *testing.T) {
+	oldListTargets := listBackupTargets
+	oldListBackups := listTargetBackups
+	oldRestore := restoreFromTarget
+	t.Cleanup(func() {
+		listBackupTargets = oldListTargets
+		listTargetBackups = oldListBackups
+		restoreFromTarget = oldRestore
+	})
+
+	listBackupTargets = func() []backup.TargetInfo {
+		return []backup.TargetInfo{{Name: "minio", Type: backup.TargetTypeS3, Location: "s3://ak:xxxxx@backups/dataark"}}
 	}
-	if _, err := part.Write([]byte(content)); err != nil {
-		t.Fatal(err)
+	response := performControllerRequest(http.MethodGet, "/backupTargets", ListBackupTargets)
+	if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), `"name":"minio"`) {
+		t.Fatalf("list targets status=%d body=%s", response.Code, response.Body.String())
 	}
-	if err := writer.Close(); err != nil {
-		t.Fatal(err)
+
+	listTargetBackups = func(_ context.Context, name string) ([]backup.TargetObject, error) {
+		if name != "minio" {
+			return nil, backup.ErrBackupTargetNotFound
+		}
+		return []backup.TargetObject{{Name: "dataark-backup-20260427-120000.zip", Size: 42}}, nil
+	}
+	response = performPathControllerRequest(http.MethodGet, "/backupTargets/:name/backups", "/backupTargets/minio/backups", ListTargetBackups)
+	if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), "dataark-backup-20260427-120000.zip") {
+		t.Fatalf("list backups status=%d body=%s", response.Code, response.Body.String())
+	}
+	if response := performPathControllerRequest(http.MethodGet, "/backupTargets/:name/backups", "/backupTargets/missing/backups", ListTargetBackups); response.Code != http.StatusNotFound {
+		t.Fatalf("list missing target status = %d, want 404", response.Code)
+	}
+
+	restoreFromTarget = func(_ context.Context, target string, name string, options backup.RestoreOptions) (*backup.RestoreResult, error) {
+		switch name {
+		case "../escape.zip":
+			return nil, backup.ErrInvalidBackupName
+		case "missing.zip":
+			return nil, backup.ErrBackupObjectNotFound
+		case "broken.zip":
+			return nil, errors.New("zip: not a valid zip file")
+		}
+		if options.DryRun {
+			return &backup.RestoreResult{DryRun: true, Plan: &backup.RestorePlan{}}, nil
+		}
+		return &backup.RestoreResult{IndexedDocuments: 3}, nil
+	}
+	restore := func(body string) *httptest.ResponseRecorder {
+		router := gin.New()
+		router.POST("/backupTargets/:name/restore", RestoreFromBackupTarget)
+		request := httptest.NewRequest(http.MethodPost, "/backupTargets/minio/restore", strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/json")
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		return response
+	}
+	for body, want := range map[string]int{
+		`{"name":"dataark-backup-20260427-120000.zip"}`: http.StatusOK,
+		`{"name":"../escape.zip"}`:                      http.StatusForbidden,
+		`{"name":"missing.zip"}`:                        http.StatusNotFound,
+		`{"name":"broken.zip"}`:                         http.StatusInternalServerError,
+		`{}`:                                            http.StatusForbidden,
+	} {
+		if response := restore(body); response.Code != want {
+			t.Fatalf("restore %s status = %d, want %d", body, response.Code, want)
+		}
+	}
+	if response := restore(`{"name":"dataark-backup-20260427-120000.zip","dryRun":true}`); response.Code != http.StatusOK || !strings.Contains(response.Body.String(), `"dryRun":true`) {
+		t.Fatalf("dry run status=%d body=%s", response.Code, response.Body.String())
+	}
+}
+
+func TestSelectiveRestoreHandlers(t *testing.T) {
+	oldRestore := restoreBackupArchive
+	oldSelected := restoreSelectedArchive
+	oldSelectedTarget := restoreSelectedTarget
+	t.Cleanup(func() {
+		restoreBackupArchive = oldRestore
+		restoreSelectedArchive = oldSelected
+		restoreSelectedTarget = oldSelectedTarget
+	})
+
+	restoreBackupArchive = func(context.Context, string, backup.RestoreOptions) (*backup.RestoreResult, error) {
+		t.Fatal("selective restore should not replace the whole archive")
+		return nil, nil
+	}
+	var gotSelection backup.RestoreSelection
+	restoreSelectedArchive = func(_ context.Context, _ string, selection backup.RestoreSelection) (*backup.SelectiveRestoreResult, error) {
+		gotSelection = selection
+		switch {
+		case len(selection.Domains) > 0 && selection.Domains[0] == "..":
+			return nil, fmt.Errorf("%w: domain", backup.ErrInvalidRestoreSelection)
+		case len(selection.Domains) > 0 && selection.Domains[0] == "missing.net":
+			return nil, fmt.Errorf("%w: missing.net", backup.ErrRestoreSelectionNotFound)
+		}
+		return &backup.SelectiveRestoreResult{RestoredFiles: 3}, nil
+	}
+	restore := func(target string, fields map[string][]string) *httptest.ResponseRecorder {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		part, err := writer.CreateFormFile("file", "backup.zip")
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write([]byte("zip content"))
+		for name, values := range fields {
+			for _, value := range values {
+				writer.WriteField(name, value)
+			}
+		}
+		writer.Close()
+		return performRawControllerRequest(http.MethodPost, target, body, writer.FormDataContentType(), RestoreBackup)
+	}
+
+	response := restore("/backup/restore", map[string][]string{"domains": {"example.com, example.org", "example.net"}, "paths": {"example.io/a.html"}})
+	if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), `"restoredFiles":3`) {
+		t.Fatalf("selective restore status=%d body=%s", response.Code, response.Body.String())
+	}
+	if strings.Join(gotSelection.Domains, ",") != "example.com,example.org,example.net" || len(gotSelection.Paths) != 1 {
+		t.Fatalf("selection = %+v", gotSelection)
+	}
+	for domain, want := range map[string]int{"..": http.StatusForbidden, "missing.net": http.StatusNotFound} {
+		if response := restore("/backup/restore", map[string][]string{"domains": {domain}}); response.Code != want {
+			t.Fatalf("domain %s status = %d, want %d", domain, response.Code, want)
+		}
+	}
+	if response := restore("/backup/restore?dryRun=true", map[string][]string{"domains": {"example.com"}}); response.Code != http.StatusForbidden {
+		t.Fatalf("selective dry run status = %d, want 403", response.Code)
+	}
+
+	restoreSelectedTarget = func(_ context.Context, target string, name string, selection backup.RestoreSelection) (*backup.SelectiveRestoreResult, error) {
+		if target != "minio" {
+			return nil, backup.ErrBackupTargetNotFound
+		}
+		return &backup.SelectiveRestoreResult{RestoredFiles: len(selection.Paths)}, nil
+	}
+	for target, want := range map[string]int{"minio": http.StatusOK, "missing": http.StatusNotFound} {
+		router := gin.New()
+		router.POST("/backupTargets/:name/restore", RestoreFromBackupTarget)
+		request := httptest.NewRequest(http.MethodPost, "/backupTargets/"+target+"/restore", strings.NewReader(`{"name":"backup.zip","paths":["example.com/a.html"]}`))
+		request.Header.Set("Content-Type", "application/json")
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		if response.Code != want {
+			t.Fatalf("target %s selective restore status=%d body=%s", target, response.Code, response.Body.String())
+		}
+	}
+}
+
+func TestBackupScheduleHandlers(t *testing.T) {
+	oldGet := getBackupSchedule
+	oldUpdate := updateBackupSchedule
+	t.Cleanup(func() {
+		getBackupSchedule = oldGet
+		updateBackupSchedule = oldUpdate
+	})
+
+	getBackupSchedule = func() (*backup.ScheduleSettings, error) {
+		return &backup.ScheduleSettings{BackupSchedule: common.BackupSchedule{Schedule: "0 3 * * *", KeepLast: 7}}, nil
+	}
+	response := performControllerRequest(http.MethodGet, "/backupSchedule", GetBackupSchedule)
+	if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), `"schedule":"0 3 * * *"`) {
+		t.Fatalf("get status=%d body=%s", response.Code, response.Body.String())
+	}
+
+	var saved common.BackupSchedule
+	updateBackupSchedule = func(schedule common.BackupSchedule, _ string) (*backup.ScheduleSettings, error) {
+		if schedule.Schedule == "bad" {
+			return nil, fmt.Errorf("%w: %w", backup.ErrInvalidBackupSchedule, backup.ErrInvalidCronSchedule)
+		}
+		saved = schedule
+		return &backup.ScheduleSettings{BackupSchedule: schedule}, nil
+	}
+	response = performJSONControllerRequest(http.MethodPut, "/backupSchedule", `{"schedule":"@daily","keepLast":3,"keepDaily":7,"keepWeekly":4}`, UpdateBackupSchedule)
+	if response.Code != http.StatusOK {
+		t.Fatalf("update status=%d body=%s", response.Code, response.Body.String())
+	}
+	if saved.Schedule != "@daily" || saved.KeepLast != 3 || saved.KeepDaily != 7 || saved.KeepWeekly != 4 {
+		t.Fatalf("saved %+v", saved)
+	}
+	if response := performJSONControllerRequest(http.MethodPut, "/backupSchedule", `{"schedule":"bad"}`, UpdateBackupSchedule); response.Code != http.StatusForbidden {
+		t.Fatalf("invalid schedule status = %d, want 403", response.Code)
+	}
+	if response := performJSONControllerRequest(http.MethodPut, "/backupSchedule", `{"keepLast":"many"}`, UpdateBackupSchedule); response.Code != http.StatusForbidden {
+		t.Fatalf("malformed body status = %d, want 403", response.Code)
+	}
+}
+
+func TestSearchSettingsHandlers(t *testing.T) {
+	oldGet := getIndexSettings
+	oldUpdate := updateIndexSettings
+	t.Cleanup(func() {
+		getIndexSettings = oldGet
+		updateIndexSettings = oldUpdate
+	})
+
+	getIndexSettings = func() (*search.IndexSettingsRecord, error) {
+		return &search.IndexSettingsRecord{Version: 2, Settings: search.DefaultIndexSettings()}, nil
+	}
+	response := performControllerRequest(http.MethodGet, "/searchSettings", GetSearchSettings)
+	if response.Code != http.StatusOK {
+		t.Fatalf("get status = %d, want 200", response.Code)
+	}
+	data := decodeResponse(t, response)["Data"].(map[string]interface{})
+	if data["version"] != float64(2) {
+		t.Fatalf("version = %#v, want 2", data["version"])
+	}
+	getIndexSettings = func() (*search.IndexSettingsRecord, error) {
+		return nil, errors.New("db down")
+	}
+	response = performControllerRequest(http.MethodGet, "/searchSettings", GetSearchSettings)
+	if response.Code != http.StatusInternalServerError {
+		t.Fatalf("get error status = %d, want 500", response.Code)
+	}
+
+	response = performJSONControllerRequest(http.MethodPut, "/searchSettings", `{"settings":{}}`, UpdateSearchSettings)
+	if response.Code != http.StatusForbidden {
+		t.Fatalf("missing version status = %d, want 403", response.Code)
+	}
+
+	cases := []struct {
+		err        error
+		wantStatus int
+	}{
+		{err: nil, wantStatus: http.StatusOK},
+		{err: search.ErrInvalidIndexSettings, wantStatus: http.StatusForbidden},
+		{err: common.ErrSearchIndexSettingVersionConflict, wantStatus: http.StatusConflict},
+		{err: errors.New("meili down"), wantStatus: http.StatusInternalServerError},
+	}
+	for _, tc := range cases {
+		updateIndexSettings = func(_ context.Context, settings search.IndexSettings, version int, _ string) (*search.IndexSettingsRecord, error) {
+			if version != 2 || settings.StopWords[0] != "the" {
+				t.Fatalf("unexpected update input version=%d settings=%#v", version, settings)
+			}
+			if tc.err != nil {
+				return nil, tc.err
+			}
+			return &search.IndexSettingsRecord{Version: 3}, nil
+		}
+		response = performJSONControllerRequest(http.MethodPut, "/searchSettings", `{"version":2,"settings":{"stopWords":["the"]}}`, UpdateSearchSettings)
+		if response.Code != tc.wantStatus {
+			t.Fatalf("update err=%v status = %d, want %d", tc.err, response.Code, tc.wantStatus)
+		}
+	}
+}
+
+func TestCORSMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(CORSMiddleware())
+	router.GET("/", func(c *gin.Context) {
+		c.String(http.StatusOK, "ok")
+	})
+
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, httptest.NewRequest(http.MethodOptions, "/", nil))
+	if response.Code != http.StatusNoContent {
+		t.Fatalf("options status = %d, want 204", response.Code)
+	}
+
+	response = httptest.NewRecorder()
+	router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/", nil))
+	if response.Header().Get("Access-Control-Allow-Origin") != "*" || response.Body.String() != "ok" {
+		t.Fatalf("unexpected cors response headers=%v body=%q", response.Header(), response.Body.String())
+	}
+}
+
+func TestWebStarterInitializesAndRunsRouter(t *testing.T) {
+	oldInitKeys := initJWTKeys
+	oldInitDB := initDatabase
+	oldCreateIndex := createSearchIndex
+	oldInitQueue := initArchiveQueue
+	oldScheduler := startBackupScheduler
+	oldTargets := initBackupTargets
+	oldEncryption := initBackupEncryption
+	oldJobs := initBackupJobs
+	oldRun := runGinRouter
+	t.Cleanup(func() {
+		initJWTKeys = oldInitKeys
+		initDatabase = oldInitDB
+		createSearchIndex = oldCreateIndex
+		initArchiveQueue = oldInitQueue
+		startBackupScheduler = oldScheduler
+		initBackupTargets = oldTargets
+		initBackupEncryption = oldEncryption
+		initBackupJobs = oldJobs
+		runGinRouter = oldRun
+	})
+
+	var calls []string
+	initJWTKeys = func() error {
+		calls = append(calls, "keys")
+		return nil
+	}
+	initBackupTargets = func() error {
+		calls = append(calls, "targets")
+		return nil
+	}
+	initBackupEncryption = func() error {
+		calls = append(calls, "encryption")
+		return nil
+	}
+	initDatabase = func() { calls = append(calls, "db") }
+	initBackupJobs = func() error {
+		calls = append(calls, "jobs")
+		return nil
+	}
+	createSearchIndex = func() error {
+		calls = append(calls, "index")
+		return nil
+	}
+	initArchiveQueue = func() error {
+		calls = append(calls, "queue")
+		return nil
+	}
+	startBackupScheduler = func() error {
+		calls = append(calls, "scheduler")
+		return nil
+	}
+	runGinRouter = func(router *gin.Engine, addr string) error {
+		calls = append(calls, "run:"+addr)
+		if len(router.Routes()) == 0 {
+			t.Fatal("router should have registered routes")
+		}
+		return errors.New("port used")
+	}
+
+	WebStarter(false)
+
+	if strings.Join(calls, ",") != "keys,targets,encryption,db,index,jobs,queue,scheduler,run:0.0.0.0:7845" {
+		t.Fatalf("calls = %#v", calls)
+	}
+}
+
+func TestWebStarterEnforcesRoutePermissions(t *testing.T) {
+	oldInitKeys := initJWTKeys
+	oldInitDB := initDatabase
+	oldCreateIndex := createSearchIndex
+	oldInitQueue := initArchiveQueue
+	oldScheduler := startBackupScheduler
+	oldTargets := initBackupTargets
+	oldEncryption := initBackupEncryption
+	oldJobs := initBackupJobs
+	oldRun := runGinRouter
+	t.Cleanup(func() {
+		initJWTKeys = oldInitKeys
+		initDatabase = oldInitDB
+		createSearchIndex = oldCreateIndex
+		initArchiveQueue = oldInitQueue
+		startBackupScheduler = oldScheduler
+		initBackupTargets = oldTargets
+		initBackupEncryption = oldEncryption
+		initBackupJobs = oldJobs
+		runGinRouter = oldRun
+	})
+	initJWTKeys = func() error { return nil }
+	initDatabase = func() {}
+	createSearchIndex = func() error { return nil }
+	initArchiveQueue = func() error { return nil }
+	startBackupScheduler = func() error { return nil }
+	initBackupTargets = func() error { return nil }
+	initBackupEncryption = func() error { return nil }
+	initBackupJobs = func() error { return nil }
+	var router *gin.Engine
+	runGinRouter = func(r *gin.Engine, _ string) error {
+		router = r
+		return nil
+	}
+	WebStarter(false)
+
+	role := common.RoleViewer
+	totpEnabled, mfa := false, false
+	withAuthFakes(t,
+		func(header string) (string, error) { return "token", nil },
+		func(token string) (*common.Claims, error) { return &common.Claims{UserID: 1, MFA: mfa}, nil },
+		func(id uint) (*common.User, error) {
+			return &common.User{ID: id, Username: "intern", Role: role, TOTPEnabled: totpEnabled}, nil
+		},
+	)
+	serve := func(method string, target string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, target, nil)
+		request.Header.Set("Authorization", "Bearer token")
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		return response
+	}
+	denied := func(response *httptest.ResponseRecorder) bool {
+		return response.Code == http.StatusForbidden && strings.Contains(response.Body.String(), "Permission denied")
+	}
+
+	for _, route := range [][2]string{
+		{http.MethodPost, "/api/backup/restore"},
+		{http.MethodPost, "/api/backup/verify"},
+		{http.MethodPost, "/api/backup"},
+		{http.MethodPost, "/api/archiveConsistency/repair"},
+		{http.MethodDelete, "/api/archive"},
+		{http.MethodPost, "/api/register"},
+		{http.MethodPut, "/api/searchSettings"},
+		{http.MethodPut, "/api/archive/visibility"},
+		{http.MethodPost, "/api/teams"},
+		{http.MethodPost, "/api/backups"},
+		{http.MethodGet, "/api/backups/20260427-120000"},
+		{http.MethodDelete, "/api/backups/20260427-120000"},
+		{http.MethodPut, "/api/backupSchedule"},
+		{http.MethodGet, "/api/backupTargets"},
+		{http.MethodPost, "/api/backupTargets/nas/restore"},
+		{http.MethodPost, "/api/backupJobs"},
+		{http.MethodPost, "/api/backupJobs/restore"},
+		{http.MethodGet, "/api/backupJobs/6f1c2f3e-8d53-4a35-9b3c-1a0f5d0b7e21/download"},
+		{http.MethodPost, "/api/backupJobs/6f1c2f3e-8d53-4a35-9b3c-1a0f5d0b7e21/cancel"},
+		{http.MethodPost, "/api/backupUploads"},
+		{http.MethodPatch, "/api/backupUploads/0b8a4c2d-5e6f-4a1b-9c3d-7e8f9a0b1c2d"},
+		{http.MethodPost, "/api/backupUploads/0b8a4c2d-5e6f-4a1b-9c3d-7e8f9a0b1c2d/restore"},
+	} {
+		if response := serve(route[0], route[1]); !denied(response) {
+			t.Fatalf("viewer %s %s status = %d body=%s, want permission denied", route[0], route[1], response.Code, response.Body.String())
+		}
+	}
+	if response := serve(http.MethodGet, "/api/search"); denied(response) {
+		t.Fatal("viewer should be allowed to search")
+	}
+
+	role = common.RoleEditor
+	if response := serve(http.MethodDelete, "/api/archive"); denied(response) {
+		t.Fatal("editor should be allowed to delete archives")
+	}
+	if response := serve(http.MethodPost, "/api/backup/restore"); !denied(response) {
+		t.Fatalf("editor restore status = %d, want permission denied", response.Code)
+	}
+
+	role = common.RoleAdmin
+	if response := serve(http.MethodPost, "/api/backup/restore"); !denied(response) || !strings.Contains(response.Body.String(), "two-factor") {
+		t.Fatalf("admin without 2fa restore status = %d body=%s, want permission denied", response.Code, response.Body.String())
+	}
+	totpEnabled = true
+	if response := serve(http.MethodPost, "/api/backup/restore"); !denied(response) {
+		t.Fatalf("admin session without 2fa login restore status = %d, want permission denied", response.Code)
+	}
+	mfa = true
+	if response := serve(http.MethodPost, "/api/backup/restore"); denied(response) {
+		t.Fatal("admin signed in with 2fa should be allowed to restore backups")
+	}
+
+	oldAuthenticate := authenticateAPIToken
+	t.Cleanup(func() {
+		authenticateAPIToken = oldAuthenticate
+	})
+	withAuthFakes(t, func(header string) (string, error) { return "dak_bookmarklet", nil }, nil, nil)
+	authenticateAPIToken = func(string) (*common.APIToken, *common.User, error) {
+		return &common.APIToken{Scopes: common.ScopeArchiveWrite}, &common.User{ID: 1, Username: "intern", Role: common.RoleAdmin}, nil
+	}
+	for _, route := range [][2]string{
+		{http.MethodGet, "/api/search"},
+		{http.MethodPost, "/api/backup"},
+		{http.MethodGet, "/api/users"},
+		{http.MethodPost, "/api/apiTokens"},
+		{http.MethodPost, "/api/logout/all"},
+	} {
+		if response := serve(route[0], route[1]); !denied(response) {
+			t.Fatalf("archive:write token %s %s status = %d, want permission denied", route[0], route[1], response.Code)
+		}
+	}
+	if response := serve(http.MethodDelete, "/api/archive"); denied(response) {
+		t.Fatal("archive:write token should be allowed to delete archives")
+	}
+	if response := serve(http.MethodGet, "/api/authChecker"); response.Code != http.StatusOK {
+		t.Fatalf("authChecker with api token status = %d, want 200", response.Code)
+	}
+
+	// backup scope 的 Token 还必须在创建时校验过两步验证码
+	backupToken := &common.APIToken{Scopes: common.ScopeBackup}
+	authenticateAPIToken = func(string) (*common.APIToken, *common.User, error) {
+		return backupToken, &common.User{ID: 1, Username: "nightly", Role: common.RoleAdmin, TOTPEnabled: true}, nil
+	}
+	if response := serve(http.MethodPost, "/api/backup/restore"); !denied(response) || !strings.Contains(response.Body.String(), "two-factor") {
+		t.Fatalf("backup token without 2fa restore status = %d body=%s, want permission denied", response.Code, response.Body.String())
+	}
+	backupToken.TwoFactor = true
+	if response := serve(http.MethodPost, "/api/backup/restore"); denied(response) {
+		t.Fatal("backup token created with 2fa should be allowed to restore backups")
+	}
+}
+
+func TestWebStarterStopsWhenQueueInitializationFails(t *testing.T) {
+	oldInitKeys := initJWTKeys
+	oldInitDB := initDatabase
+	oldCreateIndex := createSearchIndex
+	oldInitQueue := initArchiveQueue
+	oldJobs := initBackupJobs
+	oldRun := runGinRouter
+	t.Cleanup(func() {
+		initJWTKeys = oldInitKeys
+		initDatabase = oldInitDB
+		createSearchIndex = oldCreateIndex
+		initArchiveQueue = oldInitQueue
+		initBackupJobs = oldJobs
+		runGinRouter = oldRun
+	})
+
+	initJWTKeys = func() error { return nil }
+	initDatabase = func() {}
+	initBackupJobs = func() error { return nil }
+	createSearchIndex = func() error { return nil }
+	initArchiveQueue = func() error { return errors.New("queue failed") }
+	runGinRouter = func(*gin.Engine, string) error {
+		t.Fatal("router should not run when queue initialization fails")
+		return nil
+	}
+
+	WebStarter(true)
+}
+
+func performControllerRequest(method string, target string, handler gin.HandlerFunc) *httptest.ResponseRecorder {
+	return performRawControllerRequest(method, target, nil, "", handler)
+}
+
+func performJSONControllerRequest(method string, target string, body string, handler gin.HandlerFunc) *httptest.ResponseRecorder {
+	return performRawControllerRequest(method, target, strings.NewReader(body), "application/json", handler)
+}
+
+func performPathControllerRequest(method string, routePath string, target string, handler gin.HandlerFunc) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Handle(method, routePath, handler)
+	request := httptest.NewRequest(method, target, nil)
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	return response
+}
+
+func performRawControllerRequest(method string, target string, body io.Reader, contentType string, handler gin.HandlerFunc) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	routePath := strings.Split(target, "?")[0]
+	router.Handle(method, routePath, handler)
+	request := httptest.NewRequest(method, target, body)
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	return response
+}
+
+// archiveTestAdmin 是归档接口测试使用的当前用户，管理员不受可见范围限制，计算访问范围时也不查询数据库。
+var archiveTestAdmin = &common.User{ID: 1, Username: "admin", Role: common.RoleAdmin}
+
+func performArchiveControllerRequest(method string, target string, body string, handler gin.HandlerFunc) *httptest.ResponseRecorder {
+	return performUserControllerRequest(method, strings.Split(target, "?")[0], target, body, archiveTestAdmin, handler)
+}
+
+func decodeResponse(t *testing.T, response *httptest.ResponseRecorder) map[string]interface{} {
+	t.Helper()
+	var payload map[string]interface{}
+	if err := json.Unmarshal(response.Body.Bytes(), &payload); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	return payload
+}
+
+func contains(value string, part string) bool {
+	return strings.Contains(value, part)
+}
+
+func multipartBody(t *testing.T, fieldName string, fileName string, content string) (*bytes.Buffer, string) {
+	t.Helper()
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile(fieldName, fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := part.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return body, writer.FormDataContentType()
+}
+
+func performUserControllerRequest(method string, route string, target string, body string, currentUser *common.User, handler gin.HandlerFunc) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Handle(method, route, func(c *gin.Context) {
+		if currentUser != nil {
+			c.Set("user", currentUser)
+			c.Set("user_id", currentUser.ID)
+		}
+		c.Next()
+	}, handler)
+	request := httptest.NewRequest(method, target, strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	return response
+}
+
+func TestUserControllerListAndCreate(t *testing.T) {
+	controller := &UserController{}
+	oldList := listUsers
+	oldCreate := createUserWithRole
+	t.Cleanup(func() {
+		listUsers = oldList
+		createUserWithRole = oldCreate
+	})
+
+	listUsers = func(page int, pageSize int) ([]common.User, int64, error) {
+		if page != 2 || pageSize != 5 {
+			t.Fatalf("unexpected page %d size %d", page, pageSize)
+		}
+		return []common.User{{ID: 1, Username: "admin", Role: common.RoleAdmin}}, 6, nil
+	}
+	response := performControllerRequest(http.MethodGet, "/users?page=2&pageSize=5", controller.ListUsers)
+	if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), `"total":6`) {
+		t.Fatalf("list status=%d body=%s", response.Code, response.Body.String())
+	}
+	for _, target := range []string{"/users?page=0", "/users?pageSize=1000", "/users?page=x"} {
+		if response := performControllerRequest(http.MethodGet, target, controller.ListUsers); response.Code != http.StatusForbidden {
+			t.Fatalf("%s status = %d, want 403", target, response.Code)
+		}
+	}
+	listUsers = func(int, int) ([]common.User, int64, error) { return nil, 0, errors.New("db down") }
+	if response := performControllerRequest(http.MethodGet, "/users", controller.ListUsers); response.Code != http.StatusInternalServerError {
+		t.Fatalf("list error status = %d, want 500", response.Code)
+	}
+
+	createUserWithRole = func(username string, password string, role string) (*common.User, error) {
+		if username != "intern" || password != "secret1" || role != "viewer" {
+			t.Fatalf("unexpected create input %q %q %q", username, password, role)
+		}
+		return &common.User{ID: 2, Username: username, Role: role}, nil
+	}
+	response = performJSONControllerRequest(http.MethodPost, "/users", `{"username":"intern","password":"secret1","role":"viewer"}`, controller.CreateUser)
+	if response.Code != http.StatusCreated {
+		t.Fatalf("create status = %d, want 201", response.Code)
+	}
+	if response := performJSONControllerRequest(http.MethodPost, "/users", `{"username":"intern","password":"secret1","role":"root"}`, controller.CreateUser); response.Code != http.StatusForbidden {
+		t.Fatalf("bad role status = %d, want 403", response.Code)
+	}
+	if response := performJSONControllerRequest(http.MethodPost, "/users", `{"username":"in","password":"secret1"}`, controller.CreateUser); response.Code != http.StatusForbidden {
+		t.Fatalf("short username status = %d, want 403", response.Code)
+	}
+	createUserWithRole = func(string, string, string) (*common.User, error) { return nil, common.ErrUsernameExists }
+	if response := performJSONControllerRequest(http.MethodPost, "/users", `{"username":"intern","password":"secret1"}`, controller.CreateUser); response.Code != http.StatusConflict {
+		t.Fatalf("duplicate status = %d, want 409", response.Code)
+	}
+}
+
+func TestUserControllerUpdateDeleteAndReset(t *testing.T) {
+	controller := &UserController{}
+	oldUpdate := updateUserAccount
+	oldDelete := deleteUserByID
+	oldReset := resetUserPassword
+	t.Cleanup(func() {
+		updateUserAccount = oldUpdate
+		deleteUserByID = oldDelete
+		resetUserPassword = oldReset
+	})
+	admin := &common.User{ID: 1, Username: "admin", Role: common.RoleAdmin}
+
+	updateUserAccount = func(id uint, role *string, disabled *bool) (*common.User, error) {
+		if id != 2 || role != nil || disabled == nil || !*disabled {
+			t.Fatalf("unexpected update id=%d role=%v disabled=%v", id, role, disabled)
+		}
+		return &common.User{ID: id, Disabled: true}, nil
+	}
+	response := performUserControllerRequest(http.MethodPatch, "/users/:id", "/users/2", `{"disabled":true}`, admin, controller.UpdateUser)
+	if response.Code != http.StatusOK {
+		t.Fatalf("disable status = %d body=%s", response.Code, response.Body.String())
+	}
+	if response := performUserControllerRequest(http.MethodPatch, "/users/:id", "/users/1", `{"disabled":true}`, admin, controller.UpdateUser); response.Code != http.StatusForbidden {
+		t.Fatalf("disable self status = %d, want 403", response.Code)
+	}
+	if response := performUserControllerRequest(http.MethodPatch, "/users/:id", "/users/abc", `{"disabled":true}`, admin, controller.UpdateUser); response.Code != http.StatusForbidden {
+		t.Fatalf("bad id status = %d, want 403", response.Code)
+	}
+	if response := performUserControllerRequest(http.MethodPatch, "/users/:id", "/users/2", `{}`, admin, controller.UpdateUser); response.Code != http.StatusForbidden {
+		t.Fatalf("empty update status = %d, want 403", response.Code)
+	}
+	updateUserAccount = func(uint, *string, *bool) (*common.User, error) { return nil, common.ErrLastAdmin }
+	if response := performUserControllerRequest(http.MethodPatch, "/users/:id", "/users/2", `{"role":"viewer"}`, admin, controller.UpdateUser); response.Code != http.StatusConflict {
+		t.Fatalf("last admin status = %d, want 409", response.Code)
+	}
+
+	deleteUserByID = func(id uint) error {
+		if id != 2 {
+			t.Fatalf("unexpected delete id %d", id)
+		}
+		return nil
+	}
+	if response := performUserControllerRequest(http.MethodDelete, "/users/:id", "/users/2", ``, admin, controller.DeleteUser); response.Code != http.StatusOK {
+		t.Fatalf("delete status = %d, want 200", response.Code)
+	}
+	if response := performUserControllerRequest(http.MethodDelete, "/users/:id", "/users/1", ``, admin, controller.DeleteUser); response.Code != http.StatusForbidden {
+		t.Fatalf("delete self status = %d, want 403", response.Code)
+	}
+	deleteUserByID = func(uint) error { return common.ErrUserNotFound }
+	if response := performUserControllerRequest(http.MethodDelete, "/users/:id", "/users/3", ``, admin, controller.DeleteUser); response.Code != http.StatusNotFound {
+		t.Fatalf("delete missing status = %d, want 404", response.Code)
+	}
+
+	resetUserPassword = func(id uint, password string) error {
+		if id != 2 || password != "newsecret" {
+			t.Fatalf("unexpected reset id=%d password=%q", id, password)
+		}
+		return nil
+	}
+	if response := performUserControllerRequest(http.MethodPost, "/users/:id/password", "/users/2/password", `{"password":"newsecret"}`, admin, controller.ResetPassword); response.Code != http.StatusOK {
+		t.Fatalf("reset status = %d, want 200", response.Code)
+	}
+	if response := performUserControllerRequest(http.MethodPost, "/users/:id/password", "/users/2/password", `{"password":"short"}`, admin, controller.ResetPassword); response.Code != http.StatusForbidden {
+		t.Fatalf("short password status = %d, want 403", response.Code)
+	}
+}
+
+func TestUserControllerChangeMyPassword(t *testing.T) {
+	controller := &UserController{}
+	oldChange := changeUserPassword
+	t.Cleanup(func() {
+		changeUserPassword = oldChange
+	})
+	user := &common.User{ID: 7, Username: "alice", Role: common.RoleViewer}
+
+	if response := performUserControllerRequest(http.MethodPost, "/me/password", "/me/password", `{}`, nil, controller.ChangeMyPassword); response.Code != http.StatusUnauthorized {
+		t.Fatalf("anonymous status = %d, want 401", response.Code)
+	}
+
+	changeUserPassword = func(id uint, currentPassword string, newPassword string, mfa bool) (*common.TokenResponse, error) {
+		if id != 7 || currentPassword != "oldsecret" || newPassword != "newsecret" || mfa {
+			t.Fatalf("unexpected change id=%d %q %q mfa=%v", id, currentPassword, newPassword, mfa)
+		}
+		return &common.TokenResponse{Token: "reissued"}, nil
+	}
+	body := `{"currentPassword":"oldsecret","newPassword":"newsecret"}`
+	response := performUserControllerRequest(http.MethodPost, "/me/password", "/me/password", body, user, controller.ChangeMyPassword)
+	if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), `"token":"reissued"`) {
+		t.Fatalf("change status = %d body = %s, want 200 with the reissued token", response.Code, response.Body.String())
+	}
+	if response := performUserControllerRequest(http.MethodPost, "/me/password", "/me/password", `{"currentPassword":"oldsecret"}`, user, controller.ChangeMyPassword); response.Code != http.StatusForbidden {
+		t.Fatalf("missing new password status = %d, want 403", response.Code)
+	}
+	changeUserPassword = func(uint, string, string, bool) (*common.TokenResponse, error) {
+		return nil, common.ErrInvalidCredentials
+	}
+	if response := performUserControllerRequest(http.MethodPost, "/me/password", "/me/password", body, user, controller.ChangeMyPassword); response.Code != http.StatusForbidden {
+		t.Fatalf("wrong current password status = %d, want 403", response.Code)
+	}
+}
+
+func TestAuthControllerLogoutAndRefresh(t *testing.T) {
+	controller := &AuthController{}
+	oldRevoke := revokeTokenClaims
+	oldRevokeAll := revokeAllUserTokens
+	oldRefresh := refreshToken
+	t.Cleanup(func() {
+		revokeTokenClaims = oldRevoke
+		revokeAllUserTokens = oldRevokeAll
+		refreshToken = oldRefresh
+	})
+	user := &common.User{ID: 3, Username: "alice"}
+	claims := &common.Claims{UserID: 3}
+	claims.ID = "jti-1"
+	withClaims := func(c *gin.Context) {
+		c.Set("user", user)
+		c.Set("claims", claims)
+		c.Next()
+	}
+	serve := func(handler gin.HandlerFunc, header string) *httptest.ResponseRecorder {
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+		router.POST("/", withClaims, handler)
+		request := httptest.NewRequest(http.MethodPost, "/", nil)
+		if header != "" {
+			request.Header.Set("Authorization", header)
+		}
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		return response
+	}
+
+	revokeTokenClaims = func(got *common.Claims) error {
+		if got != claims {
+			t.Fatalf("unexpected claims %#v", got)
+		}
+		return nil
+	}
+	if response := serve(controller.Logout, ""); response.Code != http.StatusOK {
+		t.Fatalf("logout status = %d, want 200", response.Code)
+	}
+	revokeTokenClaims = func(*common.Claims) error { return common.ErrTokenNotRevocable }
+	if response := serve(controller.Logout, ""); response.Code != http.StatusBadRequest {
+		t.Fatalf("legacy logout status = %d, want 400", response.Code)
+	}
+	revokeTokenClaims = func(*common.Claims) error { return errors.New("db down") }
+	if response := serve(controller.Logout, ""); response.Code != http.StatusInternalServerError {
+		t.Fatalf("logout error status = %d, want 500", response.Code)
+	}
+
+	revokeAllUserTokens = func(id uint) error {
+		if id != 3 {
+			t.Fatalf("unexpected user id %d", id)
+		}
+		return nil
+	}
+	if response := serve(controller.LogoutAll, ""); response.Code != http.StatusOK {
+		t.Fatalf("logout all status = %d, want 200", response.Code)
+	}
+
+	refreshToken = func(token string) (*common.TokenResponse, error) {
+		if token != "old" {
+			t.Fatalf("unexpected token %q", token)
+		}
+		return &common.TokenResponse{Token: "new"}, nil
+	}
+	if response := serve(controller.RefreshToken, "Bearer old"); response.Code != http.StatusOK || !strings.Contains(response.Body.String(), `"new"`) {
+		t.Fatalf("refresh status = %d body=%s", response.Code, response.Body.String())
+	}
+	if response := serve(controller.RefreshToken, ""); response.Code != http.StatusUnauthorized {
+		t.Fatalf("refresh without header status = %d, want 401", response.Code)
+	}
+	refreshToken = func(string) (*common.TokenResponse, error) {
+		return nil, errors.New("token is still valid, refresh not needed")
+	}
+	if response := serve(controller.RefreshToken, "Bearer old"); response.Code != http.StatusBadRequest {
+		t.Fatalf("early refresh status = %d, want 400", response.Code)
+	}
+}
+
+func TestUserControllerLogoutUser(t *testing.T) {
+	controller := &UserController{}
+	oldRevokeAll := revokeAllUserTokens
+	t.Cleanup(func() {
+		revokeAllUserTokens = oldRevokeAll
+	})
+	admin := &common.User{ID: 1, Username: "admin", Role: common.RoleAdmin}
+
+	revokeAllUserTokens = func(id uint) error {
+		if id != 2 {
+			t.Fatalf("unexpected user id %d", id)
+		}
+		return nil
+	}
+	if response := performUserControllerRequest(http.MethodPost, "/users/:id/logout", "/users/2/logout", ``, admin, controller.LogoutUser); response.Code != http.StatusOK {
+		t.Fatalf("logout user status = %d, want 200", response.Code)
+	}
+	revokeAllUserTokens = func(uint) error { return common.ErrUserNotFound }
+	if response := performUserControllerRequest(http.MethodPost, "/users/:id/logout", "/users/9/logout", ``, admin, controller.LogoutUser); response.Code != http.StatusNotFound {
+		t.Fatalf("logout missing user status = %d, want 404", response.Code)
+	}
+}
+
+func TestWebStarterStopsWhenJWTKeysFail(t *testing.T) {
+	oldInitKeys := initJWTKeys
+	oldInitDB := initDatabase
+	t.Cleanup(func() {
+		initJWTKeys = oldInitKeys
+		initDatabase = oldInitDB
+	})
+	initJWTKeys = func() error { return errors.New("bad key file") }
+	initDatabase = func() {
+		t.Fatal("database should not be initialized without signing keys")
+	}
+
+	WebStarter(false)
+}
+
+func TestWebStarterStopsWhenBackupTargetsInvalid(t *testing.T) {
+	oldInitKeys := initJWTKeys
+	oldTargets := initBackupTargets
+	oldInitDB := initDatabase
+	t.Cleanup(func() {
+		initJWTKeys = oldInitKeys
+		initBackupTargets = oldTargets
+		initDatabase = oldInitDB
+	})
+	initJWTKeys = func() error { return nil }
+	initBackupTargets = func() error { return backup.ErrInvalidBackupTarget }
+	initDatabase = func() {
+		t.Fatal("database should not be initialized with invalid backup targets")
+	}
+
+	WebStarter(false)
+}
+
+func TestAuthControllerJWTKeys(t *testing.T) {
+	controller := &AuthController{}
+	oldList := listJWTKeys
+	oldRotate := rotateJWTKey
+	t.Cleanup(func() {
+		listJWTKeys = oldList
+		rotateJWTKey = oldRotate
+	})
+
+	listJWTKeys = func() []common.JWTKeyInfo {
+		return []common.JWTKeyInfo{{KID: "k1", Algorithm: common.JWTAlgorithmHS256, Active: true}}
+	}
+	response := performControllerRequest(http.MethodGet, "/jwtKeys", controller.ListJWTKeys)
+	if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), `"kid":"k1"`) {
+		t.Fatalf("list status=%d body=%s", response.Code, response.Body.String())
+	}
+
+	rotateJWTKey = func() (*common.JWTKeyInfo, error) {
+		return &common.JWTKeyInfo{KID: "k2", Active: true}, nil
+	}
+	if response := performControllerRequest(http.MethodPost, "/jwtKeys/rotate", controller.RotateJWTKey); response.Code != http.StatusOK {
+		t.Fatalf("rotate status = %d, want 200", response.Code)
+	}
+	rotateJWTKey = func() (*common.JWTKeyInfo, error) { return nil, errors.New("no key file") }
+	if response := performControllerRequest(http.MethodPost, "/jwtKeys/rotate", controller.RotateJWTKey); response.Code != http.StatusInternalServerError {
+		t.Fatalf("rotate error status = %d, want 500", response.Code)
+	}
+}
+
+func TestAPITokenController(t *testing.T) {
+	controller := &APITokenController{}
+	currentUser := &common.User{ID: 7, Username: "bot-owner", Role: common.RoleEditor}
+	oldList := listAPITokens
+	oldCreate := createAPIToken
+	oldDelete := deleteAPIToken
+	t.Cleanup(func() {
+		listAPITokens = oldList
+		createAPIToken = oldCreate
+		deleteAPIToken = oldDelete
+	})
+
+	listAPITokens = func(userID uint) ([]common.APIToken, error) {
+		return []common.APIToken{{ID: 1, UserID: userID, Name: "cron", TokenHash: "secret-hash"}}, nil
+	}
+	response := performUserControllerRequest(http.MethodGet, "/apiTokens", "/apiTokens", "", currentUser, controller.ListAPITokens)
+	if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), `"name":"cron"`) || strings.Contains(response.Body.String(), "secret-hash") {
+		t.Fatalf("list status=%d body=%s", response.Code, response.Body.String())
+	}
+
+	var gotExpiry *time.Time
+	createAPIToken = func(userID uint, name string, scopes []string, expiresAt *time.Time, code string) (*common.APIToken, string, error) {
+		if userID != 7 || name != "bookmarklet" {
+			t.Fatalf("unexpected create args %d %q", userID, name)
+		}
+		gotExpiry = expiresAt
+		if len(scopes) == 1 && scopes[0] == common.ScopeBackup {
+			if code == "" {
+				return nil, "", common.ErrInvalidTOTPCode
+			}
+			return nil, "", common.ErrAPITokenScopeNotAllowed
+		}
+		return &common.APIToken{ID: 2, Name: name}, "dak_plain", nil
+	}
+	response = performUserControllerRequest(http.MethodPost, "/apiTokens", "/apiTokens",
+		`{"name":"bookmarklet","scopes":["archive:write"],"expiresInDays":30}`, currentUser, controller.CreateAPIToken)
+	if response.Code != http.StatusCreated || !strings.Contains(response.Body.String(), "dak_plain") {
+		t.Fatalf("create status=%d body=%s", response.Code, response.Body.String())
+	}
+	if gotExpiry == nil || time.Until(*gotExpiry) < 29*24*time.Hour {
+		t.Fatalf("expiry = %v, want about 30 days", gotExpiry)
+	}
+	for _, body := range []string{
+		`{"name":"bookmarklet","scopes":["admin:everything"]}`,
+		`{"name":"bookmarklet","scopes":[]}`,
+		`{"name":"bookmarklet","scopes":["search:read"],"expiresInDays":-1}`,
+	} {
+		if response := performUserControllerRequest(http.MethodPost, "/apiTokens", "/apiTokens", body, currentUser, controller.CreateAPIToken); response.Code != 403 {
+			t.Fatalf("body %s status = %d, want 403", body, response.Code)
+		}
+	}
+	response = performUserControllerRequest(http.MethodPost, "/apiTokens", "/apiTokens",
+		`{"name":"bookmarklet","scopes":["backup"]}`, currentUser, controller.CreateAPIToken)
+	if response.Code != 403 || !strings.Contains(response.Body.String(), "验证码错误") {
+		t.Fatalf("backup scope without code status=%d body=%s", response.Code, response.Body.String())
+	}
+	response = performUserControllerRequest(http.MethodPost, "/apiTokens", "/apiTokens",
+		`{"name":"bookmarklet","scopes":["backup"],"code":"123456"}`, currentUser, controller.CreateAPIToken)
+	if response.Code != 403 || !strings.Contains(response.Body.String(), "当前角色不能申请该权限范围") {
+		t.Fatalf("scope beyond role status=%d body=%s", response.Code, response.Body.String())
+	}
+
+	deleteAPIToken = func(userID uint, tokenID uint) error {
+		if tokenID == 9 {
+			return common.ErrAPITokenNotFound
+		}
+		return nil
+	}
+	if response := performUserControllerRequest(http.MethodDelete, "/apiTokens/:id", "/apiTokens/2", "", currentUser, controller.DeleteAPIToken); response.Code != http.StatusOK {
+		t.Fatalf("delete status = %d, want 200", response.Code)
+	}
+	if response := performUserControllerRequest(http.MethodDelete, "/apiTokens/:id", "/apiTokens/9", "", currentUser, controller.DeleteAPIToken); response.Code != http.StatusNotFound {
+		t.Fatalf("delete missing status = %d, want 404", response.Code)
+	}
+	if response := performUserControllerRequest(http.MethodDelete, "/apiTokens/:id", "/apiTokens/x", "", currentUser, controller.DeleteAPIToken); response.Code != 403 {
+		t.Fatalf("delete bad id status = %d, want 403", response.Code)
+	}
+}
+
+func TestAuthControllerOIDCFlow(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	controller := &AuthController{}
+	oldEnabled := oidcEnabled
+	oldAuthURL := oidcAuthCodeURL
+	oldComplete := completeOIDCLogin
+	oldExchange := exchangeOIDCLoginCode
+	t.Cleanup(func() {
+		oidcEnabled = oldEnabled
+		oidcAuthCodeURL = oldAuthURL
+		completeOIDCLogin = oldComplete
+		exchangeOIDCLoginCode = oldExchange
+	})
+	router := gin.New()
+	router.GET("/api/oidc/config", controller.OIDCConfig)
+	router.GET("/api/oidc/login", controller.OIDCLogin)
+	router.GET("/api/oidc/callback", controller.OIDCCallback)
+	router.POST("/api/oidc/exchange", controller.OIDCExchange)
+	serve := func(method string, target string, body string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, target, strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/json")
+		if cookie != nil {
+			request.AddCookie(cookie)
+		}
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		return response
+	}
+
+	oidcEnabled = func() bool { return true }
+	if response := serve(http.MethodGet, "/api/oidc/config", "", nil); !strings.Contains(response.Body.String(), `"enabled":true`) {
+		t.Fatalf("config body = %s", response.Body.String())
+	}
+
+	oidcAuthCodeURL = func(context.Context) (string, string, error) { return "", "", common.ErrOIDCDisabled }
+	if response := serve(http.MethodGet, "/api/oidc/login", "", nil); response.Code != http.StatusNotFound {
+		t.Fatalf("disabled login status = %d, want 404", response.Code)
+	}
+	oidcAuthCodeURL = func(context.Context) (string, string, error) {
+		return "https://sso.example.com/authorize?state=s1", "s1", nil
+	}
+	response := serve(http.MethodGet, "/api/oidc/login", "", nil)
+	if response.Code != http.StatusFound || response.Header().Get("Location") != "https://sso.example.com/authorize?state=s1" {
+		t.Fatalf("login status=%d location=%q", response.Code, response.Header().Get("Location"))
+	}
+	var stateCookie *http.Cookie
+	for _, cookie := range response.Result().Cookies() {
+		if cookie.Name == oidcStateCookie {
+			stateCookie = cookie
+		}
+	}
+	if stateCookie == nil || stateCookie.Value != "s1" || !stateCookie.HttpOnly {
+		t.Fatalf("state cookie = %+v", stateCookie)
+	}
+
+	completeOIDCLogin = func(ctx context.Context, state string, code string) (string, error) {
+		if state != "s1" || code != "c1" {
+			t.Fatalf("unexpected callback state=%q code=%q", state, code)
+		}
+		return "login-code", nil
+	}
+	if response := serve(http.MethodGet, "/api/oidc/callback?state=s1&code=c1", "", nil); !strings.Contains(response.Header().Get("Location"), "ssoError=") {
+		t.Fatalf("callback without cookie location = %q, want error", response.Header().Get("Location"))
+	}
+	if response := serve(http.MethodGet, "/api/oidc/callback?error=access_denied&state=s1", "", stateCookie); response.Header().Get("Location") != "/#/login?ssoError=access_denied" {
+		t.Fatalf("idp error location = %q", response.Header().Get("Location"))
+	}
+	response = serve(http.MethodGet, "/api/oidc/callback?state=s1&code=c1", "", stateCookie)
+	if response.Code != http.StatusFound || response.Header().Get("Location") != "/#/login?ssoCode=login-code" {
+		t.Fatalf("callback status=%d location=%q", response.Code, response.Header().Get("Location"))
+	}
+	completeOIDCLogin = func(context.Context, string, string) (string, error) {
+		return "", errors.New("token endpoint said: secret details")
+	}
+	if response := serve(http.MethodGet, "/api/oidc/callback?state=s1&code=c1", "", stateCookie); strings.Contains(response.Header().Get("Location"), "secret") {
+		t.Fatalf("internal errors should not leak into the redirect: %q", response.Header().Get("Location"))
+	}
+
+	exchangeOIDCLoginCode = func(code string, clientIP string) (*common.TokenResponse, error) {
+		if code != "login-code" {
+			return nil, common.ErrOIDCLoginCodeInvalid
+		}
+		return &common.TokenResponse{Token: "jwt"}, nil
+	}
+	if response := serve(http.MethodPost, "/api/oidc/exchange", `{"code":"login-code"}`, nil); response.Code != http.StatusOK || !strings.Contains(response.Body.String(), `"token":"jwt"`) {
+		t.Fatalf("exchange status=%d body=%s", response.Code, response.Body.String())
+	}
+	if response := serve(http.MethodPost, "/api/oidc/exchange", `{"code":"reused"}`, nil); response.Code != http.StatusUnauthorized {
+		t.Fatalf("invalid exchange status = %d, want 401", response.Code)
+	}
+}
+
+func TestUserControllerLoginLocks(t *testing.T) {
+	controller := &UserController{}
+	admin := &common.User{ID: 1, Username: "admin", Role: common.RoleAdmin}
+	oldList := listLoginThrottles
+	oldUnlock := unlockLogin
+	oldFailures := listLoginFailures
+	t.Cleanup(func() {
+		listLoginThrottles = oldList
+		unlockLogin = oldUnlock
+		listLoginFailures = oldFailures
+	})
+
+	listLoginThrottles = func() ([]common.LoginThrottle, error) {
+		return []common.LoginThrottle{{Kind: common.LoginThrottleUser, Value: "admin", Failures: 10}}, nil
+	}
+	response := performUserControllerRequest(http.MethodGet, "/loginLocks", "/loginLocks", "", admin, controller.ListLoginLocks)
+	if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), `"failures":10`) {
+		t.Fatalf("list status=%d body=%s", response.Code, response.Body.String())
+	}
+
+	var gotKind, gotValue string
+	unlockLogin = func(kind string, value string) (bool, error) {
+		gotKind, gotValue = kind, value
+		return value != "10.0.0.9", nil
+	}
+	if response := performUserControllerRequest(http.MethodDelete, "/loginLocks", "/loginLocks?username=admin", "", admin, controller.UnlockLogin); response.Code != http.StatusOK || gotKind != common.LoginThrottleUser || gotValue != "admin" {
+		t.Fatalf("unlock user status=%d kind=%q value=%q", response.Code, gotKind, gotValue)
+	}
+	if response := performUserControllerRequest(http.MethodDelete, "/loginLocks", "/loginLocks?ip=10.0.0.9", "", admin, controller.UnlockLogin); response.Code != http.StatusNotFound || gotKind != common.LoginThrottleIP {
+		t.Fatalf("unlock unknown ip status=%d kind=%q", response.Code, gotKind)
+	}
+	if response := performUserControllerRequest(http.MethodDelete, "/loginLocks", "/loginLocks", "", admin, controller.UnlockLogin); response.Code != 403 {
+		t.Fatalf("unlock without target status = %d, want 403", response.Code)
+	}
+
+	listLoginFailures = func(page int, pageSize int, username string) ([]common.LoginFailure, int64, error) {
+		if page != 2 || pageSize != 10 || username != "admin" {
+			t.Fatalf("unexpected args page=%d size=%d username=%q", page, pageSize, username)
+		}
+		return []common.LoginFailure{{Username: "admin", IP: "10.0.0.9", Reason: common.LoginFailureInvalidCredentials}}, 11, nil
+	}
+	response = performUserControllerRequest(http.MethodGet, "/loginFailures", "/loginFailures?page=2&pageSize=10&username=admin", "", admin, controller.ListLoginFailures)
+	if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), `"total":11`) {
+		t.Fatalf("failures status=%d body=%s", response.Code, response.Body.String())
+	}
+	if response := performUserControllerRequest(http.MethodGet, "/loginFailures", "/loginFailures?pageSize=1000", "", admin, controller.ListLoginFailures); response.Code != 403 {
+		t.Fatalf("oversized page status = %d, want 403", response.Code)
+	}
+}
+
+func TestAuthControllerLoginTOTP(t *testing.T) {
+	controller := &AuthController{}
+	oldLogin := loginWithToken
+	oldLoginTOTP := loginWithTOTP
+	t.Cleanup(func() {
+		loginWithToken = oldLogin
+		loginWithTOTP = oldLoginTOTP
+	})
+
+	loginWithToken = func(string, string, string) (*common.TokenResponse, error) {
+		return &common.TokenResponse{MFARequired: true, MFAToken: "pending"}, nil
+	}
+	response := performJSONControllerRequest(http.MethodPost, "/login", `{"username":"alice","password":"secret"}`, controller.Login)
+	payload := decodeResponse(t, response)
+	data, _ := payload["Data"].(map[string]interface{})
+	if response.Code != http.StatusOK || payload["Message"] != "Two-factor authentication required" || data["mfa_token"] != "pending" || data["token"] != nil {
+		t.Fatalf("login with 2fa status=%d body=%s", response.Code, response.Body.String())
+	}
+
+	loginWithTOTP = func(mfaToken string, code string, clientIP string) (*common.TokenResponse, error) {
+		if mfaToken != "pending" || code != "123456" || clientIP == "" {
+			t.Fatalf("unexpected totp login %q %q %q", mfaToken, code, clientIP)
+		}
+		return &common.TokenResponse{Token: "session"}, nil
+	}
+	response = performJSONControllerRequest(http.MethodPost, "/login/totp", `{"mfaToken":"pending","code":"123456"}`, controller.LoginTOTP)
+	if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), `"token":"session"`) {
+		t.Fatalf("totp login status=%d body=%s", response.Code, response.Body.String())
+	}
+	if response := performJSONControllerRequest(http.MethodPost, "/login/totp", `{"mfaToken":"pending"}`, controller.LoginTOTP); response.Code != http.StatusBadRequest {
+		t.Fatalf("missing code status = %d, want 400", response.Code)
+	}
+
+	loginWithTOTP = func(string, string, string) (*common.TokenResponse, error) {
+		return nil, fmt.Errorf("%w: %v", common.ErrInvalidCredentials, common.ErrInvalidTOTPCode)
+	}
+	response = performJSONControllerRequest(http.MethodPost, "/login/totp", `{"mfaToken":"pending","code":"000000"}`, controller.LoginTOTP)
+	if response.Code != http.StatusUnauthorized || !strings.Contains(response.Body.String(), "Invalid two-factor authentication code") {
+		t.Fatalf("wrong code status=%d body=%s", response.Code, response.Body.String())
+	}
+	loginWithTOTP = func(string, string, string) (*common.TokenResponse, error) {
+		return nil, &common.LoginThrottledError{RetryAfter: 2 * time.Second}
+	}
+	response = performJSONControllerRequest(http.MethodPost, "/login/totp", `{"mfaToken":"pending","code":"000000"}`, controller.LoginTOTP)
+	if response.Code != http.StatusTooManyRequests || response.Header().Get("Retry-After") != "2" {
+		t.Fatalf("throttled status=%d headers=%v", response.Code, response.Header())
+	}
+}
+
+func TestUserControllerTOTPEnrollment(t *testing.T) {
+	controller := &UserController{}
+	oldBegin := beginTOTPEnrollment
+	oldEnable := enableTOTP
+	oldDisable := disableTOTP
+	oldRegenerate := regenerateRecoveryCodes
+	oldCount := countRecoveryCodes
+	t.Cleanup(func() {
+		beginTOTPEnrollment = oldBegin
+		enableTOTP = oldEnable
+		disableTOTP = oldDisable
+		regenerateRecoveryCodes = oldRegenerate
+		countRecoveryCodes = oldCount
+	})
+	user := &common.User{ID: 7, Username: "alice", Role: common.RoleAdmin}
+
+	beginTOTPEnrollment = func(id uint) (*common.TOTPSetup, error) {
+		if id != 7 {
+			t.Fatalf("unexpected user id %d", id)
+		}
+		return &common.TOTPSetup{Secret: "SECRET", URI: "otpauth://totp/DataArk:alice?secret=SECRET"}, nil
+	}
+	response := performUserControllerRequest(http.MethodPost, "/me/totp/setup", "/me/totp/setup", ``, user, controller.SetupMyTOTP)
+	if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), "otpauth://") {
+		t.Fatalf("setup status=%d body=%s", response.Code, response.Body.String())
+	}
+	beginTOTPEnrollment = func(uint) (*common.TOTPSetup, error) { return nil, common.ErrTOTPAlreadyEnabled }
+	if response := performUserControllerRequest(http.MethodPost, "/me/totp/setup", "/me/totp/setup", ``, user, controller.SetupMyTOTP); response.Code != http.StatusConflict {
+		t.Fatalf("setup when enabled status = %d, want 409", response.Code)
+	}
+
+	enableTOTP = func(id uint, code string) ([]string, error) {
+		if code != "123456" {
+			return nil, common.ErrInvalidTOTPCode
+		}
+		return []string{"aaaaa-bbbbb"}, nil
+	}
+	response = performUserControllerRequest(http.MethodPost, "/me/totp/enable", "/me/totp/enable", `{"code":"123456"}`, user, controller.EnableMyTOTP)
+	if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), "aaaaa-bbbbb") {
+		t.Fatalf("enable status=%d body=%s", response.Code, response.Body.String())
+	}
+	if response := performUserControllerRequest(http.MethodPost, "/me/totp/enable", "/me/totp/enable", `{"code":"000000"}`, user, controller.EnableMyTOTP); response.Code != http.StatusForbidden {
+		t.Fatalf("enable with wrong code status = %d, want 403", response.Code)
+	}
+
+	disableTOTP = func(id uint, password string, code string) error {
+		if password != "secret" {
+			return common.ErrInvalidCredentials
+		}
+		return nil
+	}
+	if response := performUserControllerRequest(http.MethodPost, "/me/totp/disable", "/me/totp/disable", `{"password":"secret","code":"123456"}`, user, controller.DisableMyTOTP); response.Code != http.StatusOK {
+		t.Fatalf("disable status = %d, want 200", response.Code)
+	}
+	if response := performUserControllerRequest(http.MethodPost, "/me/totp/disable", "/me/totp/disable", `{"password":"wrong","code":"123456"}`, user, controller.DisableMyTOTP); response.Code != http.StatusForbidden {
+		t.Fatalf("disable with wrong password status = %d, want 403", response.Code)
+	}
+
+	regenerateRecoveryCodes = func(uint, string) ([]string, error) { return nil, common.ErrTOTPNotEnabled }
+	if response := performUserControllerRequest(http.MethodPost, "/me/totp/recoveryCodes", "/me/totp/recoveryCodes", `{"code":"123456"}`, user, controller.RegenerateMyRecoveryCodes); response.Code != http.StatusConflict {
+		t.Fatalf("regenerate without 2fa status = %d, want 409", response.Code)
+	}
+
+	countRecoveryCodes = func(uint) (int64, error) { return 9, nil }
+	enabledUser := &common.User{ID: 7, Username: "alice", TOTPEnabled: true}
+	response = performUserControllerRequest(http.MethodGet, "/me/totp", "/me/totp", ``, enabledUser, controller.GetMyTOTPStatus)
+	if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), `"recoveryCodes":9`) {
+		t.Fatalf("status status=%d body=%s", response.Code, response.Body.String())
+	}
+}
+
+func TestUserControllerResetUserTOTP(t *testing.T) {
+	controller := &UserController{}
+	oldReset := resetTOTP
+	oldRevokeAll := revokeAllUserTokens
+	t.Cleanup(func() {
+		resetTOTP = oldReset
+		revokeAllUserTokens = oldRevokeAll
+	})
+	admin := &common.User{ID: 1, Username: "admin", Role: common.RoleAdmin}
+
+	var revoked uint
+	resetTOTP = func(uint) error { return nil }
+	revokeAllUserTokens = func(id uint) error {
+		revoked = id
+		return nil
+	}
+	if response := performUserControllerRequest(http.MethodPost, "/users/:id/totp/reset", "/users/2/totp/reset", ``, admin, controller.ResetUserTOTP); response.Code != http.StatusOK || revoked != 2 {
+		t.Fatalf("reset status = %d revoked=%d", response.Code, revoked)
+	}
+	resetTOTP = func(uint) error { return common.ErrUserNotFound }
+	if response := performUserControllerRequest(http.MethodPost, "/users/:id/totp/reset", "/users/9/totp/reset", ``, admin, controller.ResetUserTOTP); response.Code != http.StatusNotFound {
+		t.Fatalf("reset missing user status = %d, want 404", response.Code)
+	}
+}
+
+func TestListAuditEventsAndExport(t *testing.T) {
+	oldList := listAuditEvents
+	oldEach := eachAuditEvent
+	oldRecord := recordAuditEvent
+	t.Cleanup(func() {
+		listAuditEvents = oldList
+		eachAuditEvent = oldEach
+		recordAuditEvent = oldRecord
+	})
+	events := []common.AuditEvent{
+		{ID: 1, Actor: "alice", Action: common.AuditActionArchiveDelete, Target: "=HYPERLINK(\"x\")", Outcome: common.AuditOutcomeSuccess},
+		{ID: 2, Actor: "bob", Action: common.AuditActionBackupRestore, Target: "backup.zip", Outcome: common.AuditOutcomeFailure, Detail: "bad, zip"},
+	}
+
+	listAuditEvents = func(filter common.AuditFilter, page int, pageSize int) ([]common.AuditEvent, int64, error) {
+		if filter.Actor != "alice" || filter.Outcome != common.AuditOutcomeSuccess || filter.Since == nil || filter.Until != nil || page != 2 || pageSize != 5 {
+			t.Fatalf("unexpected filter %+v page=%d pageSize=%d", filter, page, pageSize)
+		}
+		return events[:1], 6, nil
+	}
+	response := performControllerRequest(http.MethodGet, "/audit?actor=alice&outcome=success&since=2026-01-01T00:00:00Z&page=2&pageSize=5", ListAuditEvents)
+	if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), `"total":6`) {
+		t.Fatalf("list status=%d body=%s", response.Code, response.Body.String())
+	}
+	for _, target := range []string{"/audit?since=yesterday", "/audit?outcome=maybe", "/audit?format=xml", "/audit?pageSize=1000"} {
+		if response := performControllerRequest(http.MethodGet, target, ListAuditEvents); response.Code != http.StatusForbidden {
+			t.Fatalf("%s status = %d, want 403", target, response.Code)
+		}
+	}
+
+	var exported []string
+	eachAuditEvent = func(filter common.AuditFilter, fn func(common.AuditEvent) error) error {
+		for _, event := range events {
+			if err := fn(event); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	recordAuditEvent = func(ctx context.Context, action string, target string, detail string, err error) {
+		exported = append(exported, action+" "+target+" "+detail)
+	}
+	response = performControllerRequest(http.MethodGet, "/audit?format=csv", ListAuditEvents)
+	records, err := csv.NewReader(response.Body).ReadAll()
+	if err != nil || response.Code != http.StatusOK || len(records) != 3 {
+		t.Fatalf("csv export status=%d records=%v err=%v", response.Code, records, err)
+	}
+	if records[1][5] != `'=HYPERLINK("x")` || records[2][8] != "bad, zip" {
+		t.Fatalf("unexpected csv rows %v", records[1:])
+	}
+	if !strings.Contains(response.Header().Get("Content-Disposition"), ".csv") {
+		t.Fatalf("csv headers = %v", response.Header())
+	}
+
+	response = performControllerRequest(http.MethodGet, "/audit?format=json", ListAuditEvents)
+	var decoded []common.AuditEvent
+	if err := json.Unmarshal(response.Body.Bytes(), &decoded); err != nil || len(decoded) != 2 || decoded[1].Detail != "bad, zip" {
+		t.Fatalf("json export body=%s err=%v", response.Body.String(), err)
+	}
+	if strings.Join(exported, "|") != "audit.export csv exported 2 events|audit.export json exported 2 events" {
+		t.Fatalf("export audit events = %v", exported)
+	}
+}
+
+func TestUserControllerRecordsAuditEvents(t *testing.T) {
+	controller := &UserController{}
+	oldDelete := deleteUserByID
+	oldRecord := recordAuditEvent
+	t.Cleanup(func() {
+		deleteUserByID = oldDelete
+		recordAuditEvent = oldRecord
+	})
+	admin := &common.User{ID: 1, Username: "admin", Role: common.RoleAdmin}
+
+	var recorded []string
+	recordAuditEvent = func(ctx context.Context, action string, target string, detail string, err error) {
+		recorded = append(recorded, fmt.Sprintf("%s %s %v", action, target, err != nil))
+	}
+	deleteUserByID = func(uint) error { return nil }
+	performUserControllerRequest(http.MethodDelete, "/users/:id", "/users/2", ``, admin, controller.DeleteUser)
+	deleteUserByID = func(uint) error { return common.ErrLastAdmin }
+	performUserControllerRequest(http.MethodDelete, "/users/:id", "/users/3", ``, admin, controller.DeleteUser)
+
+	if strings.Join(recorded, "|") != "user.delete user:2 false|user.delete user:3 true" {
+		t.Fatalf("recorded = %v", recorded)
+	}
+}
+
+func TestTeamController(t *testing.T) {
+	controller := &TeamController{}
+	admin := &common.User{ID: 1, Username: "admin", Role: common.RoleAdmin}
+	oldList := listTeams
+	oldListMine := listUserTeams
+	oldCreate := createTeam
+	oldDelete := deleteTeam
+	oldAdd := addTeamMember
+	oldRemove := removeTeamMember
+	t.Cleanup(func() {
+		listTeams = oldList
+		listUserTeams = oldListMine
+		createTeam = oldCreate
+		deleteTeam = oldDelete
+		addTeamMember = oldAdd
+		removeTeamMember = oldRemove
+	})
+
+	listTeams = func() ([]common.TeamSummary, error) {
+		return []common.TeamSummary{{Team: common.Team{ID: 1, Name: "research"}, Members: []common.TeamMemberSummary{{UserID: 2, Username: "bob"}}}}, nil
+	}
+	response := performUserControllerRequest(http.MethodGet, "/teams", "/teams", "", admin, controller.ListTeams)
+	if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), `"username":"bob"`) {
+		t.Fatalf("list status=%d body=%s", response.Code, response.Body.String())
+	}
+	listUserTeams = func(userID uint) ([]common.Team, error) {
+		if userID != 2 {
+			t.Fatalf("unexpected user %d", userID)
+		}
+		return []common.Team{{ID: 1, Name: "research"}}, nil
+	}
+	bob := &common.User{ID: 2, Username: "bob", Role: common.RoleViewer}
+	response = performUserControllerRequest(http.MethodGet, "/me/teams", "/me/teams", "", bob, controller.ListMyTeams)
+	if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), "research") {
+		t.Fatalf("my teams status=%d body=%s", response.Code, response.Body.String())
+	}
+
+	createTeam = func(name string) (*common.Team, error) {
+		if name == "research" {
+			return nil, common.ErrTeamNameExists
+		}
+		return &common.Team{ID: 3, Name: name}, nil
+	}
+	if response := performUserControllerRequest(http.MethodPost, "/teams", "/teams", `{"name":"ops"}`, admin, controller.CreateTeam); response.Code != http.StatusCreated {
+		t.Fatalf("create status = %d, want 201", response.Code)
+	}
+	if response := performUserControllerRequest(http.MethodPost, "/teams", "/teams", `{"name":"research"}`, admin, controller.CreateTeam); response.Code != http.StatusConflict {
+		t.Fatalf("create duplicate status = %d, want 409", response.Code)
+	}
+	if response := performUserControllerRequest(http.MethodPost, "/teams", "/teams", `{}`, admin, controller.CreateTeam); response.Code != 403 {
+		t.Fatalf("create without name status = %d, want 403", response.Code)
+	}
+
+	deleteTeam = func(teamID uint) error {
+		if teamID == 9 {
+			return common.ErrTeamNotFound
+		}
+		return nil
+	}
+	if response := performUserControllerRequest(http.MethodDelete, "/teams/:id", "/teams/1", "", admin, controller.DeleteTeam); response.Code != http.StatusOK {
+		t.Fatalf("delete status = %d, want 200", response.Code)
+	}
+	if response := performUserControllerRequest(http.MethodDelete, "/teams/:id", "/teams/9", "", admin, controller.DeleteTeam); response.Code != http.StatusNotFound {
+		t.Fatalf("delete missing status = %d, want 404", response.Code)
+	}
+	if response := performUserControllerRequest(http.MethodDelete, "/teams/:id", "/teams/x", "", admin, controller.DeleteTeam); response.Code != 403 {
+		t.Fatalf("delete bad id status = %d, want 403", response.Code)
+	}
+
+	addTeamMember = func(teamID, userID uint) error {
+		if userID == 2 {
+			return common.ErrTeamMemberExists
+		}
+		if userID == 8 {
+			return common.ErrUserNotFound
+		}
+		return nil
+	}
+	if response := performUserControllerRequest(http.MethodPost, "/teams/:id/members", "/teams/1/members", `{"userId":3}`, admin, controller.AddTeamMember); response.Code != http.StatusOK {
+		t.Fatalf("add member status = %d, want 200", response.Code)
+	}
+	if response := performUserControllerRequest(http.MethodPost, "/teams/:id/members", "/teams/1/members", `{"userId":2}`, admin, controller.AddTeamMember); response.Code != http.StatusConflict {
+		t.Fatalf("add existing member status = %d, want 409", response.Code)
+	}
+	if response := performUserControllerRequest(http.MethodPost, "/teams/:id/members", "/teams/1/members", `{"userId":8}`, admin, controller.AddTeamMember); response.Code != http.StatusNotFound {
+		t.Fatalf("add missing user status = %d, want 404", response.Code)
+	}
+
+	removeTeamMember = func(teamID, userID uint) error {
+		if userID == 4 {
+			return common.ErrTeamMemberNotFound
+		}
+		return nil
+	}
+	if response := performUserControllerRequest(http.MethodDelete, "/teams/:id/members/:userId", "/teams/1/members/3", "", admin, controller.RemoveTeamMember); response.Code != http.StatusOK {
+		t.Fatalf("remove member status = %d, want 200", response.Code)
+	}
+	if response := performUserControllerRequest(http.MethodDelete, "/teams/:id/members/:userId", "/teams/1/members/4", "", admin, controller.RemoveTeamMember); response.Code != http.StatusNotFound {
+		t.Fatalf("remove missing member status = %d, want 404", response.Code)
+	}
+}
+
+func TestArchiveVisibilityHandlers(t *testing.T) {
+	oldSet := setArchiveVisibility
+	oldResolveFile := resolveArchiveFile
+	oldAccess := archiveAccessForUser
+	oldOwnership := resolveArchiveOwnership
+	oldTask := getArchiveTask
+	oldAddTask := addDocURLTask
+	t.Cleanup(func() {
+		setArchiveVisibility = oldSet
+		resolveArchiveFile = oldResolveFile
+		archiveAccessForUser = oldAccess
+		resolveArchiveOwnership = oldOwnership
+		getArchiveTask = oldTask
+		addDocURLTask = oldAddTask
+	})
+	bob := &common.User{ID: 2, Username: "bob", Role: common.RoleEditor}
+	archiveAccessForUser = func(user *common.User) (common.ArchiveAccess, error) {
+		return common.ArchiveAccess{UserID: user.ID, TeamIDs: []uint{5}}, nil
+	}
+
+	setArchiveVisibility = func(_ context.Context, rawPath string, visibility string, teamID uint, user *common.User, access common.ArchiveAccess) (*search.ArchiveVisibilityResult, error) {
+		switch rawPath {
+		case "/archive/example.com/other.html":
+			return nil, common.ErrArchiveAccessDenied
+		case "/archive/example.com/missing.html":
+			return nil, search.ErrArchiveFileNotFound
+		}
+		if visibility == "secret" {
+			return nil, common.ErrInvalidVisibility
+		}
+		if teamID == 9 {
+			return nil, common.ErrNotTeamMember
+		}
+		if user.ID != 2 || !access.InTeam(5) {
+			t.Fatalf("unexpected user %+v access %+v", user, access)
+		}
+		return &search.ArchiveVisibilityResult{Path: rawPath, ArchiveOwnership: common.ArchiveOwnership{OwnerID: 2, TeamID: teamID, Visibility: visibility}}, nil
+	}
+	cases := []struct {
+		body string
+		want int
+	}{
+		{`{"path":"/archive/example.com/a.html","visibility":"team","teamId":5}`, http.StatusOK},
+		{`{"path":"/archive/example.com/a.html"}`, 403},
+		{`{"path":"/archive/example.com/a.html","visibility":"secret"}`, 403},
+		{`{"path":"/archive/example.com/a.html","visibility":"team","teamId":9}`, 403},
+		{`{"path":"/archive/example.com/other.html","visibility":"public"}`, 403},
+		{`{"path":"/archive/example.com/missing.html","visibility":"public"}`, http.StatusNotFound},
+	}
+	for _, tc := range cases {
+		response := performUserControllerRequest(http.MethodPut, "/archive/visibility", "/archive/visibility", tc.body, bob, SetArchiveVisibility)
+		if response.Code != tc.want {
+			t.Fatalf("body %s status = %d body=%s, want %d", tc.body, response.Code, response.Body.String(), tc.want)
+		}
+	}
+
+	archiveDir := t.TempDir()
+	filePath := filepath.Join(archiveDir, "a.html")
+	if err := os.WriteFile(filePath, []byte("<html>ok</html>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	resolveArchiveFile = func(rawPath string, access common.ArchiveAccess) (string, error) {
+		switch rawPath {
+		case "/archive/example.com/a.html", "/archive/example.com/a%2541.html":
+			return filePath, nil
+		case "/archive/example.com":
+			return archiveDir, nil
+		}
+		return "", search.ErrArchiveFileNotFound
+	}
+	response := performUserControllerRequest(http.MethodGet, "/archive/*filepath", "/archive/example.com/a.html", "", bob, ServeArchiveFile)
+	if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), "ok") {
+		t.Fatalf("serve status=%d body=%s", response.Code, response.Body.String())
+	}
+	// 传给 resolveArchiveFile 的是原始转义路径，%25 不会在这里先被解码一次
+	if response := performUserControllerRequest(http.MethodGet, "/archive/*filepath", "/archive/example.com/a%2541.html", "", bob, ServeArchiveFile); response.Code != http.StatusOK {
+		t.Fatalf("serve escaped status=%d body=%s", response.Code, response.Body.String())
+	}
+	for _, target := range []string{"/archive/example.com/private.html", "/archive/example.com"} {
+		if response := performUserControllerRequest(http.MethodGet, "/archive/*filepath", target, "", bob, ServeArchiveFile); response.Code != http.StatusNotFound {
+			t.Fatalf("serve %s status = %d, want 404", target, response.Code)
+		}
+	}
+
+	// 其他用户的私有任务按不存在处理
+	getArchiveTask = func(id string) (*common.ArchiveTask, error) {
+		return &common.ArchiveTask{ID: id, Status: search.ArchiveTaskStatusSuccess, ArchiveOwnership: common.ArchiveOwnership{OwnerID: 3, Visibility: common.ArchiveVisibilityPrivate}}, nil
+	}
+	if response := performUserControllerRequest(http.MethodGet, "/archiveTask/:taskId", "/archiveTask/task-1", "", bob, GetArchiveTaskStatus); response.Code != http.StatusNotFound {
+		t.Fatalf("other user's task status = %d, want 404", response.Code)
+	}
+
+	var gotOwnership common.ArchiveOwnership
+	resolveArchiveOwnership = func(user *common.User, visibility string, teamID uint) (common.ArchiveOwnership, error) {
+		if visibility == "team" && teamID == 0 {
+			return common.ArchiveOwnership{}, common.ErrArchiveTeamRequired
+		}
+		return common.ArchiveOwnership{OwnerID: user.ID, Visibility: visibility}, nil
+	}
+	addDocURLTask = func(rawURL string, ownership common.ArchiveOwnership) (*common.ArchiveTask, bool, error) {
+		gotOwnership = ownership
+		return &common.ArchiveTask{ID: "task-2", URL: rawURL, Status: search.ArchiveTaskStatusPending}, true, nil
+	}
+	response = performUserControllerRequest(http.MethodPost, "/archiveByURL", "/archiveByURL", `{"url":"https://example.com","visibility":"team"}`, bob, AddDocByURL)
+	if response.Code != 403 || !strings.Contains(response.Body.String(), "团队可见的归档需要指定团队") {
+		t.Fatalf("team without id status=%d body=%s", response.Code, response.Body.String())
+	}
+	response = performUserControllerRequest(http.MethodPost, "/archiveByURL", "/archiveByURL", `{"url":"https://example.com","visibility":"private"}`, bob, AddDocByURL)
+	if response.Code >= 400 || gotOwnership.OwnerID != 2 || gotOwnership.Visibility != common.ArchiveVisibilityPrivate {
+		t.Fatalf("private archive status=%d ownership=%+v body=%s", response.Code, gotOwnership, response.Body.String())
 	}
-	return body, writer.FormDataContentType()
 }
@@ -2,18 +2,25 @@ package api
 
 import (
 	"DataArk/common"
+	"errors"
 	"github.com/gin-gonic/gin"
 	"net/http"
+	"strconv"
+	"strings"
 )
 
 var (
 	extractTokenFromHeader = common.ExtractTokenFromHeader
 	validateToken          = common.ValidateToken
 	getUserByID            = common.GetUserByID
+	checkTokenActive       = common.CheckTokenActive
+	authenticateAPIToken   = common.AuthenticateAPIToken
+	recordAuditEvent       = common.RecordAuditEvent
 )
 
-// AuthMiddleware JWT认证中间件
-func AuthMiddleware() gin.HandlerFunc {
+// AuthMiddleware JWT认证中间件，同时接受 API Token。
+// scopes 为该接口接受的 API Token 权限范围，为空时只允许登录会话访问。
+func AuthMiddleware(scopes ...string) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// 从请求头中获取Authorization
 		authHeader := c.GetHeader("Authorization")
@@ -38,6 +45,11 @@ func AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
+		if common.IsAPIToken(tokenString) {
+			authenticateWithAPIToken(c, tokenString, scopes)
+			return
+		}
+
 		// 验证Token
 		claims, err := validateToken(tokenString)
 		if err != nil {
@@ -61,17 +73,199 @@ func AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
+		if user.Disabled {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"Status":  "0",
+				"Message": "This account has been disabled",
+			})
+			c.Abort()
+			return
+		}
+
+		// 检查Token是否已被吊销
+		if err := checkTokenActive(claims, user); err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"Status":  "0",
+				"Message": "Please provide a valid token",
+				"Error":   err.Error(),
+			})
+			c.Abort()
+			return
+		}
+
 		// 将用户信息存储在上下文中，供后续处理器使用
 		c.Set("user", user)
 		c.Set("user_id", user.ID)
 		c.Set("username", user.Username)
+		c.Set("role", user.Role)
 		c.Set("claims", claims)
+		setAuditActor(c, user)
 
 		// 继续处理请求
 		c.Next()
 	}
 }
 
+// authenticateWithAPIToken 校验 API Token 及其 scope，通过后与 JWT 一样设置用户信息。
+func authenticateWithAPIToken(c *gin.Context, tokenString string, scopes []string) {
+	apiToken, user, err := authenticateAPIToken(tokenString)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"Status":  "0",
+			"Message": "Please provide a valid token",
+			"Error":   err.Error(),
+		})
+		c.Abort()
+		return
+	}
+	if len(scopes) == 0 {
+		c.JSON(http.StatusForbidden, gin.H{
+			"Status":  "0",
+			"Message": "Permission denied",
+			"Error":   "api tokens are not accepted by this endpoint",
+		})
+		c.Abort()
+		return
+	}
+	if !apiToken.HasScope(scopes...) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"Status":  "0",
+			"Message": "Permission denied",
+			"Error":   "scope " + strings.Join(scopes, " or ") + " is required",
+		})
+		c.Abort()
+		return
+	}
+
+	c.Set("user", user)
+	c.Set("user_id", user.ID)
+	c.Set("username", user.Username)
+	c.Set("role", user.Role)
+	c.Set("api_token", apiToken)
+	setAuditActor(c, user)
+	c.Next()
+}
+
+// setAuditActor 把当前用户放入请求 context，下层操作写审计记录时使用。
+func setAuditActor(c *gin.Context, user *common.User) {
+	c.Request = c.Request.WithContext(common.WithAuditActor(c.Request.Context(), common.AuditActor{
+		UserID:   user.ID,
+		Username: user.Username,
+		IP:       c.ClientIP(),
+	}))
+}
+
+// auditSkippedRoutes 由登录流程自行记录审计的接口，中间件不再重复记录。
+var auditSkippedRoutes = map[string]bool{
+	"/api/login":         true,
+	"/api/login/totp":    true,
+	"/api/oidc/exchange": true,
+}
+
+// AuditMiddleware 为每个修改类请求写入一条审计记录，结果按响应状态码判断。
+// 未匹配路由的请求不记录，避免扫描器的请求刷满审计表。
+func AuditMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			c.Next()
+			return
+		}
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" || auditSkippedRoutes[route] {
+			return
+		}
+		var outcome error
+		status := c.Writer.Status()
+		if status >= http.StatusBadRequest {
+			outcome = errors.New(http.StatusText(status))
+		}
+		actor := common.AuditActor{Username: common.AuditActorAnonymous, IP: c.ClientIP()}
+		if user, ok := GetCurrentUser(c); ok {
+			actor.UserID = user.ID
+			actor.Username = user.Username
+		}
+		ctx := common.WithAuditActor(c.Request.Context(), actor)
+		recordAuditEvent(ctx, common.AuditActionRequest, c.Request.Method+" "+c.Request.URL.Path, "HTTP "+strconv.Itoa(status), outcome)
+	}
+}
+
+// RequireRole 角色校验中间件，必须放在 AuthMiddleware 之后。
+// 角色按 admin > editor > viewer 分级，拥有更高角色的用户同样可以访问。
+func RequireRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, exists := GetCurrentUser(c)
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"Status":  "0",
+				"Message": "This endpoint requires authentication",
+			})
+			c.Abort()
+			return
+		}
+		if !user.HasRole(role) {
+			c.JSON(http.StatusForbidden, gin.H{
+				"Status":  "0",
+				"Message": "Permission denied",
+				"Error":   "role " + role + " is required",
+			})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequireTwoFactor 两步验证校验中间件，必须放在 AuthMiddleware 之后。
+// 用户必须已启用两步验证；登录会话还必须是通过两步验证签发的，API Token 则必须在创建时校验过两步验证码。
+func RequireTwoFactor() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, exists := GetCurrentUser(c)
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"Status":  "0",
+				"Message": "This endpoint requires authentication",
+			})
+			c.Abort()
+			return
+		}
+		if !user.TOTPEnabled {
+			c.JSON(http.StatusForbidden, gin.H{
+				"Status":  "0",
+				"Message": "Permission denied",
+				"Error":   "two-factor authentication must be enabled for this account",
+			})
+			c.Abort()
+			return
+		}
+		if value, ok := c.Get("claims"); ok {
+			if claims, ok := value.(*common.Claims); ok && !claims.MFA {
+				c.JSON(http.StatusForbidden, gin.H{
+					"Status":  "0",
+					"Message": "Permission denied",
+					"Error":   "please sign in again with two-factor authentication",
+				})
+				c.Abort()
+				return
+			}
+		}
+		if value, ok := c.Get("api_token"); ok {
+			if apiToken, ok := value.(*common.APIToken); ok && !apiToken.TwoFactor {
+				c.JSON(http.StatusForbidden, gin.H{
+					"Status":  "0",
+					"Message": "Permission denied",
+					"Error":   "this api token was created without two-factor authentication",
+				})
+				c.Abort()
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
 // OptionalAuthMiddleware 可选的认证中间件（用于某些接口可登录可不登录）
 func OptionalAuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -97,8 +291,8 @@ func OptionalAuthMiddleware() gin.HandlerFunc {
 		}
 
 		user, err := getUserByID(claims.UserID)
-		if err != nil {
-			// 用户不存在，继续处理但不设置用户信息
+		if err != nil || user.Disabled || checkTokenActive(claims, user) != nil {
+			// 用户不存在、已禁用或Token已吊销，继续处理但不设置用户信息
 			c.Next()
 			return
 		}
@@ -107,6 +301,7 @@ func OptionalAuthMiddleware() gin.HandlerFunc {
 		c.Set("user", user)
 		c.Set("user_id", user.ID)
 		c.Set("username", user.Username)
+		c.Set("role", user.Role)
 		c.Set("claims", claims)
 		c.Set("is_authenticated", true)
 
@@ -2,6 +2,7 @@ package api
 
 import (
 	"DataArk/common"
+	"context"
 	"errors"
 	"github.com/gin-gonic/gin"
 	"net/http"
@@ -51,6 +52,33 @@ func TestAuthMiddlewareBranches(t *testing.T) {
 		}
 	})
 
+	t.Run("disabled user", func(t *testing.T) {
+		withAuthFakes(t,
+			func(header string) (string, error) { return "token", nil },
+			func(token string) (*common.Claims, error) { return &common.Claims{UserID: 4, Username: "gone"}, nil },
+			func(id uint) (*common.User, error) {
+				return &common.User{ID: id, Username: "gone", Disabled: true}, nil
+			},
+		)
+		response := performMiddlewareRequest(AuthMiddleware(), "Bearer token")
+		if response.Code != http.StatusUnauthorized {
+			t.Fatalf("status = %d, want 401", response.Code)
+		}
+	})
+
+	t.Run("revoked token", func(t *testing.T) {
+		withAuthFakes(t,
+			func(header string) (string, error) { return "token", nil },
+			func(token string) (*common.Claims, error) { return &common.Claims{UserID: 5, Username: "leaked"}, nil },
+			func(id uint) (*common.User, error) { return &common.User{ID: id, Username: "leaked"}, nil },
+		)
+		checkTokenActive = func(*common.Claims, *common.User) error { return common.ErrTokenRevoked }
+		response := performMiddlewareRequest(AuthMiddleware(), "Bearer token")
+		if response.Code != http.StatusUnauthorized {
+			t.Fatalf("status = %d, want 401", response.Code)
+		}
+	})
+
 	t.Run("success", func(t *testing.T) {
 		withAuthFakes(t,
 			func(header string) (string, error) { return "token", nil },
@@ -64,6 +92,121 @@ func TestAuthMiddlewareBranches(t *testing.T) {
 	})
 }
 
+func TestAuthMiddlewareAPITokens(t *testing.T) {
+	oldAuthenticate := authenticateAPIToken
+	t.Cleanup(func() {
+		authenticateAPIToken = oldAuthenticate
+	})
+	withAuthFakes(t, nil, func(token string) (*common.Claims, error) {
+		t.Fatal("api tokens should not be parsed as jwt")
+		return nil, nil
+	}, nil)
+	authenticateAPIToken = func(token string) (*common.APIToken, *common.User, error) {
+		if token != "dak_valid" {
+			return nil, nil, common.ErrAPITokenInvalid
+		}
+		return &common.APIToken{ID: 3, UserID: 7, Scopes: common.ScopeSearchRead}, &common.User{ID: 7, Username: "bot"}, nil
+	}
+
+	if response := performMiddlewareRequest(AuthMiddleware(common.ScopeSearchRead), "Bearer dak_unknown"); response.Code != http.StatusUnauthorized {
+		t.Fatalf("unknown token status = %d, want 401", response.Code)
+	}
+	if response := performMiddlewareRequest(AuthMiddleware(), "Bearer dak_valid"); response.Code != http.StatusForbidden {
+		t.Fatalf("session-only endpoint status = %d, want 403", response.Code)
+	}
+	if response := performMiddlewareRequest(AuthMiddleware(common.ScopeBackup), "Bearer dak_valid"); response.Code != http.StatusForbidden {
+		t.Fatalf("missing scope status = %d, want 403", response.Code)
+	}
+	response := performMiddlewareRequest(AuthMiddleware(common.ScopeArchiveWrite, common.ScopeSearchRead), "Bearer dak_valid")
+	if response.Code != http.StatusOK || response.Body.String() != "bot" {
+		t.Fatalf("status=%d body=%q, want 200 bot", response.Code, response.Body.String())
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	serve := func(user *common.User, role string) *httptest.ResponseRecorder {
+		router := gin.New()
+		router.GET("/", func(c *gin.Context) {
+			if user != nil {
+				c.Set("user", user)
+			}
+			c.Next()
+		}, RequireRole(role), func(c *gin.Context) {
+			c.String(http.StatusOK, "ok")
+		})
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/", nil))
+		return response
+	}
+
+	if response := serve(nil, common.RoleViewer); response.Code != http.StatusUnauthorized {
+		t.Fatalf("anonymous status = %d, want 401", response.Code)
+	}
+	cases := []struct {
+		userRole string
+		required string
+		want     int
+	}{
+		{common.RoleViewer, common.RoleViewer, http.StatusOK},
+		{common.RoleViewer, common.RoleEditor, http.StatusForbidden},
+		{common.RoleEditor, common.RoleEditor, http.StatusOK},
+		{common.RoleEditor, common.RoleAdmin, http.StatusForbidden},
+		{common.RoleAdmin, common.RoleEditor, http.StatusOK},
+		{"", common.RoleViewer, http.StatusForbidden},
+	}
+	for _, tc := range cases {
+		response := serve(&common.User{Username: "u", Role: tc.userRole}, tc.required)
+		if response.Code != tc.want {
+			t.Fatalf("role %q requiring %q status = %d, want %d", tc.userRole, tc.required, response.Code, tc.want)
+		}
+	}
+}
+
+func TestRequireTwoFactor(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	serve := func(user *common.User, key string, value interface{}) *httptest.ResponseRecorder {
+		router := gin.New()
+		router.GET("/", func(c *gin.Context) {
+			if user != nil {
+				c.Set("user", user)
+			}
+			if value != nil {
+				c.Set(key, value)
+			}
+			c.Next()
+		}, RequireTwoFactor(), func(c *gin.Context) {
+			c.String(http.StatusOK, "ok")
+		})
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/", nil))
+		return response
+	}
+
+	if response := serve(nil, "", nil); response.Code != http.StatusUnauthorized {
+		t.Fatalf("anonymous status = %d, want 401", response.Code)
+	}
+	enrolled := &common.User{Username: "admin", Role: common.RoleAdmin, TOTPEnabled: true}
+	cases := []struct {
+		name  string
+		user  *common.User
+		key   string
+		value interface{}
+		want  int
+	}{
+		{"user without 2fa", &common.User{Username: "admin", Role: common.RoleAdmin}, "claims", &common.Claims{MFA: true}, http.StatusForbidden},
+		{"session without 2fa login", enrolled, "claims", &common.Claims{}, http.StatusForbidden},
+		{"session with 2fa login", enrolled, "claims", &common.Claims{MFA: true}, http.StatusOK},
+		{"api token created without code", enrolled, "api_token", &common.APIToken{Scopes: common.ScopeBackup}, http.StatusForbidden},
+		{"api token created with code", enrolled, "api_token", &common.APIToken{Scopes: common.ScopeBackup, TwoFactor: true}, http.StatusOK},
+	}
+	for _, tc := range cases {
+		if response := serve(tc.user, tc.key, tc.value); response.Code != tc.want {
+			t.Fatalf("%s status = %d, want %d", tc.name, response.Code, tc.want)
+		}
+	}
+}
+
 func TestOptionalAuthMiddlewareBranches(t *testing.T) {
 	t.Run("missing header continues", func(t *testing.T) {
 		response := performMiddlewareRequest(OptionalAuthMiddleware(), "")
@@ -159,6 +302,70 @@ func TestContextAuthHelpers(t *testing.T) {
 	}
 }
 
+func TestAuditMiddlewareRecordsMutatingRequests(t *testing.T) {
+	type recorded struct {
+		actor  common.AuditActor
+		action string
+		target string
+		detail string
+		failed bool
+	}
+	var events []recorded
+	oldRecord := recordAuditEvent
+	t.Cleanup(func() {
+		recordAuditEvent = oldRecord
+	})
+	recordAuditEvent = func(ctx context.Context, action string, target string, detail string, err error) {
+		events = append(events, recorded{actor: common.AuditActorFromContext(ctx), action: action, target: target, detail: detail, failed: err != nil})
+	}
+	withAuthFakes(t,
+		func(header string) (string, error) { return "token", nil },
+		func(token string) (*common.Claims, error) { return &common.Claims{UserID: 5}, nil },
+		func(id uint) (*common.User, error) {
+			return &common.User{ID: id, Username: "alice", Role: common.RoleAdmin}, nil
+		},
+	)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(AuditMiddleware())
+	handlerActor := ""
+	router.DELETE("/api/archive", AuthMiddleware(), func(c *gin.Context) {
+		// 认证中间件把操作者放进请求 context，下层操作可以直接使用
+		handlerActor = common.AuditActorFromContext(c.Request.Context()).Username
+		c.Status(http.StatusOK)
+	})
+	router.GET("/api/search", func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.POST("/api/login", func(c *gin.Context) { c.Status(http.StatusUnauthorized) })
+	router.POST("/api/users", func(c *gin.Context) { c.Status(http.StatusForbidden) })
+	serve := func(method string, target string, authHeader string) {
+		request := httptest.NewRequest(method, target, nil)
+		if authHeader != "" {
+			request.Header.Set("Authorization", authHeader)
+		}
+		router.ServeHTTP(httptest.NewRecorder(), request)
+	}
+
+	serve(http.MethodDelete, "/api/archive?path=/archive/a/b.html", "Bearer token")
+	serve(http.MethodGet, "/api/search", "")
+	serve(http.MethodPost, "/api/login", "")
+	serve(http.MethodPost, "/api/unknown", "")
+	serve(http.MethodPost, "/api/users", "")
+
+	if handlerActor != "alice" {
+		t.Fatalf("handler actor = %q, want alice", handlerActor)
+	}
+	if len(events) != 2 {
+		t.Fatalf("events = %+v, want delete and users requests only", events)
+	}
+	if events[0].actor.Username != "alice" || events[0].actor.UserID != 5 || events[0].target != "DELETE /api/archive" || events[0].detail != "HTTP 200" || events[0].failed {
+		t.Fatalf("unexpected delete event %+v", events[0])
+	}
+	if events[1].actor.Username != common.AuditActorAnonymous || events[1].action != common.AuditActionRequest || !events[1].failed {
+		t.Fatalf("unexpected anonymous event %+v", events[1])
+	}
+}
+
 func performMiddlewareRequest(middleware gin.HandlerFunc, authHeader string) *httptest.ResponseRecorder {
 	gin.SetMode(gin.TestMode)
 	router := gin.New()
@@ -189,11 +396,14 @@ func withAuthFakes(
 	oldExtract := extractTokenFromHeader
 	oldValidate := validateToken
 	oldGetUser := getUserByID
+	oldCheckActive := checkTokenActive
 	t.Cleanup(func() {
 		extractTokenFromHeader = oldExtract
 		validateToken = oldValidate
 		getUserByID = oldGetUser
+		checkTokenActive = oldCheckActive
 	})
+	checkTokenActive = func(*common.Claims, *common.User) error { return nil }
 	if extract != nil {
 		extractTokenFromHeader = extract
 	}
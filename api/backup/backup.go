@@ -2,7 +2,6 @@ package backup
 
 import (
 	"DataArk/common"
-	"DataArk/search"
 	"archive/zip"
 	"context"
 	"encoding/json"
@@ -28,6 +27,13 @@ const (
 	databaseRestoreTimeout = 10 * time.Minute
 )
 
+const (
+	// ManifestFormatVersion 是当前写入的 manifest 格式版本，没有这个字段的旧备份读出为 0。
+	ManifestFormatVersion = 1
+	// manifestChecksumsVersion 是开始总会写入 checksums 的 manifest 版本。
+	manifestChecksumsVersion = 1
+)
+
 var operationMu sync.Mutex
 
 type PreparedBackup struct {
@@ -38,11 +44,22 @@ type PreparedBackup struct {
 }
 
 type Manifest struct {
+	// FormatVersion 是 manifest 的格式版本，见 ManifestFormatVersion。
+	FormatVersion   int    `json:"formatVersion,omitempty"`
 	CreatedAt       string `json:"createdAt"`
+	SearchEngine    string `json:"searchEngine"`
 	MeiliDumpFile   string `json:"meiliDumpFile"`
 	MeiliDumpUID    string `json:"meiliDumpUid"`
+	DatabaseDriver  string `json:"databaseDriver"`
 	DatabaseSQLFile string `json:"databaseSqlFile"`
-	ArchiveDir      string `json:"archiveDir"`
+	// DatabaseExportFile 是默认使用的 JSON lines 逻辑导出，与数据库驱动无关，DatabaseExportVersion 为导出格式版本。
+	DatabaseExportFile    string `json:"databaseExportFile,omitempty"`
+	DatabaseExportVersion int    `json:"databaseExportVersion,omitempty"`
+	// DatabaseSnapshotFile 仅在 SQLite 模式下存在，是一个完整的 SQLite 数据库文件。
+	DatabaseSnapshotFile string `json:"databaseSnapshotFile,omitempty"`
+	ArchiveDir           string `json:"archiveDir"`
+	// Checksums 记录备份中除 manifest.json 外每个文件的 SHA-256，键为相对备份根目录的路径，恢复前逐个校验。
+	Checksums map[string]string `json:"checksums,omitempty"`
 }
 
 type RestoreResult struct {
@@ -51,12 +68,22 @@ type RestoreResult struct {
 	ArchiveRestored   bool   `json:"archiveRestored"`
 	IndexedDocuments  int    `json:"indexedDocuments"`
 	RefreshedStatRows int    `json:"refreshedStatRows"`
+	// DryRun 为 true 时没有改动任何数据，Plan 描述真正恢复时会发生的变化。
+	DryRun bool         `json:"dryRun,omitempty"`
+	Plan   *RestorePlan `json:"plan,omitempty"`
+}
+
+// RestoreOptions 控制恢复行为，DryRun 只校验备份并计算变化，不改动数据库和归档目录。
+type RestoreOptions struct {
+	DryRun bool
 }
 
 type restoreComponents struct {
-	MeiliDumpPath string
-	DatabasePath  string
-	ArchiveDir    string
+	MeiliDumpPath        string
+	DatabasePath         string
+	DatabaseSnapshotPath string
+	DatabaseExportPath   string
+	ArchiveDir           string
 }
 
 func CreateBackup(ctx context.Context) (*PreparedBackup, error) {
@@ -85,28 +112,21 @@ func CreateBackup(ctx context.Context) (*PreparedBackup, error) {
 		return nil, err
 	}
 
-	meiliDumpFile, meiliDumpUID, err := createMeiliDump(ctx, backupDir)
+	manifest, err := createServiceDumps(ctx, backupDir, createdAt)
 	if err != nil {
 		return nil, err
 	}
 
-	databaseFile := "database.sql"
-	if err := createDatabaseDump(ctx, filepath.Join(backupDir, databaseFile)); err != nil {
+	if err := copyArchiveSnapshot(ctx, filepath.Join(backupDir, manifest.ArchiveDir)); err != nil {
 		return nil, err
 	}
 
-	if err := copyArchiveSnapshot(filepath.Join(backupDir, "archive")); err != nil {
+	manifest.FormatVersion = ManifestFormatVersion
+	manifest.Checksums, err = checksumDir(backupDir)
+	if err != nil {
 		return nil, err
 	}
-
-	manifest := Manifest{
-		CreatedAt:       createdAt.Format(time.RFC3339),
-		MeiliDumpFile:   meiliDumpFile,
-		MeiliDumpUID:    meiliDumpUID,
-		DatabaseSQLFile: databaseFile,
-		ArchiveDir:      "archive",
-	}
-	if err := writeJSON(filepath.Join(backupDir, "manifest.json"), manifest); err != nil {
+	if err := writeJSON(filepath.Join(backupDir, manifestFileName), manifest); err != nil {
 		return nil, err
 	}
 
@@ -119,6 +139,64 @@ func CreateBackup(ctx context.Context) (*PreparedBackup, error) {
 	}, nil
 }
 
+// createServiceDumps 把 Meilisearch dump 和数据库导出写入 dir，返回记录了这些文件的 Manifest。
+// 内嵌搜索引擎的索引可以随时从 HTML 重建，备份里只需要 Meilisearch 的 dump。
+func createServiceDumps(ctx context.Context, dir string, createdAt time.Time) (Manifest, error) {
+	manifest := Manifest{
+		CreatedAt:      createdAt.Format(time.RFC3339),
+		SearchEngine:   searchEngineName(),
+		DatabaseDriver: databaseDriverName(),
+		ArchiveDir:     "archive",
+	}
+
+	if usesMeilisearch() {
+		progressFrom(ctx).phase(JobPhaseMeiliDump, 0)
+		var err error
+		manifest.MeiliDumpFile, manifest.MeiliDumpUID, err = createMeiliDump(ctx, dir)
+		if err != nil {
+			return Manifest{}, err
+		}
+	}
+
+	progressFrom(ctx).phase(JobPhaseDatabaseDump, 0)
+	switch common.BackupDatabaseFormat {
+	case "", common.BackupDatabaseFormatJSONL:
+		manifest.DatabaseExportFile = "database.jsonl"
+		manifest.DatabaseExportVersion = common.DatabaseExportVersion
+		if err := createDatabaseExport(ctx, filepath.Join(dir, manifest.DatabaseExportFile)); err != nil {
+			return Manifest{}, fmt.Errorf("export database: %w", err)
+		}
+	case common.BackupDatabaseFormatNative:
+		if common.IsSQLite() {
+			manifest.DatabaseSnapshotFile = "database.sqlite"
+			if err := common.CreateSQLiteSnapshot(ctx, filepath.Join(dir, manifest.DatabaseSnapshotFile)); err != nil {
+				return Manifest{}, fmt.Errorf("create sqlite snapshot: %w", err)
+			}
+		} else {
+			manifest.DatabaseSQLFile = "database.sql"
+			if err := createDatabaseDump(ctx, filepath.Join(dir, manifest.DatabaseSQLFile)); err != nil {
+				return Manifest{}, err
+			}
+		}
+	default:
+		return Manifest{}, fmt.Errorf("unsupported backup database format %q", common.BackupDatabaseFormat)
+	}
+	return manifest, nil
+}
+
+// createDatabaseExport 把数据库导出为 JSON lines，不需要安装与服务端版本一致的 pg_dump。
+func createDatabaseExport(ctx context.Context, destination string) error {
+	file, err := os.OpenFile(destination, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := common.ExportDatabase(ctx, file); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
 func (p *PreparedBackup) Cleanup() {
 	if p == nil || p.RootDir == "" {
 		return
@@ -126,20 +204,48 @@ func (p *PreparedBackup) Cleanup() {
 	_ = os.RemoveAll(p.RootDir)
 }
 
+// WriteZip 把备份打包成 zip 写入 w，配置了加密时写入的是加密后的内容。
 func (p *PreparedBackup) WriteZip(w io.Writer) error {
+	return p.writeZip(context.Background(), w)
+}
+
+func (p *PreparedBackup) writeZip(ctx context.Context, w io.Writer) error {
 	if p == nil {
 		return errors.New("backup is not prepared")
 	}
+	progressFrom(ctx).phase(JobPhaseZip, dirSize(p.BackupDir))
 
-	zipWriter := zip.NewWriter(w)
-	if err := addDirectoryToZip(zipWriter, p.BackupDir); err != nil {
+	backupWriter, err := newBackupWriter(w)
+	if err != nil {
+		return err
+	}
+	zipWriter := zip.NewWriter(backupWriter)
+	if err := addDirectoryToZip(ctx, zipWriter, p.BackupDir); err != nil {
 		_ = zipWriter.Close()
 		return err
 	}
-	return zipWriter.Close()
+	if err := zipWriter.Close(); err != nil {
+		return err
+	}
+	return backupWriter.Close()
 }
 
-func RestoreBackup(ctx context.Context, zipPath string) (*RestoreResult, error) {
+// RestoreBackup 用备份覆盖数据库和归档目录并重建索引。
+// 审计记录在恢复结束后写入，因此会保存在恢复后的数据库中；预演不改动数据，也不写审计记录。
+func RestoreBackup(ctx context.Context, zipPath string, options RestoreOptions) (*RestoreResult, error) {
+	result, err := restoreBackup(ctx, zipPath, options)
+	if options.DryRun {
+		return result, err
+	}
+	detail := ""
+	if result != nil {
+		detail = fmt.Sprintf("indexed %d documents", result.IndexedDocuments)
+	}
+	common.RecordAuditEvent(ctx, common.AuditActionBackupRestore, filepath.Base(zipPath), detail, err)
+	return result, err
+}
+
+func restoreBackup(ctx context.Context, zipPath string, options RestoreOptions) (*RestoreResult, error) {
 	operationMu.Lock()
 	defer operationMu.Unlock()
 
@@ -147,54 +253,143 @@ func RestoreBackup(ctx context.Context, zipPath string) (*RestoreResult, error)
 		return nil, err
 	}
 
-	tempRoot, err := os.MkdirTemp("", "dataark-restore-*")
+	tempRoot, err := restoreStagingDir()
 	if err != nil {
 		return nil, err
 	}
 	defer os.RemoveAll(tempRoot)
 
+	progressFrom(ctx).phase(JobPhaseExtract, 0)
+	zipPath, err = openBackupZip(zipPath, tempRoot)
+	if err != nil {
+		return nil, err
+	}
 	extractDir := filepath.Join(tempRoot, "extract")
-	if err := extractZip(zipPath, extractDir); err != nil {
+	if err := extractZip(ctx, zipPath, extractDir); err != nil {
+		return nil, err
+	}
+	// 校验在改动数据库之前完成，被篡改或不完整的备份不会覆盖现有数据。
+	progressFrom(ctx).phase(JobPhaseVerify, 0)
+	if err := verifyBackupChecksums(extractDir); err != nil {
 		return nil, err
 	}
+	if options.DryRun {
+		plan, err := planRestore(ctx, extractDir)
+		if err != nil {
+			return nil, err
+		}
+		return &RestoreResult{DryRun: true, Plan: plan}, nil
+	}
+	return restoreExtracted(ctx, extractDir)
+}
+
+// openBackupZip 返回可以直接解压的 zip 路径：加密的备份解密到 tempRoot 中，未加密的原样返回。
+// 配置了加密后拒绝未加密的备份，否则替换成明文备份就能绕过加密的完整性保护。
+func openBackupZip(zipPath string, tempRoot string) (string, error) {
+	encrypted, err := isEncryptedBackup(zipPath)
+	if err != nil {
+		return "", err
+	}
+	keys := currentEncryptionKeys()
+	if !encrypted {
+		if keys.enabled() {
+			return "", ErrBackupNotEncrypted
+		}
+		return zipPath, nil
+	}
+
+	decryptedPath := filepath.Join(tempRoot, "decrypted.zip")
+	if err := decryptBackupFile(zipPath, decryptedPath, keys); err != nil {
+		return "", err
+	}
+	return decryptedPath, nil
+}
 
+// restoreExtracted 用已解开的备份目录恢复，调用方需持有 operationMu 并负责清理 extractDir。
+// 开始覆盖数据库之后不再响应取消；之后任何一步失败都会回滚到恢复前的状态，返回 *RestoreError。
+func restoreExtracted(ctx context.Context, extractDir string) (*RestoreResult, error) {
 	components, err := discoverRestoreComponents(extractDir)
 	if err != nil {
 		return nil, err
 	}
+	// 先确认备份里有当前数据库驱动可用的数据，再开始改动任何现有数据。
+	if err := checkDatabaseRestoreSource(components); err != nil {
+		return nil, err
+	}
 
-	restoredDumpFile, err := restoreMeiliDumpFile(components.MeiliDumpPath)
+	state, err := savePreRestoreState(ctx)
 	if err != nil {
 		return nil, err
 	}
-
-	if err := restoreDatabaseDump(ctx, components.DatabasePath); err != nil {
+	if err := ctx.Err(); err != nil {
+		state.discard()
 		return nil, err
 	}
+	ctx = context.WithoutCancel(ctx)
 
-	if err := replaceArchiveDir(components.ArchiveDir, tempRoot); err != nil {
-		return nil, err
+	result, phase, err := applyRestore(ctx, components, state)
+	if err != nil {
+		return nil, state.fail(ctx, phase, err)
 	}
+	state.discard()
+	return result, nil
+}
+
+// applyRestore 依次覆盖数据库、归档目录和索引，失败时返回所在的阶段，由调用方回滚。
+func applyRestore(ctx context.Context, components *restoreComponents, state *preRestoreState) (*RestoreResult, string, error) {
+	result := &RestoreResult{}
+	if components.MeiliDumpPath != "" && usesMeilisearch() {
+		dumpFile, err := restoreMeiliDumpFile(components.MeiliDumpPath)
+		if err != nil {
+			return nil, JobPhaseMeiliDump, err
+		}
+		state.meiliDumpFile = dumpFile
+		result.MeiliDumpFile = dumpFile
+	}
+
+	progressFrom(ctx).phase(JobPhaseDatabaseRestore, 0)
+	if err := restoreDatabase(ctx, components); err != nil {
+		return nil, JobPhaseDatabaseRestore, err
+	}
+	result.DatabaseRestored = true
+
+	progressFrom(ctx).phase(JobPhaseArchiveRestore, dirSize(components.ArchiveDir))
+	if err := state.moveArchiveAside(ctx); err != nil {
+		return nil, JobPhaseArchiveRestore, err
+	}
+	if err := replaceArchiveDir(ctx, components.ArchiveDir); err != nil {
+		return nil, JobPhaseArchiveRestore, err
+	}
+	result.ArchiveRestored = true
 
 	// Meilisearch dump import is a startup-only Meilisearch operation. For this
 	// running API restore path, rebuild the application index from restored HTML.
-	rebuildResult, err := search.RebuildIndexFromArchive(ctx)
+	progressFrom(ctx).phase(JobPhaseReindex, 0)
+	state.indexChanged = true
+	rebuildResult, err := rebuildArchiveIndex(ctx)
 	if err != nil {
-		return nil, err
+		return nil, JobPhaseReindex, err
 	}
+	result.IndexedDocuments = rebuildResult.Documents
 
 	stats, err := common.RefreshArchiveStatsFromDisk()
 	if err != nil {
-		return nil, err
+		return nil, JobPhaseReindex, err
 	}
+	result.RefreshedStatRows = len(stats.Sources)
+	return result, "", nil
+}
 
-	return &RestoreResult{
-		MeiliDumpFile:     restoredDumpFile,
-		DatabaseRestored:  true,
-		ArchiveRestored:   true,
-		IndexedDocuments:  rebuildResult.Documents,
-		RefreshedStatRows: len(stats.Sources),
-	}, nil
+func usesMeilisearch() bool {
+	return searchEngineName() == common.SearchEngineMeilisearch
+}
+
+func searchEngineName() string {
+	engine := strings.ToLower(strings.TrimSpace(common.SearchEngine))
+	if engine == "" {
+		return common.SearchEngineMeilisearch
+	}
+	return engine
 }
 
 func createMeiliDump(ctx context.Context, backupDir string) (string, string, error) {
@@ -226,12 +421,57 @@ func createMeiliDump(ctx context.Context, backupDir string) (string, string, err
 	}
 
 	dumpFileName := dumpUID + ".dump"
-	if err := copyFile(sourcePath, filepath.Join(backupDir, dumpFileName)); err != nil {
+	if err := copyFile(ctx, sourcePath, filepath.Join(backupDir, dumpFileName)); err != nil {
 		return "", "", fmt.Errorf("copy meilisearch dump: %w", err)
 	}
 	return dumpFileName, dumpUID, nil
 }
 
+func databaseDriverName() string {
+	if common.IsSQLite() {
+		return common.DBDriverSQLite
+	}
+	return common.DBDriverPostgres
+}
+
+// checkDatabaseRestoreSource 确认备份中包含当前驱动能导入的数据库文件。
+// JSON lines 导出两种驱动都能导入；PostgreSQL 的 SQL 和 SQLite 快照不能互相导入，跨驱动恢复直接拒绝。
+func checkDatabaseRestoreSource(components *restoreComponents) error {
+	if components.DatabaseExportPath != "" {
+		return nil
+	}
+	if common.IsSQLite() {
+		if components.DatabaseSnapshotPath == "" {
+			return errors.New("backup zip does not contain a sqlite database snapshot")
+		}
+		return nil
+	}
+	if components.DatabasePath == "" {
+		return errors.New("backup zip does not contain a database .sql file")
+	}
+	return nil
+}
+
+func restoreDatabase(ctx context.Context, components *restoreComponents) error {
+	if components.DatabaseExportPath != "" {
+		restoreCtx, cancel := context.WithTimeout(ctx, databaseRestoreTimeout)
+		defer cancel()
+		if _, err := common.ImportDatabase(restoreCtx, components.DatabaseExportPath); err != nil {
+			return fmt.Errorf("import database export: %w", err)
+		}
+		return nil
+	}
+	if common.IsSQLite() {
+		restoreCtx, cancel := context.WithTimeout(ctx, databaseRestoreTimeout)
+		defer cancel()
+		if err := common.RestoreSQLiteSnapshot(restoreCtx, components.DatabaseSnapshotPath); err != nil {
+			return fmt.Errorf("restore sqlite snapshot: %w", err)
+		}
+		return nil
+	}
+	return restoreDatabaseDump(ctx, components.DatabasePath)
+}
+
 func createDatabaseDump(ctx context.Context, destination string) error {
 	if strings.TrimSpace(common.DBName) == "" {
 		return errors.New("database name is empty")
@@ -288,7 +528,7 @@ func runDatabaseCommand(ctx context.Context, command string, args ...string) err
 	return nil
 }
 
-func copyArchiveSnapshot(destination string) error {
+func copyArchiveSnapshot(ctx context.Context, destination string) error {
 	source := strings.TrimSpace(common.ARCHIVEFILELOACTION)
 	if source == "" {
 		return errors.New("archive location is empty")
@@ -301,7 +541,8 @@ func copyArchiveSnapshot(destination string) error {
 		return err
 	}
 
-	return copyDir(source, destination)
+	progressFrom(ctx).phase(JobPhaseArchiveCopy, dirSize(source))
+	return copyDir(ctx, source, destination)
 }
 
 func restoreMeiliDumpFile(source string) (string, error) {
@@ -311,13 +552,15 @@ func restoreMeiliDumpFile(source string) (string, error) {
 
 	fileName := "restored-" + time.Now().Format("20060102-150405") + "-" + filepath.Base(source)
 	destination := filepath.Join(common.MEILIDumpDir, fileName)
-	if err := copyFile(source, destination); err != nil {
+	if err := copyFile(context.Background(), source, destination); err != nil {
 		return "", err
 	}
 	return fileName, nil
 }
 
-func replaceArchiveDir(sourceArchive string, tempRoot string) error {
+// replaceArchiveDir 把备份中的归档移到已清空的归档目录，原有内容由 preRestoreState 事先移走。
+// 备份解开在归档目录旁边的临时目录中，同一个文件系统上只需改名。
+func replaceArchiveDir(ctx context.Context, sourceArchive string) error {
 	archiveRoot, err := cleanArchiveRoot()
 	if err != nil {
 		return err
@@ -330,35 +573,45 @@ func replaceArchiveDir(sourceArchive string, tempRoot string) error {
 	if !sourceInfo.IsDir() {
 		return fmt.Errorf("backup archive path %s is not a directory", sourceArchive)
 	}
-
-	backupCurrent := filepath.Join(tempRoot, "current-archive")
-	hasCurrentArchive := false
-	if archiveInfo, err := os.Stat(archiveRoot); err == nil {
-		if !archiveInfo.IsDir() {
-			return fmt.Errorf("archive location %s is not a directory", archiveRoot)
-		}
-		if err := copyDir(archiveRoot, backupCurrent); err != nil {
-			return err
-		}
-		hasCurrentArchive = true
-	} else if os.IsNotExist(err) {
-		if err := os.MkdirAll(archiveRoot, 0o755); err != nil {
-			return err
-		}
-	} else if !os.IsNotExist(err) {
+	if err := os.MkdirAll(archiveRoot, 0o755); err != nil {
 		return err
 	}
+	return moveDirContents(ctx, sourceArchive, archiveRoot)
+}
+
+// restoreStagingDir 在归档目录旁边创建恢复用的临时目录，解开的归档与归档目录在同一个文件系统上。
+// 目录名以点开头，服务异常退出后留下的目录在下次启动时清理。
+func restoreStagingDir() (string, error) {
+	archiveRoot, err := cleanArchiveRoot()
+	if err != nil {
+		return "", err
+	}
+	parent := filepath.Dir(archiveRoot)
+	if err := os.MkdirAll(parent, 0o755); err != nil {
+		return "", err
+	}
+	return os.MkdirTemp(parent, restoreStagingPattern(archiveRoot))
+}
 
-	if err := removeDirContents(archiveRoot); err != nil {
+func restoreStagingPattern(archiveRoot string) string {
+	return "." + filepath.Base(archiveRoot) + ".restore-*"
+}
+
+// removeRestoreStagingDirs 删除上次进程退出时没有清理的恢复临时目录，恢复前移走的归档不在其中。
+func removeRestoreStagingDirs() error {
+	archiveRoot, err := cleanArchiveRoot()
+	if err != nil {
 		return err
 	}
-	if err := copyDir(sourceArchive, archiveRoot); err != nil {
-		_ = removeDirContents(archiveRoot)
-		if hasCurrentArchive {
-			_ = copyDir(backupCurrent, archiveRoot)
-		}
+	matches, err := filepath.Glob(filepath.Join(filepath.Dir(archiveRoot), restoreStagingPattern(archiveRoot)))
+	if err != nil {
 		return err
 	}
+	for _, match := range matches {
+		if err := os.RemoveAll(match); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -401,7 +654,7 @@ func writeJSON(destination string, value interface{}) error {
 	return encoder.Encode(value)
 }
 
-func addDirectoryToZip(zipWriter *zip.Writer, sourceDir string) error {
+func addDirectoryToZip(ctx context.Context, zipWriter *zip.Writer, sourceDir string) error {
 	sourceParent := filepath.Dir(sourceDir)
 
 	return filepath.WalkDir(sourceDir, func(currentPath string, entry fs.DirEntry, walkErr error) error {
@@ -448,7 +701,7 @@ func addDirectoryToZip(zipWriter *zip.Writer, sourceDir string) error {
 			return err
 		}
 
-		_, copyErr := io.Copy(writer, file)
+		_, copyErr := copyWithContext(ctx, writer, file)
 		closeErr := file.Close()
 		if copyErr != nil {
 			return copyErr
@@ -457,13 +710,19 @@ func addDirectoryToZip(zipWriter *zip.Writer, sourceDir string) error {
 	})
 }
 
-func extractZip(source string, destination string) error {
+func extractZip(ctx context.Context, source string, destination string) error {
 	reader, err := zip.OpenReader(source)
 	if err != nil {
 		return err
 	}
 	defer reader.Close()
 
+	var totalBytes int64
+	for _, file := range reader.File {
+		totalBytes += int64(file.UncompressedSize64)
+	}
+	progressFrom(ctx).phase(JobPhaseExtract, totalBytes)
+
 	for _, file := range reader.File {
 		relativePath, ok := safeZipEntryPath(file.Name)
 		if !ok {
@@ -497,7 +756,7 @@ func extractZip(source string, destination string) error {
 			return err
 		}
 
-		_, copyErr := io.Copy(targetFile, sourceFile)
+		_, copyErr := copyWithContext(ctx, targetFile, sourceFile)
 		closeErr := targetFile.Close()
 		_ = sourceFile.Close()
 		if copyErr != nil {
@@ -516,6 +775,8 @@ func discoverRestoreComponents(root string) (*restoreComponents, error) {
 	var archiveDepth int
 	var dumpCandidates []string
 	var databaseCandidates []string
+	var snapshotCandidates []string
+	var exportCandidates []string
 
 	err := filepath.WalkDir(root, func(currentPath string, entry fs.DirEntry, walkErr error) error {
 		if walkErr != nil {
@@ -543,6 +804,12 @@ func discoverRestoreComponents(root string) (*restoreComponents, error) {
 		if strings.HasSuffix(name, ".sql") {
 			databaseCandidates = append(databaseCandidates, currentPath)
 		}
+		if strings.HasSuffix(name, ".sqlite") {
+			snapshotCandidates = append(snapshotCandidates, currentPath)
+		}
+		if strings.HasSuffix(name, ".jsonl") {
+			exportCandidates = append(exportCandidates, currentPath)
+		}
 		return nil
 	})
 	if err != nil {
@@ -551,12 +818,11 @@ func discoverRestoreComponents(root string) (*restoreComponents, error) {
 
 	components.MeiliDumpPath = chooseRestoreCandidate(root, dumpCandidates, "")
 	components.DatabasePath = chooseRestoreCandidate(root, databaseCandidates, "database.sql")
+	components.DatabaseSnapshotPath = chooseRestoreCandidate(root, snapshotCandidates, "database.sqlite")
+	components.DatabaseExportPath = chooseRestoreCandidate(root, exportCandidates, "database.jsonl")
 
-	if components.MeiliDumpPath == "" {
-		return nil, errors.New("backup zip does not contain a meilisearch .dump file")
-	}
-	if components.DatabasePath == "" {
-		return nil, errors.New("backup zip does not contain a database .sql file")
+	if components.DatabasePath == "" && components.DatabaseSnapshotPath == "" && components.DatabaseExportPath == "" {
+		return nil, errors.New("backup zip does not contain a database export, .sql file or sqlite snapshot")
 	}
 	if components.ArchiveDir == "" {
 		return nil, errors.New("backup zip does not contain an archive directory")
@@ -645,7 +911,7 @@ func waitForFile(ctx context.Context, filePath string, timeout time.Duration) er
 	}
 }
 
-func copyDir(source string, destination string) error {
+func copyDir(ctx context.Context, source string, destination string) error {
 	return filepath.WalkDir(source, func(currentPath string, entry fs.DirEntry, walkErr error) error {
 		if walkErr != nil {
 			return walkErr
@@ -668,11 +934,11 @@ func copyDir(source string, destination string) error {
 		if entry.IsDir() {
 			return os.MkdirAll(targetPath, info.Mode().Perm())
 		}
-		return copyFile(currentPath, targetPath)
+		return copyFile(ctx, currentPath, targetPath)
 	})
 }
 
-func copyFile(source string, destination string) error {
+func copyFile(ctx context.Context, source string, destination string) error {
 	info, err := os.Stat(source)
 	if err != nil {
 		return err
@@ -696,7 +962,7 @@ func copyFile(source string, destination string) error {
 		return err
 	}
 
-	_, copyErr := io.Copy(targetFile, sourceFile)
+	_, copyErr := copyWithContext(ctx, targetFile, sourceFile)
 	closeErr := targetFile.Close()
 	if copyErr != nil {
 		return copyErr
@@ -72,7 +72,7 @@ func TestWriteJSONAndExtractZip(t *testing.T) {
 		"backup/archive/example/page.html": "<html></html>",
 	})
 	extractDir := filepath.Join(root, "extract")
-	if err := extractZip(zipPath, extractDir); err != nil {
+	if err := extractZip(context.Background(), zipPath, extractDir); err != nil {
 		t.Fatalf("extractZip returned error: %v", err)
 	}
 	if _, err := os.Stat(filepath.Join(extractDir, "backup", "database.sql")); err != nil {
@@ -83,7 +83,7 @@ func TestWriteJSONAndExtractZip(t *testing.T) {
 func TestExtractZipRejectsUnsafeEntry(t *testing.T) {
 	zipPath := filepath.Join(t.TempDir(), "unsafe.zip")
 	createTestZip(t, zipPath, map[string]string{"../escape.txt": "bad"})
-	if err := extractZip(zipPath, t.TempDir()); err == nil || !strings.Contains(err.Error(), "unsafe zip entry") {
+	if err := extractZip(context.Background(), zipPath, t.TempDir()); err == nil || !strings.Contains(err.Error(), "unsafe zip entry") {
 		t.Fatalf("err = %v, want unsafe zip entry", err)
 	}
 }
@@ -99,13 +99,13 @@ func TestBackupFileHelpers(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if err := copyDir(source, destination); err != nil {
+	if err := copyDir(context.Background(), source, destination); err != nil {
 		t.Fatalf("copyDir returned error: %v", err)
 	}
 	if got, err := os.ReadFile(filepath.Join(destination, "nested", "file.txt")); err != nil || string(got) != "content" {
 		t.Fatalf("copied content = %q err=%v", string(got), err)
 	}
-	if err := copyFile(source, filepath.Join(root, "bad")); err == nil || !strings.Contains(err.Error(), "is a directory") {
+	if err := copyFile(context.Background(), source, filepath.Join(root, "bad")); err == nil || !strings.Contains(err.Error(), "is a directory") {
 		t.Fatalf("copyFile directory err = %v", err)
 	}
 	if err := removeDirContents(destination); err != nil {
@@ -131,7 +131,7 @@ func TestArchiveSnapshotAndDumpRestoreHelpers(t *testing.T) {
 	root := t.TempDir()
 	common.ARCHIVEFILELOACTION = filepath.Join(root, "missing-archive")
 	destination := filepath.Join(root, "snapshot")
-	if err := copyArchiveSnapshot(destination); err != nil {
+	if err := copyArchiveSnapshot(context.Background(), destination); err != nil {
 		t.Fatalf("copyArchiveSnapshot missing source returned error: %v", err)
 	}
 	if info, err := os.Stat(destination); err != nil || !info.IsDir() {
@@ -226,3 +226,22 @@ func createTestZip(t *testing.T, zipPath string, files map[string]string) {
 		t.Fatal(err)
 	}
 }
+
+func TestRestoreBackupKeepsLaterAuditEvents(t *testing.T) {
+	archiveRoot := setupSnapshotEnvironment(t)
+	writeArchiveTestFile(t, archiveRoot, "example.com", "a.html", "original")
+	zipPath := filepath.Join(t.TempDir(), "backup.zip")
+	writeTestBackupZip(t, zipPath)
+	common.RecordAuditEvent(context.Background(), common.AuditActionUserDelete, "mallory", "after backup", nil)
+
+	if _, err := RestoreBackup(context.Background(), zipPath, RestoreOptions{}); err != nil {
+		t.Fatalf("RestoreBackup returned error: %v", err)
+	}
+	if _, total, err := common.ListAuditEvents(common.AuditFilter{Action: common.AuditActionUserDelete}, 1, 10); err != nil || total != 1 {
+		t.Fatalf("audit events recorded after the backup total=%d err=%v, want 1", total, err)
+	}
+	restores, total, err := common.ListAuditEvents(common.AuditFilter{Action: common.AuditActionBackupRestore}, 1, 10)
+	if err != nil || total != 1 || restores[0].Target != "backup.zip" || restores[0].Outcome != common.AuditOutcomeSuccess {
+		t.Fatalf("restore audit events = %+v err=%v, want one successful restore", restores, err)
+	}
+}
@@ -2,6 +2,7 @@ package backup
 
 import (
 	"DataArk/common"
+	"context"
 	"os"
 	"path/filepath"
 	"testing"
@@ -63,6 +64,90 @@ func TestDiscoverRestoreComponents(t *testing.T) {
 	}
 }
 
+func TestDiscoverRestoreComponentsWithoutMeiliDump(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "backup", "archive"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "backup", "database.sql"), []byte("-- sql"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	components, err := discoverRestoreComponents(root)
+	if err != nil {
+		t.Fatalf("backup created with the embedded engine should be restorable: %v", err)
+	}
+	if components.MeiliDumpPath != "" {
+		t.Fatalf("unexpected dump path %q", components.MeiliDumpPath)
+	}
+}
+
+func TestDiscoverRestoreComponentsWithSQLiteSnapshot(t *testing.T) {
+	oldDriver := common.DBDriver
+	t.Cleanup(func() {
+		common.DBDriver = oldDriver
+	})
+
+	root := t.TempDir()
+	backupRoot := filepath.Join(root, "backup")
+	if err := os.MkdirAll(filepath.Join(backupRoot, "archive"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(backupRoot, "database.sqlite"), []byte("snapshot"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	components, err := discoverRestoreComponents(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if components.DatabaseSnapshotPath != filepath.Join(backupRoot, "database.sqlite") || components.DatabasePath != "" {
+		t.Fatalf("unexpected database components %#v", components)
+	}
+
+	common.DBDriver = common.DBDriverSQLite
+	if err := checkDatabaseRestoreSource(components); err != nil {
+		t.Fatalf("sqlite restore source should be accepted: %v", err)
+	}
+	common.DBDriver = common.DBDriverPostgres
+	if err := checkDatabaseRestoreSource(components); err == nil {
+		t.Fatal("postgres restore should reject a backup without a .sql file")
+	}
+}
+
+func TestDiscoverRestoreComponentsPrefersDatabaseExport(t *testing.T) {
+	oldDriver := common.DBDriver
+	t.Cleanup(func() {
+		common.DBDriver = oldDriver
+	})
+
+	root := t.TempDir()
+	backupRoot := filepath.Join(root, "backup")
+	if err := os.MkdirAll(filepath.Join(backupRoot, "archive"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"database.jsonl", "database.sqlite", "database.sql"} {
+		if err := os.WriteFile(filepath.Join(backupRoot, name), []byte("data"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	components, err := discoverRestoreComponents(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if components.DatabaseExportPath != filepath.Join(backupRoot, "database.jsonl") {
+		t.Fatalf("unexpected database components %#v", components)
+	}
+	// 逻辑导出与数据库类型无关，两种驱动都可以恢复
+	for _, driver := range []string{common.DBDriverSQLite, common.DBDriverPostgres} {
+		common.DBDriver = driver
+		if err := checkDatabaseRestoreSource(components); err != nil {
+			t.Fatalf("%s restore should accept a database export: %v", driver, err)
+		}
+	}
+}
+
 func TestReplaceArchiveDirKeepsArchiveRoot(t *testing.T) {
 	oldArchiveLocation := common.ARCHIVEFILELOACTION
 	t.Cleanup(func() {
@@ -72,7 +157,6 @@ func TestReplaceArchiveDirKeepsArchiveRoot(t *testing.T) {
 	root := t.TempDir()
 	archiveRoot := filepath.Join(root, "archive")
 	sourceArchive := filepath.Join(root, "backup", "archive")
-	tempRoot := filepath.Join(root, "restore-temp")
 
 	common.ARCHIVEFILELOACTION = archiveRoot
 
@@ -94,7 +178,14 @@ func TestReplaceArchiveDirKeepsArchiveRoot(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if err := replaceArchiveDir(sourceArchive, tempRoot); err != nil {
+	state := &preRestoreState{dir: filepath.Join(root, ".archive.pre-restore-test"), archiveRoot: archiveRoot}
+	if err := os.Mkdir(state.dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.moveArchiveAside(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := replaceArchiveDir(context.Background(), sourceArchive); err != nil {
 		t.Fatal(err)
 	}
 
@@ -111,4 +202,12 @@ func TestReplaceArchiveDirKeepsArchiveRoot(t *testing.T) {
 	if got, err := os.ReadFile(filepath.Join(archiveRoot, "new.example", "new.html")); err != nil || string(got) != "new" {
 		t.Fatalf("expected restored archive file, got content %q err %v", string(got), err)
 	}
+	// 原有归档改名到归档目录旁边，恢复成功后删除
+	if got, err := os.ReadFile(filepath.Join(state.archiveAside(), "old.example", "old.html")); err != nil || string(got) != "old" {
+		t.Fatalf("previous archive should be moved aside, got content %q err %v", string(got), err)
+	}
+	state.discard()
+	if _, err := os.Stat(state.dir); !os.IsNotExist(err) {
+		t.Fatalf("previous archive should be removed after restore, stat err = %v", err)
+	}
 }
@@ -0,0 +1,165 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const manifestFileName = "manifest.json"
+
+var ErrBackupIntegrity = errors.New("backup integrity check failed")
+
+// checksumDir 计算 dir 下除 manifest.json 外全部文件的 SHA-256，键为相对 dir 的 / 分隔路径。
+func checksumDir(dir string) (map[string]string, error) {
+	checksums := make(map[string]string)
+	err := filepath.WalkDir(dir, func(currentPath string, entry fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		relativePath, err := filepath.Rel(dir, currentPath)
+		if err != nil {
+			return err
+		}
+		relativePath = filepath.ToSlash(relativePath)
+		if relativePath == manifestFileName {
+			return nil
+		}
+		hash, err := hashFile(currentPath)
+		if err != nil {
+			return err
+		}
+		checksums[relativePath] = hash
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return checksums, nil
+}
+
+func hashFile(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// verifyBackupChecksums 按 manifest.json 中的 checksums 校验解开的备份：清单中的文件必须存在且哈希一致，
+// 清单外不能有其它文件，避免被替换或夹带的数据库导出在恢复时被选中。
+// 没有 manifest 或 manifest 中没有 checksums 的旧备份跳过校验，zip 自身的 CRC 仍能发现损坏；
+// 新格式的 manifest 必须带 checksums，否则可能是被删掉了校验和的篡改备份。
+func verifyBackupChecksums(extractDir string) error {
+	manifestPath, err := findManifest(extractDir)
+	if err != nil || manifestPath == "" {
+		return err
+	}
+	manifest, err := readManifest(manifestPath)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBackupIntegrity, err)
+	}
+	if len(manifest.Checksums) == 0 {
+		if manifestRequiresChecksums(manifest) {
+			return fmt.Errorf("%w: %s has no checksums", ErrBackupIntegrity, manifestFileName)
+		}
+		return nil
+	}
+
+	root := filepath.Dir(manifestPath)
+	seen := make(map[string]bool, len(manifest.Checksums))
+	err = filepath.WalkDir(extractDir, func(currentPath string, entry fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		if entry.IsDir() || currentPath == manifestPath {
+			return nil
+		}
+		relativePath, err := filepath.Rel(root, currentPath)
+		if err != nil {
+			return err
+		}
+		relativePath = filepath.ToSlash(relativePath)
+		expected, ok := manifest.Checksums[relativePath]
+		if !ok || !entry.Type().IsRegular() {
+			return fmt.Errorf("%w: unexpected file %s", ErrBackupIntegrity, relativePath)
+		}
+		hash, err := hashFile(currentPath)
+		if err != nil {
+			return err
+		}
+		if hash != expected {
+			return fmt.Errorf("%w: checksum mismatch for %s", ErrBackupIntegrity, relativePath)
+		}
+		seen[relativePath] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var missing []string
+	for relativePath := range manifest.Checksums {
+		if !seen[relativePath] {
+			missing = append(missing, relativePath)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("%w: missing %s", ErrBackupIntegrity, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// manifestRequiresChecksums 判断 manifest 是否来自总会写入 checksums 的版本。
+// 格式版本写入 manifest 之前的备份按 databaseExportFile 判断：数据库逻辑导出比文件校验和晚加入，带导出的备份一定带有 checksums。
+func manifestRequiresChecksums(manifest *Manifest) bool {
+	return manifest.FormatVersion >= manifestChecksumsVersion || manifest.DatabaseExportFile != ""
+}
+
+// findManifest 返回层级最浅的 manifest.json，没有时返回空字符串。
+func findManifest(root string) (string, error) {
+	var candidates []string
+	err := filepath.WalkDir(root, func(currentPath string, entry fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		if !entry.IsDir() && strings.EqualFold(entry.Name(), manifestFileName) {
+			candidates = append(candidates, currentPath)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return chooseRestoreCandidate(root, candidates, manifestFileName), nil
+}
+
+func readManifest(manifestPath string) (*Manifest, error) {
+	content, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
@@ -0,0 +1,215 @@
+package backup
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// rewriteTestZip 复制 source 中的条目到新 zip，edit 返回 false 时丢弃该条目，extra 中的文件追加到末尾。
+func rewriteTestZip(t *testing.T, source string, edit func(name string, content []byte) ([]byte, bool), extra map[string]string) string {
+	t.Helper()
+	reader, err := zip.OpenReader(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	target := filepath.Join(t.TempDir(), "rewritten.zip")
+	file, err := os.Create(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := zip.NewWriter(file)
+	for _, entry := range reader.File {
+		entryReader, err := entry.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(entryReader)
+		entryReader.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, keep := edit(entry.Name, content)
+		if !keep {
+			continue
+		}
+		entryWriter, err := writer.Create(entry.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := entryWriter.Write(content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, content := range extra {
+		entryWriter, err := writer.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(entryWriter, content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return target
+}
+
+// stripManifestChecksums 返回去掉 manifest.json 中 checksums 并篡改 a.html 的 rewriteTestZip 回调。
+func stripManifestChecksums(t *testing.T) func(name string, content []byte) ([]byte, bool) {
+	return func(name string, content []byte) ([]byte, bool) {
+		switch {
+		case strings.HasSuffix(name, manifestFileName):
+			var manifest Manifest
+			if err := json.Unmarshal(content, &manifest); err != nil {
+				t.Fatal(err)
+			}
+			manifest.Checksums = nil
+			stripped, err := json.Marshal(manifest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return stripped, true
+		case strings.HasSuffix(name, "a.html"):
+			return []byte(strings.ReplaceAll(string(content), "original", "tampered")), true
+		}
+		return content, true
+	}
+}
+
+// downgradeManifest 返回伪装成旧版本备份的 rewriteTestZip 回调：去掉 checksums 和数据库导出，
+// 由调用方在 extra 中附带替换的 .sql 或 .sqlite 文件，databaseFile 写入 manifest。
+func downgradeManifest(t *testing.T, databaseFile string) func(name string, content []byte) ([]byte, bool) {
+	return func(name string, content []byte) ([]byte, bool) {
+		switch {
+		case strings.HasSuffix(name, manifestFileName):
+			var manifest Manifest
+			if err := json.Unmarshal(content, &manifest); err != nil {
+				t.Fatal(err)
+			}
+			if manifest.FormatVersion != ManifestFormatVersion {
+				t.Fatalf("manifest format version = %d, want %d", manifest.FormatVersion, ManifestFormatVersion)
+			}
+			manifest.Checksums = nil
+			manifest.DatabaseExportFile = ""
+			manifest.DatabaseExportVersion = 0
+			if strings.HasSuffix(databaseFile, ".sql") {
+				manifest.DatabaseSQLFile = databaseFile
+			} else {
+				manifest.DatabaseSnapshotFile = databaseFile
+			}
+			downgraded, err := json.Marshal(manifest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return downgraded, true
+		case strings.HasSuffix(name, "database.jsonl"):
+			return nil, false
+		}
+		return content, true
+	}
+}
+
+func TestRestoreBackupRejectsTamperedArchives(t *testing.T) {
+	archiveRoot := setupSnapshotEnvironment(t)
+	writeArchiveTestFile(t, archiveRoot, "example.com", "a.html", "original")
+	zipPath := filepath.Join(t.TempDir(), "backup.zip")
+	writeTestBackupZip(t, zipPath)
+
+	reader, err := zip.OpenReader(zipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest Manifest
+	for _, entry := range reader.File {
+		if entry.Name == "backup/manifest.json" {
+			entryReader, _ := entry.Open()
+			err = json.NewDecoder(entryReader).Decode(&manifest)
+			entryReader.Close()
+		}
+	}
+	reader.Close()
+	if err != nil || len(manifest.Checksums) != 2 || manifest.Checksums["archive/example.com/a.html"] == "" || manifest.Checksums["database.jsonl"] == "" {
+		t.Fatalf("manifest checksums = %v err=%v, want database and a.html", manifest.Checksums, err)
+	}
+
+	keepAll := func(_ string, content []byte) ([]byte, bool) { return content, true }
+	for name, tampered := range map[string]string{
+		"modified file": rewriteTestZip(t, zipPath, func(name string, content []byte) ([]byte, bool) {
+			if strings.HasSuffix(name, "a.html") {
+				return []byte(strings.ReplaceAll(string(content), "original", "tampered")), true
+			}
+			return content, true
+		}, nil),
+		"missing file": rewriteTestZip(t, zipPath, func(name string, content []byte) ([]byte, bool) {
+			return content, !strings.HasSuffix(name, "a.html")
+		}, nil),
+		// 层级更浅的数据库导出会被优先选中，必须拒绝
+		"injected file": rewriteTestZip(t, zipPath, keepAll, map[string]string{"database.sql": "DROP TABLE users;"}),
+		// 删掉校验和后替换文件，不能当作旧版本的备份跳过校验
+		"stripped checksums": rewriteTestZip(t, zipPath, stripManifestChecksums(t), nil),
+		// 同时去掉数据库导出、换成 .sql 或 .sqlite，manifest 的格式版本仍然要求校验和
+		"downgraded to sql": rewriteTestZip(t, zipPath, downgradeManifest(t, "database.sql"),
+			map[string]string{"backup/database.sql": "DROP TABLE users;"}),
+		"downgraded to sqlite": rewriteTestZip(t, zipPath, downgradeManifest(t, "database.sqlite"),
+			map[string]string{"backup/database.sqlite": "not a database"}),
+	} {
+		writeArchiveTestFile(t, archiveRoot, "example.com", "a.html", "current")
+		if _, err := RestoreBackup(context.Background(), tampered, RestoreOptions{}); !errors.Is(err, ErrBackupIntegrity) {
+			t.Fatalf("%s: err = %v, want ErrBackupIntegrity", name, err)
+		}
+		if html, _ := os.ReadFile(filepath.Join(archiveRoot, "example.com", "a.html")); !strings.Contains(string(html), "current body") {
+			t.Fatalf("%s: archive changed although the backup was rejected", name)
+		}
+	}
+
+	if _, err := RestoreBackup(context.Background(), rewriteTestZip(t, zipPath, keepAll, nil), RestoreOptions{}); err != nil {
+		t.Fatalf("untouched backup restore returned error: %v", err)
+	}
+}
+
+func TestSnapshotZipRecordsBlobChecksums(t *testing.T) {
+	archiveRoot := setupSnapshotEnvironment(t)
+	writeArchiveTestFile(t, archiveRoot, "example.com", "a.html", "snapshot")
+	snapshot, err := CreateSnapshot(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	zipPath := filepath.Join(t.TempDir(), SnapshotZipName(snapshot.ID))
+	file, err := os.Create(zipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteSnapshotZip(context.Background(), snapshot.ID, file); err != nil {
+		t.Fatalf("WriteSnapshotZip returned error: %v", err)
+	}
+	file.Close()
+
+	extractDir := t.TempDir()
+	if err := extractZip(context.Background(), zipPath, extractDir); err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := readManifest(filepath.Join(extractDir, "backup", manifestFileName))
+	if err != nil || len(manifest.Checksums) != snapshot.FileCount {
+		t.Fatalf("manifest has %d checksums err=%v, want %d", len(manifest.Checksums), err, snapshot.FileCount)
+	}
+	if err := verifyBackupChecksums(extractDir); err != nil {
+		t.Fatalf("verifyBackupChecksums returned error: %v", err)
+	}
+	// 仓库中保存的快照清单不重复记录校验和
+	if stored, _ := GetSnapshot(snapshot.ID); stored.Checksums != nil {
+		t.Fatal("stored snapshot should not carry checksums")
+	}
+}
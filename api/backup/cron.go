@@ -0,0 +1,176 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidCronSchedule 表示定时备份的 cron 表达式不合法。
+var ErrInvalidCronSchedule = errors.New("invalid cron schedule")
+
+// cronSearchLimit 查找下一次执行时间时最多向后查找的年数，2 月 29 日这类表达式最长四年才触发一次。
+const cronSearchLimit = 5
+
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// CronSchedule 标准 5 段 cron 表达式：分 时 日 月 周，按服务器本地时间计算。
+// 每段支持 *、数字、a-b 范围、/n 步长和逗号分隔的列表，周日可以写成 0 或 7；
+// 与 cron 一样，日和周同时指定时满足其一即可。
+type CronSchedule struct {
+	minutes    uint64
+	hours      uint64
+	days       uint64
+	months     uint64
+	weekdays   uint64
+	anyDay     bool
+	anyWeekday bool
+}
+
+type cronField struct {
+	name     string
+	min, max int
+}
+
+var cronFields = []cronField{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// ParseCronSchedule 解析 cron 表达式，也接受 @daily、@weekly 等简写。
+func ParseCronSchedule(spec string) (*CronSchedule, error) {
+	spec = strings.TrimSpace(spec)
+	if expanded, ok := cronDescriptors[strings.ToLower(spec)]; ok {
+		spec = expanded
+	}
+	parts := strings.Fields(spec)
+	if len(parts) != len(cronFields) {
+		return nil, fmt.Errorf("%w: %q should have 5 fields", ErrInvalidCronSchedule, spec)
+	}
+
+	var masks [5]uint64
+	for i, part := range parts {
+		mask, err := parseCronField(part, cronFields[i])
+		if err != nil {
+			return nil, err
+		}
+		masks[i] = mask
+	}
+	// 周日可以写成 7
+	if masks[4]&(1<<7) != 0 {
+		masks[4] = masks[4]&^(1<<7) | 1
+	}
+	return &CronSchedule{
+		minutes:    masks[0],
+		hours:      masks[1],
+		days:       masks[2],
+		months:     masks[3],
+		weekdays:   masks[4],
+		anyDay:     parts[2] == "*",
+		anyWeekday: parts[4] == "*",
+	}, nil
+}
+
+func parseCronField(value string, field cronField) (uint64, error) {
+	var mask uint64
+	for _, item := range strings.Split(value, ",") {
+		rangePart, step := item, 1
+		if before, after, ok := strings.Cut(item, "/"); ok {
+			parsed, err := strconv.Atoi(after)
+			if err != nil || parsed <= 0 {
+				return 0, fmt.Errorf("%w: bad step %q in %s", ErrInvalidCronSchedule, item, field.name)
+			}
+			rangePart, step = before, parsed
+		}
+
+		start, end := field.min, field.max
+		switch {
+		case rangePart == "*":
+		case strings.Contains(rangePart, "-"):
+			low, high, _ := strings.Cut(rangePart, "-")
+			var err error
+			if start, err = parseCronNumber(low, field); err != nil {
+				return 0, err
+			}
+			if end, err = parseCronNumber(high, field); err != nil {
+				return 0, err
+			}
+			if start > end {
+				return 0, fmt.Errorf("%w: empty range %q in %s", ErrInvalidCronSchedule, item, field.name)
+			}
+		default:
+			number, err := parseCronNumber(rangePart, field)
+			if err != nil {
+				return 0, err
+			}
+			start = number
+			// 单个数字带步长时与 cron 一样表示从该值开始直到最大值
+			if step == 1 {
+				end = number
+			}
+		}
+		for i := start; i <= end; i += step {
+			mask |= 1 << uint(i)
+		}
+	}
+	return mask, nil
+}
+
+func parseCronNumber(value string, field cronField) (int, error) {
+	number, err := strconv.Atoi(value)
+	if err != nil || number < field.min || number > field.max {
+		return 0, fmt.Errorf("%w: %q is not a valid %s", ErrInvalidCronSchedule, value, field.name)
+	}
+	return number, nil
+}
+
+// Matches 判断 t 所在的分钟是否应该执行。
+func (s *CronSchedule) Matches(t time.Time) bool {
+	return s.minutes&(1<<uint(t.Minute())) != 0 &&
+		s.hours&(1<<uint(t.Hour())) != 0 &&
+		s.months&(1<<uint(t.Month())) != 0 &&
+		s.matchesDay(t)
+}
+
+func (s *CronSchedule) matchesDay(t time.Time) bool {
+	dayMatch := s.days&(1<<uint(t.Day())) != 0
+	weekdayMatch := s.weekdays&(1<<uint(t.Weekday())) != 0
+	if s.anyDay || s.anyWeekday {
+		return dayMatch && weekdayMatch
+	}
+	return dayMatch || weekdayMatch
+}
+
+// Next 返回 after 之后第一个满足表达式的整分钟，找不到（如 2 月 30 日）时返回零值。
+func (s *CronSchedule) Next(after time.Time) time.Time {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(cronSearchLimit, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case s.months&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hours&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case s.minutes&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,67 @@
+package backup
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseCronScheduleRejectsInvalidExpressions(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+		"@every 5m",
+	} {
+		if _, err := ParseCronSchedule(spec); !errors.Is(err, ErrInvalidCronSchedule) {
+			t.Fatalf("ParseCronSchedule(%q) err = %v, want ErrInvalidCronSchedule", spec, err)
+		}
+	}
+}
+
+func TestCronScheduleNext(t *testing.T) {
+	location := time.FixedZone("UTC+8", 8*3600)
+	// 2026-04-27 是星期一
+	from := time.Date(2026, 4, 27, 10, 30, 15, 0, location)
+	for _, tc := range []struct {
+		spec string
+		want time.Time
+	}{
+		{"*/15 * * * *", time.Date(2026, 4, 27, 10, 45, 0, 0, location)},
+		{"0 3 * * *", time.Date(2026, 4, 28, 3, 0, 0, 0, location)},
+		{"@daily", time.Date(2026, 4, 28, 0, 0, 0, 0, location)},
+		{"@hourly", time.Date(2026, 4, 27, 11, 0, 0, 0, location)},
+		{"30 2 * * 7", time.Date(2026, 5, 3, 2, 30, 0, 0, location)},
+		{"0 0 1,15 * *", time.Date(2026, 5, 1, 0, 0, 0, 0, location)},
+		{"0 9-17/4 * * 1-5", time.Date(2026, 4, 27, 13, 0, 0, 0, location)},
+		// 日和周同时指定时满足其一即可
+		{"0 0 30 * 3", time.Date(2026, 4, 29, 0, 0, 0, 0, location)},
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, location)},
+	} {
+		schedule, err := ParseCronSchedule(tc.spec)
+		if err != nil {
+			t.Fatalf("ParseCronSchedule(%q) returned error: %v", tc.spec, err)
+		}
+		if got := schedule.Next(from); !got.Equal(tc.want) {
+			t.Fatalf("%q Next = %s, want %s", tc.spec, got, tc.want)
+		}
+		if !schedule.Matches(tc.want) {
+			t.Fatalf("%q Matches disagrees with Next at %s", tc.spec, tc.want)
+		}
+	}
+
+	impossible, err := ParseCronSchedule("0 0 30 2 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next := impossible.Next(from); !next.IsZero() {
+		t.Fatalf("Feb 30 Next = %s, want zero time", next)
+	}
+}
@@ -0,0 +1,588 @@
+package backup
+
+import (
+	"DataArk/common"
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+)
+
+// 加密备份的格式参考 age：文本头部记录用口令或接收方公钥包装的随机文件密钥，
+// 头部用文件密钥派生的 HMAC 保护，正文按 64 KiB 分块用 ChaCha20-Poly1305 加密，
+// 分块 nonce 中带有序号和结束标记，调换、删除分块或截断文件都无法通过认证。
+const (
+	encryptedBackupMagic   = "DATAARK-ENCRYPTED-BACKUP/1"
+	encryptedStanzaPrefix  = "-> "
+	encryptedMACPrefix     = "--- "
+	encryptedChunkSize     = 64 * 1024
+	encryptedNonceSize     = 16
+	encryptedFileKeySize   = 32
+	scryptStanzaType       = "scrypt"
+	x25519StanzaType       = "X25519"
+	scryptSaltLabel        = "dataark-backup/scrypt"
+	x25519Label            = "dataark-backup/X25519"
+	maxScryptLogN          = 22
+	recipientKeyPrefix     = "dataark1"
+	identityKeyPrefix      = "DATAARK-SECRET-KEY-1"
+	maxEncryptedHeaderSize = 64 * 1024
+)
+
+var (
+	ErrInvalidBackupKey   = errors.New("invalid backup encryption key")
+	ErrBackupDecrypt      = errors.New("cannot decrypt backup")
+	ErrBackupNotEncrypted = errors.New("backup is not encrypted")
+)
+
+// scryptLogN 是加密口令时 scrypt 的工作量，2^16 约占用 64 MiB 内存；测试中调低以加快速度。
+var scryptLogN = 16
+
+var keyEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// encryptionKeys 加密时使用口令和全部接收方公钥，解密时依次尝试口令和私钥。
+type encryptionKeys struct {
+	passphrase string
+	recipients []*ecdh.PublicKey
+	identities []*ecdh.PrivateKey
+}
+
+func (k *encryptionKeys) enabled() bool {
+	return k != nil && (k.passphrase != "" || len(k.recipients) > 0)
+}
+
+var (
+	encryptionMu sync.RWMutex
+	backupKeys   *encryptionKeys
+)
+
+// InitEncryption 读取 -backuppassphrase、-backuprecipients 和 -backupidentity。
+// 配置了口令或接收方公钥后，生成的备份 zip 全部加密，恢复时也只接受加密的备份。
+func InitEncryption() error {
+	keys, err := loadEncryptionKeys(common.BackupPassphrase, common.BackupRecipients, common.BackupIdentityFile)
+	if err != nil {
+		return err
+	}
+	setEncryptionKeys(keys)
+	return nil
+}
+
+func setEncryptionKeys(keys *encryptionKeys) {
+	encryptionMu.Lock()
+	defer encryptionMu.Unlock()
+	backupKeys = keys
+}
+
+func currentEncryptionKeys() *encryptionKeys {
+	encryptionMu.RLock()
+	defer encryptionMu.RUnlock()
+	return backupKeys
+}
+
+func loadEncryptionKeys(passphrase string, recipients string, identityFile string) (*encryptionKeys, error) {
+	keys := &encryptionKeys{passphrase: passphrase}
+	for _, value := range strings.Split(recipients, ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		recipient, err := ParseRecipient(value)
+		if err != nil {
+			return nil, err
+		}
+		keys.recipients = append(keys.recipients, recipient)
+	}
+	if identityFile != "" {
+		content, err := os.ReadFile(identityFile)
+		if err != nil {
+			return nil, fmt.Errorf("%w: read identity file: %v", ErrInvalidBackupKey, err)
+		}
+		for _, line := range strings.Split(string(content), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			identity, err := parseIdentity(line)
+			if err != nil {
+				return nil, err
+			}
+			keys.identities = append(keys.identities, identity)
+		}
+		if len(keys.identities) == 0 {
+			return nil, fmt.Errorf("%w: identity file %s has no keys", ErrInvalidBackupKey, identityFile)
+		}
+	}
+	return keys, nil
+}
+
+// GenerateBackupKey 生成一对 X25519 密钥，recipient 用于 -backuprecipients，identity 保存到 -backupidentity 文件。
+func GenerateBackupKey() (identity string, recipient string, err error) {
+	privateKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	identity = identityKeyPrefix + keyEncoding.EncodeToString(privateKey.Bytes())
+	recipient = recipientKeyPrefix + strings.ToLower(keyEncoding.EncodeToString(privateKey.PublicKey().Bytes()))
+	return identity, recipient, nil
+}
+
+// ParseRecipient 解析 dataark1 开头的接收方公钥。
+func ParseRecipient(value string) (*ecdh.PublicKey, error) {
+	if !strings.HasPrefix(value, recipientKeyPrefix) {
+		return nil, fmt.Errorf("%w: recipient must start with %s", ErrInvalidBackupKey, recipientKeyPrefix)
+	}
+	raw, err := keyEncoding.DecodeString(strings.ToUpper(strings.TrimPrefix(value, recipientKeyPrefix)))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidBackupKey, err)
+	}
+	recipient, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidBackupKey, err)
+	}
+	return recipient, nil
+}
+
+func parseIdentity(value string) (*ecdh.PrivateKey, error) {
+	if !strings.HasPrefix(value, identityKeyPrefix) {
+		return nil, fmt.Errorf("%w: identity must start with %s", ErrInvalidBackupKey, identityKeyPrefix)
+	}
+	raw, err := keyEncoding.DecodeString(strings.TrimPrefix(value, identityKeyPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidBackupKey, err)
+	}
+	identity, err := ecdh.X25519().NewPrivateKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidBackupKey, err)
+	}
+	return identity, nil
+}
+
+// newBackupWriter 在配置了加密时返回加密 w 的 writer，否则原样写入；调用方写完后必须 Close。
+func newBackupWriter(w io.Writer) (io.WriteCloser, error) {
+	keys := currentEncryptionKeys()
+	if !keys.enabled() {
+		return nopWriteCloser{w}, nil
+	}
+	return newEncryptWriter(w, keys)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+type encryptStanza struct {
+	kind string
+	args []string
+	body []byte
+}
+
+func newEncryptWriter(w io.Writer, keys *encryptionKeys) (io.WriteCloser, error) {
+	fileKey := make([]byte, encryptedFileKeySize)
+	if _, err := rand.Read(fileKey); err != nil {
+		return nil, err
+	}
+
+	var stanzas []encryptStanza
+	if keys.passphrase != "" {
+		stanza, err := wrapWithPassphrase(fileKey, keys.passphrase)
+		if err != nil {
+			return nil, err
+		}
+		stanzas = append(stanzas, stanza)
+	}
+	for _, recipient := range keys.recipients {
+		stanza, err := wrapForRecipient(fileKey, recipient)
+		if err != nil {
+			return nil, err
+		}
+		stanzas = append(stanzas, stanza)
+	}
+
+	var header bytes.Buffer
+	header.WriteString(encryptedBackupMagic + "\n")
+	for _, stanza := range stanzas {
+		header.WriteString(encryptedStanzaPrefix + stanza.kind)
+		for _, arg := range stanza.args {
+			header.WriteString(" " + arg)
+		}
+		header.WriteString("\n" + base64.RawStdEncoding.EncodeToString(stanza.body) + "\n")
+	}
+	header.WriteString(strings.TrimSpace(encryptedMACPrefix))
+	mac := headerMAC(fileKey, header.Bytes())
+	header.WriteString(" " + base64.RawStdEncoding.EncodeToString(mac) + "\n")
+
+	nonce := make([]byte, encryptedNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header.Bytes()); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(nonce); err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.New(deriveKey(fileKey, nonce, "payload"))
+	if err != nil {
+		return nil, err
+	}
+	return &encryptWriter{writer: w, aead: aead, buffer: make([]byte, 0, encryptedChunkSize)}, nil
+}
+
+func wrapWithPassphrase(fileKey []byte, passphrase string) (encryptStanza, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return encryptStanza{}, err
+	}
+	key, err := scrypt.Key([]byte(passphrase), append([]byte(scryptSaltLabel), salt...), 1<<scryptLogN, 8, 1, chacha20poly1305.KeySize)
+	if err != nil {
+		return encryptStanza{}, err
+	}
+	body, err := sealFileKey(key, fileKey)
+	if err != nil {
+		return encryptStanza{}, err
+	}
+	return encryptStanza{
+		kind: scryptStanzaType,
+		args: []string{base64.RawStdEncoding.EncodeToString(salt), strconv.Itoa(scryptLogN)},
+		body: body,
+	}, nil
+}
+
+func wrapForRecipient(fileKey []byte, recipient *ecdh.PublicKey) (encryptStanza, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return encryptStanza{}, err
+	}
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return encryptStanza{}, err
+	}
+	salt := append(ephemeral.PublicKey().Bytes(), recipient.Bytes()...)
+	body, err := sealFileKey(deriveKey(shared, salt, x25519Label), fileKey)
+	if err != nil {
+		return encryptStanza{}, err
+	}
+	return encryptStanza{
+		kind: x25519StanzaType,
+		args: []string{base64.RawStdEncoding.EncodeToString(ephemeral.PublicKey().Bytes())},
+		body: body,
+	}, nil
+}
+
+// sealFileKey 用只使用一次的包装密钥加密文件密钥，因此 nonce 可以固定为 0。
+func sealFileKey(key []byte, fileKey []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nil, make([]byte, chacha20poly1305.NonceSize), fileKey, nil), nil
+}
+
+func openFileKey(key []byte, body []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, make([]byte, chacha20poly1305.NonceSize), body, nil)
+}
+
+func deriveKey(secret []byte, salt []byte, info string) []byte {
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), key); err != nil {
+		panic(err)
+	}
+	return key
+}
+
+func headerMAC(fileKey []byte, header []byte) []byte {
+	mac := hmac.New(sha256.New, deriveKey(fileKey, nil, "header"))
+	mac.Write(header)
+	return mac.Sum(nil)
+}
+
+// chunkNonce 由 11 字节的分块序号和 1 字节的结束标记组成。
+func chunkNonce(counter uint64, last bool) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// encryptWriter 缓存一个分块，只有确认后面还有数据时才按非结束分块写出，
+// 因此最后一个分块总是带结束标记，只有空文件会出现空的结束分块。
+type encryptWriter struct {
+	writer  io.Writer
+	aead    cipher.AEAD
+	buffer  []byte
+	counter uint64
+	closed  bool
+}
+
+func (w *encryptWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("write to closed backup writer")
+	}
+	written := 0
+	for len(p) > 0 {
+		if len(w.buffer) == encryptedChunkSize {
+			if err := w.flush(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(w.buffer[len(w.buffer):encryptedChunkSize], p)
+		w.buffer = w.buffer[:len(w.buffer)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (w *encryptWriter) flush(last bool) error {
+	sealed := w.aead.Seal(nil, chunkNonce(w.counter, last), w.buffer, nil)
+	w.counter++
+	w.buffer = w.buffer[:0]
+	_, err := w.writer.Write(sealed)
+	return err
+}
+
+func (w *encryptWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.flush(true)
+}
+
+// isEncryptedBackup 判断文件是否以加密备份的文件头开始。
+func isEncryptedBackup(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	magic := make([]byte, len(encryptedBackupMagic)+1)
+	if _, err := io.ReadFull(file, magic); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, nil
+		}
+		return false, err
+	}
+	return string(magic) == encryptedBackupMagic+"\n", nil
+}
+
+// decryptBackupFile 把加密备份解密到 destination，文件头、密钥或任何分块认证失败都返回 ErrBackupDecrypt。
+func decryptBackupFile(source string, destination string, keys *encryptionKeys) error {
+	file, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader, err := newDecryptReader(bufio.NewReader(file), keys)
+	if err != nil {
+		return err
+	}
+	target, err := os.OpenFile(destination, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	_, copyErr := io.Copy(target, reader)
+	closeErr := target.Close()
+	if copyErr != nil {
+		return copyErr
+	}
+	return closeErr
+}
+
+func newDecryptReader(reader *bufio.Reader, keys *encryptionKeys) (io.Reader, error) {
+	var header bytes.Buffer
+	readLine := func() (string, error) {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return "", fmt.Errorf("%w: truncated header", ErrBackupDecrypt)
+		}
+		header.WriteString(line)
+		if header.Len() > maxEncryptedHeaderSize {
+			return "", fmt.Errorf("%w: header too large", ErrBackupDecrypt)
+		}
+		return strings.TrimSuffix(line, "\n"), nil
+	}
+
+	if line, err := readLine(); err != nil || line != encryptedBackupMagic {
+		return nil, fmt.Errorf("%w: unknown format", ErrBackupDecrypt)
+	}
+	var stanzas []encryptStanza
+	var macLine string
+	for {
+		line, err := readLine()
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(line, encryptedMACPrefix) {
+			macLine = strings.TrimPrefix(line, encryptedMACPrefix)
+			break
+		}
+		if !strings.HasPrefix(line, encryptedStanzaPrefix) {
+			return nil, fmt.Errorf("%w: malformed header", ErrBackupDecrypt)
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, encryptedStanzaPrefix))
+		bodyLine, err := readLine()
+		if err != nil {
+			return nil, err
+		}
+		body, err := base64.RawStdEncoding.DecodeString(bodyLine)
+		if err != nil || len(fields) == 0 {
+			return nil, fmt.Errorf("%w: malformed header", ErrBackupDecrypt)
+		}
+		stanzas = append(stanzas, encryptStanza{kind: fields[0], args: fields[1:], body: body})
+	}
+
+	fileKey, err := unwrapFileKey(stanzas, keys)
+	if err != nil {
+		return nil, err
+	}
+	mac, err := base64.RawStdEncoding.DecodeString(macLine)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed header", ErrBackupDecrypt)
+	}
+	// MAC 覆盖 "---" 之前的全部头部内容
+	authenticated := header.Bytes()[:header.Len()-len(macLine)-2]
+	if !hmac.Equal(mac, headerMAC(fileKey, authenticated)) {
+		return nil, fmt.Errorf("%w: header has been modified", ErrBackupDecrypt)
+	}
+
+	nonce := make([]byte, encryptedNonceSize)
+	if _, err := io.ReadFull(reader, nonce); err != nil {
+		return nil, fmt.Errorf("%w: truncated payload", ErrBackupDecrypt)
+	}
+	aead, err := chacha20poly1305.New(deriveKey(fileKey, nonce, "payload"))
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{reader: reader, aead: aead, chunk: make([]byte, encryptedChunkSize+aead.Overhead())}, nil
+}
+
+func unwrapFileKey(stanzas []encryptStanza, keys *encryptionKeys) ([]byte, error) {
+	if keys == nil {
+		keys = &encryptionKeys{}
+	}
+	for _, stanza := range stanzas {
+		switch stanza.kind {
+		case scryptStanzaType:
+			if keys.passphrase == "" || len(stanza.args) != 2 {
+				continue
+			}
+			salt, err := base64.RawStdEncoding.DecodeString(stanza.args[0])
+			if err != nil {
+				continue
+			}
+			logN, err := strconv.Atoi(stanza.args[1])
+			if err != nil || logN < 1 || logN > maxScryptLogN {
+				return nil, fmt.Errorf("%w: unsupported scrypt work factor", ErrBackupDecrypt)
+			}
+			key, err := scrypt.Key([]byte(keys.passphrase), append([]byte(scryptSaltLabel), salt...), 1<<logN, 8, 1, chacha20poly1305.KeySize)
+			if err != nil {
+				return nil, err
+			}
+			if fileKey, err := openFileKey(key, stanza.body); err == nil && len(fileKey) == encryptedFileKeySize {
+				return fileKey, nil
+			}
+		case x25519StanzaType:
+			if len(stanza.args) != 1 {
+				continue
+			}
+			ephemeralBytes, err := base64.RawStdEncoding.DecodeString(stanza.args[0])
+			if err != nil {
+				continue
+			}
+			ephemeral, err := ecdh.X25519().NewPublicKey(ephemeralBytes)
+			if err != nil {
+				continue
+			}
+			for _, identity := range keys.identities {
+				shared, err := identity.ECDH(ephemeral)
+				if err != nil {
+					continue
+				}
+				salt := append(ephemeral.Bytes(), identity.PublicKey().Bytes()...)
+				if fileKey, err := openFileKey(deriveKey(shared, salt, x25519Label), stanza.body); err == nil && len(fileKey) == encryptedFileKeySize {
+					return fileKey, nil
+				}
+			}
+		}
+	}
+	return nil, fmt.Errorf("%w: no matching passphrase or identity", ErrBackupDecrypt)
+}
+
+// decryptReader 逐块解密，读到文件末尾时最后一个分块必须带结束标记，否则说明文件被截断。
+type decryptReader struct {
+	reader  *bufio.Reader
+	aead    cipher.AEAD
+	chunk   []byte
+	plain   []byte
+	counter uint64
+	done    bool
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+func (r *decryptReader) readChunk() error {
+	n, err := io.ReadFull(r.reader, r.chunk)
+	last := false
+	switch {
+	case errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.EOF):
+		last = true
+	case err != nil:
+		return err
+	default:
+		if _, peekErr := r.reader.Peek(1); errors.Is(peekErr, io.EOF) {
+			last = true
+		}
+	}
+	plain, openErr := r.aead.Open(r.chunk[:0], chunkNonce(r.counter, last), r.chunk[:n], nil)
+	if openErr != nil {
+		if last {
+			return fmt.Errorf("%w: backup is truncated or modified", ErrBackupDecrypt)
+		}
+		return fmt.Errorf("%w: backup has been modified", ErrBackupDecrypt)
+	}
+	if !last && len(plain) == 0 {
+		return fmt.Errorf("%w: unexpected empty chunk", ErrBackupDecrypt)
+	}
+	r.counter++
+	r.plain = plain
+	r.done = last
+	return nil
+}
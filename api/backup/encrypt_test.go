@@ -0,0 +1,180 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testEncryptionKeys(t *testing.T, passphrase string) (*encryptionKeys, string) {
+	t.Helper()
+	oldLogN := scryptLogN
+	scryptLogN = 10
+	t.Cleanup(func() { scryptLogN = oldLogN })
+
+	identity, recipient, err := GenerateBackupKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	identityFile := filepath.Join(t.TempDir(), "backup_identity.txt")
+	if err := os.WriteFile(identityFile, []byte("# created for test\n"+identity+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := loadEncryptionKeys(passphrase, " "+recipient+" ", identityFile)
+	if err != nil {
+		t.Fatalf("loadEncryptionKeys returned error: %v", err)
+	}
+	if len(keys.recipients) != 1 || len(keys.identities) != 1 || !keys.enabled() {
+		t.Fatalf("unexpected keys %+v", keys)
+	}
+	return keys, identityFile
+}
+
+func encryptTestData(t *testing.T, keys *encryptionKeys, data []byte) []byte {
+	t.Helper()
+	var encrypted bytes.Buffer
+	writer, err := newEncryptWriter(&encrypted, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return encrypted.Bytes()
+}
+
+func decryptTestData(encrypted []byte, keys *encryptionKeys) ([]byte, error) {
+	reader, err := newDecryptReader(bufio.NewReader(bytes.NewReader(encrypted)), keys)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(reader)
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	keys, _ := testEncryptionKeys(t, "correct horse")
+	passphraseOnly := &encryptionKeys{passphrase: "correct horse"}
+	identityOnly := &encryptionKeys{identities: keys.identities}
+
+	for _, size := range []int{0, 10, encryptedChunkSize, 2*encryptedChunkSize + 5} {
+		data := bytes.Repeat([]byte("0123456789abcdef"), size/16+1)[:size]
+		encrypted := encryptTestData(t, keys, data)
+		if !bytes.HasPrefix(encrypted, []byte(encryptedBackupMagic+"\n")) || (size > 0 && bytes.Contains(encrypted, data)) {
+			t.Fatalf("size %d: output is not encrypted", size)
+		}
+		for name, decryptKeys := range map[string]*encryptionKeys{"passphrase": passphraseOnly, "identity": identityOnly} {
+			decrypted, err := decryptTestData(encrypted, decryptKeys)
+			if err != nil || !bytes.Equal(decrypted, data) {
+				t.Fatalf("size %d with %s: decrypted %d bytes err=%v", size, name, len(decrypted), err)
+			}
+		}
+	}
+
+	encrypted := encryptTestData(t, keys, []byte("secret"))
+	if _, err := decryptTestData(encrypted, &encryptionKeys{passphrase: "wrong"}); !errors.Is(err, ErrBackupDecrypt) {
+		t.Fatalf("wrong passphrase err = %v, want ErrBackupDecrypt", err)
+	}
+	if _, err := decryptTestData(encrypted, nil); !errors.Is(err, ErrBackupDecrypt) {
+		t.Fatalf("no keys err = %v, want ErrBackupDecrypt", err)
+	}
+}
+
+func TestDecryptDetectsTampering(t *testing.T) {
+	keys, _ := testEncryptionKeys(t, "correct horse")
+	data := bytes.Repeat([]byte("x"), 2*encryptedChunkSize+100)
+	encrypted := encryptTestData(t, keys, data)
+	chunk := encryptedChunkSize + 16
+
+	flipped := append([]byte(nil), encrypted...)
+	flipped[len(flipped)-chunk-50] ^= 1
+	headerEnd := bytes.Index(encrypted, []byte("\n--- ")) + 1
+	modifiedHeader := append([]byte(nil), encrypted...)
+	modifiedHeader[bytes.Index(modifiedHeader, []byte("-> X25519"))+3] = 'Y'
+
+	for name, tampered := range map[string][]byte{
+		// 去掉最后一个分块后，前一个分块不带结束标记
+		"truncated at chunk boundary": encrypted[:len(encrypted)-116],
+		"truncated inside chunk":      encrypted[:len(encrypted)-50],
+		"flipped payload byte":        flipped,
+		"modified header":             modifiedHeader,
+		"missing payload":             encrypted[:headerEnd],
+	} {
+		if _, err := decryptTestData(tampered, keys); !errors.Is(err, ErrBackupDecrypt) {
+			t.Fatalf("%s: err = %v, want ErrBackupDecrypt", name, err)
+		}
+	}
+}
+
+func TestLoadEncryptionKeysRejectsInvalidKeys(t *testing.T) {
+	for _, recipients := range []string{"age1abc", "dataark1!!!", "dataark1aaaa"} {
+		if _, err := loadEncryptionKeys("", recipients, ""); !errors.Is(err, ErrInvalidBackupKey) {
+			t.Fatalf("recipients %q err = %v, want ErrInvalidBackupKey", recipients, err)
+		}
+	}
+	emptyFile := filepath.Join(t.TempDir(), "empty.txt")
+	if err := os.WriteFile(emptyFile, []byte("# no keys\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, identityFile := range []string{emptyFile, filepath.Join(t.TempDir(), "missing.txt")} {
+		if _, err := loadEncryptionKeys("", "", identityFile); !errors.Is(err, ErrInvalidBackupKey) {
+			t.Fatalf("identity file %s err = %v, want ErrInvalidBackupKey", identityFile, err)
+		}
+	}
+	if keys, err := loadEncryptionKeys("", "", ""); err != nil || keys.enabled() {
+		t.Fatalf("empty config keys=%+v err=%v, want disabled", keys, err)
+	}
+}
+
+func TestRestoreEncryptedBackup(t *testing.T) {
+	archiveRoot := setupSnapshotEnvironment(t)
+	keys, _ := testEncryptionKeys(t, "")
+	t.Cleanup(func() { setEncryptionKeys(nil) })
+	setEncryptionKeys(keys)
+
+	writeArchiveTestFile(t, archiveRoot, "example.com", "a.html", "encrypted")
+	zipPath := filepath.Join(t.TempDir(), "backup.zip")
+	writeTestBackupZip(t, zipPath)
+	content, err := os.ReadFile(zipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(content, []byte(encryptedBackupMagic)) || bytes.Contains(content, []byte("encrypted body")) {
+		t.Fatal("backup zip should be encrypted")
+	}
+
+	writeArchiveTestFile(t, archiveRoot, "example.com", "a.html", "changed")
+	// 没有私钥时无法恢复，归档保持不变
+	setEncryptionKeys(&encryptionKeys{})
+	if _, err := RestoreBackup(context.Background(), zipPath, RestoreOptions{}); !errors.Is(err, ErrBackupDecrypt) {
+		t.Fatalf("restore without identity err = %v, want ErrBackupDecrypt", err)
+	}
+	if html, _ := os.ReadFile(filepath.Join(archiveRoot, "example.com", "a.html")); !strings.Contains(string(html), "changed body") {
+		t.Fatal("archive should not change when decryption fails")
+	}
+
+	setEncryptionKeys(keys)
+	if _, err := RestoreBackup(context.Background(), zipPath, RestoreOptions{}); err != nil {
+		t.Fatalf("RestoreBackup returned error: %v", err)
+	}
+	if html, _ := os.ReadFile(filepath.Join(archiveRoot, "example.com", "a.html")); !strings.Contains(string(html), "encrypted body") {
+		t.Fatalf("a.html = %q, want restored content", html)
+	}
+
+	// 配置了加密后不接受明文备份
+	setEncryptionKeys(nil)
+	plainPath := filepath.Join(t.TempDir(), "plain.zip")
+	writeTestBackupZip(t, plainPath)
+	setEncryptionKeys(keys)
+	if _, err := RestoreBackup(context.Background(), plainPath, RestoreOptions{}); !errors.Is(err, ErrBackupNotEncrypted) {
+		t.Fatalf("plaintext restore err = %v, want ErrBackupNotEncrypted", err)
+	}
+}
@@ -0,0 +1,67 @@
+package backup
+
+import (
+	"DataArk/common"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// 本包测试共用的环境和归档页面，新的测试直接使用这里的函数，不要在各自的测试文件中另写一份。
+
+// setupSnapshotEnvironment 使用 SQLite 和内嵌搜索引擎，快照的创建和恢复不依赖外部服务。
+func setupSnapshotEnvironment(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	oldConfig := []string{common.DBDriver, common.DBPath, common.SearchEngine, common.SearchIndexDir, common.ARCHIVEFILELOACTION, common.BackupDir}
+	t.Cleanup(func() {
+		common.DBDriver = oldConfig[0]
+		common.DBPath = oldConfig[1]
+		common.SearchEngine = oldConfig[2]
+		common.SearchIndexDir = oldConfig[3]
+		common.ARCHIVEFILELOACTION = oldConfig[4]
+		common.BackupDir = oldConfig[5]
+	})
+	common.DBDriver = common.DBDriverSQLite
+	common.DBPath = filepath.Join(root, "dataark.db")
+	common.SearchEngine = common.SearchEngineEmbedded
+	common.SearchIndexDir = filepath.Join(root, "index")
+	common.ARCHIVEFILELOACTION = filepath.Join(root, "archive")
+	common.BackupDir = filepath.Join(root, "backups")
+	common.InitDB()
+	return common.ARCHIVEFILELOACTION
+}
+
+// writeArchiveTestFile 在归档目录的 domain 下写入标题为 title 的页面。
+func writeArchiveTestFile(t *testing.T, archiveRoot string, domain string, name string, title string) {
+	t.Helper()
+	target := filepath.Join(archiveRoot, domain, name)
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("<html><head><title>" + title + "</title></head><body><p>" + title + " body</p></body></html>")
+	if err := os.WriteFile(target, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeTestBackupZip 用当前数据库和归档目录创建一个完整备份，写入 zipPath。
+func writeTestBackupZip(t *testing.T, zipPath string) {
+	t.Helper()
+	prepared, err := CreateBackup(context.Background())
+	if err != nil {
+		t.Fatalf("CreateBackup returned error: %v", err)
+	}
+	defer prepared.Cleanup()
+	file, err := os.Create(zipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := prepared.WriteZip(file); err != nil {
+		t.Fatalf("WriteZip returned error: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,438 @@
+package backup
+
+import (
+	"DataArk/common"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	JobKindBackup  = "backup"
+	JobKindRestore = "restore"
+)
+
+const (
+	JobStatusPending  = "pending"
+	JobStatusRunning  = "running"
+	JobStatusSuccess  = "success"
+	JobStatusFailed   = "failed"
+	JobStatusCanceled = "canceled"
+)
+
+const (
+	backupJobDir      = "jobs"
+	maxListedJobs     = 50
+	interruptedJobErr = "interrupted by server restart"
+)
+
+var (
+	ErrBackupJobNotFound  = errors.New("backup job not found")
+	ErrBackupJobNotActive = errors.New("backup job is not running")
+	ErrBackupJobActive    = errors.New("backup job is still running")
+	ErrBackupJobNoFile    = errors.New("backup job has no downloadable file")
+)
+
+var (
+	createBackupJob  = common.CreateBackupJob
+	saveBackupJob    = common.SaveBackupJob
+	getBackupJobByID = common.GetBackupJobByID
+)
+
+// activeJob 是本进程中正在执行的任务，进度以内存中的为准，数据库里的按 progressSaveInterval 节流更新。
+type activeJob struct {
+	progress *jobProgress
+	cancel   context.CancelFunc
+}
+
+var (
+	jobsMu     sync.Mutex
+	activeJobs = make(map[string]*activeJob)
+	jobsWG     sync.WaitGroup
+)
+
+// InitBackupJobs 回滚上次进程退出时没有完成的恢复，把没有结束的任务标记为失败，并清理它们留下的文件、恢复临时目录和过期的上传。
+// 回滚需要重建索引，应在搜索引擎初始化之后调用。
+func InitBackupJobs() error {
+	if _, err := jobOutputDir(); err != nil {
+		return err
+	}
+	if err := removeRestoreStagingDirs(); err != nil {
+		log.Printf("failed to remove restore staging directories: %v", err)
+	}
+	recoverInterruptedRestores()
+	pruneBackupUploads()
+	return reconcileBackupJobs()
+}
+
+// StartBackupJob 在后台创建完整备份，zip 写入 -backupdir 下的 jobs 目录，完成后通过 BackupJobFile 下载。
+func StartBackupJob(ctx context.Context) (*common.BackupJob, error) {
+	job := newBackupJob(ctx, JobKindBackup)
+	if err := createBackupJob(job); err != nil {
+		return nil, err
+	}
+	return startJob(ctx, job, runBackupJob), nil
+}
+
+// StartRestoreJob 在后台用 zipPath 恢复，zipPath 会被移动到任务目录，调用方不需要再清理。
+func StartRestoreJob(ctx context.Context, zipPath string, options RestoreOptions) (*common.BackupJob, error) {
+	job := newBackupJob(ctx, JobKindRestore)
+	job.FileName = filepath.Base(zipPath)
+	job.DryRun = options.DryRun
+	if info, err := os.Stat(zipPath); err == nil {
+		job.FileSize = info.Size()
+	}
+
+	// 保留上传时的文件名，审计记录中可以看到恢复的是哪个备份
+	uploadDir, err := jobOutputPath(job.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(uploadDir, 0o755); err != nil {
+		return nil, err
+	}
+	uploadPath := filepath.Join(uploadDir, job.FileName)
+	if err := moveFile(zipPath, uploadPath); err != nil {
+		_ = os.RemoveAll(uploadDir)
+		return nil, err
+	}
+	if err := createBackupJob(job); err != nil {
+		_ = os.RemoveAll(uploadDir)
+		return nil, err
+	}
+	return startJob(ctx, job, func(ctx context.Context, progress *jobProgress) error {
+		defer os.RemoveAll(uploadDir)
+		return runRestoreJob(ctx, progress, uploadPath, options)
+	}), nil
+}
+
+func newBackupJob(ctx context.Context, kind string) *common.BackupJob {
+	return &common.BackupJob{
+		ID:        uuid.NewString(),
+		Kind:      kind,
+		Status:    JobStatusPending,
+		Phase:     JobPhaseQueued,
+		CreatedBy: common.AuditActorFromContext(ctx).Username,
+	}
+}
+
+// startJob 在后台执行 run 并返回任务创建时的状态。任务不随请求结束而取消，只保留请求中的审计操作人。
+func startJob(requestCtx context.Context, job *common.BackupJob, run func(ctx context.Context, progress *jobProgress) error) *common.BackupJob {
+	progress := newJobProgress(job)
+	ctx, cancel := context.WithCancel(common.WithAuditActor(context.Background(), common.AuditActorFromContext(requestCtx)))
+	ctx = withProgress(ctx, progress)
+
+	jobsMu.Lock()
+	activeJobs[job.ID] = &activeJob{progress: progress, cancel: cancel}
+	jobsMu.Unlock()
+
+	started := progress.snapshot()
+	jobsWG.Add(1)
+	go func() {
+		defer jobsWG.Done()
+		defer cancel()
+
+		progress.update(func(job *common.BackupJob) {
+			now := time.Now()
+			job.Status = JobStatusRunning
+			job.StartedAt = &now
+		})
+		err := run(ctx, progress)
+		finishJob(progress, err)
+
+		jobsMu.Lock()
+		delete(activeJobs, job.ID)
+		jobsMu.Unlock()
+	}()
+	return &started
+}
+
+func finishJob(progress *jobProgress, err error) {
+	progress.update(func(job *common.BackupJob) {
+		now := time.Now()
+		job.FinishedAt = &now
+		switch {
+		case err == nil:
+			job.Status = JobStatusSuccess
+			job.Phase = JobPhaseDone
+			job.Percent = 100
+		case job.CancelRequested && errors.Is(err, context.Canceled):
+			job.Status = JobStatusCanceled
+			job.Error = err.Error()
+		default:
+			job.Status = JobStatusFailed
+			job.Error = err.Error()
+		}
+	})
+	if err != nil {
+		snapshot := progress.snapshot()
+		log.Printf("backup job %s %s in phase %s: %v", snapshot.ID, snapshot.Status, snapshot.Phase, err)
+	}
+}
+
+func runBackupJob(ctx context.Context, progress *jobProgress) (err error) {
+	id := progress.snapshot().ID
+	var fileName string
+	defer func() {
+		common.RecordAuditEvent(ctx, common.AuditActionBackupCreate, fileName, "job "+id, err)
+	}()
+
+	prepared, err := CreateBackup(ctx)
+	if err != nil {
+		return err
+	}
+	defer prepared.Cleanup()
+	fileName = prepared.FileName
+
+	zipPath, err := jobOutputPath(id + ".zip")
+	if err != nil {
+		return err
+	}
+	// 先写入临时文件，取消或失败时不会留下可以下载的半个备份
+	partialPath := zipPath + ".partial"
+	file, err := os.Create(partialPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(partialPath)
+	if err := prepared.writeZip(ctx, file); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	info, err := os.Stat(partialPath)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(partialPath, zipPath); err != nil {
+		return err
+	}
+
+	progress.update(func(job *common.BackupJob) {
+		job.FileName = fileName
+		job.FileSize = info.Size()
+	})
+	return nil
+}
+
+func runRestoreJob(ctx context.Context, progress *jobProgress, zipPath string, options RestoreOptions) error {
+	// 任务记录不属于备份的数据，恢复会替换整个数据库，先记下恢复前的任务历史
+	history, err := common.ListBackupJobs(maxListedJobs)
+	if err != nil {
+		return err
+	}
+	result, err := RestoreBackup(ctx, zipPath, options)
+	if err != nil {
+		return err
+	}
+	if !options.DryRun {
+		restoreJobHistory(history)
+	}
+	encoded, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	progress.update(func(job *common.BackupJob) {
+		job.Result = encoded
+	})
+	return nil
+}
+
+// restoreJobHistory 把恢复前的任务记录写回恢复后的数据库，备份中带进来的未结束任务标记为中断。
+func restoreJobHistory(history []common.BackupJob) {
+	for i := range history {
+		if lookupActiveJob(history[i].ID) != nil {
+			continue
+		}
+		if err := saveBackupJob(&history[i]); err != nil {
+			log.Printf("failed to keep backup job %s after restore: %v", history[i].ID, err)
+		}
+	}
+	if err := reconcileBackupJobs(); err != nil {
+		log.Printf("failed to reconcile backup jobs after restore: %v", err)
+	}
+}
+
+// GetBackupJob 返回任务状态，正在执行的任务返回内存中的最新进度。
+func GetBackupJob(id string) (*common.BackupJob, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrBackupJobNotFound
+	}
+	if active := lookupActiveJob(id); active != nil {
+		job := active.progress.snapshot()
+		return &job, nil
+	}
+	job, err := getBackupJobByID(id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrBackupJobNotFound
+	}
+	return job, err
+}
+
+// ListBackupJobs 按创建时间倒序返回最近的任务。
+func ListBackupJobs() ([]common.BackupJob, error) {
+	jobs, err := common.ListBackupJobs(maxListedJobs)
+	if err != nil {
+		return nil, err
+	}
+	for i := range jobs {
+		if active := lookupActiveJob(jobs[i].ID); active != nil {
+			jobs[i] = active.progress.snapshot()
+		}
+	}
+	return jobs, nil
+}
+
+// CancelBackupJob 请求取消正在执行的任务。恢复任务开始覆盖数据库后不再响应取消，会继续执行到结束。
+func CancelBackupJob(id string) (*common.BackupJob, error) {
+	active := lookupActiveJob(id)
+	if active == nil {
+		if _, err := GetBackupJob(id); err != nil {
+			return nil, err
+		}
+		return nil, ErrBackupJobNotActive
+	}
+	active.progress.update(func(job *common.BackupJob) {
+		job.CancelRequested = true
+	})
+	active.cancel()
+	job := active.progress.snapshot()
+	return &job, nil
+}
+
+// DeleteBackupJob 删除已结束的任务记录和生成的备份文件。
+func DeleteBackupJob(id string) error {
+	if _, err := GetBackupJob(id); err != nil {
+		return err
+	}
+	if lookupActiveJob(id) != nil {
+		return ErrBackupJobActive
+	}
+	if err := removeJobFiles(id); err != nil {
+		return err
+	}
+	return common.DeleteBackupJob(id)
+}
+
+// BackupJobFile 返回备份任务生成的 zip 路径和下载文件名。
+func BackupJobFile(id string) (string, string, error) {
+	job, err := GetBackupJob(id)
+	if err != nil {
+		return "", "", err
+	}
+	if job.Kind != JobKindBackup || job.Status != JobStatusSuccess {
+		return "", "", ErrBackupJobNoFile
+	}
+	zipPath, err := jobOutputPath(id + ".zip")
+	if err != nil {
+		return "", "", err
+	}
+	if _, err := os.Stat(zipPath); err != nil {
+		if os.IsNotExist(err) {
+			return "", "", ErrBackupJobNoFile
+		}
+		return "", "", err
+	}
+	return zipPath, job.FileName, nil
+}
+
+// reconcileBackupJobs 把数据库中未结束、但本进程中没有在执行的任务标记为失败。
+func reconcileBackupJobs() error {
+	jobs, err := common.ListBackupJobsByStatuses([]string{JobStatusPending, JobStatusRunning})
+	if err != nil {
+		return err
+	}
+	for i := range jobs {
+		job := &jobs[i]
+		if lookupActiveJob(job.ID) != nil {
+			continue
+		}
+		now := time.Now()
+		job.Status = JobStatusFailed
+		job.Error = interruptedJobErr
+		job.FinishedAt = &now
+		if err := saveBackupJob(job); err != nil {
+			return err
+		}
+		if err := removeJobFiles(job.ID); err != nil {
+			log.Printf("failed to remove files of interrupted backup job %s: %v", job.ID, err)
+		}
+	}
+	return nil
+}
+
+func lookupActiveJob(id string) *activeJob {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	return activeJobs[id]
+}
+
+func removeJobFiles(id string) error {
+	for _, name := range []string{id, id + ".zip", id + ".zip.partial"} {
+		target, err := jobOutputPath(name)
+		if err != nil {
+			return err
+		}
+		if err := os.RemoveAll(target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func jobOutputDir() (string, error) {
+	root := strings.TrimSpace(common.BackupDir)
+	if root == "" {
+		return "", errors.New("backup directory is empty")
+	}
+	dir := filepath.Join(filepath.Clean(root), backupJobDir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+func jobOutputPath(name string) (string, error) {
+	dir, err := jobOutputDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// moveFile 优先改名，上传的临时目录和备份目录不在同一个文件系统时改为复制。
+func moveFile(source string, destination string) error {
+	if err := os.Rename(source, destination); err == nil {
+		return nil
+	}
+	sourceFile, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer sourceFile.Close()
+	destinationFile, err := os.Create(destination)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(destinationFile, sourceFile); err != nil {
+		_ = destinationFile.Close()
+		return fmt.Errorf("move %s: %w", filepath.Base(source), err)
+	}
+	if err := destinationFile.Close(); err != nil {
+		return err
+	}
+	return os.Remove(source)
+}
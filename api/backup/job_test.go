@@ -0,0 +1,196 @@
+package backup
+
+import (
+	"DataArk/common"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackupAndRestoreJobs(t *testing.T) {
+	archiveRoot := setupSnapshotEnvironment(t)
+	writeArchiveTestFile(t, archiveRoot, "example.com", "a.html", "original")
+	ctx := common.WithAuditActor(context.Background(), common.AuditActor{Username: "admin"})
+
+	started, err := StartBackupJob(ctx)
+	if err != nil {
+		t.Fatalf("StartBackupJob returned error: %v", err)
+	}
+	if started.Kind != JobKindBackup || started.Status != JobStatusPending || started.CreatedBy != "admin" {
+		t.Fatalf("unexpected started job %+v", started)
+	}
+	jobsWG.Wait()
+
+	backupJob, err := GetBackupJob(started.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backupJob.Status != JobStatusSuccess || backupJob.Phase != JobPhaseDone || backupJob.Percent != 100 ||
+		backupJob.FileSize == 0 || !strings.HasPrefix(backupJob.FileName, "dataark-backup-") || backupJob.StartedAt == nil || backupJob.FinishedAt == nil {
+		t.Fatalf("unexpected finished backup job %+v", backupJob)
+	}
+	zipPath, fileName, err := BackupJobFile(started.ID)
+	if err != nil || fileName != backupJob.FileName {
+		t.Fatalf("BackupJobFile = %q, %q, %v", zipPath, fileName, err)
+	}
+
+	// 恢复任务会移动上传的文件，用副本恢复
+	writeArchiveTestFile(t, archiveRoot, "example.com", "a.html", "changed")
+	content, err := os.ReadFile(zipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploadPath := filepath.Join(t.TempDir(), "upload.zip")
+	if err := os.WriteFile(uploadPath, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	restoreStarted, err := StartRestoreJob(ctx, uploadPath, RestoreOptions{})
+	if err != nil {
+		t.Fatalf("StartRestoreJob returned error: %v", err)
+	}
+	jobsWG.Wait()
+
+	restoreJob, err := GetBackupJob(restoreStarted.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restoreJob.Status != JobStatusSuccess || restoreJob.FileName != "upload.zip" || restoreJob.Percent != 100 {
+		t.Fatalf("unexpected finished restore job %+v", restoreJob)
+	}
+	var result RestoreResult
+	if err := json.Unmarshal(restoreJob.Result, &result); err != nil || !result.DatabaseRestored || result.IndexedDocuments != 1 {
+		t.Fatalf("restore result = %s, %v", restoreJob.Result, err)
+	}
+	if html, _ := os.ReadFile(filepath.Join(archiveRoot, "example.com", "a.html")); !strings.Contains(string(html), "original body") {
+		t.Fatal("restore job should restore the archive")
+	}
+	if _, err := os.Stat(uploadPath); !os.IsNotExist(err) {
+		t.Fatalf("uploaded file should be moved into the job directory, stat err = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(common.BackupDir, backupJobDir, restoreStarted.ID)); !os.IsNotExist(err) {
+		t.Fatalf("restore job upload should be removed, stat err = %v", err)
+	}
+
+	// 恢复后的数据库里备份任务仍然是恢复前的最终状态，而不是备份时的 running
+	backupJob, err = GetBackupJob(started.ID)
+	if err != nil || backupJob.Status != JobStatusSuccess {
+		t.Fatalf("backup job after restore = %+v, %v", backupJob, err)
+	}
+
+	if err := DeleteBackupJob(started.ID); err != nil {
+		t.Fatalf("DeleteBackupJob returned error: %v", err)
+	}
+	if _, err := os.Stat(zipPath); !os.IsNotExist(err) {
+		t.Fatalf("deleted job zip should be removed, stat err = %v", err)
+	}
+	if _, err := GetBackupJob(started.ID); !errors.Is(err, ErrBackupJobNotFound) {
+		t.Fatalf("GetBackupJob after delete error = %v", err)
+	}
+}
+
+func TestCancelBackupJob(t *testing.T) {
+	archiveRoot := setupSnapshotEnvironment(t)
+	writeArchiveTestFile(t, archiveRoot, "example.com", "a.html", "original")
+
+	// 持有操作锁，任务停在等待锁的位置，取消后拿到锁立即结束
+	operationMu.Lock()
+	started, err := StartBackupJob(context.Background())
+	if err != nil {
+		operationMu.Unlock()
+		t.Fatal(err)
+	}
+	canceled, err := CancelBackupJob(started.ID)
+	operationMu.Unlock()
+	if err != nil || !canceled.CancelRequested {
+		t.Fatalf("CancelBackupJob = %+v, %v", canceled, err)
+	}
+	jobsWG.Wait()
+
+	job, err := GetBackupJob(started.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != JobStatusCanceled || job.FinishedAt == nil {
+		t.Fatalf("unexpected canceled job %+v", job)
+	}
+	if _, _, err := BackupJobFile(started.ID); !errors.Is(err, ErrBackupJobNoFile) {
+		t.Fatalf("canceled job should have no file, err = %v", err)
+	}
+	if entries, err := os.ReadDir(filepath.Join(common.BackupDir, backupJobDir)); len(entries) != 0 || err != nil && !os.IsNotExist(err) {
+		t.Fatalf("canceled job should leave no files, got %v, %v", entries, err)
+	}
+	if _, err := CancelBackupJob(started.ID); !errors.Is(err, ErrBackupJobNotActive) {
+		t.Fatalf("canceling a finished job error = %v", err)
+	}
+	if _, err := CancelBackupJob("not-a-job"); !errors.Is(err, ErrBackupJobNotFound) {
+		t.Fatalf("canceling an unknown job error = %v", err)
+	}
+}
+
+func TestInitBackupJobsMarksInterruptedJobs(t *testing.T) {
+	setupSnapshotEnvironment(t)
+	job := newBackupJob(context.Background(), JobKindRestore)
+	job.Status = JobStatusRunning
+	if err := createBackupJob(job); err != nil {
+		t.Fatal(err)
+	}
+	leftover := filepath.Join(common.BackupDir, backupJobDir, job.ID)
+	if err := os.MkdirAll(leftover, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := InitBackupJobs(); err != nil {
+		t.Fatalf("InitBackupJobs returned error: %v", err)
+	}
+	reconciled, err := GetBackupJob(job.ID)
+	if err != nil || reconciled.Status != JobStatusFailed || reconciled.Error != interruptedJobErr {
+		t.Fatalf("interrupted job = %+v, %v", reconciled, err)
+	}
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Fatalf("interrupted job files should be removed, stat err = %v", err)
+	}
+}
+
+func TestJobProgressPercent(t *testing.T) {
+	saves := 0
+	progress := newJobProgress(&common.BackupJob{Kind: JobKindBackup, Phase: JobPhaseQueued})
+	progress.save = func(*common.BackupJob) error {
+		saves++
+		return nil
+	}
+
+	// 内嵌搜索引擎没有 Meilisearch dump，直接从数据库导出开始
+	progress.phase(JobPhaseDatabaseDump, 0)
+	if got := progress.snapshot().Percent; got != 10 {
+		t.Fatalf("database dump percent = %d, want 10", got)
+	}
+	progress.phase(JobPhaseArchiveCopy, 100)
+	progress.add(50)
+	if job := progress.snapshot(); job.Percent != 40 || job.BytesDone != 50 || job.BytesTotal != 100 {
+		t.Fatalf("archive copy progress = %+v", job)
+	}
+	// 阶段切换总是保存，同一阶段内的字节进度按时间节流
+	if saves != 2 {
+		t.Fatalf("saves = %d, want 2", saves)
+	}
+	progress.lastSave = time.Now().Add(-progressSaveInterval)
+	progress.add(10)
+	if saves != 3 {
+		t.Fatalf("saves after interval = %d, want 3", saves)
+	}
+
+	progress.phase(JobPhaseZip, 10)
+	progress.add(10)
+	if got := progress.snapshot().Percent; got != 99 {
+		t.Fatalf("percent before finishing = %d, want 99", got)
+	}
+
+	var nilProgress *jobProgress
+	nilProgress.phase(JobPhaseZip, 1)
+	nilProgress.add(1)
+}
@@ -0,0 +1,199 @@
+package backup
+
+import (
+	"DataArk/common"
+	"context"
+	"io"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	JobPhaseQueued          = "queued"
+	JobPhaseMeiliDump       = "meili_dump"
+	JobPhaseDatabaseDump    = "database_dump"
+	JobPhaseArchiveCopy     = "archive_copy"
+	JobPhaseZip             = "zip"
+	JobPhaseExtract         = "extract"
+	JobPhaseVerify          = "verify"
+	JobPhasePreRestore      = "pre_restore"
+	JobPhaseDatabaseRestore = "database_restore"
+	JobPhaseArchiveRestore  = "archive_restore"
+	JobPhaseReindex         = "reindex"
+	JobPhaseDone            = "done"
+)
+
+// progressSaveInterval 限制进度写入数据库的频率，阶段切换时总是立即写入。
+const progressSaveInterval = 500 * time.Millisecond
+
+const copyBufferSize = 256 << 10
+
+// jobPhaseWeights 各阶段在整体进度中的占比，没有执行的阶段（例如内嵌搜索引擎没有 Meilisearch dump）直接跳过。
+var jobPhaseWeights = map[string][]phaseWeight{
+	JobKindBackup: {
+		{JobPhaseMeiliDump, 10},
+		{JobPhaseDatabaseDump, 10},
+		{JobPhaseArchiveCopy, 40},
+		{JobPhaseZip, 40},
+	},
+	JobKindRestore: {
+		{JobPhaseExtract, 20},
+		{JobPhaseVerify, 5},
+		{JobPhasePreRestore, 10},
+		{JobPhaseDatabaseRestore, 15},
+		{JobPhaseArchiveRestore, 30},
+		{JobPhaseReindex, 20},
+	},
+}
+
+type phaseWeight struct {
+	phase  string
+	weight int
+}
+
+type progressKey struct{}
+
+// jobProgress 记录任务当前阶段和字节数，通过 context 传给备份和恢复的各个步骤。
+// 没有任务时 progressFrom 返回 nil，所有方法都可以在 nil 上调用。
+type jobProgress struct {
+	mu       sync.Mutex
+	job      *common.BackupJob
+	weights  []phaseWeight
+	lastSave time.Time
+	save     func(*common.BackupJob) error
+}
+
+func newJobProgress(job *common.BackupJob) *jobProgress {
+	return &jobProgress{job: job, weights: jobPhaseWeights[job.Kind], save: saveBackupJob}
+}
+
+func withProgress(ctx context.Context, progress *jobProgress) context.Context {
+	return context.WithValue(ctx, progressKey{}, progress)
+}
+
+func progressFrom(ctx context.Context) *jobProgress {
+	progress, _ := ctx.Value(progressKey{}).(*jobProgress)
+	return progress
+}
+
+// phase 进入新阶段，totalBytes 为本阶段需要处理的字节数，未知时为 0。
+func (p *jobProgress) phase(name string, totalBytes int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.job.Phase = name
+	p.job.BytesDone = 0
+	p.job.BytesTotal = totalBytes
+	p.job.Percent = p.percent()
+	p.persist(true)
+}
+
+func (p *jobProgress) add(bytes int64) {
+	if p == nil || bytes == 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.job.BytesDone += bytes
+	p.job.Percent = p.percent()
+	p.persist(false)
+}
+
+// percent 按阶段权重计算整体进度，任务结束前最多为 99。
+func (p *jobProgress) percent() int {
+	total, done := 0, 0
+	reached := false
+	for _, weight := range p.weights {
+		total += weight.weight
+		switch {
+		case weight.phase == p.job.Phase:
+			reached = true
+			if p.job.BytesTotal > 0 {
+				done += int(int64(weight.weight) * min(p.job.BytesDone, p.job.BytesTotal) / p.job.BytesTotal)
+			}
+		case !reached:
+			done += weight.weight
+		}
+	}
+	if total == 0 || !reached {
+		return p.job.Percent
+	}
+	return min(done*100/total, 99)
+}
+
+func (p *jobProgress) persist(force bool) {
+	if !force && time.Since(p.lastSave) < progressSaveInterval {
+		return
+	}
+	p.lastSave = time.Now()
+	if err := p.save(p.job); err != nil {
+		log.Printf("failed to save backup job %s progress: %v", p.job.ID, err)
+	}
+}
+
+// update 在持有锁的情况下修改任务并立即保存，用于任务开始、结束和请求取消。
+func (p *jobProgress) update(change func(job *common.BackupJob)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	change(p.job)
+	p.persist(true)
+}
+
+// snapshot 返回任务当前状态的副本。
+func (p *jobProgress) snapshot() common.BackupJob {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return *p.job
+}
+
+// copyWithContext 分块复制，每块之间检查 ctx 是否已取消，并把字节数计入当前任务阶段。
+func copyWithContext(ctx context.Context, dst io.Writer, src io.Reader) (int64, error) {
+	progress := progressFrom(ctx)
+	buffer := make([]byte, copyBufferSize)
+	var written int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return written, err
+		}
+		readBytes, readErr := src.Read(buffer)
+		if readBytes > 0 {
+			writtenBytes, writeErr := dst.Write(buffer[:readBytes])
+			written += int64(writtenBytes)
+			progress.add(int64(writtenBytes))
+			if writeErr != nil {
+				return written, writeErr
+			}
+			if writtenBytes < readBytes {
+				return written, io.ErrShortWrite
+			}
+		}
+		if readErr == io.EOF {
+			return written, nil
+		}
+		if readErr != nil {
+			return written, readErr
+		}
+	}
+}
+
+// dirSize 返回目录下普通文件的总字节数，用作复制阶段的进度总量；目录不存在时为 0。
+func dirSize(dir string) int64 {
+	var size int64
+	_ = filepath.WalkDir(dir, func(_ string, entry fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return nil
+		}
+		if entry.Type().IsRegular() {
+			if info, err := entry.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
@@ -0,0 +1,176 @@
+package backup
+
+import (
+	"DataArk/common"
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// RetentionPolicy 快照保留策略，三条规则保留的快照取并集：
+// KeepLast 保留最近的 N 个；KeepDaily 对最近 D 个有备份的日子各保留当天最后一个；
+// KeepWeekly 对最近 W 个有备份的周（按 ISO 周计算）各保留该周最后一个。全部为 0 时不删除任何快照。
+type RetentionPolicy struct {
+	KeepLast   int `json:"keepLast"`
+	KeepDaily  int `json:"keepDaily"`
+	KeepWeekly int `json:"keepWeekly"`
+}
+
+// Enabled 表示是否配置了任何保留规则。
+func (p RetentionPolicy) Enabled() bool {
+	return p.KeepLast > 0 || p.KeepDaily > 0 || p.KeepWeekly > 0
+}
+
+// PruneResult 删除快照和回收 blob 的结果。
+type PruneResult struct {
+	DeletedSnapshots []string `json:"deletedSnapshots"`
+	RemovedBlobs     int      `json:"removedBlobs"`
+	FreedBytes       int64    `json:"freedBytes"`
+}
+
+// selectExpiredSnapshots 返回不在保留策略内的快照 ID，summaries 需按时间倒序排列。
+// 创建时间无法解析的快照总是保留，避免误删。
+func selectExpiredSnapshots(summaries []SnapshotSummary, policy RetentionPolicy) []string {
+	if !policy.Enabled() {
+		return nil
+	}
+
+	keep := make(map[string]bool)
+	days := make(map[string]bool)
+	weeks := make(map[string]bool)
+	for index, summary := range summaries {
+		createdAt, err := time.Parse(time.RFC3339, summary.CreatedAt)
+		if err != nil {
+			keep[summary.ID] = true
+			continue
+		}
+		createdAt = createdAt.Local()
+		if index < policy.KeepLast {
+			keep[summary.ID] = true
+		}
+
+		// 按时间倒序遍历，每天和每周第一次遇到的就是该时段最后一个快照
+		day := createdAt.Format("2006-01-02")
+		if !days[day] && len(days) < policy.KeepDaily {
+			days[day] = true
+			keep[summary.ID] = true
+		}
+		year, week := createdAt.ISOWeek()
+		weekKey := fmt.Sprintf("%d-%02d", year, week)
+		if !weeks[weekKey] && len(weeks) < policy.KeepWeekly {
+			weeks[weekKey] = true
+			keep[summary.ID] = true
+		}
+	}
+
+	var expired []string
+	for _, summary := range summaries {
+		if !keep[summary.ID] {
+			expired = append(expired, summary.ID)
+		}
+	}
+	return expired
+}
+
+// DeleteSnapshot 删除一个快照，并回收不再被任何快照引用的 blob。
+func DeleteSnapshot(ctx context.Context, id string) (*PruneResult, error) {
+	result, err := deleteSnapshots(ctx, func(repository *snapshotRepository) ([]string, error) {
+		if _, err := repository.load(id); err != nil {
+			return nil, err
+		}
+		return []string{id}, nil
+	})
+	common.RecordAuditEvent(ctx, common.AuditActionBackupDelete, "snapshot:"+id, pruneDetail(result), err)
+	return result, err
+}
+
+// PruneSnapshots 按保留策略删除过期的快照并回收 blob。
+func PruneSnapshots(ctx context.Context, policy RetentionPolicy) (*PruneResult, error) {
+	return deleteSnapshots(ctx, func(repository *snapshotRepository) ([]string, error) {
+		summaries, err := listRepositorySnapshots(repository)
+		if err != nil {
+			return nil, err
+		}
+		return selectExpiredSnapshots(summaries, policy), nil
+	})
+}
+
+func pruneDetail(result *PruneResult) string {
+	if result == nil {
+		return ""
+	}
+	return fmt.Sprintf("removed %d blobs, freed %d bytes", result.RemovedBlobs, result.FreedBytes)
+}
+
+func deleteSnapshots(ctx context.Context, selectIDs func(*snapshotRepository) ([]string, error)) (*PruneResult, error) {
+	repositoryMu.Lock()
+	defer repositoryMu.Unlock()
+
+	repository, err := openSnapshotRepository()
+	if err != nil {
+		return nil, err
+	}
+	ids, err := selectIDs(repository)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &PruneResult{DeletedSnapshots: []string{}}
+	for _, id := range ids {
+		if err := os.Remove(repository.manifestPath(id)); err != nil && !os.IsNotExist(err) {
+			return result, err
+		}
+		result.DeletedSnapshots = append(result.DeletedSnapshots, id)
+	}
+	if len(ids) == 0 {
+		return result, nil
+	}
+	if err := collectGarbage(ctx, repository, result); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// collectGarbage 删除不被任何快照引用的 blob，调用方需独占 repositoryMu。
+// 清单读取失败时不删除任何 blob，宁可多占空间也不能让其它快照无法恢复。
+func collectGarbage(ctx context.Context, repository *snapshotRepository, result *PruneResult) error {
+	ids, err := repository.snapshotIDs()
+	if err != nil {
+		return err
+	}
+	referenced := make(map[string]bool)
+	for _, id := range ids {
+		snapshot, err := repository.load(id)
+		if err != nil {
+			return fmt.Errorf("skip blob garbage collection: %w", err)
+		}
+		for _, file := range snapshot.Files {
+			referenced[repository.blobName(file.Hash)] = true
+		}
+	}
+
+	return filepath.WalkDir(filepath.Join(repository.root, snapshotBlobDir), func(currentPath string, entry fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if entry.IsDir() || referenced[entry.Name()] {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(currentPath); err != nil {
+			return err
+		}
+		result.RemovedBlobs++
+		result.FreedBytes += info.Size()
+		return nil
+	})
+}
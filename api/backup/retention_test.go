@@ -0,0 +1,171 @@
+package backup
+
+import (
+	"DataArk/common"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSelectExpiredSnapshots(t *testing.T) {
+	location := time.Local
+	var summaries []SnapshotSummary
+	// 4 月 1 日到 4 月 20 日每天 1:00 和 13:00 各一个快照，倒序排列
+	for day := 20; day >= 1; day-- {
+		for _, hour := range []int{13, 1} {
+			createdAt := time.Date(2026, 4, day, hour, 0, 0, 0, location)
+			summaries = append(summaries, SnapshotSummary{ID: createdAt.Format("0102-15"), CreatedAt: createdAt.Format(time.RFC3339)})
+		}
+	}
+	summaries = append(summaries, SnapshotSummary{ID: "unknown", CreatedAt: "not a time"})
+
+	keptBy := func(policy RetentionPolicy) []string {
+		expired := make(map[string]bool)
+		for _, id := range selectExpiredSnapshots(summaries, policy) {
+			expired[id] = true
+		}
+		var kept []string
+		for _, summary := range summaries {
+			if !expired[summary.ID] {
+				kept = append(kept, summary.ID)
+			}
+		}
+		return kept
+	}
+
+	if expired := selectExpiredSnapshots(summaries, RetentionPolicy{}); expired != nil {
+		t.Fatalf("empty policy expired %v, want nothing", expired)
+	}
+	if kept := keptBy(RetentionPolicy{KeepLast: 3}); !reflect.DeepEqual(kept, []string{"0420-13", "0420-01", "0419-13", "unknown"}) {
+		t.Fatalf("keep last kept %v", kept)
+	}
+	if kept := keptBy(RetentionPolicy{KeepDaily: 2}); !reflect.DeepEqual(kept, []string{"0420-13", "0419-13", "unknown"}) {
+		t.Fatalf("keep daily kept %v", kept)
+	}
+	// 2026-04-20、04-19（周日）和 04-12（周日）分别是最近三周的最后一个快照
+	if kept := keptBy(RetentionPolicy{KeepWeekly: 3}); !reflect.DeepEqual(kept, []string{"0420-13", "0419-13", "0412-13", "unknown"}) {
+		t.Fatalf("keep weekly kept %v", kept)
+	}
+	if kept := keptBy(RetentionPolicy{KeepLast: 2, KeepDaily: 2, KeepWeekly: 2}); !reflect.DeepEqual(kept, []string{"0420-13", "0420-01", "0419-13", "unknown"}) {
+		t.Fatalf("combined policy kept %v", kept)
+	}
+}
+
+func TestDeleteSnapshotCollectsUnreferencedBlobs(t *testing.T) {
+	archiveRoot := setupSnapshotEnvironment(t)
+	writeArchiveTestFile(t, archiveRoot, "example.com", "a.html", "first")
+	writeArchiveTestFile(t, archiveRoot, "example.com", "b.html", "shared")
+	first, err := CreateSnapshot(context.Background())
+	if err != nil {
+		t.Fatalf("CreateSnapshot returned error: %v", err)
+	}
+	writeArchiveTestFile(t, archiveRoot, "example.com", "a.html", "changed")
+	second, err := CreateSnapshot(context.Background())
+	if err != nil {
+		t.Fatalf("CreateSnapshot returned error: %v", err)
+	}
+
+	result, err := DeleteSnapshot(context.Background(), first.ID)
+	if err != nil {
+		t.Fatalf("DeleteSnapshot returned error: %v", err)
+	}
+	// 旧的 a.html 和数据库快照不再被引用，b.html 仍被第二个快照使用
+	if !reflect.DeepEqual(result.DeletedSnapshots, []string{first.ID}) || result.RemovedBlobs != 2 || result.FreedBytes == 0 {
+		t.Fatalf("unexpected delete result %+v", result)
+	}
+	if _, err := DeleteSnapshot(context.Background(), first.ID); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Fatalf("deleting twice err = %v, want ErrSnapshotNotFound", err)
+	}
+
+	// 下载的 zip 可以直接按普通备份恢复
+	zipPath := filepath.Join(t.TempDir(), SnapshotZipName(second.ID))
+	zipFile, err := os.Create(zipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteSnapshotZip(context.Background(), second.ID, zipFile); err != nil {
+		t.Fatalf("WriteSnapshotZip returned error: %v", err)
+	}
+	if err := zipFile.Close(); err != nil {
+		t.Fatal(err)
+	}
+	writeArchiveTestFile(t, archiveRoot, "example.com", "a.html", "later")
+	if _, err := RestoreBackup(context.Background(), zipPath, RestoreOptions{}); err != nil {
+		t.Fatalf("RestoreBackup of downloaded snapshot returned error: %v", err)
+	}
+	content, err := os.ReadFile(filepath.Join(archiveRoot, "example.com", "a.html"))
+	if err != nil || !strings.Contains(string(content), "changed body") {
+		t.Fatalf("a.html = %q err=%v, want content of the second snapshot", string(content), err)
+	}
+}
+
+func TestRunScheduledTickCreatesAndPrunes(t *testing.T) {
+	setupSnapshotEnvironment(t)
+	oldLoad, oldSnapshot, oldPrune, oldShip := loadBackupSchedule, scheduledSnapshot, scheduledPrune, scheduledShip
+	t.Cleanup(func() {
+		loadBackupSchedule, scheduledSnapshot, scheduledPrune, scheduledShip = oldLoad, oldSnapshot, oldPrune, oldShip
+	})
+
+	schedule := common.BackupSchedule{Schedule: "0 3 * * *", KeepLast: 2}
+	loadBackupSchedule = func() (common.BackupSchedule, error) { return schedule, nil }
+	var created int
+	var shipped []string
+	var prunedWith []RetentionPolicy
+	scheduledShip = func(_ context.Context, id string) { shipped = append(shipped, id) }
+	scheduledSnapshot = func(context.Context) (*Snapshot, error) {
+		created++
+		return &Snapshot{ID: "scheduled"}, nil
+	}
+	scheduledPrune = func(_ context.Context, policy RetentionPolicy) (*PruneResult, error) {
+		prunedWith = append(prunedWith, policy)
+		return &PruneResult{DeletedSnapshots: []string{"old"}}, nil
+	}
+
+	if runScheduledTick(context.Background(), time.Date(2026, 4, 27, 3, 1, 0, 0, time.Local)) || created != 0 {
+		t.Fatal("tick outside the schedule should not create a backup")
+	}
+	if !runScheduledTick(context.Background(), time.Date(2026, 4, 27, 3, 0, 0, 0, time.Local)) || created != 1 {
+		t.Fatal("tick on the schedule should create a backup")
+	}
+	if !reflect.DeepEqual(shipped, []string{"scheduled"}) || !reflect.DeepEqual(prunedWith, []RetentionPolicy{{KeepLast: 2}}) {
+		t.Fatalf("shipped %v, pruned with %+v", shipped, prunedWith)
+	}
+
+	// 没有保留策略时只备份不清理；配置为空时不备份
+	schedule = common.BackupSchedule{Schedule: "0 3 * * *"}
+	runScheduledTick(context.Background(), time.Date(2026, 4, 28, 3, 0, 0, 0, time.Local))
+	if created != 2 || len(prunedWith) != 1 {
+		t.Fatalf("created=%d pruned=%d, want backup without prune", created, len(prunedWith))
+	}
+	schedule = common.BackupSchedule{}
+	if runScheduledTick(context.Background(), time.Date(2026, 4, 29, 3, 0, 0, 0, time.Local)) {
+		t.Fatal("empty schedule should not create a backup")
+	}
+}
+
+func TestUpdateScheduleSettingsValidates(t *testing.T) {
+	setupSnapshotEnvironment(t)
+	if _, err := UpdateScheduleSettings(common.BackupSchedule{Schedule: "61 * * * *"}, "admin"); !errors.Is(err, ErrInvalidBackupSchedule) || !errors.Is(err, ErrInvalidCronSchedule) {
+		t.Fatalf("invalid cron err = %v", err)
+	}
+	if _, err := UpdateScheduleSettings(common.BackupSchedule{KeepDaily: -1}, "admin"); !errors.Is(err, ErrInvalidBackupSchedule) {
+		t.Fatalf("negative keep err = %v", err)
+	}
+
+	settings, err := UpdateScheduleSettings(common.BackupSchedule{Schedule: " @daily ", KeepLast: 5}, "admin")
+	if err != nil {
+		t.Fatalf("UpdateScheduleSettings returned error: %v", err)
+	}
+	if settings.Schedule != "@daily" || settings.NextRun == nil || settings.UpdatedBy != "admin" {
+		t.Fatalf("unexpected settings %+v", settings)
+	}
+	loaded, err := GetScheduleSettings()
+	if err != nil || loaded.Schedule != "@daily" || loaded.KeepLast != 5 {
+		t.Fatalf("GetScheduleSettings = %+v err=%v", loaded, err)
+	}
+}
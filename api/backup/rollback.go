@@ -0,0 +1,275 @@
+package backup
+
+import (
+	"DataArk/common"
+	"DataArk/search"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// 测试中替换为会失败的实现，检查恢复失败后的回滚。
+var rebuildArchiveIndex = search.RebuildIndexFromArchive
+
+const (
+	preRestoreDatabaseFile = "database.jsonl"
+	preRestoreArchiveDir   = "archive"
+	// preRestoreClearedMarker 在原有归档全部移走后写入，之后归档目录中的内容都来自备份，回滚时可以清空。
+	preRestoreClearedMarker = "archive-cleared"
+)
+
+// RestoreError 表示完整恢复在改动数据之后失败：Phase 为失败的阶段，RolledBack 表示数据库、归档目录和索引
+// 已经回到恢复前的状态。回滚也失败时 RollbackError 记录原因，恢复前的数据库导出和归档分别保留在
+// DatabaseBackup 和 ArchiveBackup 中，下次启动时会再次尝试回滚。
+type RestoreError struct {
+	Phase          string `json:"phase"`
+	RolledBack     bool   `json:"rolledBack"`
+	RollbackError  string `json:"rollbackError,omitempty"`
+	DatabaseBackup string `json:"databaseBackup,omitempty"`
+	ArchiveBackup  string `json:"archiveBackup,omitempty"`
+	Err            error  `json:"-"`
+}
+
+func (e *RestoreError) Error() string {
+	if e.RolledBack {
+		return fmt.Sprintf("restore failed during %s, rolled back to the pre-restore state: %v", e.Phase, e.Err)
+	}
+	message := fmt.Sprintf("restore failed during %s and rollback failed: %v; rollback error: %s", e.Phase, e.Err, e.RollbackError)
+	if e.DatabaseBackup != "" {
+		message += "; previous database kept at " + e.DatabaseBackup
+	}
+	if e.ArchiveBackup != "" {
+		message += "; previous archive kept at " + e.ArchiveBackup
+	}
+	return message
+}
+
+func (e *RestoreError) Unwrap() error {
+	return e.Err
+}
+
+// preRestoreState 是完整恢复开始改动数据之前的现场，保存在归档目录旁边的隐藏目录中：当前数据库的逻辑导出，
+// 以及改名移入的原有归档。归档只改名不复制，恢复前不需要额外的一份归档大小的磁盘空间。
+// 目录只在恢复过程中存在，进程在恢复中途退出时由 recoverInterruptedRestores 在下次启动时回滚。
+type preRestoreState struct {
+	dir            string
+	archiveRoot    string
+	archiveMoved   bool
+	archiveCleared bool
+	meiliDumpFile  string
+	indexChanged   bool
+}
+
+func preRestorePattern(archiveRoot string) string {
+	return "." + filepath.Base(archiveRoot) + ".pre-restore-*"
+}
+
+func (s *preRestoreState) databaseExport() string {
+	return filepath.Join(s.dir, preRestoreDatabaseFile)
+}
+
+func (s *preRestoreState) archiveAside() string {
+	return filepath.Join(s.dir, preRestoreArchiveDir)
+}
+
+// savePreRestoreState 创建现场目录并导出当前数据库，归档目录在替换前才移走。
+// 导出先写入临时文件再改名，目录中存在导出文件就说明导出是完整的。
+func savePreRestoreState(ctx context.Context) (*preRestoreState, error) {
+	archiveRoot, err := cleanArchiveRoot()
+	if err != nil {
+		return nil, err
+	}
+	parent := filepath.Dir(archiveRoot)
+	if err := os.MkdirAll(parent, 0o755); err != nil {
+		return nil, err
+	}
+	progressFrom(ctx).phase(JobPhasePreRestore, 0)
+	dir, err := os.MkdirTemp(parent, preRestorePattern(archiveRoot))
+	if err != nil {
+		return nil, err
+	}
+	state := &preRestoreState{dir: dir, archiveRoot: archiveRoot}
+	partial := state.databaseExport() + ".partial"
+	if err := createDatabaseExport(ctx, partial); err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, fmt.Errorf("export current database before restore: %w", err)
+	}
+	if err := os.Rename(partial, state.databaseExport()); err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, err
+	}
+	return state, nil
+}
+
+// moveArchiveAside 把归档目录中的内容移到现场目录，归档根目录本身保留（可能是挂载点）。移走的过程不计入进度。
+func (s *preRestoreState) moveArchiveAside(ctx context.Context) error {
+	info, err := os.Stat(s.archiveRoot)
+	if os.IsNotExist(err) {
+		if err := os.MkdirAll(s.archiveRoot, 0o755); err != nil {
+			return err
+		}
+		return s.markArchiveCleared()
+	}
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("archive location %s is not a directory", s.archiveRoot)
+	}
+
+	if err := os.Mkdir(s.archiveAside(), 0o755); err != nil {
+		return err
+	}
+	s.archiveMoved = true
+	if err := moveDirContents(withProgress(ctx, nil), s.archiveRoot, s.archiveAside()); err != nil {
+		return err
+	}
+	return s.markArchiveCleared()
+}
+
+func (s *preRestoreState) markArchiveCleared() error {
+	if err := os.WriteFile(filepath.Join(s.dir, preRestoreClearedMarker), nil, 0o644); err != nil {
+		return err
+	}
+	s.archiveCleared = true
+	return nil
+}
+
+// rollback 按与恢复相反的顺序还原归档目录、数据库和索引，尽量执行每一步并返回所有错误。
+// 全部成功后删除现场目录，否则保留，供下次启动时重试或人工处理。
+func (s *preRestoreState) rollback(ctx context.Context) error {
+	var errs []error
+	// 移走归档的过程中失败时，归档目录里剩下的仍是原有文件，不能清空。每完成一步都更新现场目录，
+	// 回滚中途退出后再次回滚不会删掉已经移回的文件。
+	var archiveErr error
+	if s.archiveCleared {
+		if err := removeDirContents(s.archiveRoot); err != nil {
+			archiveErr = fmt.Errorf("remove restored archive: %w", err)
+		} else if err := os.Remove(filepath.Join(s.dir, preRestoreClearedMarker)); err != nil && !os.IsNotExist(err) {
+			archiveErr = err
+		} else {
+			s.archiveCleared = false
+		}
+	}
+	if archiveErr == nil && s.archiveMoved {
+		if err := moveDirContents(ctx, s.archiveAside(), s.archiveRoot); err != nil {
+			archiveErr = fmt.Errorf("move previous archive back: %w", err)
+		} else if err := os.Remove(s.archiveAside()); err != nil {
+			archiveErr = err
+		} else {
+			s.archiveMoved = false
+		}
+	}
+	if archiveErr != nil {
+		errs = append(errs, archiveErr)
+	}
+	if _, err := common.ImportDatabase(ctx, s.databaseExport()); err != nil {
+		errs = append(errs, fmt.Errorf("import pre-restore database: %w", err))
+	}
+	if s.indexChanged && len(errs) == 0 {
+		if _, err := rebuildArchiveIndex(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("rebuild index: %w", err))
+		}
+	}
+	if s.meiliDumpFile != "" {
+		_ = os.Remove(filepath.Join(common.MEILIDumpDir, s.meiliDumpFile))
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	return os.RemoveAll(s.dir)
+}
+
+// fail 回滚并把失败的阶段包装成 RestoreError。回滚失败时保留现场目录，避免丢失恢复前的数据。
+func (s *preRestoreState) fail(ctx context.Context, phase string, err error) error {
+	restoreErr := &RestoreError{Phase: phase, Err: err}
+	if rollbackErr := s.rollback(ctx); rollbackErr != nil {
+		restoreErr.RollbackError = rollbackErr.Error()
+		restoreErr.DatabaseBackup = s.databaseExport()
+		// 归档已经移回时现场目录中只剩空目录，不再提示
+		if entries, readErr := os.ReadDir(s.archiveAside()); readErr == nil && len(entries) > 0 {
+			restoreErr.ArchiveBackup = s.archiveAside()
+		}
+		log.Printf("restore failed during %s and rollback failed: %v", phase, rollbackErr)
+		return restoreErr
+	}
+	restoreErr.RolledBack = true
+	return restoreErr
+}
+
+// discard 在恢复成功或还没有改动数据时删除现场目录。
+func (s *preRestoreState) discard() {
+	if err := os.RemoveAll(s.dir); err != nil {
+		log.Printf("failed to remove pre-restore state %s: %v", s.dir, err)
+	}
+}
+
+// recoverInterruptedRestores 回滚上次进程退出时没有完成的完整恢复。现场目录中没有数据库导出时，
+// 进程在导出阶段退出，还没有改动任何数据，直接删除；否则按现场还原归档、数据库并重建索引。
+// 回滚失败的目录保留并写入审计记录，不阻止服务启动。
+func recoverInterruptedRestores() {
+	archiveRoot, err := cleanArchiveRoot()
+	if err != nil {
+		return
+	}
+	matches, err := filepath.Glob(filepath.Join(filepath.Dir(archiveRoot), preRestorePattern(archiveRoot)))
+	if err != nil {
+		log.Printf("failed to look for interrupted restores: %v", err)
+		return
+	}
+	ctx := context.Background()
+	for _, dir := range matches {
+		state := &preRestoreState{dir: dir, archiveRoot: archiveRoot, indexChanged: true}
+		if _, err := os.Stat(state.databaseExport()); os.IsNotExist(err) {
+			if err := os.RemoveAll(dir); err != nil {
+				log.Printf("failed to remove incomplete pre-restore state %s: %v", dir, err)
+			}
+			continue
+		}
+		if _, err := os.Stat(state.archiveAside()); err == nil {
+			state.archiveMoved = true
+		}
+		if _, err := os.Stat(filepath.Join(dir, preRestoreClearedMarker)); err == nil {
+			state.archiveCleared = true
+		}
+
+		err := state.rollback(ctx)
+		if err != nil {
+			log.Printf("failed to roll back interrupted restore, previous data kept at %s: %v", dir, err)
+		} else {
+			log.Printf("rolled back restore interrupted by server restart")
+		}
+		common.RecordAuditEvent(ctx, common.AuditActionBackupRestore, filepath.Base(dir), "roll back restore interrupted by server restart", err)
+	}
+}
+
+// moveDirContents 把 source 中的每一项移到 destination，优先改名，不在同一个文件系统时改为复制后删除。
+func moveDirContents(ctx context.Context, source string, destination string) error {
+	entries, err := os.ReadDir(source)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		from := filepath.Join(source, entry.Name())
+		to := filepath.Join(destination, entry.Name())
+		if err := os.Rename(from, to); err == nil {
+			continue
+		}
+		if entry.IsDir() {
+			err = copyDir(ctx, from, to)
+		} else {
+			err = copyFile(ctx, from, to)
+		}
+		if err != nil {
+			_ = os.RemoveAll(to)
+			return err
+		}
+		if err := os.RemoveAll(from); err != nil {
+			return err
+		}
+	}
+	return nil
+}
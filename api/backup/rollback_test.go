@@ -0,0 +1,159 @@
+package backup
+
+import (
+	"DataArk/common"
+	"DataArk/search"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRestoreBackupRollsBackOnFailure(t *testing.T) {
+	archiveRoot := setupSnapshotEnvironment(t)
+	writeArchiveTestFile(t, archiveRoot, "example.com", "a.html", "original")
+	zipPath := filepath.Join(t.TempDir(), "backup.zip")
+	writeTestBackupZip(t, zipPath)
+
+	// 备份之后的改动，恢复失败时应该原样保留
+	writeArchiveTestFile(t, archiveRoot, "example.com", "a.html", "changed")
+	writeArchiveTestFile(t, archiveRoot, "example.com", "b.html", "added")
+	if _, err := common.CreateUser("mallory", "secret123"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := search.RebuildIndexFromArchive(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	oldRebuild := rebuildArchiveIndex
+	t.Cleanup(func() { rebuildArchiveIndex = oldRebuild })
+	rebuilds := 0
+	rebuildArchiveIndex = func(ctx context.Context) (*search.RebuildIndexResult, error) {
+		rebuilds++
+		if rebuilds == 1 {
+			return nil, errors.New("index is broken")
+		}
+		return oldRebuild(ctx)
+	}
+
+	_, err := RestoreBackup(context.Background(), zipPath, RestoreOptions{})
+	var restoreErr *RestoreError
+	if !errors.As(err, &restoreErr) {
+		t.Fatalf("RestoreBackup error = %v, want *RestoreError", err)
+	}
+	if restoreErr.Phase != JobPhaseReindex || !restoreErr.RolledBack || !strings.Contains(err.Error(), "index is broken") {
+		t.Fatalf("unexpected restore error %+v", restoreErr)
+	}
+	if rebuilds != 2 {
+		t.Fatalf("rollback should rebuild the index once, rebuilds = %d", rebuilds)
+	}
+
+	if html, _ := os.ReadFile(filepath.Join(archiveRoot, "example.com", "a.html")); !strings.Contains(string(html), "changed body") {
+		t.Fatalf("archive should be rolled back, a.html = %q", html)
+	}
+	if _, err := os.Stat(filepath.Join(archiveRoot, "example.com", "b.html")); err != nil {
+		t.Fatalf("file added after the backup should be kept: %v", err)
+	}
+	if _, err := common.GetUserByUsername("mallory"); err != nil {
+		t.Fatalf("database should be rolled back: %v", err)
+	}
+	entries, err := os.ReadDir(filepath.Dir(archiveRoot))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if strings.Contains(entry.Name(), ".pre-restore-") {
+			t.Fatalf("pre-restore archive %s should be moved back", entry.Name())
+		}
+	}
+
+	// 失败的恢复也写审计记录，并保存在回滚后的数据库中
+	events, _, err := common.ListAuditEvents(common.AuditFilter{Action: common.AuditActionBackupRestore}, 1, 10)
+	if err != nil || len(events) != 1 || events[0].Outcome == common.AuditOutcomeSuccess {
+		t.Fatalf("restore audit events = %+v, %v", events, err)
+	}
+}
+
+func TestFailedRollbackKeepsStateForNextStartup(t *testing.T) {
+	archiveRoot := setupSnapshotEnvironment(t)
+	writeArchiveTestFile(t, archiveRoot, "example.com", "a.html", "original")
+	zipPath := filepath.Join(t.TempDir(), "backup.zip")
+	writeTestBackupZip(t, zipPath)
+	writeArchiveTestFile(t, archiveRoot, "example.com", "a.html", "changed")
+	if _, err := common.CreateUser("mallory", "secret123"); err != nil {
+		t.Fatal(err)
+	}
+
+	oldRebuild := rebuildArchiveIndex
+	t.Cleanup(func() { rebuildArchiveIndex = oldRebuild })
+	rebuildArchiveIndex = func(context.Context) (*search.RebuildIndexResult, error) {
+		return nil, errors.New("index is broken")
+	}
+
+	_, err := RestoreBackup(context.Background(), zipPath, RestoreOptions{})
+	var restoreErr *RestoreError
+	if !errors.As(err, &restoreErr) || restoreErr.RolledBack || restoreErr.RollbackError == "" {
+		t.Fatalf("RestoreBackup error = %v, want a failed rollback", err)
+	}
+	// 回滚失败时恢复前的数据库导出仍然保留，而不是随临时目录删除
+	if _, err := os.Stat(restoreErr.DatabaseBackup); err != nil {
+		t.Fatalf("pre-restore database export should be kept: %v", err)
+	}
+
+	// 下次启动时索引恢复正常，自动完成回滚
+	rebuildArchiveIndex = oldRebuild
+	if err := InitBackupJobs(); err != nil {
+		t.Fatalf("InitBackupJobs returned error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Dir(restoreErr.DatabaseBackup)); !os.IsNotExist(err) {
+		t.Fatalf("pre-restore state should be removed after recovery, stat err = %v", err)
+	}
+	if html, _ := os.ReadFile(filepath.Join(archiveRoot, "example.com", "a.html")); !strings.Contains(string(html), "changed body") {
+		t.Fatalf("archive should be rolled back, a.html = %q", html)
+	}
+	if _, err := common.GetUserByUsername("mallory"); err != nil {
+		t.Fatalf("database should be rolled back: %v", err)
+	}
+}
+
+func TestInitBackupJobsRollsBackInterruptedRestore(t *testing.T) {
+	archiveRoot := setupSnapshotEnvironment(t)
+	writeArchiveTestFile(t, archiveRoot, "example.com", "a.html", "original")
+	if _, err := common.CreateUser("alice", "secret123"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 模拟进程在替换归档之后退出：现场目录已经保存，归档和数据库都已经被改动
+	state, err := savePreRestoreState(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := state.moveArchiveAside(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	writeArchiveTestFile(t, archiveRoot, "example.com", "restored.html", "restored")
+	if _, err := common.CreateUser("restored", "secret123"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := InitBackupJobs(); err != nil {
+		t.Fatalf("InitBackupJobs returned error: %v", err)
+	}
+	if _, err := os.Stat(state.dir); !os.IsNotExist(err) {
+		t.Fatalf("pre-restore state should be removed, stat err = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(archiveRoot, "example.com", "a.html")); err != nil {
+		t.Fatalf("previous archive should be moved back: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(archiveRoot, "example.com", "restored.html")); !os.IsNotExist(err) {
+		t.Fatalf("restored files should be removed, stat err = %v", err)
+	}
+	if _, err := common.GetUserByUsername("restored"); err == nil {
+		t.Fatal("database should be rolled back to the pre-restore export")
+	}
+	if _, err := common.GetUserByUsername("alice"); err != nil {
+		t.Fatalf("pre-restore users should be kept: %v", err)
+	}
+}
@@ -0,0 +1,153 @@
+package backup
+
+import (
+	"DataArk/common"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInvalidBackupSchedule 表示定时备份配置不合法，cron 表达式错误时同时满足 ErrInvalidCronSchedule。
+var ErrInvalidBackupSchedule = errors.New("invalid backup schedule")
+
+var (
+	loadBackupSchedule = common.GetBackupSchedule
+	saveBackupSchedule = common.SaveBackupSchedule
+	scheduledSnapshot  = CreateSnapshot
+	scheduledPrune     = PruneSnapshots
+	scheduledShip      = shipScheduledSnapshot
+
+	schedulerOnce sync.Once
+)
+
+// ScheduleSettings 定时备份配置，NextRun 为按当前时间计算的下一次执行时间，未启用时为空。
+type ScheduleSettings struct {
+	common.BackupSchedule
+	NextRun *time.Time `json:"nextRun"`
+}
+
+func scheduleRetentionPolicy(schedule common.BackupSchedule) RetentionPolicy {
+	return RetentionPolicy{KeepLast: schedule.KeepLast, KeepDaily: schedule.KeepDaily, KeepWeekly: schedule.KeepWeekly}
+}
+
+// validateBackupSchedule 检查配置并返回解析后的 cron 表达式，Schedule 为空时返回 nil 表示不定时备份。
+func validateBackupSchedule(schedule common.BackupSchedule) (*CronSchedule, error) {
+	if schedule.KeepLast < 0 || schedule.KeepDaily < 0 || schedule.KeepWeekly < 0 {
+		return nil, fmt.Errorf("%w: keep counts must not be negative", ErrInvalidBackupSchedule)
+	}
+	if strings.TrimSpace(schedule.Schedule) == "" {
+		return nil, nil
+	}
+	cron, err := ParseCronSchedule(schedule.Schedule)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidBackupSchedule, err)
+	}
+	return cron, nil
+}
+
+func newScheduleSettings(schedule common.BackupSchedule, now time.Time) (*ScheduleSettings, error) {
+	cron, err := validateBackupSchedule(schedule)
+	if err != nil {
+		return nil, err
+	}
+	settings := &ScheduleSettings{BackupSchedule: schedule}
+	if cron != nil {
+		if next := cron.Next(now); !next.IsZero() {
+			settings.NextRun = &next
+		}
+	}
+	return settings, nil
+}
+
+// GetScheduleSettings 返回当前生效的定时备份配置。
+func GetScheduleSettings() (*ScheduleSettings, error) {
+	schedule, err := loadBackupSchedule()
+	if err != nil {
+		return nil, err
+	}
+	return newScheduleSettings(schedule, time.Now())
+}
+
+// UpdateScheduleSettings 校验并保存定时备份配置，调度器在下一分钟读取新配置，不需要重启。
+func UpdateScheduleSettings(schedule common.BackupSchedule, updatedBy string) (*ScheduleSettings, error) {
+	schedule.Schedule = strings.TrimSpace(schedule.Schedule)
+	if _, err := validateBackupSchedule(schedule); err != nil {
+		return nil, err
+	}
+	saved, err := saveBackupSchedule(schedule, updatedBy)
+	if err != nil {
+		return nil, err
+	}
+	return newScheduleSettings(saved, time.Now())
+}
+
+// StartScheduler 启动定时备份。调度器每分钟从数据库读取一次配置，
+// 所以通过接口修改配置或恢复备份后都不需要重启；启动参数中的 cron 表达式不合法时直接返回错误。
+func StartScheduler() error {
+	var startErr error
+	schedulerOnce.Do(func() {
+		if _, err := validateBackupSchedule(common.DefaultBackupSchedule()); err != nil {
+			startErr = err
+			return
+		}
+		go runScheduler()
+	})
+	return startErr
+}
+
+func runScheduler() {
+	for {
+		now := time.Now()
+		time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+		runScheduledTick(context.Background(), time.Now().Truncate(time.Minute))
+	}
+}
+
+// runScheduledTick 在 minute 命中 cron 表达式时创建快照、上传到备份目标并按保留策略清理旧快照，返回是否执行了备份。
+func runScheduledTick(ctx context.Context, minute time.Time) bool {
+	schedule, err := loadBackupSchedule()
+	if err != nil {
+		log.Printf("failed to load backup schedule: %v", err)
+		return false
+	}
+	cron, err := validateBackupSchedule(schedule)
+	if err != nil {
+		log.Printf("skip scheduled backup: %v", err)
+		return false
+	}
+	if cron == nil || !cron.Matches(minute) {
+		return false
+	}
+
+	snapshot, err := scheduledSnapshot(ctx)
+	if err != nil {
+		log.Printf("scheduled backup failed: %v", err)
+		return true
+	}
+	log.Printf("scheduled backup %s created, %d new blobs", snapshot.ID, snapshot.NewBlobs)
+	scheduledShip(ctx, snapshot.ID)
+
+	policy := scheduleRetentionPolicy(schedule)
+	if !policy.Enabled() {
+		return true
+	}
+	result, err := scheduledPrune(ctx, policy)
+	if err != nil {
+		log.Printf("failed to prune backups: %v", err)
+	}
+	// 回收 blob 失败时清单已经删除，快照本身仍然算作已删除
+	if result != nil {
+		for _, id := range result.DeletedSnapshots {
+			common.RecordAuditEvent(ctx, common.AuditActionBackupDelete, "snapshot:"+id, "retention policy", nil)
+		}
+		// 备份目标中的副本按同样的策略清理
+		if err := removeShippedSnapshots(ctx, result.DeletedSnapshots); err != nil {
+			log.Printf("failed to prune backups in targets: %v", err)
+		}
+	}
+	return true
+}
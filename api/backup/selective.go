@@ -0,0 +1,463 @@
+package backup
+
+import (
+	"DataArk/common"
+	"DataArk/search"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// 测试中替换为会失败的实现，检查部分恢复失败后的撤销。
+var indexArchiveFiles = search.IndexArchiveFiles
+
+var (
+	ErrInvalidRestoreSelection  = errors.New("invalid restore selection")
+	ErrRestoreSelectionNotFound = errors.New("selected domains and paths are not in the backup")
+)
+
+// RestoreSelection 指定部分恢复的范围：Domains 为整个域名目录，Paths 为 domain/filename 形式的单个文件，
+// 也接受 /archive/domain/filename 形式。
+type RestoreSelection struct {
+	Domains []string `json:"domains"`
+	Paths   []string `json:"paths"`
+}
+
+type SelectiveRestoreResult struct {
+	RestoredFiles    int      `json:"restoredFiles"`
+	AddedFiles       int      `json:"addedFiles"`
+	OverwrittenFiles int      `json:"overwrittenFiles"`
+	IndexedDocuments int      `json:"indexedDocuments"`
+	Domains          []string `json:"domains"`
+	// Missing 列出备份中不存在的域名和文件，其余选中的内容照常恢复。
+	Missing []string `json:"missing,omitempty"`
+}
+
+type selectedArchiveFile struct {
+	Source       string
+	RelativePath string
+	Domain       string
+	Filename     string
+	Indexable    bool
+}
+
+// RestoreSelected 只把备份中选中的域名或文件合并回当前归档目录：不动数据库和其它归档文件，
+// 新增的文件计入统计，只为恢复的 HTML 重新建立索引。误删一个域名时不需要回滚全部数据。
+func RestoreSelected(ctx context.Context, zipPath string, selection RestoreSelection) (*SelectiveRestoreResult, error) {
+	result, err := restoreSelected(ctx, zipPath, selection)
+	detail := "selection " + selection.describe()
+	if result != nil {
+		detail = fmt.Sprintf("%s, restored %d files", detail, result.RestoredFiles)
+	}
+	common.RecordAuditEvent(ctx, common.AuditActionBackupRestore, filepath.Base(zipPath), detail, err)
+	return result, err
+}
+
+func (s RestoreSelection) describe() string {
+	parts := make([]string, 0, 2)
+	if len(s.Domains) > 0 {
+		parts = append(parts, "domains="+strings.Join(s.Domains, ","))
+	}
+	if len(s.Paths) > 0 {
+		parts = append(parts, "paths="+strings.Join(s.Paths, ","))
+	}
+	return strings.Join(parts, " ")
+}
+
+func restoreSelected(ctx context.Context, zipPath string, selection RestoreSelection) (*SelectiveRestoreResult, error) {
+	domains, paths, err := normalizeRestoreSelection(selection)
+	if err != nil {
+		return nil, err
+	}
+
+	operationMu.Lock()
+	defer operationMu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// 与完整恢复一样解开到归档目录旁边，不占用可能很小的系统临时目录，异常退出后在启动时清理
+	tempRoot, err := restoreStagingDir()
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tempRoot)
+
+	zipPath, err = openBackupZip(zipPath, tempRoot)
+	if err != nil {
+		return nil, err
+	}
+	extractDir := filepath.Join(tempRoot, "extract")
+	if err := extractZip(ctx, zipPath, extractDir); err != nil {
+		return nil, err
+	}
+	if err := verifyBackupChecksums(extractDir); err != nil {
+		return nil, err
+	}
+	components, err := discoverRestoreComponents(extractDir)
+	if err != nil {
+		return nil, err
+	}
+
+	files, missing, err := selectArchiveFiles(components.ArchiveDir, domains, paths)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrRestoreSelectionNotFound, strings.Join(missing, ", "))
+	}
+	// 先确认所有 HTML 都能建立索引，再改动归档目录
+	for _, file := range files {
+		if file.Indexable {
+			if err := search.CheckArchiveHTML(file.Source, file.Domain, file.Filename); err != nil {
+				return nil, fmt.Errorf("%s: %w", file.RelativePath, err)
+			}
+		}
+	}
+	ownerships, err := readBackupArchiveOwnerships(ctx, components)
+	if err != nil {
+		return nil, err
+	}
+
+	archiveRoot, err := cleanArchiveRoot()
+	if err != nil {
+		return nil, err
+	}
+	result := &SelectiveRestoreResult{Domains: []string{}, Missing: missing}
+	undo := &selectiveRestoreUndo{addedByDomain: make(map[string]int)}
+	restored := false
+	defer func() {
+		if !restored {
+			undo.revert(ctx)
+		}
+	}()
+
+	// 先写归属再放入文件：文件一出现在归档目录中就有归属记录，私有归档不会在恢复过程中被当作没有记录的公开旧归档
+	indexFiles := make([]search.ArchiveFile, 0, len(files))
+	for _, file := range files {
+		if !file.Indexable {
+			continue
+		}
+		previous, found, err := common.GetArchiveOwnership(file.Domain, file.Filename)
+		if err != nil {
+			return nil, err
+		}
+		ownership, ok := ownerships[common.ArchiveDocumentKey(file.Domain, file.Filename)]
+		if !ok {
+			// 备份中没有记录时沿用当前数据库中的归属，都没有时按公开处理，与重建索引时对旧归档的处理一致
+			ownership = previous
+		}
+		if err := common.SaveArchiveDocument(file.Domain, file.Filename, ownership); err != nil {
+			return nil, err
+		}
+		undo.ownerships = append(undo.ownerships, previousArchiveOwnership{domain: file.Domain, filename: file.Filename, ownership: previous, found: found})
+		destination := filepath.Join(archiveRoot, filepath.FromSlash(file.RelativePath))
+		indexFiles = append(indexFiles, search.ArchiveFile{Path: destination, Domain: file.Domain, Filename: file.Filename, Ownership: ownership})
+	}
+
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		destination := filepath.Join(archiveRoot, filepath.FromSlash(file.RelativePath))
+		overwritten, err := undo.replace(ctx, file, destination)
+		if err != nil {
+			return nil, err
+		}
+		result.RestoredFiles++
+		if overwritten {
+			result.OverwrittenFiles++
+		} else {
+			result.AddedFiles++
+		}
+	}
+
+	for domain, added := range undo.addedByDomain {
+		if err := common.IncrementArchiveStat(domain, added); err != nil {
+			return nil, err
+		}
+		undo.countedDomains = append(undo.countedDomains, domain)
+	}
+	undo.indexed = true
+	result.IndexedDocuments, err = indexArchiveFiles(ctx, indexFiles)
+	if err != nil {
+		return nil, err
+	}
+	restored = true
+	undo.commit()
+
+	restoredDomains := make(map[string]bool)
+	for _, file := range files {
+		restoredDomains[file.Domain] = true
+	}
+	for domain := range restoredDomains {
+		result.Domains = append(result.Domains, domain)
+	}
+	sort.Strings(result.Domains)
+	return result, nil
+}
+
+// normalizeRestoreSelection 校验并规范化选择，域名和路径都不能越出归档目录。
+func normalizeRestoreSelection(selection RestoreSelection) ([]string, []string, error) {
+	var domains, paths []string
+	for _, domain := range selection.Domains {
+		domain = strings.TrimSpace(domain)
+		if domain == "" {
+			continue
+		}
+		if !isSafeArchiveSegment(domain) || strings.EqualFold(domain, "Temporary") {
+			return nil, nil, fmt.Errorf("%w: domain %q", ErrInvalidRestoreSelection, domain)
+		}
+		domains = append(domains, domain)
+	}
+	for _, rawPath := range selection.Paths {
+		selectedPath := strings.TrimPrefix(strings.TrimSpace(rawPath), "/")
+		selectedPath = strings.TrimPrefix(selectedPath, "archive/")
+		if selectedPath == "" {
+			continue
+		}
+		segments := strings.Split(selectedPath, "/")
+		if len(segments) < 2 || strings.EqualFold(segments[0], "Temporary") {
+			return nil, nil, fmt.Errorf("%w: path %q must be domain/filename", ErrInvalidRestoreSelection, rawPath)
+		}
+		for _, segment := range segments {
+			if !isSafeArchiveSegment(segment) {
+				return nil, nil, fmt.Errorf("%w: path %q", ErrInvalidRestoreSelection, rawPath)
+			}
+		}
+		paths = append(paths, path.Join(segments...))
+	}
+	if len(domains) == 0 && len(paths) == 0 {
+		return nil, nil, fmt.Errorf("%w: no domains or paths selected", ErrInvalidRestoreSelection)
+	}
+	return domains, paths, nil
+}
+
+func isSafeArchiveSegment(segment string) bool {
+	return segment != "" && segment != "." && segment != ".." && !strings.ContainsAny(segment, `/\`)
+}
+
+// selectArchiveFiles 返回备份归档中被选中的普通文件，以及备份中不存在的域名和路径。
+func selectArchiveFiles(archiveDir string, domains []string, paths []string) ([]selectedArchiveFile, []string, error) {
+	selectedDomains := make(map[string]bool, len(domains))
+	for _, domain := range domains {
+		selectedDomains[domain] = true
+	}
+	selectedPaths := make(map[string]bool, len(paths))
+	for _, selectedPath := range paths {
+		selectedPaths[selectedPath] = true
+	}
+
+	found := make(map[string]bool)
+	var files []selectedArchiveFile
+	err := filepath.WalkDir(archiveDir, func(currentPath string, entry fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		relativePath, err := filepath.Rel(archiveDir, currentPath)
+		if err != nil {
+			return err
+		}
+		relativePath = filepath.ToSlash(relativePath)
+		pathParts := strings.Split(relativePath, "/")
+		if len(pathParts) < 2 {
+			return nil
+		}
+		domain := pathParts[0]
+		switch {
+		case selectedDomains[domain]:
+			found[domain] = true
+		case selectedPaths[relativePath]:
+			found[relativePath] = true
+		default:
+			return nil
+		}
+
+		extension := strings.ToLower(filepath.Ext(relativePath))
+		files = append(files, selectedArchiveFile{
+			Source:       currentPath,
+			RelativePath: relativePath,
+			Domain:       domain,
+			Filename:     strings.Join(pathParts[1:], "/"),
+			Indexable:    extension == ".html" || extension == ".htm",
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	missing := make([]string, 0)
+	for _, selected := range append(append([]string{}, domains...), paths...) {
+		if !found[selected] {
+			missing = append(missing, selected)
+		}
+	}
+	return files, missing, nil
+}
+
+// readBackupArchiveOwnerships 读取备份数据库中的归档归属，恢复的文件沿用备份时的可见范围。
+func readBackupArchiveOwnerships(ctx context.Context, components *restoreComponents) (map[string]common.ArchiveOwnership, error) {
+	var ownerships map[string]common.ArchiveOwnership
+	var err error
+	switch {
+	case components.DatabaseExportPath != "":
+		ownerships, err = common.ReadExportArchiveOwnerships(components.DatabaseExportPath)
+	case components.DatabaseSnapshotPath != "":
+		ownerships, err = common.ReadSnapshotArchiveOwnerships(ctx, components.DatabaseSnapshotPath)
+	default:
+		ownerships, err = parseSQLDumpArchiveOwnerships(components.DatabasePath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read archive ownership from backup: %w", err)
+	}
+	return ownerships, nil
+}
+
+// replaceFile 先复制到目标目录中的临时文件再改名，恢复中途失败不会留下半个文件。
+func replaceFile(ctx context.Context, source string, destination string) error {
+	temporary := destination + ".restoring"
+	if err := copyFile(ctx, source, temporary); err != nil {
+		_ = os.Remove(temporary)
+		return err
+	}
+	if err := os.Rename(temporary, destination); err != nil {
+		_ = os.Remove(temporary)
+		return err
+	}
+	return nil
+}
+
+// selectiveRestoreUndo 记录部分恢复对归档目录、归属记录、统计和索引的改动，失败时按相反顺序撤销。
+// 被覆盖的文件在替换前硬链接（不支持时复制）到旁边，撤销时改名回原位，成功后删除。
+type selectiveRestoreUndo struct {
+	files          []restoredArchiveFile
+	ownerships     []previousArchiveOwnership
+	addedByDomain  map[string]int
+	countedDomains []string
+	indexed        bool
+}
+
+type restoredArchiveFile struct {
+	file        selectedArchiveFile
+	destination string
+	previous    string
+}
+
+type previousArchiveOwnership struct {
+	domain    string
+	filename  string
+	ownership common.ArchiveOwnership
+	found     bool
+}
+
+// replace 用备份中的文件替换 destination，返回是否覆盖了已有文件。
+func (u *selectiveRestoreUndo) replace(ctx context.Context, file selectedArchiveFile, destination string) (bool, error) {
+	_, statErr := os.Stat(destination)
+	if statErr != nil && !os.IsNotExist(statErr) {
+		return false, statErr
+	}
+	restored := restoredArchiveFile{file: file, destination: destination}
+	if statErr == nil {
+		restored.previous = destination + ".restore-previous"
+		_ = os.Remove(restored.previous)
+		if err := os.Link(destination, restored.previous); err != nil {
+			if err := copyFile(ctx, destination, restored.previous); err != nil {
+				_ = os.Remove(restored.previous)
+				return false, err
+			}
+		}
+	}
+	u.files = append(u.files, restored)
+	if err := replaceFile(ctx, file.Source, destination); err != nil {
+		return false, err
+	}
+	// 统计只计算 HTML，与刷新统计时的磁盘扫描一致
+	if statErr != nil && file.Indexable {
+		u.addedByDomain[file.Domain]++
+	}
+	return statErr == nil, nil
+}
+
+// revert 撤销已经做出的改动，尽量执行每一步并记录失败。ctx 可能已经取消，撤销时不使用。
+func (u *selectiveRestoreUndo) revert(ctx context.Context) {
+	revertCtx := context.WithoutCancel(ctx)
+	var added, previous []search.ArchiveFile
+	for i := len(u.files) - 1; i >= 0; i-- {
+		restored := u.files[i]
+		archiveFile := search.ArchiveFile{Path: restored.destination, Domain: restored.file.Domain, Filename: restored.file.Filename}
+		if restored.previous == "" {
+			if err := os.Remove(restored.destination); err != nil && !os.IsNotExist(err) {
+				log.Printf("failed to remove restored file %s: %v", restored.destination, err)
+			}
+			if restored.file.Indexable {
+				added = append(added, archiveFile)
+			}
+			continue
+		}
+		if err := os.Rename(restored.previous, restored.destination); err != nil {
+			log.Printf("failed to put back %s: %v", restored.destination, err)
+			continue
+		}
+		if restored.file.Indexable {
+			previous = append(previous, archiveFile)
+		}
+	}
+
+	for _, domain := range u.countedDomains {
+		if err := common.DecrementArchiveStat(domain, u.addedByDomain[domain]); err != nil {
+			log.Printf("failed to revert archive stat for %s: %v", domain, err)
+		}
+	}
+
+	previousOwnerships := make(map[string]common.ArchiveOwnership, len(u.ownerships))
+	for _, record := range u.ownerships {
+		previousOwnerships[common.ArchiveDocumentKey(record.domain, record.filename)] = record.ownership
+		var err error
+		if record.found {
+			err = common.SaveArchiveDocument(record.domain, record.filename, record.ownership)
+		} else {
+			err = common.DeleteArchiveDocumentRecord(record.domain, record.filename)
+		}
+		if err != nil {
+			log.Printf("failed to revert archive ownership for %s/%s: %v", record.domain, record.filename, err)
+		}
+	}
+
+	if !u.indexed {
+		return
+	}
+	// 索引可能已经写入了一部分恢复的文档：删除新增文件的文档，被覆盖的文件按原有内容和归属重新建立索引
+	if err := search.RemoveArchiveFileDocuments(revertCtx, added); err != nil {
+		log.Printf("failed to remove index documents of reverted files: %v", err)
+	}
+	for i := range previous {
+		previous[i].Ownership = previousOwnerships[common.ArchiveDocumentKey(previous[i].Domain, previous[i].Filename)]
+	}
+	if _, err := search.IndexArchiveFiles(revertCtx, previous); err != nil {
+		log.Printf("failed to reindex reverted files: %v", err)
+	}
+}
+
+// commit 在恢复成功后删除被覆盖文件的旧版本。
+func (u *selectiveRestoreUndo) commit() {
+	for _, restored := range u.files {
+		if restored.previous == "" {
+			continue
+		}
+		if err := os.Remove(restored.previous); err != nil && !os.IsNotExist(err) {
+			log.Printf("failed to remove %s: %v", restored.previous, err)
+		}
+	}
+}
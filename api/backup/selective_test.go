@@ -0,0 +1,215 @@
+package backup
+
+import (
+	"DataArk/common"
+	"DataArk/search"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func indexedDocumentIDs(t *testing.T) map[string][]string {
+	t.Helper()
+	engine, err := search.CurrentEngine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	documents, err := engine.ListDocuments(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make(map[string][]string)
+	for _, document := range documents {
+		key := common.ArchiveDocumentKey(document.Domain, document.Filename)
+		ids[key] = append(ids[key], document.ID)
+	}
+	return ids
+}
+
+func archiveStatCount(t *testing.T, source string) int {
+	t.Helper()
+	stats, err := common.GetArchiveStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range stats.Sources {
+		if item.Source == source {
+			return item.FileCount
+		}
+	}
+	return 0
+}
+
+func TestRestoreSelectedMergesChosenDomains(t *testing.T) {
+	archiveRoot := setupSnapshotEnvironment(t)
+	writeArchiveTestFile(t, archiveRoot, "example.com", "a.html", "deleted page")
+	writeArchiveTestFile(t, archiveRoot, "example.com", "nested/b.html", "deleted nested")
+	writeArchiveTestFile(t, archiveRoot, "example.org", "c.html", "original")
+	private := common.ArchiveOwnership{OwnerID: 7, Visibility: common.ArchiveVisibilityPrivate}
+	if err := common.SaveArchiveDocument("example.com", "a.html", private); err != nil {
+		t.Fatal(err)
+	}
+	zipPath := filepath.Join(t.TempDir(), "backup.zip")
+	writeTestBackupZip(t, zipPath)
+
+	// 误删 example.com，example.org 在备份之后继续变化
+	if err := os.RemoveAll(filepath.Join(archiveRoot, "example.com")); err != nil {
+		t.Fatal(err)
+	}
+	if err := common.DeleteArchiveDocumentRecord("example.com", "a.html"); err != nil {
+		t.Fatal(err)
+	}
+	writeArchiveTestFile(t, archiveRoot, "example.org", "c.html", "changed after backup")
+	writeArchiveTestFile(t, archiveRoot, "example.org", "d.html", "new after backup")
+	if _, err := search.RebuildIndexFromArchive(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := common.RefreshArchiveStatsFromDisk(); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := RestoreSelected(context.Background(), zipPath, RestoreSelection{Domains: []string{"example.com", "missing.net"}})
+	if err != nil {
+		t.Fatalf("RestoreSelected returned error: %v", err)
+	}
+	if result.RestoredFiles != 2 || result.AddedFiles != 2 || result.IndexedDocuments != 2 || len(result.Missing) != 1 || result.Missing[0] != "missing.net" {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	if html, _ := os.ReadFile(filepath.Join(archiveRoot, "example.com", "nested", "b.html")); !strings.Contains(string(html), "deleted nested body") {
+		t.Fatal("nested file should be restored")
+	}
+	if html, _ := os.ReadFile(filepath.Join(archiveRoot, "example.org", "c.html")); !strings.Contains(string(html), "changed after backup") {
+		t.Fatal("unselected domain should keep its current content")
+	}
+	if ownership, found, err := common.GetArchiveOwnership("example.com", "a.html"); err != nil || !found || ownership != private {
+		t.Fatalf("restored ownership = %+v found=%v err=%v, want private owner 7", ownership, found, err)
+	}
+	if count := archiveStatCount(t, "example.com"); count != 2 {
+		t.Fatalf("example.com stat = %d, want 2", count)
+	}
+	ids := indexedDocumentIDs(t)
+	if len(ids["example.com/a.html"]) != 1 || len(ids["example.com/nested/b.html"]) != 1 || len(ids["example.org/d.html"]) != 1 {
+		t.Fatalf("index documents = %v", ids)
+	}
+
+	// 覆盖已有文件：统计不变，索引中不会出现重复文档
+	result, err = RestoreSelected(context.Background(), zipPath, RestoreSelection{Paths: []string{"/archive/example.org/c.html"}})
+	if err != nil {
+		t.Fatalf("RestoreSelected by path returned error: %v", err)
+	}
+	if result.OverwrittenFiles != 1 || result.AddedFiles != 0 {
+		t.Fatalf("unexpected path result %+v", result)
+	}
+	if html, _ := os.ReadFile(filepath.Join(archiveRoot, "example.org", "c.html")); !strings.Contains(string(html), "original body") {
+		t.Fatal("selected path should be restored")
+	}
+	if count := archiveStatCount(t, "example.org"); count != 2 {
+		t.Fatalf("example.org stat = %d, want 2", count)
+	}
+	if ids := indexedDocumentIDs(t); len(ids["example.org/c.html"]) != 1 {
+		t.Fatalf("c.html should have one index document, got %v", ids["example.org/c.html"])
+	}
+}
+
+func TestRestoreSelectedRevertsOnIndexFailure(t *testing.T) {
+	archiveRoot := setupSnapshotEnvironment(t)
+	writeArchiveTestFile(t, archiveRoot, "example.com", "private.html", "private page")
+	writeArchiveTestFile(t, archiveRoot, "example.com", "shared.html", "backup version")
+	private := common.ArchiveOwnership{OwnerID: 7, Visibility: common.ArchiveVisibilityPrivate}
+	if err := common.SaveArchiveDocument("example.com", "private.html", private); err != nil {
+		t.Fatal(err)
+	}
+	zipPath := filepath.Join(t.TempDir(), "backup.zip")
+	writeTestBackupZip(t, zipPath)
+
+	if err := os.Remove(filepath.Join(archiveRoot, "example.com", "private.html")); err != nil {
+		t.Fatal(err)
+	}
+	if err := common.DeleteArchiveDocumentRecord("example.com", "private.html"); err != nil {
+		t.Fatal(err)
+	}
+	writeArchiveTestFile(t, archiveRoot, "example.com", "shared.html", "current version")
+	if _, err := search.RebuildIndexFromArchive(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := common.RefreshArchiveStatsFromDisk(); err != nil {
+		t.Fatal(err)
+	}
+
+	oldIndex := indexArchiveFiles
+	t.Cleanup(func() { indexArchiveFiles = oldIndex })
+	indexArchiveFiles = func(ctx context.Context, files []search.ArchiveFile) (int, error) {
+		// 文件放入归档目录之前归属已经写好，私有归档不会短暂地按公开处理
+		if ownership, found, err := common.GetArchiveOwnership("example.com", "private.html"); err != nil || !found || ownership != private {
+			t.Errorf("ownership before indexing = %+v found=%v err=%v, want private owner 7", ownership, found, err)
+		}
+		if _, err := oldIndex(ctx, files); err != nil {
+			t.Fatal(err)
+		}
+		return 0, errors.New("index is broken")
+	}
+
+	if _, err := RestoreSelected(context.Background(), zipPath, RestoreSelection{Domains: []string{"example.com"}}); err == nil || !strings.Contains(err.Error(), "index is broken") {
+		t.Fatalf("RestoreSelected error = %v, want the index error", err)
+	}
+	if _, err := os.Stat(filepath.Join(archiveRoot, "example.com", "private.html")); !os.IsNotExist(err) {
+		t.Fatalf("added file should be removed, stat err = %v", err)
+	}
+	if html, _ := os.ReadFile(filepath.Join(archiveRoot, "example.com", "shared.html")); !strings.Contains(string(html), "current version body") {
+		t.Fatalf("overwritten file should be put back, shared.html = %q", html)
+	}
+	if _, err := os.Stat(filepath.Join(archiveRoot, "example.com", "shared.html.restore-previous")); !os.IsNotExist(err) {
+		t.Fatalf("previous version should be moved back, stat err = %v", err)
+	}
+	if _, found, err := common.GetArchiveOwnership("example.com", "private.html"); err != nil || found {
+		t.Fatalf("ownership of the removed file should be reverted, found=%v err=%v", found, err)
+	}
+	if count := archiveStatCount(t, "example.com"); count != 1 {
+		t.Fatalf("example.com stat = %d, want 1", count)
+	}
+	ids := indexedDocumentIDs(t)
+	if len(ids["example.com/private.html"]) != 0 || len(ids["example.com/shared.html"]) != 1 {
+		t.Fatalf("index documents = %v", ids)
+	}
+}
+
+func TestRestoreSelectedRejectsInvalidSelections(t *testing.T) {
+	archiveRoot := setupSnapshotEnvironment(t)
+	writeArchiveTestFile(t, archiveRoot, "example.com", "a.html", "page")
+	zipPath := filepath.Join(t.TempDir(), "backup.zip")
+	writeTestBackupZip(t, zipPath)
+
+	for _, selection := range []RestoreSelection{
+		{},
+		{Domains: []string{".."}},
+		{Domains: []string{"Temporary"}},
+		{Paths: []string{"example.com"}},
+		{Paths: []string{"example.com/../../etc/passwd"}},
+	} {
+		if _, err := RestoreSelected(context.Background(), zipPath, selection); !errors.Is(err, ErrInvalidRestoreSelection) {
+			t.Fatalf("selection %+v err = %v, want ErrInvalidRestoreSelection", selection, err)
+		}
+	}
+	if _, err := RestoreSelected(context.Background(), zipPath, RestoreSelection{Domains: []string{"missing.net"}}); !errors.Is(err, ErrRestoreSelectionNotFound) {
+		t.Fatalf("missing domain err = %v, want ErrRestoreSelectionNotFound", err)
+	}
+}
+
+func TestParseSQLDumpArchiveOwnerships(t *testing.T) {
+	sqlPath := writeTestSQLDump(t, testPGDump+"COPY public.archive_documents (domain, filename, owner_id, team_id, visibility, created_at) FROM stdin;\n"+
+		"example.com\tdir/a\\tb.html\t3\t0\tprivate\t\\N\n"+
+		"example.org\tc.html\t0\t5\tteam\t\\N\n"+
+		"\\.\n")
+	ownerships, err := parseSQLDumpArchiveOwnerships(sqlPath)
+	if err != nil {
+		t.Fatalf("parseSQLDumpArchiveOwnerships returned error: %v", err)
+	}
+	if len(ownerships) != 2 ||
+		ownerships["example.com/dir/a\tb.html"] != (common.ArchiveOwnership{OwnerID: 3, Visibility: "private"}) ||
+		ownerships["example.org/c.html"] != (common.ArchiveOwnership{TeamID: 5, Visibility: "team"}) {
+		t.Fatalf("ownerships = %+v", ownerships)
+	}
+}
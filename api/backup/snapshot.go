@@ -0,0 +1,670 @@
+package backup
+
+import (
+	"DataArk/common"
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 增量备份仓库位于 -backupdir，目录结构：
+//
+//	blobs/ab/<sha256>    按内容哈希保存的文件，所有快照共享，内容相同的文件只保存一份
+//	snapshots/<id>.json  快照清单，记录备份时每个文件的路径和哈希
+//	tmp/                 写入中的临时文件，与 blobs 在同一文件系统上，写完后 rename 到位
+//	repository.key       配置了加密时的仓库密钥，blob 和清单都加密保存，见 snapshot_crypto.go
+const (
+	snapshotBlobDir     = "blobs"
+	snapshotManifestDir = "snapshots"
+	snapshotTempDir     = "tmp"
+)
+
+var (
+	ErrSnapshotNotFound  = errors.New("backup snapshot not found")
+	ErrInvalidSnapshotID = errors.New("invalid backup snapshot id")
+	ErrBlobCorrupted     = errors.New("backup blob is corrupted")
+)
+
+// repositoryMu 保护仓库中的 blob：创建、恢复和下载只会新增或读取 blob，可以并发；
+// 删除快照后的垃圾回收会删除 blob，必须独占。需要同时持有时先取 operationMu。
+var repositoryMu sync.RWMutex
+
+var (
+	snapshotIDPattern = regexp.MustCompile(`^[0-9A-Za-z][0-9A-Za-z_-]{0,63}$`)
+	blobHashPattern   = regexp.MustCompile(`^[0-9a-f]{64}$`)
+)
+
+// Snapshot 增量备份的清单。Manifest 中的文件名和 ArchiveDir 与备份 zip 中的布局一致，
+// Files 中的路径相对于该布局的根目录，恢复时按原样还原后即可复用 zip 的恢复流程。
+type Snapshot struct {
+	ID     string `json:"id"`
+	Parent string `json:"parent,omitempty"`
+	Manifest
+	SnapshotStats
+	Files []SnapshotFile `json:"files"`
+}
+
+// SnapshotFile 快照中的一个文件，ModTime 为纳秒时间戳，用于判断文件自上次备份以来是否变化。
+type SnapshotFile struct {
+	Path    string      `json:"path"`
+	Hash    string      `json:"hash"`
+	Size    int64       `json:"size"`
+	Mode    fs.FileMode `json:"mode"`
+	ModTime int64       `json:"modTime"`
+}
+
+// SnapshotStats 快照的文件数和大小，NewBlobs、NewBytes 为本次实际写入仓库的部分。
+type SnapshotStats struct {
+	FileCount  int   `json:"fileCount"`
+	TotalBytes int64 `json:"totalBytes"`
+	NewBlobs   int   `json:"newBlobs"`
+	NewBytes   int64 `json:"newBytes"`
+}
+
+// SnapshotSummary 列表中展示的快照信息，不含文件清单。
+type SnapshotSummary struct {
+	ID             string `json:"id"`
+	Parent         string `json:"parent,omitempty"`
+	CreatedAt      string `json:"createdAt"`
+	SearchEngine   string `json:"searchEngine"`
+	DatabaseDriver string `json:"databaseDriver"`
+	SnapshotStats
+}
+
+// Summary 返回不含文件清单的快照信息。
+func (s *Snapshot) Summary() SnapshotSummary {
+	return SnapshotSummary{
+		ID:             s.ID,
+		Parent:         s.Parent,
+		CreatedAt:      s.CreatedAt,
+		SearchEngine:   s.SearchEngine,
+		DatabaseDriver: s.DatabaseDriver,
+		SnapshotStats:  s.SnapshotStats,
+	}
+}
+
+// snapshotRepository 的 key 为 nil 时仓库不加密。
+type snapshotRepository struct {
+	root string
+	key  []byte
+}
+
+func openSnapshotRepository() (*snapshotRepository, error) {
+	root := strings.TrimSpace(common.BackupDir)
+	if root == "" {
+		return nil, errors.New("backup directory is empty")
+	}
+	var err error
+	repository := &snapshotRepository{root: filepath.Clean(root)}
+	for _, dir := range []string{snapshotBlobDir, snapshotManifestDir, snapshotTempDir} {
+		if err := os.MkdirAll(filepath.Join(repository.root, dir), 0o755); err != nil {
+			return nil, err
+		}
+	}
+	repository.key, err = loadRepositoryKey(repository.root, currentEncryptionKeys())
+	if err != nil {
+		return nil, err
+	}
+	return repository, nil
+}
+
+func (r *snapshotRepository) blobPath(hash string) string {
+	name := r.blobName(hash)
+	return filepath.Join(r.root, snapshotBlobDir, name[:2], name)
+}
+
+func (r *snapshotRepository) manifestPath(id string) string {
+	return filepath.Join(r.root, snapshotManifestDir, id+".json")
+}
+
+func (r *snapshotRepository) hasBlob(hash string) bool {
+	if !blobHashPattern.MatchString(hash) {
+		return false
+	}
+	info, err := os.Stat(r.blobPath(hash))
+	return err == nil && info.Mode().IsRegular()
+}
+
+// storeFile 边复制边计算哈希，仓库中已有相同内容时丢弃临时文件，written 表示是否新写入了 blob。
+// 哈希和 size 都按明文计算，加密的仓库中写入的是密文。
+func (r *snapshotRepository) storeFile(source string) (hash string, size int64, written bool, err error) {
+	sourceFile, err := os.Open(source)
+	if err != nil {
+		return "", 0, false, err
+	}
+	defer sourceFile.Close()
+
+	tempFile, err := os.CreateTemp(filepath.Join(r.root, snapshotTempDir), "blob-*")
+	if err != nil {
+		return "", 0, false, err
+	}
+	tempPath := tempFile.Name()
+	defer os.Remove(tempPath)
+
+	blobWriter, err := r.sealWriter(tempFile, snapshotBlobInfo)
+	if err != nil {
+		_ = tempFile.Close()
+		return "", 0, false, err
+	}
+	hasher := sha256.New()
+	size, copyErr := io.Copy(io.MultiWriter(blobWriter, hasher), sourceFile)
+	if copyErr == nil {
+		copyErr = blobWriter.Close()
+	}
+	closeErr := tempFile.Close()
+	if copyErr != nil {
+		return "", 0, false, copyErr
+	}
+	if closeErr != nil {
+		return "", 0, false, closeErr
+	}
+
+	hash = hex.EncodeToString(hasher.Sum(nil))
+	if r.hasBlob(hash) {
+		return hash, size, false, nil
+	}
+	blobPath := r.blobPath(hash)
+	if err := os.MkdirAll(filepath.Dir(blobPath), 0o755); err != nil {
+		return "", 0, false, err
+	}
+	if err := os.Rename(tempPath, blobPath); err != nil {
+		return "", 0, false, err
+	}
+	return hash, size, true, nil
+}
+
+// copyBlob 把 blob 的内容写入 w，同时校验内容哈希，发现损坏时返回 ErrBlobCorrupted。
+func (r *snapshotRepository) copyBlob(file SnapshotFile, w io.Writer) error {
+	if !blobHashPattern.MatchString(file.Hash) {
+		return fmt.Errorf("%w: invalid hash %q for %s", ErrBlobCorrupted, file.Hash, file.Path)
+	}
+	blobFile, err := os.Open(r.blobPath(file.Hash))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%w: blob %s for %s is missing", ErrBlobCorrupted, file.Hash, file.Path)
+		}
+		return err
+	}
+	defer blobFile.Close()
+
+	blobReader, err := r.openReader(blobFile, snapshotBlobInfo)
+	if err == nil {
+		hasher := sha256.New()
+		if _, err = io.Copy(io.MultiWriter(w, hasher), blobReader); err == nil && hex.EncodeToString(hasher.Sum(nil)) != file.Hash {
+			return fmt.Errorf("%w: blob %s for %s does not match its hash", ErrBlobCorrupted, file.Hash, file.Path)
+		}
+	}
+	if errors.Is(err, ErrBackupDecrypt) {
+		return fmt.Errorf("%w: blob %s for %s: %v", ErrBlobCorrupted, file.Hash, file.Path, err)
+	}
+	return err
+}
+
+// restoreBlob 把 blob 还原成 destination 文件。
+func (r *snapshotRepository) restoreBlob(file SnapshotFile, destination string) error {
+	if err := os.MkdirAll(filepath.Dir(destination), 0o755); err != nil {
+		return err
+	}
+	targetFile, err := os.OpenFile(destination, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, permissionOrDefault(file.Mode, 0o644))
+	if err != nil {
+		return err
+	}
+	copyErr := r.copyBlob(file, targetFile)
+	closeErr := targetFile.Close()
+	if copyErr != nil {
+		return copyErr
+	}
+	return closeErr
+}
+
+func (r *snapshotRepository) snapshotIDs() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(r.root, snapshotManifestDir))
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || entry.IsDir() || !snapshotIDPattern.MatchString(id) {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	// ID 以创建时间开头，按字典序即按时间先后排序
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (r *snapshotRepository) load(id string) (*Snapshot, error) {
+	if !snapshotIDPattern.MatchString(id) {
+		return nil, ErrInvalidSnapshotID
+	}
+	file, err := os.Open(r.manifestPath(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrSnapshotNotFound
+		}
+		return nil, err
+	}
+	defer file.Close()
+	reader, err := r.openReader(file, snapshotManifestInfo)
+	if err != nil {
+		return nil, fmt.Errorf("read backup snapshot %s: %w", id, err)
+	}
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("read backup snapshot %s: %w", id, err)
+	}
+	var snapshot Snapshot
+	if err := json.Unmarshal(content, &snapshot); err != nil {
+		return nil, fmt.Errorf("parse backup snapshot %s: %w", id, err)
+	}
+	return &snapshot, nil
+}
+
+// latest 返回最近一次的快照，仓库为空时返回 nil。
+func (r *snapshotRepository) latest() (*Snapshot, error) {
+	ids, err := r.snapshotIDs()
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+	return r.load(ids[len(ids)-1])
+}
+
+// newID 以创建时间作为快照 ID，同一秒内创建多个快照时追加序号。
+func (r *snapshotRepository) newID(createdAt time.Time) string {
+	base := createdAt.Format("20060102-150405")
+	id := base
+	for sequence := 2; ; sequence++ {
+		if _, err := os.Stat(r.manifestPath(id)); os.IsNotExist(err) {
+			return id
+		}
+		id = base + "-" + strconv.Itoa(sequence)
+	}
+}
+
+// save 先写临时文件再 rename，清单要么完整存在要么不存在。
+func (r *snapshotRepository) save(snapshot *Snapshot) error {
+	tempFile, err := os.CreateTemp(filepath.Join(r.root, snapshotTempDir), "snapshot-*.json")
+	if err != nil {
+		return err
+	}
+	tempPath := tempFile.Name()
+	defer os.Remove(tempPath)
+
+	manifestWriter, err := r.sealWriter(tempFile, snapshotManifestInfo)
+	if err != nil {
+		_ = tempFile.Close()
+		return err
+	}
+	encodeErr := json.NewEncoder(manifestWriter).Encode(snapshot)
+	if encodeErr == nil {
+		encodeErr = manifestWriter.Close()
+	}
+	closeErr := tempFile.Close()
+	if encodeErr != nil {
+		return encodeErr
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	return os.Rename(tempPath, r.manifestPath(snapshot.ID))
+}
+
+// snapshotBuilder 把文件加入快照。上一个快照中大小和修改时间都相同的文件直接复用原来的 blob，不再读取内容。
+type snapshotBuilder struct {
+	repository *snapshotRepository
+	previous   map[string]SnapshotFile
+	files      []SnapshotFile
+	stats      SnapshotStats
+}
+
+func newSnapshotBuilder(repository *snapshotRepository, parent *Snapshot) *snapshotBuilder {
+	builder := &snapshotBuilder{repository: repository, previous: make(map[string]SnapshotFile)}
+	if parent != nil {
+		for _, file := range parent.Files {
+			builder.previous[file.Path] = file
+		}
+	}
+	return builder
+}
+
+func (b *snapshotBuilder) addFile(source string, relativePath string, info fs.FileInfo) error {
+	file := SnapshotFile{
+		Path:    relativePath,
+		Size:    info.Size(),
+		Mode:    info.Mode().Perm(),
+		ModTime: info.ModTime().UnixNano(),
+	}
+	if previous, ok := b.previous[relativePath]; ok && previous.Size == file.Size && previous.ModTime == file.ModTime && b.repository.hasBlob(previous.Hash) {
+		file.Hash = previous.Hash
+	} else {
+		hash, size, written, err := b.repository.storeFile(source)
+		if err != nil {
+			return fmt.Errorf("store %s: %w", relativePath, err)
+		}
+		file.Hash = hash
+		file.Size = size
+		if written {
+			b.stats.NewBlobs++
+			b.stats.NewBytes += size
+		}
+	}
+	b.files = append(b.files, file)
+	b.stats.FileCount++
+	b.stats.TotalBytes += file.Size
+	return nil
+}
+
+// addDir 把 source 下的普通文件以 prefix 为前缀加入快照，跳过符号链接。
+func (b *snapshotBuilder) addDir(ctx context.Context, source string, prefix string) error {
+	return filepath.WalkDir(source, func(currentPath string, entry fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		relativePath, err := filepath.Rel(source, currentPath)
+		if err != nil {
+			return err
+		}
+		return b.addFile(currentPath, path.Join(prefix, filepath.ToSlash(relativePath)), info)
+	})
+}
+
+// CreateSnapshot 在 -backupdir 仓库中创建一个增量备份。
+// 归档目录直接从原位置读取，只有自上一个快照以来新增或变化的文件才会写入仓库，不再整体复制和压缩。
+// 与其它增量备份工具一样，以大小和修改时间判断文件是否变化。
+func CreateSnapshot(ctx context.Context) (*Snapshot, error) {
+	snapshot, err := createSnapshot(ctx)
+	target, detail := "snapshot", ""
+	if snapshot != nil {
+		target = "snapshot:" + snapshot.ID
+		detail = fmt.Sprintf("%d files, %d new blobs", snapshot.FileCount, snapshot.NewBlobs)
+	}
+	common.RecordAuditEvent(ctx, common.AuditActionBackupCreate, target, detail, err)
+	return snapshot, err
+}
+
+func createSnapshot(ctx context.Context) (*Snapshot, error) {
+	operationMu.Lock()
+	defer operationMu.Unlock()
+	repositoryMu.RLock()
+	defer repositoryMu.RUnlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	repository, err := openSnapshotRepository()
+	if err != nil {
+		return nil, err
+	}
+	parent, err := repository.latest()
+	if err != nil {
+		return nil, err
+	}
+
+	workDir, err := os.MkdirTemp(filepath.Join(repository.root, snapshotTempDir), "dump-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(workDir)
+
+	createdAt := time.Now()
+	manifest, err := createServiceDumps(ctx, workDir, createdAt)
+	if err != nil {
+		return nil, err
+	}
+
+	builder := newSnapshotBuilder(repository, parent)
+	if err := builder.addDir(ctx, workDir, ""); err != nil {
+		return nil, err
+	}
+
+	archiveRoot := strings.TrimSpace(common.ARCHIVEFILELOACTION)
+	if archiveRoot == "" {
+		return nil, errors.New("archive location is empty")
+	}
+	if _, err := os.Stat(archiveRoot); err == nil {
+		if err := builder.addDir(ctx, archiveRoot, manifest.ArchiveDir); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	snapshot := &Snapshot{
+		ID:            repository.newID(createdAt),
+		Manifest:      manifest,
+		SnapshotStats: builder.stats,
+		Files:         builder.files,
+	}
+	if parent != nil {
+		snapshot.Parent = parent.ID
+	}
+	if err := repository.save(snapshot); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// ListSnapshots 按时间倒序列出仓库中的快照。
+func ListSnapshots() ([]SnapshotSummary, error) {
+	repositoryMu.RLock()
+	defer repositoryMu.RUnlock()
+
+	repository, err := openSnapshotRepository()
+	if err != nil {
+		return nil, err
+	}
+	return listRepositorySnapshots(repository)
+}
+
+func listRepositorySnapshots(repository *snapshotRepository) ([]SnapshotSummary, error) {
+	ids, err := repository.snapshotIDs()
+	if err != nil {
+		return nil, err
+	}
+	summaries := make([]SnapshotSummary, 0, len(ids))
+	for i := len(ids) - 1; i >= 0; i-- {
+		snapshot, err := repository.load(ids[i])
+		if err != nil {
+			return nil, err
+		}
+		summaries = append(summaries, snapshot.Summary())
+	}
+	return summaries, nil
+}
+
+// GetSnapshot 读取快照清单，下载前用来确认快照存在。
+func GetSnapshot(id string) (*Snapshot, error) {
+	repositoryMu.RLock()
+	defer repositoryMu.RUnlock()
+
+	repository, err := openSnapshotRepository()
+	if err != nil {
+		return nil, err
+	}
+	return repository.load(id)
+}
+
+// RestoreSnapshot 把仓库中的快照还原成备份 zip 的目录布局，再按恢复 zip 的流程覆盖数据库和归档目录。
+func RestoreSnapshot(ctx context.Context, id string) (*RestoreResult, error) {
+	result, err := restoreSnapshot(ctx, id)
+	detail := ""
+	if result != nil {
+		detail = fmt.Sprintf("indexed %d documents", result.IndexedDocuments)
+	}
+	common.RecordAuditEvent(ctx, common.AuditActionBackupRestore, "snapshot:"+id, detail, err)
+	return result, err
+}
+
+func restoreSnapshot(ctx context.Context, id string) (*RestoreResult, error) {
+	operationMu.Lock()
+	defer operationMu.Unlock()
+	repositoryMu.RLock()
+	defer repositoryMu.RUnlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	repository, err := openSnapshotRepository()
+	if err != nil {
+		return nil, err
+	}
+	snapshot, err := repository.load(id)
+	if err != nil {
+		return nil, err
+	}
+
+	tempRoot, err := os.MkdirTemp(filepath.Join(repository.root, snapshotTempDir), "restore-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tempRoot)
+
+	extractDir := filepath.Join(tempRoot, "extract")
+	if err := materializeSnapshot(ctx, repository, snapshot, filepath.Join(extractDir, "backup")); err != nil {
+		return nil, err
+	}
+	return restoreExtracted(ctx, extractDir)
+}
+
+// WriteSnapshotZip 把快照按备份 zip 的格式写入 w，得到的 zip 可以直接用 RestoreBackup 恢复。
+// 文件内容从 blob 读取并校验哈希，不需要先还原到临时目录。
+func WriteSnapshotZip(ctx context.Context, id string, w io.Writer) error {
+	repositoryMu.RLock()
+	defer repositoryMu.RUnlock()
+
+	repository, err := openSnapshotRepository()
+	if err != nil {
+		return err
+	}
+	snapshot, err := repository.load(id)
+	if err != nil {
+		return err
+	}
+	return writeSnapshotZip(ctx, repository, snapshot, w)
+}
+
+// SnapshotZipName 返回下载快照时使用的文件名。
+func SnapshotZipName(id string) string {
+	return "dataark-backup-" + id + ".zip"
+}
+
+func writeSnapshotZip(ctx context.Context, repository *snapshotRepository, snapshot *Snapshot, w io.Writer) error {
+	// blob 的哈希就是文件内容的 SHA-256，直接作为 zip 中的校验和
+	manifest := snapshot.Manifest
+	manifest.FormatVersion = ManifestFormatVersion
+	manifest.Checksums = make(map[string]string, len(snapshot.Files))
+	for _, file := range snapshot.Files {
+		manifest.Checksums[file.Path] = file.Hash
+	}
+
+	backupWriter, err := newBackupWriter(w)
+	if err != nil {
+		return err
+	}
+	zipWriter := zip.NewWriter(backupWriter)
+	writeEntries := func() error {
+		manifestWriter, err := zipWriter.Create(path.Join("backup", manifestFileName))
+		if err != nil {
+			return err
+		}
+		encoder := json.NewEncoder(manifestWriter)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(manifest); err != nil {
+			return err
+		}
+		if _, err := zipWriter.Create(path.Join("backup", snapshot.ArchiveDir) + "/"); err != nil {
+			return err
+		}
+
+		for _, file := range snapshot.Files {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if _, ok := safeZipEntryPath(file.Path); !ok {
+				return fmt.Errorf("unsafe snapshot entry %q", file.Path)
+			}
+			header := &zip.FileHeader{
+				Name:     path.Join("backup", file.Path),
+				Method:   zip.Deflate,
+				Modified: time.Unix(0, file.ModTime),
+			}
+			header.SetMode(permissionOrDefault(file.Mode, 0o644))
+			entryWriter, err := zipWriter.CreateHeader(header)
+			if err != nil {
+				return err
+			}
+			if err := repository.copyBlob(file, entryWriter); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := writeEntries(); err != nil {
+		_ = zipWriter.Close()
+		return err
+	}
+	if err := zipWriter.Close(); err != nil {
+		return err
+	}
+	return backupWriter.Close()
+}
+
+// materializeSnapshot 把快照中的文件逐个从 blob 还原到 destination，归档目录即使为空也会创建。
+func materializeSnapshot(ctx context.Context, repository *snapshotRepository, snapshot *Snapshot, destination string) error {
+	archiveDir, ok := safeZipEntryPath(snapshot.ArchiveDir)
+	if !ok {
+		return fmt.Errorf("unsafe snapshot archive directory %q", snapshot.ArchiveDir)
+	}
+	if err := os.MkdirAll(filepath.Join(destination, archiveDir), 0o755); err != nil {
+		return err
+	}
+
+	for _, file := range snapshot.Files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		relativePath, ok := safeZipEntryPath(file.Path)
+		if !ok {
+			return fmt.Errorf("unsafe snapshot entry %q", file.Path)
+		}
+		targetPath := filepath.Join(destination, relativePath)
+		if !isSubpath(destination, targetPath) {
+			return fmt.Errorf("unsafe snapshot entry %q", file.Path)
+		}
+		if err := repository.restoreBlob(file, targetPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// 配置了加密时增量备份仓库同样加密：仓库密钥随机生成，按加密备份的格式用口令和接收方公钥包装后保存在
+// repository.key 中；blob 和快照清单用仓库密钥派生的密钥分块加密，blob 的文件名改为内容哈希的 HMAC，
+// 不能从文件名反推文件内容。打开仓库需要能解开仓库密钥的口令或私钥。
+const (
+	snapshotKeyFile       = "repository.key"
+	snapshotBlobInfo      = "blob"
+	snapshotManifestInfo  = "manifest"
+	snapshotBlobNameInfo  = "blob-name"
+	snapshotRepositoryKey = 32
+)
+
+var (
+	// ErrSnapshotRepositoryUnencrypted 表示配置了加密，但仓库中已有未加密的快照，不能混用。
+	ErrSnapshotRepositoryUnencrypted = errors.New("backup snapshot repository is not encrypted")
+	// ErrSnapshotRepositoryEncrypted 表示仓库已加密，但当前没有能解开仓库密钥的口令或私钥。
+	ErrSnapshotRepositoryEncrypted = errors.New("backup snapshot repository is encrypted")
+)
+
+// 解开仓库密钥需要运行一次 scrypt，按仓库目录和当前密钥缓存结果。
+var (
+	repositoryKeyMu    sync.Mutex
+	repositoryKeyRoot  string
+	repositoryKeyOwner *encryptionKeys
+	repositoryKeyValue []byte
+)
+
+// loadRepositoryKey 读取或创建仓库密钥。仓库未加密且没有配置加密时返回 nil。
+func loadRepositoryKey(root string, keys *encryptionKeys) ([]byte, error) {
+	repositoryKeyMu.Lock()
+	defer repositoryKeyMu.Unlock()
+	if repositoryKeyValue != nil && repositoryKeyRoot == root && repositoryKeyOwner == keys {
+		return repositoryKeyValue, nil
+	}
+
+	keyPath := filepath.Join(root, snapshotKeyFile)
+	content, err := os.ReadFile(keyPath)
+	switch {
+	case err == nil:
+		key, err := unwrapRepositoryKey(content, keys)
+		if err != nil {
+			return nil, err
+		}
+		repositoryKeyRoot, repositoryKeyOwner, repositoryKeyValue = root, keys, key
+		return key, nil
+	case !os.IsNotExist(err):
+		return nil, err
+	case !keys.enabled():
+		return nil, nil
+	}
+
+	empty, err := repositoryIsEmpty(root)
+	if err != nil {
+		return nil, err
+	}
+	if !empty {
+		return nil, fmt.Errorf("%w: move the existing snapshots out of %s or disable backup encryption", ErrSnapshotRepositoryUnencrypted, root)
+	}
+	key := make([]byte, snapshotRepositoryKey)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	var wrapped bytes.Buffer
+	writer, err := newEncryptWriter(&wrapped, keys)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(key); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	// 先确认当前配置能解开刚写入的密钥，只配置了接收方公钥时服务端无法读取仓库
+	if _, err := unwrapRepositoryKey(wrapped.Bytes(), keys); err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(filepath.Join(root, snapshotTempDir), keyPath, wrapped.Bytes()); err != nil {
+		return nil, err
+	}
+	repositoryKeyRoot, repositoryKeyOwner, repositoryKeyValue = root, keys, key
+	return key, nil
+}
+
+func unwrapRepositoryKey(content []byte, keys *encryptionKeys) ([]byte, error) {
+	reader, err := newDecryptReader(bufio.NewReader(bytes.NewReader(content)), keys)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v; configure -backuppassphrase or -backupidentity to use it", ErrSnapshotRepositoryEncrypted, err)
+	}
+	key, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSnapshotRepositoryEncrypted, err)
+	}
+	if len(key) != snapshotRepositoryKey {
+		return nil, fmt.Errorf("%w: invalid repository key", ErrSnapshotRepositoryEncrypted)
+	}
+	return key, nil
+}
+
+// repositoryIsEmpty 判断仓库中是否还没有任何 blob 和快照清单，垃圾回收后留下的空目录不算。
+func repositoryIsEmpty(root string) (bool, error) {
+	errFound := errors.New("found")
+	for _, dir := range []string{snapshotBlobDir, snapshotManifestDir} {
+		err := filepath.WalkDir(filepath.Join(root, dir), func(_ string, entry fs.DirEntry, walkErr error) error {
+			if walkErr != nil {
+				return walkErr
+			}
+			if !entry.IsDir() {
+				return errFound
+			}
+			return nil
+		})
+		if errors.Is(err, errFound) {
+			return false, nil
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// blobName 返回保存 blob 的文件名：未加密的仓库直接使用内容哈希，加密的仓库使用内容哈希的 HMAC。
+func (r *snapshotRepository) blobName(hash string) string {
+	if r.key == nil {
+		return hash
+	}
+	mac := hmac.New(sha256.New, deriveKey(r.key, nil, snapshotBlobNameInfo))
+	mac.Write([]byte(hash))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// sealWriter 在加密的仓库中返回写入 w 的加密 writer，格式为随机 nonce 加分块密文；未加密时原样写入。
+func (r *snapshotRepository) sealWriter(w io.Writer, info string) (io.WriteCloser, error) {
+	if r.key == nil {
+		return nopWriteCloser{w}, nil
+	}
+	nonce := make([]byte, encryptedNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(nonce); err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.New(deriveKey(r.key, nonce, info))
+	if err != nil {
+		return nil, err
+	}
+	return &encryptWriter{writer: w, aead: aead, buffer: make([]byte, 0, encryptedChunkSize)}, nil
+}
+
+// openReader 解密 sealWriter 写入的内容，认证失败时读取返回 ErrBackupDecrypt。
+func (r *snapshotRepository) openReader(reader io.Reader, info string) (io.Reader, error) {
+	if r.key == nil {
+		return reader, nil
+	}
+	buffered := bufio.NewReader(reader)
+	nonce := make([]byte, encryptedNonceSize)
+	if _, err := io.ReadFull(buffered, nonce); err != nil {
+		return nil, fmt.Errorf("%w: truncated payload", ErrBackupDecrypt)
+	}
+	aead, err := chacha20poly1305.New(deriveKey(r.key, nonce, info))
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{reader: buffered, aead: aead, chunk: make([]byte, encryptedChunkSize+aead.Overhead())}, nil
+}
+
+// writeFileAtomic 在 tempDir 中写好内容后 rename 到 path。
+func writeFileAtomic(tempDir string, path string, content []byte) error {
+	tempFile, err := os.CreateTemp(tempDir, filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	tempPath := tempFile.Name()
+	defer os.Remove(tempPath)
+
+	_, writeErr := tempFile.Write(content)
+	closeErr := tempFile.Close()
+	if writeErr != nil {
+		return writeErr
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	return os.Rename(tempPath, path)
+}
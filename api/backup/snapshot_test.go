@@ -0,0 +1,200 @@
+package backup
+
+import (
+	"DataArk/common"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCreateSnapshotOnlyStoresChangedFiles(t *testing.T) {
+	archiveRoot := setupSnapshotEnvironment(t)
+	writeArchiveTestFile(t, archiveRoot, "example.com", "a.html", "first")
+	writeArchiveTestFile(t, archiveRoot, "example.com", "b.html", "second")
+
+	first, err := CreateSnapshot(context.Background())
+	if err != nil {
+		t.Fatalf("CreateSnapshot returned error: %v", err)
+	}
+	// 数据库快照加两个 HTML
+	if first.Parent != "" || first.FileCount != 3 || first.NewBlobs != 3 || first.DatabaseExportFile != "database.jsonl" {
+		t.Fatalf("unexpected first snapshot %+v", first.Summary())
+	}
+
+	writeArchiveTestFile(t, archiveRoot, "example.com", "c.html", "third")
+	second, err := CreateSnapshot(context.Background())
+	if err != nil {
+		t.Fatalf("CreateSnapshot returned error: %v", err)
+	}
+	if second.Parent != first.ID || second.ID == first.ID || second.FileCount != 4 {
+		t.Fatalf("unexpected second snapshot %+v", second.Summary())
+	}
+	// 只有新文件和数据库快照（多了一条创建备份的审计记录）需要写入，未变化的 HTML 复用原来的 blob
+	if second.NewBlobs != 2 {
+		t.Fatalf("second snapshot stored %d new blobs, want 2", second.NewBlobs)
+	}
+
+	// 内容与已有 blob 相同的文件不会重复保存，只有数据库快照是新的
+	writeArchiveTestFile(t, archiveRoot, "example.com", "copy.html", "first")
+	third, err := CreateSnapshot(context.Background())
+	if err != nil {
+		t.Fatalf("CreateSnapshot returned error: %v", err)
+	}
+	if third.NewBlobs != 1 || third.FileCount != 5 {
+		t.Fatalf("third snapshot stored %d new blobs for %d files, want 1 for 5", third.NewBlobs, third.FileCount)
+	}
+
+	summaries, err := ListSnapshots()
+	if err != nil || len(summaries) != 3 || summaries[0].ID != third.ID || summaries[2].ID != first.ID {
+		t.Fatalf("ListSnapshots = %+v err=%v, want newest first", summaries, err)
+	}
+}
+
+func TestRestoreSnapshotReturnsToPointInTime(t *testing.T) {
+	archiveRoot := setupSnapshotEnvironment(t)
+	writeArchiveTestFile(t, archiveRoot, "example.com", "a.html", "first")
+	first, err := CreateSnapshot(context.Background())
+	if err != nil {
+		t.Fatalf("CreateSnapshot returned error: %v", err)
+	}
+
+	writeArchiveTestFile(t, archiveRoot, "example.com", "a.html", "changed")
+	writeArchiveTestFile(t, archiveRoot, "example.com", "b.html", "second")
+	if _, err := CreateSnapshot(context.Background()); err != nil {
+		t.Fatalf("CreateSnapshot returned error: %v", err)
+	}
+	if _, err := common.CreateUserWithRole("later", "password", common.RoleViewer); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := RestoreSnapshot(context.Background(), first.ID)
+	if err != nil {
+		t.Fatalf("RestoreSnapshot returned error: %v", err)
+	}
+	if !result.DatabaseRestored || !result.ArchiveRestored || result.IndexedDocuments != 1 {
+		t.Fatalf("unexpected restore result %+v", result)
+	}
+	content, err := os.ReadFile(filepath.Join(archiveRoot, "example.com", "a.html"))
+	if err != nil || !strings.Contains(string(content), "first body") {
+		t.Fatalf("a.html = %q err=%v, want content of the first snapshot", string(content), err)
+	}
+	if _, err := os.Stat(filepath.Join(archiveRoot, "example.com", "b.html")); !os.IsNotExist(err) {
+		t.Fatalf("b.html should not exist after restoring the first snapshot, stat err = %v", err)
+	}
+	if _, err := common.GetUserByUsername("later"); err == nil {
+		t.Fatal("user created after the snapshot should be gone")
+	}
+
+	if _, err := RestoreSnapshot(context.Background(), "missing"); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Fatalf("missing snapshot err = %v, want ErrSnapshotNotFound", err)
+	}
+	if _, err := RestoreSnapshot(context.Background(), "../escape"); !errors.Is(err, ErrInvalidSnapshotID) {
+		t.Fatalf("invalid snapshot err = %v, want ErrInvalidSnapshotID", err)
+	}
+}
+
+func TestMaterializeSnapshotRejectsCorruptedBlob(t *testing.T) {
+	oldBackupDir := common.BackupDir
+	t.Cleanup(func() { common.BackupDir = oldBackupDir })
+	root := t.TempDir()
+	common.BackupDir = filepath.Join(root, "backups")
+	repository, err := openSnapshotRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := filepath.Join(root, "page.html")
+	if err := os.WriteFile(source, []byte("original"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	builder := newSnapshotBuilder(repository, nil)
+	if err := builder.addFile(source, "archive/example.com/page.html", info); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := &Snapshot{ID: repository.newID(time.Now()), Manifest: Manifest{ArchiveDir: "archive"}, Files: builder.files}
+
+	if err := os.WriteFile(repository.blobPath(snapshot.Files[0].Hash), []byte("tampered"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	err = materializeSnapshot(context.Background(), repository, snapshot, filepath.Join(root, "restore"))
+	if !errors.Is(err, ErrBlobCorrupted) {
+		t.Fatalf("materializeSnapshot err = %v, want ErrBlobCorrupted", err)
+	}
+
+	snapshot.Files[0].Path = "../escape.html"
+	if err := materializeSnapshot(context.Background(), repository, snapshot, filepath.Join(root, "restore")); err == nil {
+		t.Fatal("materializeSnapshot should reject entries outside the destination")
+	}
+}
+
+func TestSnapshotRepositoryIsEncryptedWithBackupKeys(t *testing.T) {
+	archiveRoot := setupSnapshotEnvironment(t)
+	writeArchiveTestFile(t, archiveRoot, "example.com", "a.html", "secret page")
+	keys, _ := testEncryptionKeys(t, "correct horse")
+	t.Cleanup(func() { setEncryptionKeys(nil) })
+	setEncryptionKeys(keys)
+
+	snapshot, err := CreateSnapshot(context.Background())
+	if err != nil {
+		t.Fatalf("CreateSnapshot returned error: %v", err)
+	}
+	// blob 和清单中都看不到明文，blob 的文件名也不是内容哈希
+	err = filepath.WalkDir(common.BackupDir, func(currentPath string, entry os.DirEntry, walkErr error) error {
+		if walkErr != nil || entry.IsDir() {
+			return walkErr
+		}
+		content, err := os.ReadFile(currentPath)
+		if err != nil {
+			return err
+		}
+		if strings.Contains(string(content), "secret page") || strings.Contains(string(content), "example.com/a.html") {
+			t.Errorf("%s contains plaintext", currentPath)
+		}
+		for _, file := range snapshot.Files {
+			if entry.Name() == file.Hash {
+				t.Errorf("blob %s is named after its content hash", currentPath)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeArchiveTestFile(t, archiveRoot, "example.com", "a.html", "changed")
+	if _, err := RestoreSnapshot(context.Background(), snapshot.ID); err != nil {
+		t.Fatalf("RestoreSnapshot returned error: %v", err)
+	}
+	if content, _ := os.ReadFile(filepath.Join(archiveRoot, "example.com", "a.html")); !strings.Contains(string(content), "secret page body") {
+		t.Fatalf("a.html = %q, want the encrypted snapshot restored", content)
+	}
+
+	// 没有口令和私钥时不能打开加密的仓库
+	setEncryptionKeys(nil)
+	if _, err := ListSnapshots(); !errors.Is(err, ErrSnapshotRepositoryEncrypted) {
+		t.Fatalf("ListSnapshots without keys err = %v, want ErrSnapshotRepositoryEncrypted", err)
+	}
+}
+
+func TestEncryptionRefusesUnencryptedSnapshotRepository(t *testing.T) {
+	archiveRoot := setupSnapshotEnvironment(t)
+	writeArchiveTestFile(t, archiveRoot, "example.com", "a.html", "page")
+	if _, err := CreateSnapshot(context.Background()); err != nil {
+		t.Fatalf("CreateSnapshot returned error: %v", err)
+	}
+
+	keys, _ := testEncryptionKeys(t, "correct horse")
+	t.Cleanup(func() { setEncryptionKeys(nil) })
+	setEncryptionKeys(keys)
+	if _, err := CreateSnapshot(context.Background()); !errors.Is(err, ErrSnapshotRepositoryUnencrypted) {
+		t.Fatalf("CreateSnapshot err = %v, want ErrSnapshotRepositoryUnencrypted", err)
+	}
+}
@@ -0,0 +1,371 @@
+package backup
+
+import (
+	"DataArk/common"
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+var (
+	sqlCopyPattern        = regexp.MustCompile(`(?is)^COPY\s+([^\s(]+)(?:\s*\(([^)]*)\))?\s+FROM\s+stdin\b`)
+	sqlCreateTablePattern = regexp.MustCompile(`(?is)^CREATE\s+(?:UNLOGGED\s+)?TABLE\s+(?:IF\s+NOT\s+EXISTS\s+)?([^\s(]+)`)
+	sqlInsertPattern      = regexp.MustCompile(`(?is)^INSERT\s+INTO\s+([^\s(]+)`)
+)
+
+// sqlDumpSummary pg_dump 纯文本导出的解析结果，TableRows 按 COPY 数据行或 INSERT 语句计数。
+type sqlDumpSummary struct {
+	Statements int
+	TableRows  map[string]int64
+}
+
+// parseSQLDump 不连接数据库检查 pg_dump 导出能否完整解析：引号、dollar quote 和注释必须闭合，
+// 每条语句以分号结束，COPY 数据以 \. 结束；psql 的反斜杠命令按行跳过。
+func parseSQLDump(sqlPath string) (*sqlDumpSummary, error) {
+	return scanSQLDump(sqlPath, nil)
+}
+
+// scanSQLDump 解析 SQL 导出，onCopyRow 不为空时对每一行 COPY 数据调用，fields 中的 NULL 为 nil。
+func scanSQLDump(sqlPath string, onCopyRow func(table string, columns []string, fields []*string) error) (*sqlDumpSummary, error) {
+	file, err := os.Open(sqlPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	parser := &sqlDumpParser{reader: bufio.NewReader(file), line: 1}
+	summary := &sqlDumpSummary{TableRows: make(map[string]int64)}
+	for {
+		statement, err := parser.nextStatement()
+		if errors.Is(err, io.EOF) {
+			return summary, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		summary.Statements++
+
+		switch {
+		case sqlCopyPattern.MatchString(statement):
+			match := sqlCopyPattern.FindStringSubmatch(statement)
+			table := normalizeSQLTableName(match[1])
+			var columns []string
+			for _, column := range strings.Split(match[2], ",") {
+				if column = normalizeSQLTableName(strings.TrimSpace(column)); column != "" {
+					columns = append(columns, column)
+				}
+			}
+			rows, err := parser.copyData(table, func(line string) error {
+				if onCopyRow == nil {
+					return nil
+				}
+				return onCopyRow(table, columns, decodeCopyFields(line))
+			})
+			if err != nil {
+				return nil, err
+			}
+			summary.TableRows[table] += rows
+		case sqlCreateTablePattern.MatchString(statement):
+			table := normalizeSQLTableName(sqlCreateTablePattern.FindStringSubmatch(statement)[1])
+			summary.TableRows[table] += 0
+		case sqlInsertPattern.MatchString(statement):
+			summary.TableRows[normalizeSQLTableName(sqlInsertPattern.FindStringSubmatch(statement)[1])]++
+		}
+	}
+}
+
+// parseSQLDumpArchiveOwnerships 从 SQL 导出的 archive_documents COPY 数据中读取归档归属，
+// 键与 common.ListArchiveOwnerships 相同。
+func parseSQLDumpArchiveOwnerships(sqlPath string) (map[string]common.ArchiveOwnership, error) {
+	ownerships := make(map[string]common.ArchiveOwnership)
+	_, err := scanSQLDump(sqlPath, func(table string, columns []string, fields []*string) error {
+		if table != "archive_documents" {
+			return nil
+		}
+		values := make(map[string]string, len(columns))
+		for index, column := range columns {
+			if index < len(fields) && fields[index] != nil {
+				values[column] = *fields[index]
+			}
+		}
+		ownership := common.ArchiveOwnership{Visibility: values["visibility"]}
+		ownerID, err := strconv.ParseUint(defaultString(values["owner_id"], "0"), 10, 64)
+		if err != nil {
+			return fmt.Errorf("archive_documents owner_id: %w", err)
+		}
+		teamID, err := strconv.ParseUint(defaultString(values["team_id"], "0"), 10, 64)
+		if err != nil {
+			return fmt.Errorf("archive_documents team_id: %w", err)
+		}
+		ownership.OwnerID, ownership.TeamID = uint(ownerID), uint(teamID)
+		if ownership.Visibility == "" {
+			ownership.Visibility = common.PublicArchiveOwnership().Visibility
+		}
+		ownerships[common.ArchiveDocumentKey(values["domain"], values["filename"])] = ownership
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ownerships, nil
+}
+
+func defaultString(value string, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+// decodeCopyFields 按 COPY 文本格式拆分一行数据：字段以制表符分隔，\N 表示 NULL，反斜杠转义特殊字符。
+func decodeCopyFields(line string) []*string {
+	line = strings.TrimRight(line, "\r\n")
+	rawFields := strings.Split(line, "\t")
+	fields := make([]*string, len(rawFields))
+	for index, raw := range rawFields {
+		if raw == `\N` {
+			continue
+		}
+		var value strings.Builder
+		for position := 0; position < len(raw); position++ {
+			if raw[position] != '\\' || position+1 == len(raw) {
+				value.WriteByte(raw[position])
+				continue
+			}
+			position++
+			switch raw[position] {
+			case 't':
+				value.WriteByte('\t')
+			case 'n':
+				value.WriteByte('\n')
+			case 'r':
+				value.WriteByte('\r')
+			default:
+				value.WriteByte(raw[position])
+			}
+		}
+		decoded := value.String()
+		fields[index] = &decoded
+	}
+	return fields
+}
+
+// normalizeSQLTableName 去掉引号和默认的 public 模式，与当前数据库中的表名一致。
+func normalizeSQLTableName(name string) string {
+	name = strings.ReplaceAll(name, `"`, "")
+	return strings.TrimPrefix(name, "public.")
+}
+
+type sqlDumpParser struct {
+	reader *bufio.Reader
+	line   int
+}
+
+func (p *sqlDumpParser) readRune() (rune, error) {
+	r, _, err := p.reader.ReadRune()
+	if r == '\n' {
+		p.line++
+	}
+	return r, err
+}
+
+func (p *sqlDumpParser) peekRune() rune {
+	r, _, err := p.reader.ReadRune()
+	if err != nil {
+		return 0
+	}
+	_ = p.reader.UnreadRune()
+	return r
+}
+
+func (p *sqlDumpParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("sql dump line %d: %s", p.line, fmt.Sprintf(format, args...))
+}
+
+// nextStatement 返回下一条以分号结束的语句（不含分号），没有更多语句时返回 io.EOF。
+func (p *sqlDumpParser) nextStatement() (string, error) {
+	var statement strings.Builder
+	for {
+		r, err := p.readRune()
+		if errors.Is(err, io.EOF) {
+			if strings.TrimSpace(statement.String()) != "" {
+				return "", p.errorf("statement is not terminated by a semicolon")
+			}
+			return "", io.EOF
+		}
+		if err != nil {
+			return "", err
+		}
+
+		switch {
+		case r == '\\' && strings.TrimSpace(statement.String()) == "":
+			// psql 反斜杠命令，例如 \connect 或新版 pg_dump 的 \restrict
+			if _, err := p.reader.ReadString('\n'); err != nil && !errors.Is(err, io.EOF) {
+				return "", err
+			}
+			p.line++
+			statement.Reset()
+			continue
+		case r == ';':
+			return strings.TrimSpace(statement.String()), nil
+		case r == '-' && p.peekRune() == '-':
+			if _, err := p.reader.ReadString('\n'); err != nil && !errors.Is(err, io.EOF) {
+				return "", err
+			}
+			p.line++
+			statement.WriteRune('\n')
+			continue
+		case r == '/' && p.peekRune() == '*':
+			if err := p.skipBlockComment(); err != nil {
+				return "", err
+			}
+			statement.WriteRune(' ')
+			continue
+		}
+
+		statement.WriteRune(r)
+		switch {
+		case r == '\'':
+			escapes := isEscapeStringPrefix(statement.String())
+			if err := p.copyQuoted(&statement, '\'', escapes); err != nil {
+				return "", err
+			}
+		case r == '"':
+			if err := p.copyQuoted(&statement, '"', false); err != nil {
+				return "", err
+			}
+		case r == '$':
+			if err := p.copyDollarQuoted(&statement); err != nil {
+				return "", err
+			}
+		}
+	}
+}
+
+// isEscapeStringPrefix 判断刚写入的单引号前是否是 E'...' 字符串的前缀。
+func isEscapeStringPrefix(text string) bool {
+	runes := []rune(text)
+	if len(runes) < 2 || (runes[len(runes)-2] != 'E' && runes[len(runes)-2] != 'e') {
+		return false
+	}
+	return len(runes) == 2 || !isSQLIdentifierRune(runes[len(runes)-3])
+}
+
+func isSQLIdentifierRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func (p *sqlDumpParser) copyQuoted(statement *strings.Builder, quote rune, backslashEscapes bool) error {
+	for {
+		r, err := p.readRune()
+		if err != nil {
+			return p.errorf("unterminated %c quoted text", quote)
+		}
+		statement.WriteRune(r)
+		if backslashEscapes && r == '\\' {
+			next, err := p.readRune()
+			if err != nil {
+				return p.errorf("unterminated %c quoted text", quote)
+			}
+			statement.WriteRune(next)
+			continue
+		}
+		if r == quote {
+			// 连续两个引号是转义
+			if p.peekRune() == quote {
+				next, _ := p.readRune()
+				statement.WriteRune(next)
+				continue
+			}
+			return nil
+		}
+	}
+}
+
+// copyDollarQuoted 处理 $tag$...$tag$，$ 后不是合法标签时按普通字符处理（例如 $1 参数）。
+func (p *sqlDumpParser) copyDollarQuoted(statement *strings.Builder) error {
+	var tag strings.Builder
+	for {
+		r := p.peekRune()
+		if r == '$' {
+			p.readRune()
+			break
+		}
+		if !isSQLIdentifierRune(r) || (tag.Len() == 0 && unicode.IsDigit(r)) {
+			statement.WriteString(tag.String())
+			return nil
+		}
+		p.readRune()
+		tag.WriteRune(r)
+	}
+	delimiter := "$" + tag.String() + "$"
+	statement.WriteString(delimiter[1:])
+
+	var body strings.Builder
+	for {
+		r, err := p.readRune()
+		if err != nil {
+			return p.errorf("unterminated dollar quoted text %s", delimiter)
+		}
+		body.WriteRune(r)
+		if r == '$' && strings.HasSuffix(body.String(), delimiter) {
+			statement.WriteString(body.String())
+			return nil
+		}
+	}
+}
+
+func (p *sqlDumpParser) skipBlockComment() error {
+	p.readRune()
+	depth := 1
+	var previous rune
+	for depth > 0 {
+		r, err := p.readRune()
+		if err != nil {
+			return p.errorf("unterminated block comment")
+		}
+		switch {
+		case previous == '/' && r == '*':
+			depth++
+			r = 0
+		case previous == '*' && r == '/':
+			depth--
+			r = 0
+		}
+		previous = r
+	}
+	return nil
+}
+
+// copyData 读取 COPY ... FROM stdin 之后的数据行，直到单独一行的 \.。
+func (p *sqlDumpParser) copyData(table string, onRow func(line string) error) (int64, error) {
+	// 分号之后到行尾的内容属于语句本身
+	if _, err := p.reader.ReadString('\n'); err != nil {
+		return 0, p.errorf("COPY data for %s is missing", table)
+	}
+	p.line++
+	var rows int64
+	for {
+		line, err := p.reader.ReadString('\n')
+		if err != nil && line == "" {
+			return 0, p.errorf("COPY data for %s is not terminated by \\.", table)
+		}
+		p.line++
+		if strings.TrimRight(line, "\r\n") == `\.` {
+			return rows, nil
+		}
+		if err != nil {
+			return 0, p.errorf("COPY data for %s is not terminated by \\.", table)
+		}
+		if err := onRow(line); err != nil {
+			return 0, p.errorf("%v", err)
+		}
+		rows++
+	}
+}
@@ -0,0 +1,72 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testPGDump = `--
+-- PostgreSQL database dump
+--
+
+\restrict abc123
+SET statement_timeout = 0;
+SELECT pg_catalog.set_config('search_path', '', false);
+DROP TABLE IF EXISTS public.users;
+/* block /* nested */ comment; */
+CREATE TABLE public.users (
+    id bigint NOT NULL,
+    name text DEFAULT 'it''s; fine'::text
+);
+CREATE TABLE public."archive_stats" (domain text);
+CREATE FUNCTION public.touch() RETURNS trigger AS $body$
+BEGIN
+  NEW.note := 'semicolon; inside';
+  RETURN NEW;
+END;
+$body$ LANGUAGE plpgsql;
+COPY public.users (id, name) FROM stdin;
+1	alice
+2	bob; with semicolon
+\.
+INSERT INTO public.archive_stats VALUES (E'a\'b;c');
+`
+
+func writeTestSQLDump(t *testing.T, content string) string {
+	t.Helper()
+	sqlPath := filepath.Join(t.TempDir(), "database.sql")
+	if err := os.WriteFile(sqlPath, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return sqlPath
+}
+
+func TestParseSQLDump(t *testing.T) {
+	summary, err := parseSQLDump(writeTestSQLDump(t, testPGDump))
+	if err != nil {
+		t.Fatalf("parseSQLDump returned error: %v", err)
+	}
+	if summary.Statements != 8 {
+		t.Fatalf("statements = %d, want 8", summary.Statements)
+	}
+	if summary.TableRows["users"] != 2 || summary.TableRows["archive_stats"] != 1 || len(summary.TableRows) != 2 {
+		t.Fatalf("table rows = %v, want users=2 archive_stats=1", summary.TableRows)
+	}
+}
+
+func TestParseSQLDumpRejectsTruncatedDumps(t *testing.T) {
+	for name, content := range map[string]string{
+		"missing semicolon":    "CREATE TABLE users (id bigint)",
+		"unterminated quote":   "INSERT INTO users VALUES ('alice);\n",
+		"unterminated dollar":  "CREATE FUNCTION f() RETURNS void AS $$ BEGIN; END;\n",
+		"unterminated comment": "/* comment\nSELECT 1;\n",
+		"unterminated copy":    "COPY public.users (id) FROM stdin;\n1\n2\n",
+	} {
+		_, err := parseSQLDump(writeTestSQLDump(t, content))
+		if err == nil || !strings.Contains(err.Error(), "sql dump line") {
+			t.Fatalf("%s: err = %v, want sql dump parse error", name, err)
+		}
+	}
+}
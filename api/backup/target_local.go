@@ -0,0 +1,103 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// localTarget 本机目录，通常是挂载的 NAS 或另一块磁盘。
+type localTarget struct {
+	dir string
+}
+
+func newLocalTarget(u *url.URL) (*localTarget, error) {
+	if u.Host != "" && u.Host != "localhost" {
+		return nil, fmt.Errorf("%w: file target must be a local path, got host %q", ErrInvalidBackupTarget, u.Host)
+	}
+	if !filepath.IsAbs(u.Path) {
+		return nil, fmt.Errorf("%w: file target needs an absolute path", ErrInvalidBackupTarget)
+	}
+	return &localTarget{dir: filepath.Clean(u.Path)}, nil
+}
+
+func (t *localTarget) Put(ctx context.Context, name string, body io.ReaderAt, size int64) error {
+	if err := os.MkdirAll(t.dir, 0o755); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(t.dir, ".upload-*")
+	if err != nil {
+		return err
+	}
+	tempPath := file.Name()
+	defer os.Remove(tempPath)
+
+	if _, err := io.Copy(file, &contextReader{ctx: ctx, reader: io.NewSectionReader(body, 0, size)}); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, filepath.Join(t.dir, name))
+}
+
+func (t *localTarget) Get(_ context.Context, name string) (io.ReadCloser, error) {
+	file, err := os.Open(filepath.Join(t.dir, name))
+	if os.IsNotExist(err) {
+		return nil, ErrBackupObjectNotFound
+	}
+	return file, err
+}
+
+func (t *localTarget) List(_ context.Context) ([]TargetObject, error) {
+	entries, err := os.ReadDir(t.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	objects := make([]TargetObject, 0, len(entries))
+	for _, entry := range entries {
+		// 以 . 开头的是写入中的临时文件
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, TargetObject{Name: entry.Name(), Size: info.Size(), ModTime: info.ModTime()})
+	}
+	return objects, nil
+}
+
+func (t *localTarget) Delete(_ context.Context, name string) error {
+	err := os.Remove(filepath.Join(t.dir, name))
+	if os.IsNotExist(err) {
+		return ErrBackupObjectNotFound
+	}
+	return err
+}
+
+// contextReader 在每次读取前检查 ctx，让大文件的上传可以被取消。
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.reader.Read(p)
+}
@@ -0,0 +1,145 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+const (
+	s3DefaultRegion = "us-east-1"
+	// s3PartSize 超过该大小的备份使用分段上传，单个 PUT 最大只能 5 GiB
+	s3PartSize = 64 << 20
+)
+
+// s3Target S3 兼容的对象存储，包括 AWS S3、MinIO、Ceph RGW 等，请求签名和分段上传由 minio-go 完成。
+// 指定 endpoint 时使用路径风格（endpoint/bucket/key），这是自建存储普遍支持的方式；
+// 否则访问 AWS 的 bucket.s3.region.amazonaws.com。
+type s3Target struct {
+	client   *minio.Client
+	bucket   string
+	prefix   string
+	partSize uint64
+}
+
+func newS3Target(u *url.URL) (*s3Target, error) {
+	query := u.Query()
+	target := &s3Target{
+		bucket:   u.Host,
+		prefix:   strings.Trim(u.Path, "/"),
+		partSize: s3PartSize,
+	}
+	if target.bucket == "" {
+		return nil, fmt.Errorf("%w: s3 target needs a bucket, e.g. s3://bucket/prefix", ErrInvalidBackupTarget)
+	}
+	region := query.Get("region")
+	if region == "" {
+		region = s3DefaultRegion
+	}
+
+	options := &minio.Options{Region: region, Secure: true, BucketLookup: minio.BucketLookupDNS}
+	host := "s3." + region + ".amazonaws.com"
+	if endpoint := query.Get("endpoint"); endpoint != "" {
+		parsed, err := url.Parse(endpoint)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return nil, fmt.Errorf("%w: invalid s3 endpoint %q", ErrInvalidBackupTarget, endpoint)
+		}
+		host = parsed.Host
+		options.Secure = parsed.Scheme == "https"
+		options.BucketLookup = minio.BucketLookupPath
+	}
+
+	var accessKey, secretKey string
+	if u.User != nil {
+		accessKey = u.User.Username()
+		secretKey, _ = u.User.Password()
+	} else {
+		accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if accessKey == "" || secretKey == "" {
+		return nil, fmt.Errorf("%w: s3 target needs an access key and secret key", ErrInvalidBackupTarget)
+	}
+	options.Creds = credentials.NewStaticV4(accessKey, secretKey, "")
+
+	client, err := minio.New(host, options)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidBackupTarget, err)
+	}
+	target.client = client
+	return target, nil
+}
+
+func (t *s3Target) objectKey(name string) string {
+	if t.prefix == "" {
+		return name
+	}
+	return t.prefix + "/" + name
+}
+
+// Put 上传备份，超过分段大小时分段上传，失败时 minio-go 会放弃已上传的分段。
+func (t *s3Target) Put(ctx context.Context, name string, body io.ReaderAt, size int64) error {
+	_, err := t.client.PutObject(ctx, t.bucket, t.objectKey(name), io.NewSectionReader(body, 0, size), size, minio.PutObjectOptions{
+		ContentType: "application/zip",
+		PartSize:    t.partSize,
+	})
+	if err != nil {
+		return s3Error("put", name, err)
+	}
+	return nil
+}
+
+func (t *s3Target) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	object, err := t.client.GetObject(ctx, t.bucket, t.objectKey(name), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, s3Error("get", name, err)
+	}
+	// GetObject 在第一次读取时才发出请求，先取一次对象信息确认备份存在
+	if _, err := object.Stat(); err != nil {
+		object.Close()
+		return nil, s3Error("get", name, err)
+	}
+	return object, nil
+}
+
+func (t *s3Target) List(ctx context.Context) ([]TargetObject, error) {
+	prefix := ""
+	if t.prefix != "" {
+		prefix = t.prefix + "/"
+	}
+	var objects []TargetObject
+	for object := range t.client.ListObjects(ctx, t.bucket, minio.ListObjectsOptions{Prefix: prefix}) {
+		if object.Err != nil {
+			return nil, s3Error("list", prefix, object.Err)
+		}
+		name := strings.TrimPrefix(object.Key, prefix)
+		if name == "" || strings.Contains(name, "/") {
+			continue
+		}
+		objects = append(objects, TargetObject{Name: name, Size: object.Size, ModTime: object.LastModified})
+	}
+	return objects, nil
+}
+
+func (t *s3Target) Delete(ctx context.Context, name string) error {
+	if err := t.client.RemoveObject(ctx, t.bucket, t.objectKey(name), minio.RemoveObjectOptions{}); err != nil {
+		return s3Error("delete", name, err)
+	}
+	return nil
+}
+
+// s3Error 把对象不存在转换为 ErrBackupObjectNotFound，其它错误带上操作和备份名。
+func s3Error(operation string, name string, err error) error {
+	response := minio.ToErrorResponse(err)
+	if response.Code == "NoSuchKey" || (response.StatusCode == http.StatusNotFound && response.Code != "NoSuchBucket") {
+		return ErrBackupObjectNotFound
+	}
+	return fmt.Errorf("s3 %s %s: %w", operation, name, err)
+}
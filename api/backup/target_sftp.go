@@ -0,0 +1,237 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const sftpDialTimeout = 30 * time.Second
+
+// sftpTarget 通过 SSH 的 sftp 子系统访问远端目录，每次操作建立一个连接。
+// 必须用 knownhosts 或 hostkey 校验服务器公钥，不接受未校验的主机。
+type sftpTarget struct {
+	dir     string
+	connect func(ctx context.Context) (*sftpConnection, error)
+}
+
+func newSFTPTarget(u *url.URL) (*sftpTarget, error) {
+	query := u.Query()
+	if u.Hostname() == "" || u.User == nil || u.User.Username() == "" {
+		return nil, fmt.Errorf("%w: sftp target needs user and host, e.g. sftp://backup@nas/dataark", ErrInvalidBackupTarget)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "22")
+	}
+
+	var auth []ssh.AuthMethod
+	if keyFile := query.Get("key"); keyFile != "" {
+		content, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("%w: read sftp key: %v", ErrInvalidBackupTarget, err)
+		}
+		signer, err := ssh.ParsePrivateKey(content)
+		if err != nil {
+			return nil, fmt.Errorf("%w: parse sftp key: %v", ErrInvalidBackupTarget, err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if password, ok := u.User.Password(); ok {
+		auth = append(auth, ssh.Password(password))
+	}
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("%w: sftp target needs key= or a password", ErrInvalidBackupTarget)
+	}
+
+	var hostKeyCallback ssh.HostKeyCallback
+	switch {
+	case query.Get("knownhosts") != "":
+		callback, err := knownhosts.New(query.Get("knownhosts"))
+		if err != nil {
+			return nil, fmt.Errorf("%w: read known_hosts: %v", ErrInvalidBackupTarget, err)
+		}
+		hostKeyCallback = callback
+	case query.Get("hostkey") != "":
+		fingerprint := query.Get("hostkey")
+		hostKeyCallback = func(_ string, _ net.Addr, key ssh.PublicKey) error {
+			if ssh.FingerprintSHA256(key) != fingerprint {
+				return fmt.Errorf("sftp host key %s does not match %s", ssh.FingerprintSHA256(key), fingerprint)
+			}
+			return nil
+		}
+	default:
+		return nil, fmt.Errorf("%w: sftp target needs knownhosts= or hostkey= to verify the server", ErrInvalidBackupTarget)
+	}
+
+	config := &ssh.ClientConfig{
+		User:            u.User.Username(),
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         sftpDialTimeout,
+	}
+	dir := u.Path
+	if dir == "" {
+		dir = "."
+	}
+	return &sftpTarget{
+		dir:     path.Clean(dir),
+		connect: func(ctx context.Context) (*sftpConnection, error) { return dialSFTP(ctx, addr, config) },
+	}, nil
+}
+
+func dialSFTP(ctx context.Context, addr string, config *ssh.ClientConfig) (*sftpConnection, error) {
+	dialer := net.Dialer{Timeout: sftpDialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	sshConn, channels, requests, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	client := ssh.NewClient(sshConn, channels, requests)
+	sftpClient, err := sftp.NewClient(client, sftp.UseConcurrentWrites(true))
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &sftpConnection{Client: sftpClient, transport: client}, nil
+}
+
+// sftpConnection 是一次 sftp 会话，关闭时同时关闭底层的 SSH 连接。
+type sftpConnection struct {
+	*sftp.Client
+	transport io.Closer
+}
+
+func (c *sftpConnection) Close() error {
+	err := c.Client.Close()
+	if c.transport != nil {
+		if closeErr := c.transport.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// withClient 建立连接执行 fn，ctx 取消时关闭连接让阻塞的请求返回。
+func (t *sftpTarget) withClient(ctx context.Context, fn func(*sftpConnection) error) error {
+	client, err := t.connect(ctx)
+	if err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() { client.Close() })
+	defer stop()
+	defer client.Close()
+	if err := fn(client); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		return err
+	}
+	return nil
+}
+
+func (t *sftpTarget) Put(ctx context.Context, name string, body io.ReaderAt, size int64) error {
+	return t.withClient(ctx, func(client *sftpConnection) error {
+		if err := client.MkdirAll(t.dir); err != nil {
+			return err
+		}
+		finalPath := path.Join(t.dir, name)
+		tempPath := path.Join(t.dir, "."+name+".upload")
+		file, err := client.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+		if err != nil {
+			return err
+		}
+		// 传入带 Size 的 reader，sftp 按偏移并发写入多个分块
+		if _, err := file.ReadFrom(io.NewSectionReader(body, 0, size)); err != nil {
+			file.Close()
+			return err
+		}
+		if err := file.Close(); err != nil {
+			return err
+		}
+		if _, ok := client.HasExtension("posix-rename@openssh.com"); ok {
+			return client.PosixRename(tempPath, finalPath)
+		}
+		// SFTP 第 3 版的 rename 不覆盖已有文件
+		if err := client.Remove(finalPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return client.Rename(tempPath, finalPath)
+	})
+}
+
+func (t *sftpTarget) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	client, err := t.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	file, err := client.Open(path.Join(t.dir, name))
+	if err != nil {
+		client.Close()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrBackupObjectNotFound
+		}
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() { client.Close() })
+	return &sftpFileReader{File: file, client: client, stop: stop}, nil
+}
+
+func (t *sftpTarget) List(ctx context.Context) ([]TargetObject, error) {
+	var objects []TargetObject
+	err := t.withClient(ctx, func(client *sftpConnection) error {
+		entries, err := client.ReadDir(t.dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if entry.Mode().IsRegular() && !strings.HasPrefix(entry.Name(), ".") {
+				objects = append(objects, TargetObject{Name: entry.Name(), Size: entry.Size(), ModTime: entry.ModTime()})
+			}
+		}
+		return nil
+	})
+	return objects, err
+}
+
+func (t *sftpTarget) Delete(ctx context.Context, name string) error {
+	return t.withClient(ctx, func(client *sftpConnection) error {
+		err := client.Remove(path.Join(t.dir, name))
+		if errors.Is(err, fs.ErrNotExist) {
+			return ErrBackupObjectNotFound
+		}
+		return err
+	})
+}
+
+// sftpFileReader 读取远端文件，关闭时一并关闭连接。
+type sftpFileReader struct {
+	*sftp.File
+	client *sftpConnection
+	stop   func() bool
+}
+
+func (r *sftpFileReader) Close() error {
+	r.stop()
+	_ = r.File.Close()
+	return r.client.Close()
+}
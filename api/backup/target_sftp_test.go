@@ -0,0 +1,96 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+// pipeConn 把两端管道组合成 sftp 服务端需要的 io.ReadWriteCloser。
+type pipeConn struct {
+	io.Reader
+	io.WriteCloser
+}
+
+func (c pipeConn) Close() error {
+	return c.WriteCloser.Close()
+}
+
+// newFakeSFTPTarget 返回连接到进程内 sftp 服务端的备份目标，远端目录是本地临时目录下的 dir。
+func newFakeSFTPTarget(t *testing.T, dir string) (*sftpTarget, string) {
+	root := t.TempDir()
+	target := &sftpTarget{
+		dir: filepath.ToSlash(filepath.Join(root, dir)),
+		connect: func(context.Context) (*sftpConnection, error) {
+			clientReader, serverWriter := io.Pipe()
+			serverReader, clientWriter := io.Pipe()
+			server, err := sftp.NewServer(pipeConn{Reader: serverReader, WriteCloser: serverWriter})
+			if err != nil {
+				return nil, err
+			}
+			// 客户端关闭后服务端读到 EOF，关闭自己的一端让客户端的接收循环退出
+			go func() {
+				server.Serve()
+				server.Close()
+			}()
+			client, err := sftp.NewClientPipe(clientReader, clientWriter, sftp.UseConcurrentWrites(true))
+			if err != nil {
+				return nil, err
+			}
+			return &sftpConnection{Client: client}, nil
+		},
+	}
+	return target, root
+}
+
+func TestSFTPTarget(t *testing.T) {
+	target, root := newFakeSFTPTarget(t, "/backups/dataark")
+	ctx := context.Background()
+
+	if objects, err := target.List(ctx); err != nil || len(objects) != 0 {
+		t.Fatalf("List of missing dir = %v err=%v, want empty", objects, err)
+	}
+	// 大于多个分块，确认并发写入后内容完整
+	content := strings.Repeat("0123456789", 32<<10)
+	body := strings.NewReader(content)
+	if err := target.Put(ctx, "a.zip", body, body.Size()); err != nil {
+		t.Fatalf("Put returned error: %v", err)
+	}
+	// 覆盖已有备份
+	if err := target.Put(ctx, "a.zip", body, body.Size()); err != nil {
+		t.Fatalf("second Put returned error: %v", err)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(root, "backups", "dataark")); len(entries) != 1 {
+		t.Fatalf("remote dir has %d entries, want only a.zip", len(entries))
+	}
+
+	objects, err := target.List(ctx)
+	if err != nil || len(objects) != 1 || objects[0].Name != "a.zip" || objects[0].Size != int64(len(content)) {
+		t.Fatalf("List = %+v err=%v", objects, err)
+	}
+	reader, err := target.Get(ctx, "a.zip")
+	if err != nil {
+		t.Fatalf("Get returned error: %v", err)
+	}
+	downloaded, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil || string(downloaded) != content {
+		t.Fatalf("Get returned %d bytes err=%v, want %d bytes", len(downloaded), err, len(content))
+	}
+
+	if _, err := target.Get(ctx, "missing.zip"); !errors.Is(err, ErrBackupObjectNotFound) {
+		t.Fatalf("Get missing err = %v, want ErrBackupObjectNotFound", err)
+	}
+	if err := target.Delete(ctx, "a.zip"); err != nil {
+		t.Fatalf("Delete returned error: %v", err)
+	}
+	if err := target.Delete(ctx, "a.zip"); !errors.Is(err, ErrBackupObjectNotFound) {
+		t.Fatalf("Delete twice err = %v, want ErrBackupObjectNotFound", err)
+	}
+}
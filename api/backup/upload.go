@@ -0,0 +1,267 @@
+package backup
+
+import (
+	"DataArk/common"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	backupUploadDir      = "uploads"
+	backupUploadInfoFile = "upload.json"
+	// backupUploadTTL 之内没有收到新数据的上传视为放弃，创建新上传和启动服务时清理。
+	backupUploadTTL = 24 * time.Hour
+)
+
+var (
+	ErrBackupUploadNotFound   = errors.New("backup upload not found")
+	ErrInvalidBackupUpload    = errors.New("invalid backup upload")
+	ErrBackupUploadOffset     = errors.New("backup upload offset does not match")
+	ErrBackupUploadBusy       = errors.New("backup upload is receiving another chunk")
+	ErrBackupUploadIncomplete = errors.New("backup upload is not complete")
+)
+
+// BackupUpload 是分块上传中的备份 zip，文件直接写入 -backupdir 下的 uploads 目录，不经过系统临时目录。
+// Offset 为已经收到的字节数，连接中断后从 Offset 继续上传。
+type BackupUpload struct {
+	ID        string    `json:"id"`
+	FileName  string    `json:"fileName"`
+	Size      int64     `json:"size"`
+	Offset    int64     `json:"offset"`
+	CreatedBy string    `json:"createdBy,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+var (
+	uploadsMu   sync.Mutex
+	busyUploads = make(map[string]bool)
+)
+
+// CreateBackupUpload 登记一个 size 字节的上传，之后用 WriteBackupUpload 按顺序写入数据。
+// size 不能超过 -backupuploadmax，避免声明一个极大的上传占满 -backupdir 所在的磁盘。
+func CreateBackupUpload(ctx context.Context, fileName string, size int64) (*BackupUpload, error) {
+	fileName = strings.TrimSpace(fileName)
+	if fileName == "" || fileName != filepath.Base(fileName) || !strings.EqualFold(filepath.Ext(fileName), ".zip") {
+		return nil, fmt.Errorf("%w: file name must be a .zip file name", ErrInvalidBackupUpload)
+	}
+	if size <= 0 {
+		return nil, fmt.Errorf("%w: size must be positive", ErrInvalidBackupUpload)
+	}
+	if maxMB := common.BackupUploadMaxMB; maxMB > 0 && size > maxMB<<20 {
+		return nil, fmt.Errorf("%w: size exceeds the upload limit of %d MiB", ErrInvalidBackupUpload, maxMB)
+	}
+	pruneBackupUploads()
+
+	upload := &BackupUpload{
+		ID:        uuid.NewString(),
+		FileName:  fileName,
+		Size:      size,
+		CreatedBy: common.AuditActorFromContext(ctx).Username,
+		CreatedAt: time.Now(),
+	}
+	dir, err := backupUploadPath(upload.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	if err := writeJSON(filepath.Join(dir, backupUploadInfoFile), upload); err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, fileName), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, err
+	}
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
+	upload.ExpiresAt = upload.CreatedAt.Add(backupUploadTTL)
+	return upload, nil
+}
+
+// GetBackupUpload 返回上传的当前进度，Offset 以磁盘上实际写入的字节数为准。
+func GetBackupUpload(id string) (*BackupUpload, error) {
+	upload, _, err := loadBackupUpload(id)
+	return upload, err
+}
+
+// WriteBackupUpload 把 r 中的数据追加到上传文件，offset 必须等于已经收到的字节数。
+// 连接中断时已经写入的部分保留，返回的上传记录中 Offset 为新的续传位置；超出声明大小的数据会被拒绝。
+func WriteBackupUpload(ctx context.Context, id string, offset int64, r io.Reader) (*BackupUpload, error) {
+	if err := lockBackupUpload(id); err != nil {
+		return nil, err
+	}
+	defer unlockBackupUpload(id)
+
+	upload, dataPath, err := loadBackupUpload(id)
+	if err != nil {
+		return nil, err
+	}
+	if offset != upload.Offset {
+		return upload, fmt.Errorf("%w: expected %d, got %d", ErrBackupUploadOffset, upload.Offset, offset)
+	}
+
+	file, err := os.OpenFile(dataPath, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	written, copyErr := copyWithContext(ctx, file, io.LimitReader(r, upload.Size-upload.Offset))
+	if copyErr == nil {
+		var extra [1]byte
+		if n, _ := r.Read(extra[:]); n > 0 {
+			copyErr = fmt.Errorf("%w: data exceeds the declared size %d", ErrInvalidBackupUpload, upload.Size)
+		}
+	}
+	if err := file.Sync(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	if err := file.Close(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	upload.Offset += written
+	upload.ExpiresAt = time.Now().Add(backupUploadTTL)
+	return upload, copyErr
+}
+
+// DeleteBackupUpload 放弃上传并删除已经收到的数据。
+func DeleteBackupUpload(id string) error {
+	if err := lockBackupUpload(id); err != nil {
+		return err
+	}
+	defer unlockBackupUpload(id)
+
+	if _, _, err := loadBackupUpload(id); err != nil {
+		return err
+	}
+	dir, err := backupUploadPath(id)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// StartUploadedRestoreJob 用上传完成的备份启动恢复任务。上传目录和任务目录都在 -backupdir 下，文件只改名不复制。
+func StartUploadedRestoreJob(ctx context.Context, id string, options RestoreOptions) (*common.BackupJob, error) {
+	if err := lockBackupUpload(id); err != nil {
+		return nil, err
+	}
+	defer unlockBackupUpload(id)
+
+	upload, dataPath, err := loadBackupUpload(id)
+	if err != nil {
+		return nil, err
+	}
+	if upload.Offset != upload.Size {
+		return nil, fmt.Errorf("%w: received %d of %d bytes", ErrBackupUploadIncomplete, upload.Offset, upload.Size)
+	}
+	job, err := StartRestoreJob(ctx, dataPath, options)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.RemoveAll(filepath.Dir(dataPath)); err != nil {
+		log.Printf("failed to remove backup upload %s: %v", id, err)
+	}
+	return job, nil
+}
+
+// loadBackupUpload 读取上传记录并返回数据文件路径。
+func loadBackupUpload(id string) (*BackupUpload, string, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, "", ErrBackupUploadNotFound
+	}
+	dir, err := backupUploadPath(id)
+	if err != nil {
+		return nil, "", err
+	}
+	content, err := os.ReadFile(filepath.Join(dir, backupUploadInfoFile))
+	if os.IsNotExist(err) {
+		return nil, "", ErrBackupUploadNotFound
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	var upload BackupUpload
+	if err := json.Unmarshal(content, &upload); err != nil {
+		return nil, "", fmt.Errorf("read backup upload %s: %w", id, err)
+	}
+	if upload.ID != id || upload.FileName != filepath.Base(upload.FileName) {
+		return nil, "", fmt.Errorf("read backup upload %s: invalid upload record", id)
+	}
+
+	dataPath := filepath.Join(dir, upload.FileName)
+	info, err := os.Stat(dataPath)
+	if os.IsNotExist(err) {
+		return nil, "", ErrBackupUploadNotFound
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	upload.Offset = info.Size()
+	upload.ExpiresAt = info.ModTime().Add(backupUploadTTL)
+	return &upload, dataPath, nil
+}
+
+// pruneBackupUploads 删除超过 backupUploadTTL 没有收到数据的上传，正在写入的上传跳过。
+func pruneBackupUploads() {
+	root, err := backupUploadPath("")
+	if err != nil {
+		return
+	}
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	for _, entry := range entries {
+		id := entry.Name()
+		if lockBackupUpload(id) != nil {
+			continue
+		}
+		upload, _, err := loadBackupUpload(id)
+		if errors.Is(err, ErrBackupUploadNotFound) || err == nil && now.After(upload.ExpiresAt) {
+			if err := os.RemoveAll(filepath.Join(root, id)); err != nil {
+				log.Printf("failed to remove expired backup upload %s: %v", id, err)
+			}
+		}
+		unlockBackupUpload(id)
+	}
+}
+
+func lockBackupUpload(id string) error {
+	uploadsMu.Lock()
+	defer uploadsMu.Unlock()
+	if busyUploads[id] {
+		return ErrBackupUploadBusy
+	}
+	busyUploads[id] = true
+	return nil
+}
+
+func unlockBackupUpload(id string) {
+	uploadsMu.Lock()
+	defer uploadsMu.Unlock()
+	delete(busyUploads, id)
+}
+
+func backupUploadPath(id string) (string, error) {
+	root := strings.TrimSpace(common.BackupDir)
+	if root == "" {
+		return "", errors.New("backup directory is empty")
+	}
+	return filepath.Join(filepath.Clean(root), backupUploadDir, id), nil
+}
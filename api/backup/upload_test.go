@@ -0,0 +1,164 @@
+package backup
+
+import (
+	"DataArk/common"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// interruptedReader 读出 data 后返回错误，模拟上传中途断开的连接。
+type interruptedReader struct {
+	data []byte
+}
+
+func (r *interruptedReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestBackupUploadResumesAndStartsRestore(t *testing.T) {
+	archiveRoot := setupSnapshotEnvironment(t)
+	writeArchiveTestFile(t, archiveRoot, "example.com", "a.html", "original")
+	zipPath := filepath.Join(t.TempDir(), "backup.zip")
+	writeTestBackupZip(t, zipPath)
+	content, err := os.ReadFile(zipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeArchiveTestFile(t, archiveRoot, "example.com", "a.html", "changed")
+
+	for _, name := range []string{"", "backup.tar", "../backup.zip"} {
+		if _, err := CreateBackupUpload(context.Background(), name, 10); !errors.Is(err, ErrInvalidBackupUpload) {
+			t.Fatalf("CreateBackupUpload(%q) error = %v, want ErrInvalidBackupUpload", name, err)
+		}
+	}
+	upload, err := CreateBackupUpload(context.Background(), "dataark-backup.zip", int64(len(content)))
+	if err != nil {
+		t.Fatalf("CreateBackupUpload returned error: %v", err)
+	}
+
+	half := int64(len(content) / 2)
+	upload, err = WriteBackupUpload(context.Background(), upload.ID, 0, &interruptedReader{data: content[:half]})
+	if err == nil || upload.Offset != half {
+		t.Fatalf("interrupted chunk = %+v, %v", upload, err)
+	}
+	if current, err := GetBackupUpload(upload.ID); err != nil || current.Offset != half {
+		t.Fatalf("GetBackupUpload = %+v, %v", current, err)
+	}
+	if _, err := WriteBackupUpload(context.Background(), upload.ID, 0, bytes.NewReader(content)); !errors.Is(err, ErrBackupUploadOffset) {
+		t.Fatalf("write at a stale offset error = %v, want ErrBackupUploadOffset", err)
+	}
+	if _, err := StartUploadedRestoreJob(context.Background(), upload.ID, RestoreOptions{}); !errors.Is(err, ErrBackupUploadIncomplete) {
+		t.Fatalf("restoring an incomplete upload error = %v, want ErrBackupUploadIncomplete", err)
+	}
+	if _, err := WriteBackupUpload(context.Background(), upload.ID, half, bytes.NewReader(append(content[half:], 'x'))); !errors.Is(err, ErrInvalidBackupUpload) {
+		t.Fatalf("write past the declared size error = %v, want ErrInvalidBackupUpload", err)
+	}
+	upload, err = GetBackupUpload(upload.ID)
+	if err != nil || upload.Offset != upload.Size {
+		t.Fatalf("completed upload = %+v, %v", upload, err)
+	}
+
+	job, err := StartUploadedRestoreJob(context.Background(), upload.ID, RestoreOptions{})
+	if err != nil {
+		t.Fatalf("StartUploadedRestoreJob returned error: %v", err)
+	}
+	jobsWG.Wait()
+	restoreJob, err := GetBackupJob(job.ID)
+	if err != nil || restoreJob.Status != JobStatusSuccess || restoreJob.FileName != "dataark-backup.zip" {
+		t.Fatalf("restore job = %+v, %v", restoreJob, err)
+	}
+	var result RestoreResult
+	if err := json.Unmarshal(restoreJob.Result, &result); err != nil || result.IndexedDocuments != 1 {
+		t.Fatalf("restore result = %s, %v", restoreJob.Result, err)
+	}
+	if html, _ := os.ReadFile(filepath.Join(archiveRoot, "example.com", "a.html")); !strings.Contains(string(html), "original body") {
+		t.Fatal("uploaded backup should be restored")
+	}
+	if _, err := GetBackupUpload(upload.ID); !errors.Is(err, ErrBackupUploadNotFound) {
+		t.Fatalf("upload should be removed after starting the restore, err = %v", err)
+	}
+	// 解开的备份放在归档目录旁边，恢复结束后不留下临时目录
+	entries, err := os.ReadDir(filepath.Dir(archiveRoot))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			t.Fatalf("restore left %s next to the archive", entry.Name())
+		}
+	}
+}
+
+func TestDeleteAndPruneBackupUploads(t *testing.T) {
+	setupSnapshotEnvironment(t)
+	deleted, err := CreateBackupUpload(context.Background(), "a.zip", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteBackupUpload(deleted.ID); err != nil {
+		t.Fatalf("DeleteBackupUpload returned error: %v", err)
+	}
+	if err := DeleteBackupUpload(deleted.ID); !errors.Is(err, ErrBackupUploadNotFound) {
+		t.Fatalf("deleting twice error = %v, want ErrBackupUploadNotFound", err)
+	}
+
+	stale, err := CreateBackupUpload(context.Background(), "b.zip", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	active, err := CreateBackupUpload(context.Background(), "c.zip", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * backupUploadTTL)
+	stalePath, _ := backupUploadPath(stale.ID)
+	if err := os.Chtimes(filepath.Join(stalePath, "b.zip"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	pruneBackupUploads()
+	if _, err := GetBackupUpload(stale.ID); !errors.Is(err, ErrBackupUploadNotFound) {
+		t.Fatalf("stale upload should be pruned, err = %v", err)
+	}
+	if _, err := GetBackupUpload(active.ID); err != nil {
+		t.Fatalf("active upload should be kept: %v", err)
+	}
+}
+
+func TestCreateBackupUploadRejectsSizeOverLimit(t *testing.T) {
+	setupSnapshotEnvironment(t)
+	oldMax := common.BackupUploadMaxMB
+	t.Cleanup(func() { common.BackupUploadMaxMB = oldMax })
+	common.BackupUploadMaxMB = 1
+
+	if _, err := CreateBackupUpload(context.Background(), "huge.zip", 1<<62); !errors.Is(err, ErrInvalidBackupUpload) {
+		t.Fatalf("huge upload error = %v, want ErrInvalidBackupUpload", err)
+	}
+	if _, err := CreateBackupUpload(context.Background(), "over.zip", 1<<20+1); !errors.Is(err, ErrInvalidBackupUpload) {
+		t.Fatalf("upload over the limit error = %v, want ErrInvalidBackupUpload", err)
+	}
+	// 被拒绝的上传不能在磁盘上留下目录
+	if entries, err := os.ReadDir(filepath.Join(common.BackupDir, backupUploadDir)); err == nil && len(entries) != 0 {
+		t.Fatalf("rejected uploads left %d entries", len(entries))
+	}
+	if _, err := CreateBackupUpload(context.Background(), "fits.zip", 1<<20); err != nil {
+		t.Fatalf("upload at the limit returned error: %v", err)
+	}
+
+	common.BackupUploadMaxMB = 0
+	if _, err := CreateBackupUpload(context.Background(), "unlimited.zip", 1<<40); err != nil {
+		t.Fatalf("upload without a limit returned error: %v", err)
+	}
+}
@@ -0,0 +1,404 @@
+package backup
+
+import (
+	"DataArk/common"
+	"DataArk/search"
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxReportedFiles 限制报告中逐个列出的文件数，数量仍按全部文件统计。
+const maxReportedFiles = 100
+
+// VerifyReport 是备份校验的结果。Problems 中的问题会导致恢复失败，Warnings 只是提示。
+type VerifyReport struct {
+	Valid             bool             `json:"valid"`
+	Encrypted         bool             `json:"encrypted"`
+	CreatedAt         string           `json:"createdAt,omitempty"`
+	SearchEngine      string           `json:"searchEngine,omitempty"`
+	DatabaseDriver    string           `json:"databaseDriver,omitempty"`
+	VerifiedChecksums int              `json:"verifiedChecksums"`
+	DatabaseFile      string           `json:"databaseFile,omitempty"`
+	SQLStatements     int              `json:"sqlStatements,omitempty"`
+	TableRows         map[string]int64 `json:"tableRows,omitempty"`
+	HTMLFiles         int              `json:"htmlFiles"`
+	Domains           int              `json:"domains"`
+	InvalidHTMLFiles  []string         `json:"invalidHtmlFiles,omitempty"`
+	Problems          []string         `json:"problems"`
+	Warnings          []string         `json:"warnings"`
+}
+
+// RestorePlan 描述恢复会带来的变化，文件路径相对归档目录。
+type RestorePlan struct {
+	FilesAdded     int              `json:"filesAdded"`
+	FilesRemoved   int              `json:"filesRemoved"`
+	FilesChanged   int              `json:"filesChanged"`
+	FilesUnchanged int              `json:"filesUnchanged"`
+	AddedFiles     []string         `json:"addedFiles"`
+	RemovedFiles   []string         `json:"removedFiles"`
+	ChangedFiles   []string         `json:"changedFiles"`
+	Tables         []TableRowChange `json:"tables"`
+}
+
+type TableRowChange struct {
+	Table       string `json:"table"`
+	CurrentRows int64  `json:"currentRows"`
+	BackupRows  int64  `json:"backupRows"`
+}
+
+// VerifyBackup 在临时目录中解开备份并逐项检查：解密、manifest、校验和、数据库文件能否解析、
+// 归档 HTML 能否按重建索引的方式解析。不持有 operationMu，也不改动任何现有数据。
+// 备份本身的问题写入报告，只有临时目录无法创建或 ctx 被取消时返回错误。
+func VerifyBackup(ctx context.Context, zipPath string) (*VerifyReport, error) {
+	tempRoot, err := os.MkdirTemp("", "dataark-verify-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tempRoot)
+
+	report := &VerifyReport{Problems: []string{}, Warnings: []string{}}
+	if err := report.verify(ctx, zipPath, tempRoot); err != nil {
+		return nil, err
+	}
+	report.Valid = len(report.Problems) == 0
+	return report, nil
+}
+
+func (r *VerifyReport) problem(format string, args ...interface{}) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+}
+
+func (r *VerifyReport) warning(format string, args ...interface{}) {
+	r.Warnings = append(r.Warnings, fmt.Sprintf(format, args...))
+}
+
+func (r *VerifyReport) verify(ctx context.Context, zipPath string, tempRoot string) error {
+	encrypted, err := isEncryptedBackup(zipPath)
+	if err != nil {
+		r.problem("read backup: %v", err)
+		return nil
+	}
+	r.Encrypted = encrypted
+	plainPath, err := openBackupZip(zipPath, tempRoot)
+	if err != nil {
+		r.problem("open backup: %v", err)
+		return nil
+	}
+	extractDir := filepath.Join(tempRoot, "extract")
+	if err := extractZip(ctx, plainPath, extractDir); err != nil {
+		r.problem("extract backup zip: %v", err)
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.verifyManifest(extractDir)
+
+	components, err := discoverRestoreComponents(extractDir)
+	if err != nil {
+		r.problem("%v", err)
+		return nil
+	}
+	if err := checkDatabaseRestoreSource(components); err != nil {
+		r.problem("cannot restore on this server: %v", err)
+	}
+
+	tableRows, statements, err := inspectBackupDatabase(ctx, components)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		r.problem("database %s: %v", relativeBackupPath(extractDir, backupDatabaseFile(components)), err)
+	}
+	r.DatabaseFile = relativeBackupPath(extractDir, backupDatabaseFile(components))
+	r.TableRows = tableRows
+	r.SQLStatements = statements
+
+	return r.verifyArchiveHTML(ctx, components.ArchiveDir)
+}
+
+func (r *VerifyReport) verifyManifest(extractDir string) {
+	manifestPath, err := findManifest(extractDir)
+	if err != nil {
+		r.problem("find manifest: %v", err)
+		return
+	}
+	if manifestPath == "" {
+		r.warning("backup has no %s, file checksums cannot be verified", manifestFileName)
+		return
+	}
+	manifest, err := readManifest(manifestPath)
+	if err != nil {
+		r.problem("read manifest: %v", err)
+		return
+	}
+	r.CreatedAt = manifest.CreatedAt
+	r.SearchEngine = manifest.SearchEngine
+	r.DatabaseDriver = manifest.DatabaseDriver
+	if _, err := time.Parse(time.RFC3339, manifest.CreatedAt); err != nil {
+		r.warning("manifest createdAt %q is not a valid time", manifest.CreatedAt)
+	}
+	if manifest.DatabaseExportFile == "" && manifest.DatabaseDriver != "" && manifest.DatabaseDriver != databaseDriverName() {
+		r.warning("backup was created with database driver %s, this server uses %s", manifest.DatabaseDriver, databaseDriverName())
+	}
+	if len(manifest.Checksums) == 0 {
+		if manifestRequiresChecksums(manifest) {
+			r.problem("manifest has no checksums although the backup was created by a version that records them")
+			return
+		}
+		r.warning("manifest has no checksums, the backup was created by an older version")
+		return
+	}
+	if err := verifyBackupChecksums(extractDir); err != nil {
+		r.problem("%v", err)
+		return
+	}
+	r.VerifiedChecksums = len(manifest.Checksums)
+}
+
+// verifyArchiveHTML 按重建索引的规则遍历归档：跳过 Temporary 和根目录下的文件，只解析 .html/.htm。
+func (r *VerifyReport) verifyArchiveHTML(ctx context.Context, archiveDir string) error {
+	domains := make(map[string]bool)
+	var invalid []string
+	err := filepath.WalkDir(archiveDir, func(currentPath string, entry fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		extension := strings.ToLower(filepath.Ext(entry.Name()))
+		if extension != ".html" && extension != ".htm" {
+			return nil
+		}
+		relativePath, err := filepath.Rel(archiveDir, currentPath)
+		if err != nil {
+			return err
+		}
+		pathParts := strings.Split(filepath.ToSlash(relativePath), "/")
+		if len(pathParts) < 2 || strings.EqualFold(pathParts[0], "Temporary") {
+			return nil
+		}
+
+		r.HTMLFiles++
+		domains[pathParts[0]] = true
+		if err := search.CheckArchiveHTML(currentPath, pathParts[0], strings.Join(pathParts[1:], "/")); err != nil {
+			invalid = append(invalid, filepath.ToSlash(relativePath))
+		}
+		return nil
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		r.problem("scan archive: %v", err)
+		return nil
+	}
+
+	r.Domains = len(domains)
+	if len(invalid) > 0 {
+		r.problem("%d archive HTML files cannot be parsed, rebuilding the index after restore would fail", len(invalid))
+		r.InvalidHTMLFiles = limitReportedFiles(invalid)
+	}
+	if r.HTMLFiles == 0 {
+		r.warning("backup archive contains no HTML files")
+	}
+	return nil
+}
+
+// inspectBackupDatabase 返回备份数据库中每张表的行数，SQL 导出同时返回语句数。
+func inspectBackupDatabase(ctx context.Context, components *restoreComponents) (map[string]int64, int, error) {
+	if components.DatabaseExportPath != "" {
+		summary, err := common.InspectDatabaseExport(components.DatabaseExportPath)
+		if err != nil {
+			return nil, 0, err
+		}
+		return summary.TableRows, 0, nil
+	}
+	if components.DatabaseSnapshotPath != "" && (common.IsSQLite() || components.DatabasePath == "") {
+		rows, err := common.InspectSQLiteSnapshot(ctx, components.DatabaseSnapshotPath)
+		return rows, 0, err
+	}
+	summary, err := parseSQLDump(components.DatabasePath)
+	if err != nil {
+		return nil, 0, err
+	}
+	return summary.TableRows, summary.Statements, nil
+}
+
+// backupDatabaseFile 返回与 inspectBackupDatabase 相同选择规则下的数据库文件。
+func backupDatabaseFile(components *restoreComponents) string {
+	if components.DatabaseExportPath != "" {
+		return components.DatabaseExportPath
+	}
+	if components.DatabaseSnapshotPath != "" && (common.IsSQLite() || components.DatabasePath == "") {
+		return components.DatabaseSnapshotPath
+	}
+	return components.DatabasePath
+}
+
+func relativeBackupPath(root string, filePath string) string {
+	relativePath, err := filepath.Rel(root, filePath)
+	if err != nil {
+		return filepath.Base(filePath)
+	}
+	return filepath.ToSlash(relativePath)
+}
+
+// planRestore 比较解开的备份和当前数据，调用方需持有 operationMu。
+func planRestore(ctx context.Context, extractDir string) (*RestorePlan, error) {
+	components, err := discoverRestoreComponents(extractDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkDatabaseRestoreSource(components); err != nil {
+		return nil, err
+	}
+	backupRows, _, err := inspectBackupDatabase(ctx, components)
+	if err != nil {
+		return nil, fmt.Errorf("inspect backup database: %w", err)
+	}
+	currentRows, err := common.CountTableRows(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("count current database rows: %w", err)
+	}
+
+	plan := &RestorePlan{AddedFiles: []string{}, RemovedFiles: []string{}, ChangedFiles: []string{}}
+	plan.Tables = diffTableRows(currentRows, backupRows)
+	archiveRoot, err := cleanArchiveRoot()
+	if err != nil {
+		return nil, err
+	}
+	if err := plan.diffArchive(ctx, archiveRoot, components.ArchiveDir); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+func diffTableRows(currentRows map[string]int64, backupRows map[string]int64) []TableRowChange {
+	tables := make(map[string]bool, len(currentRows)+len(backupRows))
+	for table := range currentRows {
+		tables[table] = true
+	}
+	for table := range backupRows {
+		tables[table] = true
+	}
+	changes := make([]TableRowChange, 0, len(tables))
+	for table := range tables {
+		changes = append(changes, TableRowChange{Table: table, CurrentRows: currentRows[table], BackupRows: backupRows[table]})
+	}
+	sort.Slice(changes, func(left int, right int) bool {
+		return changes[left].Table < changes[right].Table
+	})
+	return changes
+}
+
+// diffArchive 比较当前归档和备份归档：大小不同直接视为修改，大小相同时再比较 SHA-256。
+func (p *RestorePlan) diffArchive(ctx context.Context, currentRoot string, backupRoot string) error {
+	currentFiles, err := listArchiveFiles(currentRoot)
+	if err != nil {
+		return err
+	}
+	backupFiles, err := listArchiveFiles(backupRoot)
+	if err != nil {
+		return err
+	}
+
+	var added, removed, changed []string
+	for relativePath, backupSize := range backupFiles {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		currentSize, ok := currentFiles[relativePath]
+		if !ok {
+			added = append(added, relativePath)
+			continue
+		}
+		same := currentSize == backupSize
+		if same {
+			same, err = sameFileContent(filepath.Join(currentRoot, filepath.FromSlash(relativePath)), filepath.Join(backupRoot, filepath.FromSlash(relativePath)))
+			if err != nil {
+				return err
+			}
+		}
+		if same {
+			p.FilesUnchanged++
+		} else {
+			changed = append(changed, relativePath)
+		}
+	}
+	for relativePath := range currentFiles {
+		if _, ok := backupFiles[relativePath]; !ok {
+			removed = append(removed, relativePath)
+		}
+	}
+
+	p.FilesAdded, p.FilesRemoved, p.FilesChanged = len(added), len(removed), len(changed)
+	p.AddedFiles = limitReportedFiles(added)
+	p.RemovedFiles = limitReportedFiles(removed)
+	p.ChangedFiles = limitReportedFiles(changed)
+	return nil
+}
+
+// listArchiveFiles 返回 root 下全部普通文件的大小，键为 / 分隔的相对路径；root 不存在时返回空结果。
+func listArchiveFiles(root string) (map[string]int64, error) {
+	files := make(map[string]int64)
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		return files, nil
+	}
+	err := filepath.WalkDir(root, func(currentPath string, entry fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		relativePath, err := filepath.Rel(root, currentPath)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(relativePath)] = info.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+func sameFileContent(left string, right string) (bool, error) {
+	leftHash, err := hashFile(left)
+	if err != nil {
+		return false, err
+	}
+	rightHash, err := hashFile(right)
+	if err != nil {
+		return false, err
+	}
+	return leftHash == rightHash, nil
+}
+
+func limitReportedFiles(files []string) []string {
+	if files == nil {
+		return []string{}
+	}
+	sort.Strings(files)
+	if len(files) > maxReportedFiles {
+		files = files[:maxReportedFiles]
+	}
+	return files
+}
@@ -0,0 +1,133 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerifyBackupReportsContents(t *testing.T) {
+	archiveRoot := setupSnapshotEnvironment(t)
+	writeArchiveTestFile(t, archiveRoot, "example.com", "a.html", "first")
+	writeArchiveTestFile(t, archiveRoot, "example.com", "b.html", "second")
+	zipPath := filepath.Join(t.TempDir(), "backup.zip")
+	writeTestBackupZip(t, zipPath)
+
+	report, err := VerifyBackup(context.Background(), zipPath)
+	if err != nil {
+		t.Fatalf("VerifyBackup returned error: %v", err)
+	}
+	if !report.Valid || len(report.Problems) != 0 || len(report.Warnings) != 0 {
+		t.Fatalf("report should be valid: %+v", report)
+	}
+	if report.HTMLFiles != 2 || report.Domains != 1 || report.VerifiedChecksums != 3 || report.DatabaseFile != "backup/database.jsonl" {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if _, ok := report.TableRows["users"]; !ok {
+		t.Fatalf("table rows %v should include users", report.TableRows)
+	}
+}
+
+func TestVerifyBackupReportsProblems(t *testing.T) {
+	archiveRoot := setupSnapshotEnvironment(t)
+	writeArchiveTestFile(t, archiveRoot, "example.com", "a.html", "first")
+	// 没有 title 的页面在重建索引时会失败
+	if err := os.WriteFile(filepath.Join(archiveRoot, "example.com", "broken.html"), []byte("<html><body>no title</body></html>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	zipPath := filepath.Join(t.TempDir(), "backup.zip")
+	writeTestBackupZip(t, zipPath)
+
+	report, err := VerifyBackup(context.Background(), zipPath)
+	if err != nil {
+		t.Fatalf("VerifyBackup returned error: %v", err)
+	}
+	if report.Valid || report.HTMLFiles != 2 || len(report.InvalidHTMLFiles) != 1 || report.InvalidHTMLFiles[0] != "example.com/broken.html" {
+		t.Fatalf("invalid html should be reported: %+v", report)
+	}
+
+	tampered := rewriteTestZip(t, zipPath, func(name string, content []byte) ([]byte, bool) {
+		if strings.HasSuffix(name, "a.html") {
+			return []byte("<html><head><title>tampered</title></head></html>"), true
+		}
+		return content, true
+	}, nil)
+	if report, err := VerifyBackup(context.Background(), tampered); err != nil || report.Valid || !strings.Contains(strings.Join(report.Problems, "\n"), "checksum mismatch") {
+		t.Fatalf("tampered report=%+v err=%v, want checksum problem", report, err)
+	}
+	stripped := rewriteTestZip(t, zipPath, stripManifestChecksums(t), nil)
+	if report, err := VerifyBackup(context.Background(), stripped); err != nil || report.Valid || !strings.Contains(strings.Join(report.Problems, "\n"), "manifest has no checksums") {
+		t.Fatalf("stripped report=%+v err=%v, want missing checksums problem", report, err)
+	}
+
+	// 没有 manifest 的 PostgreSQL 导出，SQL 被截断
+	legacyPath := filepath.Join(t.TempDir(), "legacy.zip")
+	createTestZip(t, legacyPath, map[string]string{
+		"backup/database.sql":               "CREATE TABLE users (id bigint);\nINSERT INTO users VALUES ('alice",
+		"backup/archive/example.com/a.html": "<html><head><title>legacy</title></head></html>",
+	})
+	report, err = VerifyBackup(context.Background(), legacyPath)
+	if err != nil {
+		t.Fatalf("VerifyBackup returned error: %v", err)
+	}
+	problems := strings.Join(report.Problems, "\n")
+	if report.Valid || !strings.Contains(problems, "sql dump line") || !strings.Contains(problems, "sqlite database snapshot") || len(report.Warnings) != 1 {
+		t.Fatalf("legacy report problems=%v warnings=%v", report.Problems, report.Warnings)
+	}
+
+	notZip := filepath.Join(t.TempDir(), "not.zip")
+	if err := os.WriteFile(notZip, []byte("plain text"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if report, err := VerifyBackup(context.Background(), notZip); err != nil || report.Valid {
+		t.Fatalf("non-zip report=%+v err=%v, want invalid report", report, err)
+	}
+}
+
+func TestRestoreDryRunReportsChangesWithoutApplying(t *testing.T) {
+	archiveRoot := setupSnapshotEnvironment(t)
+	writeArchiveTestFile(t, archiveRoot, "example.com", "a.html", "original")
+	writeArchiveTestFile(t, archiveRoot, "example.com", "b.html", "kept")
+	writeArchiveTestFile(t, archiveRoot, "example.com", "c.html", "deleted later")
+	zipPath := filepath.Join(t.TempDir(), "backup.zip")
+	writeTestBackupZip(t, zipPath)
+
+	writeArchiveTestFile(t, archiveRoot, "example.com", "a.html", "changed")
+	if err := os.Remove(filepath.Join(archiveRoot, "example.com", "c.html")); err != nil {
+		t.Fatal(err)
+	}
+	writeArchiveTestFile(t, archiveRoot, "example.com", "d.html", "new")
+
+	result, err := RestoreBackup(context.Background(), zipPath, RestoreOptions{DryRun: true})
+	if err != nil {
+		t.Fatalf("dry run returned error: %v", err)
+	}
+	plan := result.Plan
+	if !result.DryRun || result.DatabaseRestored || result.ArchiveRestored || plan == nil {
+		t.Fatalf("unexpected dry run result %+v", result)
+	}
+	if plan.FilesChanged != 1 || plan.ChangedFiles[0] != "example.com/a.html" ||
+		plan.FilesAdded != 1 || plan.AddedFiles[0] != "example.com/c.html" ||
+		plan.FilesRemoved != 1 || plan.RemovedFiles[0] != "example.com/d.html" ||
+		plan.FilesUnchanged != 1 {
+		t.Fatalf("unexpected plan %+v", plan)
+	}
+	foundUsers := false
+	for _, table := range plan.Tables {
+		if table.Table == "users" {
+			foundUsers = table.CurrentRows == table.BackupRows
+		}
+	}
+	if !foundUsers {
+		t.Fatalf("plan tables %+v should include unchanged users", plan.Tables)
+	}
+
+	if html, _ := os.ReadFile(filepath.Join(archiveRoot, "example.com", "a.html")); !strings.Contains(string(html), "changed body") {
+		t.Fatal("dry run should not change the archive")
+	}
+	if _, err := os.Stat(filepath.Join(archiveRoot, "example.com", "d.html")); err != nil {
+		t.Fatalf("dry run should keep new files: %v", err)
+	}
+}
@@ -0,0 +1,229 @@
+package common
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// API Token 的权限范围。Token 只能访问声明了对应 scope 的接口，
+// 同时仍受所属用户角色的限制，用户降级后 Token 的权限随之收窄。
+const (
+	ScopeSearchRead   = "search:read"
+	ScopeArchiveRead  = "archive:read"
+	ScopeArchiveWrite = "archive:write"
+	ScopeBackup       = "backup"
+)
+
+// APITokenPrefix 用于在 Authorization 头中区分 API Token 与 JWT。
+const APITokenPrefix = "dak_"
+
+const (
+	apiTokenRandomBytes = 32
+	apiTokenShownPrefix = len(APITokenPrefix) + 8
+	// 最近使用时间只在超过该间隔后才写回，避免每个请求都更新数据库。
+	apiTokenTouchInterval = time.Minute
+)
+
+// 创建 Token 时每个 scope 要求的最低角色。
+var apiTokenScopeRoles = map[string]string{
+	ScopeSearchRead:   RoleViewer,
+	ScopeArchiveRead:  RoleViewer,
+	ScopeArchiveWrite: RoleEditor,
+	ScopeBackup:       RoleAdmin,
+}
+
+var (
+	ErrAPITokenInvalid  = errors.New("invalid api token")
+	ErrAPITokenExpired  = errors.New("api token has expired")
+	ErrAPITokenNotFound = errors.New("api token not found")
+	// ErrAPITokenScopeNotAllowed 表示申请的 scope 超出了用户当前角色的权限。
+	ErrAPITokenScopeNotAllowed = errors.New("api token scope exceeds user role")
+)
+
+// APIToken 供脚本和浏览器扩展使用的长期个人 Token。
+// 数据库只保存 Token 的 SHA-256，明文只在创建时返回一次；Scopes 以空格分隔。
+type APIToken struct {
+	ID         uint       `json:"id" gorm:"primaryKey"`
+	UserID     uint       `json:"userId" gorm:"index;not null"`
+	Name       string     `json:"name" gorm:"size:64;not null"`
+	Prefix     string     `json:"prefix" gorm:"size:16;not null"`
+	TokenHash  string     `json:"-" gorm:"size:64;uniqueIndex;not null"`
+	Scopes     string     `json:"scopes" gorm:"size:255;not null"`
+	ExpiresAt  *time.Time `json:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+	TwoFactor  bool       `json:"twoFactor" gorm:"not null;default:false"` // 创建时校验过两步验证码，只有这样的 Token 能访问要求两步验证的接口
+	CreatedAt  time.Time  `json:"createdAt"`
+}
+
+// APITokenScopes 返回所有可用的 scope。
+func APITokenScopes() []string {
+	scopes := make([]string, 0, len(apiTokenScopeRoles))
+	for scope := range apiTokenScopeRoles {
+		scopes = append(scopes, scope)
+	}
+	sort.Strings(scopes)
+	return scopes
+}
+
+// NormalizeAPITokenScopes 校验 scope 列表，去重并排序，至少需要一个 scope。
+func NormalizeAPITokenScopes(scopes []string) ([]string, error) {
+	seen := make(map[string]bool, len(scopes))
+	normalized := make([]string, 0, len(scopes))
+	for _, scope := range scopes {
+		scope = strings.ToLower(strings.TrimSpace(scope))
+		if _, ok := apiTokenScopeRoles[scope]; !ok {
+			return nil, fmt.Errorf("unknown api token scope %q", scope)
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			normalized = append(normalized, scope)
+		}
+	}
+	if len(normalized) == 0 {
+		return nil, errors.New("at least one api token scope is required")
+	}
+	sort.Strings(normalized)
+	return normalized, nil
+}
+
+// HasScope 判断 Token 是否拥有给定 scope 中的任意一个。
+func (t *APIToken) HasScope(scopes ...string) bool {
+	if t == nil {
+		return false
+	}
+	for _, granted := range strings.Fields(t.Scopes) {
+		for _, scope := range scopes {
+			if granted == scope {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsAPIToken 判断 Authorization 头中的凭据是否是 API Token 而不是 JWT。
+func IsAPIToken(token string) bool {
+	return strings.HasPrefix(token, APITokenPrefix)
+}
+
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateAPIToken 为用户创建 API Token，返回保存的记录和只出现这一次的明文 Token。
+// expiresAt 为 nil 表示永不过期。申请 backup scope 时 code 必须是所属用户的两步验证码（或恢复码），
+// 这样的 Token 记为 TwoFactor；其它 scope 不校验 code。
+func CreateAPIToken(userID uint, name string, scopes []string, expiresAt *time.Time, code string) (*APIToken, string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, "", errors.New("api token name is required")
+	}
+	normalizedScopes, err := NormalizeAPITokenScopes(scopes)
+	if err != nil {
+		return nil, "", err
+	}
+	user, err := GetUserByID(userID)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, scope := range normalizedScopes {
+		if !user.HasRole(apiTokenScopeRoles[scope]) {
+			return nil, "", fmt.Errorf("%w: %s requires role %s", ErrAPITokenScopeNotAllowed, scope, apiTokenScopeRoles[scope])
+		}
+	}
+	twoFactor := false
+	for _, scope := range normalizedScopes {
+		if scope == ScopeBackup {
+			if err := VerifySecondFactor(user.ID, code); err != nil {
+				return nil, "", err
+			}
+			twoFactor = true
+		}
+	}
+
+	raw := make([]byte, apiTokenRandomBytes)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, "", fmt.Errorf("failed to generate api token: %v", err)
+	}
+	plainToken := APITokenPrefix + base64.RawURLEncoding.EncodeToString(raw)
+
+	token := &APIToken{
+		UserID:    user.ID,
+		Name:      name,
+		Prefix:    plainToken[:apiTokenShownPrefix],
+		TokenHash: hashAPIToken(plainToken),
+		Scopes:    strings.Join(normalizedScopes, " "),
+		ExpiresAt: expiresAt,
+		TwoFactor: twoFactor,
+	}
+	if err := db.Create(token).Error; err != nil {
+		return nil, "", fmt.Errorf("failed to create api token: %v", err)
+	}
+	return token, plainToken, nil
+}
+
+// ListAPITokens 列出用户自己的 API Token。
+func ListAPITokens(userID uint) ([]APIToken, error) {
+	var tokens []APIToken
+	if err := db.Where("user_id = ?", userID).Order("id ASC").Find(&tokens).Error; err != nil {
+		return nil, fmt.Errorf("failed to list api tokens: %v", err)
+	}
+	return tokens, nil
+}
+
+// DeleteAPIToken 删除用户自己的 API Token，删除后立即失效。
+func DeleteAPIToken(userID uint, tokenID uint) error {
+	result := db.Where("id = ? AND user_id = ?", tokenID, userID).Delete(&APIToken{})
+	if result.Error != nil {
+		return fmt.Errorf("failed to delete api token: %v", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrAPITokenNotFound
+	}
+	return nil
+}
+
+// AuthenticateAPIToken 校验明文 API Token，返回 Token 记录和所属用户，并记录最近使用时间。
+func AuthenticateAPIToken(plainToken string) (*APIToken, *User, error) {
+	if !IsAPIToken(plainToken) {
+		return nil, nil, ErrAPITokenInvalid
+	}
+
+	var token APIToken
+	if err := db.Where("token_hash = ?", hashAPIToken(plainToken)).First(&token).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, ErrAPITokenInvalid
+		}
+		return nil, nil, fmt.Errorf("database error: %v", err)
+	}
+	now := time.Now()
+	if token.ExpiresAt != nil && now.After(*token.ExpiresAt) {
+		return nil, nil, ErrAPITokenExpired
+	}
+
+	user, err := GetUserByID(token.UserID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if user.Disabled {
+		return nil, nil, ErrUserDisabled
+	}
+
+	if token.LastUsedAt == nil || now.Sub(*token.LastUsedAt) >= apiTokenTouchInterval {
+		if err := db.Model(&APIToken{}).Where("id = ?", token.ID).UpdateColumn("last_used_at", now).Error; err != nil {
+			return nil, nil, fmt.Errorf("failed to update api token usage: %v", err)
+		}
+		token.LastUsedAt = &now
+	}
+	return &token, user, nil
+}
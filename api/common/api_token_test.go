@@ -0,0 +1,195 @@
+package common
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNormalizeAPITokenScopes(t *testing.T) {
+	scopes, err := NormalizeAPITokenScopes([]string{" Search:Read ", ScopeArchiveWrite, ScopeSearchRead})
+	if err != nil {
+		t.Fatalf("NormalizeAPITokenScopes returned error: %v", err)
+	}
+	if strings.Join(scopes, " ") != "archive:write search:read" {
+		t.Fatalf("scopes = %v", scopes)
+	}
+	if _, err := NormalizeAPITokenScopes(nil); err == nil {
+		t.Fatal("empty scopes should be rejected")
+	}
+	if _, err := NormalizeAPITokenScopes([]string{"users:write"}); err == nil {
+		t.Fatal("unknown scope should be rejected")
+	}
+}
+
+func TestAPITokenLifecycle(t *testing.T) {
+	setupSQLiteDB(t)
+	editor, err := CreateUserWithRole("capture", "password", RoleEditor)
+	if err != nil {
+		t.Fatalf("CreateUserWithRole returned error: %v", err)
+	}
+
+	if _, _, err := CreateAPIToken(editor.ID, "nightly", []string{ScopeBackup}, nil, ""); !errors.Is(err, ErrAPITokenScopeNotAllowed) {
+		t.Fatalf("backup scope for editor error = %v, want ErrAPITokenScopeNotAllowed", err)
+	}
+	if _, _, err := CreateAPIToken(editor.ID, "  ", []string{ScopeSearchRead}, nil, ""); err == nil {
+		t.Fatal("blank token name should be rejected")
+	}
+
+	token, plain, err := CreateAPIToken(editor.ID, "bookmarklet", []string{ScopeArchiveWrite, ScopeSearchRead}, nil, "")
+	if err != nil {
+		t.Fatalf("CreateAPIToken returned error: %v", err)
+	}
+	if !IsAPIToken(plain) || token.Prefix != plain[:len(token.Prefix)] || strings.Contains(token.TokenHash, plain) {
+		t.Fatalf("unexpected token %q prefix %q", plain, token.Prefix)
+	}
+	if token.TokenHash != hashAPIToken(plain) {
+		t.Fatal("token should be stored as its hash")
+	}
+
+	authenticated, user, err := AuthenticateAPIToken(plain)
+	if err != nil {
+		t.Fatalf("AuthenticateAPIToken returned error: %v", err)
+	}
+	if user.ID != editor.ID || !authenticated.HasScope(ScopeArchiveWrite) || authenticated.HasScope(ScopeBackup) {
+		t.Fatalf("unexpected token %+v user %+v", authenticated, user)
+	}
+	tokens, err := ListAPITokens(editor.ID)
+	if err != nil || len(tokens) != 1 || tokens[0].LastUsedAt == nil {
+		t.Fatalf("tokens = %+v err=%v, want one token with last used time", tokens, err)
+	}
+
+	if _, _, err := AuthenticateAPIToken(plain + "x"); !errors.Is(err, ErrAPITokenInvalid) {
+		t.Fatalf("tampered token error = %v, want ErrAPITokenInvalid", err)
+	}
+	disabled := true
+	if _, err := UpdateUserAccount(editor.ID, nil, &disabled); err != nil {
+		t.Fatalf("UpdateUserAccount returned error: %v", err)
+	}
+	if _, _, err := AuthenticateAPIToken(plain); !errors.Is(err, ErrUserDisabled) {
+		t.Fatalf("disabled user error = %v, want ErrUserDisabled", err)
+	}
+	disabled = false
+	if _, err := UpdateUserAccount(editor.ID, nil, &disabled); err != nil {
+		t.Fatalf("UpdateUserAccount returned error: %v", err)
+	}
+
+	if err := DeleteAPIToken(editor.ID+1, token.ID); !errors.Is(err, ErrAPITokenNotFound) {
+		t.Fatalf("deleting another user's token error = %v, want ErrAPITokenNotFound", err)
+	}
+	if err := DeleteAPIToken(editor.ID, token.ID); err != nil {
+		t.Fatalf("DeleteAPIToken returned error: %v", err)
+	}
+	if _, _, err := AuthenticateAPIToken(plain); !errors.Is(err, ErrAPITokenInvalid) {
+		t.Fatalf("deleted token error = %v, want ErrAPITokenInvalid", err)
+	}
+}
+
+func TestBackupScopeRequiresSecondFactor(t *testing.T) {
+	setupSQLiteDB(t)
+	admin, err := CreateUserWithRole("operator", "password", RoleAdmin)
+	if err != nil {
+		t.Fatalf("CreateUserWithRole returned error: %v", err)
+	}
+	if _, _, err := CreateAPIToken(admin.ID, "nightly", []string{ScopeBackup}, nil, "123456"); !errors.Is(err, ErrTOTPNotEnabled) {
+		t.Fatalf("backup scope without two-factor error = %v, want ErrTOTPNotEnabled", err)
+	}
+	setup, err := BeginTOTPEnrollment(admin.ID)
+	if err != nil {
+		t.Fatalf("BeginTOTPEnrollment returned error: %v", err)
+	}
+	codes, err := EnableTOTP(admin.ID, currentTOTPCode(t, setup.Secret))
+	if err != nil {
+		t.Fatalf("EnableTOTP returned error: %v", err)
+	}
+
+	if _, _, err := CreateAPIToken(admin.ID, "nightly", []string{ScopeBackup}, nil, ""); !errors.Is(err, ErrInvalidTOTPCode) {
+		t.Fatalf("backup scope without a code error = %v, want ErrInvalidTOTPCode", err)
+	}
+	reader, _, err := CreateAPIToken(admin.ID, "reader", []string{ScopeSearchRead}, nil, "")
+	if err != nil || reader.TwoFactor {
+		t.Fatalf("search token = %+v err=%v, want a token without two-factor", reader, err)
+	}
+	// 启用时已经用掉了当前时间步的验证码，这里用恢复码
+	backup, _, err := CreateAPIToken(admin.ID, "nightly", []string{ScopeBackup, ScopeSearchRead}, nil, codes[0])
+	if err != nil || !backup.TwoFactor {
+		t.Fatalf("backup token = %+v err=%v, want a two-factor token", backup, err)
+	}
+}
+
+func TestAPITokenExpiryAndUserDeletion(t *testing.T) {
+	setupSQLiteDB(t)
+	if _, err := CreateUserWithRole("root", "password", RoleAdmin); err != nil {
+		t.Fatalf("CreateUserWithRole returned error: %v", err)
+	}
+	viewer, err := CreateUserWithRole("reader", "password", RoleViewer)
+	if err != nil {
+		t.Fatalf("CreateUserWithRole returned error: %v", err)
+	}
+
+	expired := time.Now().Add(-time.Minute)
+	_, expiredPlain, err := CreateAPIToken(viewer.ID, "old", []string{ScopeSearchRead}, &expired, "")
+	if err != nil {
+		t.Fatalf("CreateAPIToken returned error: %v", err)
+	}
+	if _, _, err := AuthenticateAPIToken(expiredPlain); !errors.Is(err, ErrAPITokenExpired) {
+		t.Fatalf("expired token error = %v, want ErrAPITokenExpired", err)
+	}
+
+	_, plain, err := CreateAPIToken(viewer.ID, "reader", []string{ScopeSearchRead}, nil, "")
+	if err != nil {
+		t.Fatalf("CreateAPIToken returned error: %v", err)
+	}
+	if err := DeleteUser(viewer.ID); err != nil {
+		t.Fatalf("DeleteUser returned error: %v", err)
+	}
+	if _, _, err := AuthenticateAPIToken(plain); !errors.Is(err, ErrAPITokenInvalid) {
+		t.Fatalf("token of deleted user error = %v, want ErrAPITokenInvalid", err)
+	}
+}
+
+func TestRevokeAllUserTokensDeletesAPITokens(t *testing.T) {
+	setupSQLiteDB(t)
+	editor, err := CreateUserWithRole("capture", "password", RoleEditor)
+	if err != nil {
+		t.Fatalf("CreateUserWithRole returned error: %v", err)
+	}
+	other, err := CreateUserWithRole("other", "password", RoleEditor)
+	if err != nil {
+		t.Fatalf("CreateUserWithRole returned error: %v", err)
+	}
+	_, otherPlain, err := CreateAPIToken(other.ID, "other", []string{ScopeSearchRead}, nil, "")
+	if err != nil {
+		t.Fatalf("CreateAPIToken returned error: %v", err)
+	}
+
+	_, plain, err := CreateAPIToken(editor.ID, "bookmarklet", []string{ScopeSearchRead}, nil, "")
+	if err != nil {
+		t.Fatalf("CreateAPIToken returned error: %v", err)
+	}
+	if err := RevokeAllUserTokens(editor.ID); err != nil {
+		t.Fatalf("RevokeAllUserTokens returned error: %v", err)
+	}
+	if _, _, err := AuthenticateAPIToken(plain); !errors.Is(err, ErrAPITokenInvalid) {
+		t.Fatalf("token after revoking all sessions error = %v, want ErrAPITokenInvalid", err)
+	}
+
+	_, plain, err = CreateAPIToken(editor.ID, "bookmarklet", []string{ScopeSearchRead}, nil, "")
+	if err != nil {
+		t.Fatalf("CreateAPIToken returned error: %v", err)
+	}
+	if err := ResetUserPassword(editor.ID, "new-password"); err != nil {
+		t.Fatalf("ResetUserPassword returned error: %v", err)
+	}
+	if _, _, err := AuthenticateAPIToken(plain); !errors.Is(err, ErrAPITokenInvalid) {
+		t.Fatalf("token after password reset error = %v, want ErrAPITokenInvalid", err)
+	}
+
+	if _, _, err := AuthenticateAPIToken(otherPlain); err != nil {
+		t.Fatalf("other user's token should stay valid, got %v", err)
+	}
+	if err := RevokeAllUserTokens(other.ID + 1); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("unknown user error = %v, want ErrUserNotFound", err)
+	}
+}
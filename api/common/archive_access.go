@@ -0,0 +1,417 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// 归档的可见范围：private 只有归档者可见，team 归档者和所属团队成员可见，public 所有登录用户可见。
+// 管理员始终可以看到全部归档。
+const (
+	ArchiveVisibilityPrivate = "private"
+	ArchiveVisibilityTeam    = "team"
+	ArchiveVisibilityPublic  = "public"
+)
+
+var (
+	ErrTeamNotFound          = errors.New("team not found")
+	ErrTeamNameExists        = errors.New("team name already exists")
+	ErrInvalidTeamName       = errors.New("team name must be 1-64 characters")
+	ErrInvalidVisibility     = errors.New("visibility must be private, team or public")
+	ErrArchiveTeamRequired   = errors.New("team visibility requires a team")
+	ErrNotTeamMember         = errors.New("user is not a member of the team")
+	ErrArchiveAccessDenied   = errors.New("permission denied for this archive")
+	ErrTeamMemberNotFound    = errors.New("team member not found")
+	ErrTeamMemberExists      = errors.New("user is already a member of the team")
+	archiveVisibilityOptions = map[string]bool{
+		ArchiveVisibilityPrivate: true,
+		ArchiveVisibilityTeam:    true,
+		ArchiveVisibilityPublic:  true,
+	}
+)
+
+// Team 共用一个 DataArk 实例的团队，成员可以看到可见范围为 team 的团队归档。
+type Team struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	Name      string    `json:"name" gorm:"size:64;uniqueIndex;not null"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// TeamMember 团队成员关系，一个用户可以加入多个团队。
+type TeamMember struct {
+	TeamID    uint      `json:"teamId" gorm:"primaryKey"`
+	UserID    uint      `json:"userId" gorm:"primaryKey;index"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// TeamSummary 管理接口返回的团队及其成员。
+type TeamSummary struct {
+	Team
+	Members []TeamMemberSummary `json:"members"`
+}
+
+type TeamMemberSummary struct {
+	UserID   uint   `json:"userId"`
+	Username string `json:"username"`
+}
+
+// ArchiveOwnership 归档文档和离线任务的归属。
+// 引入可见范围之前的归档没有归属记录，OwnerID 为 0，视为公开。
+type ArchiveOwnership struct {
+	OwnerID    uint   `json:"ownerId" gorm:"index;not null;default:0"`
+	TeamID     uint   `json:"teamId" gorm:"index;not null;default:0"`
+	Visibility string `json:"visibility" gorm:"size:16;not null;default:public"`
+}
+
+// ArchiveDocument 记录每个归档 HTML 的归属，按域名目录和文件名对应磁盘上的文件。
+// 搜索索引里的文档带有同样的字段用于过滤，从 HTML 重建索引时以这里的记录为准。
+type ArchiveDocument struct {
+	Domain   string `json:"domain" gorm:"primaryKey;size:255"`
+	Filename string `json:"filename" gorm:"primaryKey;size:512"`
+	ArchiveOwnership
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// ArchiveAccess 查询者能访问的归档范围，All 为 true 时不做限制（管理员和后台任务）。
+type ArchiveAccess struct {
+	All     bool
+	UserID  uint
+	TeamIDs []uint
+}
+
+// PublicArchiveOwnership 返回没有归属记录的归档使用的公开归属。
+func PublicArchiveOwnership() ArchiveOwnership {
+	return ArchiveOwnership{Visibility: ArchiveVisibilityPublic}
+}
+
+// CanView 判断是否可以搜索和浏览该归档，未知的可见范围与旧数据一样按公开处理。
+func (a ArchiveAccess) CanView(ownership ArchiveOwnership) bool {
+	if a.All || (ownership.OwnerID != 0 && ownership.OwnerID == a.UserID) {
+		return true
+	}
+	switch ownership.Visibility {
+	case ArchiveVisibilityPrivate:
+		return false
+	case ArchiveVisibilityTeam:
+		return a.InTeam(ownership.TeamID)
+	default:
+		return true
+	}
+}
+
+// CanModify 判断是否可以删除或修改该归档：归档者、所属团队成员和管理员可以修改，旧数据不限制。
+func (a ArchiveAccess) CanModify(ownership ArchiveOwnership) bool {
+	if !a.CanView(ownership) {
+		return false
+	}
+	if a.All || ownership.OwnerID == 0 || ownership.OwnerID == a.UserID {
+		return true
+	}
+	return a.InTeam(ownership.TeamID)
+}
+
+// InTeam 判断查询者是否属于指定团队。
+func (a ArchiveAccess) InTeam(teamID uint) bool {
+	if teamID == 0 {
+		return false
+	}
+	for _, id := range a.TeamIDs {
+		if id == teamID {
+			return true
+		}
+	}
+	return false
+}
+
+// ArchiveAccessForUser 按用户角色和所属团队计算可访问的归档范围。
+func ArchiveAccessForUser(user *User) (ArchiveAccess, error) {
+	if user == nil {
+		return ArchiveAccess{}, ErrUserNotFound
+	}
+	if user.HasRole(RoleAdmin) {
+		return ArchiveAccess{All: true, UserID: user.ID}, nil
+	}
+	teamIDs, err := ListUserTeamIDs(user.ID)
+	if err != nil {
+		return ArchiveAccess{}, err
+	}
+	return ArchiveAccess{UserID: user.ID, TeamIDs: teamIDs}, nil
+}
+
+// NormalizeArchiveVisibility 校验并规范化可见范围，空字符串返回空字符串，由调用方决定默认值。
+func NormalizeArchiveVisibility(visibility string) (string, error) {
+	visibility = strings.ToLower(strings.TrimSpace(visibility))
+	if visibility == "" {
+		return "", nil
+	}
+	if !archiveVisibilityOptions[visibility] {
+		return "", ErrInvalidVisibility
+	}
+	return visibility, nil
+}
+
+// ResolveArchiveOwnership 计算用户新建归档的归属。
+// visibility 为空时使用 -archivevisibility 的默认值；team 可见时 teamID 为 0 且用户只属于一个团队则使用该团队。
+// 默认值为 team 但无法确定团队时退回 private，显式指定时则返回错误。
+func ResolveArchiveOwnership(user *User, visibility string, teamID uint) (ArchiveOwnership, error) {
+	if user == nil {
+		return ArchiveOwnership{}, ErrUserNotFound
+	}
+	normalized, err := NormalizeArchiveVisibility(visibility)
+	if err != nil {
+		return ArchiveOwnership{}, err
+	}
+	explicit := normalized != ""
+	if !explicit {
+		if normalized, err = NormalizeArchiveVisibility(DefaultArchiveVisibility); err != nil || normalized == "" {
+			normalized = ArchiveVisibilityPublic
+		}
+	}
+
+	ownership := ArchiveOwnership{OwnerID: user.ID, Visibility: normalized}
+	if normalized != ArchiveVisibilityTeam {
+		return ownership, nil
+	}
+
+	ownership.TeamID, err = resolveArchiveTeam(user, teamID)
+	if err != nil {
+		if !explicit && teamID == 0 && errors.Is(err, ErrArchiveTeamRequired) {
+			return ArchiveOwnership{OwnerID: user.ID, Visibility: ArchiveVisibilityPrivate}, nil
+		}
+		return ArchiveOwnership{}, err
+	}
+	return ownership, nil
+}
+
+func resolveArchiveTeam(user *User, teamID uint) (uint, error) {
+	if teamID != 0 {
+		if _, err := getTeam(teamID); err != nil {
+			return 0, err
+		}
+		// 管理员可以把归档放到任意团队
+		if user.HasRole(RoleAdmin) {
+			return teamID, nil
+		}
+		member, err := IsTeamMember(teamID, user.ID)
+		if err != nil {
+			return 0, err
+		}
+		if !member {
+			return 0, ErrNotTeamMember
+		}
+		return teamID, nil
+	}
+
+	teamIDs, err := ListUserTeamIDs(user.ID)
+	if err != nil {
+		return 0, err
+	}
+	if len(teamIDs) != 1 {
+		return 0, ErrArchiveTeamRequired
+	}
+	return teamIDs[0], nil
+}
+
+// SaveArchiveDocument 写入或覆盖归档 HTML 的归属。
+func SaveArchiveDocument(domain, filename string, ownership ArchiveOwnership) error {
+	record := ArchiveDocument{Domain: domain, Filename: filename, ArchiveOwnership: ownership}
+	if err := db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "domain"}, {Name: "filename"}},
+		DoUpdates: clause.AssignmentColumns([]string{"owner_id", "team_id", "visibility", "updated_at"}),
+	}).Create(&record).Error; err != nil {
+		return fmt.Errorf("failed to save archive ownership: %v", err)
+	}
+	return nil
+}
+
+// GetArchiveOwnership 查询归档 HTML 的归属，found 为 false 时返回公开归属。
+func GetArchiveOwnership(domain, filename string) (ArchiveOwnership, bool, error) {
+	var record ArchiveDocument
+	err := db.Where("domain = ? AND filename = ?", domain, filename).First(&record).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return PublicArchiveOwnership(), false, nil
+		}
+		return ArchiveOwnership{}, false, fmt.Errorf("failed to load archive ownership: %v", err)
+	}
+	return record.ArchiveOwnership, true, nil
+}
+
+// ListArchiveOwnerships 返回全部归属记录，键为 "域名/文件名"，用于重建索引。
+func ListArchiveOwnerships() (map[string]ArchiveOwnership, error) {
+	var records []ArchiveDocument
+	if err := db.Find(&records).Error; err != nil {
+		return nil, fmt.Errorf("failed to list archive ownerships: %v", err)
+	}
+	ownerships := make(map[string]ArchiveOwnership, len(records))
+	for _, record := range records {
+		ownerships[ArchiveDocumentKey(record.Domain, record.Filename)] = record.ArchiveOwnership
+	}
+	return ownerships, nil
+}
+
+// ArchiveDocumentKey 返回 ListArchiveOwnerships 使用的键。
+func ArchiveDocumentKey(domain, filename string) string {
+	return domain + "/" + filename
+}
+
+// DeleteArchiveDocumentRecord 删除归档 HTML 的归属记录，记录不存在时不报错。
+func DeleteArchiveDocumentRecord(domain, filename string) error {
+	if err := db.Where("domain = ? AND filename = ?", domain, filename).Delete(&ArchiveDocument{}).Error; err != nil {
+		return fmt.Errorf("failed to delete archive ownership: %v", err)
+	}
+	return nil
+}
+
+// CreateTeam 创建团队，名称不能重复。
+func CreateTeam(name string) (*Team, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len([]rune(name)) > 64 {
+		return nil, ErrInvalidTeamName
+	}
+	var count int64
+	if err := db.Model(&Team{}).Where("name = ?", name).Count(&count).Error; err != nil {
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	if count > 0 {
+		return nil, ErrTeamNameExists
+	}
+	team := &Team{Name: name}
+	if err := db.Create(team).Error; err != nil {
+		return nil, fmt.Errorf("failed to create team: %v", err)
+	}
+	return team, nil
+}
+
+// DeleteTeam 删除团队及其成员关系。
+// 团队归档保留原有归属，此后只有归档者和管理员可以看到。
+func DeleteTeam(teamID uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("team_id = ?", teamID).Delete(&TeamMember{}).Error; err != nil {
+			return fmt.Errorf("failed to delete team members: %v", err)
+		}
+		result := tx.Delete(&Team{}, teamID)
+		if result.Error != nil {
+			return fmt.Errorf("failed to delete team: %v", result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return ErrTeamNotFound
+		}
+		return nil
+	})
+}
+
+// ListTeams 返回全部团队及其成员，按名称排序。
+func ListTeams() ([]TeamSummary, error) {
+	var teams []Team
+	if err := db.Order("name ASC").Find(&teams).Error; err != nil {
+		return nil, fmt.Errorf("failed to list teams: %v", err)
+	}
+	var rows []struct {
+		TeamID   uint
+		UserID   uint
+		Username string
+	}
+	if err := db.Table("team_members").
+		Select("team_members.team_id, team_members.user_id, users.username").
+		Joins("JOIN users ON users.id = team_members.user_id").
+		Order("users.username ASC").
+		Scan(&rows).Error; err != nil {
+		return nil, fmt.Errorf("failed to list team members: %v", err)
+	}
+
+	members := make(map[uint][]TeamMemberSummary)
+	for _, row := range rows {
+		members[row.TeamID] = append(members[row.TeamID], TeamMemberSummary{UserID: row.UserID, Username: row.Username})
+	}
+	summaries := make([]TeamSummary, 0, len(teams))
+	for _, team := range teams {
+		teamMembers := members[team.ID]
+		if teamMembers == nil {
+			teamMembers = []TeamMemberSummary{}
+		}
+		summaries = append(summaries, TeamSummary{Team: team, Members: teamMembers})
+	}
+	return summaries, nil
+}
+
+// ListUserTeams 返回用户所属的团队，供归档时选择团队。
+func ListUserTeams(userID uint) ([]Team, error) {
+	var teams []Team
+	if err := db.Joins("JOIN team_members ON team_members.team_id = teams.id").
+		Where("team_members.user_id = ?", userID).
+		Order("teams.name ASC").
+		Find(&teams).Error; err != nil {
+		return nil, fmt.Errorf("failed to list user teams: %v", err)
+	}
+	return teams, nil
+}
+
+// ListUserTeamIDs 返回用户所属团队的 ID。
+func ListUserTeamIDs(userID uint) ([]uint, error) {
+	var teamIDs []uint
+	if err := db.Model(&TeamMember{}).Where("user_id = ?", userID).Order("team_id ASC").Pluck("team_id", &teamIDs).Error; err != nil {
+		return nil, fmt.Errorf("failed to list user teams: %v", err)
+	}
+	return teamIDs, nil
+}
+
+// IsTeamMember 判断用户是否属于团队。
+func IsTeamMember(teamID, userID uint) (bool, error) {
+	var count int64
+	if err := db.Model(&TeamMember{}).Where("team_id = ? AND user_id = ?", teamID, userID).Count(&count).Error; err != nil {
+		return false, fmt.Errorf("database error: %v", err)
+	}
+	return count > 0, nil
+}
+
+// AddTeamMember 把用户加入团队。
+func AddTeamMember(teamID, userID uint) error {
+	if _, err := getTeam(teamID); err != nil {
+		return err
+	}
+	if _, err := GetUserByID(userID); err != nil {
+		return err
+	}
+	member, err := IsTeamMember(teamID, userID)
+	if err != nil {
+		return err
+	}
+	if member {
+		return ErrTeamMemberExists
+	}
+	if err := db.Create(&TeamMember{TeamID: teamID, UserID: userID}).Error; err != nil {
+		return fmt.Errorf("failed to add team member: %v", err)
+	}
+	return nil
+}
+
+// RemoveTeamMember 把用户移出团队。
+func RemoveTeamMember(teamID, userID uint) error {
+	result := db.Where("team_id = ? AND user_id = ?", teamID, userID).Delete(&TeamMember{})
+	if result.Error != nil {
+		return fmt.Errorf("failed to remove team member: %v", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrTeamMemberNotFound
+	}
+	return nil
+}
+
+func getTeam(teamID uint) (*Team, error) {
+	var team Team
+	if err := db.First(&team, teamID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrTeamNotFound
+		}
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	return &team, nil
+}
@@ -0,0 +1,182 @@
+package common
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestArchiveAccessRules(t *testing.T) {
+	private := ArchiveOwnership{OwnerID: 1, Visibility: ArchiveVisibilityPrivate}
+	team := ArchiveOwnership{OwnerID: 1, TeamID: 7, Visibility: ArchiveVisibilityTeam}
+	public := ArchiveOwnership{OwnerID: 1, Visibility: ArchiveVisibilityPublic}
+	legacy := ArchiveOwnership{}
+
+	owner := ArchiveAccess{UserID: 1}
+	member := ArchiveAccess{UserID: 2, TeamIDs: []uint{7}}
+	stranger := ArchiveAccess{UserID: 3}
+	admin := ArchiveAccess{All: true, UserID: 4}
+
+	cases := []struct {
+		name       string
+		access     ArchiveAccess
+		ownership  ArchiveOwnership
+		wantView   bool
+		wantModify bool
+	}{
+		{"owner private", owner, private, true, true},
+		{"member private", member, private, false, false},
+		{"member team", member, team, true, true},
+		{"stranger team", stranger, team, false, false},
+		{"stranger public", stranger, public, true, false},
+		{"stranger legacy", stranger, legacy, true, true},
+		{"admin private", admin, private, true, true},
+	}
+	for _, tc := range cases {
+		if got := tc.access.CanView(tc.ownership); got != tc.wantView {
+			t.Fatalf("%s: CanView = %v, want %v", tc.name, got, tc.wantView)
+		}
+		if got := tc.access.CanModify(tc.ownership); got != tc.wantModify {
+			t.Fatalf("%s: CanModify = %v, want %v", tc.name, got, tc.wantModify)
+		}
+	}
+}
+
+func TestResolveArchiveOwnership(t *testing.T) {
+	setupSQLiteDB(t)
+	oldDefault := DefaultArchiveVisibility
+	t.Cleanup(func() { DefaultArchiveVisibility = oldDefault })
+
+	alice, err := CreateUserWithRole("alice", "password", RoleEditor)
+	if err != nil {
+		t.Fatalf("CreateUserWithRole returned error: %v", err)
+	}
+	admin, err := CreateUserWithRole("root", "password", RoleAdmin)
+	if err != nil {
+		t.Fatalf("CreateUserWithRole returned error: %v", err)
+	}
+	research, err := CreateTeam("research")
+	if err != nil {
+		t.Fatalf("CreateTeam returned error: %v", err)
+	}
+	ops, err := CreateTeam("ops")
+	if err != nil {
+		t.Fatalf("CreateTeam returned error: %v", err)
+	}
+
+	// 默认 team 但用户不属于任何团队时退回 private，显式指定则报错
+	DefaultArchiveVisibility = ArchiveVisibilityTeam
+	ownership, err := ResolveArchiveOwnership(alice, "", 0)
+	if err != nil || ownership.Visibility != ArchiveVisibilityPrivate || ownership.OwnerID != alice.ID {
+		t.Fatalf("default team without membership = %+v err=%v, want private", ownership, err)
+	}
+	if _, err := ResolveArchiveOwnership(alice, "team", 0); !errors.Is(err, ErrArchiveTeamRequired) {
+		t.Fatalf("explicit team without membership error = %v, want ErrArchiveTeamRequired", err)
+	}
+	if _, err := ResolveArchiveOwnership(alice, "team", ops.ID); !errors.Is(err, ErrNotTeamMember) {
+		t.Fatalf("team of other users error = %v, want ErrNotTeamMember", err)
+	}
+	if _, err := ResolveArchiveOwnership(alice, "secret", 0); !errors.Is(err, ErrInvalidVisibility) {
+		t.Fatalf("invalid visibility error = %v, want ErrInvalidVisibility", err)
+	}
+
+	if err := AddTeamMember(research.ID, alice.ID); err != nil {
+		t.Fatalf("AddTeamMember returned error: %v", err)
+	}
+	ownership, err = ResolveArchiveOwnership(alice, "", 0)
+	if err != nil || ownership.Visibility != ArchiveVisibilityTeam || ownership.TeamID != research.ID {
+		t.Fatalf("default team with one membership = %+v err=%v", ownership, err)
+	}
+	ownership, err = ResolveArchiveOwnership(admin, " TEAM ", ops.ID)
+	if err != nil || ownership.TeamID != ops.ID || ownership.OwnerID != admin.ID {
+		t.Fatalf("admin team ownership = %+v err=%v", ownership, err)
+	}
+
+	access, err := ArchiveAccessForUser(alice)
+	if err != nil || access.All || !access.InTeam(research.ID) || access.InTeam(ops.ID) {
+		t.Fatalf("alice access = %+v err=%v", access, err)
+	}
+}
+
+func TestTeamMembership(t *testing.T) {
+	setupSQLiteDB(t)
+	bob, err := CreateUserWithRole("bob", "password", RoleViewer)
+	if err != nil {
+		t.Fatalf("CreateUserWithRole returned error: %v", err)
+	}
+	team, err := CreateTeam(" research ")
+	if err != nil || team.Name != "research" {
+		t.Fatalf("CreateTeam = %+v err=%v", team, err)
+	}
+	if _, err := CreateTeam("research"); !errors.Is(err, ErrTeamNameExists) {
+		t.Fatalf("duplicate team error = %v, want ErrTeamNameExists", err)
+	}
+	if _, err := CreateTeam(" "); !errors.Is(err, ErrInvalidTeamName) {
+		t.Fatalf("blank team error = %v, want ErrInvalidTeamName", err)
+	}
+
+	if err := AddTeamMember(team.ID, bob.ID); err != nil {
+		t.Fatalf("AddTeamMember returned error: %v", err)
+	}
+	if err := AddTeamMember(team.ID, bob.ID); !errors.Is(err, ErrTeamMemberExists) {
+		t.Fatalf("duplicate member error = %v, want ErrTeamMemberExists", err)
+	}
+	if err := AddTeamMember(team.ID+1, bob.ID); !errors.Is(err, ErrTeamNotFound) {
+		t.Fatalf("missing team error = %v, want ErrTeamNotFound", err)
+	}
+	teams, err := ListTeams()
+	if err != nil || len(teams) != 1 || len(teams[0].Members) != 1 || teams[0].Members[0].Username != "bob" {
+		t.Fatalf("ListTeams = %+v err=%v", teams, err)
+	}
+	mine, err := ListUserTeams(bob.ID)
+	if err != nil || len(mine) != 1 || mine[0].ID != team.ID {
+		t.Fatalf("ListUserTeams = %+v err=%v", mine, err)
+	}
+
+	if err := RemoveTeamMember(team.ID, bob.ID); err != nil {
+		t.Fatalf("RemoveTeamMember returned error: %v", err)
+	}
+	if err := RemoveTeamMember(team.ID, bob.ID); !errors.Is(err, ErrTeamMemberNotFound) {
+		t.Fatalf("remove missing member error = %v, want ErrTeamMemberNotFound", err)
+	}
+	if err := AddTeamMember(team.ID, bob.ID); err != nil {
+		t.Fatalf("AddTeamMember returned error: %v", err)
+	}
+	if err := DeleteTeam(team.ID); err != nil {
+		t.Fatalf("DeleteTeam returned error: %v", err)
+	}
+	if ids, err := ListUserTeamIDs(bob.ID); err != nil || len(ids) != 0 {
+		t.Fatalf("team ids after delete = %v err=%v, want none", ids, err)
+	}
+	if err := DeleteTeam(team.ID); !errors.Is(err, ErrTeamNotFound) {
+		t.Fatalf("delete missing team error = %v, want ErrTeamNotFound", err)
+	}
+}
+
+func TestArchiveDocumentRecords(t *testing.T) {
+	setupSQLiteDB(t)
+
+	ownership, found, err := GetArchiveOwnership("example.com", "a.html")
+	if err != nil || found || ownership.Visibility != ArchiveVisibilityPublic {
+		t.Fatalf("missing record = %+v found=%v err=%v, want public", ownership, found, err)
+	}
+	if err := SaveArchiveDocument("example.com", "a.html", ArchiveOwnership{OwnerID: 1, Visibility: ArchiveVisibilityPrivate}); err != nil {
+		t.Fatalf("SaveArchiveDocument returned error: %v", err)
+	}
+	if err := SaveArchiveDocument("example.com", "a.html", ArchiveOwnership{OwnerID: 1, TeamID: 2, Visibility: ArchiveVisibilityTeam}); err != nil {
+		t.Fatalf("SaveArchiveDocument upsert returned error: %v", err)
+	}
+	ownership, found, err = GetArchiveOwnership("example.com", "a.html")
+	if err != nil || !found || ownership.Visibility != ArchiveVisibilityTeam || ownership.TeamID != 2 {
+		t.Fatalf("saved record = %+v found=%v err=%v", ownership, found, err)
+	}
+	all, err := ListArchiveOwnerships()
+	if err != nil || len(all) != 1 || all[ArchiveDocumentKey("example.com", "a.html")].TeamID != 2 {
+		t.Fatalf("ListArchiveOwnerships = %+v err=%v", all, err)
+	}
+	if err := DeleteArchiveDocumentRecord("example.com", "a.html"); err != nil {
+		t.Fatalf("DeleteArchiveDocumentRecord returned error: %v", err)
+	}
+	if _, found, _ := GetArchiveOwnership("example.com", "a.html"); found {
+		t.Fatal("record should be deleted")
+	}
+}
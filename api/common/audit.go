@@ -0,0 +1,234 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// 审计记录的结果。
+const (
+	AuditOutcomeSuccess = "success"
+	AuditOutcomeFailure = "failure"
+)
+
+// 审计动作。request 由中间件记录每个修改类请求，其它动作由具体操作记录，带有更准确的目标。
+// 登录的每一步（login.password、login.totp、login.oidc）单独记录，login 只在签发正式 Token 时记录。
+const (
+	AuditActionRequest           = "request"
+	AuditActionLogin             = "login"
+	AuditActionLoginPassword     = "login.password"
+	AuditActionLoginTOTP         = "login.totp"
+	AuditActionLoginOIDC         = "login.oidc"
+	AuditActionArchiveDelete     = "archive.delete"
+	AuditActionArchiveVisibility = "archive.visibility"
+	AuditActionBackupCreate      = "backup.create"
+	AuditActionBackupDelete      = "backup.delete"
+	AuditActionBackupRestore     = "backup.restore"
+	AuditActionBackupUpload      = "backup.upload"
+	AuditActionConsistencyRepair = "consistency.repair"
+	AuditActionUserCreate        = "user.create"
+	AuditActionUserUpdate        = "user.update"
+	AuditActionUserDelete        = "user.delete"
+	AuditActionUserPasswordReset = "user.password_reset"
+	AuditActionPasswordChange    = "user.password_change"
+	AuditActionUserLogout        = "user.logout"
+	AuditActionUserTOTPReset     = "user.totp_reset"
+	AuditActionAuditExport       = "audit.export"
+)
+
+// AuditActorSystem 没有登录用户的操作（如启动时的任务）记录的操作者；AuditActorAnonymous 为未登录的请求。
+const (
+	AuditActorSystem    = "system"
+	AuditActorAnonymous = "anonymous"
+)
+
+const (
+	auditTargetMax = 1024
+	auditDetailMax = 2048
+	// 导出时每批读取的记录数
+	auditExportBatchSize = 500
+)
+
+// AuditEvent 审计记录，只追加不修改。
+type AuditEvent struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	ActorID   uint      `json:"actorId" gorm:"index"`
+	Actor     string    `json:"actor" gorm:"size:255;index;not null"`
+	Action    string    `json:"action" gorm:"size:64;index;not null"`
+	Target    string    `json:"target" gorm:"size:1024"`
+	IP        string    `json:"ip" gorm:"size:64"`
+	Outcome   string    `json:"outcome" gorm:"size:16;index;not null"`
+	Detail    string    `json:"detail" gorm:"size:2048"`
+	CreatedAt time.Time `json:"createdAt" gorm:"index"`
+}
+
+// AuditActor 发起操作的用户，由认证中间件放入请求的 context，供下层操作写审计记录。
+type AuditActor struct {
+	UserID   uint
+	Username string
+	IP       string
+}
+
+type auditActorKey struct{}
+
+// WithAuditActor 把操作者放入 context。
+func WithAuditActor(ctx context.Context, actor AuditActor) context.Context {
+	return context.WithValue(ctx, auditActorKey{}, actor)
+}
+
+// AuditActorFromContext 取出 context 中的操作者，没有时返回 system。
+func AuditActorFromContext(ctx context.Context) AuditActor {
+	if ctx != nil {
+		if actor, ok := ctx.Value(auditActorKey{}).(AuditActor); ok {
+			return actor
+		}
+	}
+	return AuditActor{Username: AuditActorSystem}
+}
+
+// RecordAuditEvent 以 context 中的操作者写入一条审计记录，err 非空时记为失败。
+// 审计写入失败只记录日志，不影响操作本身的结果。
+func RecordAuditEvent(ctx context.Context, action, target, detail string, err error) {
+	actor := AuditActorFromContext(ctx)
+	saveAuditEvent(&AuditEvent{
+		ActorID: actor.UserID,
+		Actor:   actor.Username,
+		Action:  action,
+		Target:  target,
+		IP:      actor.IP,
+		Outcome: auditOutcome(err),
+		Detail:  auditDetail(detail, err),
+	})
+}
+
+// recordLoginAudit 记录登录结果，登录时还没有 context 中的操作者，直接使用提交的用户名。
+func recordLoginAudit(action, username, ip string, userID uint, err error) {
+	saveAuditEvent(&AuditEvent{
+		ActorID: userID,
+		Actor:   truncateLoginValue(username),
+		Action:  action,
+		Target:  username,
+		IP:      ip,
+		Outcome: auditOutcome(err),
+		Detail:  auditDetail("", err),
+	})
+}
+
+func saveAuditEvent(event *AuditEvent) {
+	event.Target = truncateAuditValue(event.Target, auditTargetMax)
+	event.Detail = truncateAuditValue(event.Detail, auditDetailMax)
+	if event.Actor == "" {
+		event.Actor = AuditActorSystem
+	}
+	if err := db.Create(event).Error; err != nil {
+		log.Printf("failed to record audit event %s %s: %v", event.Action, event.Target, err)
+	}
+}
+
+func auditOutcome(err error) string {
+	if err != nil {
+		return AuditOutcomeFailure
+	}
+	return AuditOutcomeSuccess
+}
+
+func auditDetail(detail string, err error) string {
+	if err == nil {
+		return detail
+	}
+	if detail == "" {
+		return err.Error()
+	}
+	return detail + ": " + err.Error()
+}
+
+func truncateAuditValue(value string, limit int) string {
+	if len(value) <= limit {
+		return value
+	}
+	// 按 rune 截断，避免写入半个 UTF-8 字符
+	cut := limit
+	for cut > 0 && !isRuneStart(value[cut]) {
+		cut--
+	}
+	return value[:cut]
+}
+
+func isRuneStart(b byte) bool {
+	return b&0xC0 != 0x80
+}
+
+// AuditFilter 查询审计记录的条件，空值表示不过滤。Target 按包含匹配。
+type AuditFilter struct {
+	Actor   string
+	Action  string
+	Outcome string
+	Target  string
+	Since   *time.Time
+	Until   *time.Time
+}
+
+func (f AuditFilter) apply() *gorm.DB {
+	query := db.Model(&AuditEvent{})
+	if f.Actor != "" {
+		query = query.Where("actor = ?", f.Actor)
+	}
+	if f.Action != "" {
+		query = query.Where("action = ?", f.Action)
+	}
+	if f.Outcome != "" {
+		query = query.Where("outcome = ?", f.Outcome)
+	}
+	if f.Target != "" {
+		query = query.Where(`target LIKE ? ESCAPE '\'`, "%"+escapeLike(f.Target)+"%")
+	}
+	if f.Since != nil {
+		query = query.Where("created_at >= ?", *f.Since)
+	}
+	if f.Until != nil {
+		query = query.Where("created_at < ?", *f.Until)
+	}
+	return query
+}
+
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(value)
+}
+
+// ListAuditEvents 按时间倒序分页查询审计记录。
+func ListAuditEvents(filter AuditFilter, page, pageSize int) ([]AuditEvent, int64, error) {
+	var total int64
+	if err := filter.apply().Count(&total).Error; err != nil {
+		return nil, 0, fmt.Errorf("failed to count audit events: %v", err)
+	}
+	var events []AuditEvent
+	if err := filter.apply().Order("id DESC").Offset((page - 1) * pageSize).Limit(pageSize).Find(&events).Error; err != nil {
+		return nil, 0, fmt.Errorf("failed to list audit events: %v", err)
+	}
+	return events, total, nil
+}
+
+// EachAuditEvent 按时间顺序分批遍历符合条件的审计记录，用于导出，fn 返回错误时停止。
+func EachAuditEvent(filter AuditFilter, fn func(AuditEvent) error) error {
+	lastID := uint(0)
+	for {
+		var events []AuditEvent
+		if err := filter.apply().Where("id > ?", lastID).Order("id ASC").Limit(auditExportBatchSize).Find(&events).Error; err != nil {
+			return fmt.Errorf("failed to export audit events: %v", err)
+		}
+		for _, event := range events {
+			if err := fn(event); err != nil {
+				return err
+			}
+		}
+		if len(events) < auditExportBatchSize {
+			return nil
+		}
+		lastID = events[len(events)-1].ID
+	}
+}
@@ -0,0 +1,108 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordAuditEventUsesContextActor(t *testing.T) {
+	setupSQLiteDB(t)
+
+	ctx := WithAuditActor(context.Background(), AuditActor{UserID: 3, Username: "alice", IP: "10.0.0.1"})
+	RecordAuditEvent(ctx, AuditActionArchiveDelete, "/archive/example.com/a.html", "deleted 1 index documents", nil)
+	RecordAuditEvent(context.Background(), AuditActionConsistencyRepair, "archive", "", errors.New("meilisearch unavailable"))
+	RecordAuditEvent(ctx, AuditActionArchiveDelete, strings.Repeat("界", auditTargetMax), "", nil)
+
+	events, total, err := ListAuditEvents(AuditFilter{}, 1, 10)
+	if err != nil || total != 3 {
+		t.Fatalf("events total = %d err=%v, want 3", total, err)
+	}
+	// 按时间倒序返回
+	long, failed, deleted := events[0], events[1], events[2]
+	if deleted.Actor != "alice" || deleted.ActorID != 3 || deleted.IP != "10.0.0.1" || deleted.Outcome != AuditOutcomeSuccess || deleted.Detail != "deleted 1 index documents" {
+		t.Fatalf("unexpected delete event %+v", deleted)
+	}
+	if failed.Actor != AuditActorSystem || failed.Outcome != AuditOutcomeFailure || failed.Detail != "meilisearch unavailable" {
+		t.Fatalf("unexpected failure event %+v", failed)
+	}
+	if len(long.Target) > auditTargetMax || !strings.HasPrefix(strings.Repeat("界", auditTargetMax), long.Target) {
+		t.Fatalf("target should be truncated on a rune boundary, got %d bytes", len(long.Target))
+	}
+}
+
+func TestListAuditEventsFilters(t *testing.T) {
+	setupSQLiteDB(t)
+	alice := WithAuditActor(context.Background(), AuditActor{UserID: 1, Username: "alice"})
+	bob := WithAuditActor(context.Background(), AuditActor{UserID: 2, Username: "bob"})
+	RecordAuditEvent(alice, AuditActionArchiveDelete, "/archive/example.com/100%.html", "", nil)
+	RecordAuditEvent(alice, AuditActionArchiveDelete, "/archive/example.com/1000.html", "", errors.New("not found"))
+	RecordAuditEvent(bob, AuditActionBackupRestore, "backup.zip", "", nil)
+
+	cases := []struct {
+		name   string
+		filter AuditFilter
+		want   int64
+	}{
+		{"actor", AuditFilter{Actor: "alice"}, 2},
+		{"action", AuditFilter{Action: AuditActionBackupRestore}, 1},
+		{"outcome", AuditFilter{Outcome: AuditOutcomeFailure}, 1},
+		{"target wildcard is literal", AuditFilter{Target: "100%"}, 1},
+		{"target substring", AuditFilter{Target: "example.com"}, 2},
+	}
+	for _, tc := range cases {
+		if _, total, err := ListAuditEvents(tc.filter, 1, 10); err != nil || total != tc.want {
+			t.Fatalf("%s: total = %d err=%v, want %d", tc.name, total, err, tc.want)
+		}
+	}
+
+	future := time.Now().Add(time.Hour)
+	if _, total, err := ListAuditEvents(AuditFilter{Since: &future}, 1, 10); err != nil || total != 0 {
+		t.Fatalf("since future total = %d err=%v, want 0", total, err)
+	}
+	if _, total, err := ListAuditEvents(AuditFilter{Until: &future}, 1, 10); err != nil || total != 3 {
+		t.Fatalf("until future total = %d err=%v, want 3", total, err)
+	}
+
+	var exported []string
+	if err := EachAuditEvent(AuditFilter{Actor: "alice"}, func(event AuditEvent) error {
+		exported = append(exported, event.Target)
+		return nil
+	}); err != nil {
+		t.Fatalf("EachAuditEvent returned error: %v", err)
+	}
+	if strings.Join(exported, ",") != "/archive/example.com/100%.html,/archive/example.com/1000.html" {
+		t.Fatalf("exported = %v, want alice's events in order", exported)
+	}
+}
+
+func TestLoginWritesAuditEvents(t *testing.T) {
+	setupSQLiteDB(t)
+	if _, err := CreateUserWithRole("alice", "password", RoleViewer); err != nil {
+		t.Fatalf("CreateUserWithRole returned error: %v", err)
+	}
+
+	if _, err := LoginWithToken("alice", "wrong", "10.0.0.1"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("wrong password error = %v", err)
+	}
+	if _, err := LoginWithToken("alice", "password", "10.0.0.1"); err != nil {
+		t.Fatalf("LoginWithToken returned error: %v", err)
+	}
+
+	events, total, err := ListAuditEvents(AuditFilter{Action: AuditActionLoginPassword}, 1, 10)
+	if err != nil || total != 2 {
+		t.Fatalf("password events total = %d err=%v, want 2", total, err)
+	}
+	if events[0].Outcome != AuditOutcomeSuccess || events[0].ActorID == 0 || events[0].IP != "10.0.0.1" {
+		t.Fatalf("unexpected success event %+v", events[0])
+	}
+	if events[1].Outcome != AuditOutcomeFailure || events[1].Actor != "alice" {
+		t.Fatalf("unexpected failure event %+v", events[1])
+	}
+	events, total, err = ListAuditEvents(AuditFilter{Action: AuditActionLogin}, 1, 10)
+	if err != nil || total != 1 || events[0].Outcome != AuditOutcomeSuccess || events[0].Actor != "alice" {
+		t.Fatalf("login events = %+v total = %d err=%v, want one success", events, total, err)
+	}
+}
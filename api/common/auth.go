@@ -4,31 +4,61 @@ import (
 	"errors"
 	"fmt"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"log"
 	"strconv"
 	"time"
 )
 
-// JWT配置
+// JWT配置，签名密钥见 jwt_keys.go
 var (
-	// JWT密钥，生产环境中应该从环境变量或配置文件中读取
-	jwtSecret = []byte(MEILIAPIKey)
 	// Token过期时间
 	tokenExpiration = time.Hour * 24 * 7 // 7天
+	// 密码校验通过后等待输入两步验证码的中间 Token 有效期
+	mfaTokenExpiration = 5 * time.Minute
+)
+
+// tokenPurposeMFA 中间 Token 的用途，只能用于提交两步验证码，不能访问其它接口。
+const tokenPurposeMFA = "mfa"
+
+var (
+	ErrTokenRevoked = errors.New("token has been revoked")
+	// ErrTokenNotRevocable 表示 Token 签发于支持吊销之前，没有 jti，只能通过注销全部会话失效。
+	ErrTokenNotRevocable = errors.New("token has no id and cannot be revoked individually")
+	ErrMFATokenInvalid   = errors.New("two-factor login session is invalid or expired")
 )
 
 // Claims JWT载荷结构
+// RegisteredClaims.ID 即 jti，用于单个 Token 的吊销；TokenVersion 与用户当前的版本号不一致时 Token 失效。
+// MFA 表示签发时通过了两步验证；Purpose 非空的是登录过程中的中间 Token，不能作为会话使用。
 type Claims struct {
-	UserID   uint   `json:"user_id"`
-	Username string `json:"username"`
-	Email    string `json:"email"`
+	UserID       uint   `json:"user_id"`
+	Username     string `json:"username"`
+	Email        string `json:"email"`
+	TokenVersion uint   `json:"token_version"`
+	MFA          bool   `json:"mfa,omitempty"`
+	Purpose      string `json:"purpose,omitempty"`
 	jwt.RegisteredClaims
 }
 
+// RevokedToken 已吊销的 Token，只保存到 Token 原本的过期时间，过期后由 CleanupRevokedTokens 清理。
+type RevokedToken struct {
+	JTI       string    `json:"jti" gorm:"primaryKey;size:36"`
+	UserID    uint      `json:"userId" gorm:"index;not null"`
+	ExpiresAt time.Time `json:"expiresAt" gorm:"index;not null"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
 // TokenResponse 返回给客户端的Token结构
+// 用户启用了两步验证时，密码登录只返回 MFAToken，提交验证码后才签发正式 Token。
 type TokenResponse struct {
-	Token     string    `json:"token"`
-	ExpiresAt time.Time `json:"expires_at"`
-	User      *User     `json:"user"`
+	Token       string    `json:"token,omitempty"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	User        *User     `json:"user"`
+	MFARequired bool      `json:"mfa_required,omitempty"`
+	MFAToken    string    `json:"mfa_token,omitempty"`
 }
 
 // SetTokenExpiration 设置Token过期时间
@@ -38,6 +68,11 @@ func SetTokenExpiration(duration time.Duration) {
 
 // GenerateToken 生成JWT Token
 func GenerateToken(user *User) (*TokenResponse, error) {
+	return generateSessionToken(user, false)
+}
+
+// generateSessionToken 生成会话 Token，mfa 表示本次登录是否通过了两步验证。
+func generateSessionToken(user *User, mfa bool) (*TokenResponse, error) {
 	if user == nil {
 		return nil, errors.New("user cannot be nil")
 	}
@@ -47,9 +82,12 @@ func GenerateToken(user *User) (*TokenResponse, error) {
 
 	// 创建Claims
 	claims := &Claims{
-		UserID:   user.ID,
-		Username: user.Username,
+		UserID:       user.ID,
+		Username:     user.Username,
+		TokenVersion: user.TokenVersion,
+		MFA:          mfa,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			NotBefore: jwt.NewNumericDate(time.Now()),
@@ -58,11 +96,8 @@ func GenerateToken(user *User) (*TokenResponse, error) {
 		},
 	}
 
-	// 创建Token
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-
-	// 签名Token
-	tokenString, err := token.SignedString(jwtSecret)
+	// 创建并签名Token
+	tokenString, err := signJWT(claims)
 	if err != nil {
 		return nil, fmt.Errorf("failed to sign token: %v", err)
 	}
@@ -74,20 +109,27 @@ func GenerateToken(user *User) (*TokenResponse, error) {
 	}, nil
 }
 
-// ValidateToken 验证JWT Token
+// ValidateToken 验证JWT Token，登录过程中的中间 Token 不会通过校验
 func ValidateToken(tokenString string) (*Claims, error) {
+	claims, err := parseToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Purpose != "" {
+		return nil, errors.New("invalid token purpose")
+	}
+	return claims, nil
+}
+
+// parseToken 校验签名和有效期并解析 Claims，不检查用途。
+func parseToken(tokenString string) (*Claims, error) {
 	if tokenString == "" {
 		return nil, errors.New("token is required")
 	}
 
 	// 解析Token
-	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		// 验证签名方法
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return jwtSecret, nil
-	})
+	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, jwtVerificationKey,
+		jwt.WithValidMethods([]string{JWTAlgorithmHS256, JWTAlgorithmEdDSA}))
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse token: %v", err)
@@ -107,7 +149,7 @@ func ValidateToken(tokenString string) (*Claims, error) {
 	return claims, nil
 }
 
-// RefreshToken 刷新Token
+// RefreshToken 刷新Token，新 Token 签发后旧 Token 立即吊销
 func RefreshToken(tokenString string) (*TokenResponse, error) {
 	// 验证当前Token
 	claims, err := ValidateToken(tokenString)
@@ -125,9 +167,21 @@ func RefreshToken(tokenString string) (*TokenResponse, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to get user: %v", err)
 	}
+	if err := CheckTokenActive(claims, user); err != nil {
+		return nil, err
+	}
 
-	// 生成新Token
-	return GenerateToken(user)
+	// 生成新Token，保留原会话的两步验证状态
+	tokenResponse, err := generateSessionToken(user, claims.MFA)
+	if err != nil {
+		return nil, err
+	}
+	if claims.ID != "" {
+		if err := RevokeTokenClaims(claims); err != nil {
+			return nil, err
+		}
+	}
+	return tokenResponse, nil
 }
 
 // ExtractTokenFromHeader 从Authorization header中提取Token
@@ -185,42 +239,236 @@ func GetTokenRemainingTime(tokenString string) (time.Duration, error) {
 	return remaining, nil
 }
 
-// RevokeToken 撤销Token（在实际应用中，你可能需要维护一个黑名单）
+// RevokeToken 撤销Token
 func RevokeToken(tokenString string) error {
 	// 验证Token是否有效
-	_, err := ValidateToken(tokenString)
+	claims, err := ValidateToken(tokenString)
 	if err != nil {
 		return fmt.Errorf("invalid token: %v", err)
 	}
+	return RevokeTokenClaims(claims)
+}
+
+// RevokeTokenClaims 把 Token 的 jti 写入吊销列表，并顺带清理已经过期的记录。
+func RevokeTokenClaims(claims *Claims) error {
+	if claims == nil || claims.ID == "" {
+		return ErrTokenNotRevocable
+	}
+	expiresAt := time.Now().Add(tokenExpiration)
+	if claims.ExpiresAt != nil {
+		expiresAt = claims.ExpiresAt.Time
+	}
+
+	revoked := RevokedToken{JTI: claims.ID, UserID: claims.UserID, ExpiresAt: expiresAt}
+	if err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&revoked).Error; err != nil {
+		return fmt.Errorf("failed to revoke token: %v", err)
+	}
+	if _, err := CleanupRevokedTokens(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// IsTokenRevoked 检查 jti 是否在吊销列表中，没有 jti 的旧 Token 视为未吊销。
+func IsTokenRevoked(jti string) (bool, error) {
+	if jti == "" {
+		return false, nil
+	}
+	var count int64
+	if err := db.Model(&RevokedToken{}).Where("jti = ?", jti).Count(&count).Error; err != nil {
+		return false, fmt.Errorf("failed to check revoked token: %v", err)
+	}
+	return count > 0, nil
+}
+
+// CleanupRevokedTokens 删除已经过期的吊销记录，过期的 Token 本身就无法通过校验，不需要继续保存。
+func CleanupRevokedTokens() (int64, error) {
+	result := db.Where("expires_at < ?", time.Now()).Delete(&RevokedToken{})
+	if result.Error != nil {
+		return 0, fmt.Errorf("failed to cleanup revoked tokens: %v", result.Error)
+	}
+	return result.RowsAffected, nil
+}
 
-	// 在实际应用中，你应该将Token添加到黑名单中
-	// 这里只是一个示例，实际实现可能需要Redis或数据库来存储黑名单
-	// 例如：addToBlacklist(tokenString)
+// RevokeAllUserTokens 递增用户的 Token 版本号，使该用户此前签发的全部 Token 失效，
+// 同时删除该用户的全部 API Token。重置密码、注销全部会话和重置两步验证都经过这里。
+func RevokeAllUserTokens(userID uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&User{}).Where("id = ?", userID).UpdateColumn("token_version", gorm.Expr("token_version + 1"))
+		if result.Error != nil {
+			return fmt.Errorf("failed to revoke user tokens: %v", result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return ErrUserNotFound
+		}
+		if err := tx.Where("user_id = ?", userID).Delete(&APIToken{}).Error; err != nil {
+			return fmt.Errorf("failed to revoke user api tokens: %v", err)
+		}
+		return nil
+	})
+}
 
+// CheckTokenActive 检查已通过签名校验的 Token 是否仍然有效：版本号必须与用户当前一致且 jti 未被吊销。
+func CheckTokenActive(claims *Claims, user *User) error {
+	if claims.TokenVersion != user.TokenVersion {
+		return ErrTokenRevoked
+	}
+	revoked, err := IsTokenRevoked(claims.ID)
+	if err != nil {
+		return err
+	}
+	if revoked {
+		return ErrTokenRevoked
+	}
 	return nil
 }
 
-// LoginWithToken 使用用户名密码登录并生成Token
-func LoginWithToken(username, password string) (*TokenResponse, error) {
+// LoginWithToken 使用用户名密码登录并生成Token，连续失败过多时返回 *LoginThrottledError
+func LoginWithToken(username, password, clientIP string) (*TokenResponse, error) {
+	if err := beginLoginAttempt(username, clientIP, time.Now()); err != nil {
+		var throttled *LoginThrottledError
+		if errors.As(err, &throttled) {
+			if auditErr := finishLoginAttempt(username, clientIP, err); auditErr != nil {
+				log.Println(auditErr)
+			}
+			recordLoginAudit(AuditActionLoginPassword, username, clientIP, 0, err)
+		}
+		return nil, err
+	}
+
 	// 验证用户登录
 	user, err := LoginUser(username, password)
+	if auditErr := finishLoginAttempt(username, clientIP, err); auditErr != nil {
+		log.Println(auditErr)
+	}
 	if err != nil {
+		recordLoginAudit(AuditActionLoginPassword, username, clientIP, 0, err)
 		return nil, err
 	}
+	recordLoginAudit(AuditActionLoginPassword, username, clientIP, user.ID, nil)
+
+	return completeLogin(user, clientIP)
+}
+
+// completeLogin 第一步认证通过后签发 Token，启用了两步验证的用户只拿到中间 Token，
+// 签发正式 Token 时才记录 login 审计。
+func completeLogin(user *User, clientIP string) (*TokenResponse, error) {
+	if user.TOTPEnabled {
+		return generateMFAToken(user)
+	}
 
 	// 生成Token
 	tokenResponse, err := GenerateToken(user)
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate token: %v", err)
+		err = fmt.Errorf("failed to generate token: %v", err)
+	}
+	recordLoginAudit(AuditActionLogin, user.Username, clientIP, user.ID, err)
+	if err != nil {
+		return nil, err
 	}
 
 	return tokenResponse, nil
 }
 
-// RegisterWithToken 用户注册并生成Token
-func RegisterWithToken(username, password string) (*TokenResponse, error) {
+// generateMFAToken 生成等待两步验证的中间 Token。
+func generateMFAToken(user *User) (*TokenResponse, error) {
+	now := time.Now()
+	expirationTime := now.Add(mfaTokenExpiration)
+	claims := &Claims{
+		UserID:       user.ID,
+		Username:     user.Username,
+		TokenVersion: user.TokenVersion,
+		Purpose:      tokenPurposeMFA,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
+			ExpiresAt: jwt.NewNumericDate(expirationTime),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			Issuer:    "echoark",
+			Subject:   strconv.Itoa(int(user.ID)),
+		},
+	}
+	tokenString, err := signJWT(claims)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign token: %v", err)
+	}
+	return &TokenResponse{
+		ExpiresAt:   expirationTime,
+		User:        user,
+		MFARequired: true,
+		MFAToken:    tokenString,
+	}, nil
+}
+
+// LoginWithTOTP 用中间 Token 和验证码（或恢复码）完成登录，验证码错误同样计入登录失败次数。
+func LoginWithTOTP(mfaToken, code, clientIP string) (*TokenResponse, error) {
+	claims, err := parseToken(mfaToken)
+	if err != nil || claims.Purpose != tokenPurposeMFA {
+		return nil, ErrMFATokenInvalid
+	}
+	user, err := GetUserByID(claims.UserID)
+	if err != nil {
+		if errors.Is(err, ErrUserNotFound) {
+			return nil, ErrMFATokenInvalid
+		}
+		return nil, err
+	}
+	if err := CheckTokenActive(claims, user); err != nil {
+		return nil, ErrMFATokenInvalid
+	}
+
+	if err := beginLoginAttempt(user.Username, clientIP, time.Now()); err != nil {
+		var throttled *LoginThrottledError
+		if errors.As(err, &throttled) {
+			if auditErr := finishLoginAttempt(user.Username, clientIP, err); auditErr != nil {
+				log.Println(auditErr)
+			}
+			recordLoginAudit(AuditActionLoginTOTP, user.Username, clientIP, user.ID, err)
+		}
+		return nil, err
+	}
+	err = verifyLoginSecondFactor(user, code)
+	if auditErr := finishLoginAttempt(user.Username, clientIP, err); auditErr != nil {
+		log.Println(auditErr)
+	}
+	recordLoginAudit(AuditActionLoginTOTP, user.Username, clientIP, user.ID, err)
+	if err != nil {
+		return nil, err
+	}
+
+	// 中间 Token 只能使用一次
+	if err := RevokeTokenClaims(claims); err != nil {
+		return nil, err
+	}
+	tokenResponse, err := generateSessionToken(user, true)
+	if err != nil {
+		err = fmt.Errorf("failed to generate token: %v", err)
+	}
+	recordLoginAudit(AuditActionLogin, user.Username, clientIP, user.ID, err)
+	if err != nil {
+		return nil, err
+	}
+	return tokenResponse, nil
+}
+
+// verifyLoginSecondFactor 校验登录时的第二因素，验证码错误按密码错误处理以便计入失败审计。
+func verifyLoginSecondFactor(user *User, code string) error {
+	if user.Disabled {
+		return ErrUserDisabled
+	}
+	if err := VerifySecondFactor(user.ID, code); err != nil {
+		if errors.Is(err, ErrInvalidTOTPCode) || errors.Is(err, ErrTOTPNotEnabled) {
+			return fmt.Errorf("%w: %v", ErrInvalidCredentials, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// RegisterWithToken 创建指定角色的用户并生成Token
+func RegisterWithToken(username, password, role string) (*TokenResponse, error) {
 	// 创建用户
-	user, err := CreateUser(username, password)
+	user, err := CreateUserWithRole(username, password, role)
 	if err != nil {
 		return nil, err
 	}
@@ -1,12 +1,14 @@
 package common
 
 import (
+	"errors"
 	"strings"
 	"testing"
 	"time"
 )
 
 func TestGenerateValidateAndRevokeToken(t *testing.T) {
+	setupSQLiteDB(t)
 	oldExpiration := tokenExpiration
 	t.Cleanup(func() {
 		tokenExpiration = oldExpiration
@@ -26,7 +28,7 @@ func TestGenerateValidateAndRevokeToken(t *testing.T) {
 	if err != nil {
 		t.Fatalf("ValidateToken returned error: %v", err)
 	}
-	if claims.UserID != 42 || claims.Username != "alice" {
+	if claims.UserID != 42 || claims.Username != "alice" || claims.ID == "" {
 		t.Fatalf("unexpected claims: %#v", claims)
 	}
 	if IsTokenExpired(tokenResponse.Token) {
@@ -42,6 +44,71 @@ func TestGenerateValidateAndRevokeToken(t *testing.T) {
 	if err := RevokeToken(tokenResponse.Token); err != nil {
 		t.Fatalf("RevokeToken returned error: %v", err)
 	}
+	if err := RevokeToken(tokenResponse.Token); err != nil {
+		t.Fatalf("revoking twice returned error: %v", err)
+	}
+	if err := CheckTokenActive(claims, user); !errors.Is(err, ErrTokenRevoked) {
+		t.Fatalf("CheckTokenActive err = %v, want ErrTokenRevoked", err)
+	}
+	if err := RevokeTokenClaims(&Claims{UserID: 42}); !errors.Is(err, ErrTokenNotRevocable) {
+		t.Fatalf("legacy token revoke err = %v, want ErrTokenNotRevocable", err)
+	}
+}
+
+func TestRevokedTokenCleanupAndLogoutAll(t *testing.T) {
+	setupSQLiteDB(t)
+
+	if err := db.Create(&RevokedToken{JTI: "old", UserID: 1, ExpiresAt: time.Now().Add(-time.Hour)}).Error; err != nil {
+		t.Fatalf("create expired revoked token: %v", err)
+	}
+	if err := db.Create(&RevokedToken{JTI: "live", UserID: 1, ExpiresAt: time.Now().Add(time.Hour)}).Error; err != nil {
+		t.Fatalf("create live revoked token: %v", err)
+	}
+	removed, err := CleanupRevokedTokens()
+	if err != nil || removed != 1 {
+		t.Fatalf("CleanupRevokedTokens = %d, %v; want 1", removed, err)
+	}
+	if revoked, err := IsTokenRevoked("live"); err != nil || !revoked {
+		t.Fatalf("live token revoked = %v, %v", revoked, err)
+	}
+
+	user, err := CreateUser("session-user", "secret123")
+	if err != nil {
+		t.Fatalf("CreateUser returned error: %v", err)
+	}
+	issued, err := GenerateToken(user)
+	if err != nil {
+		t.Fatalf("GenerateToken returned error: %v", err)
+	}
+	claims, err := ValidateToken(issued.Token)
+	if err != nil {
+		t.Fatalf("ValidateToken returned error: %v", err)
+	}
+	if err := CheckTokenActive(claims, user); err != nil {
+		t.Fatalf("fresh token should be active: %v", err)
+	}
+
+	if err := RevokeAllUserTokens(user.ID); err != nil {
+		t.Fatalf("RevokeAllUserTokens returned error: %v", err)
+	}
+	reloaded, err := GetUserByID(user.ID)
+	if err != nil {
+		t.Fatalf("GetUserByID returned error: %v", err)
+	}
+	if err := CheckTokenActive(claims, reloaded); !errors.Is(err, ErrTokenRevoked) {
+		t.Fatalf("token after logout all err = %v, want ErrTokenRevoked", err)
+	}
+	reissued, err := GenerateToken(reloaded)
+	if err != nil {
+		t.Fatalf("GenerateToken returned error: %v", err)
+	}
+	reissuedClaims, _ := ValidateToken(reissued.Token)
+	if err := CheckTokenActive(reissuedClaims, reloaded); err != nil {
+		t.Fatalf("token issued after logout all should be active: %v", err)
+	}
+	if err := RevokeAllUserTokens(9999); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("missing user err = %v, want ErrUserNotFound", err)
+	}
 }
 
 func TestTokenErrorBranches(t *testing.T) {
@@ -112,15 +179,15 @@ func TestTokenDatabaseHelpers(t *testing.T) {
 	})
 
 	SetTokenExpiration(10 * time.Minute)
-	registered, err := RegisterWithToken("token-user", "secret123")
+	registered, err := RegisterWithToken("token-user", "secret123", RoleEditor)
 	if err != nil {
 		t.Fatalf("RegisterWithToken returned error: %v", err)
 	}
-	if registered.Token == "" || registered.User.Username != "token-user" {
+	if registered.Token == "" || registered.User.Username != "token-user" || registered.User.Role != RoleEditor {
 		t.Fatalf("registered = %#v", registered)
 	}
 
-	loggedIn, err := LoginWithToken("token-user", "secret123")
+	loggedIn, err := LoginWithToken("token-user", "secret123", "127.0.0.1")
 	if err != nil {
 		t.Fatalf("LoginWithToken returned error: %v", err)
 	}
@@ -143,6 +210,9 @@ func TestTokenDatabaseHelpers(t *testing.T) {
 	if refreshed.Token == "" {
 		t.Fatal("RefreshToken should return a new token")
 	}
+	if _, err := RefreshToken(loggedIn.Token); !errors.Is(err, ErrTokenRevoked) {
+		t.Fatalf("refreshing a rotated token err = %v, want ErrTokenRevoked", err)
+	}
 	if _, err := RefreshToken("bad-token"); err == nil {
 		t.Fatal("RefreshToken invalid token should fail")
 	}
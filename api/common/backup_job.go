@@ -0,0 +1,70 @@
+package common
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// BackupJob 后台执行的备份或恢复任务。
+// 和 ArchiveTask 一样持久化到数据库，请求返回后仍然可以查询进度和结果；
+// 进程退出时正在执行的任务无法继续，启动时标记为失败。
+type BackupJob struct {
+	ID     string `json:"id" gorm:"primaryKey;size:36"`
+	Kind   string `json:"kind" gorm:"size:16;index;not null"`
+	Status string `json:"status" gorm:"size:16;index;not null"`
+	// Phase 为当前阶段，Percent 为整体进度，BytesDone/BytesTotal 为当前阶段已处理和需要处理的字节数。
+	Phase      string `json:"phase" gorm:"size:32"`
+	Percent    int    `json:"percent" gorm:"not null;default:0"`
+	BytesDone  int64  `json:"bytesDone" gorm:"not null;default:0"`
+	BytesTotal int64  `json:"bytesTotal" gorm:"not null;default:0"`
+	// FileName 备份任务为生成的 zip 文件名，恢复任务为上传的备份文件名。
+	FileName  string          `json:"fileName"`
+	FileSize  int64           `json:"fileSize" gorm:"not null;default:0"`
+	DryRun    bool            `json:"dryRun" gorm:"not null;default:false"`
+	Result    json.RawMessage `json:"result,omitempty" gorm:"type:text;serializer:json"`
+	Error     string          `json:"error" gorm:"type:text"`
+	CreatedBy string          `json:"createdBy"`
+	CreatedAt time.Time       `json:"createdAt"`
+	UpdatedAt time.Time       `json:"updatedAt"`
+	// CancelRequested 记录已请求取消，任务在下一个可以安全停止的位置结束。
+	CancelRequested bool       `json:"cancelRequested" gorm:"not null;default:false"`
+	StartedAt       *time.Time `json:"startedAt"`
+	FinishedAt      *time.Time `json:"finishedAt"`
+}
+
+func CreateBackupJob(job *BackupJob) error {
+	return db.Create(job).Error
+}
+
+func SaveBackupJob(job *BackupJob) error {
+	return db.Save(job).Error
+}
+
+func GetBackupJobByID(id string) (*BackupJob, error) {
+	var job BackupJob
+	if err := db.First(&job, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// ListBackupJobs 按创建时间倒序返回最近的 limit 个任务。
+func ListBackupJobs(limit int) ([]BackupJob, error) {
+	var jobs []BackupJob
+	if err := db.Order("created_at desc").Limit(limit).Find(&jobs).Error; err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+func ListBackupJobsByStatuses(statuses []string) ([]BackupJob, error) {
+	var jobs []BackupJob
+	if err := db.Where("status IN ?", statuses).Order("created_at asc").Find(&jobs).Error; err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+func DeleteBackupJob(id string) error {
+	return db.Delete(&BackupJob{}, "id = ?", id).Error
+}
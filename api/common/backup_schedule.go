@@ -0,0 +1,59 @@
+package common
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// backupScheduleID 定时备份配置只有一行。
+const backupScheduleID = 1
+
+// BackupSchedule 定时备份配置。Schedule 为 cron 表达式，为空时不定时备份；
+// KeepLast、KeepDaily、KeepWeekly 为保留策略，全部为 0 时保留所有备份。
+// 管理员通过接口保存后以数据库为准，否则使用 -backupschedule 等启动参数。
+type BackupSchedule struct {
+	ID         uint      `json:"-" gorm:"primaryKey"`
+	Schedule   string    `json:"schedule" gorm:"size:128"`
+	KeepLast   int       `json:"keepLast" gorm:"not null;default:0"`
+	KeepDaily  int       `json:"keepDaily" gorm:"not null;default:0"`
+	KeepWeekly int       `json:"keepWeekly" gorm:"not null;default:0"`
+	UpdatedBy  string    `json:"updatedBy"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+// DefaultBackupSchedule 返回启动参数中的定时备份配置。
+func DefaultBackupSchedule() BackupSchedule {
+	return BackupSchedule{
+		Schedule:   BackupScheduleSpec,
+		KeepLast:   BackupKeepLast,
+		KeepDaily:  BackupKeepDaily,
+		KeepWeekly: BackupKeepWeekly,
+	}
+}
+
+// GetBackupSchedule 返回当前生效的定时备份配置，没有保存过时返回启动参数中的配置。
+func GetBackupSchedule() (BackupSchedule, error) {
+	var schedule BackupSchedule
+	err := db.First(&schedule, backupScheduleID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return DefaultBackupSchedule(), nil
+	}
+	if err != nil {
+		return BackupSchedule{}, err
+	}
+	return schedule, nil
+}
+
+// SaveBackupSchedule 保存定时备份配置，之后不再使用启动参数中的配置。
+func SaveBackupSchedule(schedule BackupSchedule, updatedBy string) (BackupSchedule, error) {
+	schedule.ID = backupScheduleID
+	schedule.UpdatedBy = updatedBy
+	schedule.UpdatedAt = time.Now()
+	if err := db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&schedule).Error; err != nil {
+		return BackupSchedule{}, err
+	}
+	return schedule, nil
+}
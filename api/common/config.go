@@ -1,15 +1,88 @@
 package common
 
+import "time"
+
+// JWTSecretEnv 是 -jwtsecret 的环境变量，避免密钥出现在进程参数里。
+const JWTSecretEnv = "DATAARK_JWT_SECRET"
+
+// OIDCClientSecretEnv 是 -oidcsecret 的环境变量。
+const OIDCClientSecretEnv = "DATAARK_OIDC_CLIENT_SECRET"
+
+// BackupTargetsEnv 是 -backuptargets 的环境变量，目标地址中可能带有密码或访问密钥。
+const BackupTargetsEnv = "DATAARK_BACKUP_TARGETS"
+
+// BackupPassphraseEnv 是 -backuppassphrase 的环境变量。
+const BackupPassphraseEnv = "DATAARK_BACKUP_PASSPHRASE"
+
 var DEBUG = false
 var MEILIHOST = ""
 var MEILIAPIKey = ""
 var MEILIDumpDir = "./dumps"
 var MEILIBlogsIndex = "blogs"
+var SearchEngine = SearchEngineMeilisearch
+var SearchIndexDir = "./search_index"
+var EmbedderType = EmbedderNone
+var EmbedderURL = ""
+var EmbedderModel = ""
+var EmbedderAPIKey = ""
 var HTMLPath = ""
 var ARCHIVEFILELOACTION = ""
+var DBDriver = DBDriverPostgres
+var DBPath = "./dataark.db"
 var DBHost = "localhost"
 var DBPort = "5432"
 var DBName = ""
 var DBUser = ""
 var DBPassword = ""
 var SINGLEFILEWEBSERVICEURL = "http://singlefile-webservice:8080"
+var JWTSecret = ""
+var JWTKeyFile = "./jwt_keys.json"
+var JWTAlgorithm = JWTAlgorithmHS256
+var OIDCIssuer = ""
+var OIDCClientID = ""
+var OIDCClientSecret = ""
+var OIDCRedirectURL = ""
+var OIDCScopes = "openid profile email"
+var OIDCUsernameClaim = "preferred_username"
+var OIDCGroupsClaim = "groups"
+var OIDCRoleMapping = ""
+var OIDCDefaultRole = RoleViewer
+var OIDCAutoProvision = true
+var OIDCLinkByUsername = false
+var LoginLockoutAttempts = 10
+var LoginLockoutDuration = 15 * time.Minute
+var DefaultArchiveVisibility = ArchiveVisibilityPublic
+var BackupDir = "./backups"
+var BackupScheduleSpec = ""
+var BackupKeepLast = 0
+var BackupKeepDaily = 0
+var BackupKeepWeekly = 0
+var BackupTargets = ""
+var BackupPassphrase = ""
+var BackupRecipients = ""
+var BackupIdentityFile = ""
+var BackupDatabaseFormat = BackupDatabaseFormatJSONL
+var BackupUploadMaxMB int64 = 20480
+var GenerateBackupKey = false
+
+const (
+	SearchEngineMeilisearch = "meilisearch"
+	SearchEngineEmbedded    = "embedded"
+)
+
+const (
+	DBDriverPostgres = "postgres"
+	DBDriverSQLite   = "sqlite"
+)
+
+// 备份中数据库的格式：jsonl 是不依赖外部工具的逻辑导出，native 是 pg_dump 导出或 SQLite 快照。
+const (
+	BackupDatabaseFormatJSONL  = "jsonl"
+	BackupDatabaseFormatNative = "native"
+)
+
+const (
+	EmbedderNone  = "none"
+	EmbedderLocal = "local"
+	EmbedderHTTP  = "http"
+)
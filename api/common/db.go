@@ -16,30 +16,46 @@ import (
 
 var db *gorm.DB
 
+var (
+	ErrUserNotFound       = errors.New("user not found")
+	ErrUsernameExists     = errors.New("username already exists")
+	ErrUserDisabled       = errors.New("user is disabled")
+	ErrInvalidCredentials = errors.New("invalid user or password")
+	// ErrLastAdmin 阻止删除、禁用或降级最后一个可用的管理员，避免没有人能再管理系统。
+	ErrLastAdmin = errors.New("at least one enabled admin is required")
+)
+
 // User 用户模型
 type User struct {
-	ID        uint      `json:"id" gorm:"primaryKey"`
-	Username  string    `json:"username" gorm:"unique;not null"`
-	Password  string    `json:"-" gorm:"not null"` // json:"-" 表示不会在JSON序列化中包含密码
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID           uint      `json:"id" gorm:"primaryKey"`
+	Username     string    `json:"username" gorm:"unique;not null"`
+	Password     string    `json:"-" gorm:"not null"` // json:"-" 表示不会在JSON序列化中包含密码
+	Role         string    `json:"role" gorm:"size:16;not null;default:viewer"`
+	Disabled     bool      `json:"disabled" gorm:"not null;default:false"`
+	TokenVersion uint      `json:"-" gorm:"not null;default:0"` // 注销全部会话时递增，与 Token 中的版本号不一致即失效
+	TOTPSecret   string    `json:"-" gorm:"column:totp_secret;size:64"`
+	TOTPEnabled  bool      `json:"totpEnabled" gorm:"column:totp_enabled;not null;default:false"`
+	TOTPLastStep int64     `json:"-" gorm:"column:totp_last_step;not null;default:0"` // 最近一次使用的验证码时间步，防止重放
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
 }
 
 // ArchiveTask HTML 离线归档任务。
 // 这里把任务状态持久化到数据库，而不是只放在内存里，
 // 是因为链接离线本身是异步过程，服务重启后仍然需要恢复未完成任务。
 type ArchiveTask struct {
-	ID             string     `json:"id" gorm:"primaryKey;size:36"`
-	URL            string     `json:"url" gorm:"index;not null"`
-	Domain         string     `json:"domain" gorm:"not null"`
-	Status         string     `json:"status" gorm:"index;not null"`
-	FileName       string     `json:"fileName"`
-	Error          string     `json:"error" gorm:"type:text"`
-	ExternalTaskID string     `json:"externalTaskId"`
-	CreatedAt      time.Time  `json:"createdAt"`
-	UpdatedAt      time.Time  `json:"updatedAt"`
-	StartedAt      *time.Time `json:"startedAt"`
-	FinishedAt     *time.Time `json:"finishedAt"`
+	ID             string `json:"id" gorm:"primaryKey;size:36"`
+	URL            string `json:"url" gorm:"index;not null"`
+	Domain         string `json:"domain" gorm:"not null"`
+	Status         string `json:"status" gorm:"index;not null"`
+	FileName       string `json:"fileName"`
+	Error          string `json:"error" gorm:"type:text"`
+	ExternalTaskID string `json:"externalTaskId"`
+	ArchiveOwnership
+	CreatedAt  time.Time  `json:"createdAt"`
+	UpdatedAt  time.Time  `json:"updatedAt"`
+	StartedAt  *time.Time `json:"startedAt"`
+	FinishedAt *time.Time `json:"finishedAt"`
 }
 
 // ArchiveStat HTML 归档统计。
@@ -65,20 +81,59 @@ type ArchiveStatItem struct {
 
 func InitDB() {
 	var err error
-	dsn := fmt.Sprintf("host=%s user=%s password=%s dbname=%s port=%s sslmode=disable TimeZone=Asia/Shanghai",
-		DBHost, DBUser, DBPassword, DBName, DBPort)
-	db, err = gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	db, err = openDatabase()
 	if err != nil {
 		log.Fatal("failed to connect to the database", err)
 	}
 	// fmt.Println("Database connected successfully!")
 
-	// 自动迁移数据库表
-	err = db.AutoMigrate(&User{}, &ArchiveTask{}, &ArchiveStat{})
+	err = migrateDatabase(db)
 	if err != nil {
 		log.Fatal("failed to migrate database", err)
 	}
 	createDefaultAdmin()
+	if _, err := CleanupRevokedTokens(); err != nil {
+		log.Println("failed to cleanup revoked tokens:", err)
+	}
+	if _, err := CleanupLoginFailures(); err != nil {
+		log.Println(err)
+	}
+}
+
+// migrateDatabase 自动迁移数据库表，并补齐旧版本升级时需要的数据。
+func migrateDatabase(database *gorm.DB) error {
+	// 角色字段是后加的，升级前的用户都会得到默认的 viewer，
+	// 只在新增字段的这一次把内置的 admin 账号提升为管理员，之后管理员可以自行调整。
+	hadRoleColumn := database.Migrator().HasTable(&User{}) && database.Migrator().HasColumn(&User{}, "Role")
+
+	if err := database.AutoMigrate(databaseModels...); err != nil {
+		return err
+	}
+
+	if !hadRoleColumn {
+		if err := database.Model(&User{}).Where("username = ?", "admin").Update("role", RoleAdmin).Error; err != nil {
+			return fmt.Errorf("failed to migrate admin role: %w", err)
+		}
+	}
+	return nil
+}
+
+func openDatabase() (*gorm.DB, error) {
+	switch DBDriver {
+	case "", DBDriverPostgres:
+		dsn := fmt.Sprintf("host=%s user=%s password=%s dbname=%s port=%s sslmode=disable TimeZone=Asia/Shanghai",
+			DBHost, DBUser, DBPassword, DBName, DBPort)
+		return gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	case DBDriverSQLite:
+		return openSQLiteDatabase(DBPath)
+	default:
+		return nil, fmt.Errorf("unsupported database driver %q", DBDriver)
+	}
+}
+
+// IsSQLite 表示当前是否使用内嵌 SQLite 数据库。
+func IsSQLite() bool {
+	return DBDriver == DBDriverSQLite
 }
 
 func createDefaultAdmin() {
@@ -87,7 +142,7 @@ func createDefaultAdmin() {
 		log.Fatal("failed to generate random password", err)
 	}
 	randomPassword := hex.EncodeToString(bytes)
-	user, err := CreateUser("admin", randomPassword)
+	user, err := CreateUserWithRole("admin", randomPassword, RoleAdmin)
 	// admin user exists
 	if user == nil && err == nil {
 		return
@@ -117,15 +172,25 @@ func checkPassword(password, hash string) bool {
 	return err == nil
 }
 
-// CreateUser 创建用户（注册）
+// CreateUser 创建 viewer 角色的用户（注册）
 func CreateUser(username, password string) (*User, error) {
+	return CreateUserWithRole(username, password, RoleViewer)
+}
+
+// CreateUserWithRole 创建指定角色的用户
+func CreateUserWithRole(username, password, role string) (*User, error) {
+	role, err := NormalizeRole(role)
+	if err != nil {
+		return nil, err
+	}
+
 	// 检查用户名是否已存在
 	var existingUser User
 	if err := db.Where("username = ?", username).First(&existingUser).Error; err == nil {
 		if username == "admin" {
 			return nil, nil
 		}
-		return nil, fmt.Errorf("username already exists")
+		return nil, ErrUsernameExists
 	}
 
 	// 加密密码
@@ -138,6 +203,7 @@ func CreateUser(username, password string) (*User, error) {
 	user := User{
 		Username: username,
 		Password: hashedPassword,
+		Role:     role,
 	}
 
 	if err := db.Create(&user).Error; err != nil {
@@ -154,14 +220,17 @@ func LoginUser(username, password string) (*User, error) {
 	// 查找用户
 	if err := db.Where("username = ?", username).First(&user).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
-			return nil, fmt.Errorf("invalid user or password")
+			return nil, ErrInvalidCredentials
 		}
 		return nil, fmt.Errorf("database error: %v", err)
 	}
 
 	// 验证密码
 	if !checkPassword(password, user.Password) {
-		return nil, fmt.Errorf("invalid user or password")
+		return nil, ErrInvalidCredentials
+	}
+	if user.Disabled {
+		return nil, ErrUserDisabled
 	}
 
 	return &user, nil
@@ -172,7 +241,7 @@ func GetUserByID(id uint) (*User, error) {
 	var user User
 	if err := db.First(&user, id).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
-			return nil, fmt.Errorf("user not found")
+			return nil, ErrUserNotFound
 		}
 		return nil, fmt.Errorf("database error: %v", err)
 	}
@@ -184,7 +253,7 @@ func GetUserByUsername(username string) (*User, error) {
 	var user User
 	if err := db.Where("username = ?", username).First(&user).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
-			return nil, fmt.Errorf("user not found")
+			return nil, ErrUserNotFound
 		}
 		return nil, fmt.Errorf("database error: %v", err)
 	}
@@ -196,7 +265,7 @@ func UpdateUser(id uint, updates map[string]interface{}) (*User, error) {
 	var user User
 	if err := db.First(&user, id).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
-			return nil, fmt.Errorf("user not found")
+			return nil, ErrUserNotFound
 		}
 		return nil, fmt.Errorf("database error: %v", err)
 	}
@@ -217,10 +286,127 @@ func UpdateUser(id uint, updates map[string]interface{}) (*User, error) {
 	return &user, nil
 }
 
-// DeleteUser 删除用户
+// DeleteUser 删除用户，不允许删除最后一个可用的管理员
 func DeleteUser(id uint) error {
-	if err := db.Delete(&User{}, id).Error; err != nil {
-		return fmt.Errorf("failed to delete user: %v", err)
+	return db.Transaction(func(tx *gorm.DB) error {
+		var user User
+		if err := tx.First(&user, id).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return ErrUserNotFound
+			}
+			return fmt.Errorf("database error: %v", err)
+		}
+		if err := ensureOtherEnabledAdmin(tx, &user); err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", id).Delete(&APIToken{}).Error; err != nil {
+			return fmt.Errorf("failed to delete user api tokens: %v", err)
+		}
+		if err := tx.Where("user_id = ?", id).Delete(&UserIdentity{}).Error; err != nil {
+			return fmt.Errorf("failed to delete user identities: %v", err)
+		}
+		if err := tx.Where("user_id = ?", id).Delete(&RecoveryCode{}).Error; err != nil {
+			return fmt.Errorf("failed to delete recovery codes: %v", err)
+		}
+		if err := tx.Where("user_id = ?", id).Delete(&TeamMember{}).Error; err != nil {
+			return fmt.Errorf("failed to delete team memberships: %v", err)
+		}
+		if err := tx.Delete(&User{}, id).Error; err != nil {
+			return fmt.Errorf("failed to delete user: %v", err)
+		}
+		return nil
+	})
+}
+
+// UpdateUserAccount 修改用户角色或禁用状态，nil 表示不修改该项。
+// 降级或禁用最后一个可用的管理员会返回 ErrLastAdmin。
+func UpdateUserAccount(id uint, role *string, disabled *bool) (*User, error) {
+	var user User
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&user, id).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return ErrUserNotFound
+			}
+			return fmt.Errorf("database error: %v", err)
+		}
+
+		updates := make(map[string]interface{})
+		if role != nil {
+			normalizedRole, err := NormalizeRole(*role)
+			if err != nil {
+				return err
+			}
+			updates["role"] = normalizedRole
+		}
+		if disabled != nil {
+			updates["disabled"] = *disabled
+		}
+		if len(updates) == 0 {
+			return nil
+		}
+
+		losesAdmin := (role != nil && updates["role"] != RoleAdmin) || (disabled != nil && *disabled)
+		if losesAdmin {
+			if err := ensureOtherEnabledAdmin(tx, &user); err != nil {
+				return err
+			}
+		}
+		if err := tx.Model(&user).Updates(updates).Error; err != nil {
+			return fmt.Errorf("failed to update user: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// ResetUserPassword 由管理员直接设置新密码，不需要原密码。
+// 重置密码通常意味着账号可能泄露，同时注销该用户的全部会话。
+func ResetUserPassword(id uint, newPassword string) error {
+	if _, err := UpdateUser(id, map[string]interface{}{"password": newPassword}); err != nil {
+		return err
+	}
+	return RevokeAllUserTokens(id)
+}
+
+// ChangeUserPassword 用户自行修改密码，必须提供正确的当前密码。
+// 修改后注销该用户的全部会话，并为当前会话签发新 Token，mfa 保留当前会话的两步验证状态。
+func ChangeUserPassword(id uint, currentPassword, newPassword string, mfa bool) (*TokenResponse, error) {
+	user, err := GetUserByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if !checkPassword(currentPassword, user.Password) {
+		return nil, ErrInvalidCredentials
+	}
+	if _, err := UpdateUser(id, map[string]interface{}{"password": newPassword}); err != nil {
+		return nil, err
+	}
+	if err := RevokeAllUserTokens(id); err != nil {
+		return nil, err
+	}
+	user, err = GetUserByID(id)
+	if err != nil {
+		return nil, err
+	}
+	return generateSessionToken(user, mfa)
+}
+
+// ensureOtherEnabledAdmin 在 user 是可用管理员时确认还存在其它可用管理员。
+func ensureOtherEnabledAdmin(tx *gorm.DB, user *User) error {
+	if user.Role != RoleAdmin || user.Disabled {
+		return nil
+	}
+	var otherAdmins int64
+	if err := tx.Model(&User{}).
+		Where("role = ? AND disabled = ? AND id <> ?", RoleAdmin, false, user.ID).
+		Count(&otherAdmins).Error; err != nil {
+		return fmt.Errorf("failed to count admins: %v", err)
+	}
+	if otherAdmins == 0 {
+		return ErrLastAdmin
 	}
 	return nil
 }
@@ -237,7 +423,7 @@ func GetAllUsers(page, pageSize int) ([]User, int64, error) {
 
 	// 分页查询
 	offset := (page - 1) * pageSize
-	if err := db.Offset(offset).Limit(pageSize).Find(&users).Error; err != nil {
+	if err := db.Order("id").Offset(offset).Limit(pageSize).Find(&users).Error; err != nil {
 		return nil, 0, fmt.Errorf("failed to get users: %v", err)
 	}
 
@@ -260,17 +446,18 @@ func GetArchiveTaskByID(id string) (*ArchiveTask, error) {
 	return &task, nil
 }
 
-func GetLatestArchiveTaskByURL(rawURL string) (*ArchiveTask, error) {
+// GetLatestArchiveTaskByURL 返回同一归属下该 URL 最近的任务，不同用户或可见范围的归档互不复用。
+func GetLatestArchiveTaskByURL(rawURL string, ownership ArchiveOwnership) (*ArchiveTask, error) {
 	var task ArchiveTask
-	if err := db.Where("url = ?", rawURL).Order("created_at desc").First(&task).Error; err != nil {
+	if err := archiveTasksOwnedBy(ownership).Where("url = ?", rawURL).Order("created_at desc").First(&task).Error; err != nil {
 		return nil, err
 	}
 	return &task, nil
 }
 
-func FindActiveArchiveTaskByURL(rawURL string) (*ArchiveTask, error) {
+func FindActiveArchiveTaskByURL(rawURL string, ownership ArchiveOwnership) (*ArchiveTask, error) {
 	var task ArchiveTask
-	if err := db.Where("url = ? AND status IN ?", rawURL, []string{"pending", "running"}).
+	if err := archiveTasksOwnedBy(ownership).Where("url = ? AND status IN ?", rawURL, []string{"pending", "running"}).
 		Order("created_at desc").
 		First(&task).Error; err != nil {
 		return nil, err
@@ -278,6 +465,10 @@ func FindActiveArchiveTaskByURL(rawURL string) (*ArchiveTask, error) {
 	return &task, nil
 }
 
+func archiveTasksOwnedBy(ownership ArchiveOwnership) *gorm.DB {
+	return db.Where("owner_id = ? AND team_id = ? AND visibility = ?", ownership.OwnerID, ownership.TeamID, ownership.Visibility)
+}
+
 func ListArchiveTasksByStatuses(statuses []string) ([]ArchiveTask, error) {
 	var tasks []ArchiveTask
 	if err := db.Where("status IN ?", statuses).Order("created_at asc").Find(&tasks).Error; err != nil {
@@ -0,0 +1,573 @@
+package common
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+const (
+	// DatabaseExportFormat 写在导出文件第一行，用来识别 DataArk 的数据库导出。
+	DatabaseExportFormat = "dataark-db-export"
+	// DatabaseExportVersion 是导出格式的版本，表结构出现不能自动兼容的变化（改名、拆分、改类型）时加一，
+	// 并在 databaseExportMigrations 中登记从上一个版本升级的迁移。
+	DatabaseExportVersion = 1
+)
+
+const (
+	exportLineTable = "table"
+	exportLineRow   = "row"
+	exportLineEnd   = "end"
+
+	importBatchSize = 200
+)
+
+var (
+	ErrDatabaseExportFormat  = errors.New("not a DataArk database export")
+	ErrDatabaseExportVersion = errors.New("unsupported database export version")
+)
+
+// databaseModels 是 DataArk 自己的全部表。迁移、导出和导入都使用这个列表，新增的表加在这里就会被备份；
+// 导入时按顺序写入、按逆序清空。
+var databaseModels = []interface{}{
+	&User{}, &ArchiveTask{}, &ArchiveStat{}, &SearchIndexSetting{}, &RevokedToken{}, &APIToken{}, &UserIdentity{},
+	&LoginThrottle{}, &LoginFailure{}, &RecoveryCode{}, &AuditEvent{}, &Team{}, &TeamMember{}, &ArchiveDocument{},
+	&BackupSchedule{}, &BackupJob{},
+}
+
+// importKeptModels 是导入时保留当前内容的表，导出文件中这些表的行被忽略。
+// 审计记录只追加不修改，恢复旧备份不能抹掉备份之后的记录，恢复本身也记录在其后；
+// 吊销记录和 API Token 同样以当前为准，备份之后吊销或删除的 Token 不能因为恢复重新生效。
+// PostgreSQL 的 SQL 转储由 psql 整体替换，不经过这里。
+var importKeptModels = []interface{}{&AuditEvent{}, &RevokedToken{}, &APIToken{}}
+
+// DatabaseExportHeader 是导出文件的第一行。
+type DatabaseExportHeader struct {
+	Format    string `json:"format"`
+	Version   int    `json:"version"`
+	Driver    string `json:"driver"`
+	CreatedAt string `json:"createdAt"`
+}
+
+// exportLine 是导出文件中第一行之后的每一行：table 行声明一张表和它的列，row 行是一行数据，
+// 最后的 end 行记录每张表的行数，没有 end 行或行数不符说明文件被截断。
+type exportLine struct {
+	Type    string                     `json:"type"`
+	Table   string                     `json:"table,omitempty"`
+	Columns []string                   `json:"columns,omitempty"`
+	Row     map[string]json.RawMessage `json:"row,omitempty"`
+	Rows    map[string]int64           `json:"rows,omitempty"`
+}
+
+// DatabaseExportSummary 是导出文件的版本和迁移到当前版本后每张表的行数。
+type DatabaseExportSummary struct {
+	Version   int
+	TableRows map[string]int64
+}
+
+// exportMigration 把一行从版本 n 升级到 n+1，可以修改表名、列名和值；返回 false 时丢弃这一行。
+type exportMigration func(line *exportLine) (bool, error)
+
+// databaseExportMigrations[n] 把版本 n 的导出升级到 n+1。
+// 只新增表或列不需要迁移：导入时缺少的列使用数据库默认值，已经删除的表和列直接忽略。
+var databaseExportMigrations = map[int]exportMigration{}
+
+// exportTable 是一张表的 gorm schema 和可以导出的列。
+type exportTable struct {
+	model   interface{}
+	schema  *schema.Schema
+	columns []*schema.Field
+	// kept 为 true 时导入保留当前内容，见 importKeptModels
+	kept bool
+}
+
+// ExportDatabase 把 DataArk 的全部表以 JSON lines 写入 w，不依赖 pg_dump，SQLite 和 PostgreSQL 使用相同的格式。
+// 所有表在同一个只读事务中读取，得到的是某一时刻的一致数据。
+func ExportDatabase(ctx context.Context, w io.Writer) (*DatabaseExportSummary, error) {
+	tables, err := databaseExportTables()
+	if err != nil {
+		return nil, err
+	}
+
+	writer := bufio.NewWriterSize(w, 1<<20)
+	encoder := json.NewEncoder(writer)
+	encoder.SetEscapeHTML(false)
+	header := DatabaseExportHeader{
+		Format:    DatabaseExportFormat,
+		Version:   DatabaseExportVersion,
+		Driver:    db.Dialector.Name(),
+		CreatedAt: time.Now().Format(time.RFC3339),
+	}
+	if err := encoder.Encode(header); err != nil {
+		return nil, err
+	}
+
+	summary := &DatabaseExportSummary{Version: DatabaseExportVersion, TableRows: make(map[string]int64, len(tables))}
+	err = db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for _, table := range tables {
+			count, err := exportTableRows(tx, encoder, table)
+			if err != nil {
+				return fmt.Errorf("export table %s: %w", table.schema.Table, err)
+			}
+			summary.TableRows[table.schema.Table] = count
+		}
+		return nil
+	}, exportTxOptions(db))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := encoder.Encode(exportLine{Type: exportLineEnd, Rows: summary.TableRows}); err != nil {
+		return nil, err
+	}
+	if err := writer.Flush(); err != nil {
+		return nil, err
+	}
+	return summary, nil
+}
+
+// exportTxOptions 在 PostgreSQL 上使用可重复读的只读事务；SQLite 的读事务本身就是一致快照。
+func exportTxOptions(conn *gorm.DB) *sql.TxOptions {
+	if conn.Dialector.Name() != DBDriverPostgres {
+		return nil
+	}
+	return &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true}
+}
+
+func exportTableRows(tx *gorm.DB, encoder *json.Encoder, table *exportTable) (int64, error) {
+	columnNames := make([]string, len(table.columns))
+	for i, field := range table.columns {
+		columnNames[i] = field.DBName
+	}
+	if err := encoder.Encode(exportLine{Type: exportLineTable, Table: table.schema.Table, Columns: columnNames}); err != nil {
+		return 0, err
+	}
+
+	query := tx.Model(table.model)
+	for _, primaryKey := range table.schema.PrimaryFieldDBNames {
+		query = query.Order(clause.OrderByColumn{Column: clause.Column{Name: primaryKey}})
+	}
+	rows, err := query.Rows()
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var count int64
+	for rows.Next() {
+		record := reflect.New(table.schema.ModelType)
+		if err := tx.ScanRows(rows, record.Interface()); err != nil {
+			return count, err
+		}
+		row := make(map[string]json.RawMessage, len(table.columns))
+		for _, field := range table.columns {
+			encoded, err := json.Marshal(record.Elem().FieldByIndex(field.StructField.Index).Interface())
+			if err != nil {
+				return count, fmt.Errorf("column %s: %w", field.DBName, err)
+			}
+			row[field.DBName] = encoded
+		}
+		if err := encoder.Encode(exportLine{Type: exportLineRow, Table: table.schema.Table, Row: row}); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, rows.Err()
+}
+
+// ImportDatabase 用导出文件替换 DataArk 各表的内容（importKeptModels 中的表除外），旧版本的导出先迁移到当前版本。
+// 整个导入在一个事务里完成，文件损坏或写入失败时数据库保持原样。
+func ImportDatabase(ctx context.Context, path string) (*DatabaseExportSummary, error) {
+	// 先完整读一遍，确认文件没有截断、版本可以迁移，再开始改动数据库
+	if _, err := InspectDatabaseExport(path); err != nil {
+		return nil, err
+	}
+	tables, err := databaseExportTables()
+	if err != nil {
+		return nil, err
+	}
+	tablesByName := make(map[string]*exportTable, len(tables))
+	for _, table := range tables {
+		tablesByName[table.schema.Table] = table
+	}
+
+	var summary *DatabaseExportSummary
+	err = db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		versions, err := liveTokenVersions(tx)
+		if err != nil {
+			return err
+		}
+		for i := len(tables) - 1; i >= 0; i-- {
+			if tables[i].kept {
+				continue
+			}
+			if err := tx.Exec("DELETE FROM ?", clause.Table{Name: tables[i].schema.Table}).Error; err != nil {
+				return fmt.Errorf("clear table %s: %w", tables[i].schema.Table, err)
+			}
+		}
+
+		importer := &tableImporter{tx: tx}
+		summary, err = readDatabaseExport(path, func(line *exportLine) error {
+			if line.Type == exportLineTable {
+				if err := importer.flush(); err != nil {
+					return err
+				}
+				table := tablesByName[line.Table]
+				if table != nil && table.kept {
+					table = nil
+				}
+				importer.begin(table, line.Columns)
+				return nil
+			}
+			return importer.add(line.Row)
+		})
+		if err != nil {
+			return err
+		}
+		if err := importer.flush(); err != nil {
+			return err
+		}
+		if err := keepLiveAuthState(tx, versions); err != nil {
+			return err
+		}
+		if tx.Dialector.Name() == DBDriverPostgres {
+			return resetPostgresSequences(tx, tables)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return summary, nil
+}
+
+// liveTokenVersions 在恢复前读取每个用户当前的 token_version。
+func liveTokenVersions(tx *gorm.DB) (map[uint]uint, error) {
+	var users []User
+	if err := tx.Model(&User{}).Select("id", "token_version").Find(&users).Error; err != nil {
+		return nil, fmt.Errorf("read token versions: %w", err)
+	}
+	versions := make(map[uint]uint, len(users))
+	for _, user := range users {
+		versions[user.ID] = user.TokenVersion
+	}
+	return versions, nil
+}
+
+// keepLiveAuthState 在恢复后把 token_version 改回恢复前和备份中较大的一个，备份之后注销的会话不会重新生效；
+// 保留下来的 API Token 中所属用户不在恢复后数据库中的一并删除。
+func keepLiveAuthState(tx *gorm.DB, versions map[uint]uint) error {
+	for userID, version := range versions {
+		err := tx.Model(&User{}).Where("id = ? AND token_version < ?", userID, version).
+			Update("token_version", version).Error
+		if err != nil {
+			return fmt.Errorf("keep token version of user %d: %w", userID, err)
+		}
+	}
+	if err := tx.Exec("DELETE FROM api_tokens WHERE user_id NOT IN (SELECT id FROM users)").Error; err != nil {
+		return fmt.Errorf("delete api tokens of missing users: %w", err)
+	}
+	return nil
+}
+
+// tableImporter 把同一张表的行攒成一批写入，只写入导出中存在的列，其余列使用数据库默认值。
+type tableImporter struct {
+	tx      *gorm.DB
+	table   *exportTable
+	columns []string
+	batch   reflect.Value
+}
+
+func (i *tableImporter) begin(table *exportTable, columns []string) {
+	i.table = table
+	i.columns = i.columns[:0]
+	if table == nil {
+		return
+	}
+	for _, column := range columns {
+		if field := table.schema.LookUpField(column); field != nil && field.DBName != "" && field.Creatable {
+			i.columns = append(i.columns, field.DBName)
+		}
+	}
+	i.batch = reflect.MakeSlice(reflect.SliceOf(reflect.PointerTo(table.schema.ModelType)), 0, importBatchSize)
+}
+
+func (i *tableImporter) add(row map[string]json.RawMessage) error {
+	if i.table == nil || len(i.columns) == 0 {
+		return nil
+	}
+	record, err := decodeExportRow(i.table, row)
+	if err != nil {
+		return err
+	}
+	i.batch = reflect.Append(i.batch, record)
+	if i.batch.Len() >= importBatchSize {
+		return i.flush()
+	}
+	return nil
+}
+
+func (i *tableImporter) flush() error {
+	if i.table == nil || i.batch.Len() == 0 {
+		return nil
+	}
+	if err := i.tx.Select(i.columns).Create(i.batch.Interface()).Error; err != nil {
+		return fmt.Errorf("import table %s: %w", i.table.schema.Table, err)
+	}
+	i.batch = i.batch.Slice(0, 0)
+	return nil
+}
+
+// decodeExportRow 按模型字段的类型解码一行，未知的列忽略。
+func decodeExportRow(table *exportTable, row map[string]json.RawMessage) (reflect.Value, error) {
+	record := reflect.New(table.schema.ModelType)
+	for column, raw := range row {
+		field := table.schema.LookUpField(column)
+		if field == nil || field.DBName == "" {
+			continue
+		}
+		value := reflect.New(field.FieldType)
+		if err := json.Unmarshal(raw, value.Interface()); err != nil {
+			return reflect.Value{}, fmt.Errorf("table %s column %s: %w", table.schema.Table, column, err)
+		}
+		record.Elem().FieldByIndex(field.StructField.Index).Set(value.Elem())
+	}
+	return record, nil
+}
+
+// resetPostgresSequences 让自增主键从导入的最大值之后继续，否则之后新建的记录会和导入的主键冲突。
+func resetPostgresSequences(tx *gorm.DB, tables []*exportTable) error {
+	for _, table := range tables {
+		field := table.schema.PrioritizedPrimaryField
+		if field == nil || !field.AutoIncrement {
+			continue
+		}
+		statement := fmt.Sprintf("SELECT setval(pg_get_serial_sequence('%s', '%s'), COALESCE(MAX(%s), 0) + 1, false) FROM %s",
+			table.schema.Table, field.DBName, tx.Statement.Quote(field.DBName), tx.Statement.Quote(table.schema.Table))
+		if err := tx.Exec(statement).Error; err != nil {
+			return fmt.Errorf("reset sequence of %s: %w", table.schema.Table, err)
+		}
+	}
+	return nil
+}
+
+// InspectDatabaseExport 不改动数据库检查导出文件：格式和版本、每一行能否解析，以及 end 行中的行数是否一致。
+func InspectDatabaseExport(path string) (*DatabaseExportSummary, error) {
+	tables, err := databaseExportTables()
+	if err != nil {
+		return nil, err
+	}
+	tablesByName := make(map[string]*exportTable, len(tables))
+	for _, table := range tables {
+		tablesByName[table.schema.Table] = table
+	}
+	var current *exportTable
+	return readDatabaseExport(path, func(line *exportLine) error {
+		if line.Type == exportLineTable {
+			current = tablesByName[line.Table]
+			return nil
+		}
+		if current == nil {
+			return nil
+		}
+		_, err := decodeExportRow(current, line.Row)
+		return err
+	})
+}
+
+// ReadExportArchiveOwnerships 读取导出文件中的归档归属，键与 ListArchiveOwnerships 相同。
+func ReadExportArchiveOwnerships(path string) (map[string]ArchiveOwnership, error) {
+	table, err := newExportTable(&ArchiveDocument{})
+	if err != nil {
+		return nil, err
+	}
+	ownerships := make(map[string]ArchiveOwnership)
+	inTable := false
+	_, err = readDatabaseExport(path, func(line *exportLine) error {
+		if line.Type == exportLineTable {
+			inTable = line.Table == table.schema.Table
+			return nil
+		}
+		if !inTable {
+			return nil
+		}
+		record, err := decodeExportRow(table, line.Row)
+		if err != nil {
+			return err
+		}
+		document := record.Interface().(*ArchiveDocument)
+		ownerships[ArchiveDocumentKey(document.Domain, document.Filename)] = document.ArchiveOwnership
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("read archive ownerships from export: %w", err)
+	}
+	return ownerships, nil
+}
+
+// readDatabaseExport 逐行读取导出文件，把 table 和 row 行迁移到当前版本后交给 onLine，迁移丢弃的行不会传入。
+// 读到 end 行后核对行数，文件在 end 行之前结束或之后还有内容都视为损坏。
+func readDatabaseExport(path string, onLine func(line *exportLine) error) (*DatabaseExportSummary, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(bufio.NewReaderSize(file, 1<<20))
+	var header DatabaseExportHeader
+	if err := decoder.Decode(&header); err != nil || header.Format != DatabaseExportFormat {
+		return nil, ErrDatabaseExportFormat
+	}
+	migrations, err := exportMigrationsFrom(header.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &DatabaseExportSummary{Version: header.Version, TableRows: make(map[string]int64)}
+	rawCounts := make(map[string]int64)
+	declared := make(map[string]bool)
+	for lineNumber := 2; ; lineNumber++ {
+		var line exportLine
+		if err := decoder.Decode(&line); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, errors.New("database export is truncated: missing end line")
+			}
+			return nil, fmt.Errorf("database export line %d: %w", lineNumber, err)
+		}
+
+		switch line.Type {
+		case exportLineTable:
+			if line.Table == "" || declared[line.Table] {
+				return nil, fmt.Errorf("database export line %d: invalid table %q", lineNumber, line.Table)
+			}
+			declared[line.Table] = true
+			rawCounts[line.Table] = 0
+		case exportLineRow:
+			if !declared[line.Table] {
+				return nil, fmt.Errorf("database export line %d: row of undeclared table %q", lineNumber, line.Table)
+			}
+			rawCounts[line.Table]++
+		case exportLineEnd:
+			if err := checkExportRowCounts(line.Rows, rawCounts); err != nil {
+				return nil, err
+			}
+			var extra json.RawMessage
+			if err := decoder.Decode(&extra); !errors.Is(err, io.EOF) {
+				return nil, errors.New("database export has data after the end line")
+			}
+			return summary, nil
+		default:
+			return nil, fmt.Errorf("database export line %d: unknown line type %q", lineNumber, line.Type)
+		}
+
+		keep := true
+		for _, migrate := range migrations {
+			if keep, err = migrate(&line); err != nil {
+				return nil, fmt.Errorf("database export line %d: migrate: %w", lineNumber, err)
+			}
+			if !keep {
+				break
+			}
+		}
+		if !keep {
+			continue
+		}
+		if _, ok := summary.TableRows[line.Table]; !ok {
+			summary.TableRows[line.Table] = 0
+		}
+		if line.Type == exportLineRow {
+			summary.TableRows[line.Table]++
+		}
+		if onLine != nil {
+			if err := onLine(&line); err != nil {
+				return nil, fmt.Errorf("database export line %d: %w", lineNumber, err)
+			}
+		}
+	}
+}
+
+// exportMigrationsFrom 返回从 version 升级到当前版本需要依次执行的迁移。
+func exportMigrationsFrom(version int) ([]exportMigration, error) {
+	if version > DatabaseExportVersion {
+		return nil, fmt.Errorf("%w: %d is newer than this server (%d)", ErrDatabaseExportVersion, version, DatabaseExportVersion)
+	}
+	migrations := make([]exportMigration, 0, DatabaseExportVersion-version)
+	for from := version; from < DatabaseExportVersion; from++ {
+		migration, ok := databaseExportMigrations[from]
+		if !ok {
+			return nil, fmt.Errorf("%w: no migration from version %d", ErrDatabaseExportVersion, from)
+		}
+		migrations = append(migrations, migration)
+	}
+	return migrations, nil
+}
+
+func checkExportRowCounts(expected map[string]int64, actual map[string]int64) error {
+	for table, count := range actual {
+		if expected[table] != count {
+			return fmt.Errorf("database export table %s has %d rows, end line records %d", table, count, expected[table])
+		}
+	}
+	for table, count := range expected {
+		if _, ok := actual[table]; !ok && count != 0 {
+			return fmt.Errorf("database export table %s is missing, end line records %d rows", table, count)
+		}
+	}
+	return nil
+}
+
+// importKeptTables 返回导入时保留当前内容的表名，SQLite 快照恢复也跳过这些表。
+func importKeptTables() (map[string]bool, error) {
+	kept := make(map[string]bool, len(importKeptModels))
+	for _, model := range importKeptModels {
+		table, err := newExportTable(model)
+		if err != nil {
+			return nil, err
+		}
+		kept[table.schema.Table] = true
+	}
+	return kept, nil
+}
+
+func databaseExportTables() ([]*exportTable, error) {
+	tables := make([]*exportTable, 0, len(databaseModels))
+	for _, model := range databaseModels {
+		table, err := newExportTable(model)
+		if err != nil {
+			return nil, err
+		}
+		tables = append(tables, table)
+	}
+	return tables, nil
+}
+
+func newExportTable(model interface{}) (*exportTable, error) {
+	statement := &gorm.Statement{DB: db}
+	if err := statement.Parse(model); err != nil {
+		return nil, err
+	}
+	table := &exportTable{model: model, schema: statement.Schema}
+	for _, kept := range importKeptModels {
+		if reflect.TypeOf(kept) == reflect.TypeOf(model) {
+			table.kept = true
+		}
+	}
+	for _, field := range statement.Schema.Fields {
+		if field.DBName != "" && field.Readable && field.Creatable {
+			table.columns = append(table.columns, field)
+		}
+	}
+	return table, nil
+}
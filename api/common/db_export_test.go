@@ -0,0 +1,315 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func setupExportTestDatabase(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	oldDB := db
+	t.Cleanup(func() {
+		db = oldDB
+	})
+
+	sqliteDB, err := openSQLiteDatabase(filepath.Join(root, "dataark.db"))
+	if err != nil {
+		t.Fatalf("openSQLiteDatabase returned error: %v", err)
+	}
+	if err := migrateDatabase(sqliteDB); err != nil {
+		t.Fatalf("migrateDatabase returned error: %v", err)
+	}
+	db = sqliteDB
+	return root
+}
+
+func writeExportFile(t *testing.T, root string) string {
+	t.Helper()
+	var buffer bytes.Buffer
+	if _, err := ExportDatabase(context.Background(), &buffer); err != nil {
+		t.Fatalf("ExportDatabase returned error: %v", err)
+	}
+	exportPath := filepath.Join(root, "database.jsonl")
+	if err := os.WriteFile(exportPath, buffer.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return exportPath
+}
+
+func TestDatabaseExportRoundTrip(t *testing.T) {
+	root := setupExportTestDatabase(t)
+	alice, err := CreateUser("alice", "secret123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := IncrementArchiveStat("example.com", 2); err != nil {
+		t.Fatal(err)
+	}
+	private := ArchiveOwnership{OwnerID: alice.ID, Visibility: ArchiveVisibilityPrivate}
+	if err := SaveArchiveDocument("example.com", "a.html", private); err != nil {
+		t.Fatal(err)
+	}
+	job := &BackupJob{ID: "6f1c2f3e-8d53-4a35-9b3c-1a0f5d0b7e21", Kind: "restore", Status: "success", Result: json.RawMessage(`{"indexedDocuments":3}`)}
+	if err := CreateBackupJob(job); err != nil {
+		t.Fatal(err)
+	}
+
+	exportPath := writeExportFile(t, root)
+	summary, err := InspectDatabaseExport(exportPath)
+	if err != nil {
+		t.Fatalf("InspectDatabaseExport returned error: %v", err)
+	}
+	if summary.Version != DatabaseExportVersion || summary.TableRows["users"] != 1 || summary.TableRows["archive_documents"] != 1 || summary.TableRows["teams"] != 0 {
+		t.Fatalf("unexpected export summary %+v", summary)
+	}
+	if ownerships, err := ReadExportArchiveOwnerships(exportPath); err != nil || ownerships[ArchiveDocumentKey("example.com", "a.html")] != private {
+		t.Fatalf("export ownerships = %v, %v", ownerships, err)
+	}
+
+	if _, err := CreateUser("mallory", "secret123"); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteArchiveDocumentRecord("example.com", "a.html"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ImportDatabase(context.Background(), exportPath); err != nil {
+		t.Fatalf("ImportDatabase returned error: %v", err)
+	}
+	if _, err := GetUserByUsername("mallory"); err == nil {
+		t.Fatal("user created after the export should be removed by import")
+	}
+	// 密码哈希等不出现在 JSON 响应中的列也要导出
+	if _, err := LoginUser("alice", "secret123"); err != nil {
+		t.Fatalf("exported user should be able to log in: %v", err)
+	}
+	if ownership, found, err := GetArchiveOwnership("example.com", "a.html"); err != nil || !found || ownership != private {
+		t.Fatalf("imported ownership = %+v found=%v err=%v", ownership, found, err)
+	}
+	imported, err := GetBackupJobByID(job.ID)
+	if err != nil || string(imported.Result) != `{"indexedDocuments":3}` {
+		t.Fatalf("imported job = %+v, %v", imported, err)
+	}
+	// 导入保留了原来的主键，新建记录不能和它冲突
+	bob, err := CreateUser("bob", "secret123")
+	if err != nil || bob.ID == alice.ID {
+		t.Fatalf("CreateUser after import = %+v, %v", bob, err)
+	}
+}
+
+func TestImportDatabaseRejectsDamagedExports(t *testing.T) {
+	root := setupExportTestDatabase(t)
+	if _, err := CreateUser("alice", "secret123"); err != nil {
+		t.Fatal(err)
+	}
+	exportPath := writeExportFile(t, root)
+	content, err := os.ReadFile(exportPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateUser("mallory", "secret123"); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	cases := map[string]string{
+		"truncated":   strings.Join(lines[:len(lines)-1], "\n"),
+		"missing row": strings.Replace(string(content), lines[2]+"\n", "", 1),
+		"newer":       strings.Replace(string(content), `"version":1`, `"version":99`, 1),
+		"not export":  "{\"hello\":\"world\"}\n",
+	}
+	for name, damaged := range cases {
+		damagedPath := filepath.Join(root, strings.ReplaceAll(name, " ", "-")+".jsonl")
+		if err := os.WriteFile(damagedPath, []byte(damaged), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ImportDatabase(context.Background(), damagedPath); err == nil {
+			t.Fatalf("%s export should be rejected", name)
+		}
+	}
+	if _, err := ImportDatabase(context.Background(), filepath.Join(root, "newer.jsonl")); !errors.Is(err, ErrDatabaseExportVersion) {
+		t.Fatalf("newer export error = %v, want ErrDatabaseExportVersion", err)
+	}
+	// 拒绝的导入不能改动数据库
+	if _, err := GetUserByUsername("mallory"); err != nil {
+		t.Fatalf("rejected import should keep the current data: %v", err)
+	}
+}
+
+func TestImportDatabaseMigratesOlderExports(t *testing.T) {
+	root := setupExportTestDatabase(t)
+	oldMigrations := databaseExportMigrations
+	t.Cleanup(func() { databaseExportMigrations = oldMigrations })
+
+	// 模拟版本 0 中表名为 accounts、列名为 login，版本 0 的 legacy 表已经删除
+	databaseExportMigrations = map[int]exportMigration{
+		0: func(line *exportLine) (bool, error) {
+			switch line.Table {
+			case "legacy":
+				return false, nil
+			case "accounts":
+				line.Table = "users"
+				for i, column := range line.Columns {
+					if column == "login" {
+						line.Columns[i] = "username"
+					}
+				}
+				if value, ok := line.Row["login"]; ok {
+					line.Row["username"] = value
+					delete(line.Row, "login")
+				}
+			}
+			return true, nil
+		},
+	}
+	oldExport := strings.Join([]string{
+		`{"format":"dataark-db-export","version":0,"driver":"postgres","createdAt":"2025-01-01T00:00:00Z"}`,
+		`{"type":"table","table":"accounts","columns":["id","login","password","role"]}`,
+		`{"type":"row","table":"accounts","row":{"id":5,"login":"carol","password":"hash","role":"editor"}}`,
+		`{"type":"table","table":"legacy","columns":["id"]}`,
+		`{"type":"row","table":"legacy","row":{"id":1}}`,
+		`{"type":"end","rows":{"accounts":1,"legacy":1}}`,
+	}, "\n") + "\n"
+	exportPath := filepath.Join(root, "old.jsonl")
+	if err := os.WriteFile(exportPath, []byte(oldExport), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	summary, err := ImportDatabase(context.Background(), exportPath)
+	if err != nil {
+		t.Fatalf("ImportDatabase returned error: %v", err)
+	}
+	if summary.Version != 0 || summary.TableRows["users"] != 1 || summary.TableRows["legacy"] != 0 {
+		t.Fatalf("unexpected summary %+v", summary)
+	}
+	carol, err := GetUserByUsername("carol")
+	if err != nil || carol.ID != 5 || carol.Role != RoleEditor || carol.Disabled {
+		t.Fatalf("migrated user = %+v, %v", carol, err)
+	}
+
+	delete(databaseExportMigrations, 0)
+	if _, err := InspectDatabaseExport(exportPath); !errors.Is(err, ErrDatabaseExportVersion) {
+		t.Fatalf("export without a migration path error = %v, want ErrDatabaseExportVersion", err)
+	}
+}
+
+func TestImportDatabaseKeepsAuditLog(t *testing.T) {
+	root := setupExportTestDatabase(t)
+	ctx := context.Background()
+	RecordAuditEvent(ctx, AuditActionUserCreate, "alice", "before export", nil)
+	exportPath := writeExportFile(t, root)
+	RecordAuditEvent(ctx, AuditActionUserDelete, "alice", "after export", nil)
+
+	if _, err := ImportDatabase(ctx, exportPath); err != nil {
+		t.Fatalf("ImportDatabase returned error: %v", err)
+	}
+	events, total, err := ListAuditEvents(AuditFilter{}, 1, 10)
+	if err != nil || total != 2 {
+		t.Fatalf("audit events after import = %+v total=%d err=%v, want both events once", events, total, err)
+	}
+	// 导入不能把备份之后的记录抹掉
+	if _, total, _ := ListAuditEvents(AuditFilter{Action: AuditActionUserDelete}, 1, 10); total != 1 {
+		t.Fatalf("audit event recorded after the export was lost, total=%d", total)
+	}
+}
+
+func TestImportDatabaseKeepsRevocations(t *testing.T) {
+	root := setupExportTestDatabase(t)
+	ctx := context.Background()
+	alice, err := CreateUser("alice", "secret123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted, deletedPlain, err := CreateAPIToken(alice.ID, "deleted", []string{ScopeSearchRead}, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, keptPlain, err := CreateAPIToken(alice.ID, "kept", []string{ScopeSearchRead}, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := GenerateToken(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := ValidateToken(session.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exportPath := writeExportFile(t, root)
+
+	// 备份之后吊销了一个会话、删除了一个 API Token
+	if err := RevokeTokenClaims(claims); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteAPIToken(alice.ID, deleted.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ImportDatabase(ctx, exportPath); err != nil {
+		t.Fatalf("ImportDatabase returned error: %v", err)
+	}
+	restored, err := GetUserByUsername("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckTokenActive(claims, restored); !errors.Is(err, ErrTokenRevoked) {
+		t.Fatalf("session revoked after the backup err = %v, want ErrTokenRevoked", err)
+	}
+	if _, _, err := AuthenticateAPIToken(deletedPlain); !errors.Is(err, ErrAPITokenInvalid) {
+		t.Fatalf("api token deleted after the backup err = %v, want ErrAPITokenInvalid", err)
+	}
+	if _, _, err := AuthenticateAPIToken(keptPlain); err != nil {
+		t.Fatalf("api token kept since the backup err = %v", err)
+	}
+
+	// 备份之后注销了全部会话：恢复保留较大的版本号，旧会话不能重新生效
+	other, err := GenerateToken(restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherClaims, err := ValidateToken(other.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RevokeAllUserTokens(alice.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ImportDatabase(ctx, exportPath); err != nil {
+		t.Fatalf("ImportDatabase returned error: %v", err)
+	}
+	restored, err = GetUserByUsername("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.TokenVersion != 1 {
+		t.Fatalf("token version after import = %d, want the live version 1", restored.TokenVersion)
+	}
+	if err := CheckTokenActive(otherClaims, restored); !errors.Is(err, ErrTokenRevoked) {
+		t.Fatalf("session from before logout-all err = %v, want ErrTokenRevoked", err)
+	}
+	if _, _, err := AuthenticateAPIToken(keptPlain); !errors.Is(err, ErrAPITokenInvalid) {
+		t.Fatalf("api token deleted by logout-all err = %v, want ErrAPITokenInvalid", err)
+	}
+
+	// 备份之后新建的用户被恢复移除，它的 API Token 也一并删除
+	mallory, err := CreateUser("mallory", "secret123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := CreateAPIToken(mallory.ID, "later", []string{ScopeSearchRead}, nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ImportDatabase(ctx, exportPath); err != nil {
+		t.Fatalf("ImportDatabase returned error: %v", err)
+	}
+	if tokens, err := ListAPITokens(mallory.ID); err != nil || len(tokens) != 0 {
+		t.Fatalf("api tokens of a user missing after import = %+v, %v", tokens, err)
+	}
+}
@@ -0,0 +1,113 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+)
+
+// CountTableRows 返回当前数据库每张表的行数，恢复预演时与备份中的行数比较。
+func CountTableRows(ctx context.Context) (map[string]int64, error) {
+	conn := db.WithContext(ctx)
+	var tables []string
+	var err error
+	if IsSQLite() {
+		tables, err = sqliteTableNames(conn, "main")
+	} else {
+		err = conn.Raw("SELECT table_name FROM information_schema.tables WHERE table_schema = current_schema() AND table_type = 'BASE TABLE' ORDER BY table_name").
+			Scan(&tables).Error
+	}
+	if err != nil {
+		return nil, err
+	}
+	return countRows(conn, "", tables)
+}
+
+// InspectSQLiteSnapshot 以只读方式打开备份中的 SQLite 快照，检查完整性并返回每张表的行数。
+func InspectSQLiteSnapshot(ctx context.Context, path string) (map[string]int64, error) {
+	snapshot, closeSnapshot, err := openSQLiteSnapshot(path)
+	if err != nil {
+		return nil, err
+	}
+	defer closeSnapshot()
+
+	conn := snapshot.WithContext(ctx)
+	var checkResult string
+	if err := conn.Raw("PRAGMA quick_check").Scan(&checkResult).Error; err != nil {
+		return nil, err
+	}
+	if checkResult != "ok" {
+		return nil, fmt.Errorf("sqlite snapshot failed integrity check: %s", checkResult)
+	}
+	tables, err := sqliteTableNames(conn, "main")
+	if err != nil {
+		return nil, err
+	}
+	if len(tables) == 0 {
+		return nil, errors.New("sqlite snapshot has no tables")
+	}
+	return countRows(conn, "main.", tables)
+}
+
+// ReadSnapshotArchiveOwnerships 读取备份 SQLite 快照中的归档归属，键与 ListArchiveOwnerships 相同。
+// 快照早于归属功能、没有 archive_documents 表时返回空结果。
+func ReadSnapshotArchiveOwnerships(ctx context.Context, path string) (map[string]ArchiveOwnership, error) {
+	snapshot, closeSnapshot, err := openSQLiteSnapshot(path)
+	if err != nil {
+		return nil, err
+	}
+	defer closeSnapshot()
+
+	conn := snapshot.WithContext(ctx)
+	tables, err := sqliteTableNames(conn, "main")
+	if err != nil {
+		return nil, err
+	}
+	ownerships := make(map[string]ArchiveOwnership)
+	tableName := conn.NamingStrategy.TableName("ArchiveDocument")
+	if !slices.Contains(tables, tableName) {
+		return ownerships, nil
+	}
+	var records []ArchiveDocument
+	if err := conn.Table(tableName).Find(&records).Error; err != nil {
+		return nil, fmt.Errorf("read archive ownerships from snapshot: %w", err)
+	}
+	for _, record := range records {
+		ownerships[ArchiveDocumentKey(record.Domain, record.Filename)] = record.ArchiveOwnership
+	}
+	return ownerships, nil
+}
+
+// openSQLiteSnapshot 以只读方式单独打开 SQLite 文件，当前数据库是 PostgreSQL 时也可以使用。
+func openSQLiteSnapshot(path string) (*gorm.DB, func(), error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, nil, err
+	}
+	snapshot, err := gorm.Open(sqlite.Open("file:"+filepath.ToSlash(path)+"?mode=ro"), &gorm.Config{})
+	if err != nil {
+		return nil, nil, err
+	}
+	sqlDB, err := snapshot.DB()
+	if err != nil {
+		return nil, nil, err
+	}
+	return snapshot, func() { _ = sqlDB.Close() }, nil
+}
+
+func countRows(conn *gorm.DB, schemaPrefix string, tables []string) (map[string]int64, error) {
+	counts := make(map[string]int64, len(tables))
+	for _, table := range tables {
+		var count int64
+		if err := conn.Raw("SELECT COUNT(*) FROM " + schemaPrefix + quoteSQLiteIdentifier(table)).Scan(&count).Error; err != nil {
+			return nil, fmt.Errorf("count rows of %s: %w", table, err)
+		}
+		counts[table] = count
+	}
+	return counts, nil
+}
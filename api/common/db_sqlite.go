@@ -0,0 +1,178 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+)
+
+// sqliteSnapshotAlias 是恢复时挂载备份快照使用的库名。
+const sqliteSnapshotAlias = "snapshot"
+
+// openSQLiteDatabase 打开内嵌 SQLite 数据库。
+// 使用纯 Go 驱动，编译出的二进制不依赖 cgo 和系统 libsqlite3；
+// WAL 模式让读请求不会被写入阻塞，busy_timeout 让并发写入排队而不是直接返回 SQLITE_BUSY。
+func openSQLiteDatabase(path string) (*gorm.DB, error) {
+	path = strings.TrimSpace(path)
+	if path == "" {
+		return nil, errors.New("sqlite database path is empty")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+
+	dsn := "file:" + filepath.ToSlash(path) + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)"
+	return gorm.Open(sqlite.Open(dsn), &gorm.Config{})
+}
+
+// CreateSQLiteSnapshot 用 VACUUM INTO 把当前数据库写成一个独立的数据库文件。
+// VACUUM INTO 在一个读事务内完成，得到的是某一时刻的一致快照，备份期间的写入不会混进来。
+func CreateSQLiteSnapshot(ctx context.Context, destination string) error {
+	if _, err := os.Stat(destination); err == nil {
+		return fmt.Errorf("sqlite snapshot destination %s already exists", destination)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return db.WithContext(ctx).Exec("VACUUM INTO ?", destination).Error
+}
+
+// RestoreSQLiteSnapshot 用快照中的数据替换当前数据库各表的内容。
+// 没有直接替换数据库文件，是因为服务运行中连接池仍然持有原文件句柄；
+// 这里在同一个连接上挂载快照，并在一个事务里清空、回填所有表，失败时整体回滚。
+// 只复制两边都存在的列，旧版本备份缺少的新列会保留数据库默认值；
+// importKeptModels 中的表保留当前内容，token_version 按 keepLiveAuthState 取较大值。
+func RestoreSQLiteSnapshot(ctx context.Context, source string) error {
+	if _, err := os.Stat(source); err != nil {
+		return err
+	}
+
+	return db.WithContext(ctx).Connection(func(conn *gorm.DB) error {
+		if err := conn.Exec("ATTACH DATABASE ? AS "+sqliteSnapshotAlias, source).Error; err != nil {
+			return err
+		}
+		defer conn.Exec("DETACH DATABASE " + sqliteSnapshotAlias)
+
+		var checkResult string
+		if err := conn.Raw("PRAGMA " + sqliteSnapshotAlias + ".quick_check").Scan(&checkResult).Error; err != nil {
+			return err
+		}
+		if checkResult != "ok" {
+			return fmt.Errorf("sqlite snapshot failed integrity check: %s", checkResult)
+		}
+
+		tables, err := sqliteTableNames(conn, "main")
+		if err != nil {
+			return err
+		}
+		snapshotTables, err := sqliteTableNames(conn, sqliteSnapshotAlias)
+		if err != nil {
+			return err
+		}
+		kept, err := importKeptTables()
+		if err != nil {
+			return err
+		}
+		snapshotTableSet := make(map[string]bool, len(snapshotTables))
+		for _, table := range snapshotTables {
+			snapshotTableSet[table] = true
+		}
+
+		return conn.Transaction(func(tx *gorm.DB) error {
+			versions, err := liveTokenVersions(tx)
+			if err != nil {
+				return err
+			}
+			for _, table := range tables {
+				if kept[table] {
+					continue
+				}
+				if err := tx.Exec("DELETE FROM main." + quoteSQLiteIdentifier(table)).Error; err != nil {
+					return err
+				}
+				if !snapshotTableSet[table] {
+					continue
+				}
+
+				columns, err := sharedSQLiteColumns(tx, table)
+				if err != nil {
+					return err
+				}
+				if len(columns) == 0 {
+					continue
+				}
+				columnList := strings.Join(columns, ", ")
+				statement := fmt.Sprintf("INSERT INTO main.%s (%s) SELECT %s FROM %s.%s",
+					quoteSQLiteIdentifier(table), columnList, columnList, sqliteSnapshotAlias, quoteSQLiteIdentifier(table))
+				if err := tx.Exec(statement).Error; err != nil {
+					return fmt.Errorf("restore table %s: %w", table, err)
+				}
+			}
+			return keepLiveAuthState(tx, versions)
+		})
+	})
+}
+
+func sqliteTableNames(conn *gorm.DB, schema string) ([]string, error) {
+	var tables []string
+	err := conn.Raw("SELECT name FROM " + schema + ".sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name").
+		Scan(&tables).Error
+	return tables, err
+}
+
+func sharedSQLiteColumns(conn *gorm.DB, table string) ([]string, error) {
+	mainColumns, err := sqliteColumnNames(conn, "main", table)
+	if err != nil {
+		return nil, err
+	}
+	snapshotColumns, err := sqliteColumnNames(conn, sqliteSnapshotAlias, table)
+	if err != nil {
+		return nil, err
+	}
+	snapshotColumnSet := make(map[string]bool, len(snapshotColumns))
+	for _, column := range snapshotColumns {
+		snapshotColumnSet[column] = true
+	}
+
+	shared := make([]string, 0, len(mainColumns))
+	for _, column := range mainColumns {
+		if snapshotColumnSet[column] {
+			shared = append(shared, quoteSQLiteIdentifier(column))
+		}
+	}
+	return shared, nil
+}
+
+func sqliteColumnNames(conn *gorm.DB, schema string, table string) ([]string, error) {
+	rows, err := conn.Raw(fmt.Sprintf("PRAGMA %s.table_info(%s)", schema, quoteSQLiteIdentifier(table))).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := make([]string, 0)
+	for rows.Next() {
+		var (
+			cid          int
+			name         string
+			columnType   string
+			notNull      int
+			defaultValue interface{}
+			primaryKey   int
+		)
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &primaryKey); err != nil {
+			return nil, err
+		}
+		columns = append(columns, name)
+	}
+	return columns, rows.Err()
+}
+
+func quoteSQLiteIdentifier(identifier string) string {
+	return `"` + strings.ReplaceAll(identifier, `"`, `""`) + `"`
+}
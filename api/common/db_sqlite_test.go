@@ -0,0 +1,92 @@
+package common
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestSQLiteSnapshotRoundTrip(t *testing.T) {
+	root := t.TempDir()
+	oldDB := db
+	t.Cleanup(func() {
+		db = oldDB
+	})
+
+	sqliteDB, err := openSQLiteDatabase(filepath.Join(root, "data", "dataark.db"))
+	if err != nil {
+		t.Fatalf("openSQLiteDatabase returned error: %v", err)
+	}
+	if err := sqliteDB.AutoMigrate(&User{}, &ArchiveTask{}, &ArchiveStat{}, &SearchIndexSetting{}, &AuditEvent{}, &APIToken{}); err != nil {
+		t.Fatalf("AutoMigrate returned error: %v", err)
+	}
+	db = sqliteDB
+
+	if _, err := CreateUser("alice", "secret123"); err != nil {
+		t.Fatalf("CreateUser returned error: %v", err)
+	}
+	if err := IncrementArchiveStat("example.com", 2); err != nil {
+		t.Fatalf("IncrementArchiveStat returned error: %v", err)
+	}
+
+	snapshotPath := filepath.Join(root, "backup", "database.sqlite")
+	if err := CreateSQLiteSnapshot(context.Background(), snapshotPath); err == nil {
+		t.Fatal("snapshot into a missing directory should fail")
+	}
+	snapshotPath = filepath.Join(root, "database.sqlite")
+	if err := CreateSQLiteSnapshot(context.Background(), snapshotPath); err != nil {
+		t.Fatalf("CreateSQLiteSnapshot returned error: %v", err)
+	}
+	if err := CreateSQLiteSnapshot(context.Background(), snapshotPath); err == nil {
+		t.Fatal("existing snapshot destination should not be overwritten")
+	}
+
+	if _, err := CreateUser("mallory", "secret123"); err != nil {
+		t.Fatalf("CreateUser returned error: %v", err)
+	}
+	if err := IncrementArchiveStat("other.example", 1); err != nil {
+		t.Fatalf("IncrementArchiveStat returned error: %v", err)
+	}
+
+	RecordAuditEvent(context.Background(), AuditActionUserCreate, "mallory", "", nil)
+
+	if err := RestoreSQLiteSnapshot(context.Background(), snapshotPath); err != nil {
+		t.Fatalf("RestoreSQLiteSnapshot returned error: %v", err)
+	}
+	// 审计记录保留快照之后的内容
+	if _, total, err := ListAuditEvents(AuditFilter{Target: "mallory"}, 1, 10); err != nil || total != 1 {
+		t.Fatalf("audit events after restore total=%d err=%v, want the event recorded after the snapshot", total, err)
+	}
+	if _, err := GetUserByUsername("mallory"); err == nil {
+		t.Fatal("user created after the snapshot should be removed by restore")
+	}
+	if _, err := LoginUser("alice", "secret123"); err != nil {
+		t.Fatalf("snapshot user should be restored: %v", err)
+	}
+	stats, err := GetArchiveStats()
+	if err != nil {
+		t.Fatalf("GetArchiveStats returned error: %v", err)
+	}
+	if stats.TotalFiles != 2 || len(stats.Sources) != 1 {
+		t.Fatalf("stats = %#v, want snapshot stats", stats)
+	}
+
+	if err := RestoreSQLiteSnapshot(context.Background(), filepath.Join(root, "missing.sqlite")); err == nil {
+		t.Fatal("missing snapshot should fail")
+	}
+}
+
+func TestOpenDatabaseRejectsUnknownDriver(t *testing.T) {
+	oldDriver := DBDriver
+	t.Cleanup(func() {
+		DBDriver = oldDriver
+	})
+	DBDriver = "mysql"
+
+	if _, err := openDatabase(); err == nil {
+		t.Fatal("unknown driver should return error")
+	}
+	if _, err := openSQLiteDatabase(" "); err == nil {
+		t.Fatal("empty sqlite path should return error")
+	}
+}
@@ -5,7 +5,7 @@ import (
 	"testing"
 	"time"
 
-	"gorm.io/driver/sqlite"
+	"github.com/glebarez/sqlite"
 	"gorm.io/gorm"
 )
 
@@ -47,7 +47,7 @@ func TestUserDatabaseOperations(t *testing.T) {
 	if err != nil {
 		t.Fatalf("CreateUser returned error: %v", err)
 	}
-	if user.ID == 0 || user.Password == "secret123" {
+	if user.ID == 0 || user.Password == "secret123" || user.Role != RoleViewer {
 		t.Fatalf("unexpected user: %#v", user)
 	}
 	if _, err := CreateUser("bob", "secret123"); err == nil {
@@ -143,21 +143,26 @@ func TestArchiveTaskDatabaseOperations(t *testing.T) {
 		t.Fatalf("loaded task = %#v", loaded)
 	}
 
-	latest, err := GetLatestArchiveTaskByURL("https://example.com")
+	latest, err := GetLatestArchiveTaskByURL("https://example.com", PublicArchiveOwnership())
 	if err != nil || latest.ID != "task-1" {
 		t.Fatalf("GetLatestArchiveTaskByURL = %#v err=%v", latest, err)
 	}
-	if _, err := FindActiveArchiveTaskByURL("https://example.com"); !errors.Is(err, gorm.ErrRecordNotFound) {
+	if _, err := FindActiveArchiveTaskByURL("https://example.com", PublicArchiveOwnership()); !errors.Is(err, gorm.ErrRecordNotFound) {
 		t.Fatalf("FindActiveArchiveTaskByURL err = %v, want record not found", err)
 	}
 	task2 := &ArchiveTask{ID: "task-2", URL: "https://example.com", Domain: "example.com", Status: "running"}
 	if err := CreateArchiveTask(task2); err != nil {
 		t.Fatal(err)
 	}
-	active, err := FindActiveArchiveTaskByURL("https://example.com")
+	active, err := FindActiveArchiveTaskByURL("https://example.com", PublicArchiveOwnership())
 	if err != nil || active.ID != "task-2" {
 		t.Fatalf("FindActiveArchiveTaskByURL = %#v err=%v", active, err)
 	}
+	// 不同归属的同一 URL 各自归档，不复用其他用户的任务
+	private := ArchiveOwnership{OwnerID: 5, Visibility: ArchiveVisibilityPrivate}
+	if _, err := FindActiveArchiveTaskByURL("https://example.com", private); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("FindActiveArchiveTaskByURL for other owner err = %v, want record not found", err)
+	}
 	tasks, err := ListArchiveTasksByStatuses([]string{"running"})
 	if err != nil || len(tasks) != 1 || tasks[0].ID != "task-2" {
 		t.Fatalf("ListArchiveTasksByStatuses = %#v err=%v", tasks, err)
@@ -232,7 +237,7 @@ func setupSQLiteDB(t *testing.T) {
 	if err != nil {
 		t.Fatalf("failed to open sqlite db: %v", err)
 	}
-	if err := sqliteDB.AutoMigrate(&User{}, &ArchiveTask{}, &ArchiveStat{}); err != nil {
+	if err := migrateDatabase(sqliteDB); err != nil {
 		t.Fatalf("failed to migrate sqlite db: %v", err)
 	}
 	db = sqliteDB
@@ -240,3 +245,164 @@ func setupSQLiteDB(t *testing.T) {
 		db = oldDB
 	})
 }
+
+func TestMigrateDatabasePromotesExistingAdminOnce(t *testing.T) {
+	sqliteDB, err := gorm.Open(sqlite.Open("file:"+t.Name()+"?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to open sqlite db: %v", err)
+	}
+	// 模拟升级前没有 role 字段的用户表
+	if err := sqliteDB.Exec(`CREATE TABLE users (id integer PRIMARY KEY AUTOINCREMENT, username text NOT NULL UNIQUE, password text NOT NULL, created_at datetime, updated_at datetime)`).Error; err != nil {
+		t.Fatalf("create legacy users table: %v", err)
+	}
+	if err := sqliteDB.Exec(`INSERT INTO users (username, password) VALUES ('admin', 'x'), ('intern', 'x')`).Error; err != nil {
+		t.Fatalf("insert legacy users: %v", err)
+	}
+
+	if err := migrateDatabase(sqliteDB); err != nil {
+		t.Fatalf("migrateDatabase returned error: %v", err)
+	}
+	roles := map[string]string{}
+	var users []User
+	if err := sqliteDB.Find(&users).Error; err != nil {
+		t.Fatalf("load users: %v", err)
+	}
+	for _, user := range users {
+		roles[user.Username] = user.Role
+	}
+	if roles["admin"] != RoleAdmin || roles["intern"] != RoleViewer {
+		t.Fatalf("roles after migration = %#v", roles)
+	}
+
+	// 管理员降级后再次启动不应被重新提升
+	if err := sqliteDB.Model(&User{}).Where("username = ?", "admin").Update("role", RoleEditor).Error; err != nil {
+		t.Fatalf("demote admin: %v", err)
+	}
+	if err := migrateDatabase(sqliteDB); err != nil {
+		t.Fatalf("second migrateDatabase returned error: %v", err)
+	}
+	var admin User
+	if err := sqliteDB.Where("username = ?", "admin").First(&admin).Error; err != nil || admin.Role != RoleEditor {
+		t.Fatalf("admin after second migration = %#v err=%v", admin, err)
+	}
+}
+
+func TestRoles(t *testing.T) {
+	setupSQLiteDB(t)
+
+	if role, err := NormalizeRole(" Editor "); err != nil || role != RoleEditor {
+		t.Fatalf("NormalizeRole = %q, %v", role, err)
+	}
+	if role, err := NormalizeRole(""); err != nil || role != RoleViewer {
+		t.Fatalf("empty NormalizeRole = %q, %v", role, err)
+	}
+	if _, err := CreateUserWithRole("root", "secret123", "superuser"); err == nil {
+		t.Fatal("unknown role should be rejected")
+	}
+	editor, err := CreateUserWithRole("editor", "secret123", RoleEditor)
+	if err != nil {
+		t.Fatalf("CreateUserWithRole returned error: %v", err)
+	}
+	if !editor.HasRole(RoleViewer) || !editor.HasRole(RoleEditor) || editor.HasRole(RoleAdmin) {
+		t.Fatalf("unexpected permissions for %#v", editor)
+	}
+	var nobody *User
+	if nobody.HasRole(RoleViewer) {
+		t.Fatal("nil user should have no role")
+	}
+}
+
+func TestUserAccountManagement(t *testing.T) {
+	setupSQLiteDB(t)
+
+	admin, err := CreateUserWithRole("admin", "secret123", RoleAdmin)
+	if err != nil {
+		t.Fatalf("CreateUserWithRole returned error: %v", err)
+	}
+	viewer, err := CreateUser("intern", "secret123")
+	if err != nil {
+		t.Fatalf("CreateUser returned error: %v", err)
+	}
+	if _, err := CreateUser("intern", "secret123"); !errors.Is(err, ErrUsernameExists) {
+		t.Fatalf("duplicate err = %v, want ErrUsernameExists", err)
+	}
+
+	disabled := true
+	if _, err := UpdateUserAccount(admin.ID, nil, &disabled); !errors.Is(err, ErrLastAdmin) {
+		t.Fatalf("disable last admin err = %v, want ErrLastAdmin", err)
+	}
+	demoted := RoleEditor
+	if _, err := UpdateUserAccount(admin.ID, &demoted, nil); !errors.Is(err, ErrLastAdmin) {
+		t.Fatalf("demote last admin err = %v, want ErrLastAdmin", err)
+	}
+	if err := DeleteUser(admin.ID); !errors.Is(err, ErrLastAdmin) {
+		t.Fatalf("delete last admin err = %v, want ErrLastAdmin", err)
+	}
+	if _, err := UpdateUserAccount(9999, nil, &disabled); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("missing user err = %v, want ErrUserNotFound", err)
+	}
+	invalidRole := "root"
+	if _, err := UpdateUserAccount(viewer.ID, &invalidRole, nil); err == nil {
+		t.Fatal("unknown role should be rejected")
+	}
+
+	updated, err := UpdateUserAccount(viewer.ID, nil, &disabled)
+	if err != nil || !updated.Disabled {
+		t.Fatalf("disable viewer = %#v err=%v", updated, err)
+	}
+	if _, err := LoginUser("intern", "secret123"); !errors.Is(err, ErrUserDisabled) {
+		t.Fatalf("disabled login err = %v, want ErrUserDisabled", err)
+	}
+
+	promoted := RoleAdmin
+	enabled := false
+	if _, err := UpdateUserAccount(viewer.ID, &promoted, &enabled); err != nil {
+		t.Fatalf("promote viewer returned error: %v", err)
+	}
+	if _, err := UpdateUserAccount(admin.ID, &demoted, nil); err != nil {
+		t.Fatalf("demote with another admin returned error: %v", err)
+	}
+
+	if err := ResetUserPassword(viewer.ID, "reset123"); err != nil {
+		t.Fatalf("ResetUserPassword returned error: %v", err)
+	}
+	if _, err := ChangeUserPassword(viewer.ID, "secret123", "changed123", false); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("wrong current password err = %v, want ErrInvalidCredentials", err)
+	}
+	before, err := GetUserByID(viewer.ID)
+	if err != nil {
+		t.Fatalf("GetUserByID returned error: %v", err)
+	}
+	oldSession, err := GenerateToken(before)
+	if err != nil {
+		t.Fatalf("GenerateToken returned error: %v", err)
+	}
+	changed, err := ChangeUserPassword(viewer.ID, "reset123", "changed123", true)
+	if err != nil {
+		t.Fatalf("ChangeUserPassword returned error: %v", err)
+	}
+	after, err := GetUserByID(viewer.ID)
+	if err != nil {
+		t.Fatalf("GetUserByID returned error: %v", err)
+	}
+	oldClaims, err := ValidateToken(oldSession.Token)
+	if err != nil {
+		t.Fatalf("ValidateToken returned error: %v", err)
+	}
+	if err := CheckTokenActive(oldClaims, after); !errors.Is(err, ErrTokenRevoked) {
+		t.Fatalf("old session after password change err = %v, want ErrTokenRevoked", err)
+	}
+	newClaims, err := ValidateToken(changed.Token)
+	if err != nil {
+		t.Fatalf("ValidateToken returned error: %v", err)
+	}
+	if err := CheckTokenActive(newClaims, after); err != nil || !newClaims.MFA {
+		t.Fatalf("reissued session claims = %+v err = %v, want active token keeping mfa", newClaims, err)
+	}
+	if _, err := LoginUser("intern", "changed123"); err != nil {
+		t.Fatalf("login with changed password returned error: %v", err)
+	}
+	if err := DeleteUser(9999); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("delete missing err = %v, want ErrUserNotFound", err)
+	}
+}
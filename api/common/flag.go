@@ -2,7 +2,9 @@ package common
 
 import (
 	"flag"
+	"os"
 	"strings"
+	"time"
 )
 
 func ParseFlag() {
@@ -11,22 +13,96 @@ func ParseFlag() {
 	MEILIHostFlag := flag.String("mhost", "http://127.0.0.1:7700", "Assign MeiliSearch host")
 	MEILIKeyFlag := flag.String("mkey", "", "Assign MeiliSearch API key")
 	MEILIDumpDirFlag := flag.String("mdump", "./dumps", "Assign shared MeiliSearch dump directory")
+	SearchEngineFlag := flag.String("engine", SearchEngineMeilisearch, "Assign search engine: meilisearch or embedded")
+	SearchIndexDirFlag := flag.String("indexdir", "./search_index", "Assign embedded search index directory")
+	EmbedderFlag := flag.String("embedder", EmbedderNone, "Assign semantic search embedder: none, local or http")
+	EmbedderURLFlag := flag.String("embedurl", "", "Assign OpenAI compatible embeddings endpoint for the http embedder")
+	EmbedderModelFlag := flag.String("embedmodel", "", "Assign embedding model name for the http embedder")
+	EmbedderKeyFlag := flag.String("embedkey", "", "Assign API key for the http embedder")
 	SingleFileWebServiceURLFlag := flag.String("sfhost", "http://singlefile-webservice:8080", "Assign SingleFile WEBService host")
+	DBDriverFlag := flag.String("dbdriver", DBDriverPostgres, "Assign DB driver: postgres or sqlite")
+	DBPathFlag := flag.String("dbpath", "./dataark.db", "Assign SQLite database file")
 	DBHostFlag := flag.String("dbhost", "localhost", "Assign DB host")
 	DBPortFlag := flag.String("dbport", "5432", "Assign DB port")
 	DBNameFlag := flag.String("dbname", "echoark", "Assign DB name")
 	DBUserFlag := flag.String("dbuser", "postgres", "Assign DB user")
 	DBPasswordFlag := flag.String("dbpasswd", "postgres", "Assign DB password")
+	JWTSecretFlag := flag.String("jwtsecret", os.Getenv(JWTSecretEnv), "Assign JWT HS256 signing secret, defaults to $"+JWTSecretEnv)
+	JWTKeyFileFlag := flag.String("jwtkeyfile", "./jwt_keys.json", "Assign JWT signing key file, generated on first run")
+	JWTAlgorithmFlag := flag.String("jwtalg", JWTAlgorithmHS256, "Assign JWT signing algorithm for generated keys: HS256 or EdDSA")
+	OIDCIssuerFlag := flag.String("oidcissuer", "", "Assign OpenID Connect issuer URL, enables single sign-on")
+	OIDCClientIDFlag := flag.String("oidcclientid", "", "Assign OpenID Connect client ID")
+	OIDCClientSecretFlag := flag.String("oidcsecret", os.Getenv(OIDCClientSecretEnv), "Assign OpenID Connect client secret, defaults to $"+OIDCClientSecretEnv)
+	OIDCRedirectURLFlag := flag.String("oidcredirect", "", "Assign OpenID Connect redirect URL, e.g. https://ark.example.com/api/oidc/callback")
+	OIDCScopesFlag := flag.String("oidcscopes", "openid profile email", "Assign OpenID Connect scopes")
+	OIDCUsernameClaimFlag := flag.String("oidcusernameclaim", "preferred_username", "Assign ID token claim used as username")
+	OIDCGroupsClaimFlag := flag.String("oidcgroupsclaim", "groups", "Assign ID token claim that lists groups")
+	OIDCRoleMappingFlag := flag.String("oidcroles", "", "Assign group to role mapping, e.g. ark-admins=admin,ark-editors=editor")
+	OIDCDefaultRoleFlag := flag.String("oidcdefaultrole", RoleViewer, "Assign role for users without mapped groups, or none to deny them")
+	OIDCAutoProvisionFlag := flag.Bool("oidcautoprovision", true, "Create local users on first single sign-on")
+	OIDCLinkByUsernameFlag := flag.Bool("oidclinkusername", false, "Link single sign-on users to existing local users with the same username")
+	LoginLockoutAttemptsFlag := flag.Int("loginlockattempts", 10, "Assign failed login attempts per username before a temporary lockout, per IP it is 5 times")
+	LoginLockoutDurationFlag := flag.Duration("loginlockduration", 15*time.Minute, "Assign how long a login lockout lasts")
+	DefaultArchiveVisibilityFlag := flag.String("archivevisibility", ArchiveVisibilityPublic, "Assign default visibility of new archives: private, team or public")
+	BackupDirFlag := flag.String("backupdir", "./backups", "Assign incremental backup repository directory")
+	BackupScheduleFlag := flag.String("backupschedule", "", "Assign cron expression for scheduled incremental backups, e.g. \"0 3 * * *\", empty disables it")
+	BackupKeepLastFlag := flag.Int("backupkeeplast", 0, "Assign how many latest backups to keep")
+	BackupKeepDailyFlag := flag.Int("backupkeepdaily", 0, "Assign for how many days to keep the last backup of each day")
+	BackupKeepWeeklyFlag := flag.Int("backupkeepweekly", 0, "Assign for how many weeks to keep the last backup of each week")
+	BackupTargetsFlag := flag.String("backuptargets", os.Getenv(BackupTargetsEnv), "Assign comma separated off-box backup targets (file://, sftp:// or s3:// URLs), defaults to $"+BackupTargetsEnv)
+	BackupPassphraseFlag := flag.String("backuppassphrase", os.Getenv(BackupPassphraseEnv), "Assign passphrase to encrypt backup zips, defaults to $"+BackupPassphraseEnv)
+	BackupRecipientsFlag := flag.String("backuprecipients", "", "Assign comma separated dataark1... public keys to encrypt backup zips for")
+	BackupIdentityFlag := flag.String("backupidentity", "", "Assign file with DATAARK-SECRET-KEY-1... keys to decrypt backups on restore")
+	BackupDatabaseFormatFlag := flag.String("backupdbformat", BackupDatabaseFormatJSONL, "Assign database format in backups: jsonl (built-in export) or native (pg_dump or SQLite snapshot)")
+	BackupUploadMaxFlag := flag.Int64("backupuploadmax", 20480, "Assign the largest backup zip accepted by chunked uploads in MiB, 0 disables the limit")
+	GenerateBackupKeyFlag := flag.Bool("genbackupkey", false, "Print a new backup encryption key pair and exit")
 	flag.Parse()
 	DEBUG = *debugFlag
 	ARCHIVEFILELOACTION = *ArchiveFileLocationFlag
 	MEILIHOST = *MEILIHostFlag
 	MEILIAPIKey = *MEILIKeyFlag
 	MEILIDumpDir = *MEILIDumpDirFlag
+	SearchEngine = strings.ToLower(strings.TrimSpace(*SearchEngineFlag))
+	SearchIndexDir = *SearchIndexDirFlag
+	EmbedderType = strings.ToLower(strings.TrimSpace(*EmbedderFlag))
+	EmbedderURL = strings.TrimSpace(*EmbedderURLFlag)
+	EmbedderModel = *EmbedderModelFlag
+	EmbedderAPIKey = *EmbedderKeyFlag
 	SINGLEFILEWEBSERVICEURL = strings.TrimRight(*SingleFileWebServiceURLFlag, "/")
+	DBDriver = strings.ToLower(strings.TrimSpace(*DBDriverFlag))
+	DBPath = *DBPathFlag
 	DBHost = *DBHostFlag
 	DBPort = *DBPortFlag
 	DBName = *DBNameFlag
 	DBUser = *DBUserFlag
 	DBPassword = *DBPasswordFlag
+	JWTSecret = *JWTSecretFlag
+	JWTKeyFile = *JWTKeyFileFlag
+	JWTAlgorithm = strings.TrimSpace(*JWTAlgorithmFlag)
+	OIDCIssuer = strings.TrimSpace(*OIDCIssuerFlag)
+	OIDCClientID = *OIDCClientIDFlag
+	OIDCClientSecret = *OIDCClientSecretFlag
+	OIDCRedirectURL = *OIDCRedirectURLFlag
+	OIDCScopes = *OIDCScopesFlag
+	OIDCUsernameClaim = *OIDCUsernameClaimFlag
+	OIDCGroupsClaim = *OIDCGroupsClaimFlag
+	OIDCRoleMapping = *OIDCRoleMappingFlag
+	OIDCDefaultRole = *OIDCDefaultRoleFlag
+	OIDCAutoProvision = *OIDCAutoProvisionFlag
+	OIDCLinkByUsername = *OIDCLinkByUsernameFlag
+	LoginLockoutAttempts = *LoginLockoutAttemptsFlag
+	LoginLockoutDuration = *LoginLockoutDurationFlag
+	DefaultArchiveVisibility = strings.ToLower(strings.TrimSpace(*DefaultArchiveVisibilityFlag))
+	BackupDir = *BackupDirFlag
+	BackupScheduleSpec = strings.TrimSpace(*BackupScheduleFlag)
+	BackupKeepLast = *BackupKeepLastFlag
+	BackupKeepDaily = *BackupKeepDailyFlag
+	BackupKeepWeekly = *BackupKeepWeeklyFlag
+	BackupTargets = strings.TrimSpace(*BackupTargetsFlag)
+	BackupPassphrase = *BackupPassphraseFlag
+	BackupRecipients = strings.TrimSpace(*BackupRecipientsFlag)
+	BackupIdentityFile = strings.TrimSpace(*BackupIdentityFlag)
+	BackupDatabaseFormat = strings.ToLower(strings.TrimSpace(*BackupDatabaseFormatFlag))
+	BackupUploadMaxMB = *BackupUploadMaxFlag
+	GenerateBackupKey = *GenerateBackupKeyFlag
 }
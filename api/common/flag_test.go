@@ -4,6 +4,7 @@ import (
 	"flag"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestParseFlagAppliesConfiguration(t *testing.T) {
@@ -12,6 +13,13 @@ func TestParseFlagAppliesConfiguration(t *testing.T) {
 	oldConfig := []interface{}{
 		DEBUG, ARCHIVEFILELOACTION, MEILIHOST, MEILIAPIKey, MEILIDumpDir,
 		SINGLEFILEWEBSERVICEURL, DBHost, DBPort, DBName, DBUser, DBPassword,
+		SearchEngine, SearchIndexDir, DBDriver, DBPath,
+		EmbedderType, EmbedderURL, EmbedderModel, EmbedderAPIKey,
+		JWTSecret, JWTKeyFile, JWTAlgorithm,
+		OIDCIssuer, OIDCClientID, OIDCClientSecret, OIDCRedirectURL, OIDCRoleMapping, OIDCDefaultRole,
+		OIDCAutoProvision, OIDCLinkByUsername, LoginLockoutAttempts, LoginLockoutDuration,
+		DefaultArchiveVisibility, BackupDir, BackupScheduleSpec, BackupKeepLast, BackupKeepDaily, BackupKeepWeekly,
+		BackupTargets, BackupPassphrase, BackupRecipients, BackupIdentityFile, BackupDatabaseFormat, BackupUploadMaxMB,
 	}
 	t.Cleanup(func() {
 		os.Args = oldArgs
@@ -27,7 +35,44 @@ func TestParseFlagAppliesConfiguration(t *testing.T) {
 		DBName = oldConfig[8].(string)
 		DBUser = oldConfig[9].(string)
 		DBPassword = oldConfig[10].(string)
+		SearchEngine = oldConfig[11].(string)
+		SearchIndexDir = oldConfig[12].(string)
+		DBDriver = oldConfig[13].(string)
+		DBPath = oldConfig[14].(string)
+		EmbedderType = oldConfig[15].(string)
+		EmbedderURL = oldConfig[16].(string)
+		EmbedderModel = oldConfig[17].(string)
+		EmbedderAPIKey = oldConfig[18].(string)
+		JWTSecret = oldConfig[19].(string)
+		JWTKeyFile = oldConfig[20].(string)
+		JWTAlgorithm = oldConfig[21].(string)
+		OIDCIssuer = oldConfig[22].(string)
+		OIDCClientID = oldConfig[23].(string)
+		OIDCClientSecret = oldConfig[24].(string)
+		OIDCRedirectURL = oldConfig[25].(string)
+		OIDCRoleMapping = oldConfig[26].(string)
+		OIDCDefaultRole = oldConfig[27].(string)
+		OIDCAutoProvision = oldConfig[28].(bool)
+		OIDCLinkByUsername = oldConfig[29].(bool)
+		LoginLockoutAttempts = oldConfig[30].(int)
+		LoginLockoutDuration = oldConfig[31].(time.Duration)
+		DefaultArchiveVisibility = oldConfig[32].(string)
+		BackupDir = oldConfig[33].(string)
+		BackupScheduleSpec = oldConfig[34].(string)
+		BackupKeepLast = oldConfig[35].(int)
+		BackupKeepDaily = oldConfig[36].(int)
+		BackupKeepWeekly = oldConfig[37].(int)
+		BackupTargets = oldConfig[38].(string)
+		BackupPassphrase = oldConfig[39].(string)
+		BackupRecipients = oldConfig[40].(string)
+		BackupIdentityFile = oldConfig[41].(string)
+		BackupDatabaseFormat = oldConfig[42].(string)
+		BackupUploadMaxMB = oldConfig[43].(int64)
 	})
+	t.Setenv(JWTSecretEnv, "secret-from-env")
+	t.Setenv(OIDCClientSecretEnv, "oidc-secret-from-env")
+	t.Setenv(BackupTargetsEnv, " file:///mnt/nas/dataark ")
+	t.Setenv(BackupPassphraseEnv, "backup-passphrase")
 
 	flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
 	os.Args = []string{
@@ -37,12 +82,41 @@ func TestParseFlagAppliesConfiguration(t *testing.T) {
 		"-mhost", "http://meili:7700",
 		"-mkey", "key",
 		"-mdump", "/tmp/dumps",
+		"-engine", " Embedded ",
+		"-indexdir", "/tmp/index",
+		"-embedder", "HTTP",
+		"-embedurl", " http://embed/v1/embeddings ",
+		"-embedmodel", "bge-m3",
+		"-embedkey", "embed-key",
 		"-sfhost", "http://singlefile/",
+		"-dbdriver", "SQLite",
+		"-dbpath", "/tmp/dataark.db",
 		"-dbhost", "db",
 		"-dbport", "5433",
 		"-dbname", "dataark",
 		"-dbuser", "user",
 		"-dbpasswd", "pass",
+		"-jwtkeyfile", "/tmp/jwt_keys.json",
+		"-jwtalg", " EdDSA ",
+		"-oidcissuer", " https://sso.example.com ",
+		"-oidcclientid", "dataark",
+		"-oidcredirect", "https://ark.example.com/api/oidc/callback",
+		"-oidcroles", "ark-admins=admin",
+		"-oidcdefaultrole", "none",
+		"-oidcautoprovision=false",
+		"-oidclinkusername",
+		"-loginlockattempts", "6",
+		"-loginlockduration", "1h",
+		"-archivevisibility", " Team ",
+		"-backupdir", "/tmp/backups",
+		"-backupschedule", " 0 3 * * * ",
+		"-backupkeeplast", "3",
+		"-backupkeepdaily", "7",
+		"-backupkeepweekly", "4",
+		"-backuprecipients", " dataark1abc ",
+		"-backupidentity", "/tmp/backup_identity.txt",
+		"-backupdbformat", " Native ",
+		"-backupuploadmax", "512",
 	}
 
 	ParseFlag()
@@ -53,6 +127,44 @@ func TestParseFlagAppliesConfiguration(t *testing.T) {
 	if MEILIDumpDir != "/tmp/dumps" || SINGLEFILEWEBSERVICEURL != "http://singlefile" {
 		t.Fatalf("unexpected parsed service config: dump=%q singlefile=%q", MEILIDumpDir, SINGLEFILEWEBSERVICEURL)
 	}
+	if SearchEngine != SearchEngineEmbedded || SearchIndexDir != "/tmp/index" {
+		t.Fatalf("unexpected parsed search config: engine=%q indexdir=%q", SearchEngine, SearchIndexDir)
+	}
+	if EmbedderType != EmbedderHTTP || EmbedderURL != "http://embed/v1/embeddings" || EmbedderModel != "bge-m3" || EmbedderAPIKey != "embed-key" {
+		t.Fatalf("unexpected parsed embedder config: type=%q url=%q model=%q key=%q", EmbedderType, EmbedderURL, EmbedderModel, EmbedderAPIKey)
+	}
+	if JWTSecret != "secret-from-env" || JWTKeyFile != "/tmp/jwt_keys.json" || JWTAlgorithm != JWTAlgorithmEdDSA {
+		t.Fatalf("unexpected parsed jwt config: secret=%q keyfile=%q alg=%q", JWTSecret, JWTKeyFile, JWTAlgorithm)
+	}
+	if OIDCIssuer != "https://sso.example.com" || OIDCClientID != "dataark" || OIDCClientSecret != "oidc-secret-from-env" ||
+		OIDCRedirectURL != "https://ark.example.com/api/oidc/callback" || OIDCRoleMapping != "ark-admins=admin" || OIDCDefaultRole != OIDCRoleNone {
+		t.Fatalf("unexpected parsed oidc config: issuer=%q client=%q secret=%q redirect=%q roles=%q default=%q",
+			OIDCIssuer, OIDCClientID, OIDCClientSecret, OIDCRedirectURL, OIDCRoleMapping, OIDCDefaultRole)
+	}
+	if OIDCAutoProvision || !OIDCLinkByUsername {
+		t.Fatalf("unexpected parsed oidc provisioning config: auto=%v link=%v", OIDCAutoProvision, OIDCLinkByUsername)
+	}
+	if LoginLockoutAttempts != 6 || LoginLockoutDuration != time.Hour {
+		t.Fatalf("unexpected parsed login lockout config: attempts=%d duration=%s", LoginLockoutAttempts, LoginLockoutDuration)
+	}
+	if DefaultArchiveVisibility != ArchiveVisibilityTeam || BackupDir != "/tmp/backups" {
+		t.Fatalf("unexpected parsed archive config: visibility=%q backupdir=%q", DefaultArchiveVisibility, BackupDir)
+	}
+	if BackupScheduleSpec != "0 3 * * *" || BackupKeepLast != 3 || BackupKeepDaily != 7 || BackupKeepWeekly != 4 {
+		t.Fatalf("unexpected parsed backup schedule: spec=%q last=%d daily=%d weekly=%d", BackupScheduleSpec, BackupKeepLast, BackupKeepDaily, BackupKeepWeekly)
+	}
+	if BackupTargets != "file:///mnt/nas/dataark" {
+		t.Fatalf("unexpected parsed backup targets: %q", BackupTargets)
+	}
+	if BackupDatabaseFormat != BackupDatabaseFormatNative || BackupUploadMaxMB != 512 {
+		t.Fatalf("unexpected parsed backup database format: %q upload max: %d", BackupDatabaseFormat, BackupUploadMaxMB)
+	}
+	if BackupPassphrase != "backup-passphrase" || BackupRecipients != "dataark1abc" || BackupIdentityFile != "/tmp/backup_identity.txt" || GenerateBackupKey {
+		t.Fatalf("unexpected parsed backup encryption: passphrase=%q recipients=%q identity=%q genkey=%v", BackupPassphrase, BackupRecipients, BackupIdentityFile, GenerateBackupKey)
+	}
+	if DBDriver != DBDriverSQLite || DBPath != "/tmp/dataark.db" {
+		t.Fatalf("unexpected parsed db driver config: driver=%q path=%q", DBDriver, DBPath)
+	}
 	if DBHost != "db" || DBPort != "5433" || DBName != "dataark" || DBUser != "user" || DBPassword != "pass" {
 		t.Fatalf("unexpected parsed db config: host=%q port=%q name=%q user=%q pass=%q", DBHost, DBPort, DBName, DBUser, DBPassword)
 	}
@@ -0,0 +1,427 @@
+package common
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	JWTAlgorithmHS256 = "HS256"
+	JWTAlgorithmEdDSA = "EdDSA"
+)
+
+const jwtKeyFileVersion = 1
+
+var (
+	jwtKeysMu sync.RWMutex
+	jwtKeys   *jwtKeyRing
+)
+
+// JWTKeyInfo 是对外展示的签名密钥信息，不包含密钥内容。
+type JWTKeyInfo struct {
+	KID       string     `json:"kid"`
+	Algorithm string     `json:"alg"`
+	Active    bool       `json:"active"`
+	Persisted bool       `json:"persisted"`
+	CreatedAt time.Time  `json:"createdAt"`
+	RetiredAt *time.Time `json:"retiredAt,omitempty"`
+}
+
+// jwtKey 是一把签名密钥。HS256 使用 Secret，EdDSA 使用 Ed25519 私钥的 seed。
+// 轮换后旧密钥标记 RetiredAt，只用于校验，Token 最长有效期过后从文件中移除。
+type jwtKey struct {
+	KID       string     `json:"kid"`
+	Algorithm string     `json:"alg"`
+	Secret    string     `json:"secret,omitempty"`
+	Seed      string     `json:"seed,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+	RetiredAt *time.Time `json:"retiredAt,omitempty"`
+
+	signingKey   interface{}
+	verifyingKey interface{}
+	persisted    bool
+}
+
+type jwtKeyFile struct {
+	Version int       `json:"version"`
+	Active  string    `json:"active"`
+	Keys    []*jwtKey `json:"keys"`
+}
+
+// jwtKeyRing 保存全部可用于校验的密钥和当前用于签名的密钥。
+// path 为空表示密钥只在内存中，不支持持久化轮换。
+type jwtKeyRing struct {
+	path   string
+	active *jwtKey
+	keys   map[string]*jwtKey
+	file   jwtKeyFile
+}
+
+// InitJWTKeys 按 -jwtsecret、-jwtkeyfile、-jwtalg 加载签名密钥，必须在签发 Token 之前调用。
+// 指定了 -jwtsecret（或环境变量 DATAARK_JWT_SECRET）且算法为 HS256 时用它签名；
+// 否则使用密钥文件中的当前密钥，文件不存在时自动生成并保存。
+// 密钥文件中的其它未过期密钥仍可用于校验，保证轮换期间已签发的 Token 继续有效。
+func InitJWTKeys() error {
+	ring, err := loadJWTKeyRing(JWTKeyFile, JWTSecret, JWTAlgorithm)
+	if err != nil {
+		return err
+	}
+	jwtKeysMu.Lock()
+	jwtKeys = ring
+	jwtKeysMu.Unlock()
+	return nil
+}
+
+// RotateJWTKey 生成一把新的签名密钥并设为当前密钥，旧密钥在 Token 最长有效期内仍可校验。
+func RotateJWTKey() (*JWTKeyInfo, error) {
+	jwtKeysMu.Lock()
+	defer jwtKeysMu.Unlock()
+
+	ring := jwtKeys
+	if ring == nil || ring.path == "" {
+		return nil, errors.New("jwt key file is not configured")
+	}
+	if ring.active != nil && !ring.active.persisted {
+		return nil, errors.New("the signing key comes from -jwtsecret, rotate it by changing the secret")
+	}
+
+	rotated, err := ring.withNewActiveKey(ring.file.activeAlgorithm())
+	if err != nil {
+		return nil, err
+	}
+	jwtKeys = rotated
+	return rotated.active.info(true), nil
+}
+
+// ListJWTKeys 返回当前可用于校验的全部密钥。
+func ListJWTKeys() []JWTKeyInfo {
+	ring := currentJWTKeyRing()
+	infos := make([]JWTKeyInfo, 0, len(ring.keys))
+	for _, key := range ring.orderedKeys() {
+		infos = append(infos, *key.info(key == ring.active))
+	}
+	return infos
+}
+
+// currentJWTKeyRing 返回已加载的密钥；未初始化时（例如单元测试）生成仅存在于内存的临时密钥。
+func currentJWTKeyRing() *jwtKeyRing {
+	jwtKeysMu.RLock()
+	ring := jwtKeys
+	jwtKeysMu.RUnlock()
+	if ring != nil {
+		return ring
+	}
+
+	jwtKeysMu.Lock()
+	defer jwtKeysMu.Unlock()
+	if jwtKeys == nil {
+		key, err := generateJWTKey(JWTAlgorithmHS256)
+		if err != nil {
+			panic(fmt.Sprintf("failed to generate temporary jwt key: %v", err))
+		}
+		jwtKeys = &jwtKeyRing{active: key, keys: map[string]*jwtKey{key.KID: key}}
+	}
+	return jwtKeys
+}
+
+// signJWT 使用当前密钥签名，并在 header 中写入 kid。
+func signJWT(claims jwt.Claims) (string, error) {
+	key := currentJWTKeyRing().active
+	token := jwt.NewWithClaims(jwtSigningMethod(key.Algorithm), claims)
+	token.Header["kid"] = key.KID
+	return token.SignedString(key.signingKey)
+}
+
+// jwtVerificationKey 按 kid 查找校验密钥，并要求 Token 的算法与密钥一致，防止算法混淆。
+func jwtVerificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		return nil, errors.New("token has no key id")
+	}
+	key, ok := currentJWTKeyRing().keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	if token.Method.Alg() != key.Algorithm {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return key.verifyingKey, nil
+}
+
+func jwtSigningMethod(algorithm string) jwt.SigningMethod {
+	if algorithm == JWTAlgorithmEdDSA {
+		return jwt.SigningMethodEdDSA
+	}
+	return jwt.SigningMethodHS256
+}
+
+// NormalizeJWTAlgorithm 校验 -jwtalg 参数，大小写不敏感。
+func NormalizeJWTAlgorithm(algorithm string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(algorithm)) {
+	case "", "hs256":
+		return JWTAlgorithmHS256, nil
+	case "eddsa", "ed25519":
+		return JWTAlgorithmEdDSA, nil
+	default:
+		return "", fmt.Errorf("unsupported jwt algorithm %q", algorithm)
+	}
+}
+
+func loadJWTKeyRing(path string, secret string, algorithm string) (*jwtKeyRing, error) {
+	algorithm, err := NormalizeJWTAlgorithm(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	ring := &jwtKeyRing{
+		path: strings.TrimSpace(path),
+		keys: make(map[string]*jwtKey),
+		file: jwtKeyFile{Version: jwtKeyFileVersion},
+	}
+
+	if ring.path != "" {
+		if err := ring.loadFile(); err != nil {
+			return nil, err
+		}
+	}
+
+	if secret != "" && algorithm == JWTAlgorithmHS256 {
+		if len(secret) < 32 {
+			return nil, errors.New("-jwtsecret must be at least 32 characters")
+		}
+		key := newSecretJWTKey(secret)
+		ring.keys[key.KID] = key
+		ring.active = key
+		return ring, nil
+	}
+	if secret != "" {
+		return nil, errors.New("-jwtsecret can only be used with the HS256 algorithm")
+	}
+	if ring.path == "" {
+		return nil, errors.New("either -jwtsecret or -jwtkeyfile is required")
+	}
+
+	if active := ring.keys[ring.file.Active]; active != nil && active.Algorithm == algorithm {
+		ring.active = active
+		return ring, nil
+	}
+
+	// 文件不存在、为空或算法与 -jwtalg 不一致时生成新密钥，已有密钥保留用于校验。
+	return ring.withNewActiveKey(algorithm)
+}
+
+// withNewActiveKey 生成新密钥并写入密钥文件，返回新的密钥集合。
+// 已发布的密钥集合会被并发读取，这里复制一份再修改，由调用方整体替换。
+func (r *jwtKeyRing) withNewActiveKey(algorithm string) (*jwtKeyRing, error) {
+	key, err := generateJWTKey(algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	next := &jwtKeyRing{
+		path: r.path,
+		keys: make(map[string]*jwtKey, len(r.keys)+1),
+		file: jwtKeyFile{Version: jwtKeyFileVersion, Active: key.KID},
+	}
+	now := time.Now()
+	for _, existing := range r.file.Keys {
+		copied := *existing
+		if copied.KID == r.file.Active && copied.RetiredAt == nil {
+			copied.RetiredAt = &now
+		}
+		next.file.Keys = append(next.file.Keys, &copied)
+		next.keys[copied.KID] = &copied
+	}
+	next.file.Keys = append(next.file.Keys, key)
+	next.keys[key.KID] = key
+	next.active = key
+
+	if err := writeJWTKeyFile(next.path, &next.file); err != nil {
+		return nil, err
+	}
+	return next, nil
+}
+
+// loadFile 读取密钥文件，并丢弃退役时间超过 Token 最长有效期的密钥。
+func (r *jwtKeyRing) loadFile() error {
+	content, err := os.ReadFile(r.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var file jwtKeyFile
+	if err := json.Unmarshal(content, &file); err != nil {
+		return fmt.Errorf("decode jwt key file %s: %w", r.path, err)
+	}
+	if file.Version != jwtKeyFileVersion {
+		return fmt.Errorf("jwt key file %s has unsupported version %d", r.path, file.Version)
+	}
+
+	keys := make([]*jwtKey, 0, len(file.Keys))
+	for _, key := range file.Keys {
+		if key.RetiredAt != nil && time.Since(*key.RetiredAt) > tokenExpiration && key.KID != file.Active {
+			continue
+		}
+		if err := key.decode(); err != nil {
+			return fmt.Errorf("jwt key %s: %w", key.KID, err)
+		}
+		key.persisted = true
+		r.keys[key.KID] = key
+		keys = append(keys, key)
+	}
+	file.Keys = keys
+	r.file = file
+	return nil
+}
+
+func (r *jwtKeyRing) orderedKeys() []*jwtKey {
+	keys := make([]*jwtKey, 0, len(r.keys))
+	if r.active != nil && !r.active.persisted {
+		keys = append(keys, r.active)
+	}
+	for _, key := range r.file.Keys {
+		if r.keys[key.KID] == key {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func (f *jwtKeyFile) activeAlgorithm() string {
+	for _, key := range f.Keys {
+		if key.KID == f.Active {
+			return key.Algorithm
+		}
+	}
+	return JWTAlgorithmHS256
+}
+
+func newSecretJWTKey(secret string) *jwtKey {
+	// kid 取自密钥的哈希，更换 -jwtsecret 后旧 Token 因为找不到 kid 而失效。
+	sum := sha256.Sum256([]byte(secret))
+	return &jwtKey{
+		KID:          "secret-" + hex.EncodeToString(sum[:4]),
+		Algorithm:    JWTAlgorithmHS256,
+		signingKey:   []byte(secret),
+		verifyingKey: []byte(secret),
+	}
+}
+
+func generateJWTKey(algorithm string) (*jwtKey, error) {
+	kidBytes := make([]byte, 8)
+	if _, err := rand.Read(kidBytes); err != nil {
+		return nil, err
+	}
+	key := &jwtKey{
+		KID:       hex.EncodeToString(kidBytes),
+		Algorithm: algorithm,
+		CreatedAt: time.Now(),
+		persisted: true,
+	}
+
+	material := make([]byte, 32)
+	if _, err := rand.Read(material); err != nil {
+		return nil, err
+	}
+	switch algorithm {
+	case JWTAlgorithmHS256:
+		key.Secret = base64.StdEncoding.EncodeToString(material)
+	case JWTAlgorithmEdDSA:
+		key.Seed = base64.StdEncoding.EncodeToString(material)
+	default:
+		return nil, fmt.Errorf("unsupported jwt algorithm %q", algorithm)
+	}
+	if err := key.decode(); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (k *jwtKey) decode() error {
+	switch k.Algorithm {
+	case JWTAlgorithmHS256:
+		secret, err := base64.StdEncoding.DecodeString(k.Secret)
+		if err != nil {
+			return err
+		}
+		if len(secret) < 32 {
+			return errors.New("HS256 secret must be at least 32 bytes")
+		}
+		k.signingKey = secret
+		k.verifyingKey = secret
+	case JWTAlgorithmEdDSA:
+		seed, err := base64.StdEncoding.DecodeString(k.Seed)
+		if err != nil {
+			return err
+		}
+		if len(seed) != ed25519.SeedSize {
+			return fmt.Errorf("Ed25519 seed must be %d bytes", ed25519.SeedSize)
+		}
+		privateKey := ed25519.NewKeyFromSeed(seed)
+		k.signingKey = privateKey
+		k.verifyingKey = privateKey.Public()
+	default:
+		return fmt.Errorf("unsupported jwt algorithm %q", k.Algorithm)
+	}
+	return nil
+}
+
+func (k *jwtKey) info(active bool) *JWTKeyInfo {
+	return &JWTKeyInfo{
+		KID:       k.KID,
+		Algorithm: k.Algorithm,
+		Active:    active,
+		Persisted: k.persisted,
+		CreatedAt: k.CreatedAt,
+		RetiredAt: k.RetiredAt,
+	}
+}
+
+// writeJWTKeyFile 先写临时文件再重命名，权限限制为仅所有者可读写。
+func writeJWTKeyFile(path string, file *jwtKeyFile) error {
+	content, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	tempFile, err := os.CreateTemp(dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tempPath := tempFile.Name()
+	defer os.Remove(tempPath)
+
+	if err := tempFile.Chmod(0o600); err != nil {
+		_ = tempFile.Close()
+		return err
+	}
+	if _, err := tempFile.Write(content); err != nil {
+		_ = tempFile.Close()
+		return err
+	}
+	if err := tempFile.Sync(); err != nil {
+		_ = tempFile.Close()
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, path)
+}
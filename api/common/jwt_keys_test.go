@@ -0,0 +1,210 @@
+package common
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func useJWTKeyConfig(t *testing.T, keyFile string, secret string, algorithm string) {
+	t.Helper()
+	oldKeys := jwtKeys
+	oldKeyFile, oldSecret, oldAlgorithm := JWTKeyFile, JWTSecret, JWTAlgorithm
+	t.Cleanup(func() {
+		jwtKeys = oldKeys
+		JWTKeyFile, JWTSecret, JWTAlgorithm = oldKeyFile, oldSecret, oldAlgorithm
+	})
+	JWTKeyFile, JWTSecret, JWTAlgorithm = keyFile, secret, algorithm
+	if err := InitJWTKeys(); err != nil {
+		t.Fatalf("InitJWTKeys returned error: %v", err)
+	}
+}
+
+func issueTestToken(t *testing.T) (string, string) {
+	t.Helper()
+	issued, err := GenerateToken(&User{ID: 1, Username: "alice"})
+	if err != nil {
+		t.Fatalf("GenerateToken returned error: %v", err)
+	}
+	token, _, err := jwt.NewParser().ParseUnverified(issued.Token, &Claims{})
+	if err != nil {
+		t.Fatalf("ParseUnverified returned error: %v", err)
+	}
+	kid, _ := token.Header["kid"].(string)
+	return issued.Token, kid
+}
+
+func TestJWTKeyFileIsGeneratedAndReused(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "secrets", "jwt_keys.json")
+	useJWTKeyConfig(t, keyFile, "", "hs256")
+
+	token, kid := issueTestToken(t)
+	info, err := os.Stat(keyFile)
+	if err != nil {
+		t.Fatalf("key file was not created: %v", err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Fatalf("key file mode = %v, want 0600", info.Mode().Perm())
+	}
+
+	// 模拟重启：重新加载后同一个 Token 仍然有效
+	if err := InitJWTKeys(); err != nil {
+		t.Fatalf("InitJWTKeys returned error: %v", err)
+	}
+	if _, err := ValidateToken(token); err != nil {
+		t.Fatalf("token should survive restart: %v", err)
+	}
+	if _, reloadedKID := issueTestToken(t); reloadedKID != kid {
+		t.Fatalf("kid after reload = %q, want %q", reloadedKID, kid)
+	}
+}
+
+func TestRotateJWTKeyKeepsOldTokensValid(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "jwt_keys.json")
+	useJWTKeyConfig(t, keyFile, "", JWTAlgorithmHS256)
+
+	oldToken, oldKID := issueTestToken(t)
+	rotated, err := RotateJWTKey()
+	if err != nil {
+		t.Fatalf("RotateJWTKey returned error: %v", err)
+	}
+	if rotated.KID == oldKID || !rotated.Active {
+		t.Fatalf("rotated = %#v", rotated)
+	}
+	newToken, newKID := issueTestToken(t)
+	if newKID != rotated.KID {
+		t.Fatalf("new token kid = %q, want %q", newKID, rotated.KID)
+	}
+	for _, token := range []string{oldToken, newToken} {
+		if _, err := ValidateToken(token); err != nil {
+			t.Fatalf("ValidateToken returned error: %v", err)
+		}
+	}
+
+	keys := ListJWTKeys()
+	if len(keys) != 2 || keys[0].KID != oldKID || keys[0].RetiredAt == nil || keys[0].Active || !keys[1].Active {
+		t.Fatalf("ListJWTKeys = %#v", keys)
+	}
+	content, err := os.ReadFile(keyFile)
+	if err != nil {
+		t.Fatalf("ReadFile returned error: %v", err)
+	}
+	if strings.Contains(mustMarshalJSON(t, keys), `"secret"`) || !strings.Contains(string(content), `"secret"`) {
+		t.Fatal("secrets must be persisted in the key file but never listed")
+	}
+}
+
+func TestRetiredJWTKeysExpireWithTokens(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "jwt_keys.json")
+	useJWTKeyConfig(t, keyFile, "", JWTAlgorithmHS256)
+	oldToken, _ := issueTestToken(t)
+	if _, err := RotateJWTKey(); err != nil {
+		t.Fatalf("RotateJWTKey returned error: %v", err)
+	}
+
+	var file jwtKeyFile
+	content, _ := os.ReadFile(keyFile)
+	if err := json.Unmarshal(content, &file); err != nil {
+		t.Fatalf("decode key file: %v", err)
+	}
+	longAgo := time.Now().Add(-tokenExpiration - time.Hour)
+	file.Keys[0].RetiredAt = &longAgo
+	if err := writeJWTKeyFile(keyFile, &file); err != nil {
+		t.Fatalf("writeJWTKeyFile returned error: %v", err)
+	}
+
+	if err := InitJWTKeys(); err != nil {
+		t.Fatalf("InitJWTKeys returned error: %v", err)
+	}
+	if len(ListJWTKeys()) != 1 {
+		t.Fatalf("expired retired key should be dropped: %#v", ListJWTKeys())
+	}
+	if _, err := ValidateToken(oldToken); err == nil {
+		t.Fatal("token signed by a dropped key should be rejected")
+	}
+}
+
+func TestEd25519SigningAndAlgorithmSwitch(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "jwt_keys.json")
+	useJWTKeyConfig(t, keyFile, "", JWTAlgorithmHS256)
+	hmacToken, _ := issueTestToken(t)
+
+	JWTAlgorithm = "ed25519"
+	if err := InitJWTKeys(); err != nil {
+		t.Fatalf("InitJWTKeys returned error: %v", err)
+	}
+	edToken, _ := issueTestToken(t)
+	parsed, _, err := jwt.NewParser().ParseUnverified(edToken, &Claims{})
+	if err != nil || parsed.Method.Alg() != JWTAlgorithmEdDSA {
+		t.Fatalf("token alg = %v, err=%v; want EdDSA", parsed.Method.Alg(), err)
+	}
+	for _, token := range []string{hmacToken, edToken} {
+		if _, err := ValidateToken(token); err != nil {
+			t.Fatalf("ValidateToken returned error: %v", err)
+		}
+	}
+
+	// 用 Ed25519 公钥当作 HMAC 密钥伪造 Token 属于算法混淆攻击，必须被拒绝
+	active := currentJWTKeyRing().active
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, &Claims{UserID: 1})
+	forged.Header["kid"] = active.KID
+	publicKeyBytes, _ := json.Marshal(active.verifyingKey)
+	forgedToken, err := forged.SignedString(publicKeyBytes)
+	if err != nil {
+		t.Fatalf("sign forged token: %v", err)
+	}
+	if _, err := ValidateToken(forgedToken); err == nil {
+		t.Fatal("algorithm confusion token should be rejected")
+	}
+}
+
+func TestJWTSecretFromConfig(t *testing.T) {
+	secret := strings.Repeat("s", 40)
+	useJWTKeyConfig(t, "", secret, JWTAlgorithmHS256)
+
+	token, kid := issueTestToken(t)
+	if !strings.HasPrefix(kid, "secret-") {
+		t.Fatalf("kid = %q", kid)
+	}
+	if _, err := ValidateToken(token); err != nil {
+		t.Fatalf("ValidateToken returned error: %v", err)
+	}
+	if _, err := RotateJWTKey(); err == nil {
+		t.Fatal("rotating without a key file should fail")
+	}
+
+	withoutKID := jwt.NewWithClaims(jwt.SigningMethodHS256, &Claims{UserID: 1})
+	withoutKIDToken, _ := withoutKID.SignedString([]byte(secret))
+	if _, err := ValidateToken(withoutKIDToken); err == nil {
+		t.Fatal("token without kid should be rejected")
+	}
+	emptySecretToken, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, &Claims{UserID: 1}).SignedString([]byte{})
+	if _, err := ValidateToken(emptySecretToken); err == nil {
+		t.Fatal("token signed with an empty secret should be rejected")
+	}
+
+	for _, tc := range []struct{ keyFile, secret, algorithm string }{
+		{"", "short", JWTAlgorithmHS256},
+		{"", secret, JWTAlgorithmEdDSA},
+		{"", "", JWTAlgorithmHS256},
+		{filepath.Join(t.TempDir(), "jwt_keys.json"), "", "rs256"},
+	} {
+		if _, err := loadJWTKeyRing(tc.keyFile, tc.secret, tc.algorithm); err == nil {
+			t.Fatalf("loadJWTKeyRing(%q, %q, %q) should fail", tc.keyFile, tc.secret, tc.algorithm)
+		}
+	}
+}
+
+func mustMarshalJSON(t *testing.T, value interface{}) string {
+	t.Helper()
+	content, err := json.Marshal(value)
+	if err != nil {
+		t.Fatalf("json.Marshal returned error: %v", err)
+	}
+	return string(content)
+}
@@ -0,0 +1,272 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// 登录限制的计数维度：同一用户名和同一来源 IP 分别计数，任一维度触发限制都会拒绝登录。
+const (
+	LoginThrottleUser = "user"
+	LoginThrottleIP   = "ip"
+)
+
+const (
+	// 前几次失败不限制，之后每次失败的等待时间翻倍，直到达到锁定阈值。
+	loginFreeAttempts  = 3
+	loginBaseDelay     = time.Second
+	loginMaxDelay      = 5 * time.Minute
+	loginFailureWindow = 24 * time.Hour
+	// 同一 IP 后面可能是 NAT 或 VPN 出口，阈值按用户名阈值放大。
+	loginIPFactor = 5
+	// 失败登录审计记录的保留时间。
+	loginFailureRetention = 90 * 24 * time.Hour
+	loginThrottleValueMax = 255
+)
+
+// 登录失败的原因，写入审计记录。
+const (
+	LoginFailureInvalidCredentials = "invalid_credentials"
+	LoginFailureUserDisabled       = "user_disabled"
+	LoginFailureThrottled          = "throttled"
+)
+
+// loginGuardMu 保证检查与登记登录尝试是原子的，避免并发请求绕过等待时间。
+var loginGuardMu sync.Mutex
+
+// LoginThrottle 某个用户名或 IP 的连续失败次数。
+// 每次尝试在校验密码前就计入失败，登录成功后再退回，并发的猜测请求因此同样会被延迟。
+type LoginThrottle struct {
+	Kind          string     `json:"kind" gorm:"primaryKey;size:8"`
+	Value         string     `json:"value" gorm:"primaryKey;size:255"`
+	Failures      int        `json:"failures" gorm:"not null;default:0"`
+	LastFailureAt time.Time  `json:"lastFailureAt"`
+	LockedUntil   *time.Time `json:"lockedUntil"`
+	UpdatedAt     time.Time  `json:"updatedAt"`
+}
+
+// LoginFailure 失败登录的审计记录。
+type LoginFailure struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	Username  string    `json:"username" gorm:"size:255;index"`
+	IP        string    `json:"ip" gorm:"size:64;index"`
+	Reason    string    `json:"reason" gorm:"size:32;not null"`
+	CreatedAt time.Time `json:"createdAt" gorm:"index"`
+}
+
+// LoginThrottledError 表示登录尝试过于频繁，RetryAfter 之后才能再次尝试。
+type LoginThrottledError struct {
+	RetryAfter time.Duration
+	Locked     bool
+}
+
+func (e *LoginThrottledError) Error() string {
+	if e.Locked {
+		return fmt.Sprintf("too many failed login attempts, account locked for %s", e.RetryAfter.Round(time.Second))
+	}
+	return fmt.Sprintf("too many failed login attempts, retry after %s", e.RetryAfter.Round(time.Second))
+}
+
+// beginLoginAttempt 检查用户名和 IP 是否允许登录，允许时先把本次尝试计为失败。
+func beginLoginAttempt(username, ip string, now time.Time) error {
+	loginGuardMu.Lock()
+	defer loginGuardMu.Unlock()
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		throttles := make([]*LoginThrottle, 0, 2)
+		for _, key := range loginThrottleKeys(username, ip) {
+			throttle, err := loadLoginThrottle(tx, key[0], key[1], now)
+			if err != nil {
+				return err
+			}
+			if retryAfter, locked := throttle.retryAfter(now); retryAfter > 0 {
+				return &LoginThrottledError{RetryAfter: retryAfter, Locked: locked}
+			}
+			throttles = append(throttles, throttle)
+		}
+
+		for _, throttle := range throttles {
+			throttle.Failures++
+			throttle.LastFailureAt = now
+			if throttle.Failures >= throttle.lockoutAttempts() {
+				lockedUntil := now.Add(LoginLockoutDuration)
+				throttle.LockedUntil = &lockedUntil
+			}
+			if err := tx.Save(throttle).Error; err != nil {
+				return fmt.Errorf("failed to record login attempt: %v", err)
+			}
+		}
+		return nil
+	})
+}
+
+// finishLoginAttempt 登录成功时清除用户名的计数并退回 IP 上预记的一次失败，失败时写入审计记录。
+// IP 的计数不在成功时清零，否则攻击者可以用自己的账号登录来重置所在 IP 的计数。
+func finishLoginAttempt(username, ip string, loginErr error) error {
+	if loginErr == nil {
+		loginGuardMu.Lock()
+		defer loginGuardMu.Unlock()
+		return db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Where("kind = ? AND value = ?", LoginThrottleUser, truncateLoginValue(username)).Delete(&LoginThrottle{}).Error; err != nil {
+				return fmt.Errorf("failed to reset login attempts: %v", err)
+			}
+			if ip == "" {
+				return nil
+			}
+			throttle, err := loadLoginThrottle(tx, LoginThrottleIP, ip, time.Now())
+			if err != nil || throttle.Failures == 0 {
+				return err
+			}
+			throttle.Failures--
+			if throttle.Failures < throttle.lockoutAttempts() {
+				throttle.LockedUntil = nil
+			}
+			if err := tx.Save(throttle).Error; err != nil {
+				return fmt.Errorf("failed to reset login attempts: %v", err)
+			}
+			return nil
+		})
+	}
+
+	reason := LoginFailureInvalidCredentials
+	var throttled *LoginThrottledError
+	switch {
+	case errors.As(loginErr, &throttled):
+		reason = LoginFailureThrottled
+	case errors.Is(loginErr, ErrUserDisabled):
+		reason = LoginFailureUserDisabled
+	case !errors.Is(loginErr, ErrInvalidCredentials):
+		// 数据库等内部错误不属于登录失败
+		return nil
+	}
+	failure := LoginFailure{Username: truncateLoginValue(username), IP: ip, Reason: reason}
+	if err := db.Create(&failure).Error; err != nil {
+		return fmt.Errorf("failed to record login failure: %v", err)
+	}
+	return nil
+}
+
+func loadLoginThrottle(tx *gorm.DB, kind, value string, now time.Time) (*LoginThrottle, error) {
+	throttle := &LoginThrottle{Kind: kind, Value: value}
+	err := tx.Where("kind = ? AND value = ?", kind, value).First(throttle).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("failed to load login attempts: %v", err)
+	}
+	// 长时间没有失败且未处于锁定中的计数重新开始
+	if throttle.Failures > 0 && now.Sub(throttle.LastFailureAt) > loginFailureWindow &&
+		(throttle.LockedUntil == nil || now.After(*throttle.LockedUntil)) {
+		throttle.Failures = 0
+		throttle.LockedUntil = nil
+	}
+	return throttle, nil
+}
+
+// retryAfter 返回还需要等待的时间，以及是否处于锁定状态。
+func (t *LoginThrottle) retryAfter(now time.Time) (time.Duration, bool) {
+	if t.LockedUntil != nil && now.Before(*t.LockedUntil) {
+		return t.LockedUntil.Sub(now), true
+	}
+	free := loginFreeAttempts * t.factor()
+	if t.Failures < free {
+		return 0, false
+	}
+	delay := loginMaxDelay
+	if shift := t.Failures - free; shift < 16 {
+		delay = loginBaseDelay << shift
+	}
+	if delay > loginMaxDelay {
+		delay = loginMaxDelay
+	}
+	if wait := t.LastFailureAt.Add(delay).Sub(now); wait > 0 {
+		return wait, false
+	}
+	return 0, false
+}
+
+func (t *LoginThrottle) lockoutAttempts() int {
+	attempts := LoginLockoutAttempts
+	if attempts <= 0 {
+		attempts = 10
+	}
+	return attempts * t.factor()
+}
+
+func (t *LoginThrottle) factor() int {
+	if t.Kind == LoginThrottleIP {
+		return loginIPFactor
+	}
+	return 1
+}
+
+func loginThrottleKeys(username, ip string) [][2]string {
+	keys := [][2]string{{LoginThrottleUser, truncateLoginValue(username)}}
+	if ip != "" {
+		keys = append(keys, [2]string{LoginThrottleIP, ip})
+	}
+	return keys
+}
+
+func truncateLoginValue(value string) string {
+	if len(value) > loginThrottleValueMax {
+		return value[:loginThrottleValueMax]
+	}
+	return value
+}
+
+// ListLoginThrottles 列出当前被延迟或锁定的用户名和 IP。
+func ListLoginThrottles() ([]LoginThrottle, error) {
+	var throttles []LoginThrottle
+	if err := db.Where("failures > 0").Order("last_failure_at DESC").Find(&throttles).Error; err != nil {
+		return nil, fmt.Errorf("failed to list login throttles: %v", err)
+	}
+	now := time.Now()
+	active := throttles[:0]
+	for _, throttle := range throttles {
+		if wait, _ := throttle.retryAfter(now); wait > 0 {
+			active = append(active, throttle)
+		}
+	}
+	return active, nil
+}
+
+// UnlockLogin 清除用户名或 IP 的失败计数，返回是否有记录被清除。
+func UnlockLogin(kind, value string) (bool, error) {
+	if kind != LoginThrottleUser && kind != LoginThrottleIP {
+		return false, fmt.Errorf("unknown login throttle kind %q", kind)
+	}
+	result := db.Where("kind = ? AND value = ?", kind, truncateLoginValue(value)).Delete(&LoginThrottle{})
+	if result.Error != nil {
+		return false, fmt.Errorf("failed to unlock login: %v", result.Error)
+	}
+	return result.RowsAffected > 0, nil
+}
+
+// ListLoginFailures 按时间倒序分页列出失败登录记录，username 为空时不过滤。
+func ListLoginFailures(page, pageSize int, username string) ([]LoginFailure, int64, error) {
+	query := db.Model(&LoginFailure{})
+	if username != "" {
+		query = query.Where("username = ?", username)
+	}
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, fmt.Errorf("failed to count login failures: %v", err)
+	}
+	var failures []LoginFailure
+	if err := query.Order("id DESC").Offset((page - 1) * pageSize).Limit(pageSize).Find(&failures).Error; err != nil {
+		return nil, 0, fmt.Errorf("failed to list login failures: %v", err)
+	}
+	return failures, total, nil
+}
+
+// CleanupLoginFailures 删除超过保留期的失败登录记录。
+func CleanupLoginFailures() (int64, error) {
+	result := db.Where("created_at < ?", time.Now().Add(-loginFailureRetention)).Delete(&LoginFailure{})
+	if result.Error != nil {
+		return 0, fmt.Errorf("failed to cleanup login failures: %v", result.Error)
+	}
+	return result.RowsAffected, nil
+}
@@ -0,0 +1,117 @@
+package common
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLoginWithTokenThrottlesAndLocksOut(t *testing.T) {
+	setupSQLiteDB(t)
+	oldAttempts, oldDuration := LoginLockoutAttempts, LoginLockoutDuration
+	t.Cleanup(func() {
+		LoginLockoutAttempts, LoginLockoutDuration = oldAttempts, oldDuration
+	})
+	LoginLockoutAttempts = 5
+	LoginLockoutDuration = time.Hour
+	if _, err := CreateUserWithRole("alice", "correct-password", RoleViewer); err != nil {
+		t.Fatalf("CreateUserWithRole returned error: %v", err)
+	}
+
+	for i := 0; i < loginFreeAttempts; i++ {
+		if _, err := LoginWithToken("alice", "wrong", "10.0.0.1"); !errors.Is(err, ErrInvalidCredentials) {
+			t.Fatalf("attempt %d error = %v, want ErrInvalidCredentials", i+1, err)
+		}
+	}
+	var throttled *LoginThrottledError
+	_, err := LoginWithToken("alice", "correct-password", "10.0.0.2")
+	if !errors.As(err, &throttled) || throttled.Locked || throttled.RetryAfter <= 0 || throttled.RetryAfter > loginBaseDelay {
+		t.Fatalf("error after free attempts = %v, want short delay", err)
+	}
+
+	// 把上次失败时间前移，模拟等待结束，延迟应该逐次翻倍
+	expireLoginDelay := func() {
+		if err := db.Model(&LoginThrottle{}).Where("1 = 1").Update("last_failure_at", time.Now().Add(-loginMaxDelay)).Error; err != nil {
+			t.Fatalf("failed to age login throttle: %v", err)
+		}
+	}
+	expireLoginDelay()
+	if _, err := LoginWithToken("alice", "wrong", "10.0.0.1"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("fourth attempt error = %v, want ErrInvalidCredentials", err)
+	}
+	if _, err := LoginWithToken("alice", "wrong", "10.0.0.1"); !errors.As(err, &throttled) || throttled.RetryAfter <= loginBaseDelay {
+		t.Fatalf("error after fourth failure = %v, want doubled delay", err)
+	}
+	expireLoginDelay()
+	if _, err := LoginWithToken("alice", "wrong", "10.0.0.1"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("fifth attempt error = %v, want ErrInvalidCredentials", err)
+	}
+	expireLoginDelay()
+	if _, err := LoginWithToken("alice", "correct-password", "10.0.0.3"); !errors.As(err, &throttled) || !throttled.Locked {
+		t.Fatalf("error after lockout threshold = %v, want locked", err)
+	}
+
+	throttles, err := ListLoginThrottles()
+	if err != nil || len(throttles) != 1 || throttles[0].Kind != LoginThrottleUser {
+		t.Fatalf("throttles = %+v err=%v, want only the username locked", throttles, err)
+	}
+	failures, total, err := ListLoginFailures(1, 50, "alice")
+	if err != nil || total != 8 {
+		t.Fatalf("failures total = %d err=%v, want 8", total, err)
+	}
+	if failures[0].Reason != LoginFailureThrottled || failures[0].IP != "10.0.0.3" {
+		t.Fatalf("latest failure = %+v, want throttled attempt from 10.0.0.3", failures[0])
+	}
+
+	if unlocked, err := UnlockLogin(LoginThrottleUser, "alice"); err != nil || !unlocked {
+		t.Fatalf("UnlockLogin = %v, %v", unlocked, err)
+	}
+	if _, err := LoginWithToken("alice", "correct-password", "10.0.0.1"); err != nil {
+		t.Fatalf("login after unlock returned error: %v", err)
+	}
+	if _, err := UnlockLogin("host", "x"); err == nil {
+		t.Fatal("unknown throttle kind should be rejected")
+	}
+}
+
+func TestLoginThrottleByIPAndSuccessAccounting(t *testing.T) {
+	setupSQLiteDB(t)
+	oldAttempts := LoginLockoutAttempts
+	t.Cleanup(func() {
+		LoginLockoutAttempts = oldAttempts
+	})
+	LoginLockoutAttempts = 10
+	if _, err := CreateUserWithRole("bob", "correct-password", RoleViewer); err != nil {
+		t.Fatalf("CreateUserWithRole returned error: %v", err)
+	}
+
+	// 成功登录不会在 IP 上留下计数
+	for i := 0; i < 3*loginIPFactor; i++ {
+		if _, err := LoginWithToken("bob", "correct-password", "10.1.1.1"); err != nil {
+			t.Fatalf("successful login %d returned error: %v", i+1, err)
+		}
+	}
+
+	// 同一 IP 猜测不同用户名，按 IP 计数触发限制
+	now := time.Now()
+	for i := 0; i < loginFreeAttempts*loginIPFactor; i++ {
+		if err := beginLoginAttempt("user-"+string(rune('a'+i)), "10.9.9.9", now); err != nil {
+			t.Fatalf("attempt %d returned error: %v", i+1, err)
+		}
+	}
+	var throttled *LoginThrottledError
+	if err := beginLoginAttempt("someone-else", "10.9.9.9", now); !errors.As(err, &throttled) {
+		t.Fatalf("ip attempt error = %v, want throttled", err)
+	}
+	if err := beginLoginAttempt("someone-else", "10.9.9.10", now); err != nil {
+		t.Fatalf("other ip returned error: %v", err)
+	}
+
+	// 超过统计窗口的旧失败不再计入
+	if err := db.Model(&LoginThrottle{}).Where("kind = ?", LoginThrottleIP).Update("last_failure_at", now.Add(-2*loginFailureWindow)).Error; err != nil {
+		t.Fatalf("failed to age login throttle: %v", err)
+	}
+	if err := beginLoginAttempt("someone-else", "10.9.9.9", now); err != nil {
+		t.Fatalf("attempt after failure window returned error: %v", err)
+	}
+}
@@ -0,0 +1,759 @@
+package common
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+)
+
+// OIDCRoleNone 作为 -oidcdefaultrole 时，不属于任何映射组的用户不能登录。
+const OIDCRoleNone = "none"
+
+const (
+	// 登录请求（state、nonce、PKCE verifier）在内存中保留的时间，超时后需要重新发起登录。
+	oidcLoginTimeout = 10 * time.Minute
+	// 回调完成后换取 Token 的一次性登录码的有效期。
+	oidcLoginCodeTTL = time.Minute
+	// 遇到未知 kid 时重新拉取 JWKS 的最小间隔，避免伪造的 Token 频繁触发请求。
+	oidcJWKSRefreshInterval = time.Minute
+	oidcHTTPTimeout         = 10 * time.Second
+	oidcMaxResponseBytes    = 1 << 20
+)
+
+var (
+	ErrOIDCDisabled = errors.New("oidc login is not configured")
+	// ErrOIDCStateInvalid 表示回调的 state 不存在、已使用或已过期。
+	ErrOIDCStateInvalid       = errors.New("oidc login state is invalid or expired")
+	ErrOIDCLoginCodeInvalid   = errors.New("oidc login code is invalid or expired")
+	ErrOIDCIDTokenInvalid     = errors.New("oidc id token is invalid")
+	ErrOIDCUserNotAllowed     = errors.New("oidc user is not allowed to log in")
+	ErrOIDCUserNotProvisioned = errors.New("oidc user has no local account and auto-provisioning is disabled")
+)
+
+var (
+	oidcProviderMu sync.RWMutex
+	oidcProvider   *OIDCProvider
+)
+
+// OIDCConfig 单点登录配置，由 -oidc* 参数生成。
+type OIDCConfig struct {
+	Issuer         string
+	ClientID       string
+	ClientSecret   string
+	RedirectURL    string
+	Scopes         []string
+	UsernameClaim  string
+	GroupsClaim    string
+	RoleMapping    map[string]string
+	DefaultRole    string
+	AutoProvision  bool
+	LinkByUsername bool
+}
+
+// UserIdentity 外部身份与本地用户的绑定，(issuer, subject) 唯一确定一个 IdP 用户。
+type UserIdentity struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	UserID    uint      `json:"userId" gorm:"index;not null"`
+	Issuer    string    `json:"issuer" gorm:"size:255;not null;uniqueIndex:idx_user_identities_issuer_subject"`
+	Subject   string    `json:"subject" gorm:"size:255;not null;uniqueIndex:idx_user_identities_issuer_subject"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// OIDCProvider 一个 OpenID Connect 身份提供方。
+// 发现文档和 JWKS 在首次使用时拉取并缓存，IdP 暂时不可用不会影响服务启动。
+type OIDCProvider struct {
+	config OIDCConfig
+	client *http.Client
+
+	mu            sync.Mutex
+	metadata      *oidcMetadata
+	keys          map[string]crypto.PublicKey
+	keysFetchedAt time.Time
+	pending       map[string]oidcPendingLogin
+	loginCodes    map[string]oidcLoginCode
+}
+
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcPendingLogin struct {
+	nonce        string
+	codeVerifier string
+	expiresAt    time.Time
+}
+
+type oidcLoginCode struct {
+	userID    uint
+	expiresAt time.Time
+}
+
+type oidcJWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// OIDCConfigFromFlags 根据命令行参数生成配置，未设置 -oidcissuer 时返回 nil 表示未启用。
+func OIDCConfigFromFlags() (*OIDCConfig, error) {
+	if strings.TrimSpace(OIDCIssuer) == "" {
+		return nil, nil
+	}
+	roleMapping, err := ParseOIDCRoleMapping(OIDCRoleMapping)
+	if err != nil {
+		return nil, err
+	}
+	config := &OIDCConfig{
+		Issuer:         strings.TrimRight(strings.TrimSpace(OIDCIssuer), "/"),
+		ClientID:       strings.TrimSpace(OIDCClientID),
+		ClientSecret:   OIDCClientSecret,
+		RedirectURL:    strings.TrimSpace(OIDCRedirectURL),
+		Scopes:         strings.Fields(strings.ReplaceAll(OIDCScopes, ",", " ")),
+		UsernameClaim:  strings.TrimSpace(OIDCUsernameClaim),
+		GroupsClaim:    strings.TrimSpace(OIDCGroupsClaim),
+		RoleMapping:    roleMapping,
+		DefaultRole:    strings.ToLower(strings.TrimSpace(OIDCDefaultRole)),
+		AutoProvision:  OIDCAutoProvision,
+		LinkByUsername: OIDCLinkByUsername,
+	}
+	return config, config.validate()
+}
+
+func (config *OIDCConfig) validate() error {
+	if config.ClientID == "" {
+		return errors.New("oidc client id is required")
+	}
+	if config.RedirectURL == "" {
+		return errors.New("oidc redirect url is required")
+	}
+	if _, err := url.ParseRequestURI(config.RedirectURL); err != nil {
+		return fmt.Errorf("invalid oidc redirect url: %v", err)
+	}
+	if config.DefaultRole != OIDCRoleNone {
+		role, err := NormalizeRole(config.DefaultRole)
+		if err != nil {
+			return err
+		}
+		config.DefaultRole = role
+	}
+	hasOpenID := false
+	for _, scope := range config.Scopes {
+		hasOpenID = hasOpenID || scope == "openid"
+	}
+	if !hasOpenID {
+		config.Scopes = append([]string{"openid"}, config.Scopes...)
+	}
+	if config.UsernameClaim == "" {
+		config.UsernameClaim = "preferred_username"
+	}
+	return nil
+}
+
+// ParseOIDCRoleMapping 解析 "组=角色,组=角色" 形式的组到角色映射。
+func ParseOIDCRoleMapping(raw string) (map[string]string, error) {
+	mapping := make(map[string]string)
+	for _, item := range strings.Split(raw, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		group, role, ok := strings.Cut(item, "=")
+		group = strings.TrimSpace(group)
+		if !ok || group == "" || strings.TrimSpace(role) == "" {
+			return nil, fmt.Errorf("invalid oidc role mapping %q, want group=role", item)
+		}
+		normalizedRole, err := NormalizeRole(role)
+		if err != nil {
+			return nil, err
+		}
+		mapping[group] = normalizedRole
+	}
+	return mapping, nil
+}
+
+// InitOIDC 根据命令行参数启用单点登录，未配置 -oidcissuer 时不做任何事。
+func InitOIDC() error {
+	config, err := OIDCConfigFromFlags()
+	if err != nil {
+		return err
+	}
+	var provider *OIDCProvider
+	if config != nil {
+		provider = NewOIDCProvider(*config, nil)
+	}
+	setOIDCProvider(provider)
+	return nil
+}
+
+// NewOIDCProvider 创建身份提供方，client 为 nil 时使用带超时的默认客户端。
+func NewOIDCProvider(config OIDCConfig, client *http.Client) *OIDCProvider {
+	if client == nil {
+		client = &http.Client{Timeout: oidcHTTPTimeout}
+	}
+	return &OIDCProvider{
+		config:     config,
+		client:     client,
+		pending:    make(map[string]oidcPendingLogin),
+		loginCodes: make(map[string]oidcLoginCode),
+	}
+}
+
+func setOIDCProvider(provider *OIDCProvider) {
+	oidcProviderMu.Lock()
+	defer oidcProviderMu.Unlock()
+	oidcProvider = provider
+}
+
+func currentOIDCProvider() (*OIDCProvider, error) {
+	oidcProviderMu.RLock()
+	defer oidcProviderMu.RUnlock()
+	if oidcProvider == nil {
+		return nil, ErrOIDCDisabled
+	}
+	return oidcProvider, nil
+}
+
+// OIDCEnabled 表示是否配置了单点登录。
+func OIDCEnabled() bool {
+	_, err := currentOIDCProvider()
+	return err == nil
+}
+
+// OIDCAuthCodeURL 发起单点登录，返回 IdP 授权地址和本次登录的 state。
+func OIDCAuthCodeURL(ctx context.Context) (string, string, error) {
+	provider, err := currentOIDCProvider()
+	if err != nil {
+		return "", "", err
+	}
+	return provider.AuthCodeURL(ctx)
+}
+
+// CompleteOIDCLogin 处理 IdP 回调，返回用于换取 Token 的一次性登录码。
+func CompleteOIDCLogin(ctx context.Context, state, code string) (string, error) {
+	provider, err := currentOIDCProvider()
+	if err != nil {
+		return "", err
+	}
+	user, err := provider.Authenticate(ctx, state, code)
+	if err != nil {
+		return "", err
+	}
+	return provider.issueLoginCode(user.ID)
+}
+
+// ExchangeOIDCLoginCode 用一次性登录码换取 JWT，登录码只能使用一次；启用了两步验证的用户还需要提交验证码。
+func ExchangeOIDCLoginCode(code, clientIP string) (*TokenResponse, error) {
+	provider, err := currentOIDCProvider()
+	if err != nil {
+		return nil, err
+	}
+	userID, err := provider.consumeLoginCode(code)
+	if err != nil {
+		return nil, err
+	}
+	user, err := GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	if user.Disabled {
+		recordLoginAudit(AuditActionLoginOIDC, user.Username, clientIP, user.ID, ErrUserDisabled)
+		return nil, ErrUserDisabled
+	}
+	recordLoginAudit(AuditActionLoginOIDC, user.Username, clientIP, user.ID, nil)
+	return completeLogin(user, clientIP)
+}
+
+// AuthCodeURL 生成 state、nonce 和 PKCE verifier，返回授权码模式的跳转地址。
+func (p *OIDCProvider) AuthCodeURL(ctx context.Context) (string, string, error) {
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	state, err := randomOIDCValue()
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := randomOIDCValue()
+	if err != nil {
+		return "", "", err
+	}
+	verifier, err := randomOIDCValue()
+	if err != nil {
+		return "", "", err
+	}
+
+	p.mu.Lock()
+	p.cleanupLocked(time.Now())
+	p.pending[state] = oidcPendingLogin{nonce: nonce, codeVerifier: verifier, expiresAt: time.Now().Add(oidcLoginTimeout)}
+	p.mu.Unlock()
+
+	challenge := sha256.Sum256([]byte(verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.config.ClientID},
+		"redirect_uri":          {p.config.RedirectURL},
+		"scope":                 {strings.Join(p.config.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(metadata.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return metadata.AuthorizationEndpoint + separator + query.Encode(), state, nil
+}
+
+// Authenticate 校验 state，用授权码换取 ID Token 并完成校验，返回对应的本地用户。
+func (p *OIDCProvider) Authenticate(ctx context.Context, state, code string) (*User, error) {
+	p.mu.Lock()
+	login, ok := p.pending[state]
+	delete(p.pending, state)
+	p.mu.Unlock()
+	if !ok || time.Now().After(login.expiresAt) {
+		return nil, ErrOIDCStateInvalid
+	}
+	if code == "" {
+		return nil, errors.New("oidc authorization code is required")
+	}
+
+	rawIDToken, err := p.exchangeCode(ctx, code, login.codeVerifier)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := p.verifyIDToken(ctx, rawIDToken, login.nonce)
+	if err != nil {
+		return nil, err
+	}
+	return p.resolveUser(claims)
+}
+
+func (p *OIDCProvider) discover(ctx context.Context) (*oidcMetadata, error) {
+	p.mu.Lock()
+	metadata := p.metadata
+	p.mu.Unlock()
+	if metadata != nil {
+		return metadata, nil
+	}
+
+	metadata = &oidcMetadata{}
+	if err := p.getJSON(ctx, p.config.Issuer+"/.well-known/openid-configuration", metadata); err != nil {
+		return nil, fmt.Errorf("oidc discovery failed: %v", err)
+	}
+	if strings.TrimRight(metadata.Issuer, "/") != p.config.Issuer {
+		return nil, fmt.Errorf("oidc discovery issuer %q does not match %q", metadata.Issuer, p.config.Issuer)
+	}
+	if metadata.AuthorizationEndpoint == "" || metadata.TokenEndpoint == "" || metadata.JWKSURI == "" {
+		return nil, errors.New("oidc discovery document is missing endpoints")
+	}
+
+	p.mu.Lock()
+	p.metadata = metadata
+	p.mu.Unlock()
+	return metadata, nil
+}
+
+func (p *OIDCProvider) exchangeCode(ctx context.Context, code, verifier string) (string, error) {
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.config.RedirectURL},
+		"client_id":     {p.config.ClientID},
+		"code_verifier": {verifier},
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	if p.config.ClientSecret != "" {
+		request.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+
+	response, err := p.client.Do(request)
+	if err != nil {
+		return "", fmt.Errorf("oidc token request failed: %v", err)
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(response.Body, oidcMaxResponseBytes))
+	if err != nil {
+		return "", fmt.Errorf("failed to read oidc token response: %v", err)
+	}
+	var tokenResponse struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.Unmarshal(body, &tokenResponse); err != nil && response.StatusCode == http.StatusOK {
+		return "", fmt.Errorf("failed to decode oidc token response: %v", err)
+	}
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("oidc token endpoint returned %d: %s %s", response.StatusCode, tokenResponse.Error, tokenResponse.ErrorDescription)
+	}
+	if tokenResponse.IDToken == "" {
+		return "", errors.New("oidc token response has no id_token")
+	}
+	return tokenResponse.IDToken, nil
+}
+
+func (p *OIDCProvider) verifyIDToken(ctx context.Context, rawIDToken, nonce string) (jwt.MapClaims, error) {
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(rawIDToken, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.publicKey(ctx, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}),
+		jwt.WithIssuer(metadata.Issuer),
+		jwt.WithAudience(p.config.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrOIDCIDTokenInvalid, err)
+	}
+	if tokenNonce, _ := claims["nonce"].(string); tokenNonce != nonce {
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrOIDCIDTokenInvalid)
+	}
+	// 有多个受众时 azp 必须是本服务
+	if audiences, _ := claims.GetAudience(); len(audiences) > 1 {
+		if azp, _ := claims["azp"].(string); azp != p.config.ClientID {
+			return nil, fmt.Errorf("%w: unexpected authorized party", ErrOIDCIDTokenInvalid)
+		}
+	}
+	if subject, _ := claims.GetSubject(); subject == "" {
+		return nil, fmt.Errorf("%w: missing subject", ErrOIDCIDTokenInvalid)
+	}
+	return claims, nil
+}
+
+// publicKey 按 kid 查找签名公钥，找不到时在限频内重新拉取 JWKS，以支持 IdP 轮换密钥。
+func (p *OIDCProvider) publicKey(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	key, ok := p.lookupKeyLocked(kid)
+	canRefresh := time.Since(p.keysFetchedAt) >= oidcJWKSRefreshInterval || p.keys == nil
+	p.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	if !canRefresh {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var jwks struct {
+		Keys []oidcJWK `json:"keys"`
+	}
+	if err := p.getJSON(ctx, metadata.JWKSURI, &jwks); err != nil {
+		return nil, fmt.Errorf("failed to fetch oidc jwks: %v", err)
+	}
+	keys := make(map[string]crypto.PublicKey, len(jwks.Keys))
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		publicKey, err := jwk.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[jwk.Kid] = publicKey
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.keys = keys
+	p.keysFetchedAt = time.Now()
+	if key, ok := p.lookupKeyLocked(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+func (p *OIDCProvider) lookupKeyLocked(kid string) (crypto.PublicKey, bool) {
+	if key, ok := p.keys[kid]; ok {
+		return key, true
+	}
+	// 没有 kid 时只有在 JWKS 中恰好一个密钥的情况下才能确定使用哪个
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+func (jwk oidcJWK) publicKey() (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if len(n) < 256 || !exponent.IsInt64() || exponent.Int64() < 3 {
+			return nil, errors.New("unsupported rsa key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		var ecdhCurve ecdh.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve, ecdhCurve = elliptic.P256(), ecdh.P256()
+		case "P-384":
+			curve, ecdhCurve = elliptic.P384(), ecdh.P384()
+		case "P-521":
+			curve, ecdhCurve = elliptic.P521(), ecdh.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		size := (curve.Params().BitSize + 7) / 8
+		if len(x) != size || len(y) != size {
+			return nil, errors.New("invalid ec key coordinates")
+		}
+		// 借助 crypto/ecdh 校验点在曲线上
+		if _, err := ecdhCurve.NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+	}
+}
+
+// resolveUser 把 ID Token 映射到本地用户：先按已绑定的身份查找，其次按配置绑定同名用户或自动创建。
+// 配置了组映射时每次登录都会同步角色。
+func (p *OIDCProvider) resolveUser(claims jwt.MapClaims) (*User, error) {
+	issuer, _ := claims.GetIssuer()
+	subject, _ := claims.GetSubject()
+	role, err := p.mapRole(oidcClaimStrings(claims[p.config.GroupsClaim]))
+	if err != nil {
+		return nil, err
+	}
+
+	var identity UserIdentity
+	err = db.Where("issuer = ? AND subject = ?", issuer, subject).First(&identity).Error
+	if err == nil {
+		return p.syncUserRole(identity.UserID, role)
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+
+	username := p.username(claims)
+	if username == "" {
+		return nil, fmt.Errorf("%w: missing %s claim", ErrOIDCIDTokenInvalid, p.config.UsernameClaim)
+	}
+	var user User
+	err = db.Transaction(func(tx *gorm.DB) error {
+		lookupErr := tx.Where("username = ?", username).First(&user).Error
+		switch {
+		case lookupErr == nil:
+			if !p.config.LinkByUsername {
+				return ErrUsernameExists
+			}
+		case errors.Is(lookupErr, gorm.ErrRecordNotFound):
+			if !p.config.AutoProvision {
+				return ErrOIDCUserNotProvisioned
+			}
+			password, err := randomOIDCValue()
+			if err != nil {
+				return err
+			}
+			hashedPassword, err := HashPassword(password)
+			if err != nil {
+				return fmt.Errorf("failed to hash password: %v", err)
+			}
+			user = User{Username: username, Password: hashedPassword, Role: role}
+			if err := tx.Create(&user).Error; err != nil {
+				return fmt.Errorf("failed to create user: %v", err)
+			}
+		default:
+			return fmt.Errorf("database error: %v", lookupErr)
+		}
+		identity = UserIdentity{UserID: user.ID, Issuer: issuer, Subject: subject}
+		if err := tx.Create(&identity).Error; err != nil {
+			return fmt.Errorf("failed to link oidc identity: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p.syncUserRole(user.ID, role)
+}
+
+// mapRole 按组映射计算角色，多个组命中时取最高的角色；没有命中时使用默认角色。
+func (p *OIDCProvider) mapRole(groups []string) (string, error) {
+	role := ""
+	for _, group := range groups {
+		if mapped, ok := p.config.RoleMapping[group]; ok && roleLevels[mapped] > roleLevels[role] {
+			role = mapped
+		}
+	}
+	if role != "" {
+		return role, nil
+	}
+	if p.config.DefaultRole == OIDCRoleNone {
+		return "", ErrOIDCUserNotAllowed
+	}
+	return NormalizeRole(p.config.DefaultRole)
+}
+
+// syncUserRole 在配置了组映射时把角色同步为 IdP 中的角色；降级最后一个管理员会被拒绝，此时保留原角色。
+func (p *OIDCProvider) syncUserRole(userID uint, role string) (*User, error) {
+	user, err := GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	if user.Disabled {
+		return nil, ErrUserDisabled
+	}
+	if len(p.config.RoleMapping) == 0 || user.Role == role {
+		return user, nil
+	}
+	updated, err := UpdateUserAccount(user.ID, &role, nil)
+	if errors.Is(err, ErrLastAdmin) {
+		return user, nil
+	}
+	return updated, err
+}
+
+func (p *OIDCProvider) username(claims jwt.MapClaims) string {
+	for _, claim := range []string{p.config.UsernameClaim, "preferred_username", "email", "sub"} {
+		if value, _ := claims[claim].(string); strings.TrimSpace(value) != "" {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
+
+func (p *OIDCProvider) issueLoginCode(userID uint) (string, error) {
+	code, err := randomOIDCValue()
+	if err != nil {
+		return "", err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cleanupLocked(time.Now())
+	p.loginCodes[code] = oidcLoginCode{userID: userID, expiresAt: time.Now().Add(oidcLoginCodeTTL)}
+	return code, nil
+}
+
+func (p *OIDCProvider) consumeLoginCode(code string) (uint, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	loginCode, ok := p.loginCodes[code]
+	delete(p.loginCodes, code)
+	if !ok || time.Now().After(loginCode.expiresAt) {
+		return 0, ErrOIDCLoginCodeInvalid
+	}
+	return loginCode.userID, nil
+}
+
+func (p *OIDCProvider) cleanupLocked(now time.Time) {
+	for state, login := range p.pending {
+		if now.After(login.expiresAt) {
+			delete(p.pending, state)
+		}
+	}
+	for code, loginCode := range p.loginCodes {
+		if now.After(loginCode.expiresAt) {
+			delete(p.loginCodes, code)
+		}
+	}
+}
+
+func (p *OIDCProvider) getJSON(ctx context.Context, target string, value interface{}) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Accept", "application/json")
+	response, err := p.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %d", target, response.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(response.Body, oidcMaxResponseBytes)).Decode(value)
+}
+
+// oidcClaimStrings 兼容组声明为字符串数组或单个字符串两种形式。
+func oidcClaimStrings(value interface{}) []string {
+	switch typed := value.(type) {
+	case string:
+		return []string{typed}
+	case []interface{}:
+		values := make([]string, 0, len(typed))
+		for _, item := range typed {
+			if text, ok := item.(string); ok {
+				values = append(values, text)
+			}
+		}
+		return values
+	default:
+		return nil
+	}
+}
+
+func randomOIDCValue() (string, error) {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", fmt.Errorf("failed to generate random value: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(bytes), nil
+}
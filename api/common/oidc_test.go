@@ -0,0 +1,433 @@
+package common
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// testIdP 是测试用的本地身份提供方，实现发现文档、授权、Token 和 JWKS 四个端点。
+type testIdP struct {
+	t        *testing.T
+	server   *httptest.Server
+	key      *rsa.PrivateKey
+	kid      string
+	clientID string
+	secret   string
+
+	mu     sync.Mutex
+	codes  map[string]testIdPGrant
+	claims jwt.MapClaims
+	// mutate 在签发前修改 ID Token 的声明，用于构造无效 Token
+	mutate func(jwt.MapClaims)
+	// signWith 不为空时用该密钥签名，模拟不在 JWKS 中的密钥
+	signWith *rsa.PrivateKey
+}
+
+type testIdPGrant struct {
+	challenge   string
+	nonce       string
+	redirectURI string
+	claims      jwt.MapClaims
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate rsa key: %v", err)
+	}
+	idp := &testIdP{t: t, key: key, kid: "idp-key-1", clientID: "dataark", secret: "client-secret", codes: make(map[string]testIdPGrant)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.server.URL,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"jwks_uri":               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": idp.kid,
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(idp.key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(idp.key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/authorize", idp.authorize)
+	mux.HandleFunc("/token", idp.token)
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+func (idp *testIdP) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("response_type") != "code" || query.Get("client_id") != idp.clientID || query.Get("code_challenge_method") != "S256" {
+		http.Error(w, "bad authorization request", http.StatusBadRequest)
+		return
+	}
+	idp.mu.Lock()
+	code := "code-" + query.Get("state")[:8]
+	idp.codes[code] = testIdPGrant{
+		challenge:   query.Get("code_challenge"),
+		nonce:       query.Get("nonce"),
+		redirectURI: query.Get("redirect_uri"),
+		claims:      idp.claims,
+	}
+	idp.mu.Unlock()
+	http.Redirect(w, r, query.Get("redirect_uri")+"?code="+code+"&state="+url.QueryEscape(query.Get("state")), http.StatusFound)
+}
+
+func (idp *testIdP) token(w http.ResponseWriter, r *http.Request) {
+	clientID, secret, ok := r.BasicAuth()
+	if !ok || clientID != idp.clientID || secret != idp.secret {
+		w.WriteHeader(http.StatusUnauthorized)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+		return
+	}
+	idp.mu.Lock()
+	grant, exists := idp.codes[r.FormValue("code")]
+	delete(idp.codes, r.FormValue("code"))
+	idp.mu.Unlock()
+	verifierHash := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	if !exists || r.FormValue("grant_type") != "authorization_code" || r.FormValue("redirect_uri") != grant.redirectURI ||
+		base64.RawURLEncoding.EncodeToString(verifierHash[:]) != grant.challenge {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	claims := jwt.MapClaims{
+		"iss":   idp.server.URL,
+		"aud":   idp.clientID,
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"iat":   time.Now().Unix(),
+		"nonce": grant.nonce,
+	}
+	for name, value := range grant.claims {
+		claims[name] = value
+	}
+	if idp.mutate != nil {
+		idp.mutate(claims)
+	}
+	signingKey := idp.key
+	if idp.signWith != nil {
+		signingKey = idp.signWith
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = idp.kid
+	idToken, err := token.SignedString(signingKey)
+	if err != nil {
+		idp.t.Errorf("failed to sign id token: %v", err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]string{"access_token": "opaque", "token_type": "Bearer", "id_token": idToken})
+}
+
+func (idp *testIdP) provider(modify func(*OIDCConfig)) *OIDCProvider {
+	config := OIDCConfig{
+		Issuer:        idp.server.URL,
+		ClientID:      idp.clientID,
+		ClientSecret:  idp.secret,
+		RedirectURL:   "https://ark.example.com/api/oidc/callback",
+		Scopes:        []string{"openid", "profile"},
+		UsernameClaim: "preferred_username",
+		GroupsClaim:   "groups",
+		RoleMapping:   map[string]string{"ark-admins": RoleAdmin, "ark-editors": RoleEditor},
+		DefaultRole:   RoleViewer,
+		AutoProvision: true,
+	}
+	if modify != nil {
+		modify(&config)
+	}
+	return NewOIDCProvider(config, idp.server.Client())
+}
+
+// login 走一遍浏览器跳转：生成授权地址、访问 IdP 授权端点，再用回调参数完成登录。
+func (idp *testIdP) login(provider *OIDCProvider, claims jwt.MapClaims) (*User, error) {
+	idp.t.Helper()
+	idp.mu.Lock()
+	idp.claims = claims
+	idp.mu.Unlock()
+
+	authURL, state, err := provider.AuthCodeURL(context.Background())
+	if err != nil {
+		idp.t.Fatalf("AuthCodeURL returned error: %v", err)
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	response, err := client.Get(authURL)
+	if err != nil {
+		idp.t.Fatalf("authorize request failed: %v", err)
+	}
+	response.Body.Close()
+	location, err := url.Parse(response.Header.Get("Location"))
+	if err != nil || response.StatusCode != http.StatusFound {
+		idp.t.Fatalf("authorize status=%d location=%q", response.StatusCode, response.Header.Get("Location"))
+	}
+	if location.Query().Get("state") != state {
+		idp.t.Fatalf("callback state = %q, want %q", location.Query().Get("state"), state)
+	}
+	return provider.Authenticate(context.Background(), state, location.Query().Get("code"))
+}
+
+func TestOIDCLoginProvisionsAndSyncsRoles(t *testing.T) {
+	setupSQLiteDB(t)
+	idp := newTestIdP(t)
+	provider := idp.provider(nil)
+
+	user, err := idp.login(provider, jwt.MapClaims{"sub": "u-1", "preferred_username": "alice", "groups": []string{"staff", "ark-editors"}})
+	if err != nil {
+		t.Fatalf("first login returned error: %v", err)
+	}
+	if user.Username != "alice" || user.Role != RoleEditor {
+		t.Fatalf("provisioned user = %+v, want alice editor", user)
+	}
+
+	again, err := idp.login(provider, jwt.MapClaims{"sub": "u-1", "preferred_username": "alice-renamed", "groups": []string{"ark-admins", "ark-editors"}})
+	if err != nil {
+		t.Fatalf("second login returned error: %v", err)
+	}
+	if again.ID != user.ID || again.Role != RoleAdmin {
+		t.Fatalf("second login user = %+v, want same user promoted to admin", again)
+	}
+
+	viewer, err := idp.login(provider, jwt.MapClaims{"sub": "u-2", "email": "bob@example.com", "groups": "staff"})
+	if err != nil {
+		t.Fatalf("viewer login returned error: %v", err)
+	}
+	if viewer.Username != "bob@example.com" || viewer.Role != RoleViewer {
+		t.Fatalf("viewer = %+v, want bob@example.com viewer", viewer)
+	}
+	if _, err := LoginUser("bob@example.com", ""); err == nil {
+		t.Fatal("provisioned users should not be able to log in with an empty password")
+	}
+}
+
+func TestOIDCLoginCodeExchange(t *testing.T) {
+	setupSQLiteDB(t)
+	idp := newTestIdP(t)
+	provider := idp.provider(nil)
+	setOIDCProvider(provider)
+	t.Cleanup(func() {
+		setOIDCProvider(nil)
+	})
+	if !OIDCEnabled() {
+		t.Fatal("oidc should be enabled")
+	}
+
+	idp.claims = jwt.MapClaims{"sub": "u-1", "preferred_username": "carol"}
+	authURL, state, err := OIDCAuthCodeURL(context.Background())
+	if err != nil {
+		t.Fatalf("OIDCAuthCodeURL returned error: %v", err)
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	response, err := client.Get(authURL)
+	if err != nil {
+		t.Fatalf("authorize request failed: %v", err)
+	}
+	response.Body.Close()
+	location, _ := url.Parse(response.Header.Get("Location"))
+
+	loginCode, err := CompleteOIDCLogin(context.Background(), state, location.Query().Get("code"))
+	if err != nil {
+		t.Fatalf("CompleteOIDCLogin returned error: %v", err)
+	}
+	tokenResponse, err := ExchangeOIDCLoginCode(loginCode, "10.0.0.1")
+	if err != nil {
+		t.Fatalf("ExchangeOIDCLoginCode returned error: %v", err)
+	}
+	claims, err := ValidateToken(tokenResponse.Token)
+	if err != nil || claims.Username != "carol" {
+		t.Fatalf("claims = %+v err=%v, want carol", claims, err)
+	}
+	if _, err := ExchangeOIDCLoginCode(loginCode, "10.0.0.1"); !errors.Is(err, ErrOIDCLoginCodeInvalid) {
+		t.Fatalf("reused login code error = %v, want ErrOIDCLoginCodeInvalid", err)
+	}
+	if _, err := CompleteOIDCLogin(context.Background(), state, location.Query().Get("code")); !errors.Is(err, ErrOIDCStateInvalid) {
+		t.Fatalf("reused state error = %v, want ErrOIDCStateInvalid", err)
+	}
+}
+
+func TestOIDCRejectsInvalidIDTokens(t *testing.T) {
+	setupSQLiteDB(t)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate rsa key: %v", err)
+	}
+	cases := map[string]func(*testIdP){
+		"wrong nonce":    func(idp *testIdP) { idp.mutate = func(c jwt.MapClaims) { c["nonce"] = "replayed" } },
+		"wrong audience": func(idp *testIdP) { idp.mutate = func(c jwt.MapClaims) { c["aud"] = "another-app" } },
+		"wrong issuer":   func(idp *testIdP) { idp.mutate = func(c jwt.MapClaims) { c["iss"] = "https://evil.example.com" } },
+		"expired": func(idp *testIdP) {
+			idp.mutate = func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Minute).Unix() }
+		},
+		"foreign azp": func(idp *testIdP) {
+			idp.mutate = func(c jwt.MapClaims) {
+				c["aud"] = []string{"dataark", "another-app"}
+				c["azp"] = "another-app"
+			}
+		},
+		"unknown signing key": func(idp *testIdP) { idp.signWith = otherKey },
+	}
+	for name, setup := range cases {
+		t.Run(name, func(t *testing.T) {
+			idp := newTestIdP(t)
+			setup(idp)
+			_, err := idp.login(idp.provider(nil), jwt.MapClaims{"sub": "u-1", "preferred_username": "mallory"})
+			if !errors.Is(err, ErrOIDCIDTokenInvalid) {
+				t.Fatalf("error = %v, want ErrOIDCIDTokenInvalid", err)
+			}
+		})
+	}
+
+	t.Run("wrong client secret", func(t *testing.T) {
+		idp := newTestIdP(t)
+		provider := idp.provider(func(config *OIDCConfig) { config.ClientSecret = "guess" })
+		if _, err := idp.login(provider, jwt.MapClaims{"sub": "u-1", "preferred_username": "mallory"}); err == nil {
+			t.Fatal("token exchange with a wrong client secret should fail")
+		}
+	})
+
+	t.Run("pkce verifier mismatch", func(t *testing.T) {
+		idp := newTestIdP(t)
+		provider := idp.provider(nil)
+		idp.claims = jwt.MapClaims{"sub": "u-1", "preferred_username": "mallory"}
+		_, state, err := provider.AuthCodeURL(context.Background())
+		if err != nil {
+			t.Fatalf("AuthCodeURL returned error: %v", err)
+		}
+		// 攻击者用自己发起的登录换到的授权码，对应的 challenge 与本次登录的 verifier 不一致
+		idp.codes["stolen"] = testIdPGrant{challenge: "attacker-challenge", redirectURI: provider.config.RedirectURL}
+		if _, err := provider.Authenticate(context.Background(), state, "stolen"); err == nil {
+			t.Fatal("authorization code bound to another verifier should be rejected")
+		}
+	})
+}
+
+func TestOIDCProvisioningPolicies(t *testing.T) {
+	setupSQLiteDB(t)
+	idp := newTestIdP(t)
+	local, err := CreateUserWithRole("dave", "password", RoleEditor)
+	if err != nil {
+		t.Fatalf("CreateUserWithRole returned error: %v", err)
+	}
+	claims := jwt.MapClaims{"sub": "u-dave", "preferred_username": "dave"}
+
+	if _, err := idp.login(idp.provider(nil), claims); !errors.Is(err, ErrUsernameExists) {
+		t.Fatalf("unlinked username error = %v, want ErrUsernameExists", err)
+	}
+	linked, err := idp.login(idp.provider(func(config *OIDCConfig) {
+		config.LinkByUsername = true
+		config.RoleMapping = nil
+	}), claims)
+	if err != nil || linked.ID != local.ID || linked.Role != RoleEditor {
+		t.Fatalf("linked user = %+v err=%v, want existing editor", linked, err)
+	}
+
+	noProvision := idp.provider(func(config *OIDCConfig) { config.AutoProvision = false })
+	if _, err := idp.login(noProvision, jwt.MapClaims{"sub": "u-new", "preferred_username": "erin"}); !errors.Is(err, ErrOIDCUserNotProvisioned) {
+		t.Fatalf("auto-provision disabled error = %v, want ErrOIDCUserNotProvisioned", err)
+	}
+
+	groupsOnly := idp.provider(func(config *OIDCConfig) { config.DefaultRole = OIDCRoleNone })
+	if _, err := idp.login(groupsOnly, jwt.MapClaims{"sub": "u-new", "preferred_username": "erin", "groups": []string{"staff"}}); !errors.Is(err, ErrOIDCUserNotAllowed) {
+		t.Fatalf("unmapped groups error = %v, want ErrOIDCUserNotAllowed", err)
+	}
+
+	disabled := true
+	if _, err := UpdateUserAccount(local.ID, nil, &disabled); err != nil {
+		t.Fatalf("UpdateUserAccount returned error: %v", err)
+	}
+	if _, err := idp.login(idp.provider(nil), claims); !errors.Is(err, ErrUserDisabled) {
+		t.Fatalf("disabled user error = %v, want ErrUserDisabled", err)
+	}
+}
+
+func TestOIDCConfigFromFlags(t *testing.T) {
+	oldValues := []string{OIDCIssuer, OIDCClientID, OIDCRedirectURL, OIDCScopes, OIDCRoleMapping, OIDCDefaultRole}
+	t.Cleanup(func() {
+		OIDCIssuer, OIDCClientID, OIDCRedirectURL = oldValues[0], oldValues[1], oldValues[2]
+		OIDCScopes, OIDCRoleMapping, OIDCDefaultRole = oldValues[3], oldValues[4], oldValues[5]
+	})
+
+	OIDCIssuer = ""
+	if config, err := OIDCConfigFromFlags(); config != nil || err != nil {
+		t.Fatalf("config = %+v err=%v, want disabled", config, err)
+	}
+
+	OIDCIssuer = "https://sso.example.com/"
+	OIDCClientID = "dataark"
+	OIDCRedirectURL = "https://ark.example.com/api/oidc/callback"
+	OIDCScopes = "profile,email"
+	OIDCRoleMapping = " ark-admins = Admin , ark-editors=editor "
+	OIDCDefaultRole = "None"
+	config, err := OIDCConfigFromFlags()
+	if err != nil {
+		t.Fatalf("OIDCConfigFromFlags returned error: %v", err)
+	}
+	if config.Issuer != "https://sso.example.com" || config.Scopes[0] != "openid" || len(config.Scopes) != 3 || config.DefaultRole != OIDCRoleNone {
+		t.Fatalf("unexpected config %+v", config)
+	}
+	if config.RoleMapping["ark-admins"] != RoleAdmin || config.RoleMapping["ark-editors"] != RoleEditor {
+		t.Fatalf("role mapping = %v", config.RoleMapping)
+	}
+
+	for name, apply := range map[string]func(){
+		"bad mapping":       func() { OIDCRoleMapping = "ark-admins" },
+		"unknown role":      func() { OIDCRoleMapping = "ark-admins=root" },
+		"missing client":    func() { OIDCClientID = "" },
+		"relative redirect": func() { OIDCRedirectURL = "callback" },
+		"bad default role":  func() { OIDCDefaultRole = "owner" },
+	} {
+		OIDCClientID, OIDCRedirectURL, OIDCRoleMapping, OIDCDefaultRole = "dataark", "https://ark.example.com/cb", "", RoleViewer
+		apply()
+		if _, err := OIDCConfigFromFlags(); err == nil {
+			t.Fatalf("%s should be rejected", name)
+		}
+	}
+}
+
+func TestOIDCJWKParsesECKeys(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate ec key: %v", err)
+	}
+	jwk := oidcJWK{
+		Kty: "EC",
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		Y:   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	}
+	publicKey, err := jwk.publicKey()
+	if err != nil {
+		t.Fatalf("publicKey returned error: %v", err)
+	}
+	if !publicKey.(*ecdsa.PublicKey).Equal(&key.PublicKey) {
+		t.Fatal("parsed ec key does not match")
+	}
+
+	jwk.Y = jwk.X
+	if _, err := jwk.publicKey(); err == nil {
+		t.Fatal("point not on curve should be rejected")
+	}
+}
@@ -0,0 +1,41 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+)
+
+// 用户角色，权限依次递减：admin 可以管理用户、备份恢复和修复索引，
+// editor 可以归档和删除文档，viewer 只能搜索和浏览归档。
+const (
+	RoleAdmin  = "admin"
+	RoleEditor = "editor"
+	RoleViewer = "viewer"
+)
+
+var roleLevels = map[string]int{
+	RoleViewer: 1,
+	RoleEditor: 2,
+	RoleAdmin:  3,
+}
+
+// NormalizeRole 校验并规范化角色名，空字符串视为 viewer。
+func NormalizeRole(role string) (string, error) {
+	role = strings.ToLower(strings.TrimSpace(role))
+	if role == "" {
+		return RoleViewer, nil
+	}
+	if _, ok := roleLevels[role]; !ok {
+		return "", fmt.Errorf("unknown role %q", role)
+	}
+	return role, nil
+}
+
+// HasRole 判断用户是否拥有 required 或更高的角色，未知角色不具备任何权限。
+func (u *User) HasRole(required string) bool {
+	if u == nil {
+		return false
+	}
+	level, ok := roleLevels[u.Role]
+	return ok && level >= roleLevels[required]
+}
@@ -0,0 +1,82 @@
+package common
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrSearchIndexSettingVersionConflict 表示提交修改时携带的版本号已经落后于数据库中的版本。
+var ErrSearchIndexSettingVersionConflict = errors.New("search index setting version conflict")
+
+// SearchIndexSetting 搜索索引配置。
+// 配置以 JSON 文本保存，每个索引只有一行；Version 在每次修改后递增，
+// 用于乐观锁，避免两个管理员同时编辑时后提交的一方静默覆盖前者。
+type SearchIndexSetting struct {
+	IndexUID  string    `json:"indexUid" gorm:"primaryKey;size:64"`
+	Version   int       `json:"version" gorm:"not null;default:1"`
+	Settings  string    `json:"settings" gorm:"type:text;not null"`
+	UpdatedBy string    `json:"updatedBy"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// GetSearchIndexSetting 读取指定索引的配置，不存在时返回 gorm.ErrRecordNotFound。
+func GetSearchIndexSetting(indexUID string) (*SearchIndexSetting, error) {
+	var setting SearchIndexSetting
+	if err := db.First(&setting, "index_uid = ?", indexUID).Error; err != nil {
+		return nil, err
+	}
+	return &setting, nil
+}
+
+// SaveSearchIndexSetting 保存索引配置并递增版本号。
+// expectedVersion 为调用方读取到的版本，尚未保存过配置时为 0。
+func SaveSearchIndexSetting(indexUID string, settings string, expectedVersion int, updatedBy string) (*SearchIndexSetting, error) {
+	indexUID = strings.TrimSpace(indexUID)
+	if indexUID == "" {
+		return nil, errors.New("index uid is empty")
+	}
+
+	var saved SearchIndexSetting
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var current SearchIndexSetting
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&current, "index_uid = ?", indexUID).Error
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			if expectedVersion != 0 {
+				return ErrSearchIndexSettingVersionConflict
+			}
+			saved = SearchIndexSetting{
+				IndexUID:  indexUID,
+				Version:   1,
+				Settings:  settings,
+				UpdatedBy: updatedBy,
+			}
+			return tx.Create(&saved).Error
+		case err != nil:
+			return err
+		}
+
+		if current.Version != expectedVersion {
+			return ErrSearchIndexSettingVersionConflict
+		}
+		current.Version++
+		current.Settings = settings
+		current.UpdatedBy = updatedBy
+		saved = current
+		return tx.Model(&SearchIndexSetting{IndexUID: indexUID}).Updates(map[string]interface{}{
+			"version":    current.Version,
+			"settings":   current.Settings,
+			"updated_by": current.UpdatedBy,
+			"updated_at": time.Now(),
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &saved, nil
+}
@@ -0,0 +1,44 @@
+package common
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSearchIndexSettingVersioning(t *testing.T) {
+	setupSQLiteDB(t)
+
+	if _, err := SaveSearchIndexSetting("blogs", `{"stopWords":["a"]}`, 1, "admin"); !errors.Is(err, ErrSearchIndexSettingVersionConflict) {
+		t.Fatalf("first save with non-zero version err = %v, want conflict", err)
+	}
+
+	created, err := SaveSearchIndexSetting("blogs", `{"stopWords":["a"]}`, 0, "admin")
+	if err != nil {
+		t.Fatalf("SaveSearchIndexSetting returned error: %v", err)
+	}
+	if created.Version != 1 || created.UpdatedBy != "admin" {
+		t.Fatalf("created = %#v", created)
+	}
+
+	updated, err := SaveSearchIndexSetting("blogs", `{"stopWords":["the"]}`, 1, "bob")
+	if err != nil {
+		t.Fatalf("SaveSearchIndexSetting update returned error: %v", err)
+	}
+	if updated.Version != 2 {
+		t.Fatalf("updated version = %d, want 2", updated.Version)
+	}
+	if _, err := SaveSearchIndexSetting("blogs", `{}`, 1, "carol"); !errors.Is(err, ErrSearchIndexSettingVersionConflict) {
+		t.Fatalf("stale save err = %v, want conflict", err)
+	}
+
+	loaded, err := GetSearchIndexSetting("blogs")
+	if err != nil {
+		t.Fatalf("GetSearchIndexSetting returned error: %v", err)
+	}
+	if loaded.Version != 2 || loaded.Settings != `{"stopWords":["the"]}` || loaded.UpdatedBy != "bob" {
+		t.Fatalf("loaded = %#v", loaded)
+	}
+	if _, err := SaveSearchIndexSetting(" ", `{}`, 0, "admin"); err == nil {
+		t.Fatal("empty index uid should fail")
+	}
+}
@@ -0,0 +1,308 @@
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// TOTP 参数与主流验证器应用（Google Authenticator、1Password 等）的默认值一致。
+const (
+	totpIssuer      = "DataArk"
+	totpSecretBytes = 20
+	totpDigits      = 6
+	totpPeriod      = 30 * time.Second
+	// 允许前后各一个时间步的时钟偏差
+	totpSkewSteps = 1
+	// 每次生成的恢复码数量，每个恢复码只能使用一次
+	recoveryCodeCount = 10
+)
+
+var (
+	ErrTOTPNotEnrolled     = errors.New("two-factor authentication is not set up")
+	ErrTOTPAlreadyEnabled  = errors.New("two-factor authentication is already enabled")
+	ErrTOTPNotEnabled      = errors.New("two-factor authentication is not enabled")
+	ErrInvalidTOTPCode     = errors.New("invalid two-factor authentication code")
+	totpSecretEncoding     = base32.StdEncoding.WithPadding(base32.NoPadding)
+	recoveryCodeSeparators = strings.NewReplacer("-", "", " ", "")
+)
+
+// RecoveryCode 两步验证的恢复码，只保存 SHA-256，使用后记录使用时间。
+type RecoveryCode struct {
+	ID        uint       `json:"id" gorm:"primaryKey"`
+	UserID    uint       `json:"userId" gorm:"index;not null"`
+	CodeHash  string     `json:"-" gorm:"size:64;not null"`
+	UsedAt    *time.Time `json:"usedAt"`
+	CreatedAt time.Time  `json:"createdAt"`
+}
+
+// TOTPSetup 开始绑定验证器时返回给用户的信息，URI 可以直接生成二维码。
+type TOTPSetup struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// BeginTOTPEnrollment 为用户生成新的 TOTP 密钥，验证通过 EnableTOTP 之前不会生效。
+func BeginTOTPEnrollment(userID uint) (*TOTPSetup, error) {
+	user, err := GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	if user.TOTPEnabled {
+		return nil, ErrTOTPAlreadyEnabled
+	}
+
+	raw := make([]byte, totpSecretBytes)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, fmt.Errorf("failed to generate totp secret: %v", err)
+	}
+	secret := totpSecretEncoding.EncodeToString(raw)
+	if err := db.Model(&User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+		"totp_secret":    secret,
+		"totp_last_step": 0,
+	}).Error; err != nil {
+		return nil, fmt.Errorf("failed to save totp secret: %v", err)
+	}
+	return &TOTPSetup{Secret: secret, URI: totpProvisioningURI(user.Username, secret)}, nil
+}
+
+// EnableTOTP 用验证器生成的验证码确认绑定，成功后启用两步验证并返回新的恢复码。
+func EnableTOTP(userID uint, code string) ([]string, error) {
+	var codes []string
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var user User
+		if err := tx.First(&user, userID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrUserNotFound
+			}
+			return fmt.Errorf("database error: %v", err)
+		}
+		if user.TOTPEnabled {
+			return ErrTOTPAlreadyEnabled
+		}
+		if user.TOTPSecret == "" {
+			return ErrTOTPNotEnrolled
+		}
+		step, ok := validateTOTPCode(user.TOTPSecret, code, user.TOTPLastStep, time.Now())
+		if !ok {
+			return ErrInvalidTOTPCode
+		}
+		if err := tx.Model(&User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+			"totp_enabled":   true,
+			"totp_last_step": step,
+		}).Error; err != nil {
+			return fmt.Errorf("failed to enable totp: %v", err)
+		}
+		var err error
+		codes, err = replaceRecoveryCodes(tx, userID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// DisableTOTP 用户自行关闭两步验证，需要当前密码和一个有效的验证码或恢复码。
+func DisableTOTP(userID uint, password, code string) error {
+	user, err := GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+	if !checkPassword(password, user.Password) {
+		return ErrInvalidCredentials
+	}
+	if !user.TOTPEnabled {
+		return ErrTOTPNotEnabled
+	}
+	if err := VerifySecondFactor(userID, code); err != nil {
+		return err
+	}
+	return ResetTOTP(userID)
+}
+
+// ResetTOTP 清除用户的两步验证和恢复码，供管理员处理丢失设备的用户。
+func ResetTOTP(userID uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+			"totp_secret":    "",
+			"totp_enabled":   false,
+			"totp_last_step": 0,
+		})
+		if result.Error != nil {
+			return fmt.Errorf("failed to reset totp: %v", result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return ErrUserNotFound
+		}
+		if err := tx.Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error; err != nil {
+			return fmt.Errorf("failed to delete recovery codes: %v", err)
+		}
+		return nil
+	})
+}
+
+// RegenerateRecoveryCodes 作废旧的恢复码并生成新的一组，需要一个有效的验证码。
+func RegenerateRecoveryCodes(userID uint, code string) ([]string, error) {
+	user, err := GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	if !user.TOTPEnabled {
+		return nil, ErrTOTPNotEnabled
+	}
+	if err := verifyTOTP(user, code); err != nil {
+		return nil, err
+	}
+	var codes []string
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		codes, err = replaceRecoveryCodes(tx, userID)
+		return err
+	})
+	return codes, err
+}
+
+// VerifySecondFactor 校验验证码或恢复码，恢复码校验成功后即作废。
+func VerifySecondFactor(userID uint, code string) error {
+	user, err := GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+	if !user.TOTPEnabled {
+		return ErrTOTPNotEnabled
+	}
+	code = strings.TrimSpace(code)
+	if len(code) == totpDigits {
+		return verifyTOTP(user, code)
+	}
+	return useRecoveryCode(userID, code)
+}
+
+// verifyTOTP 校验验证码并记录使用的时间步，同一个验证码不能重复使用。
+func verifyTOTP(user *User, code string) error {
+	step, ok := validateTOTPCode(user.TOTPSecret, code, user.TOTPLastStep, time.Now())
+	if !ok {
+		return ErrInvalidTOTPCode
+	}
+	// 条件更新保证并发请求中只有一个能用掉这个时间步
+	result := db.Model(&User{}).Where("id = ? AND totp_last_step < ?", user.ID, step).Update("totp_last_step", step)
+	if result.Error != nil {
+		return fmt.Errorf("failed to record totp usage: %v", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrInvalidTOTPCode
+	}
+	return nil
+}
+
+func useRecoveryCode(userID uint, code string) error {
+	normalized := strings.ToLower(recoveryCodeSeparators.Replace(code))
+	if normalized == "" {
+		return ErrInvalidTOTPCode
+	}
+	result := db.Model(&RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, hashRecoveryCode(normalized)).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return fmt.Errorf("failed to use recovery code: %v", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrInvalidTOTPCode
+	}
+	return nil
+}
+
+// CountRecoveryCodes 返回用户剩余可用的恢复码数量。
+func CountRecoveryCodes(userID uint) (int64, error) {
+	var count int64
+	if err := db.Model(&RecoveryCode{}).Where("user_id = ? AND used_at IS NULL", userID).Count(&count).Error; err != nil {
+		return 0, fmt.Errorf("failed to count recovery codes: %v", err)
+	}
+	return count, nil
+}
+
+func replaceRecoveryCodes(tx *gorm.DB, userID uint) ([]string, error) {
+	if err := tx.Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error; err != nil {
+		return nil, fmt.Errorf("failed to delete recovery codes: %v", err)
+	}
+	codes := make([]string, 0, recoveryCodeCount)
+	records := make([]RecoveryCode, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, fmt.Errorf("failed to generate recovery code: %v", err)
+		}
+		code := hex.EncodeToString(raw)
+		codes = append(codes, code[:5]+"-"+code[5:])
+		records = append(records, RecoveryCode{UserID: userID, CodeHash: hashRecoveryCode(code)})
+	}
+	if err := tx.Create(&records).Error; err != nil {
+		return nil, fmt.Errorf("failed to save recovery codes: %v", err)
+	}
+	return codes, nil
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+func totpProvisioningURI(username, secret string) string {
+	label := url.PathEscape(totpIssuer + ":" + username)
+	query := url.Values{
+		"secret":    {secret},
+		"issuer":    {totpIssuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(int(totpPeriod / time.Second))},
+	}
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// validateTOTPCode 在允许的时钟偏差内查找匹配的时间步，只接受比 lastStep 更新的时间步以防止重放。
+func validateTOTPCode(secret, code string, lastStep int64, now time.Time) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits || secret == "" {
+		return 0, false
+	}
+	key, err := totpSecretEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return 0, false
+	}
+	current := now.Unix() / int64(totpPeriod/time.Second)
+	for offset := -totpSkewSteps; offset <= totpSkewSteps; offset++ {
+		step := current + int64(offset)
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(generateTOTPCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// generateTOTPCode 按 RFC 6238 / RFC 4226 计算某个时间步的验证码。
+func generateTOTPCode(key []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
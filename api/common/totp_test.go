@@ -0,0 +1,179 @@
+package common
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGenerateTOTPCodeMatchesRFC6238(t *testing.T) {
+	// RFC 6238 附录 B 的 SHA1 测试向量，取 8 位结果的后 6 位
+	key := []byte("12345678901234567890")
+	cases := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for unix, want := range cases {
+		if got := generateTOTPCode(key, unix/30); got != want {
+			t.Fatalf("code at %d = %s, want %s", unix, got, want)
+		}
+	}
+
+	secret := totpSecretEncoding.EncodeToString(key)
+	now := time.Unix(59, 0)
+	if step, ok := validateTOTPCode(secret, "287082", 0, now); !ok || step != 1 {
+		t.Fatalf("validate current code step=%d ok=%v", step, ok)
+	}
+	if _, ok := validateTOTPCode(secret, "287082", 1, now); ok {
+		t.Fatal("code of an already used step should be rejected")
+	}
+	if _, ok := validateTOTPCode(secret, "287082", 0, now.Add(3*totpPeriod)); ok {
+		t.Fatal("code outside the allowed skew should be rejected")
+	}
+	if _, ok := validateTOTPCode(secret, "28708", 0, now); ok {
+		t.Fatal("code with wrong length should be rejected")
+	}
+}
+
+func TestTOTPEnrollmentAndRecoveryCodes(t *testing.T) {
+	setupSQLiteDB(t)
+	user, err := CreateUserWithRole("alice", "password", RoleAdmin)
+	if err != nil {
+		t.Fatalf("CreateUserWithRole returned error: %v", err)
+	}
+
+	if _, err := EnableTOTP(user.ID, "123456"); !errors.Is(err, ErrTOTPNotEnrolled) {
+		t.Fatalf("enable before setup error = %v, want ErrTOTPNotEnrolled", err)
+	}
+	setup, err := BeginTOTPEnrollment(user.ID)
+	if err != nil {
+		t.Fatalf("BeginTOTPEnrollment returned error: %v", err)
+	}
+	uri, err := url.Parse(setup.URI)
+	if err != nil || uri.Scheme != "otpauth" || uri.Query().Get("secret") != setup.Secret || uri.Query().Get("issuer") != totpIssuer {
+		t.Fatalf("unexpected provisioning uri %q", setup.URI)
+	}
+
+	if _, err := EnableTOTP(user.ID, "000000x"); !errors.Is(err, ErrInvalidTOTPCode) {
+		t.Fatalf("enable with wrong code error = %v, want ErrInvalidTOTPCode", err)
+	}
+	codes, err := EnableTOTP(user.ID, currentTOTPCode(t, setup.Secret))
+	if err != nil {
+		t.Fatalf("EnableTOTP returned error: %v", err)
+	}
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("recovery codes = %v", codes)
+	}
+	if _, err := BeginTOTPEnrollment(user.ID); !errors.Is(err, ErrTOTPAlreadyEnabled) {
+		t.Fatalf("setup when enabled error = %v, want ErrTOTPAlreadyEnabled", err)
+	}
+
+	// 启用时用过的验证码不能再次使用
+	if err := VerifySecondFactor(user.ID, currentTOTPCode(t, setup.Secret)); !errors.Is(err, ErrInvalidTOTPCode) {
+		t.Fatalf("replayed code error = %v, want ErrInvalidTOTPCode", err)
+	}
+	if err := VerifySecondFactor(user.ID, strings.ToUpper(codes[0])); err != nil {
+		t.Fatalf("recovery code returned error: %v", err)
+	}
+	if err := VerifySecondFactor(user.ID, codes[0]); !errors.Is(err, ErrInvalidTOTPCode) {
+		t.Fatalf("reused recovery code error = %v, want ErrInvalidTOTPCode", err)
+	}
+	if remaining, err := CountRecoveryCodes(user.ID); err != nil || remaining != recoveryCodeCount-1 {
+		t.Fatalf("remaining recovery codes = %d err=%v", remaining, err)
+	}
+
+	if err := DisableTOTP(user.ID, "wrong", codes[1]); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("disable with wrong password error = %v, want ErrInvalidCredentials", err)
+	}
+	if err := DisableTOTP(user.ID, "password", codes[1]); err != nil {
+		t.Fatalf("DisableTOTP returned error: %v", err)
+	}
+	disabled, err := GetUserByID(user.ID)
+	if err != nil || disabled.TOTPEnabled || disabled.TOTPSecret != "" {
+		t.Fatalf("user after disable = %+v err=%v", disabled, err)
+	}
+	if remaining, _ := CountRecoveryCodes(user.ID); remaining != 0 {
+		t.Fatalf("recovery codes after disable = %d, want 0", remaining)
+	}
+}
+
+func TestLoginWithTOTP(t *testing.T) {
+	setupSQLiteDB(t)
+	user, err := CreateUserWithRole("alice", "password", RoleAdmin)
+	if err != nil {
+		t.Fatalf("CreateUserWithRole returned error: %v", err)
+	}
+	setup, err := BeginTOTPEnrollment(user.ID)
+	if err != nil {
+		t.Fatalf("BeginTOTPEnrollment returned error: %v", err)
+	}
+	codes, err := EnableTOTP(user.ID, currentTOTPCode(t, setup.Secret))
+	if err != nil {
+		t.Fatalf("EnableTOTP returned error: %v", err)
+	}
+
+	pending, err := LoginWithToken("alice", "password", "10.0.0.1")
+	if err != nil {
+		t.Fatalf("LoginWithToken returned error: %v", err)
+	}
+	if !pending.MFARequired || pending.Token != "" || pending.MFAToken == "" {
+		t.Fatalf("login response = %+v, want pending two-factor login", pending)
+	}
+	if _, err := ValidateToken(pending.MFAToken); err == nil {
+		t.Fatal("intermediate token should not be accepted as a session token")
+	}
+	// 密码通过但还没有签发正式 Token，不能算作登录成功
+	if _, total, err := ListAuditEvents(AuditFilter{Action: AuditActionLogin}, 1, 10); err != nil || total != 0 {
+		t.Fatalf("login events after password step total = %d err=%v, want 0", total, err)
+	}
+
+	if _, err := LoginWithTOTP(pending.MFAToken, "abcde-fghij", "10.0.0.1"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("wrong code error = %v, want ErrInvalidCredentials", err)
+	}
+	failures, total, err := ListLoginFailures(1, 10, "alice")
+	if err != nil || total != 1 || failures[0].Reason != LoginFailureInvalidCredentials {
+		t.Fatalf("failures = %+v total=%d err=%v", failures, total, err)
+	}
+
+	session, err := LoginWithTOTP(pending.MFAToken, codes[0], "10.0.0.1")
+	if err != nil {
+		t.Fatalf("LoginWithTOTP returned error: %v", err)
+	}
+	claims, err := ValidateToken(session.Token)
+	if err != nil || !claims.MFA || claims.UserID != user.ID {
+		t.Fatalf("session claims = %+v err=%v, want two-factor session", claims, err)
+	}
+	if events, total, err := ListAuditEvents(AuditFilter{Action: AuditActionLogin}, 1, 10); err != nil || total != 1 || events[0].ActorID != user.ID {
+		t.Fatalf("login events = %+v total = %d err=%v, want one after the second factor", events, total, err)
+	}
+	if _, err := LoginWithTOTP(pending.MFAToken, codes[1], "10.0.0.1"); !errors.Is(err, ErrMFATokenInvalid) {
+		t.Fatalf("reused intermediate token error = %v, want ErrMFATokenInvalid", err)
+	}
+	if _, err := LoginWithTOTP(session.Token, codes[1], "10.0.0.1"); !errors.Is(err, ErrMFATokenInvalid) {
+		t.Fatalf("session token as intermediate token error = %v, want ErrMFATokenInvalid", err)
+	}
+
+	if err := ResetTOTP(user.ID); err != nil {
+		t.Fatalf("ResetTOTP returned error: %v", err)
+	}
+	plain, err := LoginWithToken("alice", "password", "10.0.0.1")
+	if err != nil || plain.MFARequired || plain.Token == "" {
+		t.Fatalf("login after reset = %+v err=%v, want session token", plain, err)
+	}
+	if err := ResetTOTP(user.ID + 100); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("reset missing user error = %v, want ErrUserNotFound", err)
+	}
+}
+
+func currentTOTPCode(t *testing.T, secret string) string {
+	t.Helper()
+	key, err := totpSecretEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatalf("invalid totp secret %q: %v", secret, err)
+	}
+	return generateTOTPCode(key, time.Now().Unix()/int64(totpPeriod/time.Second))
+}
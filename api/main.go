@@ -2,21 +2,38 @@ package main
 
 import (
 	"DataArk/api"
+	"DataArk/backup"
 	"DataArk/common"
 	"fmt"
 )
 
 var (
-	parseFlags = common.ParseFlag
-	startWeb   = api.WebStarter
+	parseFlags        = common.ParseFlag
+	startWeb          = api.WebStarter
+	generateBackupKey = backup.GenerateBackupKey
 )
 
 func main() {
 	display_banner()
 	parseFlags()
+	if common.GenerateBackupKey {
+		printBackupKey()
+		return
+	}
 	startWeb(common.DEBUG)
 }
 
+// printBackupKey 输出新的备份加密密钥对，私钥需要保存到 -backupidentity 指定的文件并另外妥善保管。
+func printBackupKey() {
+	identity, recipient, err := generateBackupKey()
+	if err != nil {
+		fmt.Printf("failed to generate backup key: %v\n", err)
+		return
+	}
+	fmt.Printf("# public key, pass it to -backuprecipients: %s\n", recipient)
+	fmt.Println(identity)
+}
+
 func display_banner() {
 	fmt.Println("  _____     _             _    ____  _  __")
 	fmt.Println(" | ____|___| |__   ___   / \\  |  _ \\| |/ /")
@@ -41,6 +41,25 @@ func TestMainRunsStartupSequence(t *testing.T) {
 	}
 }
 
+func TestMainPrintsBackupKeyAndExits(t *testing.T) {
+	oldParseFlags := parseFlags
+	oldStartWeb := startWeb
+	oldGenerate := common.GenerateBackupKey
+	t.Cleanup(func() {
+		parseFlags = oldParseFlags
+		startWeb = oldStartWeb
+		common.GenerateBackupKey = oldGenerate
+	})
+
+	parseFlags = func() { common.GenerateBackupKey = true }
+	startWeb = func(bool) { t.Fatal("startWeb should not run when generating a backup key") }
+
+	output := captureStdout(t, main)
+	if !strings.Contains(output, "# public key, pass it to -backuprecipients: dataark1") || !strings.Contains(output, "\nDATAARK-SECRET-KEY-1") {
+		t.Fatalf("unexpected key output: %q", output)
+	}
+}
+
 func TestDisplayBannerWritesBanner(t *testing.T) {
 	output := captureStdout(t, display_banner)
 	if !strings.Contains(output, "____") || !strings.Contains(output, "| ____|") {
@@ -0,0 +1,145 @@
+package search
+
+import (
+	"DataArk/common"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var (
+	getArchiveOwnership         = common.GetArchiveOwnership
+	listArchiveOwnerships       = common.ListArchiveOwnerships
+	saveArchiveDocument         = common.SaveArchiveDocument
+	deleteArchiveDocumentRecord = common.DeleteArchiveDocumentRecord
+)
+
+type ArchiveVisibilityResult struct {
+	Path        string   `json:"path"`
+	Domain      string   `json:"domain"`
+	Filename    string   `json:"filename"`
+	DocumentIDs []string `json:"documentIds"`
+	common.ArchiveOwnership
+}
+
+// SetArchiveVisibility 修改归档 HTML 的可见范围并同步更新索引中的文档，无论成功与否都会写入审计记录。
+// 归档者不变，access 不可见的归档按不存在处理。
+func SetArchiveVisibility(ctx context.Context, rawPath string, visibility string, teamID uint, user *common.User, access common.ArchiveAccess) (*ArchiveVisibilityResult, error) {
+	result, err := setArchiveVisibility(ctx, rawPath, visibility, teamID, user, access)
+	detail := ""
+	if result != nil {
+		detail = fmt.Sprintf("visibility %s, team %d", result.Visibility, result.TeamID)
+	}
+	common.RecordAuditEvent(ctx, common.AuditActionArchiveVisibility, rawPath, detail, err)
+	return result, err
+}
+
+func setArchiveVisibility(ctx context.Context, rawPath string, visibility string, teamID uint, user *common.User, access common.ArchiveAccess) (*ArchiveVisibilityResult, error) {
+	if visibility == "" {
+		return nil, common.ErrInvalidVisibility
+	}
+	archivePath, current, err := resolveAccessibleArchiveDocument(rawPath, access)
+	if err != nil {
+		return nil, err
+	}
+	if !access.CanModify(current) {
+		return nil, fmt.Errorf("%w: %s", common.ErrArchiveAccessDenied, archivePath.RequestPath)
+	}
+
+	ownership, err := common.ResolveArchiveOwnership(user, visibility, teamID)
+	if err != nil {
+		return nil, err
+	}
+	// 旧数据没有归档者，由第一次设置可见范围的用户认领；已有归档者时保持不变。
+	if current.OwnerID != 0 {
+		ownership.OwnerID = current.OwnerID
+	}
+
+	engine, err := CurrentEngine()
+	if err != nil {
+		return nil, err
+	}
+	documentIDs, err := findArchiveDocumentIDs(ctx, engine, archivePath.Domain, archivePath.Filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := saveArchiveDocument(archivePath.Domain, archivePath.Filename, ownership); err != nil {
+		return nil, err
+	}
+
+	// 索引里只有归属字段需要改变，但搜索引擎只支持整篇替换，按原 ID 从 HTML 重新生成文档。
+	if len(documentIDs) > 0 {
+		document, err := buildDocumentFromHTML(archivePath.AbsPath, archivePath.Domain, archivePath.Filename)
+		if err != nil {
+			return nil, err
+		}
+		document.ArchiveOwnership = ownership
+		documents := make([]Document, 0, len(documentIDs))
+		for _, documentID := range documentIDs {
+			document.ID = documentID
+			documents = append(documents, document)
+		}
+		if err := engine.AddDocuments(ctx, documents); err != nil {
+			return nil, err
+		}
+	}
+
+	return &ArchiveVisibilityResult{
+		Path:             archivePath.RequestPath,
+		Domain:           archivePath.Domain,
+		Filename:         archivePath.Filename,
+		DocumentIDs:      documentIDs,
+		ArchiveOwnership: ownership,
+	}, nil
+}
+
+// ResolveArchiveFile 返回 access 可以浏览的 /archive 下文件的绝对路径，不可见时返回 ErrArchiveFileNotFound。
+// 只有归档 HTML 记录了归属，HTML 引用的其它文件和没有记录的旧归档都按公开处理。
+func ResolveArchiveFile(rawPath string, access common.ArchiveAccess) (string, error) {
+	archivePath, err := resolveArchiveDocumentPath(rawPath)
+	if err != nil {
+		return "", err
+	}
+	// 临时目录里是上传后还没有入库的文件，还没有归属，只允许不受限的访问者查看
+	if strings.EqualFold(archivePath.Domain, "Temporary") && !access.All {
+		return "", fmt.Errorf("%w: %s", ErrArchiveFileNotFound, archivePath.RequestPath)
+	}
+	ownership, _, err := getArchiveOwnership(archivePath.Domain, archivePath.Filename)
+	if err != nil {
+		return "", err
+	}
+	if !access.CanView(ownership) {
+		return "", fmt.Errorf("%w: %s", ErrArchiveFileNotFound, archivePath.RequestPath)
+	}
+	return archivePath.AbsPath, nil
+}
+
+// resolveAccessibleArchiveDocument 解析归档 HTML 路径并读取归属，文件不存在或 access 不可见时都返回 ErrArchiveFileNotFound，
+// 避免通过错误信息探测其他团队的私有归档。
+func resolveAccessibleArchiveDocument(rawPath string, access common.ArchiveAccess) (*archiveDocumentPath, common.ArchiveOwnership, error) {
+	archivePath, err := resolveArchiveDocumentPath(rawPath)
+	if err != nil {
+		return nil, common.ArchiveOwnership{}, err
+	}
+
+	fileInfo, err := os.Stat(archivePath.AbsPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, common.ArchiveOwnership{}, fmt.Errorf("%w: %s", ErrArchiveFileNotFound, archivePath.RequestPath)
+		}
+		return nil, common.ArchiveOwnership{}, err
+	}
+	if fileInfo.IsDir() {
+		return nil, common.ArchiveOwnership{}, fmt.Errorf("%w: %s", ErrInvalidArchivePath, archivePath.RequestPath)
+	}
+
+	ownership, _, err := getArchiveOwnership(archivePath.Domain, archivePath.Filename)
+	if err != nil {
+		return nil, common.ArchiveOwnership{}, err
+	}
+	if !access.CanView(ownership) {
+		return nil, common.ArchiveOwnership{}, fmt.Errorf("%w: %s", ErrArchiveFileNotFound, archivePath.RequestPath)
+	}
+	return archivePath, ownership, nil
+}
@@ -0,0 +1,247 @@
+package search
+
+import (
+	"DataArk/common"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// withArchiveOwnerships 用内存中的 map 代替 archive_documents 表，键为 "域名/文件名"。
+func withArchiveOwnerships(t *testing.T, ownerships map[string]common.ArchiveOwnership) map[string]common.ArchiveOwnership {
+	t.Helper()
+	if ownerships == nil {
+		ownerships = make(map[string]common.ArchiveOwnership)
+	}
+	oldGet := getArchiveOwnership
+	oldList := listArchiveOwnerships
+	oldSave := saveArchiveDocument
+	oldDelete := deleteArchiveDocumentRecord
+	t.Cleanup(func() {
+		getArchiveOwnership = oldGet
+		listArchiveOwnerships = oldList
+		saveArchiveDocument = oldSave
+		deleteArchiveDocumentRecord = oldDelete
+	})
+
+	getArchiveOwnership = func(domain, filename string) (common.ArchiveOwnership, bool, error) {
+		ownership, ok := ownerships[common.ArchiveDocumentKey(domain, filename)]
+		if !ok {
+			return common.PublicArchiveOwnership(), false, nil
+		}
+		return ownership, true, nil
+	}
+	listArchiveOwnerships = func() (map[string]common.ArchiveOwnership, error) {
+		copied := make(map[string]common.ArchiveOwnership, len(ownerships))
+		for key, ownership := range ownerships {
+			copied[key] = ownership
+		}
+		return copied, nil
+	}
+	saveArchiveDocument = func(domain, filename string, ownership common.ArchiveOwnership) error {
+		ownerships[common.ArchiveDocumentKey(domain, filename)] = ownership
+		return nil
+	}
+	deleteArchiveDocumentRecord = func(domain, filename string) error {
+		delete(ownerships, common.ArchiveDocumentKey(domain, filename))
+		return nil
+	}
+	return ownerships
+}
+
+func accessSearchIDs(t *testing.T, engine Engine, query string, access *common.ArchiveAccess) []string {
+	t.Helper()
+	response, err := engine.Search(context.Background(), SearchRequest{Query: query, Page: 1, HitsPerPage: 10, Access: access})
+	if err != nil {
+		t.Fatalf("Search(%q) returned error: %v", query, err)
+	}
+	ids := make([]string, 0, len(response.Hits))
+	for _, hit := range response.Hits {
+		ids = append(ids, hit.ID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestEmbeddedEngineFiltersByArchiveAccess(t *testing.T) {
+	engine := newTestEmbeddedEngine(t)
+	addTestDocuments(t, engine,
+		Document{ID: "legacy", Title: "report legacy", Domain: "a.com", Filename: "0.html"},
+		Document{ID: "public", Title: "report public", Domain: "a.com", Filename: "1.html", ArchiveOwnership: common.ArchiveOwnership{OwnerID: 2, Visibility: common.ArchiveVisibilityPublic}},
+		Document{ID: "mine", Title: "report mine", Domain: "a.com", Filename: "2.html", ArchiveOwnership: common.ArchiveOwnership{OwnerID: 1, Visibility: common.ArchiveVisibilityPrivate}},
+		Document{ID: "private", Title: "report private", Domain: "a.com", Filename: "3.html", ArchiveOwnership: common.ArchiveOwnership{OwnerID: 2, Visibility: common.ArchiveVisibilityPrivate}},
+		Document{ID: "team", Title: "report team", Domain: "a.com", Filename: "4.html", ArchiveOwnership: common.ArchiveOwnership{OwnerID: 2, TeamID: 5, Visibility: common.ArchiveVisibilityTeam}},
+		Document{ID: "other-team", Title: "report other", Domain: "a.com", Filename: "5.html", ArchiveOwnership: common.ArchiveOwnership{OwnerID: 2, TeamID: 6, Visibility: common.ArchiveVisibilityTeam}},
+	)
+
+	member := &common.ArchiveAccess{UserID: 1, TeamIDs: []uint{5}}
+	want := []string{"legacy", "mine", "public", "team"}
+	for _, query := range []string{"report", ""} {
+		if got := accessSearchIDs(t, engine, query, member); !reflect.DeepEqual(got, want) {
+			t.Fatalf("member search %q = %v, want %v", query, got, want)
+		}
+	}
+	if got := accessSearchIDs(t, engine, "report", &common.ArchiveAccess{All: true}); len(got) != 6 {
+		t.Fatalf("unrestricted search = %v, want all documents", got)
+	}
+	if got := accessSearchIDs(t, engine, "report", &common.ArchiveAccess{UserID: 2}); len(got) != 5 || reflect.DeepEqual(got, want) {
+		t.Fatalf("owner search = %v, want everything except user 1's private archive", got)
+	}
+}
+
+func TestMeiliAccessFilter(t *testing.T) {
+	if filter := meiliAccessFilter(nil); filter != nil {
+		t.Fatalf("nil access filter = %v, want none", filter)
+	}
+	if filter := meiliAccessFilter(&common.ArchiveAccess{All: true}); filter != nil {
+		t.Fatalf("admin filter = %v, want none", filter)
+	}
+	want := `visibility NOT EXISTS OR visibility = "public" OR ownerId = 3 OR (visibility = "team" AND teamId IN [1, 2])`
+	if filter := meiliAccessFilter(&common.ArchiveAccess{UserID: 3, TeamIDs: []uint{1, 2}}); filter != want {
+		t.Fatalf("filter = %v, want %s", filter, want)
+	}
+	ownership := documentOwnership(map[string]interface{}{"ownerId": float64(3), "teamId": float64(1), "visibility": "team"})
+	if ownership != (common.ArchiveOwnership{OwnerID: 3, TeamID: 1, Visibility: common.ArchiveVisibilityTeam}) {
+		t.Fatalf("documentOwnership = %+v", ownership)
+	}
+	if ownership := documentOwnership(map[string]interface{}{}); ownership.Visibility != common.ArchiveVisibilityPublic {
+		t.Fatalf("legacy documentOwnership = %+v, want public", ownership)
+	}
+}
+
+func setupAccessTestArchive(t *testing.T) (*embeddedEngine, map[string]common.ArchiveOwnership) {
+	t.Helper()
+	root := t.TempDir()
+	oldRoot := common.ARCHIVEFILELOACTION
+	oldEngine := currentEngine
+	engine := newTestEmbeddedEngine(t)
+	common.ARCHIVEFILELOACTION = root
+	currentEngine = func() (Engine, error) { return engine, nil }
+	withIndexSettingRows(t, nil)
+	t.Cleanup(func() {
+		common.ARCHIVEFILELOACTION = oldRoot
+		currentEngine = oldEngine
+	})
+
+	ownerships := withArchiveOwnerships(t, map[string]common.ArchiveOwnership{
+		"a.com/private.html": {OwnerID: 2, Visibility: common.ArchiveVisibilityPrivate},
+		"a.com/team.html":    {OwnerID: 2, TeamID: 5, Visibility: common.ArchiveVisibilityTeam},
+		"a.com/public.html":  {OwnerID: 2, Visibility: common.ArchiveVisibilityPublic},
+	})
+	for _, name := range []string{"private", "team", "public"} {
+		writeArchiveHTML(t, root, "a.com", name+".html", "quarterly "+name, "quarterly numbers")
+	}
+	if _, err := RebuildIndexFromArchive(context.Background()); err != nil {
+		t.Fatalf("RebuildIndexFromArchive returned error: %v", err)
+	}
+	return engine, ownerships
+}
+
+func TestRebuildIndexRestoresArchiveOwnership(t *testing.T) {
+	setupAccessTestArchive(t)
+
+	_, hits := QueryByKeyword("quarterly", 1, common.ArchiveAccess{UserID: 1})
+	if hits["TotalHits"] != 1 {
+		t.Fatalf("outsider hits = %d, want only the public archive", hits["TotalHits"])
+	}
+	_, hits = QueryByKeyword("quarterly", 1, common.ArchiveAccess{UserID: 1, TeamIDs: []uint{5}})
+	if hits["TotalHits"] != 2 {
+		t.Fatalf("team member hits = %d, want public and team archives", hits["TotalHits"])
+	}
+	_, hits = QueryByKeyword("quarterly", 1, common.ArchiveAccess{UserID: 2})
+	if hits["TotalHits"] != 3 {
+		t.Fatalf("owner hits = %d, want all archives", hits["TotalHits"])
+	}
+}
+
+func TestArchiveAccessChecksForDeleteAndRelated(t *testing.T) {
+	setupAccessTestArchive(t)
+	ctx := context.Background()
+	outsider := common.ArchiveAccess{UserID: 1}
+	member := common.ArchiveAccess{UserID: 3, TeamIDs: []uint{5}}
+
+	if _, err := deleteDocByHTMLPath(ctx, "/archive/a.com/private.html", outsider); !errors.Is(err, ErrArchiveFileNotFound) {
+		t.Fatalf("delete invisible archive error = %v, want ErrArchiveFileNotFound", err)
+	}
+	if _, err := deleteDocByHTMLPath(ctx, "/archive/a.com/public.html", outsider); !errors.Is(err, common.ErrArchiveAccessDenied) {
+		t.Fatalf("delete other user's public archive error = %v, want ErrArchiveAccessDenied", err)
+	}
+	if _, err := FindRelatedDocuments(ctx, "/archive/a.com/team.html", 5, outsider); !errors.Is(err, ErrArchiveFileNotFound) {
+		t.Fatalf("related of invisible archive error = %v, want ErrArchiveFileNotFound", err)
+	}
+
+	related, err := FindRelatedDocuments(ctx, "/archive/a.com/public.html", 5, member)
+	if err != nil {
+		t.Fatalf("FindRelatedDocuments returned error: %v", err)
+	}
+	for _, document := range related.Documents {
+		if document.Filename == "private.html" {
+			t.Fatalf("related documents leak private archive: %+v", related.Documents)
+		}
+	}
+
+	for path, visible := range map[string]bool{
+		"/archive/a.com/public.html":          true,
+		"/archive/a.com/team.html":            false,
+		"/archive/a.com/page_files/image.png": true,
+		"/archive/Temporary/upload.html":      false,
+	} {
+		absPath, err := ResolveArchiveFile(path, outsider)
+		if visible && (err != nil || absPath == "") {
+			t.Fatalf("ResolveArchiveFile(%s) = %q err=%v, want visible", path, absPath, err)
+		}
+		if !visible && !errors.Is(err, ErrArchiveFileNotFound) {
+			t.Fatalf("ResolveArchiveFile(%s) err=%v, want ErrArchiveFileNotFound", path, err)
+		}
+	}
+}
+
+func TestSetArchiveVisibilityReindexesDocument(t *testing.T) {
+	engine, ownerships := setupAccessTestArchive(t)
+	ctx := context.Background()
+	owner := &common.User{ID: 2, Role: common.RoleEditor}
+	ownerAccess := common.ArchiveAccess{UserID: 2}
+
+	result, err := setArchiveVisibility(ctx, "/archive/a.com/public.html", common.ArchiveVisibilityPrivate, 0, owner, ownerAccess)
+	if err != nil {
+		t.Fatalf("setArchiveVisibility returned error: %v", err)
+	}
+	if result.Visibility != common.ArchiveVisibilityPrivate || result.OwnerID != 2 || len(result.DocumentIDs) != 1 {
+		t.Fatalf("result = %+v", result)
+	}
+	if ownerships["a.com/public.html"].Visibility != common.ArchiveVisibilityPrivate {
+		t.Fatalf("stored ownership = %+v", ownerships["a.com/public.html"])
+	}
+	if got := accessSearchIDs(t, engine, "quarterly", &common.ArchiveAccess{UserID: 1}); len(got) != 0 {
+		t.Fatalf("outsider still sees %v after the archive became private", got)
+	}
+	if got := accessSearchIDs(t, engine, "quarterly", &ownerAccess); len(got) != 3 {
+		t.Fatalf("owner search = %v, want all three archives", got)
+	}
+
+	intruder := &common.User{ID: 1, Role: common.RoleEditor}
+	if _, err := setArchiveVisibility(ctx, "/archive/a.com/public.html", common.ArchiveVisibilityPublic, 0, intruder, common.ArchiveAccess{UserID: 1}); !errors.Is(err, ErrArchiveFileNotFound) {
+		t.Fatalf("intruder error = %v, want ErrArchiveFileNotFound", err)
+	}
+	if _, err := setArchiveVisibility(ctx, "/archive/a.com/public.html", "secret", 0, owner, ownerAccess); !errors.Is(err, common.ErrInvalidVisibility) {
+		t.Fatalf("invalid visibility error = %v, want ErrInvalidVisibility", err)
+	}
+}
+
+func TestAddDocFileRefusesToOverwriteOthersArchive(t *testing.T) {
+	setupAccessTestArchive(t)
+	tempDir := filepath.Join(common.ARCHIVEFILELOACTION, "Temporary")
+	if err := os.MkdirAll(tempDir, 0o755); err != nil {
+		t.Fatalf("MkdirAll returned error: %v", err)
+	}
+	writeArchiveHTML(t, tempDir, "", "public.html", "replacement", "replacement")
+
+	ownership := common.ArchiveOwnership{OwnerID: 1, Visibility: common.ArchiveVisibilityPrivate}
+	if err := AddDocFile("public.html", "a.com", ownership, common.ArchiveAccess{UserID: 1}); !errors.Is(err, common.ErrArchiveAccessDenied) {
+		t.Fatalf("overwrite error = %v, want ErrArchiveAccessDenied", err)
+	}
+}
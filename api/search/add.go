@@ -3,11 +3,11 @@ package search
 import (
 	"DataArk/common"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/google/uuid"
-	"github.com/meilisearch/meilisearch-go"
 	"gorm.io/gorm"
 	"io"
 	"log"
@@ -90,16 +90,26 @@ func InitArchiveTaskQueue() error {
 	return initErr
 }
 
-func AddDocFile(fileName string, originDomain string) (err error) {
+// AddDocFile 把上传到临时目录的 HTML 按 ownership 归档。
+// 同名归档已存在且 access 无权修改时返回 common.ErrArchiveAccessDenied，避免覆盖其他人的归档。
+func AddDocFile(fileName string, originDomain string, ownership common.ArchiveOwnership, access common.ArchiveAccess) (err error) {
 	htmlFilePath := filepath.Join(common.ARCHIVEFILELOACTION, "Temporary", fileName)
 	_, err = os.Stat(htmlFilePath)
 	if err != nil {
 		return err
 	}
-	return addDocFileByPath(htmlFilePath, fileName, originDomain)
+	existing, found, err := getArchiveOwnership(originDomain, fileName)
+	if err != nil {
+		return err
+	}
+	if found && !access.CanModify(existing) {
+		return fmt.Errorf("%w: %s/%s", common.ErrArchiveAccessDenied, originDomain, fileName)
+	}
+	return addDocFileByPath(htmlFilePath, fileName, originDomain, ownership)
 }
 
-func AddDocURLTask(rawURL string) (*common.ArchiveTask, bool, error) {
+// AddDocURLTask 创建链接离线任务，同一归属下相同 URL 的进行中或已成功任务会被复用。
+func AddDocURLTask(rawURL string, ownership common.ArchiveOwnership) (*common.ArchiveTask, bool, error) {
 	if err := ensureArchiveTaskQueue(); err != nil {
 		return nil, false, err
 	}
@@ -114,7 +124,7 @@ func AddDocURLTask(rawURL string) (*common.ArchiveTask, bool, error) {
 
 	// 先查正在执行的任务，是为了保证同一个 URL 在外部 SingleFile 服务和我们内部索引链路里
 	// 都只会有一个活跃任务，避免重复抓取、重复建索引。
-	activeTask, err := common.FindActiveArchiveTaskByURL(normalizedURL)
+	activeTask, err := common.FindActiveArchiveTaskByURL(normalizedURL, ownership)
 	if err == nil {
 		return activeTask, false, nil
 	}
@@ -124,7 +134,7 @@ func AddDocURLTask(rawURL string) (*common.ArchiveTask, bool, error) {
 
 	// 成功任务直接复用已有结果，而不是再次请求外部服务。
 	// 这样做可以保持接口幂等，也避免同一页面被重复保存出多个归档文件。
-	latestTask, err := common.GetLatestArchiveTaskByURL(normalizedURL)
+	latestTask, err := common.GetLatestArchiveTaskByURL(normalizedURL, ownership)
 	if err == nil && latestTask.Status == ArchiveTaskStatusSuccess {
 		return latestTask, false, nil
 	}
@@ -137,6 +147,8 @@ func AddDocURLTask(rawURL string) (*common.ArchiveTask, bool, error) {
 		URL:    normalizedURL,
 		Domain: domain,
 		Status: ArchiveTaskStatusPending,
+
+		ArchiveOwnership: ownership,
 	}
 	if err := common.CreateArchiveTask(task); err != nil {
 		return nil, false, err
@@ -197,7 +209,7 @@ func processArchiveTask(taskID string) {
 		return
 	}
 
-	if err := addDownloadedDocFile(singleFileResp.FileName, task.Domain); err != nil {
+	if err := addDownloadedDocFile(singleFileResp.FileName, task.Domain, task.ArchiveOwnership); err != nil {
 		finishArchiveTaskWithError(task, singleFileResp, err)
 		return
 	}
@@ -364,42 +376,30 @@ func normalizeArchiveURL(rawURL string) (string, string, error) {
 	return parsedURL.String(), strings.ToLower(parsedURL.Hostname()), nil
 }
 
-func addDownloadedDocFile(fileName string, originDomain string) error {
+func addDownloadedDocFile(fileName string, originDomain string, ownership common.ArchiveOwnership) error {
 	htmlFilePath := filepath.Join(common.ARCHIVEFILELOACTION, fileName)
 	_, err := os.Stat(htmlFilePath)
 	if err != nil {
 		return err
 	}
-	return addDocFileByPath(htmlFilePath, fileName, originDomain)
+	return addDocFileByPath(htmlFilePath, fileName, originDomain, ownership)
 }
 
-func addDocFileByPath(htmlFilePath string, fileName string, originDomain string) (err error) {
-	HTMLContent, err := common.GetHTMLFileContent(htmlFilePath)
+func addDocFileByPath(htmlFilePath string, fileName string, originDomain string, ownership common.ArchiveOwnership) (err error) {
+	document, err := buildDocumentFromHTML(htmlFilePath, originDomain, fileName)
 	if err != nil {
 		return err
 	}
-	title, err := common.GetHTMLTitle(HTMLContent)
+	document.ArchiveOwnership = ownership
+	engine, err := CurrentEngine()
 	if err != nil {
 		return err
 	}
-	HTMLPureText, err := common.ExtractHTMLText(HTMLContent)
-	if err != nil {
+	// 先写归属再写索引：归属写入失败时文档不会以公开状态出现在搜索结果或归档目录里。
+	if err := saveArchiveDocument(originDomain, fileName, ownership); err != nil {
 		return err
 	}
-
-	documents := []map[string]interface{}{
-		{
-			"id":       uuid.New().String(),
-			"title":    title,
-			"filename": fileName,
-			"domain":   originDomain,
-			"content":  HTMLPureText,
-		},
-	}
-	client := meilisearch.New(common.MEILIHOST, meilisearch.WithAPIKey(common.MEILIAPIKey))
-
-	_, err = client.Index(common.MEILIBlogsIndex).AddDocuments(documents)
-	if err != nil {
+	if err := engine.AddDocuments(context.Background(), []Document{document}); err != nil {
 		return err
 	}
 
@@ -429,15 +429,20 @@ func addDocFileByPath(htmlFilePath string, fileName string, originDomain string)
 }
 
 func CreateDefaultIndex() (err error) {
-	client := meilisearch.New(common.MEILIHOST, meilisearch.WithAPIKey(common.MEILIAPIKey))
-	_, err = client.GetIndex(common.MEILIBlogsIndex)
-	if err == nil {
-		return nil
-	} else {
-		client.CreateIndex(&meilisearch.IndexConfig{
-			Uid:        common.MEILIBlogsIndex,
-			PrimaryKey: "id",
-		})
+	engine, err := CurrentEngine()
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	if err := engine.EnsureIndex(ctx); err != nil {
+		log.Printf("failed to create %s search index: %v", engine.Name(), err)
+		return err
+	}
+
+	// 手动在 Meilisearch 中做的调整不会被保存，启动时统一按数据库中的配置覆盖一次。
+	if err := applyStoredIndexSettings(ctx, engine); err != nil {
+		log.Printf("failed to apply search index settings: %v", err)
+		return err
 	}
 	return nil
 }
@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"errors"
 	"github.com/meilisearch/meilisearch-go"
+	"gorm.io/gorm"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -124,7 +125,7 @@ func TestWaitForArchivedFile(t *testing.T) {
 	}
 }
 
-func TestMeiliArchiveIndexStoreListsDocuments(t *testing.T) {
+func TestEngineArchiveIndexStoreListsDocuments(t *testing.T) {
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path != "/indexes/blogs/documents" {
 			t.Fatalf("unexpected path %s", r.URL.Path)
@@ -145,7 +146,7 @@ func TestMeiliArchiveIndexStoreListsDocuments(t *testing.T) {
 	})
 	common.MEILIHOST = server.URL
 
-	documents, err := (meiliArchiveIndexStore{}).ListArchiveDocuments(context.Background())
+	documents, err := (engineArchiveIndexStore{}).ListArchiveDocuments(context.Background())
 	if err != nil {
 		t.Fatalf("ListArchiveDocuments returned error: %v", err)
 	}
@@ -177,6 +178,17 @@ func TestRebuildRecoverableIndexFromArchiveSkipsInvalidHTML(t *testing.T) {
 			_ = json.NewEncoder(w).Encode(meilisearch.TaskInfo{TaskUID: 2, Status: meilisearch.TaskStatusEnqueued})
 		case r.Method == http.MethodGet && r.URL.Path == "/tasks/2":
 			_ = json.NewEncoder(w).Encode(meilisearch.Task{TaskUID: 2, Status: meilisearch.TaskStatusSucceeded})
+		case r.Method == http.MethodDelete && r.URL.Path == "/indexes/blogs/settings":
+			w.WriteHeader(http.StatusAccepted)
+			_ = json.NewEncoder(w).Encode(meilisearch.TaskInfo{TaskUID: 3, Status: meilisearch.TaskStatusEnqueued})
+		case r.Method == http.MethodPatch && r.URL.Path == "/indexes/blogs/settings":
+			if len(addedDocuments) != 0 {
+				t.Fatal("index settings should be applied before documents are added")
+			}
+			w.WriteHeader(http.StatusAccepted)
+			_ = json.NewEncoder(w).Encode(meilisearch.TaskInfo{TaskUID: 4, Status: meilisearch.TaskStatusEnqueued})
+		case r.Method == http.MethodGet && (r.URL.Path == "/tasks/3" || r.URL.Path == "/tasks/4"):
+			_ = json.NewEncoder(w).Encode(meilisearch.Task{Status: meilisearch.TaskStatusSucceeded})
 		default:
 			t.Fatalf("unexpected meili request %s %s", r.Method, r.URL.Path)
 		}
@@ -185,12 +197,18 @@ func TestRebuildRecoverableIndexFromArchiveSkipsInvalidHTML(t *testing.T) {
 
 	oldHost := common.MEILIHOST
 	oldRoot := common.ARCHIVEFILELOACTION
+	oldLoadSettings := loadIndexSettingRow
 	t.Cleanup(func() {
 		common.MEILIHOST = oldHost
 		common.ARCHIVEFILELOACTION = oldRoot
+		loadIndexSettingRow = oldLoadSettings
 	})
 	common.MEILIHOST = server.URL
 	common.ARCHIVEFILELOACTION = root
+	loadIndexSettingRow = func(string) (*common.SearchIndexSetting, error) {
+		return nil, gorm.ErrRecordNotFound
+	}
+	withArchiveOwnerships(t, nil)
 
 	result, issues, err := RebuildRecoverableIndexFromArchive(context.Background())
 	if err != nil {
@@ -235,7 +253,7 @@ func TestDeleteDocumentHelpersUseMeiliIndex(t *testing.T) {
 
 	client := meilisearch.New(server.URL)
 	index := client.Index("blogs")
-	ids, err := findArchiveDocumentIDs(index, "example.com", "page.html")
+	ids, err := findArchiveDocumentIDs(context.Background(), newMeiliEngineWithClient(client), "example.com", "page.html")
 	if err != nil {
 		t.Fatalf("findArchiveDocumentIDs returned error: %v", err)
 	}
@@ -278,7 +296,7 @@ func TestAddDocFileRejectsMissingTemporaryFile(t *testing.T) {
 	})
 	common.ARCHIVEFILELOACTION = t.TempDir()
 
-	err := AddDocFile("missing.html", "example.com")
+	err := AddDocFile("missing.html", "example.com", common.PublicArchiveOwnership(), common.ArchiveAccess{All: true})
 	if err == nil || !errors.Is(err, os.ErrNotExist) {
 		t.Fatalf("err = %v, want not exist", err)
 	}
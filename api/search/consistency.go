@@ -4,7 +4,6 @@ import (
 	"DataArk/common"
 	"context"
 	"fmt"
-	"github.com/meilisearch/meilisearch-go"
 	"io/fs"
 	"os"
 	"path"
@@ -25,8 +24,6 @@ const (
 	ArchiveConsistencyStoreDatabase = "database"
 )
 
-const archiveConsistencyDocumentPageSize = 1000
-
 type ArchiveConsistencyIssue struct {
 	Severity    string   `json:"severity"`
 	Store       string   `json:"store"`
@@ -83,7 +80,7 @@ type archiveConsistencyService struct {
 	now         func() time.Time
 }
 
-type meiliArchiveIndexStore struct{}
+type engineArchiveIndexStore struct{}
 
 type commonArchiveStatsStore struct{}
 
@@ -91,14 +88,22 @@ func CheckArchiveConsistency(ctx context.Context) (*ArchiveConsistencyReport, er
 	return newArchiveConsistencyService().Check(ctx)
 }
 
+// RepairArchiveConsistency 修复可恢复的不一致并写入审计记录。
 func RepairArchiveConsistency(ctx context.Context) (*ArchiveConsistencyReport, error) {
-	return newArchiveConsistencyService().Repair(ctx)
+	report, err := newArchiveConsistencyService().Repair(ctx)
+	detail := ""
+	if report != nil {
+		detail = fmt.Sprintf("actions=%d indexed=%d refreshed=%d unrecoverable=%d",
+			len(report.Actions), report.IndexedDocuments, report.RefreshedStatSources, len(report.UnrecoverableIssues))
+	}
+	common.RecordAuditEvent(ctx, common.AuditActionConsistencyRepair, "archive", detail, err)
+	return report, err
 }
 
 func newArchiveConsistencyService() archiveConsistencyService {
 	return archiveConsistencyService{
 		archiveRoot: common.ARCHIVEFILELOACTION,
-		index:       meiliArchiveIndexStore{},
+		index:       engineArchiveIndexStore{},
 		stats:       commonArchiveStatsStore{},
 		now:         time.Now,
 	}
@@ -166,7 +171,7 @@ func (s archiveConsistencyService) Repair(ctx context.Context) (*ArchiveConsiste
 		return nil, err
 	}
 	report.Actions = []string{
-		fmt.Sprintf("已根据现存 HTML 文件重建 Meilisearch 索引，写入 %d 条文档", indexedDocuments),
+		fmt.Sprintf("已根据现存 HTML 文件重建搜索索引，写入 %d 条文档", indexedDocuments),
 		fmt.Sprintf("已根据现存 HTML 文件刷新数据库统计，来源数 %d 个", len(refreshedStats.Sources)),
 	}
 	report.IndexedDocuments = indexedDocuments
@@ -176,39 +181,28 @@ func (s archiveConsistencyService) Repair(ctx context.Context) (*ArchiveConsiste
 	return report, nil
 }
 
-func (meiliArchiveIndexStore) ListArchiveDocuments(ctx context.Context) ([]archiveIndexDocument, error) {
-	client := meilisearch.New(common.MEILIHOST, meilisearch.WithAPIKey(common.MEILIAPIKey))
-	index := client.Index(common.MEILIBlogsIndex)
-	documents := make([]archiveIndexDocument, 0)
-
-	for offset := int64(0); ; {
-		var result meilisearch.DocumentsResult
-		err := index.GetDocumentsWithContext(ctx, &meilisearch.DocumentsQuery{
-			Limit:  archiveConsistencyDocumentPageSize,
-			Offset: offset,
-			Fields: []string{"id", "domain", "filename"},
-		}, &result)
-		if err != nil {
-			return nil, err
-		}
-
-		for _, document := range result.Results {
-			documents = append(documents, archiveIndexDocument{
-				ID:       documentString(document, "id"),
-				Domain:   documentString(document, "domain"),
-				Filename: documentString(document, "filename"),
-			})
-		}
-		if len(result.Results) < archiveConsistencyDocumentPageSize {
-			break
-		}
-		offset += int64(len(result.Results))
+func (engineArchiveIndexStore) ListArchiveDocuments(ctx context.Context) ([]archiveIndexDocument, error) {
+	engine, err := CurrentEngine()
+	if err != nil {
+		return nil, err
+	}
+	engineDocuments, err := engine.ListDocuments(ctx)
+	if err != nil {
+		return nil, err
 	}
 
+	documents := make([]archiveIndexDocument, 0, len(engineDocuments))
+	for _, document := range engineDocuments {
+		documents = append(documents, archiveIndexDocument{
+			ID:       document.ID,
+			Domain:   document.Domain,
+			Filename: document.Filename,
+		})
+	}
 	return documents, nil
 }
 
-func (meiliArchiveIndexStore) RebuildArchiveIndex(ctx context.Context) (int, []ArchiveConsistencyIssue, error) {
+func (engineArchiveIndexStore) RebuildArchiveIndex(ctx context.Context) (int, []ArchiveConsistencyIssue, error) {
 	result, issues, err := RebuildRecoverableIndexFromArchive(ctx)
 	if err != nil {
 		return 0, nil, err
@@ -343,7 +337,7 @@ func compareArchiveFilesAndIndex(report *ArchiveConsistencyReport, files []archi
 				Severity:    ArchiveConsistencySeverityWarning,
 				Store:       ArchiveConsistencyStoreMeili,
 				DocumentIDs: []string{document.ID},
-				Message:     "Meilisearch 文档缺少 domain 或 filename 字段，可通过重建索引清理",
+				Message:     "搜索索引文档缺少 domain 或 filename 字段，可通过重建索引清理",
 				Recoverable: true,
 			})
 			continue
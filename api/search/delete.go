@@ -5,7 +5,6 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"github.com/meilisearch/meilisearch-go"
 	neturl "net/url"
 	"os"
 	"path"
@@ -14,10 +13,7 @@ import (
 	"time"
 )
 
-const (
-	deleteDocumentLookupLimit = 1000
-	deleteDocumentTaskTimeout = 10 * time.Second
-)
+const deleteDocumentTaskTimeout = 10 * time.Second
 
 var (
 	ErrInvalidArchivePath      = errors.New("invalid archive html path")
@@ -30,7 +26,6 @@ type DeleteDocResult struct {
 	Domain      string   `json:"domain"`
 	Filename    string   `json:"filename"`
 	DocumentIDs []string `json:"documentIds"`
-	TaskUID     int64    `json:"taskUid"`
 }
 
 type archiveDocumentPath struct {
@@ -40,27 +35,32 @@ type archiveDocumentPath struct {
 	AbsPath     string
 }
 
-func DeleteDocByHTMLPath(ctx context.Context, rawPath string) (*DeleteDocResult, error) {
-	archivePath, err := resolveArchiveDocumentPath(rawPath)
-	if err != nil {
-		return nil, err
+// DeleteDocByHTMLPath 删除归档 HTML 及其索引文档，无论成功与否都会写入审计记录。
+// access 不可见的归档按不存在处理，可见但无权修改时返回 common.ErrArchiveAccessDenied。
+func DeleteDocByHTMLPath(ctx context.Context, rawPath string, access common.ArchiveAccess) (*DeleteDocResult, error) {
+	result, err := deleteDocByHTMLPath(ctx, rawPath, access)
+	detail := ""
+	if result != nil {
+		detail = fmt.Sprintf("deleted %d index documents", len(result.DocumentIDs))
 	}
+	common.RecordAuditEvent(ctx, common.AuditActionArchiveDelete, rawPath, detail, err)
+	return result, err
+}
 
-	fileInfo, err := os.Stat(archivePath.AbsPath)
+func deleteDocByHTMLPath(ctx context.Context, rawPath string, access common.ArchiveAccess) (*DeleteDocResult, error) {
+	archivePath, ownership, err := resolveAccessibleArchiveDocument(rawPath, access)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, fmt.Errorf("%w: %s", ErrArchiveFileNotFound, archivePath.RequestPath)
-		}
 		return nil, err
 	}
-	if fileInfo.IsDir() {
-		return nil, fmt.Errorf("%w: %s", ErrInvalidArchivePath, archivePath.RequestPath)
+	if !access.CanModify(ownership) {
+		return nil, fmt.Errorf("%w: %s", common.ErrArchiveAccessDenied, archivePath.RequestPath)
 	}
 
-	client := meilisearch.New(common.MEILIHOST, meilisearch.WithAPIKey(common.MEILIAPIKey))
-	index := client.Index(common.MEILIBlogsIndex)
-
-	documentIDs, err := findArchiveDocumentIDs(index, archivePath.Domain, archivePath.Filename)
+	engine, err := CurrentEngine()
+	if err != nil {
+		return nil, err
+	}
+	documentIDs, err := findArchiveDocumentIDs(ctx, engine, archivePath.Domain, archivePath.Filename)
 	if err != nil {
 		return nil, err
 	}
@@ -68,22 +68,14 @@ func DeleteDocByHTMLPath(ctx context.Context, rawPath string) (*DeleteDocResult,
 		return nil, fmt.Errorf("%w: %s", ErrArchiveDocumentNotFound, archivePath.RequestPath)
 	}
 
-	taskInfo, err := deleteArchiveDocuments(index, documentIDs)
-	if err != nil {
+	if err := engine.DeleteDocuments(ctx, documentIDs); err != nil {
 		return nil, err
 	}
 
-	waitCtx, cancel := context.WithTimeout(ctx, deleteDocumentTaskTimeout)
-	defer cancel()
-	task, err := client.WaitForTaskWithContext(waitCtx, taskInfo.TaskUID, 0)
-	if err != nil {
+	if err := os.Remove(archivePath.AbsPath); err != nil {
 		return nil, err
 	}
-	if task.Status != meilisearch.TaskStatusSucceeded {
-		return nil, fmt.Errorf("meilisearch delete task %d finished with status %s", task.TaskUID, task.Status)
-	}
-
-	if err := os.Remove(archivePath.AbsPath); err != nil {
+	if err := deleteArchiveDocumentRecord(archivePath.Domain, archivePath.Filename); err != nil {
 		return nil, err
 	}
 	if err := common.DecrementArchiveStat(archivePath.Domain, 1); err != nil {
@@ -95,7 +87,6 @@ func DeleteDocByHTMLPath(ctx context.Context, rawPath string) (*DeleteDocResult,
 		Domain:      archivePath.Domain,
 		Filename:    archivePath.Filename,
 		DocumentIDs: documentIDs,
-		TaskUID:     taskInfo.TaskUID,
 	}, nil
 }
 
@@ -105,8 +96,9 @@ func resolveArchiveDocumentPath(rawPath string) (*archiveDocumentPath, error) {
 		return nil, fmt.Errorf("%w: empty path", ErrInvalidArchivePath)
 	}
 
+	// 只保留转义形式的路径，后面统一解码一次，避免 %25xx 被解码两次
 	if parsedURL, err := neturl.Parse(requestPath); err == nil && parsedURL.Path != "" {
-		requestPath = parsedURL.Path
+		requestPath = parsedURL.EscapedPath()
 	}
 
 	requestPath = strings.TrimPrefix(requestPath, "/")
@@ -160,44 +152,21 @@ func resolveArchiveDocumentPath(rawPath string) (*archiveDocumentPath, error) {
 	}, nil
 }
 
-func findArchiveDocumentIDs(index meilisearch.DocumentManager, domain string, filename string) ([]string, error) {
-	documentIDs := make([]string, 0, 1)
-	for offset := int64(0); ; {
-		var documents meilisearch.DocumentsResult
-		err := index.GetDocuments(&meilisearch.DocumentsQuery{
-			Limit:  deleteDocumentLookupLimit,
-			Offset: offset,
-			Fields: []string{"id", "filename", "domain"},
-		}, &documents)
-		if err != nil {
-			return nil, err
-		}
-
-		for _, document := range documents.Results {
-			if documentString(document, "domain") == domain && documentString(document, "filename") == filename {
-				id := documentString(document, "id")
-				if id != "" {
-					documentIDs = append(documentIDs, id)
-				}
-			}
-		}
+func findArchiveDocumentIDs(ctx context.Context, engine Engine, domain string, filename string) ([]string, error) {
+	documents, err := engine.ListDocuments(ctx)
+	if err != nil {
+		return nil, err
+	}
 
-		if len(documents.Results) < deleteDocumentLookupLimit {
-			break
+	documentIDs := make([]string, 0, 1)
+	for _, document := range documents {
+		if document.Domain == domain && document.Filename == filename && document.ID != "" {
+			documentIDs = append(documentIDs, document.ID)
 		}
-		offset += int64(len(documents.Results))
 	}
-
 	return documentIDs, nil
 }
 
-func deleteArchiveDocuments(index meilisearch.DocumentManager, documentIDs []string) (*meilisearch.TaskInfo, error) {
-	if len(documentIDs) == 1 {
-		return index.DeleteDocument(documentIDs[0])
-	}
-	return index.DeleteDocuments(documentIDs)
-}
-
 func documentString(document map[string]interface{}, key string) string {
 	value, ok := document[key]
 	if !ok || value == nil {
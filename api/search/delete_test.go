@@ -32,6 +32,32 @@ func TestResolveArchiveDocumentPath(t *testing.T) {
 	}
 }
 
+func TestResolveArchiveDocumentPathDecodesOnce(t *testing.T) {
+	rootDir := t.TempDir()
+	oldRoot := common.ARCHIVEFILELOACTION
+	common.ARCHIVEFILELOACTION = rootDir
+	t.Cleanup(func() {
+		common.ARCHIVEFILELOACTION = oldRoot
+	})
+
+	got, err := resolveArchiveDocumentPath("/archive/example.com/a%2541%253F.html")
+	if err != nil {
+		t.Fatalf("resolveArchiveDocumentPath returned error: %v", err)
+	}
+	if got.Filename != "a%41%3F.html" {
+		t.Fatalf("Filename = %q, want %q", got.Filename, "a%41%3F.html")
+	}
+
+	// 解码后的 ? 属于文件名，不能被当作查询参数截掉
+	got, err = resolveArchiveDocumentPath("/archive/example.com/a%3Fb.html")
+	if err != nil {
+		t.Fatalf("resolveArchiveDocumentPath returned error: %v", err)
+	}
+	if got.Filename != "a?b.html" {
+		t.Fatalf("Filename = %q, want %q", got.Filename, "a?b.html")
+	}
+}
+
 func TestResolveArchiveDocumentPathRejectsTraversal(t *testing.T) {
 	oldRoot := common.ARCHIVEFILELOACTION
 	common.ARCHIVEFILELOACTION = t.TempDir()
@@ -0,0 +1,206 @@
+package search
+
+import (
+	"DataArk/common"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	localEmbedderDimensions = 256
+	httpEmbedderTimeout     = time.Minute
+	// embeddingTextMaxRunes 限制送去向量化的文本长度，自托管模型的上下文通常只有几百到几千个 token。
+	embeddingTextMaxRunes = 2000
+)
+
+var ErrSemanticSearchDisabled = errors.New("semantic search is disabled")
+
+var currentEmbedder = defaultEmbedder
+
+// Embedder 把文本转换成向量，返回的向量与输入一一对应。
+// ID 用于识别向量来自哪个模型，更换模型后旧向量不可比较，需要重建索引。
+type Embedder interface {
+	ID() string
+	Embed(ctx context.Context, texts []string) ([][]float32, error)
+}
+
+// defaultEmbedder 按 -embedder 参数创建向量化实现，未配置时返回 nil，表示不启用语义搜索。
+func defaultEmbedder() (Embedder, error) {
+	switch strings.ToLower(strings.TrimSpace(common.EmbedderType)) {
+	case "", common.EmbedderNone:
+		return nil, nil
+	case common.EmbedderLocal:
+		return localEmbedder{dimensions: localEmbedderDimensions}, nil
+	case common.EmbedderHTTP:
+		if strings.TrimSpace(common.EmbedderURL) == "" {
+			return nil, errors.New("http embedder requires -embedurl")
+		}
+		return &httpEmbedder{
+			url:    common.EmbedderURL,
+			model:  common.EmbedderModel,
+			apiKey: common.EmbedderAPIKey,
+			client: &http.Client{Timeout: httpEmbedderTimeout},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported embedder %q", common.EmbedderType)
+	}
+}
+
+// localEmbedder 是不依赖模型服务的替代实现：把词项哈希到固定维度并做 L2 归一化，
+// 余弦相似度近似于词项重合度。它不理解语义，只用于测试和没有模型服务时的降级。
+type localEmbedder struct {
+	dimensions int
+}
+
+func (e localEmbedder) ID() string {
+	return fmt.Sprintf("%s:%d", common.EmbedderLocal, e.dimensions)
+}
+
+func (e localEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	vectors := make([][]float32, 0, len(texts))
+	for _, text := range texts {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		vector := make([]float32, e.dimensions)
+		for _, term := range indexTerms(text) {
+			hasher := fnv.New64a()
+			_, _ = hasher.Write([]byte(term))
+			sum := hasher.Sum64()
+			sign := float32(1)
+			if sum>>63 == 1 {
+				sign = -1
+			}
+			vector[sum%uint64(e.dimensions)] += sign
+		}
+		vectors = append(vectors, normalizeVector(vector))
+	}
+	return vectors, nil
+}
+
+// httpEmbedder 调用 OpenAI 兼容的 /embeddings 接口，Ollama、vLLM、text-embeddings-inference 等自托管服务都支持这一格式。
+type httpEmbedder struct {
+	url    string
+	model  string
+	apiKey string
+	client *http.Client
+}
+
+type httpEmbeddingRequest struct {
+	Model string   `json:"model,omitempty"`
+	Input []string `json:"input"`
+}
+
+type httpEmbeddingResponse struct {
+	Data []struct {
+		Index     int       `json:"index"`
+		Embedding []float32 `json:"embedding"`
+	} `json:"data"`
+}
+
+func (e *httpEmbedder) ID() string {
+	return common.EmbedderHTTP + ":" + e.url + ":" + e.model
+}
+
+func (e *httpEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	if len(texts) == 0 {
+		return [][]float32{}, nil
+	}
+
+	requestBody, err := json.Marshal(httpEmbeddingRequest{Model: e.model, Input: texts})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(requestBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if e.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+e.apiKey)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return nil, fmt.Errorf("embedding service returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+
+	var embeddingResp httpEmbeddingResponse
+	if err := json.Unmarshal(respBody, &embeddingResp); err != nil {
+		return nil, err
+	}
+	if len(embeddingResp.Data) != len(texts) {
+		return nil, fmt.Errorf("embedding service returned %d vectors for %d inputs", len(embeddingResp.Data), len(texts))
+	}
+
+	vectors := make([][]float32, len(texts))
+	for _, item := range embeddingResp.Data {
+		if item.Index < 0 || item.Index >= len(texts) || vectors[item.Index] != nil {
+			return nil, fmt.Errorf("embedding service returned invalid index %d", item.Index)
+		}
+		if len(item.Embedding) == 0 {
+			return nil, fmt.Errorf("embedding service returned an empty vector for input %d", item.Index)
+		}
+		vectors[item.Index] = normalizeVector(item.Embedding)
+	}
+	return vectors, nil
+}
+
+// embeddingText 取标题和正文开头作为文档的向量化输入。
+func embeddingText(document Document) string {
+	return truncateRunes(document.Title+"\n"+document.Content, embeddingTextMaxRunes)
+}
+
+func truncateRunes(text string, limit int) string {
+	runes := []rune(text)
+	if len(runes) <= limit {
+		return text
+	}
+	return string(runes[:limit])
+}
+
+func normalizeVector(vector []float32) []float32 {
+	var norm float64
+	for _, value := range vector {
+		norm += float64(value) * float64(value)
+	}
+	if norm == 0 {
+		return vector
+	}
+	norm = math.Sqrt(norm)
+	normalized := make([]float32, len(vector))
+	for i, value := range vector {
+		normalized[i] = float32(float64(value) / norm)
+	}
+	return normalized
+}
+
+// cosineSimilarity 假定两个向量都已归一化，维度不同的向量视为不相关。
+func cosineSimilarity(left []float32, right []float32) float64 {
+	if len(left) != len(right) {
+		return 0
+	}
+	var dot float64
+	for i := range left {
+		dot += float64(left[i]) * float64(right[i])
+	}
+	return dot
+}
@@ -0,0 +1,319 @@
+package search
+
+import (
+	"DataArk/common"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestLocalEmbedderSimilarity(t *testing.T) {
+	embedder := localEmbedder{dimensions: localEmbedderDimensions}
+	vectors, err := embedder.Embed(context.Background(), []string{"kubernetes 集群部署", "kubernetes 集群部署记录", "红烧肉做法"})
+	if err != nil {
+		t.Fatalf("Embed returned error: %v", err)
+	}
+	if len(vectors) != 3 || len(vectors[0]) != localEmbedderDimensions {
+		t.Fatalf("unexpected vectors shape: %d", len(vectors))
+	}
+	near := cosineSimilarity(vectors[0], vectors[1])
+	far := cosineSimilarity(vectors[0], vectors[2])
+	if near <= far || near <= 0.5 {
+		t.Fatalf("similarity near=%v far=%v", near, far)
+	}
+}
+
+func TestHTTPEmbedderCallsOpenAICompatibleAPI(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Authorization") != "Bearer secret" {
+			t.Errorf("unexpected request %s auth %q", r.Method, r.Header.Get("Authorization"))
+		}
+		var request httpEmbeddingRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+		if request.Model != "bge-m3" || len(request.Input) != 2 {
+			t.Errorf("unexpected request body %#v", request)
+		}
+		// 故意打乱顺序，Embed 应按 index 还原
+		_, _ = w.Write([]byte(`{"data":[{"index":1,"embedding":[0,2]},{"index":0,"embedding":[3,4]}]}`))
+	}))
+	defer server.Close()
+
+	embedder := &httpEmbedder{url: server.URL, model: "bge-m3", apiKey: "secret", client: server.Client()}
+	vectors, err := embedder.Embed(context.Background(), []string{"a", "b"})
+	if err != nil {
+		t.Fatalf("Embed returned error: %v", err)
+	}
+	if vectors[0][0] != 0.6 || vectors[0][1] != 0.8 || vectors[1][1] != 1 {
+		t.Fatalf("vectors = %#v", vectors)
+	}
+}
+
+func TestHTTPEmbedderRejectsBadResponses(t *testing.T) {
+	for name, body := range map[string]string{
+		"count":     `{"data":[{"index":0,"embedding":[1]}]}`,
+		"index":     `{"data":[{"index":0,"embedding":[1]},{"index":0,"embedding":[1]}]}`,
+		"empty":     `{"data":[{"index":0,"embedding":[]},{"index":1,"embedding":[1]}]}`,
+		"malformed": `{`,
+	} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(body))
+		}))
+		embedder := &httpEmbedder{url: server.URL, client: server.Client()}
+		if _, err := embedder.Embed(context.Background(), []string{"a", "b"}); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+		server.Close()
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "model not loaded", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	embedder := &httpEmbedder{url: server.URL, client: server.Client()}
+	if _, err := embedder.Embed(context.Background(), []string{"a"}); err == nil || !strings.Contains(err.Error(), "model not loaded") {
+		t.Fatalf("status error = %v", err)
+	}
+}
+
+func TestDefaultEmbedderFollowsConfig(t *testing.T) {
+	oldType, oldURL := common.EmbedderType, common.EmbedderURL
+	t.Cleanup(func() {
+		common.EmbedderType, common.EmbedderURL = oldType, oldURL
+	})
+
+	common.EmbedderType = common.EmbedderNone
+	if embedder, err := defaultEmbedder(); err != nil || embedder != nil {
+		t.Fatalf("none embedder = %#v, %v", embedder, err)
+	}
+	common.EmbedderType = common.EmbedderLocal
+	if embedder, err := defaultEmbedder(); err != nil || embedder.ID() != "local:256" {
+		t.Fatalf("local embedder = %#v, %v", embedder, err)
+	}
+	common.EmbedderType, common.EmbedderURL = common.EmbedderHTTP, ""
+	if _, err := defaultEmbedder(); err == nil {
+		t.Fatal("expected http embedder without url to fail")
+	}
+	common.EmbedderType = "word2vec"
+	if _, err := defaultEmbedder(); err == nil {
+		t.Fatal("expected unknown embedder to fail")
+	}
+}
+
+func TestVectorStorePersistsAndResetsOnEmbedderChange(t *testing.T) {
+	indexDir := t.TempDir()
+	store, err := openVectorStore(indexDir, "local:256")
+	if err != nil {
+		t.Fatalf("openVectorStore returned error: %v", err)
+	}
+	documents := []Document{{ID: "a", Title: "A"}, {ID: "b", Title: "B"}}
+	if err := store.Upsert(documents, [][]float32{{1, 0}, {0, 1}}); err != nil {
+		t.Fatalf("Upsert returned error: %v", err)
+	}
+	if err := store.Delete([]string{"b"}); err != nil {
+		t.Fatalf("Delete returned error: %v", err)
+	}
+
+	reloaded, err := loadVectorStore(filepath.Join(indexDir, common.MEILIBlogsIndex+".vectors"), "local:256")
+	if err != nil {
+		t.Fatalf("loadVectorStore returned error: %v", err)
+	}
+	if _, ok := reloaded.Get("a"); !ok {
+		t.Fatal("expected vector a to be persisted")
+	}
+	if _, ok := reloaded.Get("b"); ok {
+		t.Fatal("expected vector b to be deleted")
+	}
+
+	store, err = openVectorStore(indexDir, "http:model")
+	if err != nil {
+		t.Fatalf("openVectorStore returned error: %v", err)
+	}
+	if _, ok := store.Get("a"); ok {
+		t.Fatal("expected vectors from another embedder to be discarded")
+	}
+}
+
+func TestVectorStoreAppendsWritesToLog(t *testing.T) {
+	storePath := filepath.Join(t.TempDir(), "blogs.vectors")
+	store, err := loadVectorStore(storePath, "local:256")
+	if err != nil {
+		t.Fatalf("loadVectorStore returned error: %v", err)
+	}
+	if err := store.Reset(); err != nil {
+		t.Fatalf("Reset returned error: %v", err)
+	}
+	snapshotInfo, err := os.Stat(storePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := store.Upsert([]Document{{ID: strconv.Itoa(i)}}, [][]float32{{1, 0}}); err != nil {
+			t.Fatalf("Upsert returned error: %v", err)
+		}
+	}
+	if info, err := os.Stat(storePath); err != nil || info.Size() != snapshotInfo.Size() || !info.ModTime().Equal(snapshotInfo.ModTime()) {
+		t.Fatalf("snapshot should not be rewritten on every write: %v, %v", info, err)
+	}
+
+	// 合并进快照后清空日志；之后重置时上一代的日志记录不会在重放时复活
+	if err := store.compactLocked(store.snapshot); err != nil {
+		t.Fatalf("compactLocked returned error: %v", err)
+	}
+	if store.log.Size() != 0 {
+		t.Fatalf("log size after compaction = %d, want 0", store.log.Size())
+	}
+	if err := store.Upsert([]Document{{ID: "late"}}, [][]float32{{0, 1}}); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := loadVectorStore(storePath, "local:256")
+	if err != nil {
+		t.Fatalf("reload returned error: %v", err)
+	}
+	if len(reloaded.snapshot.Records) != 11 {
+		t.Fatalf("reloaded %d vectors, want 11", len(reloaded.snapshot.Records))
+	}
+	if err := reloaded.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if reset, err := loadVectorStore(storePath, "local:256"); err != nil || len(reset.snapshot.Records) != 0 {
+		t.Fatalf("vectors after reset = %v, %v", reset, err)
+	}
+}
+
+func newTestHybridEngine(t *testing.T) *hybridEngine {
+	t.Helper()
+	indexDir := t.TempDir()
+	keyword, err := loadEmbeddedEngine(filepath.Join(indexDir, "blogs.index"))
+	if err != nil {
+		t.Fatalf("loadEmbeddedEngine returned error: %v", err)
+	}
+	embedder := localEmbedder{dimensions: localEmbedderDimensions}
+	vectors, err := openVectorStore(indexDir, embedder.ID())
+	if err != nil {
+		t.Fatalf("openVectorStore returned error: %v", err)
+	}
+	return &hybridEngine{Engine: keyword, embedder: embedder, vectors: vectors}
+}
+
+// failingEmbedder 模拟不可用的向量化服务。
+type failingEmbedder struct {
+	localEmbedder
+}
+
+func (failingEmbedder) Embed(context.Context, []string) ([][]float32, error) {
+	return nil, errors.New("embedding service unavailable")
+}
+
+func TestHybridEngineDropsStaleVectorsWhenEmbeddingFails(t *testing.T) {
+	engine := newTestHybridEngine(t)
+	document := Document{ID: "a", Title: "部署", Domain: "a.com", Filename: "1.html", Content: "kubernetes 集群部署", ArchiveOwnership: common.PublicArchiveOwnership()}
+	addTestDocuments(t, engine, document)
+	if _, ok := engine.vectors.Get("a"); !ok {
+		t.Fatal("expected a vector for the document")
+	}
+
+	// 文档改为私有时向量化失败：旧向量中的公开归属不能继续留在语义索引里
+	engine.embedder = failingEmbedder{localEmbedder: localEmbedder{dimensions: localEmbedderDimensions}}
+	document.ArchiveOwnership = common.ArchiveOwnership{OwnerID: 7, Visibility: common.ArchiveVisibilityPrivate}
+	addTestDocuments(t, engine, document)
+	if _, ok := engine.vectors.Get("a"); ok {
+		t.Fatal("stale vector should be removed when embedding fails")
+	}
+	if failed := failedEmbeddings(engine); failed != 1 {
+		t.Fatalf("failed embeddings = %d, want 1", failed)
+	}
+}
+
+func TestHybridEngineMergesSemanticHits(t *testing.T) {
+	engine := newTestHybridEngine(t)
+	addTestDocuments(t, engine,
+		Document{ID: "exact", Title: "部署", Domain: "a.com", Filename: "1.html", Content: "kubernetes 集群部署"},
+		Document{ID: "related", Title: "集群", Domain: "b.com", Filename: "2.html", Content: "kubernetes 集群运维"},
+		Document{ID: "other", Title: "菜谱", Domain: "c.com", Filename: "3.html", Content: "红烧肉做法"},
+	)
+
+	// 本地向量化只能衡量词项重合，这里直接写入一条只存在于向量索引的记录，模拟关键词无法命中的语义近邻
+	semanticOnly := Document{ID: "semantic", Title: "运维", Domain: "d.com", Filename: "4.html", Content: "集群部署手册"}
+	vectors, err := engine.embedder.Embed(context.Background(), []string{embeddingText(semanticOnly)})
+	if err != nil {
+		t.Fatalf("Embed returned error: %v", err)
+	}
+	if err := engine.vectors.Upsert([]Document{semanticOnly}, vectors); err != nil {
+		t.Fatalf("Upsert returned error: %v", err)
+	}
+
+	if ids := searchIDs(t, engine, "部署"); strings.Join(ids, ",") != "exact" {
+		t.Fatalf("keyword ids = %#v", ids)
+	}
+
+	response, err := engine.Search(context.Background(), SearchRequest{Query: "部署", Page: 1, HitsPerPage: 10, SemanticRatio: 0.5})
+	if err != nil {
+		t.Fatalf("hybrid Search returned error: %v", err)
+	}
+	ids := make([]string, 0, len(response.Hits))
+	for _, hit := range response.Hits {
+		ids = append(ids, hit.ID)
+	}
+	if strings.Join(ids, ",") != "exact,semantic" || response.TotalHits != 2 {
+		t.Fatalf("hybrid ids = %#v total %d, want keyword hit first then semantic hit", ids, response.TotalHits)
+	}
+	if response.Hits[1].Domain != "d.com" || response.Hits[1].Score <= 0 || response.Hits[1].Score >= response.Hits[0].Score {
+		t.Fatalf("semantic hit = %#v", response.Hits[1])
+	}
+
+	response, err = engine.Search(context.Background(), SearchRequest{Query: "部署", Page: 2, HitsPerPage: 1, SemanticRatio: 0.5})
+	if err != nil || len(response.Hits) != 1 || response.Hits[0].ID != "semantic" || response.TotalPages != 2 {
+		t.Fatalf("second hybrid page = %#v, %v", response, err)
+	}
+	if _, ok := engine.vectors.Get("related"); !ok {
+		t.Fatal("expected AddDocuments to store vectors")
+	}
+
+	if err := engine.DeleteDocuments(context.Background(), []string{"related"}); err != nil {
+		t.Fatalf("DeleteDocuments returned error: %v", err)
+	}
+	if _, ok := engine.vectors.Get("related"); ok {
+		t.Fatal("expected vector to be deleted with the document")
+	}
+	if err := engine.ResetIndex(context.Background()); err != nil {
+		t.Fatalf("ResetIndex returned error: %v", err)
+	}
+	if _, ok := engine.vectors.Get("exact"); ok {
+		t.Fatal("expected vectors to be cleared on reset")
+	}
+}
+
+func TestQueryHybridRequiresEmbedder(t *testing.T) {
+	oldEmbedder := currentEmbedder
+	oldEngine := currentEngine
+	t.Cleanup(func() {
+		currentEmbedder = oldEmbedder
+		currentEngine = oldEngine
+	})
+
+	currentEmbedder = func() (Embedder, error) { return nil, nil }
+	if _, _, err := QueryHybrid("集群", 1, 0.5, common.ArchiveAccess{All: true}); err != ErrSemanticSearchDisabled {
+		t.Fatalf("QueryHybrid error = %v, want ErrSemanticSearchDisabled", err)
+	}
+
+	engine := newTestHybridEngine(t)
+	addTestDocuments(t, engine, Document{ID: "related", Title: "集群", Domain: "b.com", Filename: "2.html", Content: "kubernetes 集群运维"})
+	currentEmbedder = func() (Embedder, error) { return engine.embedder, nil }
+	currentEngine = func() (Engine, error) { return engine, nil }
+	result, pageAndHits, err := QueryHybrid("集群", 1, 1, common.ArchiveAccess{All: true})
+	if err != nil {
+		t.Fatalf("QueryHybrid returned error: %v", err)
+	}
+	if pageAndHits["TotalHits"] != 1 || !strings.Contains(result, "2.html") {
+		t.Fatalf("QueryHybrid = %s %#v", result, pageAndHits)
+	}
+}
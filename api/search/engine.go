@@ -0,0 +1,138 @@
+package search
+
+import (
+	"DataArk/common"
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Document 是写入搜索引擎的归档文档，字段与 HTML 文件一一对应。
+// 归属字段来自 archive_documents 表，供搜索时按可见范围过滤。
+type Document struct {
+	ID       string `json:"id"`
+	Title    string `json:"title"`
+	Filename string `json:"filename"`
+	Domain   string `json:"domain"`
+	Content  string `json:"content"`
+	common.ArchiveOwnership
+}
+
+// SearchRequest 是与具体搜索引擎无关的查询参数，Page 从 1 开始。
+// SemanticRatio 为 0 时只做关键词搜索，为 1 时只按语义相似度排序，仅在配置了向量化模型时生效。
+// Access 为空时不按可见范围过滤，只用于后台任务。
+type SearchRequest struct {
+	Query            string
+	Page             int64
+	HitsPerPage      int64
+	HighlightPreTag  string
+	HighlightPostTag string
+	CropLength       int
+	SemanticRatio    float64
+	Access           *common.ArchiveAccess
+}
+
+// canView 判断文档是否在本次查询的可见范围内。
+func (r SearchRequest) canView(document Document) bool {
+	return r.Access == nil || r.Access.CanView(document.ArchiveOwnership)
+}
+
+// SearchHit 是一条命中结果，FormattedContent 为高亮并裁剪后的正文片段，
+// Score 归一化到 0~1，便于后续和其它打分方式合并。
+type SearchHit struct {
+	Document
+	FormattedContent string  `json:"formattedContent"`
+	Score            float64 `json:"score"`
+}
+
+type SearchResponse struct {
+	Hits       []SearchHit `json:"hits"`
+	TotalHits  int64       `json:"totalHits"`
+	TotalPages int64       `json:"totalPages"`
+}
+
+// Engine 是归档文档的搜索后端。
+// 所有写操作都在返回前等待生效，调用方不需要关心 Meilisearch 的异步任务模型。
+type Engine interface {
+	Name() string
+	// EnsureIndex 在索引不存在时创建空索引。
+	EnsureIndex(ctx context.Context) error
+	// ResetIndex 删除索引中的全部文档和设置，用于从 HTML 重建索引。
+	ResetIndex(ctx context.Context) error
+	ApplySettings(ctx context.Context, settings IndexSettings) error
+	AddDocuments(ctx context.Context, documents []Document) error
+	DeleteDocuments(ctx context.Context, documentIDs []string) error
+	Search(ctx context.Context, request SearchRequest) (*SearchResponse, error)
+	// ListDocuments 返回全部文档的 ID、域名和文件名，不保证包含正文。
+	ListDocuments(ctx context.Context) ([]Document, error)
+}
+
+var (
+	embeddedEnginesMu sync.Mutex
+	embeddedEngines   = make(map[string]*embeddedEngine)
+	currentEngine     = defaultEngine
+)
+
+// CurrentEngine 按 -engine 参数返回当前搜索后端。
+func CurrentEngine() (Engine, error) {
+	return currentEngine()
+}
+
+// defaultEngine 在配置了向量化模型时用 hybridEngine 包装关键词引擎。
+func defaultEngine() (Engine, error) {
+	engine, err := keywordEngine()
+	if err != nil {
+		return nil, err
+	}
+	embedder, err := currentEmbedder()
+	if err != nil {
+		return nil, err
+	}
+	if embedder == nil {
+		return engine, nil
+	}
+	vectors, err := openVectorStore(common.SearchIndexDir, embedder.ID())
+	if err != nil {
+		return nil, err
+	}
+	return &hybridEngine{Engine: engine, embedder: embedder, vectors: vectors}, nil
+}
+
+func keywordEngine() (Engine, error) {
+	switch strings.ToLower(strings.TrimSpace(common.SearchEngine)) {
+	case "", common.SearchEngineMeilisearch:
+		return newMeiliEngine(), nil
+	case common.SearchEngineEmbedded:
+		return openEmbeddedEngine(common.SearchIndexDir)
+	default:
+		return nil, fmt.Errorf("unsupported search engine %q", common.SearchEngine)
+	}
+}
+
+// openEmbeddedEngine 按索引目录复用同一个实例，
+// 内嵌引擎把索引整体放在内存里，多个实例并发写同一个文件会互相覆盖。
+func openEmbeddedEngine(indexDir string) (*embeddedEngine, error) {
+	indexDir = strings.TrimSpace(indexDir)
+	if indexDir == "" {
+		return nil, fmt.Errorf("search index directory is empty")
+	}
+	indexPath, err := filepath.Abs(filepath.Join(indexDir, common.MEILIBlogsIndex+".index"))
+	if err != nil {
+		return nil, err
+	}
+
+	embeddedEnginesMu.Lock()
+	defer embeddedEnginesMu.Unlock()
+	if engine, ok := embeddedEngines[indexPath]; ok {
+		return engine, nil
+	}
+
+	engine, err := loadEmbeddedEngine(indexPath)
+	if err != nil {
+		return nil, err
+	}
+	embeddedEngines[indexPath] = engine
+	return engine, nil
+}
@@ -0,0 +1,797 @@
+package search
+
+import (
+	"DataArk/common"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// 第二版把正文移出快照，改为正文文件加操作日志，第一版快照在加载时自动迁移。
+const embeddedIndexFormatVersion = 2
+
+const (
+	embeddedDefaultHitsPerPage = 20
+	embeddedCropMarker         = "…"
+)
+
+// embeddedSnapshot 是内嵌索引的基础快照，之后的写操作记录在操作日志中。
+// 倒排表记录每个词项出现在文档的哪些字段里（按 indexDocumentAttributes 的顺序取位），
+// 四个字段始终全部建索引，修改可搜索字段只影响查询时的过滤，不需要重建索引。
+// Generation 在每次压缩时递增，ContentGeneration 是正文所在正文文件的代。
+type embeddedSnapshot struct {
+	FormatVersion     int
+	Generation        uint64
+	ContentGeneration uint64
+	NextSeq           uint64
+	Documents         map[string]embeddedDocument
+	Postings          map[string]map[string]uint8
+	Settings          IndexSettings
+}
+
+// embeddedDocument 是常驻内存的文档元数据，Content 为空，正文按 ContentOffset 和 ContentLength 从正文文件读取。
+type embeddedDocument struct {
+	Document
+	Seq           uint64
+	ContentOffset int64
+	ContentLength int64
+}
+
+// embeddedEngine 是不依赖外部服务的搜索后端，倒排表和文档元数据常驻内存，正文留在磁盘上。
+// 写操作只追加正文和一条日志记录，进程重启时加载快照并重放日志，无需重新解析 HTML。
+type embeddedEngine struct {
+	mu           sync.RWMutex
+	path         string
+	snapshot     embeddedSnapshot
+	snapshotSize int64
+	content      *os.File
+	contentSize  int64
+	log          *gobLog
+}
+
+type embeddedTermCandidate struct {
+	Term   string
+	Typos  int
+	Prefix bool
+}
+
+type embeddedTermMatch struct {
+	Term          string
+	Typos         int
+	Prefix        bool
+	AttributeRank int
+}
+
+type embeddedMatch struct {
+	Document  embeddedDocument
+	Terms     map[int]embeddedTermMatch
+	Words     int
+	Typos     int
+	Attribute int
+	Exactness int
+}
+
+func newEmbeddedSnapshot() embeddedSnapshot {
+	return embeddedSnapshot{
+		FormatVersion:     embeddedIndexFormatVersion,
+		Generation:        1,
+		ContentGeneration: 1,
+		Documents:         make(map[string]embeddedDocument),
+		Postings:          make(map[string]map[string]uint8),
+		Settings:          DefaultIndexSettings(),
+	}
+}
+
+func loadEmbeddedEngine(indexPath string) (*embeddedEngine, error) {
+	engine := &embeddedEngine{path: indexPath, snapshot: newEmbeddedSnapshot()}
+
+	file, err := os.Open(indexPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		// 还没有压缩过的索引只有日志和正文文件
+		if _, err := os.Stat(engine.logPath()); os.IsNotExist(err) {
+			return engine, nil
+		}
+		return engine, engine.openAndReplayLocked()
+	}
+	defer file.Close()
+
+	var snapshot embeddedSnapshot
+	if err := gob.NewDecoder(file).Decode(&snapshot); err != nil {
+		return nil, fmt.Errorf("decode embedded search index %s: %w", indexPath, err)
+	}
+	if snapshot.FormatVersion != 1 && snapshot.FormatVersion != embeddedIndexFormatVersion {
+		return nil, fmt.Errorf("embedded search index %s has unsupported format version %d", indexPath, snapshot.FormatVersion)
+	}
+	if info, err := file.Stat(); err == nil {
+		engine.snapshotSize = info.Size()
+	}
+	if snapshot.Documents == nil {
+		snapshot.Documents = make(map[string]embeddedDocument)
+	}
+	if snapshot.Postings == nil {
+		snapshot.Postings = make(map[string]map[string]uint8)
+	}
+	snapshot.Settings = normalizeIndexSettings(snapshot.Settings)
+	engine.snapshot = snapshot
+	if snapshot.FormatVersion == 1 {
+		if err := engine.migrateInlineContentLocked(); err != nil {
+			return nil, fmt.Errorf("migrate embedded search index %s: %w", indexPath, err)
+		}
+		return engine, nil
+	}
+	if err := engine.openAndReplayLocked(); err != nil {
+		return nil, err
+	}
+	return engine, nil
+}
+
+func (e *embeddedEngine) openAndReplayLocked() error {
+	if err := e.openFilesLocked(); err != nil {
+		return err
+	}
+	if err := e.replayLogLocked(); err != nil {
+		return err
+	}
+	e.removeStaleContentFiles()
+	return nil
+}
+
+func (e *embeddedEngine) Name() string {
+	return common.SearchEngineEmbedded
+}
+
+func (e *embeddedEngine) EnsureIndex(ctx context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if _, err := os.Stat(e.path); err == nil || !os.IsNotExist(err) {
+		return err
+	}
+	return e.compactLocked()
+}
+
+func (e *embeddedEngine) ResetIndex(ctx context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.resetFilesLocked(newEmbeddedSnapshot())
+}
+
+func (e *embeddedEngine) ApplySettings(ctx context.Context, settings IndexSettings) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	settings = normalizeIndexSettings(settings)
+	if err := e.writeLocked(embeddedLogEntry{Settings: &settings}); err != nil {
+		return err
+	}
+	e.snapshot.Settings = settings
+	return e.compactIfNeededLocked()
+}
+
+// AddDocuments 先把正文和日志写入磁盘，成功后再修改内存中的索引，写入失败时索引保持不变。
+func (e *embeddedEngine) AddDocuments(ctx context.Context, documents []Document) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, document := range documents {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if strings.TrimSpace(document.ID) == "" {
+			return errors.New("document id is empty")
+		}
+	}
+	if len(documents) == 0 {
+		return nil
+	}
+	if err := e.openFilesLocked(); err != nil {
+		return err
+	}
+	added, err := e.appendContentsLocked(documents)
+	if err != nil {
+		return err
+	}
+	if err := e.writeLocked(embeddedLogEntry{Added: added}); err != nil {
+		return err
+	}
+	for i, document := range added {
+		e.addDocumentLocked(document, documents[i].Content)
+	}
+	return e.compactIfNeededLocked()
+}
+
+func (e *embeddedEngine) DeleteDocuments(ctx context.Context, documentIDs []string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	existing := make([]string, 0, len(documentIDs))
+	for _, documentID := range documentIDs {
+		if _, ok := e.snapshot.Documents[documentID]; ok {
+			existing = append(existing, documentID)
+		}
+	}
+	if len(existing) == 0 {
+		return nil
+	}
+	if err := e.writeLocked(embeddedLogEntry{Deleted: existing}); err != nil {
+		return err
+	}
+	for _, documentID := range existing {
+		e.deleteDocumentLocked(documentID)
+	}
+	return e.compactIfNeededLocked()
+}
+
+func (e *embeddedEngine) writeLocked(entry embeddedLogEntry) error {
+	if err := e.openFilesLocked(); err != nil {
+		return err
+	}
+	return e.appendLogLocked(entry)
+}
+
+// addDocumentLocked 与 Meilisearch 一致，主键相同的文档整体替换。写入顺序在应用时分配，重放日志得到相同的顺序。
+func (e *embeddedEngine) addDocumentLocked(document embeddedDocument, content string) {
+	if existing, ok := e.snapshot.Documents[document.ID]; ok {
+		e.unindexLocked(existing)
+	}
+	if document.Seq == 0 {
+		e.snapshot.NextSeq++
+		document.Seq = e.snapshot.NextSeq
+	}
+	document.Content = ""
+	e.snapshot.Documents[document.ID] = document
+	indexed := document.Document
+	indexed.Content = content
+	e.indexLocked(indexed)
+}
+
+func (e *embeddedEngine) deleteDocumentLocked(documentID string) {
+	existing, ok := e.snapshot.Documents[documentID]
+	if !ok {
+		return
+	}
+	e.unindexLocked(existing)
+	delete(e.snapshot.Documents, documentID)
+}
+
+func (e *embeddedEngine) ListDocuments(ctx context.Context) ([]Document, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	documents := e.sortedDocumentsLocked()
+	result := make([]Document, 0, len(documents))
+	for _, document := range documents {
+		result = append(result, Document{
+			ID:               document.ID,
+			Title:            document.Title,
+			Filename:         document.Filename,
+			Domain:           document.Domain,
+			ArchiveOwnership: document.ArchiveOwnership,
+		})
+	}
+	return result, nil
+}
+
+func (e *embeddedEngine) Search(ctx context.Context, request SearchRequest) (*SearchResponse, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	settings := e.snapshot.Settings
+	terms := removeStopWords(uniqueStrings(queryTerms(request.Query)), settings.StopWords)
+
+	var matches []embeddedMatch
+	if len(terms) == 0 {
+		// 空查询与 Meilisearch 的占位搜索一致，按写入顺序返回全部文档。
+		for _, document := range e.sortedDocumentsLocked() {
+			if request.canView(document.Document) {
+				matches = append(matches, embeddedMatch{Document: document})
+			}
+		}
+	} else {
+		matches = e.matchDocumentsLocked(terms, settings)
+		visible := matches[:0]
+		for _, match := range matches {
+			if request.canView(match.Document.Document) {
+				visible = append(visible, match)
+			}
+		}
+		matches = visible
+		if sortsByContent(settings.RankingRules) {
+			for i := range matches {
+				matches[i].Document = e.withContentLocked(matches[i].Document)
+			}
+		}
+		sortEmbeddedMatches(matches, settings.RankingRules)
+	}
+
+	page := request.Page
+	if page < 1 {
+		page = 1
+	}
+	hitsPerPage := request.HitsPerPage
+	if hitsPerPage <= 0 {
+		hitsPerPage = embeddedDefaultHitsPerPage
+	}
+
+	totalHits := int64(len(matches))
+	response := &SearchResponse{
+		Hits:       make([]SearchHit, 0),
+		TotalHits:  totalHits,
+		TotalPages: (totalHits + hitsPerPage - 1) / hitsPerPage,
+	}
+	start := (page - 1) * hitsPerPage
+	if start >= totalHits {
+		return response, nil
+	}
+	end := start + hitsPerPage
+	if end > totalHits {
+		end = totalHits
+	}
+
+	for _, match := range matches[start:end] {
+		document := match.Document
+		if document.Content == "" {
+			document = e.withContentLocked(document)
+		}
+		highlightTerms := make([]string, 0, len(match.Terms))
+		for _, termMatch := range match.Terms {
+			highlightTerms = append(highlightTerms, termMatch.Term)
+		}
+		response.Hits = append(response.Hits, SearchHit{
+			Document:         document.Document,
+			FormattedContent: formatEmbeddedContent(document.Content, highlightTerms, request),
+			Score:            embeddedMatchScore(match, len(terms)),
+		})
+	}
+	return response, nil
+}
+
+func (e *embeddedEngine) indexLocked(document Document) {
+	for attributeIndex, attribute := range indexDocumentAttributes {
+		for _, term := range uniqueStrings(indexTerms(documentAttribute(document, attribute))) {
+			postings := e.snapshot.Postings[term]
+			if postings == nil {
+				postings = make(map[string]uint8)
+				e.snapshot.Postings[term] = postings
+			}
+			postings[document.ID] |= 1 << attributeIndex
+		}
+	}
+}
+
+// unindexLocked 按文档原有内容删除倒排表中的记录，正文读取失败时退回到扫描整个倒排表。
+func (e *embeddedEngine) unindexLocked(stored embeddedDocument) {
+	content, err := e.readContentLocked(stored)
+	if err != nil {
+		log.Printf("embedded search index: %v, scanning all postings instead", err)
+		for term, postings := range e.snapshot.Postings {
+			delete(postings, stored.ID)
+			if len(postings) == 0 {
+				delete(e.snapshot.Postings, term)
+			}
+		}
+		return
+	}
+	document := stored.Document
+	document.Content = content
+	for _, attribute := range indexDocumentAttributes {
+		for _, term := range indexTerms(documentAttribute(document, attribute)) {
+			postings := e.snapshot.Postings[term]
+			if postings == nil {
+				continue
+			}
+			delete(postings, document.ID)
+			if len(postings) == 0 {
+				delete(e.snapshot.Postings, term)
+			}
+		}
+	}
+}
+
+func (e *embeddedEngine) sortedDocumentsLocked() []embeddedDocument {
+	documents := make([]embeddedDocument, 0, len(e.snapshot.Documents))
+	for _, document := range e.snapshot.Documents {
+		documents = append(documents, document)
+	}
+	sort.Slice(documents, func(i, j int) bool {
+		return documents[i].Seq < documents[j].Seq
+	})
+	return documents
+}
+
+func (e *embeddedEngine) matchDocumentsLocked(terms []string, settings IndexSettings) []embeddedMatch {
+	searchableMask, attributeRanks := attributeMaskAndRanks(settings.SearchableAttributes)
+	typoDisabledMask, _ := attributeMaskAndRanks(settings.TypoTolerance.DisableOnAttributes)
+
+	matchesByID := make(map[string]*embeddedMatch)
+	for termIndex, term := range terms {
+		candidates := e.expandTermLocked(term, termIndex == len(terms)-1, settings)
+		for _, candidate := range candidates {
+			for documentID, mask := range e.snapshot.Postings[candidate.Term] {
+				mask &= searchableMask
+				if candidate.Typos > 0 {
+					mask &^= typoDisabledMask
+				}
+				if mask == 0 {
+					continue
+				}
+
+				match := matchesByID[documentID]
+				if match == nil {
+					match = &embeddedMatch{
+						Document: e.snapshot.Documents[documentID],
+						Terms:    make(map[int]embeddedTermMatch),
+					}
+					matchesByID[documentID] = match
+				}
+				termMatch := embeddedTermMatch{
+					Term:          candidate.Term,
+					Typos:         candidate.Typos,
+					Prefix:        candidate.Prefix,
+					AttributeRank: bestAttributeRank(mask, attributeRanks),
+				}
+				if current, ok := match.Terms[termIndex]; !ok || betterTermMatch(termMatch, current) {
+					match.Terms[termIndex] = termMatch
+				}
+			}
+		}
+	}
+
+	matches := make([]embeddedMatch, 0, len(matchesByID))
+	for _, match := range matchesByID {
+		match.Words = len(match.Terms)
+		for _, termMatch := range match.Terms {
+			match.Typos += termMatch.Typos
+			match.Attribute += termMatch.AttributeRank
+			if termMatch.Typos == 0 && !termMatch.Prefix {
+				match.Exactness++
+			}
+		}
+		matches = append(matches, *match)
+	}
+	return matches
+}
+
+// expandTermLocked 返回一个查询词可以命中的全部索引词项：原词、同义词、
+// 最后一个词的前缀匹配，以及在容错设置允许范围内的拼写错误匹配。
+func (e *embeddedEngine) expandTermLocked(term string, allowPrefix bool, settings IndexSettings) []embeddedTermCandidate {
+	candidates := make([]embeddedTermCandidate, 0, 1)
+	seen := make(map[string]bool)
+	add := func(candidate embeddedTermCandidate) {
+		if seen[candidate.Term] {
+			return
+		}
+		if _, ok := e.snapshot.Postings[candidate.Term]; !ok {
+			return
+		}
+		seen[candidate.Term] = true
+		candidates = append(candidates, candidate)
+	}
+
+	add(embeddedTermCandidate{Term: term})
+	for _, alternative := range settings.Synonyms[term] {
+		for _, alternativeTerm := range queryTerms(alternative) {
+			add(embeddedTermCandidate{Term: alternativeTerm})
+		}
+	}
+
+	maxTypos := allowedTypos(term, settings.TypoTolerance)
+	if !allowPrefix && maxTypos == 0 {
+		return candidates
+	}
+	for indexedTerm := range e.snapshot.Postings {
+		if seen[indexedTerm] {
+			continue
+		}
+		if allowPrefix && strings.HasPrefix(indexedTerm, term) {
+			add(embeddedTermCandidate{Term: indexedTerm, Prefix: true})
+			continue
+		}
+		if maxTypos == 0 {
+			continue
+		}
+		if distance := boundedEditDistance(term, indexedTerm, maxTypos); distance <= maxTypos {
+			add(embeddedTermCandidate{Term: indexedTerm, Typos: distance})
+		}
+	}
+	return candidates
+}
+
+func allowedTypos(term string, typoTolerance TypoToleranceSettings) int {
+	if !typoTolerance.Enabled || containsString(typoTolerance.DisableOnWords, term) {
+		return 0
+	}
+	for _, r := range term {
+		// 单个汉字就是一个词，编辑一个字符会变成完全不同的词，容错没有意义。
+		if isCJKRune(r) || unicode.IsDigit(r) {
+			return 0
+		}
+	}
+
+	length := int64(len([]rune(term)))
+	switch {
+	case length >= typoTolerance.MinWordSizeTwoTypos:
+		return 2
+	case length >= typoTolerance.MinWordSizeOneTypo:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// sortEmbeddedMatches 按配置中的排序规则依次比较，proximity 和 sort 在内嵌引擎中不参与排序，
+// 全部规则都相同时按写入顺序排列，保证分页结果稳定。
+func sortEmbeddedMatches(matches []embeddedMatch, rankingRules []string) {
+	sort.SliceStable(matches, func(i, j int) bool {
+		left, right := matches[i], matches[j]
+		for _, rule := range rankingRules {
+			switch rule {
+			case "words":
+				if left.Words != right.Words {
+					return left.Words > right.Words
+				}
+			case "typo":
+				if left.Typos != right.Typos {
+					return left.Typos < right.Typos
+				}
+			case "attribute":
+				if left.Attribute != right.Attribute {
+					return left.Attribute < right.Attribute
+				}
+			case "exactness":
+				if left.Exactness != right.Exactness {
+					return left.Exactness > right.Exactness
+				}
+			default:
+				field, direction, ok := strings.Cut(rule, ":")
+				if !ok || !isIndexDocumentAttribute(field) {
+					continue
+				}
+				leftValue := documentAttribute(left.Document.Document, field)
+				rightValue := documentAttribute(right.Document.Document, field)
+				if leftValue != rightValue {
+					if direction == "desc" {
+						return leftValue > rightValue
+					}
+					return leftValue < rightValue
+				}
+			}
+		}
+		return left.Document.Seq < right.Document.Seq
+	})
+}
+
+// sortsByContent 判断排序规则是否按正文排序，只有这时才需要读取全部命中文档的正文。
+func sortsByContent(rankingRules []string) bool {
+	for _, rule := range rankingRules {
+		if field, _, ok := strings.Cut(rule, ":"); ok && field == "content" {
+			return true
+		}
+	}
+	return false
+}
+
+// embeddedMatchScore 把命中词比例和每个词的匹配质量折算到 0~1。
+func embeddedMatchScore(match embeddedMatch, termCount int) float64 {
+	if termCount == 0 {
+		return 1
+	}
+	quality := 0.0
+	for _, termMatch := range match.Terms {
+		termQuality := 1 - 0.2*float64(termMatch.Typos) - 0.05*float64(termMatch.AttributeRank)
+		if termMatch.Prefix {
+			termQuality -= 0.1
+		}
+		if termQuality < 0.1 {
+			termQuality = 0.1
+		}
+		quality += termQuality
+	}
+	return quality / float64(termCount)
+}
+
+// formatEmbeddedContent 以第一个命中位置为中心按字符数裁剪正文，并为命中词加上高亮标签。
+// 正文中的英文单词已经粘连，按单词计数裁剪没有意义，这里的 CropLength 统一按字符计算。
+func formatEmbeddedContent(content string, terms []string, request SearchRequest) string {
+	runes := []rune(content)
+	lower := make([]rune, len(runes))
+	for i, r := range runes {
+		lower[i] = unicode.ToLower(r)
+	}
+
+	type span struct{ start, end int }
+	spans := make([]span, 0)
+	for _, term := range terms {
+		termRunes := []rune(term)
+		if len(termRunes) == 0 {
+			continue
+		}
+		for i := 0; i+len(termRunes) <= len(lower); i++ {
+			if string(lower[i:i+len(termRunes)]) == term {
+				spans = append(spans, span{start: i, end: i + len(termRunes)})
+			}
+		}
+	}
+	sort.Slice(spans, func(i, j int) bool {
+		if spans[i].start != spans[j].start {
+			return spans[i].start < spans[j].start
+		}
+		return spans[i].end > spans[j].end
+	})
+	merged := spans[:0]
+	for _, current := range spans {
+		if len(merged) > 0 && current.start < merged[len(merged)-1].end {
+			continue
+		}
+		merged = append(merged, current)
+	}
+
+	cropStart, cropEnd := 0, len(runes)
+	if request.CropLength > 0 && len(runes) > request.CropLength {
+		center := 0
+		if len(merged) > 0 {
+			center = merged[0].start
+		}
+		cropStart = center - request.CropLength/2
+		if cropStart < 0 {
+			cropStart = 0
+		}
+		cropEnd = cropStart + request.CropLength
+		if cropEnd > len(runes) {
+			cropEnd = len(runes)
+			cropStart = cropEnd - request.CropLength
+		}
+	}
+
+	var builder strings.Builder
+	if cropStart > 0 {
+		builder.WriteString(embeddedCropMarker)
+	}
+	position := cropStart
+	for _, current := range merged {
+		if current.start < cropStart || current.end > cropEnd {
+			continue
+		}
+		builder.WriteString(string(runes[position:current.start]))
+		builder.WriteString(request.HighlightPreTag)
+		builder.WriteString(string(runes[current.start:current.end]))
+		builder.WriteString(request.HighlightPostTag)
+		position = current.end
+	}
+	builder.WriteString(string(runes[position:cropEnd]))
+	if cropEnd < len(runes) {
+		builder.WriteString(embeddedCropMarker)
+	}
+	return builder.String()
+}
+
+// writeGobFile 先写临时文件再重命名，进程在写入中途退出时磁盘上仍是上一份完整快照。
+func writeGobFile(path string, value interface{}) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	tempFile, err := os.CreateTemp(dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tempPath := tempFile.Name()
+	defer os.Remove(tempPath)
+
+	if err := gob.NewEncoder(tempFile).Encode(value); err != nil {
+		_ = tempFile.Close()
+		return err
+	}
+	if err := tempFile.Sync(); err != nil {
+		_ = tempFile.Close()
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, path)
+}
+
+func attributeMaskAndRanks(attributes []string) (uint8, map[int]int) {
+	var mask uint8
+	ranks := make(map[int]int, len(attributes))
+	for rank, attribute := range attributes {
+		for attributeIndex, known := range indexDocumentAttributes {
+			if attribute == known {
+				mask |= 1 << attributeIndex
+				ranks[attributeIndex] = rank
+			}
+		}
+	}
+	return mask, ranks
+}
+
+func bestAttributeRank(mask uint8, ranks map[int]int) int {
+	best := len(indexDocumentAttributes)
+	for attributeIndex := range indexDocumentAttributes {
+		if mask&(1<<attributeIndex) == 0 {
+			continue
+		}
+		if rank, ok := ranks[attributeIndex]; ok && rank < best {
+			best = rank
+		}
+	}
+	return best
+}
+
+func betterTermMatch(candidate embeddedTermMatch, current embeddedTermMatch) bool {
+	if candidate.Typos != current.Typos {
+		return candidate.Typos < current.Typos
+	}
+	if candidate.Prefix != current.Prefix {
+		return !candidate.Prefix
+	}
+	return candidate.AttributeRank < current.AttributeRank
+}
+
+func documentAttribute(document Document, attribute string) string {
+	switch attribute {
+	case "title":
+		return document.Title
+	case "content":
+		return document.Content
+	case "domain":
+		return document.Domain
+	case "filename":
+		return document.Filename
+	default:
+		return ""
+	}
+}
+
+// removeStopWords 去掉停用词，但查询只剩停用词时保留原查询，避免搜索“the”返回全部文档。
+func removeStopWords(terms []string, stopWords []string) []string {
+	if len(stopWords) == 0 {
+		return terms
+	}
+	filtered := make([]string, 0, len(terms))
+	for _, term := range terms {
+		if !containsString(stopWords, term) {
+			filtered = append(filtered, term)
+		}
+	}
+	if len(filtered) == 0 {
+		return terms
+	}
+	return filtered
+}
+
+func uniqueStrings(values []string) []string {
+	unique := make([]string, 0, len(values))
+	seen := make(map[string]bool, len(values))
+	for _, value := range values {
+		if seen[value] {
+			continue
+		}
+		seen[value] = true
+		unique = append(unique, value)
+	}
+	return unique
+}
+
+func containsString(values []string, target string) bool {
+	for _, value := range values {
+		if value == target {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,333 @@
+package search
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// 内嵌索引在磁盘上由三部分组成：
+//   - 基础快照（indexPath）：文档元数据、倒排表和设置，只在压缩时整体重写；
+//   - 操作日志（indexPath.log）：上次压缩之后的每次写操作追加一条记录，启动时在快照之上重放；
+//   - 正文文件（indexPath.content-<代>）：只追加的文档正文，内存中只保留每篇正文的偏移和长度。
+//
+// 日志超过快照大小时压缩：写入新一代快照后清空日志，作废的正文超过有效正文时顺带重写正文文件。
+// 每次写操作只追加自己的数据，压缩的开销按写入量摊还，不再随文档数平方增长。
+const (
+	embeddedLogSuffix     = ".log"
+	embeddedContentSuffix = ".content-"
+	// embeddedMinCompactBytes 以下的日志和作废正文不触发压缩，避免小索引频繁重写快照。
+	embeddedMinCompactBytes = 1 << 20
+)
+
+// embeddedLogEntry 是一次写操作。Generation 与快照不一致的记录属于压缩前的日志，重放时跳过。
+type embeddedLogEntry struct {
+	Generation uint64
+	Added      []embeddedDocument
+	Deleted    []string
+	Settings   *IndexSettings
+}
+
+func (e *embeddedEngine) logPath() string {
+	return e.path + embeddedLogSuffix
+}
+
+func (e *embeddedEngine) contentPath(generation uint64) string {
+	return e.path + embeddedContentSuffix + strconv.FormatUint(generation, 10)
+}
+
+// openFilesLocked 打开当前代的正文文件和操作日志，已经打开时直接返回。
+func (e *embeddedEngine) openFilesLocked() error {
+	if e.content != nil && e.log != nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(e.path), 0o755); err != nil {
+		return err
+	}
+	if e.content == nil {
+		content, err := os.OpenFile(e.contentPath(e.snapshot.ContentGeneration), os.O_RDWR|os.O_CREATE, 0o644)
+		if err != nil {
+			return err
+		}
+		info, err := content.Stat()
+		if err != nil {
+			_ = content.Close()
+			return err
+		}
+		e.content, e.contentSize = content, info.Size()
+	}
+	if e.log == nil {
+		operations, err := openGobLog(e.logPath())
+		if err != nil {
+			return err
+		}
+		e.log = operations
+	}
+	return nil
+}
+
+// appendContentsLocked 把正文追加到正文文件并落盘，返回的文档只带正文的位置。
+func (e *embeddedEngine) appendContentsLocked(documents []Document) ([]embeddedDocument, error) {
+	var buffer bytes.Buffer
+	added := make([]embeddedDocument, 0, len(documents))
+	for _, document := range documents {
+		stored := embeddedDocument{
+			Document:      document,
+			ContentOffset: e.contentSize + int64(buffer.Len()),
+			ContentLength: int64(len(document.Content)),
+		}
+		stored.Content = ""
+		buffer.WriteString(document.Content)
+		added = append(added, stored)
+	}
+	if buffer.Len() == 0 {
+		return added, nil
+	}
+	if _, err := e.content.WriteAt(buffer.Bytes(), e.contentSize); err != nil {
+		return nil, err
+	}
+	if err := e.content.Sync(); err != nil {
+		return nil, err
+	}
+	e.contentSize += int64(buffer.Len())
+	return added, nil
+}
+
+// readContentLocked 从正文文件读取文档正文。
+func (e *embeddedEngine) readContentLocked(document embeddedDocument) (string, error) {
+	if document.ContentLength == 0 {
+		return "", nil
+	}
+	if e.content == nil {
+		return "", errors.New("embedded search index content file is not open")
+	}
+	content := make([]byte, document.ContentLength)
+	if _, err := e.content.ReadAt(content, document.ContentOffset); err != nil {
+		return "", fmt.Errorf("read content of document %s: %w", document.ID, err)
+	}
+	return string(content), nil
+}
+
+// withContentLocked 返回带正文的文档，读取失败时记录日志并返回空正文，只影响结果摘要。
+func (e *embeddedEngine) withContentLocked(document embeddedDocument) embeddedDocument {
+	content, err := e.readContentLocked(document)
+	if err != nil {
+		log.Printf("embedded search index: %v", err)
+	}
+	document.Content = content
+	return document
+}
+
+// appendLogLocked 追加一条属于当前代的日志记录。
+func (e *embeddedEngine) appendLogLocked(entry embeddedLogEntry) error {
+	entry.Generation = e.snapshot.Generation
+	return e.log.Append(&entry)
+}
+
+// replayLogLocked 在快照之上重放日志，跳过压缩前留下的上一代记录。
+func (e *embeddedEngine) replayLogLocked() error {
+	return e.log.Replay(func(decoder *gob.Decoder) error {
+		var entry embeddedLogEntry
+		if err := decoder.Decode(&entry); err != nil {
+			return err
+		}
+		if entry.Generation != e.snapshot.Generation {
+			return nil
+		}
+		return e.applyLogEntryLocked(entry)
+	})
+}
+
+// applyLogEntryLocked 把一条写操作应用到内存中的索引，重放日志时从正文文件读取正文建立倒排表。
+func (e *embeddedEngine) applyLogEntryLocked(entry embeddedLogEntry) error {
+	if entry.Settings != nil {
+		e.snapshot.Settings = normalizeIndexSettings(*entry.Settings)
+	}
+	for _, document := range entry.Added {
+		content, err := e.readContentLocked(document)
+		if err != nil {
+			return err
+		}
+		e.addDocumentLocked(document, content)
+	}
+	for _, documentID := range entry.Deleted {
+		e.deleteDocumentLocked(documentID)
+	}
+	return nil
+}
+
+// compactIfNeededLocked 在日志超过快照大小时压缩。
+func (e *embeddedEngine) compactIfNeededLocked() error {
+	if e.log.Size() < embeddedMinCompactBytes || e.log.Size() < e.snapshotSize {
+		return nil
+	}
+	return e.compactLocked()
+}
+
+// compactLocked 写入新一代快照并清空日志。作废的正文超过有效正文时，先把有效正文复制到新一代的正文文件。
+// 新快照改名生效之前磁盘上的旧快照、日志和正文文件都保持不变，进程中途退出时按旧的一代加载。
+func (e *embeddedEngine) compactLocked() error {
+	if err := e.openFilesLocked(); err != nil {
+		return err
+	}
+	snapshot := e.snapshot
+	snapshot.Generation++
+
+	var liveBytes int64
+	for _, document := range snapshot.Documents {
+		liveBytes += document.ContentLength
+	}
+	var newContent *os.File
+	var newContentSize int64
+	if dead := e.contentSize - liveBytes; dead > embeddedMinCompactBytes && dead > liveBytes {
+		var err error
+		newContent, newContentSize, snapshot.Documents, err = e.rewriteContentLocked(snapshot.Generation)
+		if err != nil {
+			return err
+		}
+		snapshot.ContentGeneration = snapshot.Generation
+	}
+
+	if err := writeGobFile(e.path, &snapshot); err != nil {
+		if newContent != nil {
+			_ = newContent.Close()
+			_ = os.Remove(e.contentPath(snapshot.Generation))
+		}
+		return err
+	}
+	e.snapshot = snapshot
+	if info, err := os.Stat(e.path); err == nil {
+		e.snapshotSize = info.Size()
+	}
+	if newContent != nil {
+		_ = e.content.Close()
+		e.content, e.contentSize = newContent, newContentSize
+	}
+	e.removeStaleContentFiles()
+	// 日志中的记录都属于上一代，即使清空失败，重放时也会跳过
+	if err := e.log.Reset(); err != nil {
+		log.Printf("failed to truncate embedded search index log: %v", err)
+	}
+	return nil
+}
+
+// rewriteContentLocked 把有效正文按写入顺序复制到 generation 对应的正文文件，返回新文件和更新了偏移的文档。
+func (e *embeddedEngine) rewriteContentLocked(generation uint64) (*os.File, int64, map[string]embeddedDocument, error) {
+	path := e.contentPath(generation)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	fail := func(err error) (*os.File, int64, map[string]embeddedDocument, error) {
+		_ = file.Close()
+		_ = os.Remove(path)
+		return nil, 0, nil, err
+	}
+
+	documents := make(map[string]embeddedDocument, len(e.snapshot.Documents))
+	var size int64
+	for _, document := range e.sortedDocumentsLocked() {
+		content, err := e.readContentLocked(document)
+		if err != nil {
+			return fail(err)
+		}
+		if _, err := file.WriteAt([]byte(content), size); err != nil {
+			return fail(err)
+		}
+		document.ContentOffset = size
+		size += document.ContentLength
+		documents[document.ID] = document
+	}
+	if err := file.Sync(); err != nil {
+		return fail(err)
+	}
+	return file, size, documents, nil
+}
+
+// resetFilesLocked 为空索引开始新的一代，丢弃全部正文和日志。
+func (e *embeddedEngine) resetFilesLocked(snapshot embeddedSnapshot) error {
+	if err := os.MkdirAll(filepath.Dir(e.path), 0o755); err != nil {
+		return err
+	}
+	snapshot.Generation = e.snapshot.Generation + 1
+	snapshot.ContentGeneration = snapshot.Generation
+	content, err := os.OpenFile(e.contentPath(snapshot.Generation), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if err := writeGobFile(e.path, &snapshot); err != nil {
+		_ = content.Close()
+		_ = os.Remove(e.contentPath(snapshot.Generation))
+		return err
+	}
+	e.snapshot = snapshot
+	if info, err := os.Stat(e.path); err == nil {
+		e.snapshotSize = info.Size()
+	}
+	if e.content != nil {
+		_ = e.content.Close()
+	}
+	e.content, e.contentSize = content, 0
+	e.removeStaleContentFiles()
+	if e.log != nil {
+		if err := e.log.Reset(); err != nil {
+			log.Printf("failed to truncate embedded search index log: %v", err)
+		}
+	}
+	return nil
+}
+
+// removeStaleContentFiles 删除不属于当前快照的正文文件，它们来自已经完成或中途退出的压缩。
+func (e *embeddedEngine) removeStaleContentFiles() {
+	matches, err := filepath.Glob(e.path + embeddedContentSuffix + "*")
+	if err != nil {
+		return
+	}
+	current := e.contentPath(e.snapshot.ContentGeneration)
+	for _, match := range matches {
+		if match == current {
+			continue
+		}
+		if err := os.Remove(match); err != nil && !os.IsNotExist(err) {
+			log.Printf("failed to remove stale embedded search index content %s: %v", match, err)
+		}
+	}
+}
+
+// migrateInlineContentLocked 把第一版快照中内嵌的正文移到正文文件，并写入新格式的快照。
+func (e *embeddedEngine) migrateInlineContentLocked() error {
+	e.snapshot.FormatVersion = embeddedIndexFormatVersion
+	e.snapshot.Generation = 1
+	e.snapshot.ContentGeneration = 1
+	if err := e.openFilesLocked(); err != nil {
+		return err
+	}
+	// 第一版没有日志，残留的文件不可能属于这份快照
+	if err := e.content.Truncate(0); err != nil {
+		return err
+	}
+	e.contentSize = 0
+	if err := e.log.Reset(); err != nil {
+		return err
+	}
+
+	documents := e.sortedDocumentsLocked()
+	inline := make([]Document, 0, len(documents))
+	for _, document := range documents {
+		inline = append(inline, document.Document)
+	}
+	stored, err := e.appendContentsLocked(inline)
+	if err != nil {
+		return err
+	}
+	for i, document := range stored {
+		document.Seq = documents[i].Seq
+		e.snapshot.Documents[document.ID] = document
+	}
+	return e.compactLocked()
+}
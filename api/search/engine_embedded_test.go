@@ -0,0 +1,365 @@
+package search
+
+import (
+	"DataArk/common"
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func newTestEmbeddedEngine(t *testing.T) *embeddedEngine {
+	t.Helper()
+	engine, err := loadEmbeddedEngine(filepath.Join(t.TempDir(), "blogs.index"))
+	if err != nil {
+		t.Fatalf("loadEmbeddedEngine returned error: %v", err)
+	}
+	return engine
+}
+
+func addTestDocuments(t *testing.T, engine Engine, documents ...Document) {
+	t.Helper()
+	if err := engine.AddDocuments(context.Background(), documents); err != nil {
+		t.Fatalf("AddDocuments returned error: %v", err)
+	}
+}
+
+func searchIDs(t *testing.T, engine Engine, query string) []string {
+	t.Helper()
+	response, err := engine.Search(context.Background(), SearchRequest{Query: query, Page: 1, HitsPerPage: 10})
+	if err != nil {
+		t.Fatalf("Search(%q) returned error: %v", query, err)
+	}
+	ids := make([]string, 0, len(response.Hits))
+	for _, hit := range response.Hits {
+		ids = append(ids, hit.ID)
+	}
+	return ids
+}
+
+func TestTokenizerSplitsLatinAndCJK(t *testing.T) {
+	got := strings.Join(indexTerms("Go语言Rust, 2024!"), "|")
+	if got != "go|语|语言|言|rust|2024" {
+		t.Fatalf("indexTerms = %q", got)
+	}
+	if got := strings.Join(queryTerms("数据方舟 Go"), "|"); got != "数据|据方|方舟|go" {
+		t.Fatalf("queryTerms = %q", got)
+	}
+	if got := strings.Join(queryTerms("库"), "|"); got != "库" {
+		t.Fatalf("single CJK queryTerms = %q", got)
+	}
+	if boundedEditDistance("kitten", "sitting", 3) != 3 || boundedEditDistance("kitten", "sitting", 1) != 2 {
+		t.Fatal("unexpected edit distance")
+	}
+}
+
+func TestEmbeddedEngineSearchRanksAndHighlights(t *testing.T) {
+	engine := newTestEmbeddedEngine(t)
+	addTestDocuments(t, engine,
+		Document{ID: "content", Title: "Notes", Domain: "a.com", Filename: "1.html", Content: "介绍 kubernetes 集群的部署"},
+		Document{ID: "title", Title: "Kubernetes", Domain: "b.com", Filename: "2.html", Content: "部署记录"},
+		Document{ID: "other", Title: "Cooking", Domain: "c.com", Filename: "3.html", Content: "红烧肉"},
+	)
+
+	if ids := searchIDs(t, engine, "kubernetes"); strings.Join(ids, ",") != "title,content" {
+		t.Fatalf("ids = %#v, want title match ranked first", ids)
+	}
+	if ids := searchIDs(t, engine, "部署"); len(ids) != 2 {
+		t.Fatalf("CJK ids = %#v", ids)
+	}
+	if ids := searchIDs(t, engine, "kuber"); len(ids) != 2 {
+		t.Fatalf("prefix ids = %#v", ids)
+	}
+	if ids := searchIDs(t, engine, "kubernetse"); len(ids) != 2 {
+		t.Fatalf("typo ids = %#v", ids)
+	}
+	if ids := searchIDs(t, engine, ""); strings.Join(ids, ",") != "content,title,other" {
+		t.Fatalf("placeholder ids = %#v, want insertion order", ids)
+	}
+
+	response, err := engine.Search(context.Background(), SearchRequest{
+		Query:            "集群",
+		HitsPerPage:      10,
+		HighlightPreTag:  "<em>",
+		HighlightPostTag: "</em>",
+		CropLength:       6,
+	})
+	if err != nil {
+		t.Fatalf("Search returned error: %v", err)
+	}
+	if response.TotalHits != 1 || response.TotalPages != 1 {
+		t.Fatalf("response = %#v", response)
+	}
+	if got := response.Hits[0].FormattedContent; got != "…es <em>集群</em>的…" {
+		t.Fatalf("formatted content = %q", got)
+	}
+	if response.Hits[0].Score <= 0 || response.Hits[0].Score > 1 {
+		t.Fatalf("score = %v, want normalized", response.Hits[0].Score)
+	}
+}
+
+func TestEmbeddedEngineAppliesIndexSettings(t *testing.T) {
+	engine := newTestEmbeddedEngine(t)
+	addTestDocuments(t, engine,
+		Document{ID: "k8s", Title: "Cluster", Domain: "a.com", Filename: "k.html", Content: "kubernetes"},
+		Document{ID: "domain", Title: "Home", Domain: "kubernetes.io", Filename: "d.html", Content: "welcome"},
+	)
+
+	settings := DefaultIndexSettings()
+	settings.SearchableAttributes = []string{"content"}
+	settings.Synonyms = map[string][]string{"k8s": {"kubernetes"}}
+	settings.StopWords = []string{"the"}
+	settings.TypoTolerance.Enabled = false
+	if err := engine.ApplySettings(context.Background(), settings); err != nil {
+		t.Fatalf("ApplySettings returned error: %v", err)
+	}
+
+	if ids := searchIDs(t, engine, "the k8s"); strings.Join(ids, ",") != "k8s" {
+		t.Fatalf("synonym ids = %#v, want only content match", ids)
+	}
+	if ids := searchIDs(t, engine, "kubernetse"); len(ids) != 0 {
+		t.Fatalf("typo tolerance disabled ids = %#v", ids)
+	}
+}
+
+func TestEmbeddedEnginePersistsAndDeletes(t *testing.T) {
+	indexPath := filepath.Join(t.TempDir(), "index", "blogs.index")
+	engine, err := loadEmbeddedEngine(indexPath)
+	if err != nil {
+		t.Fatalf("loadEmbeddedEngine returned error: %v", err)
+	}
+	if err := engine.EnsureIndex(context.Background()); err != nil {
+		t.Fatalf("EnsureIndex returned error: %v", err)
+	}
+	addTestDocuments(t, engine,
+		Document{ID: "1", Title: "First", Domain: "a.com", Filename: "1.html", Content: "alpha"},
+		Document{ID: "2", Title: "Second", Domain: "a.com", Filename: "2.html", Content: "beta"},
+	)
+	addTestDocuments(t, engine, Document{ID: "1", Title: "First", Domain: "a.com", Filename: "1.html", Content: "gamma"})
+	if err := engine.DeleteDocuments(context.Background(), []string{"2", "missing"}); err != nil {
+		t.Fatalf("DeleteDocuments returned error: %v", err)
+	}
+
+	reloaded, err := loadEmbeddedEngine(indexPath)
+	if err != nil {
+		t.Fatalf("reload returned error: %v", err)
+	}
+	documents, err := reloaded.ListDocuments(context.Background())
+	if err != nil {
+		t.Fatalf("ListDocuments returned error: %v", err)
+	}
+	if len(documents) != 1 || documents[0].ID != "1" || documents[0].Filename != "1.html" {
+		t.Fatalf("documents = %#v", documents)
+	}
+	if ids := searchIDs(t, reloaded, "alpha"); len(ids) != 0 {
+		t.Fatalf("replaced document terms should be removed, got %#v", ids)
+	}
+	if ids := searchIDs(t, reloaded, "gamma"); strings.Join(ids, ",") != "1" {
+		t.Fatalf("ids = %#v", ids)
+	}
+	if _, ok := reloaded.snapshot.Postings["beta"]; ok {
+		t.Fatal("deleted document terms should be removed from postings")
+	}
+
+	if err := reloaded.ResetIndex(context.Background()); err != nil {
+		t.Fatalf("ResetIndex returned error: %v", err)
+	}
+	if documents, _ := reloaded.ListDocuments(context.Background()); len(documents) != 0 {
+		t.Fatalf("documents after reset = %#v", documents)
+	}
+}
+
+func TestEmbeddedEngineAppendsToLogAndCompacts(t *testing.T) {
+	indexPath := filepath.Join(t.TempDir(), "blogs.index")
+	engine, err := loadEmbeddedEngine(indexPath)
+	if err != nil {
+		t.Fatalf("loadEmbeddedEngine returned error: %v", err)
+	}
+	if err := engine.EnsureIndex(context.Background()); err != nil {
+		t.Fatalf("EnsureIndex returned error: %v", err)
+	}
+	snapshotInfo, err := os.Stat(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		addTestDocuments(t, engine, Document{ID: strconv.Itoa(i), Title: "Page", Domain: "a.com", Filename: strconv.Itoa(i) + ".html", Content: "alpha body " + strconv.Itoa(i)})
+	}
+	if err := engine.DeleteDocuments(context.Background(), []string{"0"}); err != nil {
+		t.Fatalf("DeleteDocuments returned error: %v", err)
+	}
+
+	// 写操作只追加日志和正文，不重写快照；内存中的文档不带正文
+	if info, err := os.Stat(indexPath); err != nil || info.Size() != snapshotInfo.Size() || !info.ModTime().Equal(snapshotInfo.ModTime()) {
+		t.Fatalf("snapshot should not be rewritten on every write: %v, %v", info, err)
+	}
+	if engine.log.Size() == 0 {
+		t.Fatal("writes should be appended to the log")
+	}
+	if document := engine.snapshot.Documents["1"]; document.Content != "" || document.ContentLength == 0 {
+		t.Fatalf("resident document = %+v, want content kept on disk", document)
+	}
+	response, err := engine.Search(context.Background(), SearchRequest{Query: "alpha", Page: 1, HitsPerPage: 1})
+	if err != nil || len(response.Hits) != 1 || !strings.HasPrefix(response.Hits[0].Content, "alpha body") {
+		t.Fatalf("search hits should include content read from disk: %+v, %v", response, err)
+	}
+
+	// 日志中途写坏的最后一条记录在加载时截掉，之前的写操作都保留
+	logFile, err := os.OpenFile(indexPath+".log", os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := logFile.Write([]byte{0xff, 0, 0, 0, 1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	_ = logFile.Close()
+	reloaded, err := loadEmbeddedEngine(indexPath)
+	if err != nil {
+		t.Fatalf("reload with a torn log returned error: %v", err)
+	}
+	if documents, _ := reloaded.ListDocuments(context.Background()); len(documents) != 19 {
+		t.Fatalf("reloaded %d documents, want 19", len(documents))
+	}
+
+	if err := reloaded.compactLocked(); err != nil {
+		t.Fatalf("compactLocked returned error: %v", err)
+	}
+	if reloaded.log.Size() != 0 {
+		t.Fatalf("log size after compaction = %d, want 0", reloaded.log.Size())
+	}
+	compacted, err := loadEmbeddedEngine(indexPath)
+	if err != nil {
+		t.Fatalf("reload after compaction returned error: %v", err)
+	}
+	if ids := searchIDs(t, compacted, "19"); strings.Join(ids, ",") != "19" {
+		t.Fatalf("ids after compaction = %#v", ids)
+	}
+	if _, ok := compacted.snapshot.Documents["0"]; ok {
+		t.Fatal("deleted document should stay deleted after compaction")
+	}
+}
+
+func TestEmbeddedEngineCompactsDeadContent(t *testing.T) {
+	indexPath := filepath.Join(t.TempDir(), "blogs.index")
+	engine, err := loadEmbeddedEngine(indexPath)
+	if err != nil {
+		t.Fatalf("loadEmbeddedEngine returned error: %v", err)
+	}
+	large := strings.Repeat("alpha ", embeddedMinCompactBytes/5)
+	addTestDocuments(t, engine, Document{ID: "1", Title: "Large", Domain: "a.com", Filename: "1.html", Content: large})
+	addTestDocuments(t, engine, Document{ID: "1", Title: "Small", Domain: "a.com", Filename: "1.html", Content: "beta"})
+	if err := engine.compactLocked(); err != nil {
+		t.Fatalf("compactLocked returned error: %v", err)
+	}
+	if engine.contentSize != int64(len("beta")) {
+		t.Fatalf("content size after compaction = %d, want only live content", engine.contentSize)
+	}
+	matches, err := filepath.Glob(indexPath + embeddedContentSuffix + "*")
+	if err != nil || len(matches) != 1 {
+		t.Fatalf("content files = %v, %v, want only the current one", matches, err)
+	}
+	reloaded, err := loadEmbeddedEngine(indexPath)
+	if err != nil {
+		t.Fatalf("reload returned error: %v", err)
+	}
+	if ids := searchIDs(t, reloaded, "beta"); strings.Join(ids, ",") != "1" {
+		t.Fatalf("ids = %#v", ids)
+	}
+	if ids := searchIDs(t, reloaded, "alpha"); len(ids) != 0 {
+		t.Fatalf("replaced content should not match, got %#v", ids)
+	}
+}
+
+func TestEmbeddedEngineMigratesInlineContent(t *testing.T) {
+	indexPath := filepath.Join(t.TempDir(), "blogs.index")
+	legacy := newEmbeddedSnapshot()
+	legacy.FormatVersion = 1
+	legacy.Generation, legacy.ContentGeneration = 0, 0
+	legacy.NextSeq = 1
+	legacy.Documents["1"] = embeddedDocument{Document: Document{ID: "1", Title: "Legacy", Domain: "a.com", Filename: "1.html", Content: "gamma body"}, Seq: 1}
+	legacy.Postings["gamma"] = map[string]uint8{"1": 1 << 1}
+	if err := writeGobFile(indexPath, &legacy); err != nil {
+		t.Fatal(err)
+	}
+
+	engine, err := loadEmbeddedEngine(indexPath)
+	if err != nil {
+		t.Fatalf("loadEmbeddedEngine returned error: %v", err)
+	}
+	if engine.snapshot.FormatVersion != embeddedIndexFormatVersion || engine.snapshot.Documents["1"].Content != "" {
+		t.Fatalf("snapshot should be migrated, got %+v", engine.snapshot)
+	}
+	response, err := engine.Search(context.Background(), SearchRequest{Query: "gamma", Page: 1, HitsPerPage: 10})
+	if err != nil || len(response.Hits) != 1 || response.Hits[0].Content != "gamma body" {
+		t.Fatalf("migrated search = %+v, %v", response, err)
+	}
+	// 迁移后删除文档时按正文文件中的内容清理倒排表
+	if err := engine.DeleteDocuments(context.Background(), []string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := engine.snapshot.Postings["gamma"]; ok {
+		t.Fatal("deleted document terms should be removed from postings")
+	}
+}
+
+func TestCurrentEngineSelectsEmbeddedEngine(t *testing.T) {
+	oldEngine := common.SearchEngine
+	oldIndexDir := common.SearchIndexDir
+	t.Cleanup(func() {
+		common.SearchEngine = oldEngine
+		common.SearchIndexDir = oldIndexDir
+	})
+	common.SearchEngine = common.SearchEngineEmbedded
+	common.SearchIndexDir = t.TempDir()
+
+	first, err := CurrentEngine()
+	if err != nil {
+		t.Fatalf("CurrentEngine returned error: %v", err)
+	}
+	second, err := CurrentEngine()
+	if err != nil {
+		t.Fatalf("CurrentEngine returned error: %v", err)
+	}
+	if first.Name() != common.SearchEngineEmbedded || first != second {
+		t.Fatalf("embedded engine should be cached per index dir: %#v %#v", first, second)
+	}
+
+	common.SearchEngine = "elastic"
+	if _, err := CurrentEngine(); err == nil {
+		t.Fatal("unknown engine should return error")
+	}
+}
+
+func TestRebuildIndexFromArchiveWithEmbeddedEngine(t *testing.T) {
+	root := t.TempDir()
+	writeArchiveHTML(t, root, "example.com", "page.html", "Embedded Page", "searchable")
+
+	oldRoot := common.ARCHIVEFILELOACTION
+	oldCurrentEngine := currentEngine
+	withIndexSettingRows(t, nil)
+	withArchiveOwnerships(t, nil)
+	t.Cleanup(func() {
+		common.ARCHIVEFILELOACTION = oldRoot
+		currentEngine = oldCurrentEngine
+	})
+	common.ARCHIVEFILELOACTION = root
+	engine := newTestEmbeddedEngine(t)
+	currentEngine = func() (Engine, error) {
+		return engine, nil
+	}
+
+	result, err := RebuildIndexFromArchive(context.Background())
+	if err != nil {
+		t.Fatalf("RebuildIndexFromArchive returned error: %v", err)
+	}
+	if result.Documents != 1 {
+		t.Fatalf("result = %#v", result)
+	}
+
+	resultJSON, pageAndHits := QueryByKeyword("searchable", 1, common.ArchiveAccess{All: true})
+	if pageAndHits["TotalHits"] != 1 || !strings.Contains(resultJSON, "Embedded Page") || !strings.Contains(resultJSON, "color: red;") {
+		t.Fatalf("QueryByKeyword = %s %#v", resultJSON, pageAndHits)
+	}
+}
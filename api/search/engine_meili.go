@@ -0,0 +1,284 @@
+package search
+
+import (
+	"DataArk/common"
+	"context"
+	"fmt"
+	"github.com/meilisearch/meilisearch-go"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const meiliDocumentPageSize = 1000
+
+// meiliFilterableAttributes 是按可见范围过滤需要的字段，不属于可配置的搜索设置，每次下发设置时固定带上。
+var meiliFilterableAttributes = []string{"ownerId", "teamId", "visibility"}
+
+type meiliEngine struct {
+	client meilisearch.ServiceManager
+}
+
+func newMeiliEngine() *meiliEngine {
+	return newMeiliEngineWithClient(meilisearch.New(common.MEILIHOST, meilisearch.WithAPIKey(common.MEILIAPIKey)))
+}
+
+func newMeiliEngineWithClient(client meilisearch.ServiceManager) *meiliEngine {
+	return &meiliEngine{client: client}
+}
+
+func (e *meiliEngine) Name() string {
+	return common.SearchEngineMeilisearch
+}
+
+func (e *meiliEngine) EnsureIndex(ctx context.Context) error {
+	if _, err := e.client.GetIndexWithContext(ctx, common.MEILIBlogsIndex); err == nil {
+		return nil
+	}
+	taskInfo, err := e.client.CreateIndexWithContext(ctx, &meilisearch.IndexConfig{
+		Uid:        common.MEILIBlogsIndex,
+		PrimaryKey: "id",
+	})
+	if err != nil {
+		return err
+	}
+	return waitForServiceTask(ctx, e.client, taskInfo)
+}
+
+func (e *meiliEngine) ResetIndex(ctx context.Context) error {
+	return recreateBlogsIndex(ctx, e.client)
+}
+
+func (e *meiliEngine) ApplySettings(ctx context.Context, settings IndexSettings) error {
+	return applyMeiliIndexSettings(ctx, e.client, settings)
+}
+
+func (e *meiliEngine) AddDocuments(ctx context.Context, documents []Document) error {
+	if len(documents) == 0 {
+		return nil
+	}
+	taskInfo, err := e.client.Index(common.MEILIBlogsIndex).AddDocumentsWithContext(ctx, documents)
+	if err != nil {
+		return err
+	}
+	return waitForServiceTask(ctx, e.client, taskInfo)
+}
+
+func (e *meiliEngine) DeleteDocuments(ctx context.Context, documentIDs []string) error {
+	if len(documentIDs) == 0 {
+		return nil
+	}
+	taskInfo, err := deleteArchiveDocuments(e.client.Index(common.MEILIBlogsIndex), documentIDs)
+	if err != nil {
+		return err
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, deleteDocumentTaskTimeout)
+	defer cancel()
+	return waitForServiceTask(waitCtx, e.client, taskInfo)
+}
+
+func (e *meiliEngine) Search(ctx context.Context, request SearchRequest) (*SearchResponse, error) {
+	meiliResp, err := e.client.Index(common.MEILIBlogsIndex).SearchWithContext(ctx, request.Query, &meilisearch.SearchRequest{
+		Page:                  request.Page,
+		HitsPerPage:           request.HitsPerPage,
+		AttributesToHighlight: []string{"content"},
+		ShowMatchesPosition:   true,
+		ShowRankingScore:      true,
+		HighlightPreTag:       request.HighlightPreTag,
+		HighlightPostTag:      request.HighlightPostTag,
+		AttributesToCrop:      []string{"content"},
+		CropLength:            int64(request.CropLength),
+		Filter:                meiliAccessFilter(request.Access),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	response := &SearchResponse{
+		Hits:       make([]SearchHit, 0, len(meiliResp.Hits)),
+		TotalHits:  meiliResp.TotalHits,
+		TotalPages: meiliResp.TotalPages,
+	}
+	for _, rawHit := range meiliResp.Hits {
+		hit, _ := rawHit.(map[string]interface{})
+		formatted, _ := hit["_formatted"].(map[string]interface{})
+		score, _ := hit["_rankingScore"].(float64)
+		response.Hits = append(response.Hits, SearchHit{
+			Document: Document{
+				ID:               documentString(hit, "id"),
+				Title:            documentString(hit, "title"),
+				Filename:         documentString(hit, "filename"),
+				Domain:           documentString(hit, "domain"),
+				Content:          documentString(hit, "content"),
+				ArchiveOwnership: documentOwnership(hit),
+			},
+			FormattedContent: documentString(formatted, "content"),
+			Score:            score,
+		})
+	}
+	return response, nil
+}
+
+func (e *meiliEngine) ListDocuments(ctx context.Context) ([]Document, error) {
+	index := e.client.Index(common.MEILIBlogsIndex)
+	documents := make([]Document, 0)
+
+	for offset := int64(0); ; {
+		var result meilisearch.DocumentsResult
+		err := index.GetDocumentsWithContext(ctx, &meilisearch.DocumentsQuery{
+			Limit:  meiliDocumentPageSize,
+			Offset: offset,
+			Fields: []string{"id", "domain", "filename", "ownerId", "teamId", "visibility"},
+		}, &result)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, document := range result.Results {
+			documents = append(documents, Document{
+				ID:               documentString(document, "id"),
+				Domain:           documentString(document, "domain"),
+				Filename:         documentString(document, "filename"),
+				ArchiveOwnership: documentOwnership(document),
+			})
+		}
+		if len(result.Results) < meiliDocumentPageSize {
+			break
+		}
+		offset += int64(len(result.Results))
+	}
+
+	return documents, nil
+}
+
+// meiliAccessFilter 把可见范围转换成 Meilisearch 过滤表达式，access 为空或不受限时不过滤。
+// 引入可见范围之前写入的文档没有 visibility 字段，按公开处理。
+func meiliAccessFilter(access *common.ArchiveAccess) interface{} {
+	if access == nil || access.All {
+		return nil
+	}
+	conditions := []string{
+		"visibility NOT EXISTS",
+		fmt.Sprintf("visibility = %q", common.ArchiveVisibilityPublic),
+		fmt.Sprintf("ownerId = %d", access.UserID),
+	}
+	if len(access.TeamIDs) > 0 {
+		teamIDs := make([]string, 0, len(access.TeamIDs))
+		for _, teamID := range access.TeamIDs {
+			teamIDs = append(teamIDs, strconv.FormatUint(uint64(teamID), 10))
+		}
+		conditions = append(conditions, fmt.Sprintf("(visibility = %q AND teamId IN [%s])", common.ArchiveVisibilityTeam, strings.Join(teamIDs, ", ")))
+	}
+	return strings.Join(conditions, " OR ")
+}
+
+// documentOwnership 读取 Meilisearch 返回的归属字段，缺失时为公开。
+func documentOwnership(document map[string]interface{}) common.ArchiveOwnership {
+	ownership := common.ArchiveOwnership{
+		OwnerID:    documentUint(document, "ownerId"),
+		TeamID:     documentUint(document, "teamId"),
+		Visibility: documentString(document, "visibility"),
+	}
+	if ownership.Visibility == "" {
+		ownership.Visibility = common.ArchiveVisibilityPublic
+	}
+	return ownership
+}
+
+func documentUint(document map[string]interface{}, key string) uint {
+	value, ok := document[key].(float64)
+	if !ok || value < 0 {
+		return 0
+	}
+	return uint(value)
+}
+
+func recreateBlogsIndex(ctx context.Context, client meilisearch.ServiceManager) error {
+	indexes, err := client.ListIndexesWithContext(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, index := range indexes.Results {
+		if index.UID != common.MEILIBlogsIndex {
+			continue
+		}
+		taskInfo, err := client.DeleteIndexWithContext(ctx, common.MEILIBlogsIndex)
+		if err != nil {
+			return err
+		}
+		if err := waitForServiceTask(ctx, client, taskInfo); err != nil {
+			return err
+		}
+		break
+	}
+
+	taskInfo, err := client.CreateIndexWithContext(ctx, &meilisearch.IndexConfig{
+		Uid:        common.MEILIBlogsIndex,
+		PrimaryKey: "id",
+	})
+	if err != nil {
+		return err
+	}
+	return waitForServiceTask(ctx, client, taskInfo)
+}
+
+func waitForServiceTask(ctx context.Context, client meilisearch.ServiceManager, taskInfo *meilisearch.TaskInfo) error {
+	task, err := client.WaitForTaskWithContext(ctx, taskInfo.TaskUID, time.Second)
+	if err != nil {
+		return err
+	}
+	if task.Status != meilisearch.TaskStatusSucceeded {
+		return fmt.Errorf("meilisearch task %d finished with status %s", taskInfo.TaskUID, task.Status)
+	}
+	return nil
+}
+
+func deleteArchiveDocuments(index meilisearch.DocumentManager, documentIDs []string) (*meilisearch.TaskInfo, error) {
+	if len(documentIDs) == 1 {
+		return index.DeleteDocument(documentIDs[0])
+	}
+	return index.DeleteDocuments(documentIDs)
+}
+
+// applyMeiliIndexSettings 先重置再写入，Meilisearch 的设置接口是合并语义，
+// 不重置的话从配置中删掉的同义词或停用词会一直残留在索引里。
+func applyMeiliIndexSettings(ctx context.Context, client meilisearch.ServiceManager, settings IndexSettings) error {
+	waitCtx, cancel := context.WithTimeout(ctx, indexSettingsTaskTimeout)
+	defer cancel()
+
+	index := client.Index(common.MEILIBlogsIndex)
+	taskInfo, err := index.ResetSettingsWithContext(waitCtx)
+	if err != nil {
+		return err
+	}
+	if err := waitForServiceTask(waitCtx, client, taskInfo); err != nil {
+		return err
+	}
+
+	taskInfo, err = index.UpdateSettingsWithContext(waitCtx, toMeiliSettings(settings))
+	if err != nil {
+		return err
+	}
+	return waitForServiceTask(waitCtx, client, taskInfo)
+}
+
+func toMeiliSettings(settings IndexSettings) *meilisearch.Settings {
+	return &meilisearch.Settings{
+		SearchableAttributes: settings.SearchableAttributes,
+		FilterableAttributes: meiliFilterableAttributes,
+		RankingRules:         settings.RankingRules,
+		Synonyms:             settings.Synonyms,
+		StopWords:            settings.StopWords,
+		TypoTolerance: &meilisearch.TypoTolerance{
+			Enabled: settings.TypoTolerance.Enabled,
+			MinWordSizeForTypos: meilisearch.MinWordSizeForTypos{
+				OneTypo:  settings.TypoTolerance.MinWordSizeOneTypo,
+				TwoTypos: settings.TypoTolerance.MinWordSizeTwoTypos,
+			},
+			DisableOnWords:      settings.TypoTolerance.DisableOnWords,
+			DisableOnAttributes: settings.TypoTolerance.DisableOnAttributes,
+		},
+	}
+}
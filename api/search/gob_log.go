@@ -0,0 +1,108 @@
+package search
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// gobLogHeaderSize 是每条日志记录前的长度和 CRC32 校验。
+const gobLogHeaderSize = 8
+
+// gobLog 是只追加的操作日志，每条记录单独用 gob 编码，前面带长度和校验。
+// 进程在追加记录时退出会留下不完整的最后一条，重放时截掉，之前的记录不受影响。
+type gobLog struct {
+	path string
+	file *os.File
+	size int64
+}
+
+func openGobLog(path string) (*gobLog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return &gobLog{path: path, file: file, size: info.Size()}, nil
+}
+
+// Append 追加一条记录并落盘。写入失败时截掉写了一半的记录，之后追加的记录仍然可以重放。
+func (l *gobLog) Append(value interface{}) error {
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(value); err != nil {
+		return err
+	}
+	record := make([]byte, gobLogHeaderSize, gobLogHeaderSize+payload.Len())
+	binary.LittleEndian.PutUint32(record[0:4], uint32(payload.Len()))
+	binary.LittleEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload.Bytes()))
+	record = append(record, payload.Bytes()...)
+
+	_, err := l.file.WriteAt(record, l.size)
+	if err == nil {
+		err = l.file.Sync()
+	}
+	if err != nil {
+		_ = l.file.Truncate(l.size)
+		return err
+	}
+	l.size += int64(len(record))
+	return nil
+}
+
+// Replay 按写入顺序把每条记录交给 apply 解码，apply 返回错误时停止。
+func (l *gobLog) Replay(apply func(decoder *gob.Decoder) error) error {
+	reader := io.NewSectionReader(l.file, 0, l.size)
+	var offset int64
+	header := make([]byte, gobLogHeaderSize)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if err != io.EOF {
+				l.truncateTorn(offset)
+			}
+			return nil
+		}
+		payload := make([]byte, binary.LittleEndian.Uint32(header[0:4]))
+		if _, err := io.ReadFull(reader, payload); err != nil || crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[4:8]) {
+			l.truncateTorn(offset)
+			return nil
+		}
+		if err := apply(gob.NewDecoder(bytes.NewReader(payload))); err != nil {
+			return fmt.Errorf("replay %s: %w", l.path, err)
+		}
+		offset += int64(len(header) + len(payload))
+	}
+}
+
+func (l *gobLog) truncateTorn(offset int64) {
+	log.Printf("log %s ends with an incomplete record, truncating it at %d bytes", l.path, offset)
+	if err := l.file.Truncate(offset); err != nil {
+		log.Printf("failed to truncate %s: %v", l.path, err)
+	}
+	l.size = offset
+}
+
+// Reset 在写入新快照后清空日志。
+func (l *gobLog) Reset() error {
+	if err := l.file.Truncate(0); err != nil {
+		return err
+	}
+	l.size = 0
+	return nil
+}
+
+func (l *gobLog) Size() int64 {
+	return l.size
+}
@@ -0,0 +1,191 @@
+package search
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// hybridCandidateLimit 是混合搜索时关键词和向量两路各自取回的候选数量，合并打分后再分页。
+const hybridCandidateLimit = 200
+
+// hybridEngine 在任意关键词引擎外面加一层向量索引：
+// 写入文档时同步生成向量，查询时按 SemanticRatio 混合关键词得分和语义相似度。
+type hybridEngine struct {
+	Engine
+	embedder Embedder
+	vectors  *vectorStore
+	// failedEmbeddings 累计向量化失败的文档数，重建索引时据此报告缺少向量的文档。
+	failedEmbeddings atomic.Int64
+}
+
+// embeddingFailureCounter 由带向量索引的引擎实现。
+type embeddingFailureCounter interface {
+	FailedEmbeddings() int64
+}
+
+// failedEmbeddings 返回 engine 累计向量化失败的文档数，没有向量索引的引擎返回 0。
+func failedEmbeddings(engine Engine) int64 {
+	if counter, ok := engine.(embeddingFailureCounter); ok {
+		return counter.FailedEmbeddings()
+	}
+	return 0
+}
+
+type hybridCandidate struct {
+	hit          SearchHit
+	keywordScore float64
+	keywordRank  int
+	semantic     float64
+}
+
+func (e *hybridEngine) ResetIndex(ctx context.Context) error {
+	if err := e.Engine.ResetIndex(ctx); err != nil {
+		return err
+	}
+	return e.vectors.Reset()
+}
+
+// AddDocuments 先写关键词索引再生成向量。
+// 向量化服务不可用时只记录日志：关键词索引已经写入，归档流程不应因为辅助的语义索引失败而中断，
+// 缺失的向量可以通过重建索引补齐。同一 ID 原有的向量记录随之删除，其中的归属已经过时，
+// 留下会让语义搜索和相关推荐按旧的可见范围返回文档。
+func (e *hybridEngine) AddDocuments(ctx context.Context, documents []Document) error {
+	if err := e.Engine.AddDocuments(ctx, documents); err != nil {
+		return err
+	}
+	if len(documents) == 0 {
+		return nil
+	}
+
+	texts := make([]string, 0, len(documents))
+	for _, document := range documents {
+		texts = append(texts, embeddingText(document))
+	}
+	vectors, err := e.embedder.Embed(ctx, texts)
+	if err != nil {
+		log.Printf("failed to embed %d documents, semantic search will miss them until the index is rebuilt: %v", len(documents), err)
+		e.failedEmbeddings.Add(int64(len(documents)))
+		documentIDs := make([]string, 0, len(documents))
+		for _, document := range documents {
+			documentIDs = append(documentIDs, document.ID)
+		}
+		return e.vectors.Delete(documentIDs)
+	}
+	return e.vectors.Upsert(documents, vectors)
+}
+
+func (e *hybridEngine) FailedEmbeddings() int64 {
+	return e.failedEmbeddings.Load()
+}
+
+func (e *hybridEngine) DeleteDocuments(ctx context.Context, documentIDs []string) error {
+	if err := e.Engine.DeleteDocuments(ctx, documentIDs); err != nil {
+		return err
+	}
+	return e.vectors.Delete(documentIDs)
+}
+
+func (e *hybridEngine) Search(ctx context.Context, request SearchRequest) (*SearchResponse, error) {
+	ratio := request.SemanticRatio
+	if ratio <= 0 || strings.TrimSpace(request.Query) == "" {
+		return e.Engine.Search(ctx, request)
+	}
+	if ratio > 1 {
+		ratio = 1
+	}
+
+	keywordRequest := request
+	keywordRequest.Page = 1
+	keywordRequest.HitsPerPage = hybridCandidateLimit
+	keywordResponse, err := e.Engine.Search(ctx, keywordRequest)
+	if err != nil {
+		return nil, err
+	}
+	queryVectors, err := e.embedder.Embed(ctx, []string{request.Query})
+	if err != nil {
+		return nil, err
+	}
+	queryVector := queryVectors[0]
+
+	candidates := make(map[string]*hybridCandidate)
+	for rank, hit := range keywordResponse.Hits {
+		candidate := &hybridCandidate{hit: hit, keywordScore: hit.Score, keywordRank: rank}
+		if record, ok := e.vectors.Get(hit.ID); ok {
+			candidate.semantic = cosineSimilarity(queryVector, record.Vector)
+		}
+		candidates[hit.ID] = candidate
+	}
+	hidden := func(record vectorRecord) bool {
+		return !request.canView(record.Document)
+	}
+	for _, record := range e.vectors.Nearest(queryVector, hybridCandidateLimit, hidden) {
+		if _, ok := candidates[record.Document.ID]; ok {
+			continue
+		}
+		candidates[record.Document.ID] = &hybridCandidate{
+			hit: SearchHit{
+				Document:         record.Document,
+				FormattedContent: formatEmbeddedContent(record.Document.Content, queryTerms(request.Query), request),
+			},
+			keywordRank: len(keywordResponse.Hits),
+			semantic:    record.Similarity,
+		}
+	}
+
+	ranked := make([]hybridCandidate, 0, len(candidates))
+	for _, candidate := range candidates {
+		semantic := candidate.semantic
+		if semantic < 0 {
+			semantic = 0
+		}
+		candidate.hit.Score = (1-ratio)*candidate.keywordScore + ratio*semantic
+		if candidate.hit.Score <= 0 {
+			continue
+		}
+		ranked = append(ranked, *candidate)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].hit.Score != ranked[j].hit.Score {
+			return ranked[i].hit.Score > ranked[j].hit.Score
+		}
+		if ranked[i].keywordRank != ranked[j].keywordRank {
+			return ranked[i].keywordRank < ranked[j].keywordRank
+		}
+		return ranked[i].hit.ID < ranked[j].hit.ID
+	})
+
+	return paginateHybridCandidates(ranked, request), nil
+}
+
+func paginateHybridCandidates(ranked []hybridCandidate, request SearchRequest) *SearchResponse {
+	page := request.Page
+	if page < 1 {
+		page = 1
+	}
+	hitsPerPage := request.HitsPerPage
+	if hitsPerPage <= 0 {
+		hitsPerPage = embeddedDefaultHitsPerPage
+	}
+
+	totalHits := int64(len(ranked))
+	response := &SearchResponse{
+		Hits:       make([]SearchHit, 0),
+		TotalHits:  totalHits,
+		TotalPages: (totalHits + hitsPerPage - 1) / hitsPerPage,
+	}
+	start := (page - 1) * hitsPerPage
+	if start >= totalHits {
+		return response
+	}
+	end := start + hitsPerPage
+	if end > totalHits {
+		end = totalHits
+	}
+	for _, candidate := range ranked[start:end] {
+		response.Hits = append(response.Hits, candidate.hit)
+	}
+	return response
+}
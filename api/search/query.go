@@ -2,11 +2,10 @@ package search
 
 import (
 	"DataArk/common"
+	"context"
 	"encoding/json"
 	"log"
 	"strings"
-
-	"github.com/meilisearch/meilisearch-go"
 )
 
 type Result struct {
@@ -17,58 +16,70 @@ type Result struct {
 	Domain   string `json:"domain"`
 }
 
-func QueryByKeyword(keyword string, pageNum int64) (string, map[string]int) {
+// QueryByKeyword 按关键词搜索 access 可见的归档。
+func QueryByKeyword(keyword string, pageNum int64, access common.ArchiveAccess) (string, map[string]int) {
+	resultJsonString, pageAndHits, err := queryArchive(keyword, pageNum, 0, access)
+	if err != nil {
+		log.Println("Error Occur: " + err.Error())
+		return "Error", nil
+	}
+	return resultJsonString, pageAndHits
+}
+
+// QueryHybrid 按 semanticRatio 混合关键词和语义相似度搜索，返回格式与 QueryByKeyword 相同。
+// 未配置向量化模型时返回 ErrSemanticSearchDisabled。
+func QueryHybrid(keyword string, pageNum int64, semanticRatio float64, access common.ArchiveAccess) (string, map[string]int, error) {
+	embedder, err := currentEmbedder()
+	if err != nil {
+		return "", nil, err
+	}
+	if embedder == nil {
+		return "", nil, ErrSemanticSearchDisabled
+	}
+	return queryArchive(keyword, pageNum, semanticRatio, access)
+}
+
+func queryArchive(keyword string, pageNum int64, semanticRatio float64, access common.ArchiveAccess) (string, map[string]int, error) {
 	pageAndHits := make(map[string]int)
 	QueryResults := make([]Result, 10)
 	preTag := "<span style=\"color: red;\">"
 	postTag := "</span>"
 
-	client := meilisearch.New(common.MEILIHOST, meilisearch.WithAPIKey(common.MEILIAPIKey))
-
-	meiliReqOpt := &meilisearch.SearchRequest{
-		Page:                  pageNum,
-		HitsPerPage:           10,
-		AttributesToHighlight: []string{"content"},
-		ShowMatchesPosition:   true,
-		HighlightPreTag:       preTag,
-		HighlightPostTag:      postTag,
-		AttributesToCrop:      []string{"content"},
-		CropLength:            150,
+	engine, err := CurrentEngine()
+	if err != nil {
+		return "", nil, err
 	}
 
-	meiliResp, err := client.Index("blogs").Search(keyword, meiliReqOpt)
-
-	TotalHits := meiliResp.TotalHits
-	TotalPages := meiliResp.TotalPages
-	pageAndHits["TotalHits"] = int(TotalHits)
-	pageAndHits["TotalPages"] = int(TotalPages)
-
-	hits := meiliResp.Hits
-
-	for hitIndex, hit := range hits {
-		var result Result
-		singleContent, _ := hit.(map[string]interface{})
-
-		// 获取高亮内容
-		formattedContent, _ := singleContent["_formatted"].(map[string]interface{})
-		formattedContentStr, _ := formattedContent["content"].(string)
+	searchResp, err := engine.Search(context.Background(), SearchRequest{
+		Query:            keyword,
+		Page:             pageNum,
+		HitsPerPage:      10,
+		HighlightPreTag:  preTag,
+		HighlightPostTag: postTag,
+		CropLength:       150,
+		SemanticRatio:    semanticRatio,
+		Access:           &access,
+	})
+	if err != nil {
+		return "", nil, err
+	}
 
-		result.Id = formattedContent["id"].(string)
-		result.Filename = singleContent["filename"].(string)
-		result.Domain = singleContent["domain"].(string)
-		result.Title = singleContent["title"].(string)
-		result.Content = formattedContentStr
+	pageAndHits["TotalHits"] = int(searchResp.TotalHits)
+	pageAndHits["TotalPages"] = int(searchResp.TotalPages)
 
-		QueryResults[hitIndex] = result
+	for hitIndex, hit := range searchResp.Hits {
+		if hitIndex >= len(QueryResults) {
+			break
+		}
+		QueryResults[hitIndex] = Result{
+			Id:       hit.ID,
+			Title:    hit.Title,
+			Filename: hit.Filename,
+			Content:  hit.FormattedContent,
+			Domain:   hit.Domain,
+		}
 	}
 	resultJson, _ := json.MarshalIndent(QueryResults, "", "    ")
-	// fmt.Println(string(resultJson))
 	resultJsonString := strings.ReplaceAll(string(resultJson), "\n", "")
-
-	if err == nil {
-		return resultJsonString, pageAndHits
-	} else {
-		log.Println("Error Occur: " + err.Error())
-		return "Error", nil
-	}
+	return resultJsonString, pageAndHits, nil
 }
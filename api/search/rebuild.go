@@ -5,19 +5,19 @@ import (
 	"context"
 	"fmt"
 	"github.com/google/uuid"
-	"github.com/meilisearch/meilisearch-go"
 	"io/fs"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
-	"time"
 )
 
 const rebuildBatchSize = 100
 
 type RebuildIndexResult struct {
 	Documents int `json:"documents"`
+	// FailedEmbeddings 是向量化失败、语义搜索暂时找不到的文档数，只有开启语义搜索时才可能不为 0。
+	FailedEmbeddings int `json:"failedEmbeddings,omitempty"`
 }
 
 func RebuildIndexFromArchive(ctx context.Context) (*RebuildIndexResult, error) {
@@ -30,13 +30,27 @@ func RebuildRecoverableIndexFromArchive(ctx context.Context) (*RebuildIndexResul
 }
 
 func rebuildIndexFromArchive(ctx context.Context, skipInvalidFiles bool) (*RebuildIndexResult, []ArchiveConsistencyIssue, error) {
-	client := meilisearch.New(common.MEILIHOST, meilisearch.WithAPIKey(common.MEILIAPIKey))
-	if err := recreateBlogsIndex(ctx, client); err != nil {
+	engine, err := CurrentEngine()
+	if err != nil {
+		return nil, nil, err
+	}
+	failedBefore := failedEmbeddings(engine)
+	if err := engine.ResetIndex(ctx); err != nil {
+		return nil, nil, err
+	}
+	// 删除重建会丢掉索引上的全部设置，需要在写入文档前重新下发，避免文档按默认规则索引两遍。
+	if err := applyStoredIndexSettings(ctx, engine); err != nil {
+		return nil, nil, err
+	}
+
+	// 索引里的归属字段以数据库记录为准，没有记录的旧归档按公开处理
+	ownerships, err := listArchiveOwnerships()
+	if err != nil {
 		return nil, nil, err
 	}
 
 	archiveRoot := filepath.Clean(common.ARCHIVEFILELOACTION)
-	documents := make([]map[string]interface{}, 0, rebuildBatchSize)
+	documents := make([]Document, 0, rebuildBatchSize)
 	indexedDocuments := 0
 	unrecoverableIssues := make([]ArchiveConsistencyIssue, 0)
 
@@ -45,17 +59,9 @@ func rebuildIndexFromArchive(ctx context.Context, skipInvalidFiles bool) (*Rebui
 			return nil
 		}
 
-		taskInfo, err := client.Index(common.MEILIBlogsIndex).AddDocumentsWithContext(ctx, documents)
-		if err != nil {
+		if err := engine.AddDocuments(ctx, documents); err != nil {
 			return err
 		}
-		task, err := client.WaitForTaskWithContext(ctx, taskInfo.TaskUID, time.Second)
-		if err != nil {
-			return err
-		}
-		if task.Status != meilisearch.TaskStatusSucceeded {
-			return fmt.Errorf("meilisearch add documents task %d finished with status %s", taskInfo.TaskUID, task.Status)
-		}
 
 		indexedDocuments += len(documents)
 		documents = documents[:0]
@@ -69,7 +75,7 @@ func rebuildIndexFromArchive(ctx context.Context, skipInvalidFiles bool) (*Rebui
 		return nil, nil, err
 	}
 
-	err := filepath.WalkDir(archiveRoot, func(currentPath string, entry fs.DirEntry, walkErr error) error {
+	err = filepath.WalkDir(archiveRoot, func(currentPath string, entry fs.DirEntry, walkErr error) error {
 		if walkErr != nil {
 			return walkErr
 		}
@@ -111,6 +117,10 @@ func rebuildIndexFromArchive(ctx context.Context, skipInvalidFiles bool) (*Rebui
 			})
 			return nil
 		}
+		document.ArchiveOwnership = common.PublicArchiveOwnership()
+		if ownership, ok := ownerships[common.ArchiveDocumentKey(pathParts[0], fileName)]; ok {
+			document.ArchiveOwnership = ownership
+		}
 		documents = append(documents, document)
 
 		if len(documents) >= rebuildBatchSize {
@@ -126,69 +136,117 @@ func rebuildIndexFromArchive(ctx context.Context, skipInvalidFiles bool) (*Rebui
 		return nil, nil, err
 	}
 
-	return &RebuildIndexResult{Documents: indexedDocuments}, unrecoverableIssues, nil
+	return &RebuildIndexResult{
+		Documents:        indexedDocuments,
+		FailedEmbeddings: int(failedEmbeddings(engine) - failedBefore),
+	}, unrecoverableIssues, nil
 }
 
-func recreateBlogsIndex(ctx context.Context, client meilisearch.ServiceManager) error {
-	indexes, err := client.ListIndexesWithContext(ctx, nil)
+// CheckArchiveHTML 按重建索引时的方式解析归档 HTML，备份校验用它确认恢复后能重建索引。
+func CheckArchiveHTML(htmlPath string, domain string, fileName string) error {
+	_, err := buildDocumentFromHTML(htmlPath, domain, fileName)
+	return err
+}
+
+// ArchiveFile 是已经放入归档目录、需要（重新）建立索引的 HTML。
+type ArchiveFile struct {
+	Path      string
+	Domain    string
+	Filename  string
+	Ownership common.ArchiveOwnership
+}
+
+// IndexArchiveFiles 只为给定的归档 HTML 写入归属并建立索引，同名文档原有的索引先删除，避免重复。
+// 部分恢复时使用，不重置整个索引。
+func IndexArchiveFiles(ctx context.Context, files []ArchiveFile) (int, error) {
+	if len(files) == 0 {
+		return 0, nil
+	}
+	documents := make([]Document, 0, len(files))
+	for _, file := range files {
+		document, err := buildDocumentFromHTML(file.Path, file.Domain, file.Filename)
+		if err != nil {
+			return 0, fmt.Errorf("%s/%s: %w", file.Domain, file.Filename, err)
+		}
+		document.ArchiveOwnership = file.Ownership
+		documents = append(documents, document)
+	}
+
+	engine, err := CurrentEngine()
 	if err != nil {
-		return err
+		return 0, err
+	}
+	if err := deleteArchiveFileDocuments(ctx, engine, files); err != nil {
+		return 0, err
 	}
 
-	for _, index := range indexes.Results {
-		if index.UID != common.MEILIBlogsIndex {
-			continue
-		}
-		taskInfo, err := client.DeleteIndexWithContext(ctx, common.MEILIBlogsIndex)
-		if err != nil {
-			return err
+	// 与新增归档相同，先写归属再写索引
+	for _, file := range files {
+		if err := saveArchiveDocument(file.Domain, file.Filename, file.Ownership); err != nil {
+			return 0, err
 		}
-		if err := waitForServiceTask(ctx, client, taskInfo); err != nil {
-			return err
+	}
+	for start := 0; start < len(documents); start += rebuildBatchSize {
+		end := min(start+rebuildBatchSize, len(documents))
+		if err := engine.AddDocuments(ctx, documents[start:end]); err != nil {
+			return 0, err
 		}
-		break
 	}
+	return len(documents), nil
+}
 
-	taskInfo, err := client.CreateIndexWithContext(ctx, &meilisearch.IndexConfig{
-		Uid:        common.MEILIBlogsIndex,
-		PrimaryKey: "id",
-	})
+// RemoveArchiveFileDocuments 删除给定归档文件的索引文档，不改动归属记录。部分恢复失败、撤销新增的文件时使用。
+func RemoveArchiveFileDocuments(ctx context.Context, files []ArchiveFile) error {
+	if len(files) == 0 {
+		return nil
+	}
+	engine, err := CurrentEngine()
 	if err != nil {
 		return err
 	}
-	return waitForServiceTask(ctx, client, taskInfo)
+	return deleteArchiveFileDocuments(ctx, engine, files)
 }
 
-func waitForServiceTask(ctx context.Context, client meilisearch.ServiceManager, taskInfo *meilisearch.TaskInfo) error {
-	task, err := client.WaitForTaskWithContext(ctx, taskInfo.TaskUID, time.Second)
+func deleteArchiveFileDocuments(ctx context.Context, engine Engine, files []ArchiveFile) error {
+	existing, err := engine.ListDocuments(ctx)
 	if err != nil {
 		return err
 	}
-	if task.Status != meilisearch.TaskStatusSucceeded {
-		return fmt.Errorf("meilisearch task %d finished with status %s", taskInfo.TaskUID, task.Status)
+	removed := make(map[string]bool, len(files))
+	for _, file := range files {
+		removed[common.ArchiveDocumentKey(file.Domain, file.Filename)] = true
+	}
+	staleIDs := make([]string, 0)
+	for _, document := range existing {
+		if document.ID != "" && removed[common.ArchiveDocumentKey(document.Domain, document.Filename)] {
+			staleIDs = append(staleIDs, document.ID)
+		}
+	}
+	if len(staleIDs) == 0 {
+		return nil
 	}
-	return nil
+	return engine.DeleteDocuments(ctx, staleIDs)
 }
 
-func buildDocumentFromHTML(htmlPath string, domain string, fileName string) (map[string]interface{}, error) {
+func buildDocumentFromHTML(htmlPath string, domain string, fileName string) (Document, error) {
 	htmlContent, err := common.GetHTMLFileContent(htmlPath)
 	if err != nil {
-		return nil, err
+		return Document{}, err
 	}
 	title, err := common.GetHTMLTitle(htmlContent)
 	if err != nil {
-		return nil, err
+		return Document{}, err
 	}
 	pureText, err := common.ExtractHTMLText(htmlContent)
 	if err != nil {
-		return nil, err
+		return Document{}, err
 	}
 
-	return map[string]interface{}{
-		"id":       uuid.New().String(),
-		"title":    title,
-		"filename": fileName,
-		"domain":   domain,
-		"content":  pureText,
+	return Document{
+		ID:       uuid.New().String(),
+		Title:    title,
+		Filename: fileName,
+		Domain:   domain,
+		Content:  pureText,
 	}, nil
 }
@@ -0,0 +1,246 @@
+package search
+
+import (
+	"DataArk/common"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"math"
+	"path"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	DefaultRelatedLimit = 10
+	MaxRelatedLimit     = 50
+	// relatedQueryTerms 是按词频挑出的代表性词项数量，拼成一条查询去搜索引擎里召回候选文档。
+	relatedQueryTerms = 8
+	// relatedCandidateLimit 是重新打分前召回的候选数量。
+	relatedCandidateLimit = 100
+	// relatedTitleWeight 让标题里的词项在词向量中占更高权重。
+	relatedTitleWeight = 2
+)
+
+const (
+	RelatedMethodEmbedding = "embedding"
+	RelatedMethodTerms     = "terms"
+)
+
+type RelatedDocument struct {
+	Path     string  `json:"path"`
+	Domain   string  `json:"domain"`
+	Filename string  `json:"filename"`
+	Title    string  `json:"title"`
+	Score    float64 `json:"score"`
+}
+
+type RelatedDocResult struct {
+	Path      string            `json:"path"`
+	Domain    string            `json:"domain"`
+	Filename  string            `json:"filename"`
+	Title     string            `json:"title"`
+	Method    string            `json:"method"`
+	Documents []RelatedDocument `json:"documents"`
+}
+
+// FindRelatedDocuments 返回与指定归档 HTML 内容最相近的其它归档文档。
+// 配置了向量化模型时按向量相似度查找，否则用词频向量召回并重新打分。
+// 文档本身以及标题和正文完全相同的重复归档不会出现在结果里，结果和源文档都限定在 access 可见的范围内。
+func FindRelatedDocuments(ctx context.Context, rawPath string, limit int, access common.ArchiveAccess) (*RelatedDocResult, error) {
+	archivePath, _, err := resolveAccessibleArchiveDocument(rawPath, access)
+	if err != nil {
+		return nil, err
+	}
+	if limit <= 0 {
+		limit = DefaultRelatedLimit
+	}
+	if limit > MaxRelatedLimit {
+		limit = MaxRelatedLimit
+	}
+
+	source, err := buildDocumentFromHTML(archivePath.AbsPath, archivePath.Domain, archivePath.Filename)
+	if err != nil {
+		return nil, err
+	}
+
+	engine, err := CurrentEngine()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &RelatedDocResult{
+		Path:     archivePath.RequestPath,
+		Domain:   archivePath.Domain,
+		Filename: archivePath.Filename,
+		Title:    source.Title,
+	}
+	if hybrid, ok := engine.(*hybridEngine); ok {
+		result.Method = RelatedMethodEmbedding
+		result.Documents, err = relatedByEmbedding(ctx, hybrid, source, limit, access)
+	} else {
+		result.Method = RelatedMethodTerms
+		result.Documents, err = relatedByTerms(ctx, engine, source, limit, access)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func relatedByEmbedding(ctx context.Context, engine *hybridEngine, source Document, limit int, access common.ArchiveAccess) ([]RelatedDocument, error) {
+	vectors, err := engine.embedder.Embed(ctx, []string{embeddingText(source)})
+	if err != nil {
+		return nil, err
+	}
+
+	collector := newRelatedCollector(source, limit)
+	hidden := func(record vectorRecord) bool {
+		return !access.CanView(record.Document.ArchiveOwnership)
+	}
+	for _, record := range engine.vectors.Nearest(vectors[0], relatedCandidateLimit, hidden) {
+		if collector.full() {
+			break
+		}
+		collector.add(record.Document, record.ContentHash, record.Similarity)
+	}
+	return collector.documents, nil
+}
+
+func relatedByTerms(ctx context.Context, engine Engine, source Document, limit int, access common.ArchiveAccess) ([]RelatedDocument, error) {
+	sourceTerms := documentTermFrequencies(source)
+	representativeTerms := topTerms(sourceTerms, relatedQueryTerms)
+	if len(representativeTerms) == 0 {
+		return []RelatedDocument{}, nil
+	}
+
+	response, err := engine.Search(ctx, SearchRequest{
+		Query:       strings.Join(representativeTerms, " "),
+		Page:        1,
+		HitsPerPage: relatedCandidateLimit,
+		Access:      &access,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	scored := make([]scoredVectorRecord, 0, len(response.Hits))
+	for _, hit := range response.Hits {
+		scored = append(scored, scoredVectorRecord{
+			vectorRecord: vectorRecord{Document: hit.Document},
+			Similarity:   termCosineSimilarity(sourceTerms, documentTermFrequencies(hit.Document)),
+		})
+	}
+	sort.SliceStable(scored, func(i, j int) bool {
+		return scored[i].Similarity > scored[j].Similarity
+	})
+
+	collector := newRelatedCollector(source, limit)
+	for _, record := range scored {
+		if collector.full() {
+			break
+		}
+		collector.add(record.Document, documentContentHash(record.Document), record.Similarity)
+	}
+	return collector.documents, nil
+}
+
+// relatedCollector 按相似度从高到低收集结果，跳过源文档、与源文档重复的归档以及彼此重复的归档。
+type relatedCollector struct {
+	source    Document
+	limit     int
+	seen      map[string]bool
+	documents []RelatedDocument
+}
+
+func newRelatedCollector(source Document, limit int) *relatedCollector {
+	return &relatedCollector{
+		source:    source,
+		limit:     limit,
+		seen:      map[string]bool{documentContentHash(source): true},
+		documents: make([]RelatedDocument, 0, limit),
+	}
+}
+
+func (c *relatedCollector) full() bool {
+	return len(c.documents) >= c.limit
+}
+
+// add 的 contentHash 是完整正文的摘要；更早写入的向量记录没有摘要，这时只按路径排除源文档。
+func (c *relatedCollector) add(document Document, contentHash string, score float64) {
+	if score <= 0 {
+		return
+	}
+	if document.Domain == c.source.Domain && document.Filename == c.source.Filename {
+		return
+	}
+	if contentHash != "" {
+		if c.seen[contentHash] {
+			return
+		}
+		c.seen[contentHash] = true
+	}
+	c.documents = append(c.documents, RelatedDocument{
+		Path:     "/" + path.Join("archive", document.Domain, document.Filename),
+		Domain:   document.Domain,
+		Filename: document.Filename,
+		Title:    document.Title,
+		Score:    score,
+	})
+}
+
+// documentContentHash 按标题和完整正文计算摘要，用于识别重复归档。
+func documentContentHash(document Document) string {
+	sum := sha256.Sum256([]byte(strings.TrimSpace(document.Title) + "\x00" + strings.TrimSpace(document.Content)))
+	return hex.EncodeToString(sum[:])
+}
+
+// documentTermFrequencies 统计文档的词频向量。
+// 单个字符的词项（CJK 单字、单个字母）区分度太低，不参与相似度计算。
+func documentTermFrequencies(document Document) map[string]float64 {
+	frequencies := make(map[string]float64)
+	for _, term := range indexTerms(document.Title) {
+		if utf8.RuneCountInString(term) > 1 {
+			frequencies[term] += relatedTitleWeight
+		}
+	}
+	for _, term := range indexTerms(document.Content) {
+		if utf8.RuneCountInString(term) > 1 {
+			frequencies[term]++
+		}
+	}
+	return frequencies
+}
+
+func topTerms(frequencies map[string]float64, limit int) []string {
+	terms := make([]string, 0, len(frequencies))
+	for term := range frequencies {
+		terms = append(terms, term)
+	}
+	sort.Slice(terms, func(i, j int) bool {
+		if frequencies[terms[i]] != frequencies[terms[j]] {
+			return frequencies[terms[i]] > frequencies[terms[j]]
+		}
+		return terms[i] < terms[j]
+	})
+	if len(terms) > limit {
+		terms = terms[:limit]
+	}
+	return terms
+}
+
+func termCosineSimilarity(left map[string]float64, right map[string]float64) float64 {
+	var dot, leftNorm, rightNorm float64
+	for term, weight := range left {
+		leftNorm += weight * weight
+		dot += weight * right[term]
+	}
+	for _, weight := range right {
+		rightNorm += weight * weight
+	}
+	if leftNorm == 0 || rightNorm == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(leftNorm) * math.Sqrt(rightNorm))
+}
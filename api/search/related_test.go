@@ -0,0 +1,117 @@
+package search
+
+import (
+	"DataArk/common"
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func setupRelatedTestArchive(t *testing.T, engine Engine) {
+	t.Helper()
+	root := t.TempDir()
+	oldRoot := common.ARCHIVEFILELOACTION
+	oldEngine := currentEngine
+	common.ARCHIVEFILELOACTION = root
+	currentEngine = func() (Engine, error) { return engine, nil }
+	withArchiveOwnerships(t, nil)
+	t.Cleanup(func() {
+		common.ARCHIVEFILELOACTION = oldRoot
+		currentEngine = oldEngine
+	})
+
+	pages := []struct {
+		domain, filename, title, body string
+	}{
+		{"a.com", "1.html", "集群部署指南", "使用容器编排系统部署集群，集群节点需要统一配置网络"},
+		{"mirror.com", "1.html", "集群部署指南", "使用容器编排系统部署集群，集群节点需要统一配置网络"},
+		{"b.com", "2.html", "集群网络配置", "集群节点的网络配置与部署步骤"},
+		{"c.com", "3.html", "红烧肉做法", "五花肉切块焯水后加糖炒色"},
+	}
+	documents := make([]Document, 0, len(pages))
+	for _, page := range pages {
+		writeArchiveHTML(t, root, page.domain, page.filename, page.title, page.body)
+		document, err := buildDocumentFromHTML(filepath.Join(root, page.domain, page.filename), page.domain, page.filename)
+		if err != nil {
+			t.Fatalf("buildDocumentFromHTML returned error: %v", err)
+		}
+		documents = append(documents, document)
+	}
+	addTestDocuments(t, engine, documents...)
+}
+
+func relatedPaths(result *RelatedDocResult) string {
+	paths := make([]string, 0, len(result.Documents))
+	for _, document := range result.Documents {
+		paths = append(paths, document.Path)
+	}
+	return strings.Join(paths, ",")
+}
+
+func TestFindRelatedDocumentsByTerms(t *testing.T) {
+	setupRelatedTestArchive(t, newTestEmbeddedEngine(t))
+
+	result, err := FindRelatedDocuments(context.Background(), "/archive/a.com/1.html", 0, common.ArchiveAccess{All: true})
+	if err != nil {
+		t.Fatalf("FindRelatedDocuments returned error: %v", err)
+	}
+	if result.Method != RelatedMethodTerms || result.Title != "集群部署指南" {
+		t.Fatalf("result = %#v", result)
+	}
+	// 源文档本身和 mirror.com 上的完全重复归档都应被排除，无关的菜谱不应出现
+	if got := relatedPaths(result); got != "/archive/b.com/2.html" {
+		t.Fatalf("related paths = %q", got)
+	}
+}
+
+func TestFindRelatedDocumentsByEmbedding(t *testing.T) {
+	setupRelatedTestArchive(t, newTestHybridEngine(t))
+
+	result, err := FindRelatedDocuments(context.Background(), "/archive/a.com/1.html", 5, common.ArchiveAccess{All: true})
+	if err != nil {
+		t.Fatalf("FindRelatedDocuments returned error: %v", err)
+	}
+	if result.Method != RelatedMethodEmbedding {
+		t.Fatalf("Method = %q", result.Method)
+	}
+	if got := relatedPaths(result); !strings.HasPrefix(got, "/archive/b.com/2.html") || strings.Contains(got, "a.com") || strings.Contains(got, "mirror.com") {
+		t.Fatalf("related paths = %q", got)
+	}
+}
+
+func TestFindRelatedDocumentsByEmbeddingComparesFullContent(t *testing.T) {
+	engine := newTestHybridEngine(t)
+	setupRelatedTestArchive(t, engine)
+
+	// 两篇文档开头超过向量记录保留的长度且完全相同，只有结尾不同，不应被当作重复
+	prefix := strings.Repeat("集群部署需要统一配置网络。", vectorExcerptRunes/10)
+	addTestDocuments(t, engine,
+		Document{ID: "x", Title: "集群部署笔记", Domain: "x.com", Filename: "long.html", Content: prefix + "第一版", ArchiveOwnership: common.PublicArchiveOwnership()},
+		Document{ID: "y", Title: "集群部署笔记", Domain: "y.com", Filename: "long.html", Content: prefix + "第二版", ArchiveOwnership: common.PublicArchiveOwnership()},
+	)
+
+	result, err := FindRelatedDocuments(context.Background(), "/archive/a.com/1.html", 10, common.ArchiveAccess{All: true})
+	if err != nil {
+		t.Fatalf("FindRelatedDocuments returned error: %v", err)
+	}
+	got := relatedPaths(result)
+	if !strings.Contains(got, "/archive/x.com/long.html") || !strings.Contains(got, "/archive/y.com/long.html") {
+		t.Fatalf("related paths = %q", got)
+	}
+	if strings.Contains(got, "mirror.com") {
+		t.Fatalf("related paths = %q, want mirror.com excluded as a duplicate", got)
+	}
+}
+
+func TestFindRelatedDocumentsRejectsMissingFile(t *testing.T) {
+	setupRelatedTestArchive(t, newTestEmbeddedEngine(t))
+
+	if _, err := FindRelatedDocuments(context.Background(), "/archive/a.com/missing.html", 0, common.ArchiveAccess{All: true}); !errors.Is(err, ErrArchiveFileNotFound) {
+		t.Fatalf("err = %v, want ErrArchiveFileNotFound", err)
+	}
+	if _, err := FindRelatedDocuments(context.Background(), "/archive/a.com/../x.html", 0, common.ArchiveAccess{All: true}); !errors.Is(err, ErrInvalidArchivePath) {
+		t.Fatalf("err = %v, want ErrInvalidArchivePath", err)
+	}
+}
@@ -0,0 +1,252 @@
+package search
+
+import (
+	"DataArk/common"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const indexSettingsTaskTimeout = 2 * time.Minute
+
+const (
+	IndexSettingsSourceDefault  = "default"
+	IndexSettingsSourceDatabase = "database"
+)
+
+var ErrInvalidIndexSettings = errors.New("invalid search index settings")
+
+var (
+	loadIndexSettingRow = common.GetSearchIndexSetting
+	saveIndexSettingRow = common.SaveSearchIndexSetting
+)
+
+// 搜索文档只有这几个字段，配置里出现其它字段名通常是拼写错误，直接拒绝比让 Meilisearch 静默忽略更容易排查。
+var indexDocumentAttributes = []string{"title", "content", "domain", "filename"}
+
+var builtinRankingRules = []string{"words", "typo", "proximity", "attribute", "sort", "exactness"}
+
+var customRankingRulePattern = regexp.MustCompile(`^[A-Za-z0-9_.]+:(asc|desc)$`)
+
+// IndexSettings 是 blogs 索引的可调配置，保存到数据库后在启动和每次重建索引后重新下发。
+type IndexSettings struct {
+	SearchableAttributes []string              `json:"searchableAttributes"`
+	RankingRules         []string              `json:"rankingRules"`
+	Synonyms             map[string][]string   `json:"synonyms"`
+	StopWords            []string              `json:"stopWords"`
+	TypoTolerance        TypoToleranceSettings `json:"typoTolerance"`
+}
+
+type TypoToleranceSettings struct {
+	Enabled             bool     `json:"enabled"`
+	MinWordSizeOneTypo  int64    `json:"minWordSizeOneTypo"`
+	MinWordSizeTwoTypos int64    `json:"minWordSizeTwoTypos"`
+	DisableOnWords      []string `json:"disableOnWords"`
+	DisableOnAttributes []string `json:"disableOnAttributes"`
+}
+
+// IndexSettingsRecord 是接口返回的配置快照，Version 为 0 表示尚未保存过、当前使用内置默认值。
+type IndexSettingsRecord struct {
+	IndexUID  string        `json:"indexUid"`
+	Version   int           `json:"version"`
+	Source    string        `json:"source"`
+	UpdatedBy string        `json:"updatedBy"`
+	UpdatedAt *time.Time    `json:"updatedAt"`
+	Settings  IndexSettings `json:"settings"`
+}
+
+// DefaultIndexSettings 返回与 Meilisearch 默认行为一致、但显式声明字段顺序的配置。
+// 标题排在正文之前，使标题命中在 attribute 规则下获得更高权重。
+func DefaultIndexSettings() IndexSettings {
+	return IndexSettings{
+		SearchableAttributes: []string{"title", "content", "domain", "filename"},
+		RankingRules:         append([]string(nil), builtinRankingRules...),
+		Synonyms:             map[string][]string{},
+		StopWords:            []string{},
+		TypoTolerance: TypoToleranceSettings{
+			Enabled:             true,
+			MinWordSizeOneTypo:  5,
+			MinWordSizeTwoTypos: 9,
+			DisableOnWords:      []string{},
+			DisableOnAttributes: []string{},
+		},
+	}
+}
+
+func GetIndexSettings() (*IndexSettingsRecord, error) {
+	row, err := loadIndexSettingRow(common.MEILIBlogsIndex)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return &IndexSettingsRecord{
+				IndexUID: common.MEILIBlogsIndex,
+				Source:   IndexSettingsSourceDefault,
+				Settings: DefaultIndexSettings(),
+			}, nil
+		}
+		return nil, err
+	}
+
+	var settings IndexSettings
+	if err := json.Unmarshal([]byte(row.Settings), &settings); err != nil {
+		return nil, fmt.Errorf("decode search index settings version %d: %w", row.Version, err)
+	}
+	updatedAt := row.UpdatedAt
+	return &IndexSettingsRecord{
+		IndexUID:  row.IndexUID,
+		Version:   row.Version,
+		Source:    IndexSettingsSourceDatabase,
+		UpdatedBy: row.UpdatedBy,
+		UpdatedAt: &updatedAt,
+		Settings:  normalizeIndexSettings(settings),
+	}, nil
+}
+
+// UpdateIndexSettings 校验并保存新配置，然后立即下发到当前搜索引擎。
+// 先落库再下发，是为了让下发失败时下次启动或重建索引仍能按最新配置重试。
+func UpdateIndexSettings(ctx context.Context, settings IndexSettings, expectedVersion int, updatedBy string) (*IndexSettingsRecord, error) {
+	settings = normalizeIndexSettings(settings)
+	if err := validateIndexSettings(settings); err != nil {
+		return nil, err
+	}
+
+	encoded, err := json.Marshal(settings)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := saveIndexSettingRow(common.MEILIBlogsIndex, string(encoded), expectedVersion, updatedBy); err != nil {
+		return nil, err
+	}
+
+	record, err := GetIndexSettings()
+	if err != nil {
+		return nil, err
+	}
+	engine, err := CurrentEngine()
+	if err != nil {
+		return record, err
+	}
+	if err := engine.ApplySettings(ctx, record.Settings); err != nil {
+		return record, fmt.Errorf("search index settings saved as version %d but failed to apply: %w", record.Version, err)
+	}
+	return record, nil
+}
+
+// ApplyIndexSettings 把当前生效的配置下发到 blogs 索引。
+func ApplyIndexSettings(ctx context.Context) error {
+	engine, err := CurrentEngine()
+	if err != nil {
+		return err
+	}
+	return applyStoredIndexSettings(ctx, engine)
+}
+
+func applyStoredIndexSettings(ctx context.Context, engine Engine) error {
+	record, err := GetIndexSettings()
+	if err != nil {
+		return err
+	}
+	return engine.ApplySettings(ctx, record.Settings)
+}
+
+func normalizeIndexSettings(settings IndexSettings) IndexSettings {
+	defaults := DefaultIndexSettings()
+
+	settings.SearchableAttributes = normalizeStringList(settings.SearchableAttributes, false)
+	if len(settings.SearchableAttributes) == 0 {
+		settings.SearchableAttributes = defaults.SearchableAttributes
+	}
+	settings.RankingRules = normalizeStringList(settings.RankingRules, false)
+	if len(settings.RankingRules) == 0 {
+		settings.RankingRules = defaults.RankingRules
+	}
+	settings.StopWords = normalizeStringList(settings.StopWords, true)
+
+	synonyms := make(map[string][]string, len(settings.Synonyms))
+	for word, alternatives := range settings.Synonyms {
+		word = strings.ToLower(strings.TrimSpace(word))
+		alternatives = normalizeStringList(alternatives, true)
+		if word == "" || len(alternatives) == 0 {
+			continue
+		}
+		synonyms[word] = alternatives
+	}
+	settings.Synonyms = synonyms
+
+	settings.TypoTolerance.DisableOnWords = normalizeStringList(settings.TypoTolerance.DisableOnWords, true)
+	settings.TypoTolerance.DisableOnAttributes = normalizeStringList(settings.TypoTolerance.DisableOnAttributes, false)
+	if settings.TypoTolerance.MinWordSizeOneTypo <= 0 {
+		settings.TypoTolerance.MinWordSizeOneTypo = defaults.TypoTolerance.MinWordSizeOneTypo
+	}
+	if settings.TypoTolerance.MinWordSizeTwoTypos <= 0 {
+		settings.TypoTolerance.MinWordSizeTwoTypos = defaults.TypoTolerance.MinWordSizeTwoTypos
+	}
+	return settings
+}
+
+func validateIndexSettings(settings IndexSettings) error {
+	for _, attribute := range settings.SearchableAttributes {
+		if !isIndexDocumentAttribute(attribute) {
+			return fmt.Errorf("%w: unknown searchable attribute %q", ErrInvalidIndexSettings, attribute)
+		}
+	}
+	for _, attribute := range settings.TypoTolerance.DisableOnAttributes {
+		if !isIndexDocumentAttribute(attribute) {
+			return fmt.Errorf("%w: unknown typo tolerance attribute %q", ErrInvalidIndexSettings, attribute)
+		}
+	}
+	for _, rule := range settings.RankingRules {
+		if !isBuiltinRankingRule(rule) && !customRankingRulePattern.MatchString(rule) {
+			return fmt.Errorf("%w: unsupported ranking rule %q", ErrInvalidIndexSettings, rule)
+		}
+	}
+	if settings.TypoTolerance.MinWordSizeTwoTypos < settings.TypoTolerance.MinWordSizeOneTypo {
+		return fmt.Errorf("%w: minWordSizeTwoTypos must not be smaller than minWordSizeOneTypo", ErrInvalidIndexSettings)
+	}
+	return nil
+}
+
+func isIndexDocumentAttribute(attribute string) bool {
+	for _, known := range indexDocumentAttributes {
+		if attribute == known {
+			return true
+		}
+	}
+	return false
+}
+
+func isBuiltinRankingRule(rule string) bool {
+	for _, builtin := range builtinRankingRules {
+		if rule == builtin {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeStringList 去除空白和重复项；lower 为 true 时统一转小写，
+// 停用词和同义词在 Meilisearch 中按小写匹配，提前归一化可避免看似重复的条目。
+func normalizeStringList(values []string, lower bool) []string {
+	normalized := make([]string, 0, len(values))
+	seen := make(map[string]bool, len(values))
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if lower {
+			value = strings.ToLower(value)
+		}
+		if value == "" || seen[value] {
+			continue
+		}
+		seen[value] = true
+		normalized = append(normalized, value)
+	}
+	if lower {
+		sort.Strings(normalized)
+	}
+	return normalized
+}
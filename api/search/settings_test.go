@@ -0,0 +1,180 @@
+package search
+
+import (
+	"DataArk/common"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/meilisearch/meilisearch-go"
+	"gorm.io/gorm"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestGetIndexSettingsFallsBackToDefaults(t *testing.T) {
+	withIndexSettingRows(t, nil)
+
+	record, err := GetIndexSettings()
+	if err != nil {
+		t.Fatalf("GetIndexSettings returned error: %v", err)
+	}
+	if record.Version != 0 || record.Source != IndexSettingsSourceDefault {
+		t.Fatalf("record = %#v, want default version 0", record)
+	}
+	if record.Settings.SearchableAttributes[0] != "title" || !record.Settings.TypoTolerance.Enabled {
+		t.Fatalf("unexpected default settings: %#v", record.Settings)
+	}
+}
+
+func TestGetIndexSettingsDecodesStoredRow(t *testing.T) {
+	withIndexSettingRows(t, &common.SearchIndexSetting{
+		IndexUID: "blogs",
+		Version:  3,
+		Settings: `{"searchableAttributes":["content"],"stopWords":["The"," a "],"synonyms":{"JS":["javascript"]}}`,
+	})
+
+	record, err := GetIndexSettings()
+	if err != nil {
+		t.Fatalf("GetIndexSettings returned error: %v", err)
+	}
+	if record.Version != 3 || record.Source != IndexSettingsSourceDatabase {
+		t.Fatalf("record = %#v", record)
+	}
+	settings := record.Settings
+	if len(settings.SearchableAttributes) != 1 || settings.SearchableAttributes[0] != "content" {
+		t.Fatalf("searchable attributes = %#v", settings.SearchableAttributes)
+	}
+	if len(settings.StopWords) != 2 || settings.StopWords[0] != "a" || settings.StopWords[1] != "the" {
+		t.Fatalf("stop words = %#v, want normalized", settings.StopWords)
+	}
+	if settings.Synonyms["js"][0] != "javascript" {
+		t.Fatalf("synonyms = %#v", settings.Synonyms)
+	}
+	if len(settings.RankingRules) != len(builtinRankingRules) {
+		t.Fatalf("missing ranking rules should fall back to defaults: %#v", settings.RankingRules)
+	}
+}
+
+func TestValidateIndexSettings(t *testing.T) {
+	valid := DefaultIndexSettings()
+	valid.RankingRules = append(valid.RankingRules, "createdAt:desc")
+	if err := validateIndexSettings(valid); err != nil {
+		t.Fatalf("valid settings returned error: %v", err)
+	}
+
+	cases := map[string]func(*IndexSettings){
+		"unknown attribute":      func(s *IndexSettings) { s.SearchableAttributes = []string{"body"} },
+		"unknown typo attribute": func(s *IndexSettings) { s.TypoTolerance.DisableOnAttributes = []string{"url"} },
+		"bad ranking rule":       func(s *IndexSettings) { s.RankingRules = []string{"popularity"} },
+		"typo sizes":             func(s *IndexSettings) { s.TypoTolerance.MinWordSizeTwoTypos = 2 },
+	}
+	for name, mutate := range cases {
+		t.Run(name, func(t *testing.T) {
+			settings := DefaultIndexSettings()
+			mutate(&settings)
+			if err := validateIndexSettings(settings); !errors.Is(err, ErrInvalidIndexSettings) {
+				t.Fatalf("err = %v, want ErrInvalidIndexSettings", err)
+			}
+		})
+	}
+}
+
+func TestUpdateIndexSettingsSavesAndApplies(t *testing.T) {
+	var applied meilisearch.Settings
+	var requests []string
+	server := newSettingsMeiliServer(t, &requests, &applied)
+	defer server.Close()
+
+	oldHost := common.MEILIHOST
+	t.Cleanup(func() {
+		common.MEILIHOST = oldHost
+	})
+	common.MEILIHOST = server.URL
+
+	stored := withIndexSettingRows(t, nil)
+	saveIndexSettingRow = func(indexUID string, settings string, expectedVersion int, updatedBy string) (*common.SearchIndexSetting, error) {
+		if expectedVersion != 0 || updatedBy != "admin" {
+			t.Fatalf("unexpected save input version=%d by=%q", expectedVersion, updatedBy)
+		}
+		*stored = &common.SearchIndexSetting{IndexUID: indexUID, Version: 1, Settings: settings, UpdatedBy: updatedBy, UpdatedAt: time.Now()}
+		return *stored, nil
+	}
+
+	settings := DefaultIndexSettings()
+	settings.StopWords = []string{"the"}
+	settings.Synonyms = map[string][]string{"k8s": {"kubernetes"}}
+	record, err := UpdateIndexSettings(context.Background(), settings, 0, "admin")
+	if err != nil {
+		t.Fatalf("UpdateIndexSettings returned error: %v", err)
+	}
+	if record.Version != 1 || record.UpdatedBy != "admin" {
+		t.Fatalf("record = %#v", record)
+	}
+	if len(requests) != 2 || requests[0] != "DELETE" || requests[1] != "PATCH" {
+		t.Fatalf("requests = %#v, want reset then update", requests)
+	}
+	if len(applied.StopWords) != 1 || applied.Synonyms["k8s"][0] != "kubernetes" {
+		t.Fatalf("applied settings = %#v", applied)
+	}
+
+	settings.SearchableAttributes = []string{"unknown"}
+	if _, err := UpdateIndexSettings(context.Background(), settings, 1, "admin"); !errors.Is(err, ErrInvalidIndexSettings) {
+		t.Fatalf("invalid update err = %v", err)
+	}
+}
+
+func TestUpdateIndexSettingsReturnsVersionConflict(t *testing.T) {
+	withIndexSettingRows(t, nil)
+	saveIndexSettingRow = func(string, string, int, string) (*common.SearchIndexSetting, error) {
+		return nil, common.ErrSearchIndexSettingVersionConflict
+	}
+
+	_, err := UpdateIndexSettings(context.Background(), DefaultIndexSettings(), 4, "admin")
+	if !errors.Is(err, common.ErrSearchIndexSettingVersionConflict) {
+		t.Fatalf("err = %v, want version conflict", err)
+	}
+}
+
+func withIndexSettingRows(t *testing.T, row *common.SearchIndexSetting) **common.SearchIndexSetting {
+	t.Helper()
+	oldLoad := loadIndexSettingRow
+	oldSave := saveIndexSettingRow
+	t.Cleanup(func() {
+		loadIndexSettingRow = oldLoad
+		saveIndexSettingRow = oldSave
+	})
+
+	stored := &row
+	loadIndexSettingRow = func(string) (*common.SearchIndexSetting, error) {
+		if *stored == nil {
+			return nil, gorm.ErrRecordNotFound
+		}
+		return *stored, nil
+	}
+	return stored
+}
+
+func newSettingsMeiliServer(t *testing.T, requests *[]string, applied *meilisearch.Settings) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodDelete && r.URL.Path == "/indexes/blogs/settings":
+			*requests = append(*requests, r.Method)
+			w.WriteHeader(http.StatusAccepted)
+			_ = json.NewEncoder(w).Encode(meilisearch.TaskInfo{TaskUID: 1})
+		case r.Method == http.MethodPatch && r.URL.Path == "/indexes/blogs/settings":
+			*requests = append(*requests, r.Method)
+			if err := json.NewDecoder(r.Body).Decode(applied); err != nil {
+				t.Fatalf("failed to decode settings payload: %v", err)
+			}
+			w.WriteHeader(http.StatusAccepted)
+			_ = json.NewEncoder(w).Encode(meilisearch.TaskInfo{TaskUID: 2})
+		case r.Method == http.MethodGet && (r.URL.Path == "/tasks/1" || r.URL.Path == "/tasks/2"):
+			_ = json.NewEncoder(w).Encode(meilisearch.Task{Status: meilisearch.TaskStatusSucceeded})
+		default:
+			t.Fatalf("unexpected meili request %s %s", r.Method, r.URL.Path)
+		}
+	}))
+}
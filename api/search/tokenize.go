@@ -0,0 +1,128 @@
+package search
+
+import (
+	"unicode"
+)
+
+// textRun 是分词时的一段连续文本，CJK 为 true 时表示中日韩字符组成的片段。
+type textRun struct {
+	Text string
+	CJK  bool
+}
+
+// splitTextRuns 把文本切成小写的字母数字片段和 CJK 片段，其余字符一律视为分隔符。
+// 归档正文在 ExtractHTMLText 中已经去掉了空格，英文单词会粘连成一个片段，
+// 这与 Meilisearch 对同一份文档的切分结果一致，两种引擎的检索行为因此保持接近。
+func splitTextRuns(text string) []textRun {
+	runs := make([]textRun, 0)
+	current := make([]rune, 0, 16)
+	currentCJK := false
+
+	flush := func() {
+		if len(current) > 0 {
+			runs = append(runs, textRun{Text: string(current), CJK: currentCJK})
+			current = current[:0]
+		}
+	}
+
+	for _, r := range text {
+		switch {
+		case isCJKRune(r):
+			if !currentCJK {
+				flush()
+			}
+			currentCJK = true
+			current = append(current, r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if currentCJK {
+				flush()
+			}
+			currentCJK = false
+			current = append(current, unicode.ToLower(r))
+		default:
+			flush()
+		}
+	}
+	flush()
+	return runs
+}
+
+// indexTerms 返回写入倒排索引的词项。CJK 片段没有分词器可用，
+// 同时写入单字和相邻双字，单字保证一个字的查询能命中，双字保证多字查询不会匹配到零散的字。
+func indexTerms(text string) []string {
+	terms := make([]string, 0)
+	for _, run := range splitTextRuns(text) {
+		if !run.CJK {
+			terms = append(terms, run.Text)
+			continue
+		}
+		runes := []rune(run.Text)
+		for i := range runes {
+			terms = append(terms, string(runes[i]))
+			if i+1 < len(runes) {
+				terms = append(terms, string(runes[i:i+2]))
+			}
+		}
+	}
+	return terms
+}
+
+// queryTerms 按与 indexTerms 对应的规则切分查询，多字 CJK 片段只使用双字。
+func queryTerms(text string) []string {
+	terms := make([]string, 0)
+	for _, run := range splitTextRuns(text) {
+		runes := []rune(run.Text)
+		if !run.CJK || len(runes) == 1 {
+			terms = append(terms, run.Text)
+			continue
+		}
+		for i := 0; i+1 < len(runes); i++ {
+			terms = append(terms, string(runes[i:i+2]))
+		}
+	}
+	return terms
+}
+
+func isCJKRune(r rune) bool {
+	return unicode.Is(unicode.Han, r) ||
+		unicode.Is(unicode.Hiragana, r) ||
+		unicode.Is(unicode.Katakana, r) ||
+		unicode.Is(unicode.Hangul, r)
+}
+
+// boundedEditDistance 计算两个词的编辑距离，超过 limit 时提前返回 limit+1。
+func boundedEditDistance(left string, right string, limit int) int {
+	a := []rune(left)
+	b := []rune(right)
+	if diff := len(a) - len(b); diff > limit || -diff > limit {
+		return limit + 1
+	}
+
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		rowMin := current[0]
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+			if current[j] < rowMin {
+				rowMin = current[j]
+			}
+		}
+		if rowMin > limit {
+			return limit + 1
+		}
+		previous, current = current, previous
+	}
+	if previous[len(b)] > limit {
+		return limit + 1
+	}
+	return previous[len(b)]
+}
@@ -0,0 +1,268 @@
+package search
+
+import (
+	"DataArk/common"
+	"encoding/gob"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const vectorStoreFormatVersion = 1
+
+// vectorExcerptRunes 是向量记录里保留的正文长度，只用于语义命中时生成结果摘要。
+const vectorExcerptRunes = 400
+
+// vectorMinCompactBytes 以下的日志不合并进快照，避免小索引频繁重写快照。
+const vectorMinCompactBytes = 1 << 20
+
+var (
+	vectorStoresMu sync.Mutex
+	vectorStores   = make(map[string]*vectorStore)
+)
+
+// vectorRecord 的 ContentHash 是截断前完整正文的摘要，查找相关文档时用它识别重复归档。
+type vectorRecord struct {
+	Document    Document
+	Vector      []float32
+	ContentHash string
+}
+
+// vectorSnapshot 是向量索引的基础快照，之后的写操作追加到 .log 日志中，日志超过快照大小时合并进新快照。
+// Generation 在每次写入快照时递增，日志中其它代的记录在重放时跳过。
+type vectorSnapshot struct {
+	FormatVersion int
+	Generation    uint64
+	EmbedderID    string
+	Records       map[string]vectorRecord
+}
+
+// vectorLogEntry 是一次写入或删除。
+type vectorLogEntry struct {
+	Generation uint64
+	Upserted   []vectorRecord
+	Deleted    []string
+}
+
+type scoredVectorRecord struct {
+	vectorRecord
+	Similarity float64
+}
+
+// vectorStore 是保存在索引目录下的本地向量索引，按余弦相似度暴力检索。
+// 个人归档的文档量在几万以内，暴力检索的耗时可以接受，换来的是不依赖任何向量数据库。
+type vectorStore struct {
+	mu           sync.RWMutex
+	path         string
+	snapshot     vectorSnapshot
+	snapshotSize int64
+	log          *gobLog
+}
+
+func newVectorSnapshot(embedderID string) vectorSnapshot {
+	return vectorSnapshot{
+		FormatVersion: vectorStoreFormatVersion,
+		EmbedderID:    embedderID,
+		Records:       make(map[string]vectorRecord),
+	}
+}
+
+// openVectorStore 按索引目录复用同一个实例。
+// 已保存的向量来自其它向量化模型时直接丢弃，不同模型的向量不可比较，需要重建索引重新生成。
+func openVectorStore(indexDir string, embedderID string) (*vectorStore, error) {
+	indexDir = strings.TrimSpace(indexDir)
+	if indexDir == "" {
+		return nil, fmt.Errorf("search index directory is empty")
+	}
+	storePath, err := filepath.Abs(filepath.Join(indexDir, common.MEILIBlogsIndex+".vectors"))
+	if err != nil {
+		return nil, err
+	}
+
+	vectorStoresMu.Lock()
+	defer vectorStoresMu.Unlock()
+	store, ok := vectorStores[storePath]
+	if !ok {
+		store, err = loadVectorStore(storePath, embedderID)
+		if err != nil {
+			return nil, err
+		}
+		vectorStores[storePath] = store
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.snapshot.EmbedderID != embedderID {
+		if len(store.snapshot.Records) > 0 {
+			log.Printf("embedder changed from %q to %q, discarding %d stored vectors; rebuild the search index to regenerate them",
+				store.snapshot.EmbedderID, embedderID, len(store.snapshot.Records))
+		}
+		if err := store.resetLocked(embedderID); err != nil {
+			return nil, err
+		}
+	}
+	return store, nil
+}
+
+func loadVectorStore(storePath string, embedderID string) (*vectorStore, error) {
+	store := &vectorStore{path: storePath, snapshot: newVectorSnapshot(embedderID)}
+
+	file, err := os.Open(storePath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		defer file.Close()
+		var snapshot vectorSnapshot
+		if err := gob.NewDecoder(file).Decode(&snapshot); err != nil {
+			return nil, fmt.Errorf("decode vector store %s: %w", storePath, err)
+		}
+		if snapshot.FormatVersion != vectorStoreFormatVersion {
+			return nil, fmt.Errorf("vector store %s has unsupported format version %d", storePath, snapshot.FormatVersion)
+		}
+		if snapshot.Records == nil {
+			snapshot.Records = make(map[string]vectorRecord)
+		}
+		if info, err := file.Stat(); err == nil {
+			store.snapshotSize = info.Size()
+		}
+		store.snapshot = snapshot
+	}
+
+	store.log, err = openGobLog(storePath + ".log")
+	if err != nil {
+		return nil, err
+	}
+	err = store.log.Replay(func(decoder *gob.Decoder) error {
+		var entry vectorLogEntry
+		if err := decoder.Decode(&entry); err != nil {
+			return err
+		}
+		if entry.Generation == store.snapshot.Generation {
+			store.applyLocked(entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Upsert 只把本次写入的向量追加到日志，不重写整个向量索引。
+func (s *vectorStore) Upsert(documents []Document, vectors [][]float32) error {
+	if len(documents) != len(vectors) {
+		return fmt.Errorf("got %d vectors for %d documents", len(vectors), len(documents))
+	}
+
+	entry := vectorLogEntry{Upserted: make([]vectorRecord, 0, len(documents))}
+	for i, document := range documents {
+		contentHash := documentContentHash(document)
+		document.Content = truncateRunes(document.Content, vectorExcerptRunes)
+		entry.Upserted = append(entry.Upserted, vectorRecord{Document: document, Vector: vectors[i], ContentHash: contentHash})
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writeLocked(entry)
+}
+
+func (s *vectorStore) Delete(documentIDs []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	deleted := make([]string, 0, len(documentIDs))
+	for _, documentID := range documentIDs {
+		if _, ok := s.snapshot.Records[documentID]; ok {
+			deleted = append(deleted, documentID)
+		}
+	}
+	if len(deleted) == 0 {
+		return nil
+	}
+	return s.writeLocked(vectorLogEntry{Deleted: deleted})
+}
+
+func (s *vectorStore) Reset() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.resetLocked(s.snapshot.EmbedderID)
+}
+
+// writeLocked 先追加日志再修改内存，日志超过快照大小时写入新快照并清空日志。
+func (s *vectorStore) writeLocked(entry vectorLogEntry) error {
+	entry.Generation = s.snapshot.Generation
+	if err := s.log.Append(&entry); err != nil {
+		return err
+	}
+	s.applyLocked(entry)
+	if s.log.Size() < vectorMinCompactBytes || s.log.Size() < s.snapshotSize {
+		return nil
+	}
+	return s.compactLocked(s.snapshot)
+}
+
+func (s *vectorStore) applyLocked(entry vectorLogEntry) {
+	for _, record := range entry.Upserted {
+		s.snapshot.Records[record.Document.ID] = record
+	}
+	for _, documentID := range entry.Deleted {
+		delete(s.snapshot.Records, documentID)
+	}
+}
+
+func (s *vectorStore) resetLocked(embedderID string) error {
+	return s.compactLocked(newVectorSnapshot(embedderID))
+}
+
+// compactLocked 把 snapshot 作为新一代快照写入磁盘并清空日志。日志中的记录都属于上一代，清空失败时重放也会跳过。
+func (s *vectorStore) compactLocked(snapshot vectorSnapshot) error {
+	snapshot.Generation = s.snapshot.Generation + 1
+	if err := writeGobFile(s.path, &snapshot); err != nil {
+		return err
+	}
+	s.snapshot = snapshot
+	if info, err := os.Stat(s.path); err == nil {
+		s.snapshotSize = info.Size()
+	}
+	if err := s.log.Reset(); err != nil {
+		log.Printf("failed to truncate vector store log: %v", err)
+	}
+	return nil
+}
+
+func (s *vectorStore) Get(documentID string) (vectorRecord, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	record, ok := s.snapshot.Records[documentID]
+	return record, ok
+}
+
+// Nearest 返回与 vector 最相似的 limit 条记录，skip 返回 true 的记录不参与排序。
+func (s *vectorStore) Nearest(vector []float32, limit int, skip func(vectorRecord) bool) []scoredVectorRecord {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	scored := make([]scoredVectorRecord, 0, len(s.snapshot.Records))
+	for _, record := range s.snapshot.Records {
+		if skip != nil && skip(record) {
+			continue
+		}
+		scored = append(scored, scoredVectorRecord{
+			vectorRecord: record,
+			Similarity:   cosineSimilarity(vector, record.Vector),
+		})
+	}
+	sort.Slice(scored, func(i, j int) bool {
+		if scored[i].Similarity != scored[j].Similarity {
+			return scored[i].Similarity > scored[j].Similarity
+		}
+		return scored[i].Document.ID < scored[j].Document.ID
+	})
+	if limit > 0 && len(scored) > limit {
+		scored = scored[:limit]
+	}
+	return scored
+}